@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AlertSilence keeps the alerts of matching rules from being notified until
+// it expires. The alerts still fire and show in the alerts API.
+type AlertSilence struct {
+	ID uint `json:"id"`
+	// Rule is a glob (path.Match syntax) on alert rule names.
+	Rule      string    `json:"rule"`
+	Until     time.Time `json:"until"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AlertSilences holds the silences in effect, persisted so they survive
+// restarts.
+type AlertSilences struct {
+	db *gorm.DB
+
+	mu     sync.Mutex
+	active []AlertSilence
+}
+
+// NewAlertSilences creates the store, loading the silences that haven't
+// expired yet from the database.
+func NewAlertSilences(db *gorm.DB) (*AlertSilences, error) {
+	var rows []AlertSilenceModel
+	if err := db.Where("until > ?", time.Now().Unix()).Order("id").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load alert silences: %w", err)
+	}
+	s := &AlertSilences{db: db}
+	for _, row := range rows {
+		s.active = append(s.active, silenceFromModel(row))
+	}
+	return s, nil
+}
+
+func silenceFromModel(m AlertSilenceModel) AlertSilence {
+	return AlertSilence{
+		ID:        m.ID,
+		Rule:      m.Rule,
+		Until:     time.Unix(m.Until, 0),
+		CreatedBy: m.CreatedBy,
+		CreatedAt: time.Unix(m.CreatedAt, 0),
+	}
+}
+
+// Add silences the rules matching the glob until the given time, and drops
+// the silences that have expired.
+func (s *AlertSilences) Add(rule string, until time.Time, createdBy string, now time.Time) (AlertSilence, error) {
+	if _, err := path.Match(rule, ""); err != nil {
+		return AlertSilence{}, fmt.Errorf("invalid rule pattern %q: %v", rule, err)
+	}
+	row := AlertSilenceModel{Rule: rule, Until: until.Unix(), CreatedBy: createdBy, CreatedAt: now.Unix()}
+	if err := s.db.Create(&row).Error; err != nil {
+		return AlertSilence{}, fmt.Errorf("failed to store alert silence: %w", err)
+	}
+	if err := s.db.Where("until <= ?", now.Unix()).Delete(&AlertSilenceModel{}).Error; err != nil {
+		return AlertSilence{}, fmt.Errorf("failed to prune alert silences: %w", err)
+	}
+
+	silence := silenceFromModel(row)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = slices.DeleteFunc(s.active, func(a AlertSilence) bool { return !a.Until.After(now) })
+	s.active = append(s.active, silence)
+	return silence, nil
+}
+
+// Active returns the silences in effect at now, in the order they were added.
+func (s *AlertSilences) Active(now time.Time) []AlertSilence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := []AlertSilence{}
+	for _, silence := range s.active {
+		if silence.Until.After(now) {
+			active = append(active, silence)
+		}
+	}
+	return active
+}
+
+// Silenced reports whether a silence in effect at now matches the rule.
+func (s *AlertSilences) Silenced(rule string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.ContainsFunc(s.active, func(silence AlertSilence) bool {
+		ok, _ := path.Match(silence.Rule, rule)
+		return ok && silence.Until.After(now)
+	})
+}
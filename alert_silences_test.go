@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertSilences_Expiry(t *testing.T) {
+	setupTestDB(t)
+	s, err := NewAlertSilences(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if _, err := s.Add("co2_*", now.Add(time.Hour), "telegram:alice", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Silenced("co2_high", now.Add(59*time.Minute)) {
+		t.Error("co2_high not silenced before the silence ends")
+	}
+	if s.Silenced("gas", now) {
+		t.Error("gas silenced by co2_*")
+	}
+	if s.Silenced("co2_high", now.Add(time.Hour)) {
+		t.Error("co2_high still silenced when the silence ends")
+	}
+	if got := s.Active(now.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("active after expiry: %+v", got)
+	}
+}
+
+func TestAlertSilences_SurviveRestart(t *testing.T) {
+	setupTestDB(t)
+	s, err := NewAlertSilences(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	s.Add("gas", now.Add(-time.Minute), "telegram:alice", now.Add(-time.Hour))
+	if _, err := s.Add("door_*", now.Add(time.Hour), "telegram:bob", now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding prunes the expired silence from the database too.
+	var rows int64
+	gormDB.Model(&AlertSilenceModel{}).Count(&rows)
+	if rows != 1 {
+		t.Errorf("%d silences stored, want 1", rows)
+	}
+
+	restarted, err := NewAlertSilences(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := restarted.Active(now)
+	if len(active) != 1 || active[0].Rule != "door_*" || !active[0].Until.Equal(now.Add(time.Hour)) || active[0].CreatedBy != "telegram:bob" {
+		t.Fatalf("active after restart: %+v", active)
+	}
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// alertCheckInterval is how often alerts waiting on their for duration,
+	// and devices that stopped reporting, are looked at between updates.
+	alertCheckInterval = 15 * time.Second
+	// defaultAlertStaleAfter is alerts.stale_after when it isn't set.
+	defaultAlertStaleAfter = 15 * time.Minute
+	// defaultAlertStartupGrace is alerts.startup_grace when it isn't set.
+	defaultAlertStartupGrace = 5 * time.Minute
+)
+
+// Alert states. A resolved alert is only ever seen by sinks.
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// What a rule does about a device that stopped reporting.
+const (
+	alertStaleIgnore = "ignore"
+	alertStaleFire   = "fire"
+)
+
+// Rule kinds: a condition on the state, or the device going silent.
+const (
+	alertKindCondition = "condition"
+	alertKindStale     = "stale"
+)
+
+// alertSeverities are the valid severities, most severe first.
+var alertSeverities = []string{"critical", "warning", "info"}
+
+// AlertsConfig configures the alert rules evaluated on device updates.
+type AlertsConfig struct {
+	// StaleAfter is a Go duration: a device that hasn't reported for this
+	// long is stale. Default "15m".
+	StaleAfter string `yaml:"stale_after"`
+	// StaleAfterTypes overrides StaleAfter by device type, e.g.
+	// {battery: "24h"}. An entity's stale_after overrides both.
+	StaleAfterTypes map[string]string `yaml:"stale_after_types"`
+	// StartupGrace is a Go duration: devices that haven't reported since
+	// at2 started aren't stale before it passed. Default "5m".
+	StartupGrace string `yaml:"startup_grace"`
+	// Rules are evaluated independently for every device they match.
+	Rules []AlertRule `yaml:"rules"`
+}
+
+// AlertRule raises an alert for each device it matches whose state meets
+// the condition. A rule matches when every selector it sets matches.
+type AlertRule struct {
+	// Name identifies the rule; it must be unique.
+	Name string `yaml:"name"`
+	// Kind is "condition" (default) or "stale": a stale rule needs no
+	// condition and raises an alert for each device that went stale,
+	// resolving when it reports again. Without device and type it matches
+	// the room entities that set stale_after.
+	Kind string `yaml:"kind"`
+	// Device is a glob (path.Match syntax) on the device ID, e.g. "temperature/*".
+	Device string `yaml:"device"`
+	// Type matches the device type, e.g. "co2".
+	Type string `yaml:"type"`
+	// Condition compares the state with a value: "> 1200", "== false",
+	// "!= ON". Numbers allow >, >=, <, <=, == and !=; true/false and
+	// strings (compared ignoring case) only == and !=.
+	Condition string `yaml:"condition"`
+	// For is a Go duration the condition has to hold before the alert
+	// fires. Empty fires right away.
+	For string `yaml:"for"`
+	// Severity is info, warning (default) or critical.
+	Severity string `yaml:"severity"`
+	// Message is a text/template rendered with the Alert, e.g.
+	// "{{.DeviceID}} reads {{.Value}} ppm".
+	Message string `yaml:"message"`
+	// Stale is "ignore" (default): a stale device raises nothing and its
+	// firing alert stays until it reports again. "fire" makes a stale
+	// device meet the condition, to alert on devices going silent.
+	Stale string `yaml:"stale"`
+	// Escalation is optional; when nil a firing alert is notified once.
+	Escalation *AlertEscalation `yaml:"escalation"`
+}
+
+// validateAlertsConfig fails fast on alert rules that can't be evaluated.
+func validateAlertsConfig(cfg *Config, cfgPath string) error {
+	if _, err := compileAlertRules(cfg.Alerts, cfgPath); err != nil {
+		return err
+	}
+	if v := cfg.Alerts.StartupGrace; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return fmt.Errorf("alerts.startup_grace is not a valid duration (%q) in %s", v, cfgPath)
+		}
+	}
+	for typ, v := range cfg.Alerts.StaleAfterTypes {
+		if !slices.Contains(vdevTypes, VdevType(typ)) {
+			return fmt.Errorf("alerts.stale_after_types has unknown type %q in %s", typ, cfgPath)
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("alerts.stale_after_types.%s is not a valid duration (%q) in %s", typ, v, cfgPath)
+		}
+	}
+	for _, room := range cfg.Rooms {
+		for _, entity := range room.Entities {
+			if v := entity.StaleAfter; v != "" {
+				if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+					return fmt.Errorf("entity %q stale_after is not a valid duration (%q) in %s", entity.ID, v, cfgPath)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Alert is one rule raised for one device.
+type Alert struct {
+	// ID identifies the alert to POST /api/v1/alerts/:id/ack.
+	ID       string `json:"id"`
+	Rule     string `json:"rule"`
+	DeviceID string `json:"device_id"`
+	Severity string `json:"severity"`
+	State    string `json:"state"`
+	Message  string `json:"message"`
+	// Value is the device state last evaluated.
+	Value any `json:"value"`
+	// Stale is set when the device hadn't reported for alerts.stale_after.
+	Stale bool `json:"stale"`
+	// LastSeenAt is when the device last reported; zero if it never did.
+	LastSeenAt time.Time `json:"last_seen_at,omitzero"`
+	// Silenced is set while a silence keeps the alert from being notified.
+	Silenced bool `json:"silenced"`
+	// Since is when the condition started to hold.
+	Since      time.Time `json:"since"`
+	FiredAt    time.Time `json:"fired_at,omitzero"`
+	ResolvedAt time.Time `json:"resolved_at,omitzero"`
+	// Repeat counts the notifications repeated by the rule's escalation.
+	Repeat int `json:"repeat,omitempty"`
+	// AckedBy is who acknowledged the alert, which stops its repeats.
+	AckedBy string    `json:"acked_by,omitempty"`
+	AckedAt time.Time `json:"acked_at,omitzero"`
+
+	// notified is set once the sinks were told the alert fired; only then
+	// are they told it resolved.
+	notified bool
+	// nextRepeat is when the alert is notified again.
+	nextRepeat time.Time
+	// held and escalated are the escalation targets not reached yet and
+	// reached at Repeat.
+	held, escalated []string
+}
+
+// AlertSink is notified when alerts fire and resolve, e.g. to send
+// notifications. Sinks are called one at a time in the order of the events
+// and must not block for long.
+type AlertSink interface {
+	AlertFired(Alert)
+	AlertResolved(Alert)
+}
+
+// alertEvent is a transition to hand to the sinks.
+type alertEvent struct {
+	alert    Alert
+	resolved bool
+}
+
+// alertRule is an AlertRule ready for evaluation.
+type alertRule struct {
+	AlertRule
+	kind     string
+	cond     alertCondition
+	forDur   time.Duration
+	severity string
+	stale    string
+	message  *template.Template
+	// repeatEvery is zero without escalation.
+	repeatEvery time.Duration
+}
+
+type alertKey struct {
+	rule, device string
+}
+
+// AlertEngine evaluates the alert rules on every device update, and
+// periodically for the for durations and stale devices. Each rule and device
+// pair goes from pending (the condition holds) to firing (it held for the
+// rule's for duration) to resolved (it no longer holds).
+type AlertEngine struct {
+	vdev *VdevManager
+	log  *slog.Logger
+
+	mu         sync.Mutex
+	rules      []alertRule
+	staleAfter time.Duration
+	// typeStaleAfter and entityStaleAfter override staleAfter by device
+	// type and ID.
+	typeStaleAfter   map[VdevType]time.Duration
+	entityStaleAfter map[string]time.Duration
+	// Devices that haven't reported since startedAt aren't stale before
+	// startupGrace passed.
+	startedAt    time.Time
+	startupGrace time.Duration
+	alerts       map[alertKey]*Alert
+	sinks        []AlertSink
+	silences     *AlertSilences
+
+	// sinkMu keeps events in order across concurrent evaluations. It is
+	// taken while holding mu, never the other way around.
+	sinkMu sync.Mutex
+}
+
+// NewAlertEngine creates the engine for the alert rules of cfg.
+func NewAlertEngine(cfg *Config, vdev *VdevManager, logger *slog.Logger) *AlertEngine {
+	e := &AlertEngine{vdev: vdev, log: logger, startedAt: time.Now(), alerts: map[alertKey]*Alert{}}
+	e.loadConfig(cfg)
+	return e
+}
+
+// AddSink registers a sink for the alerts firing and resolving from now on.
+func (e *AlertEngine) AddSink(sink AlertSink) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sinks = append(e.sinks, sink)
+}
+
+// SetSilences makes the engine hold back the notifications of silenced
+// rules. An alert firing while silenced is notified when the silence ends.
+func (e *AlertEngine) SetSilences(s *AlertSilences) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.silences = s
+}
+
+// Start registers for device changes and config reloads, and periodically
+// evaluates every device.
+func (e *AlertEngine) Start() {
+	e.vdev.OnVirtualDeviceUpdated = append(e.vdev.OnVirtualDeviceUpdated, e.onDeviceUpdate)
+	e.vdev.OnVirtualDeviceRemoved = append(e.vdev.OnVirtualDeviceRemoved, e.onDeviceRemoved)
+	OnConfigReload(e.loadConfig)
+	go func() {
+		ticker := time.NewTicker(alertCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.check(time.Now())
+		}
+	}()
+}
+
+// loadConfig replaces the rules. Alerts of rules that are gone resolve;
+// those of rules still present keep their state.
+func (e *AlertEngine) loadConfig(cfg *Config) {
+	rules, err := compileAlertRules(cfg.Alerts, "config")
+	if err != nil {
+		// validateAlertsConfig keeps such configs from loading.
+		e.log.Error("invalid alert rules", "err", err)
+		return
+	}
+	staleAfter := defaultAlertStaleAfter
+	if d, err := time.ParseDuration(cfg.Alerts.StaleAfter); err == nil {
+		staleAfter = d
+	}
+	grace := defaultAlertStartupGrace
+	if d, err := time.ParseDuration(cfg.Alerts.StartupGrace); err == nil {
+		grace = d
+	}
+	typeStaleAfter := map[VdevType]time.Duration{}
+	for typ, v := range cfg.Alerts.StaleAfterTypes {
+		if d, err := time.ParseDuration(v); err == nil {
+			typeStaleAfter[VdevType(typ)] = d
+		}
+	}
+	entityStaleAfter := map[string]time.Duration{}
+	for _, room := range cfg.Rooms {
+		for _, entity := range room.Entities {
+			if d, err := time.ParseDuration(entity.StaleAfter); err == nil {
+				entityStaleAfter[entity.ID] = d
+			}
+		}
+	}
+
+	e.mu.Lock()
+	e.rules, e.staleAfter, e.startupGrace = rules, staleAfter, grace
+	e.typeStaleAfter, e.entityStaleAfter = typeStaleAfter, entityStaleAfter
+	var events []alertEvent
+	now := time.Now()
+	for key, a := range e.alerts {
+		if slices.ContainsFunc(rules, func(r alertRule) bool { return r.Name == key.rule }) {
+			continue
+		}
+		delete(e.alerts, key)
+		if a.notified {
+			a.State, a.ResolvedAt = alertResolved, now
+			events = append(events, alertEvent{alert: *a, resolved: true})
+		}
+	}
+	e.unlockAndDispatch(events)
+}
+
+func (e *AlertEngine) onDeviceUpdate(v *VirtualDevice) {
+	if v == nil {
+		return
+	}
+	e.evaluate([]*VirtualDevice{v}, time.Now())
+}
+
+// onDeviceRemoved drops the alerts of a removed device; those notified
+// resolve.
+func (e *AlertEngine) onDeviceRemoved(v *VirtualDevice) {
+	e.mu.Lock()
+	var events []alertEvent
+	now := time.Now()
+	for key, a := range e.alerts {
+		if key.device != v.ID {
+			continue
+		}
+		delete(e.alerts, key)
+		if a.notified {
+			a.State, a.ResolvedAt = alertResolved, now
+			events = append(events, alertEvent{alert: *a, resolved: true})
+		}
+	}
+	e.unlockAndDispatch(events)
+}
+
+// check evaluates every device, firing alerts whose for duration has passed
+// and noticing devices that went stale.
+func (e *AlertEngine) check(now time.Time) {
+	e.evaluate(e.vdev.Devices(), now)
+}
+
+// evaluate runs every rule on the given devices and hands the resulting
+// transitions to the sinks.
+func (e *AlertEngine) evaluate(devs []*VirtualDevice, now time.Time) {
+	e.mu.Lock()
+	var events []alertEvent
+	for i := range e.rules {
+		r := &e.rules[i]
+		for _, dev := range devs {
+			if !e.matches(r, dev) {
+				continue
+			}
+			if ev, ok := e.step(r, dev, now); ok {
+				events = append(events, ev)
+			}
+		}
+	}
+	e.unlockAndDispatch(events)
+}
+
+// step advances the alert of rule r for dev and reports a firing or
+// resolving transition. Called with e.mu held.
+func (e *AlertEngine) step(r *alertRule, dev *VirtualDevice, now time.Time) (alertEvent, bool) {
+	key := alertKey{rule: r.Name, device: dev.ID}
+	a := e.alerts[key]
+	stale := dev.LastUpdatedAt.IsZero() || now.Sub(dev.LastUpdatedAt) > e.deviceStaleAfter(dev)
+	// Devices restored from the database, or not seen yet, may simply not
+	// have reported since the start.
+	graced := stale && !dev.Fresh && now.Sub(e.startedAt) < e.startupGrace
+
+	var holds bool
+	switch {
+	case r.kind == alertKindStale && !graced:
+		holds = stale
+	case stale && (graced || r.stale == alertStaleIgnore):
+		// Nothing is known about the device any more: don't start or fire
+		// an alert on old data, but don't resolve one either.
+		if a != nil && a.State == alertPending {
+			delete(e.alerts, key)
+		} else if a != nil {
+			a.Stale = true
+		}
+		return alertEvent{}, false
+	case stale:
+		holds = true
+	default:
+		holds = r.cond.matches(dev.State)
+	}
+
+	if !holds {
+		if a == nil {
+			return alertEvent{}, false
+		}
+		delete(e.alerts, key)
+		if !a.notified {
+			return alertEvent{}, false
+		}
+		a.State, a.ResolvedAt = alertResolved, now
+		a.Value, a.Stale, a.LastSeenAt = dev.State, false, dev.LastUpdatedAt
+		a.Message = r.render(a, now, e.log)
+		return alertEvent{alert: *a, resolved: true}, true
+	}
+
+	if a == nil {
+		a = &Alert{ID: newAlertID(), Rule: r.Name, DeviceID: dev.ID, Severity: r.severity, State: alertPending, Since: now}
+		e.alerts[key] = a
+	}
+	a.Value, a.Stale, a.LastSeenAt = dev.State, stale, dev.LastUpdatedAt
+	a.Message = r.render(a, now, e.log)
+	if a.State == alertPending && now.Sub(a.Since) >= r.forDur {
+		a.State, a.FiredAt = alertFiring, now
+	}
+	if a.State != alertFiring || a.AckedBy != "" || e.silenced(r.Name, now) {
+		return alertEvent{}, false
+	}
+	switch {
+	case !a.notified:
+		a.notified = true
+	case r.repeatEvery > 0 && !now.Before(a.nextRepeat):
+		a.Repeat++
+	default:
+		return alertEvent{}, false
+	}
+	a.nextRepeat = now.Add(r.repeatEvery)
+	a.held, a.escalated = r.escalationTargets(a.Repeat)
+	return alertEvent{alert: *a}, true
+}
+
+// deviceStaleAfter is how long dev may go without reporting: its entity's
+// stale_after, else its type's, else alerts.stale_after. Called with e.mu
+// held.
+func (e *AlertEngine) deviceStaleAfter(dev *VirtualDevice) time.Duration {
+	if d, ok := e.entityStaleAfter[dev.ID]; ok {
+		return d
+	}
+	if d, ok := e.typeStaleAfter[dev.Type]; ok {
+		return d
+	}
+	return e.staleAfter
+}
+
+// silenced reports whether the rule's notifications are held back. Called
+// with e.mu held.
+func (e *AlertEngine) silenced(rule string, now time.Time) bool {
+	return e.silences != nil && e.silences.Silenced(rule, now)
+}
+
+// unlockAndDispatch releases e.mu and hands events to the sinks. The sinks
+// are called without e.mu but before a later evaluation can dispatch, so
+// they see the transitions in order.
+func (e *AlertEngine) unlockAndDispatch(events []alertEvent) {
+	if len(events) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	sinks := slices.Clone(e.sinks)
+	e.sinkMu.Lock()
+	defer e.sinkMu.Unlock()
+	e.mu.Unlock()
+	for _, ev := range events {
+		if ev.resolved {
+			e.log.Info("alert resolved", "rule", ev.alert.Rule, "device", ev.alert.DeviceID)
+		} else {
+			e.log.Warn("alert firing", "rule", ev.alert.Rule, "device", ev.alert.DeviceID, "severity", ev.alert.Severity, "message", ev.alert.Message)
+		}
+		for _, sink := range sinks {
+			if ev.resolved {
+				sink.AlertResolved(ev.alert)
+			} else {
+				sink.AlertFired(ev.alert)
+			}
+		}
+	}
+}
+
+// Active returns the pending and firing alerts, most severe and then
+// oldest first.
+func (e *AlertEngine) Active() []Alert {
+	e.mu.Lock()
+	now := time.Now()
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alert := *a
+		alert.Silenced = e.silenced(a.Rule, now)
+		alerts = append(alerts, alert)
+	}
+	e.mu.Unlock()
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(alertSeverities, a.Severity), slices.Index(alertSeverities, b.Severity)),
+			a.Since.Compare(b.Since),
+			strings.Compare(a.Rule, b.Rule),
+			strings.Compare(a.DeviceID, b.DeviceID),
+		)
+	})
+	return alerts
+}
+
+// matches reports whether the rule applies to dev. A stale rule without
+// selectors applies to the entities that set stale_after. Called with e.mu
+// held.
+func (e *AlertEngine) matches(r *alertRule, dev *VirtualDevice) bool {
+	if r.kind == alertKindStale && r.Device == "" && r.Type == "" {
+		_, monitored := e.entityStaleAfter[dev.ID]
+		return monitored
+	}
+	if r.Device != "" {
+		if ok, _ := path.Match(r.Device, dev.ID); !ok {
+			return false
+		}
+	}
+	return r.Type == "" || VdevType(r.Type) == dev.Type
+}
+
+// render returns the alert's message, or a default one when the rule has no
+// message template.
+func (r *alertRule) render(a *Alert, now time.Time, log *slog.Logger) string {
+	if r.message == nil {
+		return r.defaultMessage(a, now)
+	}
+	var b strings.Builder
+	if err := r.message.Execute(&b, a); err != nil {
+		log.Warn("rendering alert message failed", "rule", r.Name, "err", err)
+		return r.defaultMessage(a, now)
+	}
+	return b.String()
+}
+
+// defaultMessage states the condition, or for stale rules how long the
+// device has been silent.
+func (r *alertRule) defaultMessage(a *Alert, now time.Time) string {
+	switch {
+	case r.kind != alertKindStale:
+		return fmt.Sprintf("%s %s", a.DeviceID, r.Condition)
+	case a.State == alertResolved:
+		return fmt.Sprintf("%s reports again", a.DeviceID)
+	case a.LastSeenAt.IsZero():
+		return fmt.Sprintf("%s has never reported", a.DeviceID)
+	}
+	return fmt.Sprintf("%s last reported %s ago", a.DeviceID, formatAlertAge(now.Sub(a.LastSeenAt)))
+}
+
+// formatAlertAge rounds d to minutes, or seconds below a minute, and drops
+// the zero units: "2h15m", "45s".
+func formatAlertAge(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	s := strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func compileAlertRules(cfg AlertsConfig, cfgPath string) ([]alertRule, error) {
+	if v := cfg.StaleAfter; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return nil, fmt.Errorf("alerts.stale_after is not a valid duration (%q) in %s", v, cfgPath)
+		}
+	}
+	rules := make([]alertRule, 0, len(cfg.Rules))
+	seen := map[string]struct{}{}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("alerts.rules[%d] needs a name in %s", i, cfgPath)
+		}
+		if _, dup := seen[rule.Name]; dup {
+			return nil, fmt.Errorf("duplicate alert rule name %q in %s", rule.Name, cfgPath)
+		}
+		seen[rule.Name] = struct{}{}
+		if rule.Device == "" && rule.Type == "" && rule.Kind != alertKindStale {
+			return nil, fmt.Errorf("alert rule %q needs device or type in %s", rule.Name, cfgPath)
+		}
+		if _, err := path.Match(rule.Device, ""); err != nil {
+			return nil, fmt.Errorf("alert rule %q has invalid device pattern %q in %s: %v", rule.Name, rule.Device, cfgPath, err)
+		}
+		if rule.Type != "" && !slices.Contains(vdevTypes, VdevType(rule.Type)) {
+			return nil, fmt.Errorf("alert rule %q has unknown type %q in %s", rule.Name, rule.Type, cfgPath)
+		}
+		r := alertRule{AlertRule: rule, kind: cmp.Or(rule.Kind, alertKindCondition), severity: cmp.Or(rule.Severity, "warning"), stale: cmp.Or(rule.Stale, alertStaleIgnore)}
+		var err error
+		switch r.kind {
+		case alertKindCondition:
+			if r.cond, err = parseAlertCondition(rule.Condition); err != nil {
+				return nil, fmt.Errorf("alert rule %q has invalid condition in %s: %v", rule.Name, cfgPath, err)
+			}
+		case alertKindStale:
+			if rule.Condition != "" || rule.Stale != "" {
+				return nil, fmt.Errorf("alert rule %q of kind stale takes no condition or stale in %s", rule.Name, cfgPath)
+			}
+		default:
+			return nil, fmt.Errorf("alert rule %q kind must be condition or stale (got %q) in %s", rule.Name, rule.Kind, cfgPath)
+		}
+		if rule.For != "" {
+			if r.forDur, err = time.ParseDuration(rule.For); err != nil || r.forDur < 0 {
+				return nil, fmt.Errorf("alert rule %q has invalid for duration (%q) in %s", rule.Name, rule.For, cfgPath)
+			}
+		}
+		if !slices.Contains(alertSeverities, r.severity) {
+			return nil, fmt.Errorf("alert rule %q severity must be info, warning or critical (got %q) in %s", rule.Name, rule.Severity, cfgPath)
+		}
+		if r.stale != alertStaleIgnore && r.stale != alertStaleFire {
+			return nil, fmt.Errorf("alert rule %q stale must be ignore or fire (got %q) in %s", rule.Name, rule.Stale, cfgPath)
+		}
+		if rule.Message != "" {
+			if r.message, err = template.New(rule.Name).Parse(rule.Message); err != nil {
+				return nil, fmt.Errorf("alert rule %q has invalid message template in %s: %v", rule.Name, cfgPath, err)
+			}
+		}
+		if r.repeatEvery, err = compileAlertEscalation(rule, cfgPath); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// alertCondition compares a device state with a float64, bool or string.
+type alertCondition struct {
+	op    string
+	value any
+}
+
+// parseAlertCondition parses "<op> <value>". Longer operators are tried
+// first so ">=" isn't read as ">" and "=...".
+func parseAlertCondition(s string) (alertCondition, error) {
+	s = strings.TrimSpace(s)
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		raw, ok := strings.CutPrefix(s, op)
+		if !ok {
+			continue
+		}
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			return alertCondition{}, fmt.Errorf("%q has no value", s)
+		}
+		c := alertCondition{op: op}
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			c.value = f
+			return c, nil
+		}
+		if op != "==" && op != "!=" {
+			return alertCondition{}, fmt.Errorf("%q compares a non-number with %s", s, op)
+		}
+		switch strings.ToLower(raw) {
+		case "true":
+			c.value = true
+		case "false":
+			c.value = false
+		default:
+			c.value = strings.Trim(raw, `"'`)
+		}
+		return c, nil
+	}
+	return alertCondition{}, fmt.Errorf("%q needs one of >, >=, <, <=, ==, != and a value", s)
+}
+
+// matches reports whether state meets the condition. A state of another
+// kind than the value (e.g. nil before the first report) never does.
+func (c alertCondition) matches(state any) bool {
+	switch want := c.value.(type) {
+	case float64:
+		if _, isBool := state.(bool); isBool {
+			return false
+		}
+		got, ok := toFloat64Internal(state)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		case "==":
+			return got == want
+		case "!=":
+			return got != want
+		}
+	case bool:
+		got, ok := state.(bool)
+		return ok && (got == want) == (c.op == "==")
+	case string:
+		got, ok := state.(string)
+		return ok && strings.EqualFold(got, want) == (c.op == "==")
+	}
+	return false
+}
+
+// liveAlertSink sends alert transitions to the version 2 live feed clients.
+type liveAlertSink struct{}
+
+func (liveAlertSink) AlertFired(a Alert)    { broadcastLiveAlert(a) }
+func (liveAlertSink) AlertResolved(a Alert) { broadcastLiveAlert(a) }
+
+func broadcastLiveAlert(a Alert) {
+	msg := liveMessage{Type: liveMsgAlert, Payload: a}
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	for _, sub := range liveSubscribers {
+		sub.queue(msg)
+	}
+}
+
+// handleListAlerts returns the pending and firing alerts and the silences in
+// effect.
+func handleListAlerts(c *fiber.Ctx) error {
+	alerts, silences := []Alert{}, []AlertSilence{}
+	if alertEngine != nil {
+		alerts = alertEngine.Active()
+	}
+	if alertSilences != nil {
+		silences = alertSilences.Active(time.Now())
+	}
+	return c.JSON(fiber.Map{"alerts": alerts, "silences": silences})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// escalationTargetMatrix and escalationTargetTelegram name the Matrix room and
+// the Telegram chat in escalation tiers; other names are webhooks.
+const (
+	escalationTargetMatrix   = "matrix"
+	escalationTargetTelegram = "telegram"
+)
+
+var errAlertNotFound = errors.New("alert not found")
+
+// AlertEscalation notifies a firing alert again until it resolves or is
+// acknowledged, reaching more targets the longer it goes on.
+type AlertEscalation struct {
+	// RepeatEvery is a Go duration: a firing alert is notified again this
+	// often until it resolves or is acknowledged.
+	RepeatEvery string `yaml:"repeat_every"`
+	// Tiers add targets after some repeats. Until its tier is reached a
+	// target doesn't get the rule's alerts; from then on it gets them
+	// whatever its severities and rules.
+	Tiers []EscalationTier `yaml:"tiers"`
+}
+
+// EscalationTier is a set of targets joining after some repeats.
+type EscalationTier struct {
+	// AfterRepeats is the repeat from which the targets are notified; at
+	// least 1, and increasing from tier to tier.
+	AfterRepeats int `yaml:"after_repeats"`
+	// Targets are webhook names, "matrix" and "telegram".
+	Targets []string `yaml:"targets"`
+}
+
+// compileAlertEscalation checks a rule's escalation and returns its repeat
+// interval, zero without escalation.
+func compileAlertEscalation(rule AlertRule, cfgPath string) (time.Duration, error) {
+	esc := rule.Escalation
+	if esc == nil {
+		return 0, nil
+	}
+	every, err := time.ParseDuration(esc.RepeatEvery)
+	if err != nil || every <= 0 {
+		return 0, fmt.Errorf("alert rule %q escalation needs a valid repeat_every duration (got %q) in %s", rule.Name, esc.RepeatEvery, cfgPath)
+	}
+	last := 0
+	for i, tier := range esc.Tiers {
+		if tier.AfterRepeats <= last {
+			return 0, fmt.Errorf("alert rule %q escalation tier %d needs after_repeats above %d in %s", rule.Name, i, last, cfgPath)
+		}
+		if len(tier.Targets) == 0 {
+			return 0, fmt.Errorf("alert rule %q escalation tier %d has no targets in %s", rule.Name, i, cfgPath)
+		}
+		last = tier.AfterRepeats
+	}
+	return every, nil
+}
+
+// validateAlertEscalationTargets checks that escalation tiers name configured
+// notification targets.
+func validateAlertEscalationTargets(cfg *Config, cfgPath string) error {
+	n := cfg.Notifications
+	for _, rule := range cfg.Alerts.Rules {
+		if rule.Escalation == nil {
+			continue
+		}
+		for _, tier := range rule.Escalation.Tiers {
+			for _, target := range tier.Targets {
+				switch {
+				case target == escalationTargetMatrix && n.Matrix != nil:
+				case target == escalationTargetTelegram && n.Telegram != nil:
+				case slices.ContainsFunc(n.Webhooks, func(w WebhookConfig) bool { return w.Name == target }):
+				default:
+					return fmt.Errorf("alert rule %q escalates to unknown target %q in %s", rule.Name, target, cfgPath)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// escalationTargets splits the targets of the rule's tiers into those not
+// reached yet at the given repeat and those reached.
+func (r *alertRule) escalationTargets(repeat int) (held, reached []string) {
+	if r.Escalation == nil {
+		return nil, nil
+	}
+	for _, tier := range r.Escalation.Tiers {
+		if repeat >= tier.AfterRepeats {
+			reached = append(reached, tier.Targets...)
+		}
+	}
+	for _, tier := range r.Escalation.Tiers {
+		for _, target := range tier.Targets {
+			if !slices.Contains(reached, target) {
+				held = append(held, target)
+			}
+		}
+	}
+	return held, reached
+}
+
+// routedTo reports whether the alert goes to the named target: escalation
+// targets get it once their tier is reached, other targets by their
+// severities and rules.
+func (a Alert) routedTo(target string, severities, rules []string) bool {
+	switch {
+	case slices.Contains(a.escalated, target):
+		return true
+	case slices.Contains(a.held, target):
+		return false
+	}
+	return alertRouted(severities, rules, a)
+}
+
+// stateLabel is the alert's state for messages, with the repeat count of
+// repeated notifications.
+func (a Alert) stateLabel() string {
+	if a.State == alertFiring && a.Repeat > 0 {
+		return fmt.Sprintf("%s (repeat %d)", a.State, a.Repeat)
+	}
+	return a.State
+}
+
+// newAlertID returns a random ID for an alert.
+func newAlertID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Ack records who acknowledged the firing alert with the given ID, which
+// stops its repeats. It is still notified when it resolves; acknowledged
+// while silenced, it isn't notified at all.
+func (e *AlertEngine) Ack(id, by string, now time.Time) (Alert, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, a := range e.alerts {
+		if a.ID != id || a.State != alertFiring {
+			continue
+		}
+		if a.AckedBy == "" {
+			a.AckedBy, a.AckedAt = by, now
+			e.log.Info("alert acknowledged", "rule", a.Rule, "device", a.DeviceID, "by", by)
+		}
+		alert := *a
+		alert.Silenced = e.silenced(a.Rule, now)
+		return alert, nil
+	}
+	return Alert{}, errAlertNotFound
+}
+
+// handleAckAlert acknowledges a firing alert as the logged in user.
+func handleAckAlert(c *fiber.Ctx) error {
+	username, _ := c.Locals("username").(string)
+	if alertEngine == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": errAlertNotFound.Error()})
+	}
+	a, err := alertEngine.Ack(c.Params("id"), username, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(a)
+}
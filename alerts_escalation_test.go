@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// escalatingRule repeats every 10 minutes, adding Telegram after two repeats
+// and the on-call webhook after four.
+var escalatingRule = AlertRule{Name: "gas", Type: "gas", Condition: "== true", Severity: "critical", Escalation: &AlertEscalation{
+	RepeatEvery: "10m",
+	Tiers: []EscalationTier{
+		{AfterRepeats: 2, Targets: []string{"telegram"}},
+		{AfterRepeats: 4, Targets: []string{"oncall"}},
+	},
+}}
+
+func TestAlertEngine_RepeatsWhileFiring(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{escalatingRule}})
+	t0 := time.Now()
+	at := func(d time.Duration, state bool) {
+		e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, state, t0.Add(d))}, t0.Add(d))
+	}
+
+	at(0, true)
+	expectEvents(t, sink, "fired", "fired:gas/kitchen/gas")
+	at(9*time.Minute, true)
+	expectEvents(t, sink, "before repeat_every")
+	at(10*time.Minute, true)
+	expectEvents(t, sink, "first repeat", "fired:gas/kitchen/gas")
+	at(15*time.Minute, true)
+	expectEvents(t, sink, "next repeat not due")
+	// A late check repeats once, counting the interval from then.
+	at(27*time.Minute, true)
+	at(30*time.Minute, true)
+	expectEvents(t, sink, "second repeat", "fired:gas/kitchen/gas")
+	at(37*time.Minute, true)
+	expectEvents(t, sink, "third repeat", "fired:gas/kitchen/gas")
+	for i, want := range []int{0, 1, 2, 3} {
+		if got := sink.alerts[i].Repeat; got != want {
+			t.Errorf("notification %d: repeat %d, want %d", i, got, want)
+		}
+	}
+
+	at(40*time.Minute, false)
+	expectEvents(t, sink, "resolved", "resolved:gas/kitchen/gas")
+	at(50*time.Minute, false)
+	at(60*time.Minute, false)
+	expectEvents(t, sink, "no repeats once resolved")
+}
+
+func TestAlertEngine_WithoutEscalationNotifiesOnce(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{{Name: "gas", Type: "gas", Condition: "== true"}}})
+	t0 := time.Now()
+	for _, d := range []time.Duration{0, time.Hour, 24 * time.Hour} {
+		e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, true, t0.Add(d))}, t0.Add(d))
+	}
+	expectEvents(t, sink, "firing a day", "fired:gas/kitchen/gas")
+}
+
+func TestAlertEngine_EscalationTiers(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{escalatingRule}})
+	t0 := time.Now()
+	for i := range 6 {
+		now := t0.Add(time.Duration(i) * 10 * time.Minute)
+		e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, true, now)}, now)
+	}
+	now := t0.Add(55 * time.Minute)
+	e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, false, now)}, now)
+
+	// Matrix routes by its own rules; telegram and oncall join at their tiers.
+	type routes struct{ matrix, telegram, oncall bool }
+	want := []routes{
+		{true, false, false},
+		{true, false, false},
+		{true, true, false},
+		{true, true, false},
+		{true, true, true},
+		{true, true, true},
+		// The resolve reaches every target that was escalated to.
+		{true, true, true},
+	}
+	if len(sink.alerts) != len(want) {
+		t.Fatalf("%d notifications, want %d", len(sink.alerts), len(want))
+	}
+	for i, a := range sink.alerts {
+		got := routes{
+			matrix:   a.routedTo(escalationTargetMatrix, nil, nil),
+			telegram: a.routedTo(escalationTargetTelegram, nil, nil),
+			// Tiers override the webhook's own routing.
+			oncall: a.routedTo("oncall", []string{"info"}, nil),
+		}
+		if got != want[i] {
+			t.Errorf("notification %d (%s, repeat %d): routes %+v, want %+v", i, a.State, a.Repeat, got, want[i])
+		}
+	}
+}
+
+func TestAlertEngine_Ack(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		escalatingRule,
+		{Name: "co2_high", Type: "co2", Condition: "> 1200", For: "5m"},
+	}})
+	t0 := time.Now()
+	gas := func(d time.Duration, state bool) {
+		e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, state, t0.Add(d))}, t0.Add(d))
+	}
+
+	gas(0, true)
+	gas(10*time.Minute, true)
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 1500.0, t0)}, t0)
+	expectEvents(t, sink, "firing", "fired:gas/kitchen/gas", "fired:gas/kitchen/gas")
+
+	if _, err := e.Ack("nope", "alice", t0); err != errAlertNotFound {
+		t.Fatalf("unknown id: %v", err)
+	}
+	if _, err := e.Ack(e.Active()[1].ID, "alice", t0); err != errAlertNotFound {
+		t.Fatalf("pending alert: %v", err)
+	}
+	id := e.Active()[0].ID
+	a, err := e.Ack(id, "alice", t0.Add(12*time.Minute))
+	if err != nil || a.AckedBy != "alice" || !a.AckedAt.Equal(t0.Add(12*time.Minute)) {
+		t.Fatalf("ack: %+v, %v", a, err)
+	}
+	// Acknowledging again keeps who acknowledged first.
+	if a, _ := e.Ack(id, "bob", t0.Add(13*time.Minute)); a.AckedBy != "alice" {
+		t.Fatalf("acked again by %q", a.AckedBy)
+	}
+
+	gas(20*time.Minute, true)
+	gas(60*time.Minute, true)
+	expectEvents(t, sink, "no repeats once acknowledged")
+	gas(70*time.Minute, false)
+	expectEvents(t, sink, "resolved", "resolved:gas/kitchen/gas")
+	if got := sink.alerts[len(sink.alerts)-1]; got.AckedBy != "alice" || got.Repeat != 1 {
+		t.Errorf("resolved %+v", got)
+	}
+
+	// Firing again is a new alert, not acknowledged.
+	gas(80*time.Minute, true)
+	expectEvents(t, sink, "fires again", "fired:gas/kitchen/gas")
+	if a := e.Active()[0]; a.ID == id || a.AckedBy != "" {
+		t.Fatalf("new alert %+v", a)
+	}
+	if _, err := e.Ack(id, "alice", t0.Add(80*time.Minute)); err != errAlertNotFound {
+		t.Fatalf("old id: %v", err)
+	}
+}
+
+func TestHandleAckAlert(t *testing.T) {
+	app := fiber.New()
+	app.Post("/api/v1/alerts/:id/ack", func(c *fiber.Ctx) error {
+		c.Locals("username", "alice")
+		return c.Next()
+	}, handleAckAlert)
+	ack := func(id string) (int, map[string]any) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("POST", "/api/v1/alerts/"+id+"/ack", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	prev := alertEngine
+	t.Cleanup(func() { alertEngine = prev })
+	alertEngine = nil
+	if status, _ := ack("abc"); status != fiber.StatusNotFound {
+		t.Fatalf("without an engine: status %d", status)
+	}
+
+	alertEngine, _ = newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{escalatingRule}})
+	now := time.Now()
+	alertEngine.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, true, now)}, now)
+	id := alertEngine.Active()[0].ID
+
+	if status, body := ack("abc"); status != fiber.StatusNotFound || body["error"] != "alert not found" {
+		t.Fatalf("unknown alert: %d %v", status, body)
+	}
+	if status, body := ack(id); status != fiber.StatusOK || body["id"] != id || body["acked_by"] != "alice" {
+		t.Fatalf("ack: %d %v", status, body)
+	}
+	if got := alertEngine.Active()[0]; got.AckedBy != "alice" {
+		t.Fatalf("active %+v", got)
+	}
+}
+
+func TestAlertStateLabel(t *testing.T) {
+	for _, tc := range []struct {
+		alert Alert
+		want  string
+	}{
+		{Alert{State: alertFiring}, "firing"},
+		{Alert{State: alertFiring, Repeat: 3}, "firing (repeat 3)"},
+		{Alert{State: alertResolved, Repeat: 3}, "resolved"},
+	} {
+		if got := tc.alert.stateLabel(); got != tc.want {
+			t.Errorf("%+v: %q, want %q", tc.alert, got, tc.want)
+		}
+	}
+}
+
+func TestValidateAlertEscalation(t *testing.T) {
+	with := func(edit func(*AlertEscalation)) AlertRule {
+		r := escalatingRule
+		esc := *r.Escalation
+		esc.Tiers = slices.Clone(esc.Tiers)
+		edit(&esc)
+		r.Escalation = &esc
+		return r
+	}
+	notifications := NotificationsConfig{
+		Webhooks: []WebhookConfig{{Name: "oncall", URL: "https://ntfy.sh/oncall"}},
+		Telegram: &TelegramConfig{BotToken: "123:abc", ChatID: -1001},
+	}
+	for _, tc := range []struct {
+		name          string
+		rule          AlertRule
+		notifications NotificationsConfig
+		ok            bool
+	}{
+		{"valid", escalatingRule, notifications, true},
+		{"repeat only", with(func(esc *AlertEscalation) { esc.Tiers = nil }), NotificationsConfig{}, true},
+		{"repeat_every", with(func(esc *AlertEscalation) { esc.RepeatEvery = "" }), notifications, false},
+		{"negative repeat_every", with(func(esc *AlertEscalation) { esc.RepeatEvery = "-5m" }), notifications, false},
+		{"after_repeats", with(func(esc *AlertEscalation) { esc.Tiers[0].AfterRepeats = 0 }), notifications, false},
+		{"decreasing", with(func(esc *AlertEscalation) { esc.Tiers[1].AfterRepeats = 2 }), notifications, false},
+		{"no targets", with(func(esc *AlertEscalation) { esc.Tiers[1].Targets = nil }), notifications, false},
+		{"unknown webhook", escalatingRule, NotificationsConfig{Telegram: notifications.Telegram}, false},
+		{"no telegram", escalatingRule, NotificationsConfig{Webhooks: notifications.Webhooks}, false},
+	} {
+		cfg := &Config{Alerts: AlertsConfig{Rules: []AlertRule{tc.rule}}, Notifications: tc.notifications}
+		err := validateAlertsConfig(cfg, "at2.yaml")
+		if err == nil {
+			err = validateAlertEscalationTargets(cfg, "at2.yaml")
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordingSink collects the alert transitions as "fired:rule/device" and
+// "resolved:rule/device".
+type recordingSink struct {
+	events []string
+	alerts []Alert
+}
+
+func (s *recordingSink) AlertFired(a Alert) {
+	s.events = append(s.events, "fired:"+a.Rule+"/"+a.DeviceID)
+	s.alerts = append(s.alerts, a)
+}
+
+func (s *recordingSink) AlertResolved(a Alert) {
+	s.events = append(s.events, "resolved:"+a.Rule+"/"+a.DeviceID)
+	s.alerts = append(s.alerts, a)
+}
+
+// take returns the events recorded since the last call.
+func (s *recordingSink) take() []string {
+	events := s.events
+	s.events = nil
+	return events
+}
+
+func newTestAlertEngine(t *testing.T, alerts AlertsConfig) (*AlertEngine, *recordingSink) {
+	t.Helper()
+	if err := validateAlertsConfig(&Config{Alerts: alerts}, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	e := NewAlertEngine(&Config{Alerts: alerts}, NewVdevManager(), testLogger)
+	sink := &recordingSink{}
+	e.AddSink(sink)
+	return e, sink
+}
+
+// reading is a device that reported state at the given time.
+func reading(id string, typ VdevType, state any, at time.Time) *VirtualDevice {
+	return &VirtualDevice{ID: id, Type: typ, State: state, Fresh: true, LastUpdatedAt: at}
+}
+
+func expectEvents(t *testing.T, sink *recordingSink, step string, want ...string) {
+	t.Helper()
+	if got := sink.take(); !slices.Equal(got, want) {
+		t.Fatalf("%s: events %v, want %v", step, got, want)
+	}
+}
+
+func activeStates(e *AlertEngine) []string {
+	var states []string
+	for _, a := range e.Active() {
+		states = append(states, a.Rule+"/"+a.DeviceID+"="+a.State)
+	}
+	return states
+}
+
+func TestAlertEngine_FiresAfterDuration(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "co2_high", Type: "co2", Condition: "> 1200", For: "5m", Message: "{{.DeviceID}} at {{.Value}} ppm"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 1300.0, t0)}, t0)
+	expectEvents(t, sink, "condition starts to hold")
+	if got := activeStates(e); !slices.Equal(got, []string{"co2_high/lab/co2=pending"}) {
+		t.Fatalf("active %v", got)
+	}
+
+	// Still high, but not for long enough.
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 1400.0, t0.Add(4*time.Minute))}, t0.Add(4*time.Minute))
+	expectEvents(t, sink, "before the for duration")
+
+	// The periodic check fires it without a new report.
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 1400.0, t0.Add(4*time.Minute))}, t0.Add(5*time.Minute))
+	expectEvents(t, sink, "after the for duration", "fired:co2_high/lab/co2")
+	fired := sink.alerts[0]
+	if fired.State != alertFiring || fired.Severity != "warning" || fired.Message != "lab/co2 at 1400 ppm" ||
+		!fired.Since.Equal(t0) || !fired.FiredAt.Equal(t0.Add(5*time.Minute)) {
+		t.Fatalf("fired alert %+v", fired)
+	}
+
+	// Firing alerts don't fire again.
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 1500.0, t0.Add(6*time.Minute))}, t0.Add(6*time.Minute))
+	expectEvents(t, sink, "still high")
+
+	e.evaluate([]*VirtualDevice{reading("lab/co2", VdevTypeCO2, 800.0, t0.Add(7*time.Minute))}, t0.Add(7*time.Minute))
+	expectEvents(t, sink, "back to normal", "resolved:co2_high/lab/co2")
+	if resolved := sink.alerts[1]; resolved.State != alertResolved || !resolved.ResolvedAt.Equal(t0.Add(7*time.Minute)) || resolved.Value != 800.0 {
+		t.Fatalf("resolved alert %+v", resolved)
+	}
+	if got := e.Active(); len(got) != 0 {
+		t.Fatalf("active after resolving: %+v", got)
+	}
+}
+
+func TestAlertEngine_SustainedNoise(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "workshop_loud", Type: string(VdevTypeNoiseLevel), Condition: "> 70", For: "10m"},
+	}})
+	t0 := time.Date(2026, 10, 15, 23, 0, 0, 0, time.UTC)
+	loud := func(db float64, after time.Duration) {
+		at := t0.Add(after)
+		e.evaluate([]*VirtualDevice{reading("workshop/noise", VdevTypeNoiseLevel, db, at)}, at)
+	}
+
+	// A short quiet spell restarts the duration.
+	loud(78, 0)
+	loud(65, 6*time.Minute)
+	loud(75, 7*time.Minute)
+	loud(76, 16*time.Minute)
+	expectEvents(t, sink, "loud for 9 minutes")
+	loud(74, 17*time.Minute)
+	expectEvents(t, sink, "loud for 10 minutes", "fired:workshop_loud/workshop/noise")
+}
+
+func TestAlertEngine_RemovedDeviceResolves(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "co2_high", Type: "co2", Condition: "> 1200"},
+		{Name: "co2_rising", Type: "co2", Condition: "> 1000", For: "5m"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	e.evaluate([]*VirtualDevice{
+		reading("lab/co2", VdevTypeCO2, 1300.0, t0),
+		reading("hall/co2", VdevTypeCO2, 1300.0, t0),
+	}, t0)
+	expectEvents(t, sink, "both high", "fired:co2_high/lab/co2", "fired:co2_high/hall/co2")
+
+	// The firing alert resolves, the pending one goes silently.
+	e.onDeviceRemoved(&VirtualDevice{ID: "lab/co2", Type: VdevTypeCO2})
+	expectEvents(t, sink, "lab/co2 removed", "resolved:co2_high/lab/co2")
+	want := []string{"co2_high/hall/co2=firing", "co2_rising/hall/co2=pending"}
+	if got := activeStates(e); !slices.Equal(got, want) {
+		t.Fatalf("active %v, want %v", got, want)
+	}
+}
+
+func TestAlertEngine_PendingClearsSilently(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "door_open", Device: "front_door/contact", Condition: "== false", For: "15m"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	door := func(closed bool, at time.Time) []*VirtualDevice {
+		return []*VirtualDevice{reading("front_door/contact", VdevTypeContact, closed, at)}
+	}
+
+	e.evaluate(door(false, t0), t0)
+	e.evaluate(door(true, t0.Add(10*time.Minute)), t0.Add(10*time.Minute))
+	expectEvents(t, sink, "closed while pending")
+	if got := e.Active(); len(got) != 0 {
+		t.Fatalf("active after closing: %+v", got)
+	}
+
+	// Opening again starts a new period.
+	e.evaluate(door(false, t0.Add(12*time.Minute)), t0.Add(12*time.Minute))
+	e.evaluate(door(false, t0.Add(12*time.Minute)), t0.Add(20*time.Minute))
+	expectEvents(t, sink, "15m since the first opening")
+	e.evaluate(door(false, t0.Add(12*time.Minute)), t0.Add(27*time.Minute))
+	expectEvents(t, sink, "15m since the second opening", "fired:door_open/front_door/contact")
+}
+
+func TestAlertEngine_FiresImmediatelyWithoutDuration(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "gas", Type: "gas", Condition: "== true", Severity: "critical"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	e.evaluate([]*VirtualDevice{reading("kitchen/gas", VdevTypeGas, true, t0)}, t0)
+	expectEvents(t, sink, "gas detected", "fired:gas/kitchen/gas")
+	if got := activeStates(e); !slices.Equal(got, []string{"gas/kitchen/gas=firing"}) {
+		t.Fatalf("active %v", got)
+	}
+	if sink.alerts[0].Message != "kitchen/gas == true" {
+		t.Errorf("default message %q", sink.alerts[0].Message)
+	}
+}
+
+func TestAlertEngine_Selectors(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "hot", Device: "lab/*", Type: "temperature", Condition: ">= 30"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	e.evaluate([]*VirtualDevice{
+		reading("lab/temperature", VdevTypeTemperature, 31.0, t0),
+		reading("lab/humidity", VdevTypeHumidity, 80.0, t0),
+		reading("hall/temperature", VdevTypeTemperature, 35.0, t0),
+		// A state of another kind never matches.
+		reading("lab/probe", VdevTypeTemperature, "unavailable", t0),
+	}, t0)
+	expectEvents(t, sink, "evaluate", "fired:hot/lab/temperature")
+}
+
+func TestAlertEngine_StaleIgnore(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{StaleAfter: "10m", Rules: []AlertRule{
+		{Name: "hot", Type: "temperature", Condition: "> 30"},
+		{Name: "warm", Type: "temperature", Condition: "> 25", For: "30m"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	dev := reading("lab/temperature", VdevTypeTemperature, 35.0, t0)
+
+	e.evaluate([]*VirtualDevice{dev}, t0)
+	expectEvents(t, sink, "hot", "fired:hot/lab/temperature")
+
+	// The sensor goes silent: the firing alert stays, marked stale, and the
+	// pending one is dropped rather than fired on old data.
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(45*time.Minute))
+	expectEvents(t, sink, "stale")
+	active := e.Active()
+	if len(active) != 1 || active[0].Rule != "hot" || active[0].State != alertFiring || !active[0].Stale {
+		t.Fatalf("active while stale: %+v", active)
+	}
+
+	// Reporting again, cooled down, resolves it.
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 20.0, t0.Add(50*time.Minute))}, t0.Add(50*time.Minute))
+	expectEvents(t, sink, "reporting again", "resolved:hot/lab/temperature")
+
+	// A device that never reported is stale too.
+	e.evaluate([]*VirtualDevice{{ID: "hall/temperature", Type: VdevTypeTemperature, State: 40.0}}, t0)
+	expectEvents(t, sink, "never reported")
+}
+
+func TestAlertEngine_StaleFire(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "silent", Device: "*/temperature", Condition: "< -100", For: "5m", Stale: "fire", Message: "{{.DeviceID}} silent: {{.Stale}}"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	dev := reading("lab/temperature", VdevTypeTemperature, 21.0, t0)
+
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(14*time.Minute))
+	expectEvents(t, sink, "fresh")
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(16*time.Minute))
+	expectEvents(t, sink, "stale, pending")
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(21*time.Minute))
+	expectEvents(t, sink, "stale for 5m", "fired:silent/lab/temperature")
+	if a := sink.alerts[0]; !a.Stale || a.Message != "lab/temperature silent: true" {
+		t.Fatalf("fired alert %+v", a)
+	}
+
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 21.0, t0.Add(22*time.Minute))}, t0.Add(22*time.Minute))
+	expectEvents(t, sink, "reporting again", "resolved:silent/lab/temperature")
+}
+
+func TestAlertEngine_StaleRule(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{StaleAfterTypes: map[string]string{"temperature": "30m"}, Rules: []AlertRule{
+		{Name: "silent", Kind: "stale", Type: "temperature"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	dev := reading("lab/temperature", VdevTypeTemperature, 21.0, t0)
+
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(30*time.Minute))
+	expectEvents(t, sink, "within the TTL")
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(31*time.Minute))
+	expectEvents(t, sink, "past the TTL", "fired:silent/lab/temperature")
+	if a := sink.alerts[0]; a.Message != "lab/temperature last reported 31m ago" || !a.LastSeenAt.Equal(t0) {
+		t.Fatalf("fired alert %+v", a)
+	}
+	e.evaluate([]*VirtualDevice{dev}, t0.Add(2*time.Hour))
+	if a := e.Active(); len(a) != 1 || a[0].Message != "lab/temperature last reported 2h ago" {
+		t.Fatalf("active %+v", a)
+	}
+
+	t1 := t0.Add(2*time.Hour + 30*time.Second)
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 21.0, t1)}, t1)
+	expectEvents(t, sink, "reporting again", "resolved:silent/lab/temperature")
+	if a := sink.alerts[1]; a.Message != "lab/temperature reports again" {
+		t.Fatalf("resolved alert %+v", a)
+	}
+}
+
+func TestAlertEngine_StaleRuleMonitorsEntities(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{})
+	e.loadConfig(&Config{
+		Alerts: AlertsConfig{Rules: []AlertRule{{Name: "silent", Kind: "stale"}}},
+		Rooms:  []RoomConfig{{ID: "hall", Entities: []EntityConfig{{ID: "hall/co2", StaleAfter: "10m"}, {ID: "hall/temperature"}}}},
+	})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	// Only the entity with stale_after is monitored, after its own TTL.
+	e.evaluate([]*VirtualDevice{
+		reading("hall/co2", VdevTypeCO2, 800.0, t0),
+		reading("hall/temperature", VdevTypeTemperature, 21.0, t0),
+	}, t0.Add(time.Hour))
+	expectEvents(t, sink, "an hour later", "fired:silent/hall/co2")
+}
+
+func TestAlertEngine_StaleStartupGrace(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{StaleAfter: "30m", Rules: []AlertRule{
+		{Name: "silent", Kind: "stale", Type: "temperature"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	e.startedAt = t0
+	// Restored from the database and never heard from since the start.
+	restored := &VirtualDevice{ID: "lab/temperature", Type: VdevTypeTemperature, State: 21.0, LastUpdatedAt: t0.Add(-2 * time.Hour)}
+	unknown := &VirtualDevice{ID: "hall/temperature", Type: VdevTypeTemperature}
+	stale := reading("kitchen/temperature", VdevTypeTemperature, 21.0, t0.Add(-time.Hour))
+
+	e.evaluate([]*VirtualDevice{restored, unknown, stale}, t0.Add(time.Minute))
+	expectEvents(t, sink, "within the grace period", "fired:silent/kitchen/temperature")
+	if got := activeStates(e); len(got) != 1 {
+		t.Fatalf("active within the grace period %v", got)
+	}
+
+	e.evaluate([]*VirtualDevice{restored, unknown}, t0.Add(5*time.Minute))
+	expectEvents(t, sink, "after the grace period", "fired:silent/lab/temperature", "fired:silent/hall/temperature")
+	if got := sink.alerts[2].Message; got != "hall/temperature has never reported" {
+		t.Errorf("never reported: %q", got)
+	}
+}
+
+func TestAlertEngine_CheckUsesManagerDevices(t *testing.T) {
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "door_open", Type: "contact", Condition: "== false", For: "1m"},
+	}})
+	now := time.Now()
+	e.vdev.AddDevices([]*VirtualDevice{reading("front_door/contact", VdevTypeContact, false, now)})
+
+	e.check(now)
+	e.check(now.Add(time.Minute))
+	expectEvents(t, sink, "check", "fired:door_open/front_door/contact")
+}
+
+func TestAlertEngine_ReloadResolvesRemovedRules(t *testing.T) {
+	rules := []AlertRule{
+		{Name: "hot", Type: "temperature", Condition: "> 30"},
+		{Name: "cold", Type: "temperature", Condition: "< 10"},
+	}
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: rules})
+	now := time.Now()
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, now)}, now)
+	expectEvents(t, sink, "hot", "fired:hot/lab/temperature")
+
+	e.loadConfig(&Config{Alerts: AlertsConfig{Rules: rules[1:]}})
+	expectEvents(t, sink, "reload", "resolved:hot/lab/temperature")
+	if got := e.Active(); len(got) != 0 {
+		t.Fatalf("active after reload: %+v", got)
+	}
+}
+
+func TestAlertEngine_Silences(t *testing.T) {
+	setupTestDB(t)
+	silences, err := NewAlertSilences(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, sink := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "hot", Type: "temperature", Condition: "> 30"},
+	}})
+	e.SetSilences(silences)
+	t0 := time.Now()
+	if _, err := silences.Add("h*", t0.Add(time.Hour), "test", t0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Silenced alerts fire, but aren't notified, neither firing nor resolving.
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, t0)}, t0)
+	e.evaluate([]*VirtualDevice{reading("hall/temperature", VdevTypeTemperature, 35.0, t0)}, t0)
+	expectEvents(t, sink, "silenced")
+	if got := e.Active(); len(got) != 2 || got[0].State != alertFiring || !got[0].Silenced {
+		t.Fatalf("active while silenced: %+v", got)
+	}
+	t1 := t0.Add(30 * time.Minute)
+	e.evaluate([]*VirtualDevice{reading("hall/temperature", VdevTypeTemperature, 20.0, t1)}, t1)
+	expectEvents(t, sink, "resolved while silenced")
+
+	// Once the silence ends, the alert still firing is notified late.
+	t2 := t0.Add(time.Hour)
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, t2)}, t2)
+	expectEvents(t, sink, "silence ended", "fired:hot/lab/temperature")
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, t2)}, t2)
+	expectEvents(t, sink, "notified once")
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 20.0, t2)}, t2)
+	expectEvents(t, sink, "resolved", "resolved:hot/lab/temperature")
+}
+
+func TestAlertEngine_ActiveOrder(t *testing.T) {
+	e, _ := newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{
+		{Name: "warm", Type: "temperature", Condition: "> 25", Severity: "info"},
+		{Name: "hot", Type: "temperature", Condition: "> 30", Severity: "critical"},
+		{Name: "humid", Type: "humidity", Condition: "> 70", For: "1h"},
+	}})
+	t0 := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	e.evaluate([]*VirtualDevice{reading("lab/humidity", VdevTypeHumidity, 80.0, t0)}, t0)
+	e.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, t0)}, t0.Add(time.Minute))
+
+	want := []string{"hot/lab/temperature=firing", "humid/lab/humidity=pending", "warm/lab/temperature=firing"}
+	if got := activeStates(e); !slices.Equal(got, want) {
+		t.Fatalf("active %v, want %v", got, want)
+	}
+}
+
+func TestAlertCondition(t *testing.T) {
+	for _, tc := range []struct {
+		cond  string
+		state any
+		want  bool
+	}{
+		{"> 1200", 1300.0, true},
+		{">1200", 1200.0, false},
+		{">= 1200", 1200.0, true},
+		{"< 10", 9, true},
+		{"<= -5.5", -5.5, true},
+		{"== 0", 0.0, true},
+		{"!= 0", 0.0, false},
+		{"> 0", nil, false},
+		{"> 0", true, false},
+		{"== false", false, true},
+		{"== false", true, false},
+		{"!= true", false, true},
+		{"== false", "false", false},
+		{"== ON", "on", true},
+		{"!= ON", "OFF", true},
+		{`== "idle"`, "idle", true},
+		{"== ON", 1.0, false},
+	} {
+		c, err := parseAlertCondition(tc.cond)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.cond, err)
+		}
+		if got := c.matches(tc.state); got != tc.want {
+			t.Errorf("%q on %#v = %v, want %v", tc.cond, tc.state, got, tc.want)
+		}
+	}
+
+	for _, cond := range []string{"", "1200", "> ", "=> 5", "> high", "~= 3"} {
+		if _, err := parseAlertCondition(cond); err == nil {
+			t.Errorf("%q accepted", cond)
+		}
+	}
+}
+
+func TestValidateAlertsConfig(t *testing.T) {
+	ok := AlertRule{Name: "hot", Type: "temperature", Condition: "> 30"}
+	with := func(edit func(*AlertRule)) AlertRule {
+		r := ok
+		edit(&r)
+		return r
+	}
+	for _, tc := range []struct {
+		name   string
+		alerts AlertsConfig
+		ok     bool
+	}{
+		{"empty", AlertsConfig{}, true},
+		{"valid", AlertsConfig{StaleAfter: "1h", Rules: []AlertRule{ok, with(func(r *AlertRule) {
+			r.Name, r.Type, r.Device, r.For, r.Severity, r.Stale, r.Message = "door", "", "*/contact", "15m", "critical", "fire", "{{.DeviceID}}"
+		})}}, true},
+		{"stale_after", AlertsConfig{StaleAfter: "soon", Rules: []AlertRule{ok}}, false},
+		{"no name", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Name = "" })}}, false},
+		{"duplicate", AlertsConfig{Rules: []AlertRule{ok, ok}}, false},
+		{"no selector", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Type = "" })}}, false},
+		{"bad glob", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Device = "lab/[" })}}, false},
+		{"unknown type", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Type = "radiation" })}}, false},
+		{"condition", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Condition = "hot" })}}, false},
+		{"for", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.For = "-1m" })}}, false},
+		{"severity", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Severity = "fatal" })}}, false},
+		{"stale", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Stale = "resolve" })}}, false},
+		{"message", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Message = "{{.DeviceID" })}}, false},
+		{"stale kind", AlertsConfig{StaleAfterTypes: map[string]string{"battery": "24h"}, StartupGrace: "10m", Rules: []AlertRule{{Name: "silent", Kind: "stale"}}}, true},
+		{"kind", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Kind = "absent" })}}, false},
+		{"stale kind condition", AlertsConfig{Rules: []AlertRule{with(func(r *AlertRule) { r.Kind = "stale" })}}, false},
+		{"stale_after_types type", AlertsConfig{StaleAfterTypes: map[string]string{"radiation": "1h"}}, false},
+		{"stale_after_types duration", AlertsConfig{StaleAfterTypes: map[string]string{"battery": "1 day"}}, false},
+		{"startup_grace", AlertsConfig{StartupGrace: "-1m"}, false},
+	} {
+		err := validateAlertsConfig(&Config{Alerts: tc.alerts}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+
+	rooms := []RoomConfig{{ID: "lab", Entities: []EntityConfig{{ID: "lab/co2", StaleAfter: "often"}}}}
+	if err := validateAlertsConfig(&Config{Rooms: rooms}, "at2.yaml"); err == nil {
+		t.Error("entity stale_after: no error")
+	}
+}
+
+func TestHandleListAlerts(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/v1/alerts", handleListAlerts)
+	list := func() ([]Alert, []AlertSilence) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/alerts", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Alerts   []Alert        `json:"alerts"`
+			Silences []AlertSilence `json:"silences"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Alerts == nil || body.Silences == nil {
+			t.Fatalf("decoding alerts: %v (%+v)", err, body)
+		}
+		return body.Alerts, body.Silences
+	}
+
+	prev, prevSilences := alertEngine, alertSilences
+	t.Cleanup(func() { alertEngine, alertSilences = prev, prevSilences })
+	alertEngine, alertSilences = nil, nil
+	if got, silences := list(); len(got) != 0 || len(silences) != 0 {
+		t.Fatalf("without an engine: %+v %+v", got, silences)
+	}
+
+	alertEngine, _ = newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{{Name: "hot", Type: "temperature", Condition: "> 30"}}})
+	now := time.Now()
+	alertEngine.evaluate([]*VirtualDevice{reading("lab/temperature", VdevTypeTemperature, 35.0, now)}, now)
+	if got, _ := list(); len(got) != 1 || got[0].Rule != "hot" || got[0].State != alertFiring || got[0].Value != 35.0 || got[0].Silenced {
+		t.Fatalf("alerts %+v", got)
+	}
+
+	setupTestDB(t)
+	alertSilences, _ = NewAlertSilences(gormDB)
+	alertEngine.SetSilences(alertSilences)
+	if _, err := alertSilences.Add("hot", now.Add(time.Hour), "test", now); err != nil {
+		t.Fatal(err)
+	}
+	if got, silences := list(); !got[0].Silenced || len(silences) != 1 || silences[0].Rule != "hot" {
+		t.Fatalf("silenced: alerts %+v, silences %+v", got, silences)
+	}
+}
+
+func TestLiveAlertSink_QueuesForV2Subscribers(t *testing.T) {
+	v1 := &liveSubscriber{control: make(chan liveMessage, 1), version: liveWsProtocolV1}
+	v2 := &liveSubscriber{control: make(chan liveMessage, 1), version: liveWsProtocolV2}
+	liveSubscribersMutex.Lock()
+	prev := liveSubscribers
+	liveSubscribers = []*liveSubscriber{v1, v2}
+	liveSubscribersMutex.Unlock()
+	t.Cleanup(func() {
+		liveSubscribersMutex.Lock()
+		liveSubscribers = prev
+		liveSubscribersMutex.Unlock()
+	})
+
+	liveAlertSink{}.AlertFired(Alert{Rule: "hot", DeviceID: "lab/temperature", State: alertFiring})
+	msg := <-v2.control
+	env, ok := encodeLiveMessage(liveWsProtocolV2, msg, time.Now()).(liveEnvelope)
+	if !ok || env.Type != liveMsgAlert || env.Payload.(Alert).Rule != "hot" {
+		t.Fatalf("v2 message %+v", env)
+	}
+	// Version 1 has no alert message; its writer skips it.
+	if out := encodeLiveMessage(liveWsProtocolV1, <-v1.control, time.Now()); out != nil {
+		t.Fatalf("v1 message %+v", out)
+	}
+}
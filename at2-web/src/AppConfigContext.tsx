@@ -13,9 +13,11 @@ export interface BrandingConfig {
 }
 
 export interface VersionInfo {
-    git_repo_url: string;
+    version: string;
+    git_repo_url?: string;
     git_commit_hash: string;
     git_commit_date: string;
+    build_date: string;
 }
 
 export interface AppConfig {
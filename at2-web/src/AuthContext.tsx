@@ -5,6 +5,13 @@ import { API_URL } from "./config";
 interface User {
   username: string;
   membershipExpirationTimestamp?: number | null;
+  email?: string;
+  groups?: string[];
+  isTablet?: boolean;
+  canControl?: boolean;
+  // Unix time at which the session ends unless it is used again.
+  sessionExpiresAt?: number;
+  sessionExpiresIn?: number;
 }
 
 interface AuthContextType {
@@ -63,18 +70,17 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   }, []);
 
   const login = () => {
-    window.location.href = `${API_URL.replace(/\/$/, "")}/api/v1/auth/login`;
+    // Come back to the current page once the IdP redirects us back.
+    const redirect = encodeURIComponent(
+      window.location.pathname + window.location.search + window.location.hash,
+    );
+    window.location.href = `${API_URL.replace(/\/$/, "")}/api/v1/auth/login?redirect=${redirect}`;
   };
 
-  const logout = async () => {
-    try {
-      await fetch(`${API_URL.replace(/\/$/, "")}/api/v1/auth/logout`, {
-        method: "POST",
-      });
-      setUser(null);
-    } catch (error) {
-      console.error("Logout failed", error);
-    }
+  const logout = () => {
+    // Navigate instead of fetching so the backend can send us on to the
+    // IdP's logout page; otherwise the IdP session logs us straight back in.
+    window.location.href = `${API_URL.replace(/\/$/, "")}/api/v1/auth/logout`;
   };
 
   return (
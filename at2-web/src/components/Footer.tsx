@@ -11,8 +11,8 @@ const Footer: FC = () => {
 
     if (!branding) return null;
 
-    const shortHash = version?.git_commit_hash?.substring(0, 7) || "unknown";
-    const commitDate = version?.git_commit_date ? new Date(version.git_commit_date).toLocaleString() : "";
+    const shortHash = version?.git_commit_hash?.substring(0, 7) || "dev";
+    const commitDate = version?.git_commit_date && version.git_commit_date !== "dev" ? new Date(version.git_commit_date).toLocaleString() : "";
     const commitUrl = version?.git_repo_url && version?.git_commit_hash ? `${version.git_repo_url}/commit/${version.git_commit_hash}` : undefined;
 
     return (
@@ -56,9 +56,10 @@ const Footer: FC = () => {
                         </a>
                     </div>
                 </div>
-                {version && version.git_commit_hash !== "unknown" && (
+                {version && version.git_commit_hash !== "dev" && (
                     <div className="text-xs opacity-50">
                         {t("Version")}:{" "}
+                        {version.version !== "dev" && <>{version.version} · </>}
                         <a
                             href={commitUrl}
                             target="_blank"
@@ -1,5 +1,5 @@
 import { useState, type FC } from "react";
-import { Thermometer, Droplets, SwitchCamera, Plug, VideoOff, Bubbles } from "lucide-react";
+import { Thermometer, Droplets, SwitchCamera, Plug, VideoOff, Bubbles, Wind } from "lucide-react";
 import type { RoomState, CameraSnapshotEntity, CoEntity, GasEntity, ContactEntity, PrinterEntity } from "../schema";
 import { useLocale } from "../locale";
 import RelayGroupControl from "./RelayGroupControl";
@@ -121,6 +121,19 @@ export const RoomCard: FC<{ room: RoomState }> = ({ room }) => {
               ) : null
             )}
 
+            {room.entities.map((e) =>
+              e.type === "co2" && typeof e.state === "number" ? (
+                <NumericSensorBarItem
+                  key={e.id}
+                  icon={Wind}
+                  value={e.state}
+                  unit="ppm"
+                  precision={0}
+                  title={getName(e.localized_name, e.id)}
+                />
+              ) : null
+            )}
+
 
 
 
@@ -1,7 +1,7 @@
 import type { FC } from "react";
 import { useParams } from "react-router-dom";
 import { useTranslation } from "react-i18next";
-import { Thermometer, Droplets, Plug, Bubbles } from "lucide-react";
+import { Thermometer, Droplets, Plug, Bubbles, Wind } from "lucide-react";
 import { useLocale } from "../locale";
 import { useLiveRoomStates } from "../useLiveRoomStates";
 import type {
@@ -89,6 +89,19 @@ export const TabletRoomPage: FC = () => {
             ) : null,
           )}
 
+          {room.entities.map((e) =>
+            e.type === "co2" && typeof e.state === "number" ? (
+              <NumericSensorBarItem
+                key={e.id}
+                icon={Wind}
+                value={e.state}
+                unit="ppm"
+                precision={0}
+                title={getName(e.localized_name, e.id)}
+              />
+            ) : null,
+          )}
+
           {room.entities.map((e) =>
             e.type === "power_usage" && typeof e.state === "number" ? (
               <NumericSensorBarItem
@@ -12,6 +12,7 @@ export type EntityRepresentation =
   | "plug"
   | "power"
   | "co"
+  | "co2"
   | "gas"
   | "contact"
   | "printer";
@@ -108,6 +109,17 @@ export interface CoEntity {
   state: number;
 }
 
+/**
+ * CO2 sensor (ppm).
+ */
+export interface Co2Entity {
+  representation: "co2";
+  type: "co2";
+  id: string;
+  localized_name: LocalizedName | null;
+  state: number;
+}
+
 /**
  * Gas sensor (LEL).
  */
@@ -201,27 +213,42 @@ export interface UnknownEntity {
  * Union of all known entity variants.
  * UnknownEntity at end for forward compatibility.
  */
-export type Entity =
+// Optional display hints from the room config. Entities arrive sorted by
+// (group, order, id).
+export interface EntityDisplayHints {
+  icon?: string;
+  group?: string;
+  order?: number;
+}
+
+export type Entity = (
   | PresenceEntity
   | CameraSnapshotEntity
   | TemperatureEntity
   | HumidityEntity
   | PowerEntity
   | CoEntity
+  | Co2Entity
   | GasEntity
   | ContactEntity
   | RelayEntity
   | PrinterEntity
-  | UnknownEntity;
+  | UnknownEntity
+) & EntityDisplayHints;
 
 export interface RoomState {
   id: string;
+  // localized_name resolved for ?lang= / Accept-Language (HTTP only, not the websocket)
+  name?: string;
   localized_name: LocalizedName;
   exclude_from_entrance_tablet: boolean;
   people_count: number;
+  // a person sensor of the room has no fresh state (e.g. just restored after a restart)
+  data_stale: boolean;
   latest_person_detected_at: string | null;
   voip_phone_number?: string;
   entities: Entity[];
+  cameras: CameraSnapshotEntity[];
 }
 
 export type RoomStates = RoomState[];
@@ -235,6 +262,8 @@ export interface UsageHeatmapDataPoint {
 
 export interface UsageHeatmapResponse {
   dataPoints: UsageHeatmapDataPoint[];
+  // Unix ms; earlier than the request when precomputed in the background
+  computedAt: number;
 }
 
 
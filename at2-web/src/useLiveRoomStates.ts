@@ -3,6 +3,7 @@ import {
   createElement,
   useCallback,
   useContext,
+  useEffect,
   useRef,
   useState,
   type ReactNode,
@@ -88,15 +89,45 @@ export function LiveStateProvider({ children }: { children: ReactNode }) {
       return;
     }
 
+    const type = (parsed as { type?: string }).type;
+    if (type === "resync") {
+      const resynced = (parsed as { rooms?: RoomState[] }).rooms ?? [];
+      setRoomStates((prev) => {
+        const next = { ...prev };
+        for (const room of resynced) {
+          next[room.id] = room;
+        }
+        return next;
+      });
+      return;
+    }
+    if (type !== undefined) {
+      // Other control messages (e.g. errors) are not room states.
+      return;
+    }
+
     const nextRoom = parsed as RoomState;
     setRoomStates((prev) => ({ ...prev, [nextRoom.id]: nextRoom }));
   }, []);
 
-  useWebsocket(liveWebsocketUrl(), {
+  const { sendMessage } = useWebsocket(liveWebsocketUrl(), {
     binaryType: "arraybuffer",
     onMessage,
   });
 
+  // After the device wakes from sleep the socket may still be open but stale;
+  // ask for a fresh snapshot instead of reconnecting.
+  useEffect(() => {
+    const onVisibilityChange = () => {
+      if (document.visibilityState === "visible") {
+        sendMessage(JSON.stringify({ type: "resync" }));
+      }
+    };
+    document.addEventListener("visibilitychange", onVisibilityChange);
+    return () =>
+      document.removeEventListener("visibilitychange", onVisibilityChange);
+  }, [sendMessage]);
+
   const rooms = Object.values(roomStates);
 
   return createElement(
@@ -2,26 +2,45 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
+// authLog is the logger of authentication; main replaces it with the
+// configured one.
+var authLog = slog.Default()
+
 var (
 	oauth2Config *oauth2.Config
 	oidcProvider *oidc.Provider
+	// oidcEndSessionURL is the provider's RP-initiated logout endpoint, empty
+	// when the provider doesn't advertise one.
+	oidcEndSessionURL string
 )
 
 func initAuth() error {
-	oidcConfig := ConfigInstance.Oidc
+	oidcConfig := GetConfig().Oidc
 	if oidcConfig == nil {
-		log.Printf("OIDC not configured, authorization is not available")
+		if len(GetConfig().Web.LocalUsers) > 0 {
+			authLog.Info("OIDC not configured, only local users can log in")
+		} else {
+			authLog.Info("OIDC not configured, authorization is not available")
+		}
 		return nil
 	}
 
@@ -33,6 +52,14 @@ func initAuth() error {
 		return fmt.Errorf("failed to initialize OIDC provider: %w", err)
 	}
 
+	var metadata struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := oidcProvider.Claims(&metadata); err != nil {
+		return fmt.Errorf("failed to parse OIDC provider metadata: %w", err)
+	}
+	oidcEndSessionURL = metadata.EndSessionEndpoint
+
 	scopes := []string{oidc.ScopeOpenID, "profile", "email"}
 	if oidcConfig.ExtraScopes != nil {
 		scopes = append(scopes, oidcConfig.ExtraScopes...)
@@ -41,7 +68,7 @@ func initAuth() error {
 	oauth2Config = &oauth2.Config{
 		ClientID:     oidcConfig.ClientID,
 		ClientSecret: oidcConfig.ClientSecret,
-		RedirectURL:  ConfigInstance.Web.PublicURL + "/api/v1/auth/callback",
+		RedirectURL:  GetConfig().Web.PublicURL + "/api/v1/auth/callback",
 
 		// Discovery returns the OAuth2 endpoints.
 		Endpoint: oidcProvider.Endpoint(),
@@ -54,15 +81,118 @@ func initAuth() error {
 }
 
 const (
+	// CookieName is the default session cookie name (web.cookie.name).
 	CookieName = "session_id"
+	// oidcStateCookieName binds a pending login to the browser that started
+	// it, so a callback carrying someone else's state is rejected.
+	oidcStateCookieName = "oidc_state"
+)
+
+// oidcLoginTTL is how long a user may take on the IdP login page.
+const oidcLoginTTL = 10 * time.Minute
+
+// pendingLogin is what handleLoginRequest remembers about a login until the
+// IdP redirects back to handleAuthCallback.
+type pendingLogin struct {
+	nonce string
+	// verifier is the PKCE code verifier; the IdP only saw its S256 challenge.
+	verifier string
+	// redirectURI is the callback URL the IdP was told to return to, which
+	// the code exchange has to repeat.
+	redirectURI string
+	redirect    string
+	expires     time.Time
+}
+
+var (
+	pendingLoginsMutex sync.Mutex
+	pendingLogins      = map[string]pendingLogin{}
 )
 
+// randomToken returns a URL-safe string of 32 random bytes.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// storePendingLogin remembers a login under its state and drops the ones
+// that were abandoned.
+func storePendingLogin(state string, login pendingLogin) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	now := time.Now()
+	for s, l := range pendingLogins {
+		if now.After(l.expires) {
+			delete(pendingLogins, s)
+		}
+	}
+	pendingLogins[state] = login
+}
+
+// takePendingLogin returns and forgets the login started with the given
+// state. Each state can be used once.
+func takePendingLogin(state string) (pendingLogin, bool) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	login, ok := pendingLogins[state]
+	delete(pendingLogins, state)
+	if !ok || time.Now().After(login.expires) {
+		return pendingLogin{}, false
+	}
+	return login, true
+}
+
+// safeRedirect returns target if it is a path on this site, "/" otherwise,
+// so the login flow can't be used as an open redirect.
+func safeRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
 func handleLoginRequest(c *fiber.Ctx) error {
 	if oauth2Config == nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "OIDC not configured"})
 	}
 
-	authCodeURL := oauth2Config.AuthCodeURL("state", oauth2.AccessTypeOffline)
+	state, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate state"})
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate nonce"})
+	}
+	// PKCE is always on; providers that don't require it ignore it.
+	verifier := oauth2.GenerateVerifier()
+	expires := time.Now().Add(oidcLoginTTL)
+	redirectURI := requestBaseURL(c) + "/api/v1/auth/callback"
+	storePendingLogin(state, pendingLogin{
+		nonce:       nonce,
+		verifier:    verifier,
+		redirectURI: redirectURI,
+		// Query values point into fiber's request buffer, which is reused
+		// once this handler returns.
+		redirect: safeRedirect(strings.Clone(c.Query("redirect"))),
+		expires:  expires,
+	})
+
+	c.Cookie(secureForRequest(c, &fiber.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/v1/auth",
+		Expires:  expires,
+		HTTPOnly: true,
+		Secure:   cookieSecure(),
+		SameSite: fiber.CookieSameSiteLaxMode,
+	}))
+
+	authCodeURL := oauth2Config.AuthCodeURL(state, oauth2.AccessTypeOffline, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("redirect_uri", redirectURI))
 	return c.Redirect(authCodeURL, fiber.StatusFound)
 }
 
@@ -71,13 +201,29 @@ func handleAuthCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "OIDC not configured"})
 	}
 
+	state := c.Query("state")
+	if state == "" || state != c.Cookies(oidcStateCookieName) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid state"})
+	}
+	login, ok := takePendingLogin(state)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Login expired, please try again"})
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:    oidcStateCookieName,
+		Value:   "",
+		Path:    "/api/v1/auth",
+		Expires: time.Now().Add(-1 * time.Hour),
+	})
+
 	code := c.Query("code")
 	if code == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing code in callback"})
 	}
 
 	ctx := context.Background()
-	oauth2Token, err := oauth2Config.Exchange(ctx, code)
+	oauth2Token, err := oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(login.verifier),
+		oauth2.SetAuthURLParam("redirect_uri", login.redirectURI))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to exchange token: " + err.Error()})
 	}
@@ -89,11 +235,14 @@ func handleAuthCallback(c *fiber.Ctx) error {
 	}
 
 	// Verify the ID Token signature and expiration.
-	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: ConfigInstance.Oidc.ClientID})
+	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: GetConfig().Oidc.ClientID})
 	idToken, err := verifier.Verify(ctx, rawIDToken)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to verify ID Token: " + err.Error()})
 	}
+	if idToken.Nonce != login.nonce {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid nonce"})
+	}
 
 	// Get the claims
 	var claims struct {
@@ -115,6 +264,10 @@ func handleAuthCallback(c *fiber.Ctx) error {
 	if err := userInfo.Claims(&allClaims); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to parse user info claims: " + err.Error()})
 	}
+	var idTokenClaims map[string]interface{}
+	if err := idToken.Claims(&idTokenClaims); err == nil {
+		mergeGroupsClaim(allClaims, idTokenClaims)
+	}
 	cachedClaimsJSON, _ := json.Marshal(allClaims)
 
 	db := gormDB
@@ -126,6 +279,7 @@ func handleAuthCallback(c *fiber.Ctx) error {
 		Username:     claims.PreferredUsername,
 		AccessToken:  oauth2Token.AccessToken,
 		RefreshToken: oauth2Token.RefreshToken,
+		IDToken:      rawIDToken,
 		CachedClaims: string(cachedClaimsJSON),
 		ExpiresAt:    oauth2Token.Expiry,
 	}
@@ -134,17 +288,9 @@ func handleAuthCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create session: " + err.Error()})
 	}
 
-	// Set the cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     CookieName,
-		Value:    session.ID,
-		Expires:  time.Now().Add(31 * 24 * time.Hour),
-		HTTPOnly: true,
-		Secure:   false, // set to true if using HTTPS
-		SameSite: "Lax",
-	})
+	c.Cookie(secureForRequest(c, sessionCookie(session.ID, sessionMaxAge())))
 
-	return c.Redirect("/")
+	return c.Redirect(login.redirect)
 }
 
 // tabletSessionDuration is how long a kiosk tablet session stays valid.
@@ -152,14 +298,7 @@ const tabletSessionDuration = 365 * 24 * time.Hour
 
 // tabletSessionCookie builds the session cookie used for tablet sessions.
 func tabletSessionCookie(sessionID string) *fiber.Cookie {
-	return &fiber.Cookie{
-		Name:     CookieName,
-		Value:    sessionID,
-		Expires:  time.Now().Add(tabletSessionDuration),
-		HTTPOnly: true,
-		Secure:   false, // set to true if using HTTPS
-		SameSite: "Lax",
-	}
+	return sessionCookie(sessionID, tabletSessionDuration)
 }
 
 // ipInTrustedSubnets reports whether the given IP falls inside any of the
@@ -169,10 +308,10 @@ func ipInTrustedSubnets(ipStr string) bool {
 	if ip == nil {
 		return false
 	}
-	for _, cidr := range ConfigInstance.Tablet.TrustedSubnets {
+	for _, cidr := range GetConfig().Tablet.TrustedSubnets {
 		_, network, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.Printf("Invalid tablet trusted_subnet %q: %v", cidr, err)
+			authLog.Warn("invalid tablet trusted_subnet", "cidr", cidr, "err", err)
 			continue
 		}
 		if network.Contains(ip) {
@@ -185,18 +324,18 @@ func ipInTrustedSubnets(ipStr string) bool {
 // handleTabletAuth grants a long-lived control session to a tablet connecting
 // from a trusted subnet. Requests from outside those subnets get 401.
 func handleTabletAuth(c *fiber.Ctx) error {
-	clientIP := c.IP()
-	if !ipInTrustedSubnets(clientIP) {
-		log.Printf("Tablet auth denied for IP %s (not in a trusted subnet)", clientIP)
+	ip := clientIP(c)
+	if !ipInTrustedSubnets(ip) {
+		authLog.Warn("tablet auth denied, not in a trusted subnet", "ip", ip)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not in a trusted subnet"})
 	}
 
 	// Reuse an existing valid tablet session from this client if the cookie is
 	// still good, otherwise mint a new one.
-	if cookie := c.Cookies(CookieName); cookie != "" {
+	if cookie, _ := requestSessionCookie(c); cookie != "" {
 		var existing SessionModel
 		if err := gormDB.First(&existing, "id = ? AND is_tablet = ?", cookie, true).Error; err == nil {
-			c.Cookie(tabletSessionCookie(existing.ID))
+			c.Cookie(secureForRequest(c, tabletSessionCookie(existing.ID)))
 			return c.JSON(fiber.Map{"ok": true})
 		}
 	}
@@ -212,89 +351,341 @@ func handleTabletAuth(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create session: " + err.Error()})
 	}
 
-	c.Cookie(tabletSessionCookie(session.ID))
-	log.Printf("Granted tablet session to IP %s", clientIP)
+	c.Cookie(secureForRequest(c, tabletSessionCookie(session.ID)))
+	authLog.Info("granted tablet session", "ip", ip)
 	return c.JSON(fiber.Map{"ok": true})
 }
 
+// handleLogout ends the session. POST requests (API clients) just get 200.
+// GET requests come from the browser navigating here; they are sent on to the
+// IdP's end_session_endpoint so the user is signed out there as well, and
+// otherwise back to the start page.
 func handleLogout(c *fiber.Ctx) error {
-	cookie := c.Cookies(CookieName)
-	if cookie != "" {
-		gormDB.Delete(&SessionModel{}, "id = ?", cookie)
+	var session SessionModel
+	if cookie, _ := requestSessionCookie(c); cookie != "" {
+		if err := gormDB.First(&session, "id = ?", cookie).Error; err == nil {
+			gormDB.Delete(&SessionModel{}, "id = ?", session.ID)
+		}
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:    CookieName,
-		Value:   "",
-		Expires: time.Now().Add(-1 * time.Hour),
-	})
-	return c.SendStatus(fiber.StatusOK)
+	c.Cookie(expiredSessionCookie())
+	expireLegacySessionCookie(c)
+
+	if c.Method() != fiber.MethodGet {
+		return c.SendStatus(fiber.StatusOK)
+	}
+	if session.IsLocal {
+		return c.Redirect("/", fiber.StatusFound)
+	}
+	if logoutURL := endSessionURL(session.IDToken, requestBaseURL(c)); logoutURL != "" {
+		return c.Redirect(logoutURL, fiber.StatusFound)
+	}
+	return c.Redirect("/", fiber.StatusFound)
 }
 
-func handleMe(c *fiber.Ctx) error {
-	cookie := c.Cookies(CookieName)
-	if cookie == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
+// endSessionURL builds the RP-initiated logout URL at the IdP, which returns
+// the user to baseURL, or returns "" when the provider has no end-session
+// endpoint.
+func endSessionURL(idToken, baseURL string) string {
+	if oidcEndSessionURL == "" {
+		return ""
+	}
+	u, err := url.Parse(oidcEndSessionURL)
+	if err != nil {
+		authLog.Warn("invalid OIDC end_session_endpoint", "url", oidcEndSessionURL, "err", err)
+		return ""
 	}
+	q := u.Query()
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	q.Set("client_id", GetConfig().Oidc.ClientID)
+	q.Set("post_logout_redirect_uri", baseURL+"/")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
 
-	db := gormDB
+const (
+	// sessionRefreshMargin is the default web.session_refresh_window: how
+	// long before the access token expires that a request refreshes it, so
+	// handlers never see a token about to lapse.
+	sessionRefreshMargin = 5 * time.Minute
+	// sessionIdleTimeout is the default session cookie lifetime
+	// (web.cookie.max_age). OIDC sessions whose token hasn't been refreshed
+	// for this long are removed by the cleanup job.
+	sessionIdleTimeout = 31 * 24 * time.Hour
+	// sessionCleanupInterval is how often expired sessions are deleted.
+	sessionCleanupInterval = time.Hour
+)
+
+var (
+	errNotLoggedIn    = errors.New("not logged in")
+	errSessionExpired = errors.New("session expired")
+)
+
+// sessionRefreshes serializes token refreshes per session ID: parallel
+// requests of one browser share a single refresh instead of each spending
+// the (possibly rotating) refresh token.
+var sessionRefreshes singleflight.Group
+
+// sessionRefresh is the result of a shared refresh.
+type sessionRefresh struct {
+	session   SessionModel
+	refreshed bool
+}
+
+// loadSession returns the session behind the request's cookie. OIDC sessions
+// get their access token refreshed with the refresh token when it is close
+// to expiry; if the IdP rejects that (e.g. the user was disabled) the session
+// is deleted, so revoked users lose access within one token lifetime. Other
+// refresh failures keep the session, which stays usable while its access
+// token is valid and is retried on the next request.
+func loadSession(c *fiber.Ctx) (*SessionModel, error) {
+	sessionID := requestSessionID(c)
+	if sessionID == "" {
+		return nil, errNotLoggedIn
+	}
 
 	var session SessionModel
-	if err := db.First(&session, "id = ?", cookie).Error; err != nil {
+	if err := gormDB.First(&session, "id = ?", sessionID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refreshed := false
+	if sessionNeedsRefresh(&session, now) {
+		v, err, _ := sessionRefreshes.Do(sessionID, func() (any, error) {
+			// Another request may have refreshed the session since it was read.
+			var current SessionModel
+			if err := gormDB.First(&current, "id = ?", sessionID).Error; err != nil {
+				return nil, err
+			}
+			refreshed, err := refreshSession(context.Background(), &current, now)
+			return sessionRefresh{session: current, refreshed: refreshed}, err
+		})
+		switch {
+		case err == nil:
+			result := v.(sessionRefresh)
+			session, refreshed = result.session, result.refreshed
+		case errors.Is(err, errSessionExpired) || sessionRefreshRejected(err):
+			authLog.Info("ending session", "user", session.Username, "err", err)
+			gormDB.Delete(&SessionModel{}, "id = ?", session.ID)
+			c.Cookie(expiredSessionCookie())
+			expireLegacySessionCookie(c)
+			return nil, err
+		case now.Before(session.ExpiresAt):
+			authLog.Warn("session refresh failed, keeping current token", "user", session.Username, "err", err)
+		default:
+			authLog.Warn("session refresh failed", "user", session.Username, "err", err)
+			return nil, err
+		}
+	}
+	// A cookie under the legacy name moves to the current one.
+	_, legacy := requestSessionCookie(c)
+	switch {
+	case legacy && session.IsTablet:
+		c.Cookie(secureForRequest(c, tabletSessionCookie(session.ID)))
+	case legacy || refreshed:
+		c.Cookie(secureForRequest(c, sessionCookie(session.ID, sessionMaxAge())))
+	}
+	if legacy {
+		expireLegacySessionCookie(c)
+	}
+	touchSession(&session, now)
+	return &session, nil
+}
+
+// sessionNeedsRefresh reports whether the session has expired or must be
+// renewed before it is used. OIDC sessions without a refresh token can't be
+// renewed and last until the cleanup job would remove them.
+func sessionNeedsRefresh(session *SessionModel, now time.Time) bool {
+	switch {
+	case now.After(sessionExpiresAt(session)):
+		return true
+	case session.IsTablet || session.ExpiresAt.Sub(now) > sessionRefreshWindow():
+		return false
+	case session.IsLocal:
+		return true
+	default:
+		return oauth2Config != nil && session.RefreshToken != ""
+	}
+}
+
+// sessionRefreshRejected reports whether a refresh failed because the IdP
+// refused the refresh token, as opposed to it being unreachable.
+func sessionRefreshRejected(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.Response != nil &&
+		retrieveErr.Response.StatusCode >= 400 && retrieveErr.Response.StatusCode < 500
+}
+
+// requestSessionID returns the session ID from the session cookie, or from an
+// "Authorization: Bearer <session id>" header for non-browser clients.
+func requestSessionID(c *fiber.Ctx) string {
+	if cookie, _ := requestSessionCookie(c); cookie != "" {
+		return cookie
+	}
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// refreshSession renews the session's access token if it expires within the
+// session refresh window and persists the new tokens. Local user sessions
+// have no tokens and are extended instead; tablet sessions are only checked
+// for expiry, as are OIDC sessions without a refresh token. It reports
+// whether the session was renewed, so the caller can re-issue the cookie.
+func refreshSession(ctx context.Context, session *SessionModel, now time.Time) (bool, error) {
+	if now.After(sessionExpiresAt(session)) {
+		return false, errSessionExpired
+	}
+	if session.IsTablet || session.ExpiresAt.Sub(now) > sessionRefreshWindow() {
+		return false, nil
+	}
+	if session.IsLocal {
+		session.ExpiresAt = now.Add(sessionMaxAge())
+		return true, gormDB.Model(session).Update("expires_at", session.ExpiresAt).Error
+	}
+	if oauth2Config == nil || session.RefreshToken == "" {
+		return false, nil
+	}
+
+	// Without an access token the token source always goes to the IdP.
+	token, err := oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: session.RefreshToken}).Token()
+	if err != nil {
+		return false, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	session.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		session.RefreshToken = token.RefreshToken
+	}
+	session.ExpiresAt = token.Expiry
+	if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+		session.IDToken = idToken
+	}
+	return true, gormDB.Model(session).Updates(map[string]interface{}{
+		"access_token":  session.AccessToken,
+		"refresh_token": session.RefreshToken,
+		"id_token":      session.IDToken,
+		"expires_at":    session.ExpiresAt,
+	}).Error
+}
+
+// sessionRefreshWindow is how long before expiry a session is renewed, from
+// web.session_refresh_window (validated at load) or sessionRefreshMargin.
+func sessionRefreshWindow() time.Duration {
+	if GetConfig() == nil {
+		return sessionRefreshMargin
+	}
+	if d, err := time.ParseDuration(GetConfig().Web.SessionRefreshWindow); err == nil && d > 0 {
+		return d
+	}
+	return sessionRefreshMargin
+}
+
+// sessionExpiresAt returns when the session ends unless it is used again:
+// tablet and local user sessions at ExpiresAt, OIDC sessions when the
+// cleanup job considers them abandoned.
+func sessionExpiresAt(session *SessionModel) time.Time {
+	if session.IsTablet || session.IsLocal {
+		return session.ExpiresAt
+	}
+	return session.ExpiresAt.Add(sessionMaxAge())
+}
+
+// sessionMayControl reports whether the session is accepted on the control
+// endpoints; see RequireAuth.
+func sessionMayControl(session *SessionModel) bool {
+	return oauth2Config != nil || session.IsTablet || session.IsLocal
+}
+
+// withSessionInfo adds what the frontend needs about the session itself to
+// a /me response: whether it may control devices and when it expires. The
+// remaining lifetime is also sent as the X-Session-Expires-In header
+// (seconds).
+func withSessionInfo(c *fiber.Ctx, info fiber.Map, session *SessionModel) fiber.Map {
+	expiresAt := sessionExpiresAt(session)
+	expiresIn := max(int64(time.Until(expiresAt).Seconds()), 0)
+	c.Set("X-Session-Expires-In", strconv.FormatInt(expiresIn, 10))
+	info["isTablet"] = session.IsTablet
+	info["canControl"] = sessionMayControl(session)
+	info["sessionExpiresAt"] = expiresAt.Unix()
+	info["sessionExpiresIn"] = expiresIn
+	return info
+}
+
+// cleanupExpiredSessions deletes tablet and local user sessions past their
+// expiry and OIDC sessions whose token was last refreshed longer than
+// sessionMaxAge ago.
+func cleanupExpiredSessions(now time.Time) (int64, error) {
+	result := gormDB.Where(
+		"((is_tablet = ? OR is_local = ?) AND expires_at < ?) OR (is_tablet = ? AND is_local = ? AND expires_at < ?)",
+		true, true, now, false, false, now.Add(-sessionMaxAge()),
+	).Delete(&SessionModel{})
+	return result.RowsAffected, result.Error
+}
+
+// startSessionCleanup periodically deletes expired sessions.
+func startSessionCleanup() {
+	go func() {
+		ticker := time.NewTicker(sessionCleanupInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := cleanupExpiredSessions(time.Now()); err != nil {
+				authLog.Warn("cleaning up expired sessions failed", "err", err)
+			} else if n > 0 {
+				authLog.Info("removed expired sessions", "count", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func handleMe(c *fiber.Ctx) error {
+	session, err := loadSession(c)
+	if errors.Is(err, errNotLoggedIn) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
+	} else if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid session"})
 	}
 
 	// Tablet sessions have no OIDC tokens; return their identity directly.
 	if session.IsTablet {
-		c.Cookie(tabletSessionCookie(session.ID))
-		return c.JSON(fiber.Map{
+		c.Cookie(secureForRequest(c, tabletSessionCookie(session.ID)))
+		return c.JSON(withSessionInfo(c, fiber.Map{
 			"username":                      session.Username,
 			"membershipExpirationTimestamp": nil,
-			"isTablet":                      true,
-		})
+			"email":                         "",
+			"groups":                        []string{},
+		}, session))
+	}
+
+	// Local users have no IdP to ask; their claims come from the config.
+	if session.IsLocal {
+		var claims map[string]interface{}
+		if err := json.Unmarshal([]byte(session.CachedClaims), &claims); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to parse claims"})
+		}
+		return c.JSON(withSessionInfo(c, extractUserInfo(claims), session))
 	}
 
 	fast := c.Query("fast") == "true"
 	if fast && session.CachedClaims != "" {
 		var claims map[string]interface{}
 		if err := json.Unmarshal([]byte(session.CachedClaims), &claims); err == nil {
-			return c.JSON(extractUserInfo(claims))
+			return c.JSON(withSessionInfo(c, extractUserInfo(claims), session))
 		}
 		// If unmarshal fails, we fall through to the slow path
 	}
 
-	// Reconstruct the token
+	// loadSession has already refreshed the access token if needed.
 	token := &oauth2.Token{
-		AccessToken:  session.AccessToken,
-		RefreshToken: session.RefreshToken,
-		Expiry:       session.ExpiresAt,
-		TokenType:    "Bearer",
+		AccessToken: session.AccessToken,
+		Expiry:      session.ExpiresAt,
+		TokenType:   "Bearer",
 	}
-
-	ctx := context.Background()
-	tokenSource := oauth2Config.TokenSource(ctx, token)
-
-	// Get a fresh token (this will refresh if needed)
-	newToken, err := tokenSource.Token()
-	if err != nil {
-		// Invalidate the session and return 401
-		db.Delete(&SessionModel{}, "id = ?", cookie)
-		c.ClearCookie(CookieName)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Failed to refresh token: " + err.Error()})
-	}
-
-	// Update session if token changed
-	if newToken.AccessToken != session.AccessToken {
-		session.AccessToken = newToken.AccessToken
-		if newToken.RefreshToken != "" {
-			session.RefreshToken = newToken.RefreshToken
-		}
-		session.ExpiresAt = newToken.Expiry
-		session.CachedClaims = "" // Invalidate cached claims as we will fetch new ones
-		// We don't save yet, we save after fetching new claims
-	}
-
-	userInfo, err := oidcProvider.UserInfo(ctx, tokenSource)
+	userInfo, err := oidcProvider.UserInfo(context.Background(), oauth2.StaticTokenSource(token))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get user info: " + err.Error()})
 	}
@@ -304,77 +695,117 @@ func handleMe(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to parse user info claims: " + err.Error()})
 	}
 
+	// Keep groups that came from the ID token at login.
+	var previousClaims map[string]interface{}
+	if err := json.Unmarshal([]byte(session.CachedClaims), &previousClaims); err == nil {
+		mergeGroupsClaim(claims, previousClaims)
+	}
+
 	// Update cached claims
 	if claimsJSON, err := json.Marshal(claims); err == nil {
-		session.CachedClaims = string(claimsJSON)
-		if err := db.Save(&session).Error; err != nil {
-			log.Printf("Failed to update session with new token: %v", err)
-		}
-	} else {
-		// Just save the token update if we couldn't marshal claims for some reason
-		if err := db.Save(&session).Error; err != nil {
-			log.Printf("Failed to update session with new token: %v", err)
+		if err := gormDB.Model(session).Update("cached_claims", string(claimsJSON)).Error; err != nil {
+			authLog.Warn("updating session claims failed", "err", err)
 		}
 	}
 
 	// Extend the session cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     CookieName,
-		Value:    session.ID,
-		Expires:  time.Now().Add(31 * 24 * time.Hour),
-		HTTPOnly: true,
-		Secure:   false, // set to true if using HTTPS
-		SameSite: "Lax",
-	})
+	c.Cookie(secureForRequest(c, sessionCookie(session.ID, sessionMaxAge())))
 
-	return c.JSON(extractUserInfo(claims))
+	return c.JSON(withSessionInfo(c, extractUserInfo(claims), session))
 }
 
 func extractUserInfo(claims map[string]interface{}) fiber.Map {
-	usernameClaim := ConfigInstance.Oidc.UsernameClaim
-	if usernameClaim == "" {
-		usernameClaim = "preferred_username"
-	}
-
-	username, _ := claims[usernameClaim].(string)
+	username, _ := claims[usernameClaimName()].(string)
 
 	var membershipExpirationTimestamp interface{} = nil
-	if ConfigInstance.Oidc.MembershipExpirationTimestampClaim != "" {
-		if val, ok := claims[ConfigInstance.Oidc.MembershipExpirationTimestampClaim]; ok {
+	if GetConfig().Oidc != nil && GetConfig().Oidc.MembershipExpirationTimestampClaim != "" {
+		if val, ok := claims[GetConfig().Oidc.MembershipExpirationTimestampClaim]; ok {
 			membershipExpirationTimestamp = val
 		}
 	}
 
+	email, _ := claims["email"].(string)
+	groups := claimGroups(claims)
+	if groups == nil {
+		groups = []string{}
+	}
+
 	return fiber.Map{
 		"username":                      username,
 		"membershipExpirationTimestamp": membershipExpirationTimestamp,
+		"email":                         email,
+		"groups":                        groups,
 	}
 }
 
 func AuthMiddleware(c *fiber.Ctx) error {
-	cookie := c.Cookies(CookieName)
-	if cookie == "" {
+	session, err := loadSession(c)
+	if errors.Is(err, errNotLoggedIn) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
-	}
-
-	db := gormDB
-
-	var session SessionModel
-	if err := db.First(&session, "id = ?", cookie).Error; err != nil {
+	} else if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid session"})
 	}
 
-	// Store user info in context for downstream handlers
+	setSessionLocals(c, session)
+	return c.Next()
+}
+
+// setSessionLocals stores user info in context for downstream handlers.
+func setSessionLocals(c *fiber.Ctx, session *SessionModel) {
+	c.Locals("session", session)
 	c.Locals("username", session.Username)
 	c.Locals("cached_claims", session.CachedClaims)
+}
 
+// defaultProtectedPaths are guarded by RequireAuth when web.protected_paths
+// is not set.
+var defaultProtectedPaths = []string{"/api/v1/control", "/api/v1/debug"}
+
+// isProtectedPath reports whether the path starts with one of the configured
+// protected path prefixes. Fiber routes case-insensitively, so the prefixes
+// are matched the same way: /API/v1/control reaches the control routes too.
+func isProtectedPath(path string) bool {
+	prefixes := GetConfig().Web.ProtectedPaths
+	if prefixes == nil {
+		prefixes = defaultProtectedPaths
+	}
+	path = strings.ToLower(path)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAuth is installed for the whole app and rejects requests to
+// protected paths that carry no valid session, so a newly added control or
+// debug route can't end up public by accident. Everything else stays open for
+// the public dashboard. Without OIDC only tablet and local user sessions are
+// accepted: OIDC sessions could then neither be refreshed nor revoked.
+func RequireAuth(c *fiber.Ctx) error {
+	if !isProtectedPath(c.Path()) {
+		return c.Next()
+	}
+
+	session, err := loadSession(c)
+	if errors.Is(err, errNotLoggedIn) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
+	} else if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid session"})
+	}
+	if !sessionMayControl(session) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "OIDC not configured"})
+	}
+
+	setSessionLocals(c, session)
 	return c.Next()
 }
 
 // TabletAuthMiddleware allows only requests carrying a valid tablet session
 // cookie (a session minted by handleTabletAuth from a trusted subnet).
 func TabletAuthMiddleware(c *fiber.Ctx) error {
-	cookie := c.Cookies(CookieName)
+	cookie, _ := requestSessionCookie(c)
 	if cookie == "" {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
 	}
@@ -387,6 +818,82 @@ func TabletAuthMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// lookupLiveSession returns the session with the given ID if it is still
+// valid, by the same expiry loadSession enforces for every kind of session.
+func lookupLiveSession(sessionID string) (*SessionModel, error) {
+	var session SessionModel
+	if err := gormDB.First(&session, "id = ?", sessionID).Error; err != nil {
+		return nil, err
+	}
+	if time.Now().After(sessionExpiresAt(&session)) {
+		return nil, fmt.Errorf("session %s expired", sessionID)
+	}
+	return &session, nil
+}
+
+// LiveWsAuthMiddleware guards the live websocket upgrade when
+// web.live_ws_require_auth is enabled. Browsers authenticate with the session
+// cookie; non-browser clients may pass the session ID as ?token=. The username
+// and session ID are stored in locals so the connection can log who it serves
+// and re-check the session while it stays open, as is the client IP, which
+// the websocket connection can't resolve through trusted proxies itself.
+func LiveWsAuthMiddleware(c *fiber.Ctx) error {
+	required := GetConfig().Web.LiveWsRequireAuth
+	c.Locals("client_ip", clientIP(c))
+
+	sessionID, _ := requestSessionCookie(c)
+	if sessionID == "" {
+		sessionID = c.Query("token")
+	}
+	if sessionID == "" {
+		if !required {
+			return c.Next()
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
+	}
+
+	// Without live_ws_require_auth a session is still attached when present
+	// so the connection may send control messages.
+	session, err := lookupLiveSession(sessionID)
+	if err != nil {
+		if !required {
+			return c.Next()
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid session"})
+	}
+
+	c.Locals("username", session.Username)
+	c.Locals("session_id", session.ID)
+	return c.Next()
+}
+
+func usernameClaimName() string {
+	if GetConfig().Oidc != nil && GetConfig().Oidc.UsernameClaim != "" {
+		return GetConfig().Oidc.UsernameClaim
+	}
+	return "preferred_username"
+}
+
+func groupsClaimName() string {
+	if GetConfig().Oidc != nil && GetConfig().Oidc.GroupsClaim != "" {
+		return GetConfig().Oidc.GroupsClaim
+	}
+	return "groups"
+}
+
+// mergeGroupsClaim copies the groups claim from src into dst unless dst
+// already has one. Some IdPs put groups only into the ID token and not into
+// the userinfo response that gets cached in the session.
+func mergeGroupsClaim(dst, src map[string]interface{}) {
+	claim := groupsClaimName()
+	if _, ok := dst[claim]; ok {
+		return
+	}
+	if groups, ok := src[claim]; ok {
+		dst[claim] = groups
+	}
+}
+
 // getUserGroups extracts the user's OIDC groups from the cached claims that
 // AuthMiddleware stored in c.Locals. It returns an empty slice (not an error)
 // when the session carries no claims (e.g. tablet sessions) or no groups claim.
@@ -401,18 +908,13 @@ func getUserGroups(c *fiber.Ctx) ([]string, error) {
 	if err := json.Unmarshal([]byte(cachedClaimsStr), &claims); err != nil {
 		return nil, err
 	}
+	return claimGroups(claims), nil
+}
 
-	groupsClaim := ConfigInstance.Oidc.GroupsClaim
-	if groupsClaim == "" {
-		groupsClaim = "groups"
-	}
-
-	userGroupsInterface, ok := claims[groupsClaim]
-	if !ok {
-		return nil, nil
-	}
-
-	switch v := userGroupsInterface.(type) {
+// claimGroups returns the groups in the configured groups claim, or nil when
+// the claims have none.
+func claimGroups(claims map[string]interface{}) []string {
+	switch v := claims[groupsClaimName()].(type) {
 	case []interface{}:
 		groups := make([]string, 0, len(v))
 		for _, g := range v {
@@ -420,11 +922,11 @@ func getUserGroups(c *fiber.Ctx) ([]string, error) {
 				groups = append(groups, s)
 			}
 		}
-		return groups, nil
+		return groups
 	case []string:
-		return v, nil
+		return v
 	default:
-		return nil, nil
+		return nil
 	}
 }
 
@@ -453,7 +955,10 @@ func DebugAccessAuthMiddleware(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No groups in user claims"})
 	}
 
-	allowedGroups := ConfigInstance.Oidc.DebugAccessGroups
+	var allowedGroups []string
+	if GetConfig().Oidc != nil {
+		allowedGroups = GetConfig().Oidc.DebugAccessGroups
+	}
 	if len(allowedGroups) == 0 {
 		// If no debug groups are configured, maybe nobody should have access, or everyone?
 		// Secure by default: nobody.
@@ -481,6 +986,9 @@ func DebugAccessAuthMiddleware(c *fiber.Ctx) error {
 }
 
 func handleBackchannelLogout(c *fiber.Ctx) error {
+	if oidcProvider == nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "OIDC not configured"})
+	}
 	logoutToken := c.FormValue("logout_token")
 	if logoutToken == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing logout_token"})
@@ -496,7 +1004,7 @@ func handleBackchannelLogout(c *fiber.Ctx) error {
 	// Let's create a new one.
 	ctx := context.Background()
 
-	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: ConfigInstance.Oidc.ClientID})
+	verifier := oidcProvider.Verifier(&oidc.Config{ClientID: GetConfig().Oidc.ClientID})
 	token, err := verifier.Verify(ctx, logoutToken)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid logout_token: " + err.Error()})
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// hostCookiePrefix makes browsers pin a cookie to the exact host: they only
+// accept it when it is Secure, has no Domain and has Path "/".
+const hostCookiePrefix = "__Host-"
+
+// isHTTPSURL reports whether the public URL is served over https, in which
+// case cookies are marked Secure.
+func isHTTPSURL(publicURL string) bool {
+	return len(publicURL) >= len("https://") && strings.EqualFold(publicURL[:len("https://")], "https://")
+}
+
+// cookieSecure reports whether cookies are sent with the Secure flag.
+func cookieSecure() bool {
+	return isHTTPSURL(GetConfig().Web.PublicURL)
+}
+
+// cookieSameSite normalizes the configured SameSite mode, defaulting to Lax.
+func cookieSameSite(mode string) string {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return fiber.CookieSameSiteStrictMode
+	case "none":
+		return fiber.CookieSameSiteNoneMode
+	default:
+		return fiber.CookieSameSiteLaxMode
+	}
+}
+
+// sessionCookieNameFor returns the session cookie name for the web config,
+// adding the __Host- prefix when the cookie qualifies for it.
+func sessionCookieNameFor(web WebConfig) string {
+	name := web.Cookie.Name
+	if name == "" {
+		name = CookieName
+	}
+	if isHTTPSURL(web.PublicURL) && web.Cookie.Domain == "" && !strings.HasPrefix(name, hostCookiePrefix) {
+		name = hostCookiePrefix + name
+	}
+	return name
+}
+
+// buildSessionCookie builds the session cookie for the web config. A
+// non-positive lifetime builds a cookie that deletes the session cookie.
+func buildSessionCookie(web WebConfig, value string, lifetime time.Duration) *fiber.Cookie {
+	cookie := &fiber.Cookie{
+		Name:     sessionCookieNameFor(web),
+		Value:    value,
+		Path:     "/",
+		Domain:   web.Cookie.Domain,
+		Expires:  time.Now().Add(lifetime),
+		HTTPOnly: true,
+		Secure:   isHTTPSURL(web.PublicURL),
+		SameSite: cookieSameSite(web.Cookie.SameSite),
+	}
+	if lifetime <= 0 {
+		cookie.Value = ""
+		cookie.Expires = time.Now().Add(-time.Hour)
+	}
+	return cookie
+}
+
+// sessionCookieName is the name of the session cookie under the loaded config.
+func sessionCookieName() string {
+	return sessionCookieNameFor(GetConfig().Web)
+}
+
+// legacySessionCookieName is the name the session cookie had before the
+// __Host- prefix was added, or "" when the prefix doesn't apply. Browsers
+// logged in before the upgrade still send it.
+func legacySessionCookieName() string {
+	web := GetConfig().Web
+	name := web.Cookie.Name
+	if name == "" {
+		name = CookieName
+	}
+	if name == sessionCookieNameFor(web) {
+		return ""
+	}
+	return name
+}
+
+// requestSessionCookie returns the session cookie of the request, falling
+// back to the legacy name, and whether it came under the legacy name.
+func requestSessionCookie(c *fiber.Ctx) (string, bool) {
+	if value := c.Cookies(sessionCookieName()); value != "" {
+		return value, false
+	}
+	if legacy := legacySessionCookieName(); legacy != "" {
+		if value := c.Cookies(legacy); value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// expireLegacySessionCookie removes a session cookie the request sent under
+// the legacy name, so it isn't sent alongside the current one.
+func expireLegacySessionCookie(c *fiber.Ctx) {
+	legacy := legacySessionCookieName()
+	if legacy == "" || c.Cookies(legacy) == "" {
+		return
+	}
+	cookie := expiredSessionCookie()
+	cookie.Name = legacy
+	c.Cookie(cookie)
+}
+
+// sessionCookie builds a session cookie under the loaded config.
+func sessionCookie(sessionID string, lifetime time.Duration) *fiber.Cookie {
+	return buildSessionCookie(GetConfig().Web, sessionID, lifetime)
+}
+
+// expiredSessionCookie builds a cookie that removes the session cookie.
+func expiredSessionCookie() *fiber.Cookie {
+	return buildSessionCookie(GetConfig().Web, "", 0)
+}
+
+// sessionMaxAge is how long an OIDC session stays valid without use, from
+// web.cookie.max_age (validated at load) or sessionIdleTimeout.
+func sessionMaxAge() time.Duration {
+	if GetConfig() == nil {
+		return sessionIdleTimeout
+	}
+	if d, err := time.ParseDuration(GetConfig().Web.Cookie.MaxAge); err == nil && d > 0 {
+		return d
+	}
+	return sessionIdleTimeout
+}
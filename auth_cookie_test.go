@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBuildSessionCookie(t *testing.T) {
+	tests := []struct {
+		name         string
+		web          WebConfig
+		wantName     string
+		wantDomain   string
+		wantSecure   bool
+		wantSameSite string
+	}{
+		{
+			name:         "http defaults",
+			web:          WebConfig{PublicURL: "http://localhost:8080"},
+			wantName:     "session_id",
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "https gets host prefix",
+			web:          WebConfig{PublicURL: "https://at.example.com"},
+			wantName:     "__Host-session_id",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "https scheme is case-insensitive",
+			web:          WebConfig{PublicURL: "HTTPS://at.example.com"},
+			wantName:     "__Host-session_id",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "https with domain has no host prefix",
+			web:          WebConfig{PublicURL: "https://at.example.com", Cookie: CookieConfig{Domain: "example.com"}},
+			wantName:     "session_id",
+			wantDomain:   "example.com",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "http with domain",
+			web:          WebConfig{PublicURL: "http://at.lan", Cookie: CookieConfig{Domain: "lan"}},
+			wantName:     "session_id",
+			wantDomain:   "lan",
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "custom name over http",
+			web:          WebConfig{PublicURL: "http://at.lan", Cookie: CookieConfig{Name: "at2"}},
+			wantName:     "at2",
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "custom name over https",
+			web:          WebConfig{PublicURL: "https://at.example.com", Cookie: CookieConfig{Name: "at2"}},
+			wantName:     "__Host-at2",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "custom name already prefixed",
+			web:          WebConfig{PublicURL: "https://at.example.com", Cookie: CookieConfig{Name: "__Host-at2"}},
+			wantName:     "__Host-at2",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteLaxMode,
+		},
+		{
+			name:         "strict",
+			web:          WebConfig{PublicURL: "https://at.example.com", Cookie: CookieConfig{SameSite: "strict"}},
+			wantName:     "__Host-session_id",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteStrictMode,
+		},
+		{
+			name:         "none",
+			web:          WebConfig{PublicURL: "https://at.example.com", Cookie: CookieConfig{SameSite: "None"}},
+			wantName:     "__Host-session_id",
+			wantSecure:   true,
+			wantSameSite: fiber.CookieSameSiteNoneMode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			cookie := buildSessionCookie(tt.web, "abc", time.Hour)
+			if cookie.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", cookie.Name, tt.wantName)
+			}
+			if cookie.Domain != tt.wantDomain {
+				t.Errorf("Domain = %q, want %q", cookie.Domain, tt.wantDomain)
+			}
+			if cookie.Secure != tt.wantSecure {
+				t.Errorf("Secure = %v, want %v", cookie.Secure, tt.wantSecure)
+			}
+			if cookie.SameSite != tt.wantSameSite {
+				t.Errorf("SameSite = %q, want %q", cookie.SameSite, tt.wantSameSite)
+			}
+			if cookie.Value != "abc" || cookie.Path != "/" || !cookie.HTTPOnly {
+				t.Errorf("cookie = %+v, want value abc, path / and HttpOnly", cookie)
+			}
+			if cookie.Expires.Before(before.Add(time.Hour)) {
+				t.Errorf("Expires = %v, want an hour from now", cookie.Expires)
+			}
+			if got := sessionCookieNameFor(tt.web); got != cookie.Name {
+				t.Errorf("sessionCookieNameFor = %q, want the cookie name %q", got, cookie.Name)
+			}
+
+			expired := buildSessionCookie(tt.web, "abc", 0)
+			if expired.Name != cookie.Name || expired.Domain != cookie.Domain || expired.Path != cookie.Path {
+				t.Errorf("expired cookie %+v doesn't match the session cookie %+v", expired, cookie)
+			}
+			if expired.Value != "" || !expired.Expires.Before(time.Now()) {
+				t.Errorf("expired cookie = %+v, want an empty value expiring in the past", expired)
+			}
+		})
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+
+	setConfig(&Config{})
+	if got := sessionMaxAge(); got != sessionIdleTimeout {
+		t.Errorf("default sessionMaxAge = %v, want %v", got, sessionIdleTimeout)
+	}
+	setConfig(&Config{Web: WebConfig{Cookie: CookieConfig{MaxAge: "72h"}}})
+	if got := sessionMaxAge(); got != 72*time.Hour {
+		t.Errorf("sessionMaxAge = %v, want 72h", got)
+	}
+}
+
+func TestLegacySessionCookieIsMigrated(t *testing.T) {
+	app, _ := setupSessionTest(t)
+	GetConfig().Web.PublicURL = "https://at.example.com"
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "current", RefreshToken: "refresh",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	// A browser logged in before the __Host- prefix sends the old name.
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: "s1"})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	if c := cookies[hostCookiePrefix+CookieName]; c == nil || c.Value != "s1" || !c.Secure {
+		t.Errorf("session cookie not reissued under the new name: %+v", c)
+	}
+	if c := cookies[CookieName]; c == nil || c.Value != "" || !c.Expires.Before(time.Now()) {
+		t.Errorf("legacy cookie not removed: %+v", c)
+	}
+
+	// The current name wins and nothing is reissued.
+	req = httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.AddCookie(&http.Cookie{Name: hostCookiePrefix + CookieName, Value: "s1"})
+	if resp, err = app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || len(resp.Cookies()) != 0 {
+		t.Errorf("status = %d, cookies %v", resp.StatusCode, resp.Cookies())
+	}
+}
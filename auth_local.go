@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// localLoginMaxFailures failed local logins from one IP within
+	// localLoginLockout lock that IP out for localLoginLockout.
+	localLoginMaxFailures = 5
+	localLoginLockout     = 15 * time.Minute
+)
+
+// localLoginAttempts tracks the failed local logins of one client IP.
+type localLoginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var (
+	localLoginFailures      = map[string]*localLoginAttempts{}
+	localLoginFailuresMutex sync.Mutex
+)
+
+// localLoginDummyHash is compared against when the username is unknown, so
+// the response time doesn't reveal which users exist.
+var localLoginDummyHash = sync.OnceValues(func() ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+})
+
+// validateLocalUsers fails fast on local users that could never log in.
+func validateLocalUsers(cfg *Config, cfgPath string) error {
+	seen := map[string]struct{}{}
+	for i, user := range cfg.Web.LocalUsers {
+		if user.Username == "" {
+			return fmt.Errorf("web.local_users[%d] has empty username in %s", i, cfgPath)
+		}
+		if _, dup := seen[user.Username]; dup {
+			return fmt.Errorf("duplicate local user %q in %s", user.Username, cfgPath)
+		}
+		seen[user.Username] = struct{}{}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("web.local_users[%d] (%s) has no valid bcrypt password_hash in %s: %v", i, user.Username, cfgPath, err)
+		}
+	}
+	return nil
+}
+
+// findLocalUser returns the configured local user with the given name.
+func findLocalUser(username string) *LocalUser {
+	for i, user := range GetConfig().Web.LocalUsers {
+		if user.Username == username {
+			return &GetConfig().Web.LocalUsers[i]
+		}
+	}
+	return nil
+}
+
+// localLoginLockedUntil returns when the IP's lockout ends, or the zero time
+// when it may try to log in.
+func localLoginLockedUntil(ip string, now time.Time) time.Time {
+	localLoginFailuresMutex.Lock()
+	defer localLoginFailuresMutex.Unlock()
+	if attempts, ok := localLoginFailures[ip]; ok && now.Before(attempts.lockedUntil) {
+		return attempts.lockedUntil
+	}
+	return time.Time{}
+}
+
+// recordLocalLoginFailure counts a failed login and locks the IP out once it
+// reaches localLoginMaxFailures. Failures older than localLoginLockout are
+// forgotten.
+func recordLocalLoginFailure(ip string, now time.Time) {
+	localLoginFailuresMutex.Lock()
+	defer localLoginFailuresMutex.Unlock()
+	for key, attempts := range localLoginFailures {
+		if now.Sub(attempts.lastFailure) > localLoginLockout && now.After(attempts.lockedUntil) {
+			delete(localLoginFailures, key)
+		}
+	}
+
+	attempts, ok := localLoginFailures[ip]
+	if !ok {
+		attempts = &localLoginAttempts{}
+		localLoginFailures[ip] = attempts
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+	if attempts.failures >= localLoginMaxFailures {
+		attempts.failures = 0
+		attempts.lockedUntil = now.Add(localLoginLockout)
+		authLog.Warn("locking out local logins", "ip", ip, "lockout", localLoginLockout, "failures", localLoginMaxFailures)
+	}
+}
+
+// resetLocalLoginFailures forgets the failures of an IP after a successful
+// login.
+func resetLocalLoginFailures(ip string) {
+	localLoginFailuresMutex.Lock()
+	defer localLoginFailuresMutex.Unlock()
+	delete(localLoginFailures, ip)
+}
+
+// localUserClaims builds the cached claims of a local user's session, so
+// group checks treat it like an OIDC user.
+func localUserClaims(user *LocalUser) string {
+	groups := user.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	claims, _ := json.Marshal(map[string]interface{}{
+		usernameClaimName(): user.Username,
+		groupsClaimName():   groups,
+	})
+	return string(claims)
+}
+
+// handleLocalLogin logs in a web.local_users user with username and password
+// (JSON or form body) and issues a session cookie like the OIDC callback.
+// Client IPs with too many failed attempts get 429 until the lockout ends.
+func handleLocalLogin(c *fiber.Ctx) error {
+	ip := clientIP(c)
+	now := time.Now()
+	if until := localLoginLockedUntil(ip, now); !until.IsZero() {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(until.Sub(now).Seconds())+1))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many failed login attempts, try again later"})
+	}
+
+	var req struct {
+		Username string `json:"username" form:"username"`
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	user := findLocalUser(req.Username)
+	hash, err := localLoginDummyHash()
+	if err != nil {
+		authLog.Error("generating bcrypt hash failed", "err", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to check password"})
+	}
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)); err != nil || user == nil {
+		recordLocalLoginFailure(ip, now)
+		authLog.Warn("failed local login", "user", req.Username, "ip", ip)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid username or password"})
+	}
+	resetLocalLoginFailures(ip)
+
+	session := SessionModel{
+		ID:           GenerateUUIDv7(),
+		Subject:      "local:" + user.Username,
+		Username:     user.Username,
+		CachedClaims: localUserClaims(user),
+		ExpiresAt:    now.Add(sessionMaxAge()),
+		IsLocal:      true,
+	}
+	if err := gormDB.Create(&session).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create session: " + err.Error()})
+	}
+
+	c.Cookie(secureForRequest(c, sessionCookie(session.ID, sessionMaxAge())))
+	authLog.Info("local user logged in", "user", user.Username, "ip", ip)
+	return c.JSON(fiber.Map{"ok": true})
+}
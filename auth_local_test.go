@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupLocalLoginTest configures local user alice (password "hunter2", group
+// "infra") with OIDC unset and serves the local login, /me and a protected
+// control route.
+func setupLocalLoginTest(t *testing.T) *fiber.App {
+	t.Helper()
+	setupTestDB(t)
+
+	prevConfig, prevOAuth2, prevProvider := GetConfig(), oauth2Config, oidcProvider
+	t.Cleanup(func() {
+		setConfig(prevConfig)
+		oauth2Config, oidcProvider = prevOAuth2, prevProvider
+		localLoginFailuresMutex.Lock()
+		localLoginFailures = map[string]*localLoginAttempts{}
+		localLoginFailuresMutex.Unlock()
+	})
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(&Config{Web: WebConfig{
+		PublicURL:  "http://localhost:8080",
+		LocalUsers: []LocalUser{{Username: "alice", PasswordHash: string(hash), Groups: []string{"infra"}}},
+	}})
+	oauth2Config, oidcProvider = nil, nil
+
+	app := fiber.New()
+	app.Use(RequireAuth)
+	app.Post("/api/v1/auth/login-local", handleLocalLogin)
+	app.Get("/api/v1/auth/me", handleMe)
+	app.Post("/api/v1/control-relay", func(c *fiber.Ctx) error {
+		groups, err := getUserGroups(c)
+		if err != nil {
+			return err
+		}
+		return c.SendString(strings.Join(groups, ","))
+	})
+	return app
+}
+
+func localLogin(t *testing.T, app *fiber.App, username, password string) *http.Response {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login-local", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	// bcrypt is slow under the race detector; don't time out.
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func sessionCookieFrom(resp *http.Response) string {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == CookieName {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestLocalLogin_Success(t *testing.T) {
+	app := setupLocalLoginTest(t)
+
+	resp := localLogin(t, app, "alice", "hunter2")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	sessionID := sessionCookieFrom(resp)
+	if sessionID == "" {
+		t.Fatal("no session cookie set")
+	}
+	var session SessionModel
+	if err := gormDB.First(&session, "id = ?", sessionID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsLocal || session.Username != "alice" || session.Subject != "local:alice" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+
+	// The session works for protected routes without OIDC and carries the
+	// configured groups.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/control-relay", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: sessionID})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(body) != "infra" {
+		t.Fatalf("protected route: status %d, groups %q", resp.StatusCode, body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/auth/me", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: sessionID})
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var me map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || me["username"] != "alice" || me["canControl"] != true || me["isTablet"] != false {
+		t.Fatalf("/me: status %d, body %v", resp.StatusCode, me)
+	}
+	if groups, _ := me["groups"].([]any); len(groups) != 1 || groups[0] != "infra" {
+		t.Fatalf("/me groups = %v", me["groups"])
+	}
+	expiresIn, _ := strconv.Atoi(resp.Header.Get("X-Session-Expires-In"))
+	if expiresIn <= 0 || float64(expiresIn) != me["sessionExpiresIn"] {
+		t.Fatalf("X-Session-Expires-In = %q, sessionExpiresIn = %v", resp.Header.Get("X-Session-Expires-In"), me["sessionExpiresIn"])
+	}
+}
+
+func TestLocalSession_ExtendedNearExpiry(t *testing.T) {
+	app := setupLocalLoginTest(t)
+	createTestSession(t, SessionModel{
+		ID: "local", Subject: "local:alice", Username: "alice", IsLocal: true,
+		CachedClaims: localUserClaims(&GetConfig().Web.LocalUsers[0]),
+		ExpiresAt:    time.Now().Add(time.Minute),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/me", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: "local"})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || sessionCookieFrom(resp) != "local" {
+		t.Fatalf("status %d, cookie %q; want the cookie re-issued", resp.StatusCode, sessionCookieFrom(resp))
+	}
+	var session SessionModel
+	gormDB.First(&session, "id = ?", "local")
+	if time.Until(session.ExpiresAt) < sessionMaxAge()-time.Minute {
+		t.Fatalf("session not extended, expires at %v", session.ExpiresAt)
+	}
+}
+
+func TestLocalLogin_WrongPassword(t *testing.T) {
+	app := setupLocalLoginTest(t)
+
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"mallory", "hunter2"}, {"", ""}} {
+		resp := localLogin(t, app, creds[0], creds[1])
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("login as %q/%q: status = %d, want 401", creds[0], creds[1], resp.StatusCode)
+		}
+		if sessionCookieFrom(resp) != "" {
+			t.Errorf("login as %q/%q set a session cookie", creds[0], creds[1])
+		}
+	}
+	var count int64
+	gormDB.Model(&SessionModel{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d sessions created by failed logins", count)
+	}
+}
+
+func TestLocalLogin_LocksOutAfterRepeatedFailures(t *testing.T) {
+	app := setupLocalLoginTest(t)
+
+	for i := 0; i < localLoginMaxFailures; i++ {
+		if resp := localLogin(t, app, "alice", "wrong"); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i+1, resp.StatusCode)
+		}
+	}
+	// Locked out now, even with the right password.
+	resp := localLogin(t, app, "alice", "hunter2")
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("status after %d failures = %d, want 429", localLoginMaxFailures, resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+}
+
+func TestLocalLoginFailures_ExpireAndReset(t *testing.T) {
+	setupLocalLoginTest(t)
+	now := time.Now()
+
+	for i := 0; i < localLoginMaxFailures; i++ {
+		recordLocalLoginFailure("10.0.0.1", now)
+	}
+	if localLoginLockedUntil("10.0.0.1", now).IsZero() {
+		t.Fatal("IP not locked out")
+	}
+	if !localLoginLockedUntil("10.0.0.2", now).IsZero() {
+		t.Fatal("lockout applied to another IP")
+	}
+	if !localLoginLockedUntil("10.0.0.1", now.Add(localLoginLockout+time.Second)).IsZero() {
+		t.Fatal("lockout did not end")
+	}
+
+	// A successful login forgets earlier failures.
+	for i := 0; i < localLoginMaxFailures-1; i++ {
+		recordLocalLoginFailure("10.0.0.3", now)
+	}
+	resetLocalLoginFailures("10.0.0.3")
+	recordLocalLoginFailure("10.0.0.3", now)
+	if !localLoginLockedUntil("10.0.0.3", now).IsZero() {
+		t.Fatal("failures before a successful login still counted")
+	}
+
+	// Failures spread out over more than the lockout window don't add up.
+	later := now
+	for i := 0; i < localLoginMaxFailures; i++ {
+		later = later.Add(localLoginLockout + time.Second)
+		recordLocalLoginFailure("10.0.0.4", later)
+	}
+	if !localLoginLockedUntil("10.0.0.4", later).IsZero() {
+		t.Fatal("stale failures counted towards the lockout")
+	}
+}
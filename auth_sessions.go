@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// sessionLastSeenInterval limits how often a session's LastSeenAt is written,
+// so busy clients don't cause a database write per request.
+const sessionLastSeenInterval = time.Minute
+
+// touchSession records that the session was just used.
+func touchSession(session *SessionModel, now time.Time) {
+	if now.Sub(session.LastSeenAt) < sessionLastSeenInterval {
+		return
+	}
+	session.LastSeenAt = now
+	if err := gormDB.Model(session).Update("last_seen_at", now).Error; err != nil {
+		authLog.Warn("updating last-seen time of session failed", "err", err)
+	}
+}
+
+// sessionHandle is the opaque ID a session is listed and revoked by. The
+// session ID itself is the credential, so it is never exposed.
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sessionInfo is a session as listed by handleListSessions; neither tokens
+// nor the session ID are exposed. ID is the sessionHandle.
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	IsTablet   bool      `json:"is_tablet"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current marks the session the request was made with.
+	Current bool `json:"current"`
+}
+
+// isSessionAdmin reports whether the logged-in user is in one of the
+// configured oidc.admin_groups.
+func isSessionAdmin(c *fiber.Ctx) bool {
+	if GetConfig().Oidc == nil || len(GetConfig().Oidc.AdminGroups) == 0 {
+		return false
+	}
+	groups, err := getUserGroups(c)
+	if err != nil {
+		return false
+	}
+	for _, group := range groups {
+		if slices.Contains(GetConfig().Oidc.AdminGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuthMiddleware lets through users in oidc.admin_groups. It goes
+// after AuthMiddleware.
+func AdminAuthMiddleware(c *fiber.Ctx) error {
+	if !isSessionAdmin(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
+	}
+	return c.Next()
+}
+
+// visibleSessions scopes a session query to what the user may see: all
+// sessions for admins, otherwise the sessions of the same OIDC subject. A
+// tablet only sees itself, as all tablets share one subject.
+func visibleSessions(c *fiber.Ctx) *gorm.DB {
+	current := c.Locals("session").(*SessionModel)
+	query := gormDB.Model(&SessionModel{})
+	switch {
+	case isSessionAdmin(c):
+		return query
+	case current.IsTablet:
+		return query.Where("id = ?", current.ID)
+	default:
+		return query.Where("subject = ? AND is_tablet = ?", current.Subject, false)
+	}
+}
+
+// handleListSessions lists the sessions visible to the logged-in user. It is
+// registered behind AuthMiddleware.
+func handleListSessions(c *fiber.Ctx) error {
+	var sessions []SessionModel
+	if err := visibleSessions(c).Order("created_at DESC").Find(&sessions).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	current := c.Locals("session").(*SessionModel)
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, sessionInfo{
+			ID:         sessionHandle(s.ID),
+			Username:   s.Username,
+			IsTablet:   s.IsTablet,
+			CreatedAt:  s.CreatedAt,
+			ExpiresAt:  s.ExpiresAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    s.ID == current.ID,
+		})
+	}
+	return c.JSON(infos)
+}
+
+// handleRevokeSession deletes a session visible to the logged-in user by its
+// sessionHandle; the next request made with it is rejected. It is registered
+// behind AuthMiddleware.
+func handleRevokeSession(c *fiber.Ctx) error {
+	handle := c.Params("id")
+	var ids []string
+	if err := visibleSessions(c).Pluck("id", &ids).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	i := slices.IndexFunc(ids, func(id string) bool { return sessionHandle(id) == handle })
+	if i < 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+	}
+	if err := gormDB.Delete(&SessionModel{}, "id = ?", ids[i]).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	authLog.Info("session revoked", "user", c.Locals("username"), "session", handle)
+	return c.SendStatus(fiber.StatusOK)
+}
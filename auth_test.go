@@ -0,0 +1,925 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB points gormDB at a fresh in-memory database for the test.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	prevDB := gormDB
+	t.Cleanup(func() { gormDB = prevDB })
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AutoMigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+	gormDB = db
+}
+
+// fakeOIDCProvider is a minimal OpenID provider: discovery, JWKS, a token
+// endpoint issuing RS256-signed ID tokens, and userinfo.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu sync.Mutex
+	// nonce is put into the next ID token.
+	nonce string
+	// tokenForms records every request to the token endpoint.
+	tokenForms []url.Values
+	// rejectRefresh makes refresh token grants fail like for a disabled user.
+	rejectRefresh bool
+	// refreshStatus, when set, makes refresh token grants fail with this
+	// status, like an IdP that is down.
+	refreshStatus int
+	// rotateRefresh issues a new refresh token on every refresh and rejects
+	// reuse of spent ones.
+	rotateRefresh bool
+	spentRefresh  map[string]bool
+	// refreshDelay holds refresh token grants, so concurrent requests overlap.
+	refreshDelay time.Duration
+	// endSession advertises an end_session_endpoint in the discovery document.
+	endSession bool
+}
+
+func newFakeOIDCProvider(t *testing.T, clientID string) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key, clientID: clientID, spentRefresh: map[string]bool{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		doc := map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"userinfo_endpoint":                     p.URL + "/userinfo",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		}
+		p.mu.Lock()
+		if p.endSession {
+			doc["end_session_endpoint"] = p.URL + "/logout"
+		}
+		p.mu.Unlock()
+		writeTestJSON(w, doc)
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		p.tokenForms = append(p.tokenForms, r.PostForm)
+		nonce, rejectRefresh, refreshStatus, delay := p.nonce, p.rejectRefresh, p.refreshStatus, p.refreshDelay
+		refreshToken := "refresh"
+		isRefresh := r.PostForm.Get("grant_type") == "refresh_token"
+		if isRefresh && p.rotateRefresh {
+			spent := r.PostForm.Get("refresh_token")
+			rejectRefresh = rejectRefresh || p.spentRefresh[spent]
+			p.spentRefresh[spent] = true
+			refreshToken = fmt.Sprintf("refresh-%d", len(p.tokenForms))
+		}
+		p.mu.Unlock()
+
+		if isRefresh {
+			time.Sleep(delay)
+		}
+		if isRefresh && refreshStatus != 0 {
+			w.WriteHeader(refreshStatus)
+			return
+		}
+		if rejectRefresh && isRefresh {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		now := time.Now()
+		writeTestJSON(w, map[string]any{
+			"access_token":  "access-" + r.PostForm.Get("grant_type"),
+			"token_type":    "Bearer",
+			"refresh_token": refreshToken,
+			"expires_in":    3600,
+			"id_token": p.sign(t, map[string]any{
+				"iss":                p.URL,
+				"aud":                p.clientID,
+				"sub":                "user-1",
+				"sid":                "idp-session-1",
+				"preferred_username": "alice",
+				"groups":             []string{"infra"},
+				"nonce":              nonce,
+				"iat":                now.Unix(),
+				"exp":                now.Add(time.Hour).Unix(),
+			}),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]any{"sub": "user-1", "preferred_username": "alice"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) setNonce(nonce string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonce = nonce
+}
+
+func (p *fakeOIDCProvider) setRejectRefresh(reject bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rejectRefresh = reject
+}
+
+func (p *fakeOIDCProvider) tokenRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tokenForms)
+}
+
+func (p *fakeOIDCProvider) lastTokenForm() url.Values {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.tokenForms) == 0 {
+		return nil
+	}
+	return p.tokenForms[len(p.tokenForms)-1]
+}
+
+// sign encodes claims as an RS256 JWT.
+func (p *fakeOIDCProvider) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// setupOIDCTest configures authentication against a fake provider and returns
+// an app serving the login and callback routes.
+func setupOIDCTest(t *testing.T) (*fiber.App, *fakeOIDCProvider) {
+	t.Helper()
+	setupTestDB(t)
+	prevCfg, prevOauth2, prevProvider, prevEndSession := GetConfig(), oauth2Config, oidcProvider, oidcEndSessionURL
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		oauth2Config, oidcProvider, oidcEndSessionURL = prevOauth2, prevProvider, prevEndSession
+	})
+
+	provider := newFakeOIDCProvider(t, "at2")
+	setConfig(&Config{
+		Web:  WebConfig{PublicURL: "http://at2.test"},
+		Oidc: &OidcConfig{ClientID: "at2", ClientSecret: "secret", IssuerURL: provider.URL},
+	})
+	if err := initAuth(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/api/v1/auth/login", handleLoginRequest)
+	app.Get("/api/v1/auth/callback", handleAuthCallback)
+	app.Get("/api/v1/auth/logout", handleLogout)
+	app.Post("/api/v1/auth/logout", handleLogout)
+	return app, provider
+}
+
+// startLogin requests the login redirect and returns the authorization URL
+// parameters and the state cookie it set.
+func startLogin(t *testing.T, app *fiber.App, redirect string) (url.Values, *http.Cookie) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/auth/login?redirect="+url.QueryEscape(redirect), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("login status = %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcStateCookieName {
+			return location.Query(), cookie
+		}
+	}
+	t.Fatalf("login did not set the %s cookie", oidcStateCookieName)
+	return nil, nil
+}
+
+func finishLogin(t *testing.T, app *fiber.App, state, stateCookie string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/callback?code=abc&state="+url.QueryEscape(state), nil)
+	if stateCookie != "" {
+		req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: stateCookie})
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOIDCLogin_RoundTrip(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+
+	params, cookie := startLogin(t, app, "/rooms/hall")
+	state, nonce := params.Get("state"), params.Get("nonce")
+	if state == "" || state == "state" || nonce == "" || cookie.Value != state {
+		t.Fatalf("expected random state and nonce, got state=%q nonce=%q cookie=%q", state, nonce, cookie.Value)
+	}
+	provider.setNonce(nonce)
+
+	resp := finishLogin(t, app, state, cookie.Value)
+	if resp.StatusCode != fiber.StatusFound || resp.Header.Get("Location") != "/rooms/hall" {
+		t.Fatalf("callback = %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var session SessionModel
+	if err := gormDB.First(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "alice" || session.Subject != "user-1" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+	// Userinfo has no groups; they come from the ID token.
+	if !strings.Contains(session.CachedClaims, `"groups":["infra"]`) {
+		t.Fatalf("groups claim not cached: %s", session.CachedClaims)
+	}
+
+	// A state can only be used once.
+	if resp := finishLogin(t, app, state, cookie.Value); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("replayed state: status = %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCCallback_RejectsStateMismatch(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+
+	params, _ := startLogin(t, app, "/")
+	provider.setNonce(params.Get("nonce"))
+	// The attacker's state arrives in a browser that never started it.
+	if resp := finishLogin(t, app, params.Get("state"), ""); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("missing state cookie: status = %d", resp.StatusCode)
+	}
+	if resp := finishLogin(t, app, params.Get("state"), "forged"); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("mismatched state cookie: status = %d", resp.StatusCode)
+	}
+	if resp := finishLogin(t, app, "forged", "forged"); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("unknown state: status = %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCCallback_RejectsNonceMismatch(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+
+	params, cookie := startLogin(t, app, "/")
+	provider.setNonce("replayed-id-token")
+	if resp := finishLogin(t, app, params.Get("state"), cookie.Value); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("nonce mismatch: status = %d", resp.StatusCode)
+	}
+	var count int64
+	gormDB.Model(&SessionModel{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no session to be created, got %d", count)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	cases := map[string]string{
+		"":                   "/",
+		"/rooms/hall?x=1":    "/rooms/hall?x=1",
+		"https://evil.test":  "/",
+		"//evil.test/path":   "/",
+		"/\\evil.test":       "/",
+		"javascript:alert()": "/",
+	}
+	for in, want := range cases {
+		if got := safeRedirect(in); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestOIDCLogin_PKCE(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+
+	params, cookie := startLogin(t, app, "/")
+	state := params.Get("state")
+	pendingLoginsMutex.Lock()
+	verifier := pendingLogins[state].verifier
+	pendingLoginsMutex.Unlock()
+
+	if params.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q", params.Get("code_challenge_method"))
+	}
+	digest := sha256.Sum256([]byte(verifier))
+	if want := base64.RawURLEncoding.EncodeToString(digest[:]); params.Get("code_challenge") != want {
+		t.Fatalf("code_challenge = %q, want S256(verifier) = %q", params.Get("code_challenge"), want)
+	}
+
+	provider.setNonce(params.Get("nonce"))
+	if resp := finishLogin(t, app, state, cookie.Value); resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("callback status = %d", resp.StatusCode)
+	}
+	if got := provider.lastTokenForm().Get("code_verifier"); got == "" || got != verifier {
+		t.Fatalf("token exchange sent code_verifier %q, want %q", got, verifier)
+	}
+}
+
+// authedStatus requests a route guarded by AuthMiddleware with the given
+// session cookie.
+func authedStatus(t *testing.T, app *fiber.App, sessionID string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: sessionID})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func setupSessionTest(t *testing.T) (*fiber.App, *fakeOIDCProvider) {
+	t.Helper()
+	app, provider := setupOIDCTest(t)
+	app.Get("/protected", AuthMiddleware, func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("username").(string))
+	})
+	return app, provider
+}
+
+func TestAuthMiddleware_RefreshesTokenNearExpiry(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "old", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+
+	if status := authedStatus(t, app, "s1"); status != fiber.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	form := provider.lastTokenForm()
+	if form.Get("grant_type") != "refresh_token" || form.Get("refresh_token") != "refresh-old" {
+		t.Fatalf("unexpected token request: %v", form)
+	}
+	var session SessionModel
+	gormDB.First(&session, "id = ?", "s1")
+	if session.AccessToken != "access-refresh_token" || session.RefreshToken != "refresh" || time.Until(session.ExpiresAt) < 50*time.Minute {
+		t.Fatalf("session not updated with refreshed tokens: %+v", session)
+	}
+}
+
+func TestAuthMiddleware_KeepsFreshToken(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "current", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	if status := authedStatus(t, app, "s1"); status != fiber.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	if form := provider.lastTokenForm(); form != nil {
+		t.Fatalf("fresh token should not be refreshed, got request %v", form)
+	}
+}
+
+func TestAuthMiddleware_FailedRefreshEndsSession(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	provider.setRejectRefresh(true)
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "old", RefreshToken: "revoked",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	if status := authedStatus(t, app, "s1"); status != fiber.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+	var count int64
+	gormDB.Model(&SessionModel{}).Where("id = ?", "s1").Count(&count)
+	if count != 0 {
+		t.Fatalf("session of revoked user was kept")
+	}
+}
+
+func TestAuthMiddleware_RefreshWindowReissuesCookie(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "current", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+	})
+	request := func() *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: "s1"})
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Outside the default 5 minute window: nothing happens.
+	if resp := request(); sessionCookieFrom(resp) != "" || provider.lastTokenForm() != nil {
+		t.Fatalf("session refreshed outside the window (cookie %q)", sessionCookieFrom(resp))
+	}
+
+	GetConfig().Web.SessionRefreshWindow = "15m"
+	resp := request()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if form := provider.lastTokenForm(); form.Get("grant_type") != "refresh_token" {
+		t.Fatalf("no refresh inside the window, token request %v", form)
+	}
+	if got := sessionCookieFrom(resp); got != "s1" {
+		t.Fatalf("session cookie not re-issued after refresh, got %q", got)
+	}
+}
+
+func TestAuthMiddleware_ConcurrentRequestsShareRefresh(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	// Every request must see the same in-memory database.
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	provider.mu.Lock()
+	provider.rotateRefresh = true
+	provider.refreshDelay = 100 * time.Millisecond
+	provider.mu.Unlock()
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "old", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+			req.AddCookie(&http.Cookie{Name: CookieName, Value: "s1"})
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.StatusCode != fiber.StatusOK {
+				t.Errorf("status = %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := provider.tokenRequests(); n != 1 {
+		t.Fatalf("%d token requests, want one shared refresh", n)
+	}
+	var session SessionModel
+	if err := gormDB.First(&session, "id = ?", "s1").Error; err != nil {
+		t.Fatalf("session lost: %v", err)
+	}
+	if session.RefreshToken != "refresh-1" {
+		t.Fatalf("refresh token = %q, want the rotated one", session.RefreshToken)
+	}
+}
+
+func TestAuthMiddleware_TransientRefreshErrorKeepsSession(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	provider.mu.Lock()
+	provider.refreshStatus = http.StatusServiceUnavailable
+	provider.mu.Unlock()
+	createTestSession(t, SessionModel{
+		ID: "valid", Subject: "user-1", Username: "alice",
+		AccessToken: "current", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(time.Minute),
+	})
+	createTestSession(t, SessionModel{
+		ID: "lapsed", Subject: "user-1", Username: "alice",
+		AccessToken: "old", RefreshToken: "refresh-old",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	// The access token is still valid, so the request is served.
+	if status := authedStatus(t, app, "valid"); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	// It has lapsed: refused until the IdP is back, but not logged out.
+	if status := authedStatus(t, app, "lapsed"); status != fiber.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", status)
+	}
+	var count int64
+	gormDB.Model(&SessionModel{}).Count(&count)
+	if count != 2 {
+		t.Fatalf("%d sessions left, transient refresh errors must not end sessions", count)
+	}
+
+	provider.mu.Lock()
+	provider.refreshStatus = 0
+	provider.mu.Unlock()
+	if status := authedStatus(t, app, "lapsed"); status != fiber.StatusOK {
+		t.Fatalf("status after the IdP recovered = %d, want 200", status)
+	}
+}
+
+func TestAuthMiddleware_SessionWithoutRefreshTokenLasts(t *testing.T) {
+	app, provider := setupSessionTest(t)
+	createTestSession(t, SessionModel{
+		ID: "s1", Subject: "user-1", Username: "alice",
+		AccessToken: "old",
+		ExpiresAt:   time.Now().Add(-time.Hour),
+	})
+	createTestSession(t, SessionModel{
+		ID: "abandoned", Subject: "user-1", Username: "alice",
+		AccessToken: "old",
+		ExpiresAt:   time.Now().Add(-sessionMaxAge() - time.Hour),
+	})
+
+	if status := authedStatus(t, app, "s1"); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if form := provider.lastTokenForm(); form != nil {
+		t.Fatalf("refresh attempted without a refresh token: %v", form)
+	}
+	if status := authedStatus(t, app, "abandoned"); status != fiber.StatusUnauthorized {
+		t.Fatalf("status of abandoned session = %d, want 401", status)
+	}
+}
+
+func TestExtractUserInfo(t *testing.T) {
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	setConfig(&Config{Oidc: &OidcConfig{
+		UsernameClaim:                      "nickname",
+		GroupsClaim:                        "roles",
+		MembershipExpirationTimestampClaim: "membership_expiration",
+	}})
+
+	info := extractUserInfo(map[string]interface{}{
+		"nickname":              "alice",
+		"email":                 "alice@example.com",
+		"roles":                 []interface{}{"infra", "members"},
+		"membership_expiration": float64(1767225600),
+	})
+	if info["username"] != "alice" || info["email"] != "alice@example.com" || info["membershipExpirationTimestamp"] != float64(1767225600) {
+		t.Fatalf("unexpected user info: %v", info)
+	}
+	if groups, _ := info["groups"].([]string); len(groups) != 2 || groups[0] != "infra" || groups[1] != "members" {
+		t.Fatalf("groups = %v", info["groups"])
+	}
+
+	// Missing claims give empty values rather than nulls.
+	info = extractUserInfo(map[string]interface{}{"nickname": "bob"})
+	if groups, ok := info["groups"].([]string); !ok || len(groups) != 0 || info["email"] != "" {
+		t.Fatalf("unexpected user info without claims: %v", info)
+	}
+}
+
+func TestCleanupExpiredSessions(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	for _, s := range []SessionModel{
+		{ID: "tablet-expired", Subject: "tablet", Username: "tablet", IsTablet: true, ExpiresAt: now.Add(-time.Hour)},
+		{ID: "tablet-valid", Subject: "tablet", Username: "tablet", IsTablet: true, ExpiresAt: now.Add(time.Hour)},
+		// The access token lapsed, but the refresh token may still be good.
+		{ID: "oidc-refreshable", Subject: "u", Username: "u", ExpiresAt: now.Add(-time.Hour)},
+		{ID: "oidc-abandoned", Subject: "u", Username: "u", ExpiresAt: now.Add(-sessionIdleTimeout - time.Hour)},
+		{ID: "local-expired", Subject: "local:alice", Username: "alice", IsLocal: true, ExpiresAt: now.Add(-time.Hour)},
+	} {
+		createTestSession(t, s)
+	}
+
+	n, err := cleanupExpiredSessions(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("removed %d sessions, want 3", n)
+	}
+	var kept []SessionModel
+	gormDB.Order("id").Find(&kept)
+	if len(kept) != 2 || kept[0].ID != "oidc-refreshable" || kept[1].ID != "tablet-valid" {
+		t.Fatalf("unexpected remaining sessions: %+v", kept)
+	}
+}
+
+// requireAuthApp serves a protected and an open route behind RequireAuth.
+func requireAuthApp() *fiber.App {
+	app := fiber.New()
+	app.Use(RequireAuth)
+	ok := func(c *fiber.Ctx) error {
+		username, _ := c.Locals("username").(string)
+		return c.SendString(username)
+	}
+	app.Post("/api/v1/control-relay", ok)
+	app.Get("/api/v1/debug/ws-clients", ok)
+	app.Get("/api/v1/room-states", ok)
+	app.Get("/api/v1/stats/usage-heatmap", ok)
+	app.Get("/api/v1/all-devices", ok)
+	return app
+}
+
+func requireAuthStatus(t *testing.T, app *fiber.App, method, target string, header http.Header) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header = header
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestRequireAuth_ProtectsDefaultPaths(t *testing.T) {
+	setupOIDCTest(t)
+	createTestSession(t, SessionModel{ID: "s1", Subject: "user-1", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	app := requireAuthApp()
+
+	cookie := http.Header{"Cookie": {CookieName + "=s1"}}
+	bearer := http.Header{"Authorization": {"Bearer s1"}}
+	forged := http.Header{"Cookie": {CookieName + "=forged"}}
+	cases := []struct {
+		method, target string
+		header         http.Header
+		want           int
+	}{
+		{http.MethodPost, "/api/v1/control-relay", nil, fiber.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/control-relay", forged, fiber.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/control-relay", cookie, fiber.StatusOK},
+		{http.MethodPost, "/api/v1/control-relay", bearer, fiber.StatusOK},
+		{http.MethodPost, "/API/V1/Control-Relay", nil, fiber.StatusUnauthorized},
+		{http.MethodPost, "/API/V1/Control-Relay", cookie, fiber.StatusOK},
+		{http.MethodGet, "/api/v1/debug/ws-clients", nil, fiber.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/debug/ws-clients", cookie, fiber.StatusOK},
+		{http.MethodGet, "/api/v1/room-states", nil, fiber.StatusOK},
+	}
+	for _, tc := range cases {
+		if got := requireAuthStatus(t, app, tc.method, tc.target, tc.header); got != tc.want {
+			t.Errorf("%s %s with %v = %d, want %d", tc.method, tc.target, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestRequireAuth_ConfiguredPaths(t *testing.T) {
+	setupOIDCTest(t)
+	GetConfig().Web.ProtectedPaths = []string{"/api/v1/stats", "/api/v1/All-Devices"}
+	app := requireAuthApp()
+
+	if got := requireAuthStatus(t, app, http.MethodGet, "/api/v1/stats/usage-heatmap", nil); got != fiber.StatusUnauthorized {
+		t.Errorf("configured path: status = %d, want 401", got)
+	}
+	// Fiber routes these to the same handlers, whatever the case.
+	for _, target := range []string{"/API/v1/all-devices", "/api/v1/all-devices", "/Api/V1/Stats/usage-heatmap"} {
+		if got := requireAuthStatus(t, app, http.MethodGet, target, nil); got != fiber.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", target, got)
+		}
+	}
+	if got := requireAuthStatus(t, app, http.MethodPost, "/api/v1/control-relay", nil); got != fiber.StatusOK {
+		t.Errorf("path dropped from the list: status = %d, want 200", got)
+	}
+}
+
+func TestRequireAuth_FailsClosedWithoutOIDC(t *testing.T) {
+	setupOIDCTest(t)
+	oauth2Config, oidcProvider = nil, nil
+	createTestSession(t, SessionModel{ID: "oidc", Subject: "user-1", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	createTestSession(t, SessionModel{ID: "tablet", Subject: "tablet", Username: "tablet", IsTablet: true, ExpiresAt: time.Now().Add(time.Hour)})
+	app := requireAuthApp()
+
+	if got := requireAuthStatus(t, app, http.MethodPost, "/api/v1/control-relay", http.Header{"Cookie": {CookieName + "=oidc"}}); got != fiber.StatusUnauthorized {
+		t.Errorf("OIDC session without OIDC configured: status = %d, want 401", got)
+	}
+	if got := requireAuthStatus(t, app, http.MethodPost, "/api/v1/control-relay", http.Header{"Cookie": {CookieName + "=tablet"}}); got != fiber.StatusOK {
+		t.Errorf("tablet session: status = %d, want 200", got)
+	}
+}
+
+// loginForTest runs the whole login flow and returns the new session.
+func loginForTest(t *testing.T, app *fiber.App, provider *fakeOIDCProvider) SessionModel {
+	t.Helper()
+	params, cookie := startLogin(t, app, "/")
+	provider.setNonce(params.Get("nonce"))
+	if resp := finishLogin(t, app, params.Get("state"), cookie.Value); resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("callback status = %d", resp.StatusCode)
+	}
+	var session SessionModel
+	if err := gormDB.First(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func logout(t *testing.T, app *fiber.App, method, sessionID string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/auth/logout", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: sessionID})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	gormDB.Model(&SessionModel{}).Where("id = ?", sessionID).Count(&count)
+	if count != 0 {
+		t.Fatalf("session still exists after logout")
+	}
+	return resp
+}
+
+func TestLogout_RedirectsToEndSessionEndpoint(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+	provider.mu.Lock()
+	provider.endSession = true
+	provider.mu.Unlock()
+	if err := initAuth(); err != nil {
+		t.Fatal(err)
+	}
+	session := loginForTest(t, app, provider)
+	if session.IDToken == "" {
+		t.Fatalf("ID token not stored in the session")
+	}
+
+	resp := logout(t, app, http.MethodGet, session.ID)
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("status = %d, want 302", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	if location.Host != strings.TrimPrefix(provider.URL, "http://") || location.Path != "/logout" {
+		t.Fatalf("redirected to %s, want the end_session_endpoint", location)
+	}
+	if q.Get("id_token_hint") != session.IDToken || q.Get("post_logout_redirect_uri") != "http://at2.test/" || q.Get("client_id") != "at2" {
+		t.Fatalf("unexpected end-session parameters: %v", q)
+	}
+}
+
+func TestLogout_WithoutEndSessionEndpoint(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+	if oidcEndSessionURL != "" {
+		t.Fatalf("provider does not advertise an end_session_endpoint, got %q", oidcEndSessionURL)
+	}
+
+	session := loginForTest(t, app, provider)
+	if resp := logout(t, app, http.MethodGet, session.ID); resp.StatusCode != fiber.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("GET logout = %d to %q, want 302 to /", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	session = loginForTest(t, app, provider)
+	if resp := logout(t, app, http.MethodPost, session.ID); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("POST logout = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestSessionsListingAndRevocation(t *testing.T) {
+	setupOIDCTest(t)
+	GetConfig().Oidc.AdminGroups = []string{"admin"}
+	expires := time.Now().Add(time.Hour)
+	for _, s := range []SessionModel{
+		{ID: "alice-1", Subject: "u-alice", Username: "alice", ExpiresAt: expires, CachedClaims: `{"groups":["members"]}`},
+		{ID: "alice-2", Subject: "u-alice", Username: "alice", ExpiresAt: expires},
+		{ID: "bob", Subject: "u-bob", Username: "bob", ExpiresAt: expires, CachedClaims: `{"groups":["admin"]}`},
+		{ID: "tablet", Subject: "tablet", Username: "tablet", IsTablet: true, ExpiresAt: expires},
+	} {
+		createTestSession(t, s)
+	}
+
+	app := fiber.New()
+	app.Get("/api/v1/auth/sessions", AuthMiddleware, handleListSessions)
+	app.Delete("/api/v1/auth/sessions/:id", AuthMiddleware, handleRevokeSession)
+	do := func(method, target, sessionID string) *http.Response {
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: sessionID})
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	list := func(sessionID string) []sessionInfo {
+		resp := do(http.MethodGet, "/api/v1/auth/sessions", sessionID)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("list as %s: status = %d", sessionID, resp.StatusCode)
+		}
+		var infos []sessionInfo
+		if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	own := list("alice-1")
+	if len(own) != 2 {
+		t.Fatalf("alice should see her 2 sessions, got %+v", own)
+	}
+	for _, s := range own {
+		if s.Username != "alice" || s.Current != (s.ID == sessionHandle("alice-1")) || strings.HasPrefix(s.ID, "alice") {
+			t.Fatalf("unexpected session in alice's list: %+v", s)
+		}
+	}
+	if all := list("bob"); len(all) != 4 {
+		t.Fatalf("admin should see all 4 sessions, got %d", len(all))
+	}
+	if tablet := list("tablet"); len(tablet) != 1 || tablet[0].ID != sessionHandle("tablet") {
+		t.Fatalf("tablet should only see itself, got %+v", tablet)
+	}
+
+	if resp := do(http.MethodDelete, "/api/v1/auth/sessions/"+sessionHandle("bob"), "alice-1"); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("revoking someone else's session: status = %d, want 404", resp.StatusCode)
+	}
+	// Sessions are revoked by handle, never by the credential itself.
+	if resp := do(http.MethodDelete, "/api/v1/auth/sessions/alice-2", "alice-1"); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("revoking by session ID: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/api/v1/auth/sessions/"+sessionHandle("alice-2"), "alice-1"); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("revoking own session: status = %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/api/v1/auth/sessions", "alice-2"); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("revoked session still accepted: status = %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/api/v1/auth/sessions/"+sessionHandle("tablet"), "bob"); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("admin revoking a tablet: status = %d", resp.StatusCode)
+	}
+}
+
+func TestTouchSession_WritesAtMostOncePerInterval(t *testing.T) {
+	setupTestDB(t)
+	createTestSession(t, SessionModel{ID: "s1", Subject: "u", Username: "u", ExpiresAt: time.Now().Add(time.Hour)})
+	lastSeen := func() time.Time {
+		var s SessionModel
+		gormDB.First(&s, "id = ?", "s1")
+		return s.LastSeenAt
+	}
+
+	var session SessionModel
+	gormDB.First(&session, "id = ?", "s1")
+	now := time.Now()
+	touchSession(&session, now)
+	if !lastSeen().Equal(now) {
+		t.Fatalf("first use not recorded: %v", lastSeen())
+	}
+	touchSession(&session, now.Add(30*time.Second))
+	if !lastSeen().Equal(now) {
+		t.Fatalf("last-seen rewritten within the interval: %v", lastSeen())
+	}
+	later := now.Add(sessionLastSeenInterval + time.Second)
+	touchSession(&session, later)
+	if !lastSeen().Equal(later) {
+		t.Fatalf("last-seen not updated after the interval: %v", lastSeen())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// autoOffCheckInterval is how often due auto-off timers are looked for.
+	autoOffCheckInterval = 15 * time.Second
+	// autoOffRetryInterval is how long to wait for a relay to report OFF
+	// before sending the command again.
+	autoOffRetryInterval = time.Minute
+)
+
+// AutoOffService turns relays with auto_off_minutes off once they have been
+// on for that long, however they were switched on. The deadline is kept in
+// the device's AutoOffAt.
+type AutoOffService struct {
+	vdev *VdevManager
+	// control switches a relay; MQTTAdapter.ControlDevice outside tests.
+	control   func(deviceID string, state any) error
+	durations map[string]time.Duration
+	log       *slog.Logger
+}
+
+// validateAutoOff fails fast on negative auto-off times.
+func validateAutoOff(cfg *Config, cfgPath string) error {
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.AutoOffMinutes < 0 {
+				return fmt.Errorf("entity %s has negative auto_off_minutes in %s", ent.ID, cfgPath)
+			}
+		}
+	}
+	return nil
+}
+
+// NewAutoOffService creates the service for the entities with
+// auto_off_minutes.
+func NewAutoOffService(cfg *Config, vdev *VdevManager, control func(deviceID string, state any) error, logger *slog.Logger) *AutoOffService {
+	s := &AutoOffService{
+		vdev:      vdev,
+		control:   control,
+		durations: map[string]time.Duration{},
+		log:       logger,
+	}
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.AutoOffMinutes > 0 {
+				s.durations[ent.ID] = time.Duration(ent.AutoOffMinutes) * time.Minute
+			}
+		}
+	}
+	return s
+}
+
+// Start registers for device changes and periodically turns off relays whose
+// time is up. It does nothing when no entity has auto_off_minutes.
+func (s *AutoOffService) Start() {
+	if len(s.durations) == 0 {
+		return
+	}
+	s.vdev.OnVirtualDeviceUpdated = append(s.vdev.OnVirtualDeviceUpdated, s.onDeviceUpdate)
+	go func() {
+		ticker := time.NewTicker(autoOffCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.check(time.Now())
+		}
+	}()
+	s.log.Info("watching relays", "count", len(s.durations))
+}
+
+func (s *AutoOffService) onDeviceUpdate(v *VirtualDevice) {
+	if v == nil {
+		return
+	}
+	s.update(v, time.Now())
+}
+
+// update starts the timer of a relay that turned on and cancels it when the
+// relay turned off. Optimistic states wait for the device to confirm them.
+// A relay reported on again while its timer runs keeps the deadline, so a
+// reverted OFF command doesn't grant it another full period.
+func (s *AutoOffService) update(v *VirtualDevice, now time.Time) {
+	d, ok := s.durations[v.ID]
+	if !ok || v.Pending {
+		return
+	}
+	switch {
+	case !isLightOn(v.State):
+		s.vdev.SetAutoOffAt(v.ID, time.Time{})
+	case v.AutoOffAt.IsZero():
+		s.vdev.SetAutoOffAt(v.ID, now.Add(d))
+	}
+}
+
+// check turns off the relays whose deadline has passed. Relays found on
+// without a deadline were on before at2 started (their state was restored)
+// and count from when that state was recorded.
+func (s *AutoOffService) check(now time.Time) {
+	for _, dev := range s.vdev.Devices() {
+		d, ok := s.durations[dev.ID]
+		if !ok || !isLightOn(dev.State) {
+			continue
+		}
+		deadline := dev.AutoOffAt
+		if deadline.IsZero() {
+			since := dev.LastUpdatedAt
+			if since.IsZero() {
+				since = now
+			}
+			deadline = since.Add(d)
+			s.vdev.SetAutoOffAt(dev.ID, deadline)
+		}
+		if now.Before(deadline) {
+			continue
+		}
+
+		s.log.Info("turning off", "device", dev.ID, "after", d)
+		if err := s.control(dev.ID, "OFF"); err != nil {
+			s.log.Warn("turning off failed", "device", dev.ID, "err", err)
+		}
+		// The OFF report cancels the timer; until then, try again later.
+		s.vdev.SetAutoOffAt(dev.ID, now.Add(autoOffRetryInterval))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setupAutoOffTest returns a service switching off "relay/solder" after two
+// hours and the list of devices it sent OFF to.
+func setupAutoOffTest(t *testing.T, dev *VirtualDevice) (*AutoOffService, *[]string) {
+	t.Helper()
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{dev, {ID: "relay/other", Type: VdevTypeRelay, State: "ON"}})
+	cfg := &Config{Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{
+		{ID: "relay/solder", AutoOffMinutes: 120},
+		{ID: "relay/other"},
+	}}}}
+	var turnedOff []string
+	s := NewAutoOffService(cfg, vm, func(deviceID string, state any) error {
+		if state != "OFF" {
+			t.Fatalf("auto-off sent %v to %s", state, deviceID)
+		}
+		turnedOff = append(turnedOff, deviceID)
+		return nil
+	}, testLogger)
+	return s, &turnedOff
+}
+
+func TestAutoOff_Refresh(t *testing.T) {
+	s, turnedOff := setupAutoOffTest(t, &VirtualDevice{ID: "relay/solder", Type: VdevTypeRelay, State: "OFF"})
+	t0 := time.Unix(1_700_000_000, 0)
+
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/solder", State: "ON"}})
+	s.update(s.vdev.Device("relay/solder"), t0)
+	if at := s.vdev.Device("relay/solder").AutoOffAt; !at.Equal(t0.Add(2 * time.Hour)) {
+		t.Fatalf("AutoOffAt = %v", at)
+	}
+
+	// Turning off and on again restarts the period.
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/solder", State: "OFF"}})
+	s.update(s.vdev.Device("relay/solder"), t0.Add(time.Hour))
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/solder", State: "ON"}})
+	s.update(s.vdev.Device("relay/solder"), t0.Add(time.Hour))
+
+	s.check(t0.Add(2 * time.Hour))
+	if len(*turnedOff) != 0 {
+		t.Fatalf("turned off before the refreshed deadline: %v", *turnedOff)
+	}
+	s.check(t0.Add(3 * time.Hour))
+	if len(*turnedOff) != 1 || (*turnedOff)[0] != "relay/solder" {
+		t.Fatalf("turned off %v", *turnedOff)
+	}
+	// Until the relay reports OFF, the command is retried later.
+	if at := s.vdev.Device("relay/solder").AutoOffAt; !at.Equal(t0.Add(3*time.Hour + autoOffRetryInterval)) {
+		t.Fatalf("AutoOffAt after command = %v", at)
+	}
+}
+
+func TestAutoOff_Cancel(t *testing.T) {
+	s, turnedOff := setupAutoOffTest(t, &VirtualDevice{ID: "relay/solder", Type: VdevTypeRelay, State: "OFF"})
+	t0 := time.Unix(1_700_000_000, 0)
+
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/solder", State: "ON"}})
+	s.update(s.vdev.Device("relay/solder"), t0)
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/solder", State: "OFF"}})
+	s.update(s.vdev.Device("relay/solder"), t0.Add(time.Minute))
+	if at := s.vdev.Device("relay/solder").AutoOffAt; !at.IsZero() {
+		t.Fatalf("AutoOffAt after turning off = %v", at)
+	}
+
+	s.check(t0.Add(3 * time.Hour))
+	if len(*turnedOff) != 0 {
+		t.Fatalf("turned off %v", *turnedOff)
+	}
+}
+
+func TestAutoOff_Restored(t *testing.T) {
+	t0 := time.Unix(1_700_000_000, 0)
+	// The relay was switched on 90 minutes before the first check.
+	s, turnedOff := setupAutoOffTest(t, &VirtualDevice{
+		ID: "relay/solder", Type: VdevTypeRelay, State: "ON", LastUpdatedAt: t0.Add(-90 * time.Minute),
+	})
+
+	s.check(t0)
+	if at := s.vdev.Device("relay/solder").AutoOffAt; !at.Equal(t0.Add(30 * time.Minute)) {
+		t.Fatalf("AutoOffAt = %v", at)
+	}
+	s.check(t0.Add(30 * time.Minute))
+	// relay/other has no auto-off.
+	if len(*turnedOff) != 1 || (*turnedOff)[0] != "relay/solder" {
+		t.Fatalf("turned off %v", *turnedOff)
+	}
+}
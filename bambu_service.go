@@ -4,7 +4,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"path"
 	"strconv"
 	"strings"
@@ -76,22 +76,24 @@ type BambuService struct {
 	// footerName is the branding footer name, prefixed onto notification titles
 	// so the user knows which space/installation a print belongs to.
 	footerName string
+	log        *slog.Logger
 }
 
-func NewBambuService(cfg *Config, vdev *VdevManager, push *PushService, db *gorm.DB) (*BambuService, error) {
+func NewBambuService(cfg *Config, vdev *VdevManager, push *PushService, db *gorm.DB, logger *slog.Logger) (*BambuService, error) {
 	s := &BambuService{
 		vdev:       vdev,
 		push:       push,
 		printers:   make(map[string]*bambuPrinter),
 		footerName: cfg.Branding.FooterName,
+		log:        logger,
 	}
 	// republishState re-emits a printer's last state so a newly cached thumbnail
 	// (HasThumbnail flip) propagates to the frontend over the WebSocket.
-	s.thumbs = newBambuThumbnailCache(db, s.republishState)
+	s.thumbs = newBambuThumbnailCache(db, s.republishState, logger)
 
 	for _, pc := range cfg.BambuPrinters {
 		if pc.ID == "" || pc.SerialNumber == "" || pc.Host == "" {
-			log.Printf("[bambu] skipping printer with missing id/serial/host: %+v", pc.ID)
+			s.log.Warn("skipping printer with missing id, serial or host", "printer", pc.ID)
 			continue
 		}
 		p := &bambuPrinter{cfg: pc, full: make(map[string]any)}
@@ -145,18 +147,18 @@ func (s *BambuService) connectPrinter(p *bambuPrinter) {
 	}
 
 	opts.OnConnect = func(c mqtt.Client) {
-		log.Printf("[bambu] connected to %s (printer %s)", broker, p.cfg.ID)
+		s.log.Info("connected", "broker", broker, "printer", p.cfg.ID)
 		token := c.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
 			s.handleMessage(p, msg.Payload())
 		})
 		if !token.WaitTimeout(5 * time.Second) {
-			log.Printf("[bambu] subscription timeout for %s", topic)
+			s.log.Warn("subscription timed out", "topic", topic)
 		} else if err := token.Error(); err != nil {
-			log.Printf("[bambu] failed to subscribe to %s: %v", topic, err)
+			s.log.Warn("subscribing failed", "topic", topic, "err", err)
 		}
 	}
 	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
-		log.Printf("[bambu] connection lost for printer %s: %v", p.cfg.ID, err)
+		s.log.Warn("connection lost", "printer", p.cfg.ID, "err", err)
 	}
 
 	p.client = mqtt.NewClient(opts)
@@ -166,7 +168,7 @@ func (s *BambuService) connectPrinter(p *bambuPrinter) {
 		token := p.client.Connect()
 		token.Wait()
 		if err := token.Error(); err != nil {
-			log.Printf("[bambu] initial connect failed for printer %s: %v", p.cfg.ID, err)
+			s.log.Warn("initial connect failed", "printer", p.cfg.ID, "err", err)
 		}
 	}()
 }
@@ -178,7 +180,7 @@ func (s *BambuService) handleMessage(p *bambuPrinter, payload []byte) {
 		Print map[string]any `json:"print"`
 	}
 	if err := json.Unmarshal(payload, &msg); err != nil {
-		log.Printf("[bambu] failed to parse report for printer %s: %v", p.cfg.ID, err)
+		s.log.Warn("parsing report failed", "printer", p.cfg.ID, "err", err)
 		return
 	}
 	if msg.Print == nil {
@@ -7,7 +7,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
@@ -255,15 +255,17 @@ type bambuThumbnailCache struct {
 	// onCached is invoked (printerID) after a thumbnail is successfully stored,
 	// so the owner can republish device state with HasThumbnail=true.
 	onCached func(printerID string)
+	log      *slog.Logger
 
 	mu    sync.Mutex
 	state map[string]*thumbAttempt
 }
 
-func newBambuThumbnailCache(db *gorm.DB, onCached func(printerID string)) *bambuThumbnailCache {
+func newBambuThumbnailCache(db *gorm.DB, onCached func(printerID string), logger *slog.Logger) *bambuThumbnailCache {
 	return &bambuThumbnailCache{
 		db:       db,
 		onCached: onCached,
+		log:      logger,
 		state:    make(map[string]*thumbAttempt),
 	}
 }
@@ -374,7 +376,7 @@ func (c *bambuThumbnailCache) fetch(cfg BambuPrinterConfig, taskName string, sta
 
 	png, err := fetchBambu3mfThumbnail(cfg, bambu3mfCandidates(taskName))
 	if err != nil {
-		log.Printf("[bambu] thumbnail fetch failed for printer %s task %q: %v", cfg.ID, taskName, err)
+		c.log.Warn("fetching thumbnail failed", "printer", cfg.ID, "task", taskName, "err", err)
 		c.mu.Lock()
 		if a := c.state[key]; a != nil {
 			a.inflight = false
@@ -392,7 +394,7 @@ func (c *bambuThumbnailCache) fetch(cfg BambuPrinterConfig, taskName string, sta
 		CreatedAt:      time.Now(),
 	}
 	if err := c.db.Create(&row).Error; err != nil {
-		log.Printf("[bambu] failed to store thumbnail for printer %s task %q: %v", cfg.ID, taskName, err)
+		c.log.Warn("storing thumbnail failed", "printer", cfg.ID, "task", taskName, "err", err)
 		c.mu.Lock()
 		if a := c.state[key]; a != nil {
 			a.inflight = false
@@ -402,7 +404,7 @@ func (c *bambuThumbnailCache) fetch(cfg BambuPrinterConfig, taskName string, sta
 		return
 	}
 
-	log.Printf("[bambu] cached thumbnail (%d bytes) for printer %s task %q", len(png), cfg.ID, taskName)
+	c.log.Info("cached thumbnail", "printer", cfg.ID, "task", taskName, "bytes", len(png))
 	c.markCached(key)
 	if c.onCached != nil {
 		c.onCached(cfg.ID)
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// CalibrationConfig corrects the numeric readings of a device: the value
+// reported becomes value*multiplier + offset, e.g. offset -1.5 for a
+// thermometer reading 1.5 °C high, or multiplier 1000 for a power meter
+// reporting kW.
+type CalibrationConfig struct {
+	Offset float64 `yaml:"offset"`
+	// Multiplier defaults to 1.
+	Multiplier *float64 `yaml:"multiplier"`
+	// KeepRaw keeps the uncalibrated value as the raw_state of the device,
+	// for checking the calibration.
+	KeepRaw bool `yaml:"keep_raw"`
+}
+
+// calibrate returns the calibrated value of a numeric state. Other states
+// are returned as they are, with ok false.
+func (c *CalibrationConfig) calibrate(state any) (calibrated any, ok bool) {
+	multiplier := 1.0
+	if c.Multiplier != nil {
+		multiplier = *c.Multiplier
+	}
+	switch v := state.(type) {
+	case float64:
+		return v*multiplier + c.Offset, true
+	case int:
+		// Counts stay whole numbers.
+		return int(math.Round(float64(v)*multiplier + c.Offset)), true
+	}
+	return state, false
+}
+
+// validateCalibration rejects multipliers that would lose the reading.
+func validateCalibration(cfg *Config, cfgPath string) error {
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			c := ent.Calibration
+			if c == nil {
+				continue
+			}
+			if m := c.Multiplier; m != nil && (*m == 0 || math.IsNaN(*m) || math.IsInf(*m, 0)) {
+				return fmt.Errorf("entity %s has calibration multiplier %v in %s", ent.ID, *m, cfgPath)
+			}
+			if math.IsNaN(c.Offset) || math.IsInf(c.Offset, 0) {
+				return fmt.Errorf("entity %s has calibration offset %v in %s", ent.ID, c.Offset, cfgPath)
+			}
+		}
+	}
+	return nil
+}
+
+// calibrations are the calibrations of a config by device ID.
+type calibrations struct {
+	cfg      *Config
+	byDevice map[string]*CalibrationConfig
+}
+
+// calibrationsCache holds the calibrations of the active config; a reload
+// replaces it on the next update.
+var calibrationsCache atomic.Pointer[calibrations]
+
+func configCalibrations(cfg *Config) map[string]*CalibrationConfig {
+	if c := calibrationsCache.Load(); c != nil && c.cfg == cfg {
+		return c.byDevice
+	}
+	byDevice := map[string]*CalibrationConfig{}
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.Calibration != nil {
+				if _, ok := byDevice[ent.ID]; !ok {
+					byDevice[ent.ID] = ent.Calibration
+				}
+			}
+		}
+	}
+	calibrationsCache.Store(&calibrations{cfg: cfg, byDevice: byDevice})
+	return byDevice
+}
+
+// calibrateUpdates applies the calibrations of cfg to the numeric states of
+// updates, in place, before they reach VdevManager.ApplyUpdates. The
+// calibration in effect is the one of the config active when the update
+// arrives, so a reload changes only the updates after it.
+func calibrateUpdates(cfg *Config, updates []*VirtualDeviceUpdate) {
+	if cfg == nil {
+		return
+	}
+	byDevice := configCalibrations(cfg)
+	if len(byDevice) == 0 {
+		return
+	}
+	for _, upd := range updates {
+		if upd == nil {
+			continue
+		}
+		c, ok := byDevice[upd.Name]
+		if !ok {
+			continue
+		}
+		calibrated, ok := c.calibrate(upd.State)
+		if !ok {
+			continue
+		}
+		if c.KeepRaw {
+			upd.RawState = upd.State
+		}
+		upd.State = calibrated
+	}
+}
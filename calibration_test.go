@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func calibrationConfig(entities ...EntityConfig) *Config {
+	return &Config{Rooms: []RoomConfig{{ID: "lab", Entities: entities}}}
+}
+
+func float64Ptr(f float64) *float64 { return &f }
+
+func TestCalibrateUpdates(t *testing.T) {
+	cfg := calibrationConfig(
+		EntityConfig{ID: "lab/temp", Calibration: &CalibrationConfig{Offset: -1.5}},
+		EntityConfig{ID: "lab/power", Calibration: &CalibrationConfig{Multiplier: float64Ptr(1000)}},
+		EntityConfig{ID: "lab/people", Calibration: &CalibrationConfig{Offset: -1}},
+		EntityConfig{ID: "lab/relay", Calibration: &CalibrationConfig{Offset: 1}},
+		EntityConfig{ID: "lab/humidity"},
+	)
+	updates := []*VirtualDeviceUpdate{
+		{Name: "lab/temp", State: 23.0},
+		{Name: "lab/power", State: 1.25},
+		{Name: "lab/people", State: 3},
+		{Name: "lab/relay", State: "ON"},
+		{Name: "lab/humidity", State: 41.0},
+		nil,
+	}
+	calibrateUpdates(cfg, updates)
+
+	for i, want := range []any{21.5, 1250.0, 2, "ON", 41.0} {
+		if got := updates[i].State; got != want {
+			t.Errorf("%s = %v (%T), want %v (%T)", updates[i].Name, got, got, want, want)
+		}
+		if updates[i].RawState != nil {
+			t.Errorf("%s kept raw state %v without keep_raw", updates[i].Name, updates[i].RawState)
+		}
+	}
+}
+
+func TestCalibrationKeepRaw(t *testing.T) {
+	setupLiveWsTest(t)
+	setConfig(calibrationConfig(EntityConfig{ID: "lab/air/temperature", Calibration: &CalibrationConfig{
+		Offset: -1.5, Multiplier: float64Ptr(2), KeepRaw: true,
+	}}))
+	vm := NewVdevManager()
+	adapter := &MQTTAdapter{log: testLogger, vdevMgr: vm}
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
+	adapter.handleMapperMessage(mapper, "zigbee2mqtt/bridge/devices", []byte(z2mSCD41Devices))
+
+	adapter.handleMapperMessage(mapper, "zigbee2mqtt/lab/air", []byte(`{"co2": 812, "temperature": 11}`))
+	dev := vm.Device("lab/air/temperature")
+	if dev.State != 20.5 || dev.RawState != 11.0 {
+		t.Errorf("temperature state %v, raw %v, want 20.5 and 11", dev.State, dev.RawState)
+	}
+	if co2 := vm.Device("lab/air/co2"); co2.State != 812.0 || co2.RawState != nil {
+		t.Errorf("uncalibrated co2 state %v, raw %v", co2.State, co2.RawState)
+	}
+
+	// A reload changes the next reading, not the current state.
+	setConfig(calibrationConfig(EntityConfig{ID: "lab/air/temperature", Calibration: &CalibrationConfig{Offset: -1}}))
+	if dev := vm.Device("lab/air/temperature"); dev.State != 20.5 {
+		t.Errorf("state after reload = %v, want 20.5 until the next reading", dev.State)
+	}
+	adapter.handleMapperMessage(mapper, "zigbee2mqtt/lab/air", []byte(`{"temperature": 11}`))
+	if dev := vm.Device("lab/air/temperature"); dev.State != 10.0 || dev.RawState != nil {
+		t.Errorf("after reload state %v, raw %v, want 10 and none", dev.State, dev.RawState)
+	}
+}
+
+func TestValidateCalibration(t *testing.T) {
+	ok := calibrationConfig(EntityConfig{ID: "lab/power", Calibration: &CalibrationConfig{Offset: 2, Multiplier: float64Ptr(-1)}})
+	if err := validateCalibration(ok, "config.yaml"); err != nil {
+		t.Errorf("valid calibration: %v", err)
+	}
+	zero := calibrationConfig(EntityConfig{ID: "lab/power", Calibration: &CalibrationConfig{Multiplier: float64Ptr(0)}})
+	if err := validateCalibration(zero, "config.yaml"); err == nil || !strings.Contains(err.Error(), "lab/power has calibration multiplier 0") {
+		t.Errorf("zero multiplier: err = %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultCameraImageTTL is how long /image/:name serves a fetched image
+// before fetching it again.
+const defaultCameraImageTTL = 30 * time.Second
+
+type CameraImage struct {
+	Data      []byte
+	Timestamp time.Time
+}
+
+var (
+	cameraImages       = sync.Map{} // map[string]CameraImage
+	cameraImageFetches singleflight.Group
+)
+
+// cameraImageTTL returns frigate.image_ttl, or defaultCameraImageTTL.
+func cameraImageTTL(cfg *Config) time.Duration {
+	if d, err := time.ParseDuration(cfg.Frigate.ImageTTL); err == nil {
+		return d
+	}
+	return defaultCameraImageTTL
+}
+
+// fetchAndCacheImage fetches the latest image of a camera from Frigate and
+// caches it. Concurrent calls for the same camera share one request.
+func fetchAndCacheImage(name string) (CameraImage, error) {
+	v, err, _ := cameraImageFetches.Do(name, func() (any, error) {
+		base := strings.TrimRight(GetConfig().Frigate.Url, "/")
+		if base == "" {
+			return nil, fmt.Errorf("frigate url empty")
+		}
+		url := fmt.Sprintf("%s/api/%s/latest.webp?height=900&cache=%d", base, name, time.Now().Unix())
+		resp, err := frigateSnapshotMapper.get(url)
+		if err != nil {
+			return nil, fmt.Errorf("fetching image for camera %s: %w", name, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching image for camera %s: status %d", name, resp.StatusCode)
+		}
+		imgBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading image for camera %s: %w", name, err)
+		}
+
+		img := CameraImage{Data: imgBytes, Timestamp: time.Now()}
+		cameraImages.Store(name, img)
+		return img, nil
+	})
+	if err != nil {
+		return CameraImage{}, err
+	}
+	return v.(CameraImage), nil
+}
+
+// handleImage serves the latest image of a Frigate camera, fetching it when
+// it isn't cached or older than frigate.image_ttl. Only cameras Frigate
+// reported are fetched, so the name can't point the request elsewhere.
+func handleImage(c *fiber.Ctx) error {
+	// The name is kept as a cache key after the request, while Fiber reuses
+	// the buffer params point into, so copy it.
+	name := strings.Clone(c.Params("name"))
+	if frigateSnapshotMapper == nil || !frigateSnapshotMapper.HasCamera(name) {
+		return fiber.ErrNotFound
+	}
+
+	val, ok := cameraImages.Load(name)
+	img, _ := val.(CameraImage)
+	if !ok || time.Since(img.Timestamp) > cameraImageTTL(GetConfig()) {
+		fetched, err := fetchAndCacheImage(name)
+		if err != nil {
+			frigateSnapshotMapper.log.Warn("fetching camera image failed", "camera", name, "err", err)
+			if !ok {
+				return fiber.NewError(fiber.StatusBadGateway, "fetching the image from Frigate failed")
+			}
+			// The stale image beats none.
+		} else {
+			img = fetched
+		}
+	}
+
+	c.Set("Content-Type", "image/webp")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Last-Modified", img.Timestamp.Format(http.TimeFormat))
+	c.Set("Content-Length", fmt.Sprintf("%d", len(img.Data)))
+	return c.Status(fiber.StatusOK).Send(img.Data)
+}
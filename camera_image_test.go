@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// frigateImageStub serves /api/<camera>/latest.webp, counting requests.
+type frigateImageStub struct {
+	*httptest.Server
+	requests atomic.Int32
+	// down makes it answer 502.
+	down atomic.Bool
+	// blocking makes requests wait for release; started is closed on the
+	// first request.
+	blocking atomic.Bool
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func setupCameraImageTest(t *testing.T, imageTTL string) (*fiber.App, *frigateImageStub) {
+	t.Helper()
+	stub := &frigateImageStub{started: make(chan struct{}), release: make(chan struct{})}
+	var startOnce sync.Once
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.requests.Add(1)
+		startOnce.Do(func() { close(stub.started) })
+		if stub.blocking.Load() {
+			<-stub.release
+		}
+		if stub.down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("webp of " + r.URL.Path))
+	}))
+	t.Cleanup(stub.Close)
+
+	prevCfg, prevMapper := GetConfig(), frigateSnapshotMapper
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		frigateSnapshotMapper = prevMapper
+		cameraImages.Clear()
+	})
+	cfg := &Config{Frigate: FrigateConfig{Url: stub.URL + "/", ImageTTL: imageTTL}}
+	setConfig(cfg)
+	frigateSnapshotMapper = NewFrigateSnapshotMapper(NewVdevManager(), cfg, testLogger)
+	frigateSnapshotMapper.cameraNames = []string{"hardroom", "hall", "lab"}
+	cameraImages.Clear()
+
+	app := fiber.New()
+	app.Get("/image/:name", handleImage)
+	return app, stub
+}
+
+func getImage(t *testing.T, app *fiber.App, name string) (int, string) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/image/"+name, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHandleImage_MissThenHit(t *testing.T) {
+	app, stub := setupCameraImageTest(t, "")
+
+	for range 2 {
+		status, body := getImage(t, app, "lab")
+		if status != fiber.StatusOK || body != "webp of /api/lab/latest.webp" {
+			t.Fatalf("%d %q", status, body)
+		}
+	}
+	if n := stub.requests.Load(); n != 1 {
+		t.Fatalf("%d requests to Frigate, want 1", n)
+	}
+}
+
+func TestHandleImage_CachesUnderCameraName(t *testing.T) {
+	app, stub := setupCameraImageTest(t, "")
+
+	// The cache keys must outlive the request buffers Fiber reuses.
+	getImage(t, app, "lab")
+	getImage(t, app, "hall")
+	var keys []string
+	cameraImages.Range(func(k, _ any) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"hall", "lab"}) {
+		t.Fatalf("cached under %q, want hall and lab", keys)
+	}
+	for _, name := range []string{"lab", "hall"} {
+		if status, body := getImage(t, app, name); status != fiber.StatusOK || body != "webp of /api/"+name+"/latest.webp" {
+			t.Fatalf("%s: %d %q", name, status, body)
+		}
+	}
+	if n := stub.requests.Load(); n != 2 {
+		t.Fatalf("%d requests to Frigate, want 2", n)
+	}
+}
+
+func TestHandleImage_Stale(t *testing.T) {
+	app, stub := setupCameraImageTest(t, "0s")
+
+	getImage(t, app, "lab")
+	getImage(t, app, "lab")
+	if n := stub.requests.Load(); n != 2 {
+		t.Fatalf("%d requests to Frigate, want 2", n)
+	}
+
+	// With Frigate down the stale image is served.
+	stub.down.Store(true)
+	if status, body := getImage(t, app, "lab"); status != fiber.StatusOK || body != "webp of /api/lab/latest.webp" {
+		t.Fatalf("stale: %d %q", status, body)
+	}
+	if status, _ := getImage(t, app, "hardroom"); status != fiber.StatusBadGateway {
+		t.Fatalf("never fetched: %d", status)
+	}
+}
+
+func TestHandleImage_UnknownCamera(t *testing.T) {
+	app, stub := setupCameraImageTest(t, "")
+
+	for _, name := range []string{"garage", "..%2Fconfig", "lab%3Fx=1"} {
+		if status, _ := getImage(t, app, name); status != fiber.StatusNotFound {
+			t.Errorf("%s: %d", name, status)
+		}
+	}
+	if n := stub.requests.Load(); n != 0 {
+		t.Fatalf("%d requests to Frigate, want 0", n)
+	}
+}
+
+func TestFetchAndCacheImage_Coalesces(t *testing.T) {
+	_, stub := setupCameraImageTest(t, "")
+	stub.blocking.Store(true)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Go(func() {
+			_, err := fetchAndCacheImage("lab")
+			errs <- err
+		})
+	}
+	<-stub.started
+	// Give the other callers time to join the request in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(stub.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stub.requests.Load(); n != 1 {
+		t.Fatalf("%d requests to Frigate, want 1", n)
+	}
+}
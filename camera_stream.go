@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultMaxCameraStreams is frigate.max_streams when it isn't set.
+	defaultMaxCameraStreams = 4
+	// maxCameraStreamFrame bounds a single frame read from Frigate.
+	maxCameraStreamFrame = 8 << 20
+	// cameraStreamBoundary separates the frames relayed to clients.
+	cameraStreamBoundary = "frame"
+)
+
+// validateCameraStreamConfig rejects a negative frigate.max_streams.
+func validateCameraStreamConfig(cfg *Config, cfgPath string) error {
+	if cfg.Frigate.MaxStreams < 0 {
+		return fmt.Errorf("frigate.max_streams must not be negative in %s", cfgPath)
+	}
+	return nil
+}
+
+// cameraStreamLimit counts the camera streams being relayed.
+type cameraStreamLimit struct {
+	mu     sync.Mutex
+	active int
+}
+
+var cameraStreams cameraStreamLimit
+
+// acquire takes a stream slot unless limit are in use. The limit is passed on
+// every call, so a reload applies to new streams.
+func (l *cameraStreamLimit) acquire(limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active >= limit {
+		return false
+	}
+	l.active++
+	return true
+}
+
+func (l *cameraStreamLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+}
+
+// newFrigateStreamClient returns a client for long-lived streams from
+// Frigate: frigate.auth applies and frigate.timeout bounds waiting for the
+// response headers, but not reading the body.
+func newFrigateStreamClient(cfg FrigateConfig) *http.Client {
+	client := newFrigateClient(cfg)
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = client.Timeout
+	// Each stream is its own connection; don't pool them once done.
+	base.DisableKeepAlives = true
+	return &http.Client{Transport: frigateTransport{auth: cfg.Auth, base: base}}
+}
+
+// HandleStream relays a camera's MJPEG stream from Frigate
+// (/api/<camera>), so clients never talk to Frigate directly. Only the
+// latest frame is kept for a client that can't keep up; it skips frames
+// rather than falling behind. At most frigate.max_streams are relayed at
+// once. Requires AuthMiddleware.
+func (s *FrigateSnapshotMapper) HandleStream(c *fiber.Ctx) error {
+	camera := c.Params("camera")
+	if !s.HasCamera(camera) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown camera"})
+	}
+	cfg := s.config()
+	limit := cfg.Frigate.MaxStreams
+	if limit <= 0 {
+		limit = defaultMaxCameraStreams
+	}
+	if !cameraStreams.acquire(limit) {
+		c.Set(fiber.HeaderRetryAfter, "10")
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "too many camera streams"})
+	}
+
+	// Stop ends the streams with the snapshot fetching.
+	ctx, cancel := context.WithCancel(s.ctx)
+	frames, err := s.openStream(ctx, cfg, camera)
+	if err != nil {
+		cancel()
+		cameraStreams.release()
+		s.log.Warn("opening camera stream failed", "camera", camera, "err", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "camera stream unavailable"})
+	}
+
+	c.Set(fiber.HeaderContentType, "multipart/x-mixed-replace; boundary="+cameraStreamBoundary)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("X-Accel-Buffering", "no") // disable nginx response buffering
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cameraStreams.release()
+		// Closes the upstream connection, which ends the reader.
+		defer cancel()
+		// A write or flush error means the client went away.
+		for frame := range frames.next(ctx) {
+			if err := writeCameraStreamFrame(w, frame); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// openStream requests the camera's MJPEG stream and starts reading its
+// frames until ctx is canceled or the stream ends.
+func (s *FrigateSnapshotMapper) openStream(ctx context.Context, cfg *Config, camera string) (*latestFrame, error) {
+	base := strings.TrimRight(cfg.Frigate.Url, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/"+camera, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newFrigateStreamClient(cfg.Frigate).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("frigate stream status %d", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get(fiber.HeaderContentType))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("frigate stream is not multipart (%q)", resp.Header.Get(fiber.HeaderContentType))
+	}
+
+	frames := newLatestFrame()
+	go func() {
+		defer resp.Body.Close()
+		defer frames.close()
+		parts := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				if ctx.Err() == nil && err != io.EOF {
+					s.log.Warn("reading camera stream failed", "camera", camera, "err", err)
+				}
+				return
+			}
+			frame, err := io.ReadAll(io.LimitReader(part, maxCameraStreamFrame+1))
+			if err != nil || len(frame) > maxCameraStreamFrame {
+				s.log.Warn("reading camera stream frame failed", "camera", camera, "err", err, "bytes", len(frame))
+				return
+			}
+			frames.set(frame)
+			s.lastSuccess.Store(time.Now().UnixNano())
+		}
+	}()
+	return frames, nil
+}
+
+// latestFrame hands the newest frame from the reader to the writer, replacing
+// one the writer hasn't picked up yet.
+type latestFrame struct {
+	mu    sync.Mutex
+	frame []byte
+	ready chan struct{}
+	done  chan struct{}
+}
+
+func newLatestFrame() *latestFrame {
+	return &latestFrame{ready: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+func (f *latestFrame) set(frame []byte) {
+	f.mu.Lock()
+	f.frame = frame
+	f.mu.Unlock()
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close marks the end of the stream.
+func (f *latestFrame) close() {
+	close(f.done)
+}
+
+// next yields each newest frame as the consumer gets to it, until the stream
+// ends or ctx is canceled.
+func (f *latestFrame) next(ctx context.Context) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.done:
+				return
+			case <-f.ready:
+				f.mu.Lock()
+				frame := f.frame
+				f.frame = nil
+				f.mu.Unlock()
+				if frame != nil && !yield(frame) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeCameraStreamFrame(w *bufio.Writer, frame []byte) error {
+	if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", cameraStreamBoundary, len(frame)); err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
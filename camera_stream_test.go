@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mjpegUpstream is a Frigate serving an endless MJPEG stream per camera.
+type mjpegUpstream struct {
+	*httptest.Server
+	auth   chan string
+	closed chan struct{}
+}
+
+func newMJPEGUpstream(t *testing.T) *mjpegUpstream {
+	t.Helper()
+	u := &mjpegUpstream{auth: make(chan string, 10), closed: make(chan struct{}, 10)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/lab" {
+			http.NotFound(w, r)
+			return
+		}
+		u.auth <- r.Header.Get("Authorization")
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+			if err == nil {
+				fmt.Fprintf(part, "frame %d", i)
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				u.closed <- struct{}{}
+				return
+			case <-ticker.C:
+			}
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func setupStreamTest(t *testing.T, frigate FrigateConfig) string {
+	t.Helper()
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: frigate}, testLogger)
+	s.cameraNames = []string{"lab"}
+	t.Cleanup(s.Stop)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/camera-stream/:camera", s.HandleStream)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.ShutdownWithTimeout(time.Second) })
+	return "http://" + ln.Addr().String() + "/api/v1/camera-stream/"
+}
+
+func openStream(t *testing.T, url string) *http.Response {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func waitClosed(t *testing.T, u *mjpegUpstream) {
+	t.Helper()
+	select {
+	case <-u.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream stream not closed after the client disconnected")
+	}
+}
+
+func TestHandleStream_RelaysFrames(t *testing.T) {
+	u := newMJPEGUpstream(t)
+	base := setupStreamTest(t, FrigateConfig{Url: u.URL, Auth: FrigateAuthConfig{Token: "s3cret"}})
+
+	resp := openStream(t, base+"lab")
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	if got := <-u.auth; got != "Bearer s3cret" {
+		t.Errorf("upstream Authorization = %q", got)
+	}
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	prev := ""
+	for range 3 {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, _ := io.ReadAll(part)
+		var n int
+		if _, err := fmt.Sscanf(string(frame), "frame %d", &n); err != nil || string(frame) == prev || part.Header.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("frame %q (%v) after %q, %v", frame, err, prev, part.Header)
+		}
+		prev = string(frame)
+	}
+
+	resp.Body.Close()
+	waitClosed(t, u)
+}
+
+func TestHandleStream_Limit(t *testing.T) {
+	u := newMJPEGUpstream(t)
+	base := setupStreamTest(t, FrigateConfig{Url: u.URL, MaxStreams: 1})
+
+	first := openStream(t, base+"lab")
+	if first.StatusCode != fiber.StatusOK {
+		t.Fatalf("first stream: %d", first.StatusCode)
+	}
+	second := openStream(t, base+"lab")
+	second.Body.Close()
+	if second.StatusCode != fiber.StatusServiceUnavailable || second.Header.Get("Retry-After") == "" {
+		t.Fatalf("second stream: %d", second.StatusCode)
+	}
+
+	// The slot is freed once the first client is gone.
+	first.Body.Close()
+	waitClosed(t, u)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		third := openStream(t, base+"lab")
+		third.Body.Close()
+		if third.StatusCode == fiber.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream slot not released: %d", third.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHandleStream_Errors(t *testing.T) {
+	notMultipart := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a stream"))
+	}))
+	defer notMultipart.Close()
+	base := setupStreamTest(t, FrigateConfig{Url: notMultipart.URL})
+	active := func() int {
+		cameraStreams.mu.Lock()
+		defer cameraStreams.mu.Unlock()
+		return cameraStreams.active
+	}
+	before := active()
+
+	for camera, want := range map[string]int{
+		"garage":      fiber.StatusNotFound,
+		"..%2Fconfig": fiber.StatusNotFound,
+		"lab":         fiber.StatusBadGateway,
+	} {
+		resp := openStream(t, base+camera)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: %d, want %d", camera, resp.StatusCode, want)
+		}
+	}
+	// Failed streams don't hold slots. Streams of earlier tests may still be
+	// releasing theirs.
+	if after := active(); after > before {
+		t.Fatalf("%d stream slots taken after failed streams, %d before", after, before)
+	}
+}
+
+func TestLatestFrame_SkipsFramesForSlowConsumer(t *testing.T) {
+	f := newLatestFrame()
+	f.set([]byte("1"))
+	f.set([]byte("2"))
+	f.set([]byte("3"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []string
+	for frame := range f.next(ctx) {
+		got = append(got, string(frame))
+		if len(got) == 1 {
+			f.set([]byte("4"))
+			continue
+		}
+		f.close()
+	}
+	if len(got) != 2 || got[0] != "3" || got[1] != "4" {
+		t.Fatalf("frames %v, want [3 4]", got)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// Default thresholds of ComfortConfig.
+const (
+	defaultComfortDryBelow      = 30.0
+	defaultComfortHumidAbove    = 60.0
+	defaultComfortHeatIndexFrom = 27.0
+)
+
+// Labels of ComfortState.
+const (
+	comfortDry         = "dry"
+	comfortComfortable = "comfortable"
+	comfortHumid       = "humid"
+)
+
+// ComfortConfig derives a comfort device from a thermometer and a
+// hygrometer, for displays that show a word rather than the readings.
+type ComfortConfig struct {
+	// ID of the comfort device.
+	ID string `yaml:"id"`
+	// Temperature and Humidity are the IDs of the input devices.
+	Temperature string `yaml:"temperature"`
+	Humidity    string `yaml:"humidity"`
+	// DryBelow and HumidAbove are the relative humidities (%) outside
+	// which the air is dry or humid (default 30 and 60).
+	DryBelow   *float64 `yaml:"dry_below"`
+	HumidAbove *float64 `yaml:"humid_above"`
+	// HeatIndexFrom is the temperature (°C) from which the heat index is
+	// given (default 27).
+	HeatIndexFrom *float64 `yaml:"heat_index_from"`
+}
+
+func (c ComfortConfig) thresholds() (dryBelow, humidAbove, heatIndexFrom float64) {
+	dryBelow, humidAbove, heatIndexFrom = defaultComfortDryBelow, defaultComfortHumidAbove, defaultComfortHeatIndexFrom
+	if c.DryBelow != nil {
+		dryBelow = *c.DryBelow
+	}
+	if c.HumidAbove != nil {
+		humidAbove = *c.HumidAbove
+	}
+	if c.HeatIndexFrom != nil {
+		heatIndexFrom = *c.HeatIndexFrom
+	}
+	return dryBelow, humidAbove, heatIndexFrom
+}
+
+// ComfortState is the state of a comfort device.
+type ComfortState struct {
+	Label string `json:"label"`
+	// HeatIndex is the apparent temperature (°C) when it is warm; omitted
+	// below heat_index_from.
+	HeatIndex float64 `json:"heat_index,omitempty"`
+}
+
+// validateComfortConfig checks that every comfort device has an ID and
+// inputs, and thresholds in order.
+func validateComfortConfig(cfg *Config, cfgPath string) error {
+	seen := map[string]bool{}
+	for i, c := range cfg.Comfort {
+		if c.ID == "" || c.Temperature == "" || c.Humidity == "" {
+			return fmt.Errorf("comfort[%d] needs id, temperature and humidity in %s", i, cfgPath)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("duplicate comfort device %s in %s", c.ID, cfgPath)
+		}
+		seen[c.ID] = true
+		if dry, humid, _ := c.thresholds(); dry >= humid {
+			return fmt.Errorf("comfort device %s has dry_below %v not below humid_above %v in %s", c.ID, dry, humid, cfgPath)
+		}
+	}
+	return nil
+}
+
+// classifyComfort labels the air by its relative humidity and gives the
+// heat index from heat_index_from up.
+func classifyComfort(c ComfortConfig, temperature, humidity float64) ComfortState {
+	dryBelow, humidAbove, heatIndexFrom := c.thresholds()
+	state := ComfortState{Label: comfortComfortable}
+	switch {
+	case humidity < dryBelow:
+		state.Label = comfortDry
+	case humidity > humidAbove:
+		state.Label = comfortHumid
+	}
+	if temperature >= heatIndexFrom {
+		state.HeatIndex = math.Round(heatIndex(temperature, humidity)*10) / 10
+	}
+	return state
+}
+
+// heatIndex is the NOAA heat index (°C) of a temperature (°C) and relative
+// humidity (%): Steadman's simple formula, and the Rothfusz regression with
+// its adjustments where that gives 80 °F or more.
+func heatIndex(celsius, humidity float64) float64 {
+	t := celsius*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity -
+			0.22475541*t*humidity - 0.00683783*t*t - 0.05481717*humidity*humidity +
+			0.00122874*t*t*humidity + 0.00085282*t*humidity*humidity -
+			0.00000199*t*t*humidity*humidity
+		switch {
+		case humidity < 13 && t >= 80 && t <= 112:
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case humidity > 85 && t >= 80 && t <= 87:
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// ComfortService keeps the configured comfort devices up to date with their
+// inputs.
+type ComfortService struct {
+	vdev    *VdevManager
+	devices []ComfortConfig
+	// byInput maps input device IDs to the comfort devices using them.
+	byInput map[string][]ComfortConfig
+	log     *slog.Logger
+
+	// mu serializes updates so a comfort device never goes back to an
+	// older reading.
+	mu sync.Mutex
+}
+
+// NewComfortService registers the comfort devices of the config.
+func NewComfortService(cfg *Config, vdev *VdevManager, logger *slog.Logger) *ComfortService {
+	s := &ComfortService{vdev: vdev, devices: cfg.Comfort, byInput: map[string][]ComfortConfig{}, log: logger}
+	devs := make([]*VirtualDevice, 0, len(cfg.Comfort))
+	for _, c := range cfg.Comfort {
+		s.byInput[c.Temperature] = append(s.byInput[c.Temperature], c)
+		s.byInput[c.Humidity] = append(s.byInput[c.Humidity], c)
+		devs = append(devs, &VirtualDevice{ID: c.ID, Type: VdevTypeComfort, ProhibitControl: true})
+	}
+	vdev.AddDevices(devs)
+	return s
+}
+
+// Start derives the comfort devices from the current readings and follows
+// the inputs from then on. It does nothing without comfort devices.
+func (s *ComfortService) Start() {
+	if len(s.devices) == 0 {
+		return
+	}
+	s.vdev.OnVirtualDeviceUpdated = append(s.vdev.OnVirtualDeviceUpdated, s.onDeviceUpdate)
+	for _, c := range s.devices {
+		s.update(c)
+	}
+	s.log.Info("deriving comfort devices", "count", len(s.devices))
+}
+
+func (s *ComfortService) onDeviceUpdate(v *VirtualDevice) {
+	if v == nil {
+		return
+	}
+	for _, c := range s.byInput[v.ID] {
+		s.update(c)
+	}
+}
+
+// update derives a comfort device from the current states of its inputs,
+// once both have a numeric one.
+func (s *ComfortService) update(c ComfortConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	temperature, ok := s.reading(c.Temperature)
+	if !ok {
+		return
+	}
+	humidity, ok := s.reading(c.Humidity)
+	if !ok {
+		return
+	}
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{{Name: c.ID, State: classifyComfort(c, temperature, humidity)}})
+}
+
+func (s *ComfortService) reading(id string) (float64, bool) {
+	dev := s.vdev.Device(id)
+	if dev == nil {
+		return 0, false
+	}
+	switch v := dev.State.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// comfortLabel is the label of a comfort state, as kept in memory or
+// decoded from the history.
+func comfortLabel(state any) string {
+	switch s := state.(type) {
+	case ComfortState:
+		return s.Label
+	case map[string]any:
+		label, _ := s["label"].(string)
+		return label
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClassifyComfort(t *testing.T) {
+	custom := ComfortConfig{DryBelow: float64Ptr(40), HumidAbove: float64Ptr(50), HeatIndexFrom: float64Ptr(30)}
+	for _, tc := range []struct {
+		cfg         ComfortConfig
+		temperature float64
+		humidity    float64
+		want        ComfortState
+	}{
+		{ComfortConfig{}, 21, 29.9, ComfortState{Label: "dry"}},
+		{ComfortConfig{}, 21, 30, ComfortState{Label: "comfortable"}},
+		{ComfortConfig{}, 21, 60, ComfortState{Label: "comfortable"}},
+		{ComfortConfig{}, 21, 60.1, ComfortState{Label: "humid"}},
+		{ComfortConfig{}, 26.9, 45, ComfortState{Label: "comfortable"}},
+		{ComfortConfig{}, 27, 45, ComfortState{Label: "comfortable", HeatIndex: 27.1}},
+		{ComfortConfig{}, 32.2, 60, ComfortState{Label: "comfortable", HeatIndex: 37.5}},
+		{ComfortConfig{}, 27, 80, ComfortState{Label: "humid", HeatIndex: 29.7}},
+		{custom, 21, 39, ComfortState{Label: "dry"}},
+		{custom, 21, 51, ComfortState{Label: "humid"}},
+		{custom, 29, 45, ComfortState{Label: "comfortable"}},
+	} {
+		if got := classifyComfort(tc.cfg, tc.temperature, tc.humidity); got != tc.want {
+			t.Errorf("classifyComfort(%v °C, %v%%) = %+v, want %+v", tc.temperature, tc.humidity, got, tc.want)
+		}
+	}
+}
+
+func TestHeatIndex(t *testing.T) {
+	// Points of the NWS heat index chart, in °F.
+	for _, tc := range []struct{ fahrenheit, humidity, want float64 }{
+		{68, 50, 67},  // simple formula
+		{80, 40, 80},  // regression
+		{90, 60, 100}, // regression
+		{100, 60, 129},
+		{104, 10, 98}, // dry adjustment
+		{86, 90, 105}, // humid adjustment
+	} {
+		got := heatIndex((tc.fahrenheit-32)*5/9, tc.humidity)*9/5 + 32
+		if math.Round(got) != tc.want {
+			t.Errorf("heat index at %v °F, %v%% = %.1f °F, want %v", tc.fahrenheit, tc.humidity, got, tc.want)
+		}
+	}
+}
+
+func TestValidateComfortConfig(t *testing.T) {
+	for name, tc := range map[string]struct {
+		comfort []ComfortConfig
+		want    string
+	}{
+		"ok":         {[]ComfortConfig{{ID: "lounge/comfort", Temperature: "lounge/temp", Humidity: "lounge/hum"}}, ""},
+		"no input":   {[]ComfortConfig{{ID: "lounge/comfort", Temperature: "lounge/temp"}}, "comfort[0] needs id, temperature and humidity"},
+		"duplicate":  {[]ComfortConfig{{ID: "c", Temperature: "t", Humidity: "h"}, {ID: "c", Temperature: "t", Humidity: "h"}}, "duplicate comfort device c"},
+		"thresholds": {[]ComfortConfig{{ID: "c", Temperature: "t", Humidity: "h", DryBelow: float64Ptr(70)}}, "dry_below 70 not below humid_above 60"},
+	} {
+		err := validateComfortConfig(&Config{Comfort: tc.comfort}, "at2.yaml")
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestComfortService(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "lounge/temp", Type: VdevTypeTemperature},
+		{ID: "lounge/hum", Type: VdevTypeHumidity},
+	})
+	s := NewComfortService(&Config{Comfort: []ComfortConfig{{ID: "lounge/comfort", Temperature: "lounge/temp", Humidity: "lounge/hum"}}}, vm, testLogger)
+
+	// Nothing to derive until both inputs have a reading.
+	vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lounge/temp", State: 22.0}})
+	s.onDeviceUpdate(vm.Device("lounge/temp"))
+	if dev := vm.Device("lounge/comfort"); dev == nil || dev.State != nil || dev.Type != VdevTypeComfort {
+		t.Fatalf("comfort device before humidity: %+v", dev)
+	}
+
+	vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lounge/hum", State: 25.0}})
+	s.onDeviceUpdate(vm.Device("lounge/hum"))
+	if got := vm.Device("lounge/comfort").State; got != (ComfortState{Label: "dry"}) {
+		t.Errorf("comfort = %+v, want dry", got)
+	}
+	vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lounge/temp", State: 32.2}, {Name: "lounge/hum", State: 60.0}})
+	s.onDeviceUpdate(vm.Device("lounge/temp"))
+	if got := vm.Device("lounge/comfort").State; got != (ComfortState{Label: "comfortable", HeatIndex: 37.5}) {
+		t.Errorf("comfort = %+v, want comfortable at 37.5", got)
+	}
+}
+
+func TestComfortHistoryRecordsLabelChanges(t *testing.T) {
+	setupTestDB(t)
+	repo := NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	for _, state := range []ComfortState{
+		{Label: "comfortable", HeatIndex: 27.5},
+		{Label: "comfortable", HeatIndex: 28.1},
+		{Label: "humid", HeatIndex: 29.6},
+		{Label: "humid", HeatIndex: 30.2},
+		{Label: "comfortable"},
+	} {
+		repo.OnDeviceUpdated(&VirtualDevice{ID: "lounge/comfort", Type: VdevTypeComfort, State: state})
+	}
+	recorded := func() []string {
+		var states []string
+		gormDB.Model(&VirtualDeviceStateModel{}).Order("id").Pluck("state", &states)
+		return states
+	}
+	want := []string{`{"label":"comfortable","heat_index":27.5}`, `{"label":"humid","heat_index":29.6}`, `{"label":"comfortable"}`}
+	if got := recorded(); !slices.Equal(got, want) {
+		t.Errorf("recorded %v, want %v", got, want)
+	}
+
+	// After a restart the last label comes from the history.
+	repo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	repo.OnDeviceUpdated(&VirtualDevice{ID: "lounge/comfort", Type: VdevTypeComfort, State: ComfortState{Label: "comfortable", HeatIndex: 27}})
+	if got := recorded(); len(got) != len(want) {
+		t.Errorf("after restart recorded %v, want no new state", got)
+	}
+}
@@ -21,6 +21,119 @@ type Config struct {
 	// ExitBoard optionally drives an MQTT-based exit status panel. When nil the
 	// feature is disabled.
 	ExitBoard *ExitBoardConfig `yaml:"exit_board"`
+	// ControlRules restrict who may control which devices. The first rule
+	// matching a device decides; devices no rule matches can be controlled
+	// by any logged-in user.
+	ControlRules []ControlRule `yaml:"control_rules"`
+	// Metrics configures the Prometheus /metrics endpoint.
+	Metrics MetricsConfig `yaml:"metrics"`
+	// Grafana enables the simple JSON datasource endpoints. When nil they
+	// are not served.
+	Grafana *GrafanaConfig `yaml:"grafana"`
+	// Energy prices the electricity of power_usage devices for
+	// /api/v1/energy-cost. When nil the endpoint returns 503.
+	Energy *EnergyConfig `yaml:"energy"`
+	// Weather polls the outdoor conditions into weather/* devices.
+	Weather *WeatherConfig `yaml:"weather"`
+	// Precision overrides the decimals numeric readings are rounded to by
+	// device type, e.g. {power_usage: 1}; -1 keeps them as reported.
+	Precision map[string]int `yaml:"precision"`
+	// Sun computes the sun/elevation and sun/is_day devices.
+	Sun *SunConfig `yaml:"sun"`
+	// UsageStats precomputes usage heatmaps in the background. When nil
+	// they are computed on demand.
+	UsageStats *UsageStatsConfig `yaml:"usage_stats"`
+	// Prometheus configures what the device collector exports.
+	Prometheus PrometheusConfig `yaml:"prometheus"`
+	// Comfort derives comfort devices from a thermometer and a hygrometer.
+	Comfort []ComfortConfig `yaml:"comfort"`
+	// Scenes are named groups of control commands activated together.
+	Scenes []SceneConfig `yaml:"scenes"`
+	// Alerts are raised by rules on device states.
+	Alerts AlertsConfig `yaml:"alerts"`
+	// Notifications sends alerts to webhooks.
+	Notifications NotificationsConfig `yaml:"notifications"`
+	// Health sets the thresholds of the /readyz component checks.
+	Health HealthConfig `yaml:"health"`
+	// Logging sets the log level and format.
+	Logging LoggingConfig `yaml:"logging"`
+	// ReconcileDelay is how long after startup configured entities are
+	// compared with the discovered devices and the differences logged
+	// (default "2m", "0s" disables it).
+	ReconcileDelay string `yaml:"reconcile_delay"`
+	// Strict rejects the config when it has keys at2 doesn't know, which are
+	// usually typos. Defaults to true; false only warns about them.
+	Strict *bool `yaml:"strict"`
+	// Include lists YAML files, relative to this one, whose rooms and scenes
+	// are appended to the ones above.
+	Include []string `yaml:"include"`
+}
+
+// ConfigInclude is what a file listed under include may contain.
+type ConfigInclude struct {
+	Rooms  []RoomConfig  `yaml:"rooms"`
+	Scenes []SceneConfig `yaml:"scenes"`
+}
+
+// SceneConfig is a named list of control commands, e.g. turning off every
+// light at closing time.
+type SceneConfig struct {
+	Name          string          `yaml:"name" json:"name"`
+	LocalizedName LocalizedString `yaml:"localized_name" json:"localized_name,omitempty"`
+	// Commands are sent in order; a failing one doesn't stop the rest.
+	Commands []SceneCommand `yaml:"commands" json:"commands"`
+}
+
+// SceneCommand is a single ControlDevice call of a scene.
+type SceneCommand struct {
+	DeviceID string `yaml:"device_id" json:"deviceId"`
+	State    any    `yaml:"state" json:"state"`
+}
+
+// PrometheusConfig configures the device metrics collector.
+type PrometheusConfig struct {
+	// NameLanguage picks the localized entity name used as the name label of
+	// at2_device_info. Falls back like LocalizedString.Resolve.
+	NameLanguage string `yaml:"name_language"`
+	// ExcludeTypes lists device types (e.g. "gas") not exported.
+	ExcludeTypes []string `yaml:"exclude_types"`
+	// ExcludeDevices are globs (path.Match syntax) on device IDs not exported.
+	ExcludeDevices []string `yaml:"exclude_devices"`
+	// MetricPrefix is prepended to the names of all at2 metrics, e.g. "hq_"
+	// gives hq_at2_temperature_celsius. Go and process metrics keep their names.
+	MetricPrefix string `yaml:"metric_prefix"`
+}
+
+// MetricsConfig controls the Prometheus /metrics endpoint. The metrics reveal
+// room occupancy, so the endpoint can require a bearer token or basic auth;
+// when both are set either is accepted. Without them it is public.
+type MetricsConfig struct {
+	// Disabled removes the endpoint entirely.
+	Disabled              bool   `yaml:"disabled"`
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"token_file"`
+	BasicAuthUsername     string `yaml:"basic_auth_username"`
+	BasicAuthPassword     string `yaml:"basic_auth_password"`
+	BasicAuthPasswordFile string `yaml:"basic_auth_password_file"`
+}
+
+// GrafanaConfig configures the Grafana simple JSON datasource endpoints under
+// /api/v1/grafana. They serve the device history, so they require a bearer
+// token.
+type GrafanaConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// ControlRule limits control of the devices it matches to members of an OIDC
+// group. A rule matches when every criterion it sets matches.
+type ControlRule struct {
+	// Match is a glob (path.Match syntax) on the device ID, e.g. "relay/compressor*".
+	Match string `yaml:"match" json:"match,omitempty"`
+	// Representation matches the entity representation, e.g. "light".
+	Representation string `yaml:"representation" json:"representation,omitempty"`
+	// RequireGroup is the group a user must be in to control the device.
+	RequireGroup string `yaml:"require_group" json:"require_group"`
 }
 
 // ExitBoardConfig configures the exit-board publisher. For each room a status
@@ -157,8 +270,39 @@ type SpaceAPIConfig struct {
 	Url      string                 `yaml:"url"`
 	Location SpaceAPILocationConfig `yaml:"location"`
 	Contact  SpaceAPIContactConfig  `yaml:"contact"`
+	// OpenSource decides state.open: "people_present" (default) reports the
+	// space open while any person sensor in the rooms counts someone, any
+	// other value is the ID of a virtual device (e.g. a "space open" switch)
+	// whose truthy state means open.
+	OpenSource string `yaml:"open_source"`
+	// Message is published as state.message.
+	Message string `yaml:"message"`
+	// PowerTotalDevice is the ID of a power_usage device metering the whole
+	// space. When set, it is reported as the total power consumption instead
+	// of the sum over the rooms.
+	PowerTotalDevice string `yaml:"power_total_device"`
+	// CacheTTL is a Go duration for which the generated document is reused.
+	// Person and open-state changes invalidate it early. Default "10s",
+	// "0s" disables the cache.
+	CacheTTL string `yaml:"cache_ttl"`
+	// BadgeLabel is the left part of /badge.svg. Defaults to Space.
+	BadgeLabel string `yaml:"badge_label"`
+	// CalendarLookback is a Go duration for how far back the open periods of
+	// /api/v1/space-open.ics go. Default "720h" (30 days).
+	CalendarLookback string `yaml:"calendar_lookback"`
+	// StaleSensorTypes lists the sensor types (temperature, humidity, co2)
+	// whose readings are published even when not fresh, e.g. restored after
+	// a restart, with their lastchange. Other readings that aren't fresh,
+	// and people counts, are left out until the device reports.
+	StaleSensorTypes []string `yaml:"stale_sensor_types"`
+	// Ext holds custom fields merged into the top level of the document.
+	// Keys must start with "ext_", the SpaceAPI prefix for extensions.
+	Ext map[string]any `yaml:"ext"`
 }
 
+// SpaceAPIOpenSourcePeople is the default SpaceAPIConfig.OpenSource.
+const SpaceAPIOpenSourcePeople = "people_present"
+
 type SpaceAPILocationConfig struct {
 	Address  string  `yaml:"address"`
 	Lat      float64 `yaml:"lat"`
@@ -181,6 +325,8 @@ type SpaceAPIContactConfig struct {
 
 type DatabaseConfig struct {
 	Path string `yaml:"path"` // SQLite file path
+	// Backup optionally copies the database on a schedule.
+	Backup *DatabaseBackupConfig `yaml:"backup"`
 }
 
 // LocalizedString represents a string localized into multiple languages.
@@ -191,10 +337,82 @@ type WebConfig struct {
 	ListenAddress   string   `yaml:"listen_address"`
 	PublicURL       string   `yaml:"public_url"`
 	SpaceapiDomains []string `yaml:"spaceapi_domains"`
+	// ListenUnixSocket serves on a unix socket instead of ListenAddress.
+	ListenUnixSocket *UnixSocketConfig `yaml:"listen_unix_socket"`
+	// TLS serves HTTPS on ListenAddress.
+	TLS *TLSConfig `yaml:"tls"`
+	// DefaultLocale is the language room and entity names fall back to when
+	// the requested one isn't set, before "en". Default "pl".
+	DefaultLocale string `yaml:"default_locale"`
+	// DefaultUnits is the unit system ("metric" or "imperial") device states
+	// are served in when a request doesn't ask with ?units=. Default
+	// "metric". Only temperatures differ.
+	DefaultUnits string `yaml:"default_units"`
+	// AllDevicesMapperData serves the devices' mapper data from
+	// /api/v1/all-devices to everyone, as before it was limited to logged in
+	// clients asking with ?include=mapper_data. Deprecated: goes away in the
+	// next release.
+	AllDevicesMapperData bool `yaml:"all_devices_mapper_data"`
 	// TrustedProxies is a list of IPs/CIDRs of reverse proxies (e.g. Traefik)
-	// allowed to set the X-Forwarded-For header. When set, the real client IP
-	// is taken from that header instead of the immediate peer.
+	// allowed to set the X-Forwarded-For, -Proto and -Host headers. Requests
+	// from them take the client IP and scheme from those headers; the headers
+	// are ignored from everyone else. Peers on ListenUnixSocket are always
+	// trusted.
 	TrustedProxies []string `yaml:"trusted_proxies"`
+	// LiveWsRequireAuth rejects live websocket connections without a valid
+	// session. Off by default so existing kiosks keep working.
+	LiveWsRequireAuth bool `yaml:"live_ws_require_auth"`
+	// ProtectedPaths are path prefixes that require a valid session (cookie
+	// or bearer session ID), compared case-insensitively like routes are.
+	// Defaults to /api/v1/control and /api/v1/debug.
+	ProtectedPaths []string `yaml:"protected_paths"`
+	// LiveWsCompression negotiates permessage-deflate on the live websocket.
+	// Only messages of at least LiveWsCompressionThreshold bytes (default
+	// 1024) are compressed; small deltas aren't worth the CPU.
+	LiveWsCompression          bool `yaml:"live_ws_compression"`
+	LiveWsCompressionThreshold int  `yaml:"live_ws_compression_threshold"`
+	// LiveWsCompressionDebug logs the compression ratio of every compressed
+	// live websocket message.
+	LiveWsCompressionDebug bool `yaml:"live_ws_compression_debug"`
+	// DebugEndpoints mounts pprof under /api/v1/debug/pprof/ and runtime
+	// stats at /api/v1/debug/runtime, for users in oidc.debug_access_groups.
+	// Read at startup only.
+	DebugEndpoints bool `yaml:"debug_endpoints"`
+	// Cookie overrides attributes of the session cookie. Its Secure flag
+	// always follows PublicURL.
+	Cookie CookieConfig `yaml:"cookie"`
+	// SessionRefreshWindow is a Go duration: a session used this close to
+	// its expiry is renewed (OIDC token refresh, or extending a local user
+	// session) and its cookie re-issued. Default "5m".
+	SessionRefreshWindow string `yaml:"session_refresh_window"`
+	// LocalUsers may log in with a password via /api/v1/auth/login-local,
+	// for deployments without (or cut off from) an OIDC provider.
+	LocalUsers []LocalUser `yaml:"local_users"`
+}
+
+// LocalUser is a statically configured user with a bcrypt password hash.
+type LocalUser struct {
+	Username string `yaml:"username"`
+	// PasswordHash is a bcrypt hash, e.g. the part after "user:" printed by
+	// `htpasswd -nbB user <password>`.
+	PasswordHash string `yaml:"password_hash"`
+	// Groups are matched by control_rules and the debug/admin groups like
+	// the groups of an OIDC user.
+	Groups []string `yaml:"groups"`
+}
+
+// CookieConfig configures the session cookie. Unset fields keep the defaults.
+type CookieConfig struct {
+	// Name of the cookie, default "session_id". Over https with no Domain the
+	// name gets the "__Host-" prefix; a cookie still sent under the plain
+	// name is accepted and moved to the prefixed one.
+	Name   string `yaml:"name"`
+	Domain string `yaml:"domain"`
+	// SameSite is "Lax" (default), "Strict" or "None".
+	SameSite string `yaml:"same_site"`
+	// MaxAge is a Go duration (e.g. "720h") for which the cookie of a
+	// logged-in user stays valid without use. Default 31 days.
+	MaxAge string `yaml:"max_age"`
 }
 
 type OidcConfig struct {
@@ -207,10 +425,31 @@ type OidcConfig struct {
 	MembershipExpirationTimestampClaim string   `yaml:"membership_expiration_timestamp_claim"`
 	GroupsClaim                        string   `yaml:"groups_claim"`
 	DebugAccessGroups                  []string `yaml:"debug_access_groups"`
+	// AdminGroups may list and revoke the sessions of all users.
+	AdminGroups []string `yaml:"admin_groups"`
 }
 
 type FrigateConfig struct {
 	Url string `yaml:"url"`
+	// ImageTTL is a Go duration: how long /image/:name serves a camera image
+	// before fetching it from Frigate again. Default "30s".
+	ImageTTL string `yaml:"image_ttl"`
+	// SnapshotCacheBusting adds ?cache=<fetch time> to snapshot URLs, as
+	// before snapshots had ETag and Last-Modified validators.
+	SnapshotCacheBusting bool `yaml:"snapshot_cache_busting"`
+	// Snapshots sets the snapshot variant sizes, quality and refresh interval.
+	Snapshots SnapshotsConfig `yaml:"snapshots"`
+	// Auth is sent with every request to Frigate.
+	Auth FrigateAuthConfig `yaml:"auth"`
+	// Timeout is a Go duration bounding each request to Frigate. Default
+	// "10s".
+	Timeout string `yaml:"timeout"`
+	// Archive optionally keeps periodic snapshots on disk. When nil, nothing
+	// is archived and the /api/v1/camera-archive endpoints return 503.
+	Archive *SnapshotArchiveConfig `yaml:"archive"`
+	// MaxStreams caps the /api/v1/camera-stream clients relayed at once,
+	// each holding a connection to Frigate. Default 4.
+	MaxStreams int `yaml:"max_streams"`
 }
 
 type MQTTConfig struct {
@@ -218,6 +457,17 @@ type MQTTConfig struct {
 	Username     string `yaml:"username"`
 	Password     string `yaml:"password"`
 	PasswordFile string `yaml:"password_file"`
+	// ControlConfirmTimeout is how long a relay shows the state it was just
+	// commanded to before reverting when the device doesn't confirm it.
+	// Defaults to 5s; "0s" disables optimistic updates.
+	ControlConfirmTimeout string `yaml:"control_confirm_timeout"`
+	// ThermostatMinSetpoint and ThermostatMaxSetpoint bound the setpoint (°C)
+	// thermostats may be set to. Unset they are 5 and 30.
+	ThermostatMinSetpoint float64 `yaml:"thermostat_min_setpoint"`
+	ThermostatMaxSetpoint float64 `yaml:"thermostat_max_setpoint"`
+	// ProhibitControl are globs (path.Match syntax) on device IDs that are
+	// shown but can't be controlled, like an entity's prohibit_control.
+	ProhibitControl []string `yaml:"prohibit_control"`
 }
 
 type EntityConfig struct {
@@ -236,6 +486,51 @@ type EntityConfig struct {
 	// Used for esphome power consumption sensors, which
 	// have the CT transformer installed backwards
 	NegateValue bool `yaml:"negate_value"`
+
+	// Calibration corrects the numeric readings of the device before
+	// anything sees them
+	Calibration *CalibrationConfig `yaml:"calibration"`
+
+	// Precision is the number of decimals the numeric readings of the
+	// device are rounded to, overriding the precision of its type; -1 keeps
+	// them as reported.
+	Precision *int `yaml:"precision"`
+
+	// Turns a relay off after it has been on for this many minutes
+	AutoOffMinutes int `yaml:"auto_off_minutes"`
+
+	// StaleAfter is a Go duration after which the device counts as stale
+	// when it hasn't reported; it also puts the device under the stale
+	// alert rules without selectors
+	StaleAfter string `yaml:"stale_after"`
+
+	// Overrides for the SpaceAPI sensor entry built from this entity
+	SpaceAPI *EntitySpaceAPIConfig `yaml:"spaceapi"`
+
+	// Icon names the icon the UI shows instead of the representation's
+	// default, e.g. "fan" (see knownIcons)
+	Icon string `yaml:"icon"`
+
+	// Group and Order sort the entities of a room: by group, then order,
+	// then ID. The UI may show each group under its own heading.
+	Group string `yaml:"group"`
+	Order int    `yaml:"order"`
+
+	// Position places the entity on the floor plan
+	Position *FloorplanPoint `yaml:"position"`
+}
+
+// EntitySpaceAPIConfig customizes how an entity is published in SpaceAPI.
+type EntitySpaceAPIConfig struct {
+	// Description is published as the sensor's description. For person
+	// sensors it goes to the room's people_now_present entry.
+	Description string `yaml:"description"`
+	// Name replaces the localized name of temperature, humidity and CO2
+	// sensors.
+	Name string `yaml:"name"`
+	// Names of members to publish in the room's people_now_present entry
+	// while the person sensor counts someone.
+	Names []string `yaml:"names"`
 }
 
 type RoomConfig struct {
@@ -249,4 +544,26 @@ type RoomConfig struct {
 
 	Cameras  []string       `yaml:"cameras"`
 	Entities []EntityConfig `yaml:"entities"`
+
+	// Floorplan optionally outlines the room on the floor plan view.
+	Floorplan *RoomFloorplan `yaml:"floorplan"`
+
+	// SourceFile is the config file the room was read from, for error
+	// messages.
+	SourceFile string `yaml:"-" json:"-"`
+}
+
+// RoomFloorplan outlines a room on the floor plan, either as SVG path data or
+// as polygon points, in the coordinate system of the floor plan image.
+type RoomFloorplan struct {
+	Path   string           `yaml:"path" json:"path,omitempty"`
+	Points []FloorplanPoint `yaml:"points" json:"points,omitempty"`
+	// Label is where the room name is drawn.
+	Label *FloorplanPoint `yaml:"label" json:"label,omitempty"`
+}
+
+// FloorplanPoint is a position on the floor plan.
+type FloorplanPoint struct {
+	X float64 `yaml:"x" json:"x"`
+	Y float64 `yaml:"y" json:"y"`
 }
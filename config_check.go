@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// representationTypes maps the entity representations the web UI renders to
+// the device types that can back them.
+var representationTypes = map[string][]VdevType{
+	"light":           {VdevTypeRelay},
+	"fan":             {VdevTypeRelay},
+	"plug":            {VdevTypeRelay},
+	"contact":         {VdevTypeContact},
+	"presence":        {VdevTypePerson},
+	"person":          {VdevTypePerson},
+	"camera_snapshot": {VdevTypeCameraSnapshot},
+	"temperature":     {VdevTypeTemperature},
+	"humidity":        {VdevTypeHumidity},
+	"power":           {VdevTypePowerUsage},
+	"co":              {VdevTypeCo},
+	"co2":             {VdevTypeCO2},
+	"gas":             {VdevTypeGas},
+	"printer":         {VdevTypePrinter},
+	"comfort":         {VdevTypeComfort},
+	"noise":           {VdevTypeNoiseLevel},
+	"water_meter":     {VdevTypeWaterMeter},
+	"gas_meter":       {VdevTypeGasMeter},
+}
+
+// configField is a config value with its YAML path, for error messages.
+type configField struct {
+	name, value string
+}
+
+// runCheckConfig validates the config at path (or the first candidate when
+// empty) as -check-config does, writes a report to w and returns the exit
+// code. Nothing is started.
+func runCheckConfig(path string, w io.Writer) int {
+	if path == "" {
+		var tried []string
+		if path, tried = findConfigFile(); path == "" {
+			fmt.Fprintf(w, "No configuration file found. Tried: %v\n", tried)
+			return 1
+		}
+	}
+
+	r := checkConfigFile(path)
+	switch {
+	case len(r.Errors) > 0:
+		fmt.Fprintf(w, "%s: %d error(s), %d warning(s)\n", path, len(r.Errors), len(r.Warnings))
+	case len(r.Warnings) > 0:
+		fmt.Fprintf(w, "%s: OK, %d warning(s)\n", path, len(r.Warnings))
+	default:
+		fmt.Fprintf(w, "%s: OK\n", path)
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "  error: %v\n", err)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "  warning: %s\n", warning)
+	}
+	if len(r.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkConfigFile returns everything wrong with the config at path: what
+// loading it at startup finds, plus checkConfigStrict.
+func checkConfigFile(path string) *ConfigReport {
+	cfg, r, err := checkedConfigFile(path)
+	if err != nil {
+		r.add(err)
+		return r
+	}
+	r.Errors = append(r.Errors, checkConfigStrict(cfg)...)
+	return r
+}
+
+// checkConfigStrict finds mistakes startup tolerates but that are almost
+// certainly unintended: entities listed in more than one room, unknown
+// representations, unreadable secret files and malformed URLs.
+func checkConfigStrict(cfg *Config) []error {
+	var errs []error
+
+	entityRoom := map[string]string{}
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if prev, dup := entityRoom[ent.ID]; dup && prev == room.ID {
+				errs = append(errs, fmt.Errorf("entity %s is listed twice in room %s", ent.ID, room.ID))
+				continue
+			} else if dup {
+				errs = append(errs, fmt.Errorf("entity %s is in rooms %s and %s", ent.ID, prev, room.ID))
+				continue
+			}
+			entityRoom[ent.ID] = room.ID
+			if _, ok := representationTypes[ent.Representation]; ent.Representation != "" && !ok {
+				errs = append(errs, fmt.Errorf("entity %s has unknown representation %q", ent.ID, ent.Representation))
+			}
+		}
+	}
+
+	secretFiles := []configField{
+		{"mqtt.password_file", cfg.MQTT.PasswordFile},
+		{"phabricator.api_token_file", cfg.Phabricator.APITokenFile},
+		{"metrics.token_file", cfg.Metrics.TokenFile},
+		{"metrics.basic_auth_password_file", cfg.Metrics.BasicAuthPasswordFile},
+		{"frigate.auth.token_file", cfg.Frigate.Auth.TokenFile},
+		{"frigate.auth.basic_auth_password_file", cfg.Frigate.Auth.BasicAuthPasswordFile},
+	}
+	if cfg.Oidc != nil {
+		secretFiles = append(secretFiles, configField{"oidc.client_secret_file", cfg.Oidc.ClientSecretFile})
+	}
+	if cfg.Grafana != nil {
+		secretFiles = append(secretFiles, configField{"grafana.token_file", cfg.Grafana.TokenFile})
+	}
+	for i, p := range cfg.BambuPrinters {
+		secretFiles = append(secretFiles, configField{fmt.Sprintf("bambu_printers[%d].password_file", i), p.PasswordFile})
+	}
+	if d := cfg.Dhcp; d != nil {
+		secretFiles = append(secretFiles, configField{"dhcp.router.password_file", d.Router.PasswordFile})
+		for i, src := range d.WiredSources {
+			secretFiles = append(secretFiles, configField{fmt.Sprintf("dhcp.wired_sources[%d].password_file", i), src.PasswordFile})
+		}
+		for i, src := range d.WifiSources {
+			secretFiles = append(secretFiles, configField{fmt.Sprintf("dhcp.wifi_sources[%d].password_file", i), src.PasswordFile})
+		}
+	}
+	for _, f := range secretFiles {
+		if f.value == "" {
+			continue
+		}
+		if _, err := os.ReadFile(f.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s can't be read: %v", f.name, err))
+		}
+	}
+
+	// Absolute URLs need a scheme and a host; branding links may be paths.
+	absoluteURLs := []configField{
+		{"web.public_url", cfg.Web.PublicURL},
+		{"mqtt.broker", cfg.MQTT.Broker},
+		{"frigate.url", cfg.Frigate.Url},
+		{"phabricator.url", cfg.Phabricator.URL},
+		{"spaceapi.url", cfg.SpaceAPI.Url},
+	}
+	if cfg.Oidc != nil {
+		absoluteURLs = append(absoluteURLs, configField{"oidc.issuer_url", cfg.Oidc.IssuerURL})
+	}
+	if cfg.Dhcp != nil {
+		for i, src := range cfg.Dhcp.WifiSources {
+			absoluteURLs = append(absoluteURLs, configField{fmt.Sprintf("dhcp.wifi_sources[%d].url", i), src.URL})
+		}
+	}
+	for _, f := range absoluteURLs {
+		if f.value == "" {
+			continue
+		}
+		if u, err := url.Parse(f.value); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is not an absolute URL: %q", f.name, f.value))
+		}
+	}
+	b := cfg.Branding
+	for _, f := range []configField{
+		{"branding.logo_url", b.LogoURL},
+		{"branding.logo_dark_url", b.LogoDarkURL},
+		{"branding.logo_link_url", b.LogoLinkURL},
+		{"branding.favicon_url", b.FaviconURL},
+		{"branding.footer_name_link_url", b.FooterNameLinkURL},
+	} {
+		if _, err := url.Parse(f.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s is not a valid URL: %v", f.name, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, tc := range []struct {
+		name    string
+		config  string
+		wantErr []string
+	}{
+		{
+			name:   "valid",
+			config: "web:\n  public_url: https://at2.example.com\nrooms:\n  - id: lab\n    entities:\n      - id: lab/light\n        representation: light\n",
+		},
+		{
+			name:    "unknown key",
+			config:  "rooms:\n  - id: lab\n    localised_name:\n      en: Lab\n",
+			wantErr: []string{"unknown field"},
+		},
+		{
+			name:    "duplicate entity",
+			config:  "rooms:\n  - id: lab\n    entities:\n      - id: lab/temp\n  - id: hall\n    entities:\n      - id: lab/temp\n",
+			wantErr: []string{"entity lab/temp is in rooms lab and hall"},
+		},
+		{
+			name:    "unknown representation",
+			config:  "rooms:\n  - id: lab\n    entities:\n      - id: lab/light\n        representation: lamp\n",
+			wantErr: []string{`unknown representation "lamp"`},
+		},
+		{
+			name:    "unreadable secret",
+			config:  "mqtt:\n  broker: tcp://mqtt:1883\n  password_file: " + missing + "\nrooms:\n  - id: lab\n",
+			wantErr: []string{"mqtt.password_file can't be read"},
+		},
+		{
+			name:    "bad urls",
+			config:  "web:\n  public_url: at2.example.com\nmqtt:\n  broker: \"tcp://mqtt:port\"\nrooms:\n  - id: lab\n",
+			wantErr: []string{"web.public_url is not an absolute URL", "mqtt.broker is not an absolute URL"},
+		},
+		{
+			name:    "startup errors are all reported",
+			config:  "rooms:\n  - id: lab\n  - id: lab\nscenes:\n  - name: empty\n",
+			wantErr: []string{`duplicate room ID "lab"`, `scene "empty" has no commands`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "at2.yaml")
+			writeTestConfig(t, path, tc.config)
+
+			problems := checkConfigFile(path).Errors
+			if len(problems) != len(tc.wantErr) {
+				t.Fatalf("problems = %v, want %d", problems, len(tc.wantErr))
+			}
+			for i, want := range tc.wantErr {
+				if !strings.Contains(problems[i].Error(), want) {
+					t.Errorf("problems[%d] = %v, want %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCheckConfig_Report(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, path, "frigate:\n  url: http://frigate:5000\nmqtt:\n  broker: tcp://mqtt:1883\nmetrics:\n  disabled: true\nrooms:\n  - id: lab\n")
+	var out bytes.Buffer
+	if code := runCheckConfig(path, &out); code != 0 || out.String() != path+": OK\n" {
+		t.Fatalf("exit %d, report %q", code, out.String())
+	}
+
+	writeTestConfig(t, path, "rooms:\n  - id: lab\n    entities:\n      - id: a\n        representation: lamp\n      - id: a\n")
+	out.Reset()
+	if code := runCheckConfig(path, &out); code != 1 || !strings.Contains(out.String(), "2 error(s), 3 warning(s)\n  error: entity a has unknown representation \"lamp\"\n  error: entity a is listed twice in room lab\n  warning: frigate.url is empty") {
+		t.Fatalf("exit %d, report %q", code, out.String())
+	}
+}
@@ -1,31 +1,56 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"time"
-
+	"path/filepath"
 	"strings"
-
-	"github.com/goccy/go-yaml"
+	"sync/atomic"
+	"time"
 )
 
 // Config is defined in config.go
 
-// Global immutable configuration instance.
-// Loaded once by MustLoadConfig() at program start.
-var ConfigInstance *Config
+// currentConfig holds the active configuration. A reload replaces it as a
+// whole, so every GetConfig caller sees either the old or the new config.
+var currentConfig atomic.Pointer[Config]
+
+// configPath is the file the configuration was loaded from, read again on
+// reload.
+var configPath string
+
+// configLog is the logger of config loading; main replaces it with the
+// configured one once the config is loaded.
+var configLog = slog.Default()
 
-// MustLoadConfig loads the configuration from the first existing candidate path
-// and stores it in ConfigInstance. It fatals if no valid config is found.
+// LoadConfig loads the configuration from the first existing candidate path
+// and makes it the active one. It fails if no valid config is found.
 // If CONFIG_PATH env var is set, it is tried first.
-func MustLoadConfig() *Config {
-	if ConfigInstance != nil {
-		return ConfigInstance
+func LoadConfig() (*Config, error) {
+	if cfg := GetConfig(); cfg != nil {
+		return cfg, nil
 	}
 
+	path, tried := findConfigFile()
+	if path == "" {
+		return nil, fmt.Errorf("no configuration file found, tried %v", tried)
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	setConfig(cfg)
+	configPath = path
+	configLog.Info("loaded config", "path", path)
+	return cfg, nil
+}
+
+// findConfigFile returns the first existing candidate path, or "" and the
+// paths tried.
+func findConfigFile() (string, []string) {
 	candidates := []string{
 		os.Getenv("CONFIG_PATH"),
 		"at2.yaml",
@@ -40,119 +65,345 @@ func MustLoadConfig() *Config {
 		}
 		tried = append(tried, path)
 
-		data, err := os.ReadFile(path)
+		if _, err := os.Stat(path); err == nil {
+			return path, tried
+		}
+	}
+	return "", tried
+}
+
+// ConfigReport collects the errors and warnings found loading a config.
+type ConfigReport struct {
+	Errors   []error
+	Warnings []string
+}
+
+func (r *ConfigReport) add(err error) {
+	if err != nil {
+		r.Errors = append(r.Errors, err)
+	}
+}
+
+func (r *ConfigReport) warnf(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Err joins the errors, nil if there are none.
+func (r *ConfigReport) Err() error {
+	return errors.Join(r.Errors...)
+}
+
+// logWarnings logs every warning.
+func (r *ConfigReport) logWarnings() {
+	for _, w := range r.Warnings {
+		configLog.Warn(w)
+	}
+}
+
+// loadConfigFile reads, parses and validates a config file. Warnings are
+// logged.
+func loadConfigFile(path string) (*Config, error) {
+	cfg, r, err := checkedConfigFile(path)
+	r.logWarnings()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, r.Err()
+}
+
+// checkedConfigFile reads and validates a config file, returning everything
+// found. err is set only when the file can't be read or parsed at all.
+func checkedConfigFile(path string) (*Config, *ConfigReport, error) {
+	r := &ConfigReport{}
+	cfg, err := readConfigFile(path, r)
+	if err != nil {
+		return nil, r, err
+	}
+	validateConfig(cfg, path, r)
+	return cfg, r, nil
+}
+
+// readConfigFile parses a config file and merges in the files it includes.
+// Unknown keys are errors in r, or warnings with strict: false.
+func readConfigFile(path string, r *ConfigReport) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	unknown, err := decodeConfigData(data, path, &cfg, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML in %s: %w", path, err)
+	}
+	for i := range cfg.Rooms {
+		cfg.Rooms[i].SourceFile = path
+	}
+
+	for _, file := range includedFiles(&cfg, path) {
+		data, err := os.ReadFile(file)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to read include %s: %w", file, err)
 		}
-		var cfg Config
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			log.Fatalf("Failed to parse YAML in %s: %v", path, err)
+		var inc ConfigInclude
+		incUnknown, err := decodeConfigData(data, file, &inc, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse YAML in %s: %w", file, err)
 		}
+		unknown = append(unknown, incUnknown...)
+		for i := range inc.Rooms {
+			inc.Rooms[i].SourceFile = file
+		}
+		cfg.Rooms = append(cfg.Rooms, inc.Rooms...)
+		cfg.Scenes = append(cfg.Scenes, inc.Scenes...)
+	}
 
-		validateConfig(&cfg, path)
-		ConfigInstance = &cfg
-		log.Printf("Loaded config from %s", path)
-		return ConfigInstance
+	for _, err := range unknown {
+		if cfg.Strict != nil && !*cfg.Strict {
+			r.warnf("%v", err)
+		} else {
+			r.add(err)
+		}
 	}
+	return &cfg, nil
+}
 
-	log.Fatalf("No configuration file found. Tried: %v", tried)
-	return nil
+// includedFiles returns the paths of the files cfg includes, resolved
+// relative to the directory of path.
+func includedFiles(cfg *Config, path string) []string {
+	files := make([]string, len(cfg.Include))
+	for i, file := range cfg.Include {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		files[i] = file
+	}
+	return files
 }
 
-// GetConfig returns the loaded configuration (nil if not yet loaded).
+// decodeConfig parses YAML config strictly, so a misspelled or removed option
+// fails instead of being silently ignored. All unknown keys are reported.
+func decodeConfig(data []byte, cfg *Config) error {
+	unknown, err := decodeConfigData(data, "config", cfg, nil)
+	if err != nil {
+		return err
+	}
+	return errors.Join(unknown...)
+}
+
+// GetConfig returns the active configuration (nil if not yet loaded). Keep
+// the result for the duration of a request rather than calling it for every
+// field, so a reload in between can't mix two configs.
 func GetConfig() *Config {
-	return ConfigInstance
+	return currentConfig.Load()
+}
+
+// setConfig makes cfg the active configuration.
+func setConfig(cfg *Config) {
+	currentConfig.Store(cfg)
 }
 
-// Basic validation & warnings.
-func validateConfig(cfg *Config, path string) {
-	loadSecret(&cfg.MQTT.Password, cfg.MQTT.PasswordFile)
-	loadSecret(&cfg.Oidc.ClientSecret, cfg.Oidc.ClientSecretFile)
-	loadSecret(&cfg.Oidc.ClientSecret, cfg.Oidc.ClientSecretFile)
-	loadSecret(&cfg.Phabricator.APIToken, cfg.Phabricator.APITokenFile)
-	validateDhcpConfig(cfg, path)
+// validateConfig loads secrets from their _file variants and adds the
+// problems it finds to r.
+func validateConfig(cfg *Config, path string, r *ConfigReport) {
+	r.loadSecret(&cfg.MQTT.Password, cfg.MQTT.PasswordFile)
+	if cfg.Oidc != nil {
+		r.loadSecret(&cfg.Oidc.ClientSecret, cfg.Oidc.ClientSecretFile)
+	}
+	r.loadSecret(&cfg.Phabricator.APIToken, cfg.Phabricator.APITokenFile)
+	r.loadSecret(&cfg.Metrics.Token, cfg.Metrics.TokenFile)
+	r.loadSecret(&cfg.Metrics.BasicAuthPassword, cfg.Metrics.BasicAuthPasswordFile)
+	r.loadSecret(&cfg.Frigate.Auth.Token, cfg.Frigate.Auth.TokenFile)
+	if g := cfg.Grafana; g != nil {
+		r.loadSecret(&g.Token, g.TokenFile)
+	}
+	r.loadSecret(&cfg.Frigate.Auth.BasicAuthPassword, cfg.Frigate.Auth.BasicAuthPasswordFile)
+	for i := range cfg.Notifications.Webhooks {
+		r.loadSecret(&cfg.Notifications.Webhooks[i].URL, cfg.Notifications.Webhooks[i].URLFile)
+	}
+	if m := cfg.Notifications.Matrix; m != nil {
+		r.loadSecret(&m.AccessToken, m.AccessTokenFile)
+	}
+	if tg := cfg.Notifications.Telegram; tg != nil {
+		r.loadSecret(&tg.BotToken, tg.BotTokenFile)
+	}
+	r.add(validateDhcpConfig(cfg, path, r))
+	r.add(validateSessionConfig(cfg, path, r))
+	r.add(validateLocalUsers(cfg, path))
+	r.add(validateListenConfig(cfg, path))
+	r.add(validateTrustedProxies(cfg, path))
 
 	for i := range cfg.BambuPrinters {
-		loadSecret(&cfg.BambuPrinters[i].Password, cfg.BambuPrinters[i].PasswordFile)
+		r.loadSecret(&cfg.BambuPrinters[i].Password, cfg.BambuPrinters[i].PasswordFile)
 		if cfg.BambuPrinters[i].ID == "" {
-			log.Printf("warning: bambu_printers[%d] has empty id in %s", i, path)
+			r.warnf("bambu_printers[%d] has empty id in %s", i, path)
 		}
 		if cfg.BambuPrinters[i].SerialNumber == "" {
-			log.Printf("warning: bambu_printers[%d] (%s) has empty serial_number in %s", i, cfg.BambuPrinters[i].ID, path)
+			r.warnf("bambu_printers[%d] (%s) has empty serial_number in %s", i, cfg.BambuPrinters[i].ID, path)
 		}
 	}
 
 	if cfg.Frigate.Url == "" {
-		log.Printf("warning: frigate.url is empty in %s", path)
+		r.warnf("frigate.url is empty in %s", path)
+	}
+	if val := cfg.Frigate.ImageTTL; val != "" {
+		if d, err := time.ParseDuration(val); err != nil || d < 0 {
+			r.add(fmt.Errorf("frigate.image_ttl is not a valid duration (%q) in %s", val, path))
+		}
 	}
+	r.add(validateSnapshotsConfig(cfg, path))
+	r.add(validateFrigateClientConfig(cfg, path))
+	r.add(validateSnapshotArchiveConfig(cfg, path))
+	r.add(validateCameraStreamConfig(cfg, path))
 	if cfg.MQTT.Broker == "" {
-		log.Printf("warning: mqtt.broker is empty in %s", path)
+		r.warnf("mqtt.broker is empty in %s", path)
+	}
+	if val := cfg.MQTT.ControlConfirmTimeout; val != "" {
+		if d, err := time.ParseDuration(val); err != nil || d < 0 {
+			r.add(fmt.Errorf("mqtt.control_confirm_timeout is not a valid duration (%q) in %s", val, path))
+		}
 	}
-	nameSeen := map[string]struct{}{}
+	if lo, hi := thermostatSetpointRange(cfg); lo >= hi {
+		r.add(fmt.Errorf("mqtt.thermostat_min_setpoint (%v) must be below mqtt.thermostat_max_setpoint (%v) in %s", lo, hi, path))
+	}
+	roomSource := func(room RoomConfig) string {
+		if room.SourceFile != "" {
+			return room.SourceFile
+		}
+		return path
+	}
+	roomSeen := map[string]RoomConfig{}
 	for i, room := range cfg.Rooms {
 		if room.ID == "" {
-			log.Printf("warning: rooms[%d] has empty ID in %s", i, path)
-		} else if _, dup := nameSeen[room.ID]; dup {
-			log.Fatalf("error: duplicate room ID %q in %s", room.ID, path)
+			r.warnf("rooms[%d] has empty ID in %s", i, roomSource(room))
+		} else if prev, dup := roomSeen[room.ID]; dup {
+			r.add(fmt.Errorf("duplicate room ID %q in %s and %s", room.ID, roomSource(prev), roomSource(room)))
 		} else {
-			nameSeen[room.ID] = struct{}{}
+			roomSeen[room.ID] = room
 		}
 	}
 	if len(cfg.Rooms) == 0 {
-		log.Printf("warning: No rooms defined in %s", path)
+		r.warnf("No rooms defined in %s", path)
+	}
+	r.add(validateControlRules(cfg, path))
+	r.add(validateProhibitControl(cfg, path))
+	r.add(validateAutoOff(cfg, path))
+	r.add(validateCalibration(cfg, path))
+	r.add(validatePrecision(cfg, path))
+	r.add(validateComfortConfig(cfg, path))
+	r.add(validateScenes(cfg, path))
+	r.add(validateAlertsConfig(cfg, path))
+	r.add(validateNotificationsConfig(cfg, path))
+	r.add(validateMQTTAlertsConfig(cfg, path))
+	r.add(validateMatrixConfig(cfg, path))
+	r.add(validateTelegramConfig(cfg, path))
+	r.add(validateDigestConfig(cfg, path))
+	r.add(validateAlertEscalationTargets(cfg, path))
+	r.add(validateRoomLayout(cfg, path))
+	r.add(validateReconcileDelay(cfg, path))
+	r.add(validateHealthConfig(cfg, path))
+	r.add(validateLoggingConfig(cfg, path))
+	r.add(validateSpaceAPIConfig(cfg, path))
+	r.add(validateUnitsConfig(cfg, path))
+	r.add(validateMetricsConfig(cfg, path, r))
+	r.add(validatePrometheusConfig(cfg, path))
+	r.add(validateGrafanaConfig(cfg, path))
+	r.add(validateEnergyConfig(cfg, path))
+	r.add(validateWeatherConfig(cfg, path))
+	r.add(validateSunConfig(cfg, path))
+	r.add(validateUsageStatsConfig(cfg, path))
+	r.add(validateDatabaseBackupConfig(cfg, path))
+}
+
+// validateSessionConfig rejects session lifetimes that can't be parsed and
+// cookie attributes browsers would reject.
+func validateSessionConfig(cfg *Config, path string, r *ConfigReport) error {
+	positiveDuration := func(field, val string) error {
+		if val == "" {
+			return nil
+		}
+		if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+			return fmt.Errorf("web.%s is not a positive duration (%q) in %s", field, val, path)
+		}
+		return nil
+	}
+	if err := positiveDuration("cookie.max_age", cfg.Web.Cookie.MaxAge); err != nil {
+		return err
 	}
+	if err := positiveDuration("session_refresh_window", cfg.Web.SessionRefreshWindow); err != nil {
+		return err
+	}
+
+	ck := cfg.Web.Cookie
+	switch strings.ToLower(ck.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !isHTTPSURL(cfg.Web.PublicURL) {
+			r.warnf("web.cookie.same_site None requires https, browsers will drop the session cookie (%s)", path)
+		}
+	default:
+		return fmt.Errorf("web.cookie.same_site must be Lax, Strict or None (got %q) in %s", ck.SameSite, path)
+	}
+	return nil
 }
 
-// validateDhcpConfig loads DHCP secrets from their _file variants and fails
-// fast on malformed durations, CIDRs, or unknown source kinds.
-func validateDhcpConfig(cfg *Config, path string) {
+// validateDhcpConfig loads DHCP secrets from their _file variants and rejects
+// malformed durations, CIDRs, or unknown source kinds.
+func validateDhcpConfig(cfg *Config, path string, r *ConfigReport) error {
 	d := cfg.Dhcp
 	if d == nil {
-		return
+		return nil
 	}
 
-	loadSecret(&d.Router.Password, d.Router.PasswordFile)
+	r.loadSecret(&d.Router.Password, d.Router.PasswordFile)
 	for i := range d.WiredSources {
-		loadSecret(&d.WiredSources[i].Password, d.WiredSources[i].PasswordFile)
+		r.loadSecret(&d.WiredSources[i].Password, d.WiredSources[i].PasswordFile)
 	}
 	for i := range d.WifiSources {
-		loadSecret(&d.WifiSources[i].Password, d.WifiSources[i].PasswordFile)
+		r.loadSecret(&d.WifiSources[i].Password, d.WifiSources[i].PasswordFile)
 	}
 
-	mustDuration := func(field, val string) {
+	for field, val := range map[string]string{
+		"scrape_interval":   d.ScrapeInterval,
+		"offline_threshold": d.OfflineThreshold,
+		"prune_after":       d.PruneAfter,
+	} {
 		if val == "" {
-			return
+			continue
 		}
 		if _, err := time.ParseDuration(val); err != nil {
-			log.Fatalf("error: dhcp.%s is not a valid duration (%q) in %s: %v", field, val, path, err)
+			return fmt.Errorf("dhcp.%s is not a valid duration (%q) in %s: %v", field, val, path, err)
 		}
 	}
-	mustDuration("scrape_interval", d.ScrapeInterval)
-	mustDuration("offline_threshold", d.OfflineThreshold)
-	mustDuration("prune_after", d.PruneAfter)
 
-	mustCidrs := func(field string, cidrs []string) {
+	checkCidrs := func(field string, cidrs []string) error {
 		for _, c := range cidrs {
 			if _, _, err := net.ParseCIDR(c); err != nil {
-				log.Fatalf("error: dhcp.%s contains invalid CIDR %q in %s: %v", field, c, path, err)
+				return fmt.Errorf("dhcp.%s contains invalid CIDR %q in %s: %v", field, c, path, err)
 			}
 		}
+		return nil
+	}
+	if err := checkCidrs("access.default_cidrs", d.Access.DefaultCidrs); err != nil {
+		return err
 	}
-	mustCidrs("access.default_cidrs", d.Access.DefaultCidrs)
 	for group, cidrs := range d.Access.GroupCidrs {
-		mustCidrs(fmt.Sprintf("access.group_cidrs[%s]", group), cidrs)
+		if err := checkCidrs(fmt.Sprintf("access.group_cidrs[%s]", group), cidrs); err != nil {
+			return err
+		}
 	}
 
 	if d.Router.Kind == "" {
-		log.Printf("warning: dhcp.router.kind is empty in %s; lease scraping disabled", path)
+		r.warnf("dhcp.router.kind is empty in %s; lease scraping disabled", path)
 	}
+	return nil
 }
 
-func loadSecret(target *string, file string) {
+// loadSecret reads *target from file unless it is set already.
+func (r *ConfigReport) loadSecret(target *string, file string) {
 	if *target == "" && file != "" {
 		data, err := os.ReadFile(file)
 		if err != nil {
-			log.Printf("warning: failed to read secret from file %s: %v", file, err)
+			r.warnf("failed to read secret from file %s: %v", file, err)
 			return
 		}
 		*target = strings.TrimSpace(string(data))
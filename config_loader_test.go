@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfig_Example(t *testing.T) {
+	data, err := os.ReadFile("at2.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if err := decodeConfig(data, &cfg); err != nil {
+		t.Fatalf("at2.example.yaml: %v", err)
+	}
+}
+
+func TestDecodeConfig_RejectsUnknownKeys(t *testing.T) {
+	for _, data := range []string{
+		"spaceapi:\n  space: Test\n  extra_field: 1\n",
+		"rooms:\n  - id: lab\n    entities:\n      - id: lab/temp\n        spaceapi:\n          descripton: typo\n",
+	} {
+		var cfg Config
+		err := decodeConfig([]byte(data), &cfg)
+		if err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Fatalf("decodeConfig(%q) = %v, want unknown field error", data, err)
+		}
+	}
+}
+
+func TestLoadConfigFile_Include(t *testing.T) {
+	dir := t.TempDir()
+	writeTestConfig(t, filepath.Join(dir, "at2.yaml"), "include:\n  - rooms/workshop.yaml\nrooms:\n  - id: hall\n")
+	if err := os.Mkdir(filepath.Join(dir, "rooms"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestConfig(t, filepath.Join(dir, "rooms", "workshop.yaml"),
+		"rooms:\n  - id: lab\n    entities:\n      - id: lab/light\nscenes:\n  - name: lab_off\n    commands:\n      - device_id: lab/light\n        state: \"OFF\"\n")
+
+	cfg, err := loadConfigFile(filepath.Join(dir, "at2.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rooms) != 2 || cfg.Rooms[0].ID != "hall" || cfg.Rooms[1].ID != "lab" || len(cfg.Rooms[1].Entities) != 1 {
+		t.Fatalf("rooms = %+v", cfg.Rooms)
+	}
+	if cfg.Rooms[0].SourceFile != filepath.Join(dir, "at2.yaml") || cfg.Rooms[1].SourceFile != filepath.Join(dir, "rooms", "workshop.yaml") {
+		t.Fatalf("sources = %q, %q", cfg.Rooms[0].SourceFile, cfg.Rooms[1].SourceFile)
+	}
+	if len(cfg.Scenes) != 1 || cfg.Scenes[0].Name != "lab_off" {
+		t.Fatalf("scenes = %+v", cfg.Scenes)
+	}
+}
+
+func TestLoadConfigFile_IncludeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		main    string
+		include string
+		wantErr string
+	}{
+		{
+			name:    "duplicate room across files",
+			main:    "include: [extra.yaml]\nrooms:\n  - id: lab\n",
+			include: "rooms:\n  - id: lab\n",
+			wantErr: `duplicate room ID "lab" in DIR/at2.yaml and DIR/extra.yaml`,
+		},
+		{
+			name:    "only rooms and scenes",
+			main:    "include: [extra.yaml]\n",
+			include: "mqtt:\n  broker: tcp://other:1883\n",
+			wantErr: `DIR/extra.yaml:1:1: unknown field "mqtt" in top level`,
+		},
+		{
+			name:    "missing include",
+			main:    "include: [missing.yaml]\n",
+			wantErr: "failed to read include DIR/missing.yaml",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestConfig(t, filepath.Join(dir, "at2.yaml"), tc.main)
+			if tc.include != "" {
+				writeTestConfig(t, filepath.Join(dir, "extra.yaml"), tc.include)
+			}
+			_, err := loadConfigFile(filepath.Join(dir, "at2.yaml"))
+			if want := strings.ReplaceAll(tc.wantErr, "DIR", dir); err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("err = %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile_CollectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, path, `mqtt:
+  brokr: tcp://mqtt:1883
+rooms:
+  - id: lab
+    localised_name:
+      en: Lab
+    entities:
+      - id: lab/temp
+        spaceapi:
+          descripton: Bench
+scenes:
+  - name: off
+    commands:
+      - device_id: lab/light
+        state: {position: 0, speed: 1}
+colour: red
+`)
+	r := &ConfigReport{}
+	if _, err := readConfigFile(path, r); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		path + `:2:3: unknown field "brokr" in mqtt`,
+		path + `:5:5: unknown field "localised_name" in rooms[0]`,
+		path + `:10:11: unknown field "descripton" in rooms[0].entities[0].spaceapi`,
+		path + `:16:1: unknown field "colour" in top level`,
+	}
+	if len(r.Errors) != len(want) || len(r.Warnings) != 0 {
+		t.Fatalf("errors = %v, warnings = %v", r.Errors, r.Warnings)
+	}
+	for i := range want {
+		if r.Errors[i].Error() != want[i] {
+			t.Errorf("errors[%d] = %q, want %q", i, r.Errors[i], want[i])
+		}
+	}
+}
+
+func TestReadConfigFile_NotStrict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, path, "strict: false\nrooms:\n  - id: lab\n    localised_name:\n      en: Lab\n")
+	r := &ConfigReport{}
+	cfg, err := readConfigFile(path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 0 || len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], `unknown field "localised_name"`) {
+		t.Fatalf("errors = %v, warnings = %v", r.Errors, r.Warnings)
+	}
+	if cfg.Rooms[0].ID != "lab" {
+		t.Fatalf("rooms = %+v", cfg.Rooms)
+	}
+}
+
+func TestReadConfigFile_DeprecatedKeys(t *testing.T) {
+	deprecatedConfigKeys["rooms[].entities[].negate_value"] = "use a template instead"
+	t.Cleanup(func() { delete(deprecatedConfigKeys, "rooms[].entities[].negate_value") })
+
+	path := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, path, "rooms:\n  - id: lab\n    entities:\n      - id: lab/power\n        negate_value: true\n")
+	r := &ConfigReport{}
+	cfg, err := readConfigFile(path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := path + ":5:9: rooms[0].entities[0].negate_value is deprecated; use a template instead"
+	if len(r.Errors) != 0 || len(r.Warnings) != 1 || r.Warnings[0] != want {
+		t.Fatalf("errors = %v, warnings = %v", r.Errors, r.Warnings)
+	}
+	if !cfg.Rooms[0].Entities[0].NegateValue {
+		t.Fatal("deprecated key not decoded")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 5 * time.Second
+
+// ConfigReloadStats is served by GET /api/v1/debug/config-reload.
+type ConfigReloadStats struct {
+	Reloads      int       `json:"reloads"`
+	Failures     int       `json:"failures"`
+	LastReloadAt time.Time `json:"last_reload_at,omitzero"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+var (
+	// configReloadMu serializes reloads and guards the hooks and stats.
+	configReloadMu    sync.Mutex
+	configReloadHooks []func(*Config)
+	configReloadStats ConfigReloadStats
+)
+
+// OnConfigReload registers a hook called with the new config after every
+// successful reload. Hooks run one after another on the reloading goroutine.
+func OnConfigReload(hook func(*Config)) {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+	configReloadHooks = append(configReloadHooks, hook)
+}
+
+// reloadConfig parses and validates the config at path and, if it is valid,
+// makes it the active one and runs the reload hooks. An invalid config is
+// rejected and the active one kept.
+//
+// Only what is read through GetConfig or a hook follows a reload; the MQTT
+// connection, database, listen address and services set up at startup need a
+// restart.
+func reloadConfig(path string) error {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		configReloadStats.Failures++
+		configReloadStats.LastError = err.Error()
+		return err
+	}
+	setConfig(cfg)
+	for _, hook := range configReloadHooks {
+		hook(cfg)
+	}
+	configReloadStats.Reloads++
+	configReloadStats.LastReloadAt = time.Now()
+	configReloadStats.LastError = ""
+	return nil
+}
+
+// watchConfig reloads the config file on SIGHUP and when it or a file it
+// includes changes.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// modTime is the latest modification time of the config and the files
+	// it includes.
+	modTime := func() time.Time {
+		var latest time.Time
+		files := []string{path}
+		if cfg := GetConfig(); cfg != nil {
+			files = append(files, includedFiles(cfg, path)...)
+		}
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+		return latest
+	}
+	lastMod := modTime()
+
+	go func() {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		for {
+			reason := "SIGHUP"
+			select {
+			case <-hup:
+			case <-ticker.C:
+				mod := modTime()
+				if mod.IsZero() || mod.Equal(lastMod) {
+					continue
+				}
+				reason = "file change"
+			}
+			lastMod = modTime()
+			if err := reloadConfig(path); err != nil {
+				configLog.Warn("reload rejected, keeping the current config", "reason", reason, "err", err)
+				continue
+			}
+			configLog.Info("reloaded config", "path", path, "reason", reason)
+		}
+	}()
+}
+
+func handleConfigReloadStats(c *fiber.Ctx) error {
+	configReloadMu.Lock()
+	stats := configReloadStats
+	configReloadMu.Unlock()
+	return c.JSON(stats)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setupConfigReloadTest writes a config with one room to a temp file, makes
+// it the active one and returns its path.
+func setupConfigReloadTest(t *testing.T) string {
+	t.Helper()
+	configReloadMu.Lock()
+	prevCfg, prevHooks, prevStats := GetConfig(), configReloadHooks, configReloadStats
+	configReloadHooks, configReloadStats = nil, ConfigReloadStats{}
+	configReloadMu.Unlock()
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		configReloadMu.Lock()
+		configReloadHooks, configReloadStats = prevHooks, prevStats
+		configReloadMu.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, path, "rooms:\n  - id: lab\n")
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+	return path
+}
+
+func writeTestConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig_SwapsAndRunsHooks(t *testing.T) {
+	path := setupConfigReloadTest(t)
+	var got *Config
+	OnConfigReload(func(cfg *Config) { got = cfg })
+
+	writeTestConfig(t, path, "rooms:\n  - id: lab\n  - id: hall\n")
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := GetConfig(); len(cfg.Rooms) != 2 || cfg.Rooms[1].ID != "hall" {
+		t.Fatalf("rooms after reload = %+v", cfg.Rooms)
+	}
+	if got != GetConfig() {
+		t.Fatal("hook didn't get the new config")
+	}
+	if configReloadStats.Reloads != 1 || configReloadStats.LastReloadAt.IsZero() {
+		t.Fatalf("stats = %+v", configReloadStats)
+	}
+}
+
+func TestReloadConfig_KeepsOldConfigWhenInvalid(t *testing.T) {
+	path := setupConfigReloadTest(t)
+	prev := GetConfig()
+	hookCalled := false
+	OnConfigReload(func(*Config) { hookCalled = true })
+
+	for _, data := range []string{
+		"rooms:\n  - id: lab\n    typo: 1\n",
+		"rooms:\n  - id: lab\n  - id: lab\n",
+		"scenes:\n  - name: empty\n",
+	} {
+		writeTestConfig(t, path, data)
+		if err := reloadConfig(path); err == nil {
+			t.Fatalf("reload of %q succeeded", data)
+		}
+		if GetConfig() != prev {
+			t.Fatalf("config replaced by invalid %q", data)
+		}
+	}
+	if hookCalled {
+		t.Fatal("hook called for a rejected config")
+	}
+	if configReloadStats.Failures != 3 || !strings.Contains(configReloadStats.LastError, "scene") {
+		t.Fatalf("stats = %+v", configReloadStats)
+	}
+
+	// A later valid config clears the error.
+	writeTestConfig(t, path, "rooms:\n  - id: hall\n")
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if configReloadStats.LastError != "" || GetConfig().Rooms[0].ID != "hall" {
+		t.Fatalf("stats = %+v, rooms = %+v", configReloadStats, GetConfig().Rooms)
+	}
+}
+
+// TestReloadConfig_ConcurrentReaders is meant for -race: readers must always
+// see a complete config, either the old or the new one.
+func TestReloadConfig_ConcurrentReaders(t *testing.T) {
+	pathA := setupConfigReloadTest(t)
+	pathB := filepath.Join(t.TempDir(), "at2.yaml")
+	writeTestConfig(t, pathB, "rooms:\n  - id: hall\n    entities:\n      - id: hall/light\n")
+
+	prevMgr := vdevManager
+	t.Cleanup(func() { vdevManager = prevMgr })
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "hall/light", Type: VdevTypeRelay, State: "ON"}})
+	vdevManager = vm
+	collector := NewPrometheusCollector(vm, GetConfig())
+	OnConfigReload(collector.loadConfig)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cfg := GetConfig()
+				if len(cfg.Rooms) != 1 {
+					t.Errorf("reader saw rooms %+v", cfg.Rooms)
+					return
+				}
+				switch room := cfg.Rooms[0]; room.ID {
+				case "lab":
+				case "hall":
+					if len(room.Entities) != 1 {
+						t.Errorf("reader saw a partial hall room: %+v", room)
+						return
+					}
+				default:
+					t.Errorf("reader saw room %q", room.ID)
+					return
+				}
+				buildRoomState(cfg.Rooms[0].ID)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			testutil.CollectAndCount(collector, "at2_device_info")
+		}
+	}()
+
+	for i := range 50 {
+		path := pathA
+		if i%2 == 0 {
+			path = pathB
+		}
+		if err := reloadConfig(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if configReloadStats.Reloads != 50 {
+		t.Fatalf("reloads = %d", configReloadStats.Reloads)
+	}
+}
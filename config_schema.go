@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// deprecatedConfigKeys maps keys that are still understood but going away to
+// what to use instead. Keys are paths like "rooms[].entities[].name", with
+// [] standing for any sequence index or map key.
+var deprecatedConfigKeys = map[string]string{
+	"web.all_devices_mapper_data": "log in and request /api/v1/all-devices?include=mapper_data instead",
+}
+
+// decodeConfigData decodes YAML into out, ignoring keys out has no field for,
+// and returns those keys as errors with their position in file. Deprecated
+// keys are added to r as warnings. err is set when the YAML itself is
+// invalid or a value has the wrong type.
+func decodeConfigData(data []byte, file string, out any, r *ConfigReport) (unknown []error, err error) {
+	f, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	w := &configKeyWalker{file: file, report: r}
+	for _, doc := range f.Docs {
+		w.walk(doc.Body, reflect.TypeOf(out), "", "")
+	}
+	return w.unknown, nil
+}
+
+// configKeyWalker compares a YAML tree with the type it is decoded into.
+type configKeyWalker struct {
+	file    string
+	report  *ConfigReport
+	unknown []error
+}
+
+// walk checks node against t. path is the position for messages
+// ("rooms[2].entities[0]"), pattern the same with indexes left out, for
+// deprecatedConfigKeys.
+func (w *configKeyWalker) walk(node ast.Node, t reflect.Type, path, pattern string) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node == nil || t == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *ast.AnchorNode:
+		w.walk(n.Value, t, path, pattern)
+		return
+	case *ast.TagNode:
+		w.walk(n.Value, t, path, pattern)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := yamlFields(t)
+		for _, mv := range mappingValues(node) {
+			key := mv.Key.GetToken().Value
+			if key == "<<" {
+				continue
+			}
+			field, ok := fields[key]
+			keyPath, keyPattern := joinConfigPath(path, key), joinConfigPath(pattern, key)
+			if !ok {
+				w.unknown = append(w.unknown, fmt.Errorf("%s: unknown field %q in %s", w.position(mv.Key), key, configPathOrRoot(path)))
+				continue
+			}
+			if hint, ok := deprecatedConfigKeys[keyPattern]; ok && w.report != nil {
+				w.report.warnf("%s: %s is deprecated; %s", w.position(mv.Key), keyPath, hint)
+			}
+			w.walk(mv.Value, field.Type, keyPath, keyPattern)
+		}
+	case reflect.Map:
+		for _, mv := range mappingValues(node) {
+			key := mv.Key.GetToken().Value
+			w.walk(mv.Value, t.Elem(), fmt.Sprintf("%s[%s]", path, key), pattern+"[]")
+		}
+	case reflect.Slice, reflect.Array:
+		if seq, ok := node.(*ast.SequenceNode); ok {
+			for i, v := range seq.Values {
+				w.walk(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), pattern+"[]")
+			}
+		}
+	}
+}
+
+func (w *configKeyWalker) position(n ast.Node) string {
+	pos := n.GetToken().Position
+	return fmt.Sprintf("%s:%d:%d", w.file, pos.Line, pos.Column)
+}
+
+// mappingValues returns the entries of a mapping node. The parser represents
+// a mapping with a single entry as just that entry.
+func mappingValues(node ast.Node) []*ast.MappingValueNode {
+	switch n := node.(type) {
+	case *ast.MappingNode:
+		return n.Values
+	case *ast.MappingValueNode:
+		return []*ast.MappingValueNode{n}
+	}
+	return nil
+}
+
+// yamlFields returns the fields of struct type t by the key they are decoded
+// from, following the decoder's rules: the yaml tag, else the json tag, else
+// the lowercased field name. Fields of ",inline" structs are included.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "" {
+			tag = f.Tag.Get("json")
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if opts == "inline" && f.Type.Kind() == reflect.Struct {
+			maps.Copy(fields, yamlFields(f.Type))
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func configPathOrRoot(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return path
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// CoverCommand moves a cover to Position, 0 (closed) to 100 (open). Clients
+// send it as {"position": n}.
+type CoverCommand struct {
+	Position float64 `json:"position"`
+}
+
+// ThermostatCommand sets the target temperature in °C. Clients send it as
+// {"setpoint": x}.
+type ThermostatCommand struct {
+	Setpoint float64 `json:"setpoint"`
+}
+
+// Default bounds of thermostat setpoints in °C, the range of common radiator
+// valves.
+const (
+	defaultThermostatMinSetpoint = 5.0
+	defaultThermostatMaxSetpoint = 30.0
+)
+
+// thermostatSetpointRange returns mqtt.thermostat_min_setpoint and
+// mqtt.thermostat_max_setpoint, or the defaults when unset.
+func thermostatSetpointRange(cfg *Config) (float64, float64) {
+	lo, hi := defaultThermostatMinSetpoint, defaultThermostatMaxSetpoint
+	if cfg == nil {
+		return lo, hi
+	}
+	if cfg.MQTT.ThermostatMinSetpoint != 0 {
+		lo = cfg.MQTT.ThermostatMinSetpoint
+	}
+	if cfg.MQTT.ThermostatMaxSetpoint != 0 {
+		hi = cfg.MQTT.ThermostatMaxSetpoint
+	}
+	return lo, hi
+}
+
+// parseControlCommand validates a command for a device of type t and returns
+// what mappers get: "ON", "OFF" or "TOGGLE" for relays, CoverCommand and
+// ThermostatCommand for covers and thermostats. The command is decoded JSON
+// (or YAML for scenes), so objects arrive as maps.
+func parseControlCommand(deviceID string, t VdevType, command any) (any, error) {
+	switch t {
+	case VdevTypeRelay:
+		stateStr, ok := command.(string)
+		if !ok {
+			return nil, controlErrorf(ErrInvalidControl, "state must be a string")
+		}
+		upperState := strings.ToUpper(stateStr)
+		if upperState != "ON" && upperState != "OFF" && upperState != "TOGGLE" {
+			return nil, controlErrorf(ErrInvalidControl, "invalid state %q; must be ON, OFF or TOGGLE", stateStr)
+		}
+		return upperState, nil
+	case VdevTypeCover:
+		if cmd, ok := command.(CoverCommand); ok {
+			command = map[string]any{"position": cmd.Position}
+		}
+		position, err := commandField(command, "position")
+		if err != nil {
+			return nil, err
+		}
+		if position < 0 || position > 100 {
+			return nil, controlErrorf(ErrInvalidControl, "position %v must be between 0 and 100", position)
+		}
+		return CoverCommand{Position: position}, nil
+	case VdevTypeThermostat:
+		if cmd, ok := command.(ThermostatCommand); ok {
+			command = map[string]any{"setpoint": cmd.Setpoint}
+		}
+		setpoint, err := commandField(command, "setpoint")
+		if err != nil {
+			return nil, err
+		}
+		if lo, hi := thermostatSetpointRange(GetConfig()); setpoint < lo || setpoint > hi {
+			return nil, controlErrorf(ErrInvalidControl, "setpoint %v must be between %v and %v", setpoint, lo, hi)
+		}
+		return ThermostatCommand{Setpoint: setpoint}, nil
+	}
+	return nil, controlErrorf(ErrInvalidControl, "device %s can't be controlled (type: %s)", deviceID, t)
+}
+
+// commandField returns the number under key of an object command.
+func commandField(command any, key string) (float64, error) {
+	obj, ok := command.(map[string]any)
+	if !ok {
+		return 0, controlErrorf(ErrInvalidControl, "state must be an object with %s", key)
+	}
+	raw, ok := obj[key]
+	if !ok {
+		return 0, controlErrorf(ErrInvalidControl, "state must be an object with %s", key)
+	}
+	var n float64
+	switch v := raw.(type) {
+	case float64:
+		n = v
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	default:
+		return 0, controlErrorf(ErrInvalidControl, "%s must be a number", key)
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, controlErrorf(ErrInvalidControl, "%s must be a number", key)
+	}
+	return n, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// controlLog is the logger of device control by users; main replaces it with
+// the configured one.
+var controlLog = slog.Default()
+
+// ControlRequest is the body of POST /api/v1/control. State is "ON"/"OFF"
+// for relays; other device kinds may take structured states.
+type ControlRequest struct {
+	DeviceID string `json:"deviceId"`
+	State    any    `json:"state"`
+}
+
+// handleControl sends a control command to a device and answers with the
+// accepted command, or with a status telling why it was rejected.
+func handleControl(c *fiber.Ctx) error {
+	var req ControlRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.DeviceID == "" || req.State == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "deviceId and state are required"})
+	}
+
+	if ok, err := authorizeControl(c, req.DeviceID); !ok {
+		return err
+	}
+	if mqttAdapter == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "MQTT adapter not initialized"})
+	}
+
+	controlLog.Info("control requested", "user", c.Locals("username"), "device", req.DeviceID, "state", req.State)
+	if err := mqttAdapter.ControlDevice(req.DeviceID, req.State); err != nil {
+		return c.Status(controlErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(req)
+}
+
+// controlErrorCode maps a ControlDevice error to the code reported to live
+// feed clients.
+func controlErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidControl):
+		return "invalid"
+	case errors.Is(err, ErrDeviceNotFound):
+		return "not_found"
+	case errors.Is(err, ErrControlProhibited):
+		return "forbidden"
+	case errors.Is(err, ErrMQTTNotConnected):
+		return "unavailable"
+	default:
+		return "failed"
+	}
+}
+
+// controlErrorStatus maps a ControlDevice error to an HTTP status.
+func controlErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidControl):
+		return fiber.StatusBadRequest
+	case errors.Is(err, ErrDeviceNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, ErrControlProhibited):
+		return fiber.StatusForbidden
+	case errors.Is(err, ErrMQTTNotConnected):
+		return fiber.StatusServiceUnavailable
+	default:
+		return fiber.StatusBadGateway
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// validateControlRules fails fast on control rules that match nothing or
+// can't be evaluated.
+func validateControlRules(cfg *Config, cfgPath string) error {
+	for i, rule := range cfg.ControlRules {
+		if rule.Match == "" && rule.Representation == "" {
+			return fmt.Errorf("control_rules[%d] needs match or representation in %s", i, cfgPath)
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return fmt.Errorf("control_rules[%d] has invalid match pattern %q in %s: %v", i, rule.Match, cfgPath, err)
+		}
+		if rule.RequireGroup == "" {
+			return fmt.Errorf("control_rules[%d] has empty require_group in %s", i, cfgPath)
+		}
+	}
+	return nil
+}
+
+// validateProhibitControl fails fast on read-only device patterns that can't
+// be evaluated.
+func validateProhibitControl(cfg *Config, cfgPath string) error {
+	for i, pattern := range cfg.MQTT.ProhibitControl {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("mqtt.prohibit_control[%d] has invalid pattern %q in %s: %v", i, pattern, cfgPath, err)
+		}
+	}
+	return nil
+}
+
+// controlProhibited reports whether the config makes a device read-only,
+// by the prohibit_control flag of its entity or an mqtt.prohibit_control
+// pattern. Nobody may control such devices, whatever their groups.
+func controlProhibited(cfg *Config, deviceID string) bool {
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.ID == deviceID && ent.ProhibitControl {
+				return true
+			}
+		}
+	}
+	for _, pattern := range cfg.MQTT.ProhibitControl {
+		if ok, _ := path.Match(pattern, deviceID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// entityRepresentation returns the representation a device is configured
+// with in the rooms, or "" when it has none.
+func entityRepresentation(deviceID string) string {
+	for _, room := range GetConfig().Rooms {
+		for _, ent := range room.Entities {
+			if ent.ID == deviceID && ent.Representation != "" {
+				return ent.Representation
+			}
+		}
+	}
+	return ""
+}
+
+func (r ControlRule) matches(deviceID, representation string) bool {
+	if r.Match != "" {
+		if ok, _ := path.Match(r.Match, deviceID); !ok {
+			return false
+		}
+	}
+	return r.Representation == "" || r.Representation == representation
+}
+
+// deniedControlRule returns the rule forbidding a member of the given groups
+// to control the device, or nil when control is allowed. Only the first
+// matching rule counts; devices no rule matches are open to everyone.
+func deniedControlRule(deviceID string, groups []string) *ControlRule {
+	representation := entityRepresentation(deviceID)
+	for i, rule := range GetConfig().ControlRules {
+		if !rule.matches(deviceID, representation) {
+			continue
+		}
+		if slices.Contains(groups, rule.RequireGroup) {
+			return nil
+		}
+		return &GetConfig().ControlRules[i]
+	}
+	return nil
+}
+
+// authorizeControl checks the control rules for the logged-in user and
+// answers 403 when they deny control of the device. It reports whether the
+// caller may go ahead.
+func authorizeControl(c *fiber.Ctx, deviceID string) (bool, error) {
+	groups, err := getUserGroups(c)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to parse claims"})
+	}
+	rule := deniedControlRule(deviceID, groups)
+	if rule == nil {
+		return true, nil
+	}
+	controlLog.Warn("control denied", "user", c.Locals("username"), "device", deviceID, "require_group", rule.RequireGroup)
+	return false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "Controlling this device requires group " + rule.RequireGroup,
+		"rule":  rule,
+	})
+}
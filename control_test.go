@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofiber/fiber/v2"
 )
 
 // MockToken satisfies mqtt.Token
@@ -29,8 +33,9 @@ func (t *MockToken) Error() error {
 // MockClient satisfies mqtt.Client
 type MockClient struct {
 	mqtt.Client
-	PublishedTopic   string
-	PublishedPayload []byte
+	PublishedTopic    string
+	PublishedPayload  []byte
+	PublishedRetained bool
 }
 
 func (m *MockClient) IsConnectionOpen() bool {
@@ -39,6 +44,7 @@ func (m *MockClient) IsConnectionOpen() bool {
 
 func (m *MockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
 	m.PublishedTopic = topic
+	m.PublishedRetained = retained
 	switch v := payload.(type) {
 	case []byte:
 		m.PublishedPayload = v
@@ -49,7 +55,7 @@ func (m *MockClient) Publish(topic string, qos byte, retained bool, payload inte
 }
 
 func TestZigbee2MQTTMapper_Control(t *testing.T) {
-	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/")
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
 	mockClient := &MockClient{}
 
 	// Case 1: Standard relay
@@ -107,6 +113,81 @@ func TestZigbee2MQTTMapper_Control(t *testing.T) {
 	if val, ok := payload["state_left"]; !ok || val != "OFF" {
 		t.Errorf("Expected payload {'state_left': 'OFF'}, got %v", payload)
 	}
+
+	// Case 3: Toggle is passed through as zigbee2mqtt supports it natively
+	if !mapper.TogglesNatively(vdev) {
+		t.Fatal("Expected zigbee2mqtt to toggle natively")
+	}
+	if err := mapper.Control(vdev, "TOGGLE", mockClient); err != nil {
+		t.Fatalf("Control failed: %v", err)
+	}
+	if string(mockClient.PublishedPayload) != `{"state":"TOGGLE"}` {
+		t.Errorf("Expected payload {'state': 'TOGGLE'}, got %s", mockClient.PublishedPayload)
+	}
+}
+
+// recordingMapperData marks devices owned by recordingMapper.
+type recordingMapperData struct{}
+
+// recordingMapper records the states it is asked to set and has no native
+// toggle.
+type recordingMapper struct {
+	states []any
+}
+
+func (m *recordingMapper) SubscriptionTopics() []string { return nil }
+func (m *recordingMapper) DiscoverDevicesFromMessage(string, []byte) ([]*VirtualDevice, error) {
+	return nil, nil
+}
+func (m *recordingMapper) UpdateDevicesFromMessage(string, []byte) ([]*VirtualDeviceUpdate, error) {
+	return nil, nil
+}
+func (m *recordingMapper) Control(vdev *VirtualDevice, state any, client mqtt.Client) error {
+	if _, ok := vdev.MapperData.(*recordingMapperData); ok {
+		m.states = append(m.states, state)
+	}
+	return nil
+}
+
+func TestMQTTAdapter_ControlDevice_Toggle(t *testing.T) {
+	mgr := NewVdevManager()
+	mockClient := &MockClient{}
+	recorder := &recordingMapper{}
+	adapter := &MQTTAdapter{
+		log:     testLogger,
+		vdevMgr: mgr,
+		client:  mockClient,
+		mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger), recorder},
+	}
+	mgr.AddDevices([]*VirtualDevice{
+		{ID: "relay/zigbee", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "z1"}},
+		{ID: "relay/on", Type: VdevTypeRelay, MapperData: &recordingMapperData{}, State: "ON"},
+		{ID: "relay/off", Type: VdevTypeRelay, MapperData: &recordingMapperData{}, State: false},
+		{ID: "relay/unknown", Type: VdevTypeRelay, MapperData: &recordingMapperData{}},
+	})
+
+	// zigbee2mqtt toggles even without a known state.
+	if err := adapter.ControlDevice("relay/zigbee", "toggle"); err != nil {
+		t.Fatalf("toggle zigbee relay: %v", err)
+	}
+	if mockClient.PublishedTopic != "zigbee2mqtt/z1/set" || string(mockClient.PublishedPayload) != `{"state":"TOGGLE"}` {
+		t.Errorf("published %s %s", mockClient.PublishedTopic, mockClient.PublishedPayload)
+	}
+
+	// Other mappers get the inverse of the current state.
+	for _, id := range []string{"relay/on", "relay/off"} {
+		if err := adapter.ControlDevice(id, "TOGGLE"); err != nil {
+			t.Fatalf("toggle %s: %v", id, err)
+		}
+	}
+	if len(recorder.states) != 2 || recorder.states[0] != "OFF" || recorder.states[1] != "ON" {
+		t.Errorf("recorded states %v, want [OFF ON]", recorder.states)
+	}
+
+	err := adapter.ControlDevice("relay/unknown", "TOGGLE")
+	if !errors.Is(err, ErrInvalidControl) || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected unknown state error, got: %v", err)
+	}
 }
 
 func TestMQTTAdapter_ControlDevice_Validation(t *testing.T) {
@@ -116,10 +197,11 @@ func TestMQTTAdapter_ControlDevice_Validation(t *testing.T) {
 
 	// Create adapter manually to avoid connection logic
 	adapter := &MQTTAdapter{
+		log:     testLogger,
 		vdevMgr: mgr,
 		client:  mockClient,
 		mappers: []MQTTMapper{
-			NewZigbee2MQTTMapper("zigbee2mqtt/"),
+			NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger),
 		},
 	}
 
@@ -161,16 +243,16 @@ func TestMQTTAdapter_ControlDevice_Validation(t *testing.T) {
 	err = adapter.ControlDevice("relay/1", "INVALID")
 	if err == nil {
 		t.Errorf("Expected error for invalid state, got nil")
-	} else if !strings.Contains(err.Error(), "must be ON or OFF") {
-		t.Errorf("Expected 'must be ON or OFF' error, got: %v", err)
+	} else if !strings.Contains(err.Error(), "must be ON, OFF or TOGGLE") {
+		t.Errorf("Expected 'must be ON, OFF or TOGGLE' error, got: %v", err)
 	}
 
 	// Test 5: Not a Relay -> Error
 	err = adapter.ControlDevice("sensor/1", "ON")
 	if err == nil {
 		t.Errorf("Expected error for non-relay device, got nil")
-	} else if !strings.Contains(err.Error(), "not a relay") {
-		t.Errorf("Expected 'not a relay' error, got: %v", err)
+	} else if !strings.Contains(err.Error(), "can't be controlled") {
+		t.Errorf("Expected 'can't be controlled' error, got: %v", err)
 	}
 	// Test 6: Prohibited Control -> Error
 	prohibitedDev := &VirtualDevice{
@@ -188,3 +270,277 @@ func TestMQTTAdapter_ControlDevice_Validation(t *testing.T) {
 		t.Errorf("Expected 'prohibited' error, got: %v", err)
 	}
 }
+
+func setupControlRulesTest(t *testing.T) {
+	t.Helper()
+	prevCfg, prevAdapter := GetConfig(), mqttAdapter
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		mqttAdapter = prevAdapter
+	})
+	mqttAdapter = nil
+
+	setConfig(&Config{
+		Rooms: []RoomConfig{{ID: "hall", Entities: []EntityConfig{
+			{ID: "relay/hall_light", Representation: "light"},
+			{ID: "relay/compressor_main"},
+			{ID: "relay/printer_power", Representation: "printer"},
+		}}},
+		ControlRules: []ControlRule{
+			{Match: "relay/compressor*", RequireGroup: "infra"},
+			{Representation: "printer", RequireGroup: "members"},
+		},
+	})
+}
+
+func TestDeniedControlRule(t *testing.T) {
+	setupControlRulesTest(t)
+
+	cases := []struct {
+		device   string
+		groups   []string
+		deniedBy string
+	}{
+		// No rule matches lights: open to everyone.
+		{"relay/hall_light", nil, ""},
+		{"relay/compressor_main", []string{"members"}, "infra"},
+		{"relay/compressor_main", []string{"members", "infra"}, ""},
+		// Rules can match on representation alone.
+		{"relay/printer_power", nil, "members"},
+		{"relay/printer_power", []string{"members"}, ""},
+		// Devices not in any room have no representation.
+		{"relay/unknown", nil, ""},
+	}
+	for _, tc := range cases {
+		rule := deniedControlRule(tc.device, tc.groups)
+		got := ""
+		if rule != nil {
+			got = rule.RequireGroup
+		}
+		if got != tc.deniedBy {
+			t.Errorf("deniedControlRule(%q, %v) denied by %q, want %q", tc.device, tc.groups, got, tc.deniedBy)
+		}
+	}
+}
+
+func TestHandleControlRelay_EnforcesControlRules(t *testing.T) {
+	setupControlRulesTest(t)
+
+	controlAs := func(claims, device string) (int, map[string]any) {
+		app := fiber.New()
+		app.Post("/control", func(c *fiber.Ctx) error {
+			c.Locals("username", "alice")
+			c.Locals("cached_claims", claims)
+			return c.Next()
+		}, handleControlRelay)
+		req := httptest.NewRequest(http.MethodPost, "/control", strings.NewReader(`{"id":"`+device+`","state":"ON"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	status, body := controlAs(`{"groups":["members"]}`, "relay/compressor_main")
+	if status != fiber.StatusForbidden {
+		t.Fatalf("denied control: status = %d, want 403", status)
+	}
+	if rule, _ := body["rule"].(map[string]any); rule["match"] != "relay/compressor*" || rule["require_group"] != "infra" {
+		t.Fatalf("403 should name the matching rule, got %v", body)
+	}
+
+	// Allowed requests get past authorization (and then fail on the missing
+	// MQTT adapter in this test).
+	if status, _ := controlAs(`{"groups":["infra"]}`, "relay/compressor_main"); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("allowed control: status = %d, want 503", status)
+	}
+	if status, _ := controlAs("", "relay/hall_light"); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("default policy: status = %d, want 503", status)
+	}
+}
+
+func TestHandleControl_Statuses(t *testing.T) {
+	setupControlRulesTest(t)
+	mgr := NewVdevManager()
+	mockClient := &MockClient{}
+	mqttAdapter = &MQTTAdapter{log: testLogger, vdevMgr: mgr, client: mockClient, mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)}}
+	mgr.AddDevices([]*VirtualDevice{
+		{ID: "relay/hall_light", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "hall_light"}},
+		{ID: "sensor/hall", Type: VdevTypeTemperature, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "hall"}},
+		{ID: "relay/locked", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "locked"}, ProhibitControl: true},
+	})
+
+	app := fiber.New()
+	app.Post("/api/v1/control", func(c *fiber.Ctx) error {
+		c.Locals("username", "alice")
+		return c.Next()
+	}, handleControl)
+	control := func(body string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/control", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]any
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	status, body := control(`{"deviceId":"relay/hall_light","state":"ON"}`)
+	if status != fiber.StatusOK || body["deviceId"] != "relay/hall_light" || body["state"] != "ON" {
+		t.Fatalf("valid command: %d %v", status, body)
+	}
+	if mockClient.PublishedTopic != "zigbee2mqtt/hall_light/set" || string(mockClient.PublishedPayload) != `{"state":"ON"}` {
+		t.Fatalf("published %s %s", mockClient.PublishedTopic, mockClient.PublishedPayload)
+	}
+
+	cases := []struct {
+		body, errContains string
+		want              int
+	}{
+		{`{"deviceId":"relay/hall_light","state":"DIM"}`, "must be ON, OFF or TOGGLE", fiber.StatusBadRequest},
+		{`{"deviceId":"relay/hall_light","state":{"brightness":10}}`, "state must be a string", fiber.StatusBadRequest},
+		{`{"deviceId":"sensor/hall","state":"ON"}`, "can't be controlled", fiber.StatusBadRequest},
+		{`{"state":"ON"}`, "required", fiber.StatusBadRequest},
+		{`not json`, "Invalid request body", fiber.StatusBadRequest},
+		{`{"deviceId":"relay/missing","state":"ON"}`, "not found", fiber.StatusNotFound},
+		{`{"deviceId":"relay/locked","state":"ON"}`, "prohibited", fiber.StatusForbidden},
+		// Control rules apply too.
+		{`{"deviceId":"relay/compressor_main","state":"ON"}`, "requires group infra", fiber.StatusForbidden},
+	}
+	for _, tc := range cases {
+		status, body := control(tc.body)
+		if msg, _ := body["error"].(string); status != tc.want || !strings.Contains(msg, tc.errContains) {
+			t.Errorf("%s: %d %v, want %d with %q", tc.body, status, body, tc.want, tc.errContains)
+		}
+	}
+}
+
+func TestControlProhibited_AppliedFromConfig(t *testing.T) {
+	cfg := &Config{
+		MQTT: MQTTConfig{ProhibitControl: []string{"relay/compressor*"}},
+		Rooms: []RoomConfig{{ID: "hall", Entities: []EntityConfig{
+			{ID: "relay/hall_light"},
+			{ID: "relay/fan", ProhibitControl: true},
+			{ID: "relay/compressor_main"},
+		}}},
+	}
+	mgr := NewVdevManager()
+	mgr.SetControlProhibited(func(deviceID string) bool { return controlProhibited(cfg, deviceID) })
+	mockClient := &MockClient{}
+	adapter := &MQTTAdapter{log: testLogger, vdevMgr: mgr, client: mockClient, mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)}}
+	for _, id := range []string{"relay/hall_light", "relay/fan", "relay/compressor_main"} {
+		mgr.AddDevices([]*VirtualDevice{{ID: id, Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: id}}})
+	}
+
+	for id, want := range map[string]bool{"relay/hall_light": false, "relay/fan": true, "relay/compressor_main": true} {
+		if got := mgr.Device(id).ProhibitControl; got != want {
+			t.Errorf("%s ProhibitControl = %v, want %v", id, got, want)
+		}
+		err := adapter.ControlDevice(id, "ON")
+		if want && !errors.Is(err, ErrControlProhibited) {
+			t.Errorf("%s: expected ErrControlProhibited, got %v", id, err)
+		}
+		if !want && err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+	if mockClient.PublishedTopic != "zigbee2mqtt/relay/hall_light/set" {
+		t.Errorf("published to %s", mockClient.PublishedTopic)
+	}
+
+	// The UI greys out devices made read-only by a pattern too.
+	if es := newEntityState(EntityConfig{ID: "relay/compressor_main"}, mgr.Device("relay/compressor_main")); !es.ProhibitControl {
+		t.Errorf("entity state = %+v", es)
+	}
+}
+
+func TestParseControlCommand(t *testing.T) {
+	cases := []struct {
+		vdevType    VdevType
+		command     any
+		want        any
+		errContains string
+	}{
+		{VdevTypeRelay, "on", "ON", ""},
+		{VdevTypeRelay, "Toggle", "TOGGLE", ""},
+		{VdevTypeRelay, "DIM", nil, "must be ON, OFF or TOGGLE"},
+		{VdevTypeRelay, map[string]any{"state": "ON"}, nil, "state must be a string"},
+		{VdevTypeCover, map[string]any{"position": 40.0}, CoverCommand{Position: 40}, ""},
+		// Scene commands come from YAML with integer numbers.
+		{VdevTypeCover, map[string]any{"position": uint64(100)}, CoverCommand{Position: 100}, ""},
+		{VdevTypeCover, CoverCommand{Position: 0}, CoverCommand{Position: 0}, ""},
+		{VdevTypeCover, map[string]any{"position": 101.0}, nil, "between 0 and 100"},
+		{VdevTypeCover, map[string]any{"position": "half"}, nil, "position must be a number"},
+		{VdevTypeCover, "OPEN", nil, "object with position"},
+		{VdevTypeThermostat, map[string]any{"setpoint": 21.5}, ThermostatCommand{Setpoint: 21.5}, ""},
+		{VdevTypeThermostat, map[string]any{"temperature": 21.5}, nil, "object with setpoint"},
+		{VdevTypeThermostat, "ON", nil, "object with setpoint"},
+		{VdevTypeThermostat, map[string]any{"setpoint": 5.0}, ThermostatCommand{Setpoint: 5}, ""},
+		{VdevTypeThermostat, map[string]any{"setpoint": 85.0}, nil, "between 5 and 30"},
+		{VdevTypeThermostat, map[string]any{"setpoint": -40.0}, nil, "between 5 and 30"},
+		{VdevTypeTemperature, "ON", nil, "can't be controlled"},
+	}
+	for _, tc := range cases {
+		got, err := parseControlCommand("dev", tc.vdevType, tc.command)
+		if tc.errContains != "" {
+			if !errors.Is(err, ErrInvalidControl) || !strings.Contains(err.Error(), tc.errContains) {
+				t.Errorf("%s %v: expected error containing %q, got %v", tc.vdevType, tc.command, tc.errContains, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s %v = %v, %v; want %v", tc.vdevType, tc.command, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseControlCommand_ConfiguredSetpointRange(t *testing.T) {
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	setConfig(&Config{MQTT: MQTTConfig{ThermostatMinSetpoint: 10, ThermostatMaxSetpoint: 24}})
+
+	if _, err := parseControlCommand("dev", VdevTypeThermostat, map[string]any{"setpoint": 25.0}); !errors.Is(err, ErrInvalidControl) {
+		t.Errorf("setpoint above the configured maximum: err = %v", err)
+	}
+	if got, err := parseControlCommand("dev", VdevTypeThermostat, map[string]any{"setpoint": 10.0}); err != nil || got != (ThermostatCommand{Setpoint: 10}) {
+		t.Errorf("setpoint at the configured minimum = %v, %v", got, err)
+	}
+}
+
+func TestZigbee2MQTTMapper_ControlStructured(t *testing.T) {
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
+	mockClient := &MockClient{}
+	adapter := &MQTTAdapter{log: testLogger, vdevMgr: NewVdevManager(), client: mockClient, mappers: []MQTTMapper{mapper}}
+	adapter.vdevMgr.AddDevices([]*VirtualDevice{
+		{ID: "blinds/cover", Type: VdevTypeCover, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "blinds", StateKey: "position"}},
+		{ID: "trv/thermostat", Type: VdevTypeThermostat, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "trv", StateKey: "occupied_heating_setpoint"}},
+	})
+
+	cases := []struct {
+		deviceID string
+		command  any
+		topic    string
+		payload  string
+	}{
+		{"blinds/cover", map[string]any{"position": 30.0}, "zigbee2mqtt/blinds/set", `{"position":30}`},
+		{"trv/thermostat", map[string]any{"setpoint": 19.5}, "zigbee2mqtt/trv/set", `{"occupied_heating_setpoint":19.5}`},
+	}
+	for _, tc := range cases {
+		if err := adapter.ControlDevice(tc.deviceID, tc.command); err != nil {
+			t.Fatalf("%s: %v", tc.deviceID, err)
+		}
+		if mockClient.PublishedTopic != tc.topic || string(mockClient.PublishedPayload) != tc.payload {
+			t.Errorf("%s published %s %s", tc.deviceID, mockClient.PublishedTopic, mockClient.PublishedPayload)
+		}
+		// Only relays get optimistic states.
+		if dev := adapter.vdevMgr.Device(tc.deviceID); dev.Pending {
+			t.Errorf("%s pending after command", tc.deviceID)
+		}
+	}
+}
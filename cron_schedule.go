@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week (0-7, 0 and 7 being Sunday). Fields take *, numbers,
+// ranges (1-5), lists (1,15) and steps (*/15, 8-18/2).
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both days are restricted either may match.
+	domAny, dowAny bool
+}
+
+// cronFieldBounds are the lowest and highest values of each field.
+var cronFieldBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+var cronFieldNames = [5]string{"minute", "hour", "day of month", "month", "day of week"}
+
+func parseCronSchedule(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("%q needs 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFieldBounds[i][0], cronFieldBounds[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("%q has invalid %s: %v", expr, cronFieldNames[i], err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField returns the set of values of one field as a bitmask.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		first, last := lo, hi
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				last = hi
+			}
+			if first < lo || last > hi || first > last {
+				return 0, fmt.Errorf("%q is outside %d-%d", rng, lo, hi)
+			}
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule fires in the minute of t, in t's
+// location.
+func (s cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domOK := s.dom&(1<<t.Day()) != 0
+	dowOK := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule_Matches(t *testing.T) {
+	// 2026-10-15 is a Thursday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"0 8 * * *", at(15, 8, 0), true},
+		{"0 8 * * *", at(15, 8, 1), false},
+		{"0 8 * * *", at(15, 9, 0), false},
+		{"*/15 * * * *", at(15, 3, 45), true},
+		{"*/15 * * * *", at(15, 3, 50), false},
+		{"30 8-18/2 * * *", at(15, 10, 30), true},
+		{"30 8-18/2 * * *", at(15, 11, 30), false},
+		{"0 8 * * 1-5", at(15, 8, 0), true},
+		{"0 8 * * 1-5", at(17, 8, 0), false},
+		{"0 8 * * 0", at(18, 8, 0), true},
+		{"0 8 * * 7", at(18, 8, 0), true},
+		{"0 8 1,15 * *", at(15, 8, 0), true},
+		{"0 8 1,15 10 *", at(15, 8, 0), true},
+		{"0 8 1,15 11 *", at(15, 8, 0), false},
+		// Both days restricted: either may match.
+		{"0 8 1 * 4", at(15, 8, 0), true},
+		{"0 8 1 * 5", at(15, 8, 0), false},
+	} {
+		s, err := parseCronSchedule(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.expr, err)
+		}
+		if got := s.matches(tc.t); got != tc.want {
+			t.Errorf("%q at %s: %v, want %v", tc.expr, tc.t.Format(time.RFC1123), got, tc.want)
+		}
+	}
+}
+
+func TestParseCronSchedule_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 8 * *",
+		"0 8 * * * *",
+		"60 8 * * *",
+		"0 24 * * *",
+		"0 8 0 * *",
+		"0 8 * 13 *",
+		"0 8 * * 8",
+		"0 18-8 * * *",
+		"*/0 * * * *",
+		"a 8 * * *",
+		"0 8 * * mon",
+	} {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("%q parsed", expr)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// defaultBackupSchedule is database.backup.schedule when it isn't set.
+	defaultBackupSchedule = "0 3 * * *"
+	// defaultBackupKeep is database.backup.keep when it isn't set.
+	defaultBackupKeep = 7
+	// backupCheckInterval is how often the schedule is looked at; below a
+	// minute so no scheduled minute is missed.
+	backupCheckInterval = 20 * time.Second
+	// backupStepPages is how many pages are copied at a time. The source is
+	// only locked while a step runs, so writers wait at most this long.
+	backupStepPages = 256
+	// backupStepPause lets writers in between steps.
+	backupStepPause = 10 * time.Millisecond
+	// backupTimeout gives up on a backup that a busy writer keeps restarting.
+	backupTimeout = 30 * time.Minute
+	// backupTimeLayout stamps the backup file names, in UTC.
+	backupTimeLayout = "20060102T150405Z"
+	// backupPrefix and backupSuffix frame the names of backup files.
+	backupPrefix = "at2-"
+	backupSuffix = ".db"
+	// backupRule is the rule of the alert raised when a backup fails.
+	backupRule = "database_backup"
+)
+
+// errBackupRunning is returned by DatabaseBackups.Backup while another
+// backup is in progress.
+var errBackupRunning = errors.New("a backup is already running")
+
+// errBackupExists is returned by DatabaseBackups.Backup when a backup was
+// already taken in the same second, which its file name is stamped with.
+var errBackupExists = errors.New("a backup was already taken this second")
+
+// DatabaseBackupConfig is database.backup: consistent copies of the SQLite
+// file taken on a schedule while at2 keeps writing. Read at startup only.
+type DatabaseBackupConfig struct {
+	// Dir is where the backups go. Defaults to backups/ next to
+	// database.path.
+	Dir string `yaml:"dir"`
+	// Schedule is a cron expression (minute hour day-of-month month
+	// day-of-week) in Timezone. Default "0 3 * * *", every night at 3.
+	Schedule string `yaml:"schedule"`
+	// Timezone is an IANA zone name, e.g. "Europe/Warsaw". Default the
+	// server's local time.
+	Timezone string `yaml:"timezone"`
+	// Keep is how many backups are kept; older ones are deleted. Default 7.
+	Keep int `yaml:"keep"`
+}
+
+// validateDatabaseBackupConfig rejects database.backup settings that can't
+// be used.
+func validateDatabaseBackupConfig(cfg *Config, cfgPath string) error {
+	b := cfg.Database.Backup
+	if b == nil {
+		return nil
+	}
+	if _, err := parseCronSchedule(cmp.Or(b.Schedule, defaultBackupSchedule)); err != nil {
+		return fmt.Errorf("database.backup.schedule: %v in %s", err, cfgPath)
+	}
+	if _, err := time.LoadLocation(b.Timezone); err != nil {
+		return fmt.Errorf("database.backup.timezone is unknown (%q) in %s", b.Timezone, cfgPath)
+	}
+	if b.Keep < 0 {
+		return fmt.Errorf("database.backup.keep must not be negative in %s", cfgPath)
+	}
+	return nil
+}
+
+// DatabaseBackup is a backup file, served by GET /api/v1/admin/backups.
+type DatabaseBackup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DatabaseBackups copies the database to <dir>/at2-<UTC time>.db on its
+// schedule and on demand, keeping the newest ones. A failed backup raises
+// an alert through the sink, resolved by the next successful one.
+type DatabaseBackups struct {
+	src      string
+	dir      string
+	keep     int
+	schedule cronSchedule
+	loc      *time.Location
+	sink     AlertSink
+	log      *slog.Logger
+
+	// running is held while a backup is taken.
+	running sync.Mutex
+	// failedSince is when backups started failing; zero while they work.
+	failedSince time.Time
+	// lastDue is the last scheduled minute a backup was taken for.
+	lastDue time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	loop   sync.WaitGroup
+}
+
+// NewDatabaseBackups creates the backups for database.backup of cfg. sink
+// may be nil when no notifications are configured.
+func NewDatabaseBackups(cfg *Config, sink AlertSink, logger *slog.Logger) (*DatabaseBackups, error) {
+	b := cfg.Database.Backup
+	// validateDatabaseBackupConfig rejected schedules and zones that don't
+	// parse.
+	schedule, err := parseCronSchedule(cmp.Or(b.Schedule, defaultBackupSchedule))
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(b.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	dir := b.Dir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(cfg.Database.Path), "backups")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DatabaseBackups{
+		src:      cfg.Database.Path,
+		dir:      dir,
+		keep:     cmp.Or(b.Keep, defaultBackupKeep),
+		schedule: schedule,
+		loc:      loc,
+		sink:     sink,
+		log:      logger,
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Start creates the backup directory and checks the schedule periodically.
+func (d *DatabaseBackups) Start() error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return fmt.Errorf("creating backup directory: %w", err)
+	}
+	d.loop.Go(func() {
+		ticker := time.NewTicker(backupCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.ctx.Done():
+				return
+			case now := <-ticker.C:
+				d.run(now)
+			}
+		}
+	})
+	return nil
+}
+
+// Stop abandons a backup in progress and ends the schedule.
+func (d *DatabaseBackups) Stop() {
+	d.cancel()
+	d.loop.Wait()
+}
+
+// run takes a backup when the schedule is due in now's minute and none was
+// taken for that minute yet.
+func (d *DatabaseBackups) run(now time.Time) {
+	minute := now.In(d.loc).Truncate(time.Minute)
+	if !d.schedule.matches(minute) || !minute.After(d.lastDue) {
+		return
+	}
+	d.lastDue = minute
+	if _, err := d.Backup(now); err != nil && !errors.Is(err, errBackupRunning) && !errors.Is(err, errBackupExists) {
+		d.log.Error("scheduled database backup failed", "err", err)
+	}
+}
+
+// Backup copies the database now and deletes the backups beyond keep.
+func (d *DatabaseBackups) Backup(now time.Time) (DatabaseBackup, error) {
+	if !d.running.TryLock() {
+		return DatabaseBackup{}, errBackupRunning
+	}
+	defer d.running.Unlock()
+
+	name := backupPrefix + now.UTC().Format(backupTimeLayout) + backupSuffix
+	path := filepath.Join(d.dir, name)
+	// Not a failure: the database is backed up, just not twice.
+	if _, err := os.Stat(path); err == nil {
+		return DatabaseBackup{}, errBackupExists
+	}
+	started := time.Now()
+	backup, err := d.copyTo(path)
+	if err != nil {
+		d.failed(now, err)
+		return DatabaseBackup{}, err
+	}
+	backup.CreatedAt = now.UTC().Truncate(time.Second)
+	d.log.Info("database backed up", "file", path, "size", backup.Size, "took", time.Since(started))
+	d.succeeded(now)
+	d.prune()
+	return backup, nil
+}
+
+// copyTo backs the database up into a temporary file renamed to path once
+// complete, so path is never a partial copy.
+func (d *DatabaseBackups) copyTo(path string) (DatabaseBackup, error) {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	ctx, cancel := context.WithTimeout(d.ctx, backupTimeout)
+	defer cancel()
+	if err := sqliteBackup(ctx, d.src, tmp); err != nil {
+		os.Remove(tmp)
+		return DatabaseBackup{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return DatabaseBackup{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return DatabaseBackup{}, err
+	}
+	return DatabaseBackup{Name: filepath.Base(path), Size: info.Size()}, nil
+}
+
+// sqliteBackup copies the database at src to dest with SQLite's online
+// backup API, a few pages at a time. It uses its own connection to src, so
+// the application's connection stays free, and the source is only locked
+// during each step. A write from another connection makes SQLite restart
+// the copy, so it converges once writes leave it enough room.
+func sqliteBackup(ctx context.Context, src, dest string) error {
+	srcDB, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", src, err)
+	}
+	defer srcConn.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", dest, err)
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("starting backup: %w", err)
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Finish()
+					return fmt.Errorf("copying pages: %w", err)
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return ctx.Err()
+				case <-time.After(backupStepPause):
+				}
+			}
+		})
+	})
+}
+
+// failed raises the backup alert, once per run of failures.
+func (d *DatabaseBackups) failed(now time.Time, err error) {
+	d.log.Error("database backup failed", "err", err)
+	if !d.failedSince.IsZero() {
+		return
+	}
+	d.failedSince = now
+	if d.sink != nil {
+		d.sink.AlertFired(Alert{Rule: backupRule, Severity: "critical", State: alertFiring, Message: "Database backup failed: " + err.Error(), Since: now, FiredAt: now})
+	}
+}
+
+// succeeded resolves the backup alert after failures.
+func (d *DatabaseBackups) succeeded(now time.Time) {
+	if d.failedSince.IsZero() {
+		return
+	}
+	since := d.failedSince
+	d.failedSince = time.Time{}
+	if d.sink != nil {
+		d.sink.AlertResolved(Alert{Rule: backupRule, Severity: "critical", State: alertResolved, Message: "Database backups work again", Since: since, FiredAt: since, ResolvedAt: now})
+	}
+}
+
+// List returns the backups in the directory, newest first.
+func (d *DatabaseBackups) List() ([]DatabaseBackup, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []DatabaseBackup{}
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), backupPrefix)
+		if stamp, ok = strings.CutSuffix(stamp, backupSuffix); !ok || e.IsDir() {
+			continue
+		}
+		created, err := time.Parse(backupTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, DatabaseBackup{Name: e.Name(), Size: info.Size(), CreatedAt: created})
+	}
+	slices.SortFunc(backups, func(a, b DatabaseBackup) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return backups, nil
+}
+
+// prune deletes the backups beyond the newest keep.
+func (d *DatabaseBackups) prune() {
+	backups, err := d.List()
+	if err != nil {
+		d.log.Warn("listing backups failed", "err", err)
+		return
+	}
+	for _, b := range backups[min(d.keep, len(backups)):] {
+		if err := os.Remove(filepath.Join(d.dir, b.Name)); err != nil {
+			d.log.Warn("deleting old backup failed", "file", b.Name, "err", err)
+		}
+	}
+}
+
+// handleDatabaseBackup takes a backup on demand. It is registered behind
+// AuthMiddleware and AdminAuthMiddleware.
+func handleDatabaseBackup(c *fiber.Ctx) error {
+	if databaseBackups == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "database backups not configured"})
+	}
+	backup, err := databaseBackups.Backup(time.Now())
+	if errors.Is(err, errBackupRunning) || errors.Is(err, errBackupExists) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusCreated).JSON(backup)
+}
+
+// handleListDatabaseBackups lists the backups, newest first. It is
+// registered behind AuthMiddleware and AdminAuthMiddleware.
+func handleListDatabaseBackups(c *fiber.Ctx) error {
+	if databaseBackups == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "database backups not configured"})
+	}
+	backups, err := databaseBackups.List()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(backups)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openTestDBFile(t *testing.T, path string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// setupDatabaseBackupTest creates a database file with 500 states of one
+// device and the backups of it.
+func setupDatabaseBackupTest(t *testing.T, backup DatabaseBackupConfig) (*DatabaseBackups, *gorm.DB, *recordingSink) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &Config{Database: DatabaseConfig{Path: filepath.Join(dir, "at2.db"), Backup: &backup}}
+	if err := validateDatabaseBackupConfig(cfg, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDBFile(t, cfg.Database.Path)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	if err := AutoMigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+	device := VirtualDeviceModel{Name: "hall/temp", Type: string(VdevTypeTemperature)}
+	if err := db.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	states := make([]VirtualDeviceStateModel, 500)
+	for i := range states {
+		states[i] = VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: int64(i) * 1000, VirtualDeviceID: device.ID, State: "21.5"}
+	}
+	if err := db.CreateInBatches(states, 100).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	backups, err := NewDatabaseBackups(cfg, sink, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backups.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(backups.Stop)
+	return backups, db, sink
+}
+
+func countStates(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(&VirtualDeviceStateModel{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDatabaseBackups_BackupOpens(t *testing.T) {
+	backups, _, sink := setupDatabaseBackupTest(t, DatabaseBackupConfig{})
+	now := time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC)
+
+	backup, err := backups.Backup(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.Name != "at2-20261015T030000Z.db" || backup.Size == 0 || !backup.CreatedAt.Equal(now) {
+		t.Fatalf("backup %+v", backup)
+	}
+	copied := openTestDBFile(t, filepath.Join(backups.dir, backup.Name))
+	if n := countStates(t, copied); n != 500 {
+		t.Fatalf("backup has %d states", n)
+	}
+	var devices int64
+	copied.Model(&VirtualDeviceModel{}).Count(&devices)
+	if devices != 1 {
+		t.Fatalf("backup has %d devices", devices)
+	}
+	if len(sink.events) != 0 {
+		t.Fatalf("alerts %v", sink.events)
+	}
+	if _, err := os.Stat(filepath.Join(backups.dir, backup.Name+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left: %v", err)
+	}
+}
+
+// Writes going on during the backup wait for a step at most; the copy is
+// one consistent state of the database.
+func TestDatabaseBackups_ConsistentWhileWriting(t *testing.T) {
+	backups, db, _ := setupDatabaseBackupTest(t, DatabaseBackupConfig{})
+
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	var writeErr error
+	writer.Go(func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			state := VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: int64(1_000_000 + i), VirtualDeviceID: 1, State: "22"}
+			if err := db.Create(&state).Error; err != nil {
+				writeErr = err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	backup, err := backups.Backup(time.Now())
+	close(stop)
+	writer.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writeErr != nil {
+		t.Fatalf("writer failed during the backup: %v", writeErr)
+	}
+
+	copied := openTestDBFile(t, filepath.Join(backups.dir, backup.Name))
+	var check string
+	if err := copied.Raw("PRAGMA integrity_check").Scan(&check).Error; err != nil || check != "ok" {
+		t.Fatalf("integrity check: %q %v", check, err)
+	}
+	if n := countStates(t, copied); n < 500 || n > countStates(t, db) {
+		t.Fatalf("backup has %d states", n)
+	}
+}
+
+func TestDatabaseBackups_Retention(t *testing.T) {
+	backups, _, _ := setupDatabaseBackupTest(t, DatabaseBackupConfig{Keep: 2})
+	start := time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC)
+	for day := range 4 {
+		if _, err := backups.Backup(start.AddDate(0, 0, day)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not backups: left alone.
+	os.WriteFile(filepath.Join(backups.dir, "notes.txt"), []byte("keep me"), 0o644)
+
+	list, err := backups.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range list {
+		names = append(names, b.Name)
+	}
+	if want := []string{"at2-20261018T030000Z.db", "at2-20261017T030000Z.db"}; !slices.Equal(names, want) {
+		t.Fatalf("backups %v, want %v", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(backups.dir, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatabaseBackups_FailureAlert(t *testing.T) {
+	backups, _, sink := setupDatabaseBackupTest(t, DatabaseBackupConfig{})
+	src := backups.src
+	backups.src = filepath.Join(t.TempDir(), "garbage.db")
+	os.WriteFile(backups.src, []byte(strings.Repeat("not a database ", 100)), 0o644)
+
+	now := time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC)
+	for i := range 2 {
+		if _, err := backups.Backup(now.Add(time.Duration(i) * time.Minute)); err == nil {
+			t.Fatal("backing up garbage succeeded")
+		}
+	}
+	// Raised once for the run of failures.
+	if got := sink.take(); !slices.Equal(got, []string{"fired:database_backup/"}) || sink.alerts[0].Severity != "critical" {
+		t.Fatalf("alerts %v", got)
+	}
+	if list, _ := backups.List(); len(list) != 0 {
+		t.Fatalf("failed backups listed: %+v", list)
+	}
+
+	backups.src = src
+	if _, err := backups.Backup(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.take(); !slices.Equal(got, []string{"resolved:database_backup/"}) {
+		t.Fatalf("alerts %v", got)
+	}
+}
+
+func TestDatabaseBackups_SameSecond(t *testing.T) {
+	backups, _, sink := setupDatabaseBackupTest(t, DatabaseBackupConfig{})
+	now := time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC)
+	if _, err := backups.Backup(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backups.Backup(now.Add(500 * time.Millisecond)); !errors.Is(err, errBackupExists) {
+		t.Fatalf("second backup in the same second: err = %v", err)
+	}
+	if got := sink.take(); len(got) != 0 {
+		t.Fatalf("alerts %v", got)
+	}
+}
+
+func TestDatabaseBackups_Schedule(t *testing.T) {
+	backups, _, _ := setupDatabaseBackupTest(t, DatabaseBackupConfig{Schedule: "30 3 * * *", Timezone: "UTC"})
+	at := time.Date(2026, 10, 15, 3, 30, 5, 0, time.UTC)
+	backups.run(at.Add(-time.Minute))
+	backups.run(at)
+	// Checked again within the same minute.
+	backups.run(at.Add(20 * time.Second))
+	if list, _ := backups.List(); len(list) != 1 {
+		t.Fatalf("backups %+v", list)
+	}
+
+	backups.running.Lock()
+	_, err := backups.Backup(at.Add(time.Hour))
+	backups.running.Unlock()
+	if !errors.Is(err, errBackupRunning) {
+		t.Fatalf("concurrent backup: %v", err)
+	}
+}
+
+func TestValidateDatabaseBackupConfig(t *testing.T) {
+	for _, tc := range []struct {
+		backup DatabaseBackupConfig
+		err    string
+	}{
+		{DatabaseBackupConfig{Schedule: "every night"}, "database.backup.schedule"},
+		{DatabaseBackupConfig{Timezone: "Mars/Olympus"}, "database.backup.timezone"},
+		{DatabaseBackupConfig{Keep: -1}, "database.backup.keep"},
+	} {
+		err := validateDatabaseBackupConfig(&Config{Database: DatabaseConfig{Backup: &tc.backup}}, "at2.yaml")
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: %v, want %s", tc.backup, err, tc.err)
+		}
+	}
+}
+
+func TestHandleDatabaseBackup(t *testing.T) {
+	prev := databaseBackups
+	t.Cleanup(func() { databaseBackups = prev })
+	app := fiber.New()
+	app.Post("/api/v1/admin/backup", handleDatabaseBackup)
+	app.Get("/api/v1/admin/backups", handleListDatabaseBackups)
+
+	databaseBackups = nil
+	if resp, _ := app.Test(httptest.NewRequest(http.MethodPost, "/api/v1/admin/backup", nil)); resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Fatalf("not configured: %d", resp.StatusCode)
+	}
+
+	databaseBackups, _, _ = setupDatabaseBackupTest(t, DatabaseBackupConfig{})
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/v1/admin/backup", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("backup: %d", resp.StatusCode)
+	}
+	var list []DatabaseBackup
+	getJSON(t, app, "/api/v1/admin/backups", &list)
+	if len(list) != 1 || list[0].Size == 0 || !strings.HasPrefix(list[0].Name, backupPrefix) {
+		t.Fatalf("backups %+v", list)
+	}
+
+	// Another backup stamped with the same second is refused, not failed.
+	for i := range 5 {
+		at := time.Now().Add(time.Duration(i) * time.Second)
+		os.WriteFile(filepath.Join(databaseBackups.dir, backupPrefix+at.UTC().Format(backupTimeLayout)+backupSuffix), nil, 0o600)
+	}
+	if resp, _ := app.Test(httptest.NewRequest(http.MethodPost, "/api/v1/admin/backup", nil)); resp.StatusCode != fiber.StatusConflict {
+		t.Fatalf("backup in the same second: %d, want 409", resp.StatusCode)
+	}
+}
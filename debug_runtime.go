@@ -0,0 +1,87 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+// recentGCPauses is how many of the latest GC pauses /api/v1/debug/runtime
+// lists.
+const recentGCPauses = 10
+
+// processStart is reported as the uptime base by /api/v1/debug/runtime.
+var processStart = time.Now()
+
+// RuntimeStats is the GET /api/v1/debug/runtime body.
+type RuntimeStats struct {
+	Uptime     string `json:"uptime"`
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	Heap       struct {
+		AllocBytes    uint64 `json:"alloc_bytes"`
+		InuseBytes    uint64 `json:"inuse_bytes"`
+		SysBytes      uint64 `json:"sys_bytes"`
+		Objects       uint64 `json:"objects"`
+		NextGCBytes   uint64 `json:"next_gc_bytes"`
+		TotalAllocs   uint64 `json:"total_allocs"`
+		TotalFrees    uint64 `json:"total_frees"`
+		ReleasedBytes uint64 `json:"released_bytes"`
+	} `json:"heap"`
+	GC struct {
+		Count      uint32    `json:"count"`
+		Last       time.Time `json:"last,omitzero"`
+		PauseTotal string    `json:"pause_total"`
+		// RecentPauses are the latest pauses, newest first.
+		RecentPauses []string `json:"recent_pauses"`
+		CPUFraction  float64  `json:"cpu_fraction"`
+	} `json:"gc"`
+	SnapshotCache SnapshotCacheStats `json:"snapshot_cache"`
+}
+
+// registerDebugRoutes mounts pprof and the runtime stats when
+// web.debug_endpoints is set, behind the same auth as the other debug
+// routes. Nothing is registered otherwise.
+func registerDebugRoutes(app *fiber.App, cfg *Config) {
+	if !cfg.Web.DebugEndpoints {
+		return
+	}
+	app.Get("/api/v1/debug/runtime", AuthMiddleware, DebugAccessAuthMiddleware, handleRuntimeStats)
+	app.Use("/api/v1/debug/pprof", AuthMiddleware, DebugAccessAuthMiddleware, pprof.New(pprof.Config{Prefix: "/api/v1"}))
+}
+
+func handleRuntimeStats(c *fiber.Ctx) error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	var stats RuntimeStats
+	stats.Uptime = time.Since(processStart).Round(time.Second).String()
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	stats.Heap.AllocBytes = ms.HeapAlloc
+	stats.Heap.InuseBytes = ms.HeapInuse
+	stats.Heap.SysBytes = ms.HeapSys
+	stats.Heap.Objects = ms.HeapObjects
+	stats.Heap.NextGCBytes = ms.NextGC
+	stats.Heap.TotalAllocs = ms.Mallocs
+	stats.Heap.TotalFrees = ms.Frees
+	stats.Heap.ReleasedBytes = ms.HeapReleased
+	stats.GC.Count = ms.NumGC
+	if ms.LastGC != 0 {
+		stats.GC.Last = time.Unix(0, int64(ms.LastGC))
+	}
+	stats.GC.PauseTotal = time.Duration(ms.PauseTotalNs).String()
+	stats.GC.RecentPauses = []string{}
+	// PauseNs is a ring buffer; the latest pause is at (NumGC+255)%256.
+	for i := uint32(0); i < min(ms.NumGC, recentGCPauses); i++ {
+		pause := ms.PauseNs[(ms.NumGC-1-i)%uint32(len(ms.PauseNs))]
+		stats.GC.RecentPauses = append(stats.GC.RecentPauses, time.Duration(pause).String())
+	}
+	stats.GC.CPUFraction = ms.GCCPUFraction
+	stats.SnapshotCache = snapshotCacheStats()
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(stats)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setupDebugRoutesTest(t *testing.T, enabled bool) *fiber.App {
+	t.Helper()
+	setupOIDCTest(t)
+	cfg := GetConfig()
+	cfg.Web.DebugEndpoints = enabled
+	cfg.Oidc.DebugAccessGroups = []string{"infra"}
+	expires := time.Now().Add(time.Hour)
+	createTestSession(t, SessionModel{ID: "infra-1", Subject: "u-alice", Username: "alice", ExpiresAt: expires, CachedClaims: `{"groups":["infra"]}`})
+	createTestSession(t, SessionModel{ID: "member-1", Subject: "u-bob", Username: "bob", ExpiresAt: expires, CachedClaims: `{"groups":["members"]}`})
+
+	app := fiber.New()
+	registerDebugRoutes(app, cfg)
+	return app
+}
+
+func debugStatus(t *testing.T, app *fiber.App, target, session string) (*http.Response, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if session != "" {
+		req.Header.Set("Cookie", CookieName+"="+session)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, resp.StatusCode
+}
+
+func TestDebugRoutes_Disabled(t *testing.T) {
+	app := setupDebugRoutesTest(t, false)
+	for _, target := range []string{"/api/v1/debug/runtime", "/api/v1/debug/pprof/", "/api/v1/debug/pprof/goroutine"} {
+		if _, status := debugStatus(t, app, target, "infra-1"); status != fiber.StatusNotFound {
+			t.Errorf("%s: %d, want 404", target, status)
+		}
+	}
+}
+
+func TestDebugRoutes_Enabled(t *testing.T) {
+	app := setupDebugRoutesTest(t, true)
+	for _, target := range []string{"/api/v1/debug/runtime", "/api/v1/debug/pprof/", "/api/v1/debug/pprof/goroutine?debug=1"} {
+		cases := []struct {
+			session string
+			want    int
+		}{
+			{"", fiber.StatusUnauthorized},
+			{"member-1", fiber.StatusForbidden},
+			{"infra-1", fiber.StatusOK},
+		}
+		for _, tc := range cases {
+			if _, status := debugStatus(t, app, target, tc.session); status != tc.want {
+				t.Errorf("%s as %q: %d, want %d", target, tc.session, status, tc.want)
+			}
+		}
+	}
+
+	resp, _ := debugStatus(t, app, "/api/v1/debug/runtime", "infra-1")
+	var stats RuntimeStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines == 0 || stats.Heap.AllocBytes == 0 || stats.GOMAXPROCS == 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
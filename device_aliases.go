@@ -0,0 +1,283 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// deviceAliasMaxName is the longest alias name, in characters.
+const deviceAliasMaxName = 64
+
+// DeviceAlias is a display name, and optionally a room, given to a device
+// through the API. The config wins over it: the alias name only shows for
+// devices the config doesn't name, the room for devices no room lists.
+type DeviceAlias struct {
+	DeviceID  string    `json:"device_id"`
+	Name      string    `json:"name"`
+	Room      string    `json:"room,omitempty"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeviceAliases holds the aliases, persisted by device ID so they outlive
+// the device going away and being discovered again. A nil *DeviceAliases
+// has no aliases.
+type DeviceAliases struct {
+	db *gorm.DB
+
+	mu   sync.RWMutex
+	byID map[string]DeviceAlias
+}
+
+// NewDeviceAliases creates the store, loading the aliases from the database.
+func NewDeviceAliases(db *gorm.DB) (*DeviceAliases, error) {
+	var rows []DeviceAliasModel
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load device aliases: %w", err)
+	}
+	a := &DeviceAliases{db: db, byID: make(map[string]DeviceAlias, len(rows))}
+	for _, row := range rows {
+		a.byID[row.DeviceID] = aliasFromModel(row)
+	}
+	return a, nil
+}
+
+func aliasFromModel(m DeviceAliasModel) DeviceAlias {
+	return DeviceAlias{
+		DeviceID:  m.DeviceID,
+		Name:      m.Name,
+		Room:      m.RoomID,
+		UpdatedBy: m.UpdatedBy,
+		UpdatedAt: time.Unix(m.UpdatedAt, 0),
+	}
+}
+
+// Get returns the alias of a device.
+func (a *DeviceAliases) Get(deviceID string) (DeviceAlias, bool) {
+	if a == nil {
+		return DeviceAlias{}, false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	alias, ok := a.byID[deviceID]
+	return alias, ok
+}
+
+// All returns the aliases ordered by device ID.
+func (a *DeviceAliases) All() []DeviceAlias {
+	if a == nil {
+		return []DeviceAlias{}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	aliases := slices.Collect(maps.Values(a.byID))
+	slices.SortFunc(aliases, func(x, y DeviceAlias) int { return strings.Compare(x.DeviceID, y.DeviceID) })
+	return aliases
+}
+
+// Set creates or replaces the alias of alias.DeviceID.
+func (a *DeviceAliases) Set(alias DeviceAlias) error {
+	row := DeviceAliasModel{
+		DeviceID:  alias.DeviceID,
+		Name:      alias.Name,
+		RoomID:    alias.Room,
+		UpdatedBy: alias.UpdatedBy,
+		UpdatedAt: alias.UpdatedAt.Unix(),
+	}
+	if err := a.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error; err != nil {
+		return fmt.Errorf("failed to store device alias: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.byID[alias.DeviceID] = aliasFromModel(row)
+	return nil
+}
+
+// Delete removes the alias of a device, reporting whether it had one.
+func (a *DeviceAliases) Delete(deviceID string) (bool, error) {
+	res := a.db.Where("device_id = ?", deviceID).Delete(&DeviceAliasModel{})
+	if res.Error != nil {
+		return false, fmt.Errorf("failed to delete device alias: %w", res.Error)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.byID, deviceID)
+	return res.RowsAffected > 0, nil
+}
+
+// entityNames maps the device IDs of room entities to their configured
+// names. A device listed by several rooms has the name of the first.
+func entityNames(cfg *Config) map[string]LocalizedString {
+	names := map[string]LocalizedString{}
+	for _, room := range cfg.Rooms {
+		for _, e := range room.Entities {
+			if _, ok := names[e.ID]; !ok {
+				names[e.ID] = e.LocalizedName
+			}
+		}
+	}
+	return names
+}
+
+// deviceName is the name of a device in lang: its entity's from the config,
+// else its alias, else empty.
+func deviceName(configName LocalizedString, deviceID, lang string) string {
+	if name := configName.Resolve(lang); name != "" {
+		return name
+	}
+	alias, _ := deviceAliases.Get(deviceID)
+	return alias.Name
+}
+
+// deviceRoom is the room of a device: the one listing it in the config,
+// else the room of its alias.
+func deviceRoom(rooms map[string]string, deviceID string) string {
+	if room, ok := rooms[deviceID]; ok {
+		return room
+	}
+	alias, _ := deviceAliases.Get(deviceID)
+	return alias.Room
+}
+
+// deviceLog is the logger of device changes made by users; main replaces it
+// with the configured one.
+var deviceLog = slog.Default()
+
+// aliasRepresentations are the representations aliased devices are shown
+// with in their room, by type; other types go by their own name.
+var aliasRepresentations = map[VdevType]string{
+	VdevTypeRelay:      "plug",
+	VdevTypePowerUsage: "power",
+	VdevTypeNoiseLevel: "noise",
+}
+
+// aliasedEntities are the entities a room gets from the aliases of devices
+// no room lists, ordered by device ID.
+func aliasedEntities(cfg *Config, roomID string) []EntityConfig {
+	var entities []EntityConfig
+	var rooms map[string]string
+	for _, alias := range deviceAliases.All() {
+		if alias.Room != roomID {
+			continue
+		}
+		if rooms == nil {
+			rooms = deviceRooms(cfg)
+		}
+		if _, configured := rooms[alias.DeviceID]; configured {
+			continue
+		}
+		entity := EntityConfig{ID: alias.DeviceID, LocalizedName: LocalizedString{defaultLocale(): alias.Name}}
+		if dev := vdevManager.Device(alias.DeviceID); dev != nil {
+			entity.Representation = cmp.Or(aliasRepresentations[dev.Type], string(dev.Type))
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+// roomEntities are the entities a room shows: the configured ones, sorted,
+// with the alias names of those the config doesn't name, followed by
+// aliasedEntities.
+func roomEntities(cfg *Config, room RoomConfig) []EntityConfig {
+	entities := sortedEntities(room.Entities)
+	for i, e := range entities {
+		if e.LocalizedName.Resolve("") != "" {
+			continue
+		}
+		if alias, ok := deviceAliases.Get(e.ID); ok {
+			entities[i].LocalizedName = LocalizedString{defaultLocale(): alias.Name}
+		}
+	}
+	return append(entities, aliasedEntities(cfg, room.ID)...)
+}
+
+// deviceAliasRequest is the body of PUT /api/v1/device/+/alias.
+type deviceAliasRequest struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+}
+
+// handleListDeviceAliases serves every alias.
+func handleListDeviceAliases(c *fiber.Ctx) error {
+	return c.JSON(deviceAliases.All())
+}
+
+// handleSetDeviceAlias names a discovered device, and with "room" puts it
+// in a room when no room lists it. "+" is a greedy param so device IDs
+// containing slashes are captured whole. It is registered behind
+// AuthMiddleware.
+func handleSetDeviceAlias(c *fiber.Ctx) error {
+	if deviceAliases == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Device aliases are not available"})
+	}
+	// Cloned as it is kept, and Fiber reuses the request's memory.
+	id := strings.Clone(c.Params("+"))
+	var req deviceAliasRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > deviceAliasMaxName {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("name must have 1 to %d characters", deviceAliasMaxName)})
+	}
+	cfg := GetConfig()
+	if req.Room != "" && !slices.ContainsFunc(cfg.Rooms, func(r RoomConfig) bool { return r.ID == req.Room }) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown room " + req.Room})
+	}
+	if vdevManager.Device(id) == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+
+	previous, _ := deviceAliases.Get(id)
+	username, _ := c.Locals("username").(string)
+	alias := DeviceAlias{DeviceID: id, Name: req.Name, Room: req.Room, UpdatedBy: username, UpdatedAt: time.Now()}
+	if err := deviceAliases.Set(alias); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	deviceLog.Info("device named", "user", username, "device", id, "name", alias.Name, "room", alias.Room)
+	broadcastAliasRooms(cfg, id, previous.Room, alias.Room)
+	alias, _ = deviceAliases.Get(id)
+	return c.JSON(alias)
+}
+
+// handleDeleteDeviceAlias removes the alias of a device. It is registered
+// behind AuthMiddleware.
+func handleDeleteDeviceAlias(c *fiber.Ctx) error {
+	if deviceAliases == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Device aliases are not available"})
+	}
+	id := c.Params("+")
+	previous, _ := deviceAliases.Get(id)
+	deleted, err := deviceAliases.Delete(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !deleted {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Alias not found"})
+	}
+	deviceLog.Info("device alias removed", "user", c.Locals("username"), "device", id)
+	broadcastAliasRooms(GetConfig(), id, previous.Room)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// broadcastAliasRooms refreshes the live clients of the rooms that show the
+// device: the one listing it and those of its old and new alias.
+func broadcastAliasRooms(cfg *Config, deviceID string, aliasRooms ...string) {
+	roomIDs := append(aliasRooms, deviceRooms(cfg)[deviceID])
+	for _, room := range cfg.Rooms {
+		if slices.Contains(roomIDs, room.ID) {
+			broadcastRoomUpdate(room)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupDeviceAliasesTest serves the alias and device endpoints over a hall
+// with a named thermometer and an unnamed camera, a lab, and an unconfigured
+// Zigbee relay.
+func setupDeviceAliasesTest(t *testing.T) *fiber.App {
+	t.Helper()
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	prevAliases, prevAdapter := deviceAliases, mqttAdapter
+	t.Cleanup(func() { deviceAliases, mqttAdapter = prevAliases, prevAdapter })
+	mqttAdapter = &MQTTAdapter{}
+	aliases, err := NewDeviceAliases(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceAliases = aliases
+
+	setConfig(&Config{Rooms: []RoomConfig{
+		{ID: "hall", Entities: []EntityConfig{
+			{ID: "hall/temp", LocalizedName: LocalizedString{"en": "Thermometer"}, Representation: "temperature"},
+			{ID: "frigate/person/hall"},
+		}},
+		{ID: "lab"},
+	}})
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "0x00158d0005a2b3c4", Type: VdevTypeRelay, State: "ON"},
+		{ID: "0x00158d0005ffffff", Type: VdevTypeCO2, State: 800.0},
+	})
+
+	app := fiber.New()
+	app.Get("/api/v1/all-devices", handleDevices)
+	app.Get("/api/v1/devices/search", handleDeviceSearch)
+	app.Get("/api/v1/room-states", handleGetRoomStates)
+	app.Get("/api/v1/device-aliases", handleListDeviceAliases)
+	app.Put("/api/v1/device/+/alias", handleSetDeviceAlias)
+	app.Delete("/api/v1/device/+/alias", handleDeleteDeviceAlias)
+	return app
+}
+
+func putAlias(t *testing.T, app *fiber.App, deviceID, body string) (int, DeviceAlias) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/device/"+deviceID+"/alias", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alias DeviceAlias
+	if resp.StatusCode == fiber.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, alias
+}
+
+func deleteAlias(t *testing.T, app *fiber.App, deviceID string) int {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodDelete, "/api/v1/device/"+deviceID+"/alias", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestDeviceAliasHandlers(t *testing.T) {
+	app := setupDeviceAliasesTest(t)
+
+	for body, want := range map[string]int{
+		`{"name": "  "}`: fiber.StatusBadRequest,
+		`{"name": "` + strings.Repeat("x", deviceAliasMaxName+1) + `"}`: fiber.StatusBadRequest,
+		`{"name": "Lamp", "room": "attic"}`:                             fiber.StatusBadRequest,
+		`not json`:                                                      fiber.StatusBadRequest,
+	} {
+		if status, _ := putAlias(t, app, "0x00158d0005a2b3c4", body); status != want {
+			t.Errorf("PUT %s: status %d, want %d", body, status, want)
+		}
+	}
+	if status, _ := putAlias(t, app, "nope/relay", `{"name": "Lamp"}`); status != fiber.StatusNotFound {
+		t.Errorf("unknown device: status %d, want 404", status)
+	}
+
+	status, alias := putAlias(t, app, "0x00158d0005a2b3c4", `{"name": " Lamp ", "room": "lab"}`)
+	if status != fiber.StatusOK || alias.DeviceID != "0x00158d0005a2b3c4" || alias.Name != "Lamp" || alias.Room != "lab" {
+		t.Fatalf("PUT: %d %+v", status, alias)
+	}
+	// Replacing it; IDs with slashes are taken whole.
+	status, alias = putAlias(t, app, "0x00158d0005a2b3c4", `{"name": "Desk lamp"}`)
+	if status != fiber.StatusOK || alias.Name != "Desk lamp" || alias.Room != "" {
+		t.Fatalf("PUT again: %d %+v", status, alias)
+	}
+	if status, _ := putAlias(t, app, "frigate/person/hall", `{"name": "Hall camera"}`); status != fiber.StatusOK {
+		t.Fatalf("PUT frigate/person/hall: %d", status)
+	}
+
+	var listed []DeviceAlias
+	getJSON(t, app, "/api/v1/device-aliases", &listed)
+	var ids []string
+	for _, a := range listed {
+		ids = append(ids, a.DeviceID+"="+a.Name)
+	}
+	if want := []string{"0x00158d0005a2b3c4=Desk lamp", "frigate/person/hall=Hall camera"}; !slices.Equal(ids, want) {
+		t.Errorf("listed %v, want %v", ids, want)
+	}
+
+	// Aliases outlive the device going away and coming back, and restarts.
+	vdevManager.RemoveDevice("0x00158d0005a2b3c4")
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "0x00158d0005a2b3c4", Type: VdevTypeRelay}})
+	reloaded, err := NewDeviceAliases(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Get("0x00158d0005a2b3c4"); !ok || got.Name != "Desk lamp" || got.UpdatedAt.IsZero() {
+		t.Errorf("reloaded alias %+v, %t", got, ok)
+	}
+
+	if status := deleteAlias(t, app, "frigate/person/hall"); status != fiber.StatusNoContent {
+		t.Errorf("DELETE: status %d, want 204", status)
+	}
+	if status := deleteAlias(t, app, "frigate/person/hall"); status != fiber.StatusNotFound {
+		t.Errorf("DELETE again: status %d, want 404", status)
+	}
+	if _, ok := deviceAliases.Get("frigate/person/hall"); ok {
+		t.Error("deleted alias still in effect")
+	}
+}
+
+func TestDeviceAliasPrecedence(t *testing.T) {
+	app := setupDeviceAliasesTest(t)
+	now := time.Now()
+	for _, alias := range []DeviceAlias{
+		// The config names and places hall/temp; its alias changes nothing.
+		{DeviceID: "hall/temp", Name: "Ignored", Room: "lab", UpdatedAt: now},
+		// The camera is placed but not named by the config.
+		{DeviceID: "frigate/person/hall", Name: "Hall camera", Room: "lab", UpdatedAt: now},
+		{DeviceID: "0x00158d0005a2b3c4", Name: "Lamp", Room: "hall", UpdatedAt: now},
+	} {
+		if err := deviceAliases.Set(alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var devices []deviceResponse
+	getJSON(t, app, "/api/v1/all-devices", &devices)
+	got := map[string]string{}
+	for _, d := range devices {
+		got[d.ID] = d.Name + "@" + d.Room
+	}
+	want := map[string]string{
+		"hall/temp":           "Thermometer@hall",
+		"frigate/person/hall": "Hall camera@hall",
+		"0x00158d0005a2b3c4":  "Lamp@hall",
+		"0x00158d0005ffffff":  "0x00158d0005ffffff@",
+	}
+	for id, w := range want {
+		if got[id] != w {
+			t.Errorf("all-devices %s = %q, want %q", id, got[id], w)
+		}
+	}
+
+	var found []DeviceSearchResult
+	getJSON(t, app, "/api/v1/devices/search?q=lamp", &found)
+	if len(found) != 1 || found[0].ID != "0x00158d0005a2b3c4" || found[0].Name != "Lamp" || found[0].Room != "hall" ||
+		!slices.Equal(found[0].Matched, []string{"name"}) {
+		t.Errorf("search lamp: %+v", found)
+	}
+	getJSON(t, app, "/api/v1/devices/search?q=ignored", &found)
+	if len(found) != 1 || found[0].Name != "Thermometer" {
+		t.Errorf("search ignored: %+v", found)
+	}
+
+	var rooms []RoomState
+	getJSON(t, app, "/api/v1/room-states?lang=en", &rooms)
+	entities := map[string][]string{}
+	for _, rs := range rooms {
+		for _, e := range rs.Entities {
+			entities[rs.ID] = append(entities[rs.ID], e.ID+"="+e.Name+"/"+e.Representation)
+		}
+	}
+	wantHall := []string{"frigate/person/hall=Hall camera/", "hall/temp=Thermometer/temperature", "0x00158d0005a2b3c4=Lamp/plug"}
+	if !slices.Equal(entities["hall"], wantHall) || len(entities["lab"]) != 0 {
+		t.Errorf("room entities %v, want hall %v and an empty lab", entities, wantHall)
+	}
+
+	report := buildReconcileReport(GetConfig(), vdevManager.Devices(), now)
+	if len(report.AliasedUnconfigured) != 1 || report.AliasedUnconfigured[0].DeviceID != "0x00158d0005a2b3c4" {
+		t.Errorf("aliased but unconfigured: %+v", report.AliasedUnconfigured)
+	}
+	if got := report.Unconfigured[VdevTypeCO2]; !slices.Equal(got, []string{"0x00158d0005ffffff"}) || len(report.Unconfigured[VdevTypeRelay]) != 0 {
+		t.Errorf("unconfigured: %v", report.Unconfigured)
+	}
+}
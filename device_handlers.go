@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// allDevicesFields are the fields of the devices served by
+// /api/v1/all-devices, which ?fields= picks from.
+var allDevicesFields = []string{
+	"id", "type", "state", "mapper_data", "fresh", "last_updated_at",
+	"prohibit_control", "pending", "auto_off_at", "raw_state", "name", "room",
+	"unit",
+}
+
+// deviceResponse is a device as served by /api/v1/all-devices.
+type deviceResponse struct {
+	*VirtualDevice
+	// Name is the entity's name in the request's language, else the
+	// device's alias, else its ID.
+	Name string `json:"name"`
+	// Room is the ID of the room listing the device as an entity or camera,
+	// else the room of its alias; empty when there is neither.
+	Room string `json:"room,omitempty"`
+	// Unit is the unit State is in: the canonical one of the type, or °F
+	// for temperatures in imperial units. Empty for unitless types.
+	Unit string `json:"unit,omitempty"`
+}
+
+// deviceRooms maps the device IDs of room entities and cameras to the room
+// ID. A device listed by several rooms belongs to the first.
+func deviceRooms(cfg *Config) map[string]string {
+	rooms := map[string]string{}
+	for _, room := range cfg.Rooms {
+		ids := make([]string, 0, len(room.Entities)+len(room.Cameras))
+		for _, e := range room.Entities {
+			ids = append(ids, e.ID)
+		}
+		for _, name := range room.Cameras {
+			ids = append(ids, cameraDeviceID(name))
+		}
+		for _, id := range ids {
+			if _, ok := rooms[id]; !ok {
+				rooms[id] = room.ID
+			}
+		}
+	}
+	return rooms
+}
+
+// splitQueryList splits a comma-separated query parameter, dropping empty
+// items; nil when the parameter isn't set.
+func splitQueryList(v string) []string {
+	var items []string
+	for item := range strings.SplitSeq(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleDevices serves every device with its name, in the language picked
+// by ?lang= or Accept-Language, and the room it is in. ?type= and
+// ?room= (comma-separated) keep the devices of those types and rooms, and
+// ?fields= only serves the listed fields. MapperData holds mapper internals
+// (IEEE addresses, topics) and is only served to logged in clients asking
+// with ?include=mapper_data, unless web.all_devices_mapper_data is set.
+func handleDevices(c *fiber.Ctx) error {
+	if mqttAdapter == nil {
+		return c.Status(fiber.StatusServiceUnavailable).SendString("MQTT adapter not initialized")
+	}
+	cfg := GetConfig()
+	types, roomIDs, fields := splitQueryList(c.Query("type")), splitQueryList(c.Query("room")), splitQueryList(c.Query("fields"))
+	for _, f := range fields {
+		if !slices.Contains(allDevicesFields, f) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown field " + f})
+		}
+	}
+	mapperData := cfg.Web.AllDevicesMapperData
+	if slices.Contains(splitQueryList(c.Query("include")), "mapper_data") {
+		session, err := loadSession(c)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Not logged in"})
+		}
+		setSessionLocals(c, session)
+		mapperData = true
+	}
+
+	rooms, names := deviceRooms(cfg), entityNames(cfg)
+	lang := requestLocale(c, configLocales(cfg))
+	units := requestUnits(c)
+	devices := []deviceResponse{}
+	for _, dev := range vdevManager.Devices() {
+		if dev == nil {
+			continue
+		}
+		room := deviceRoom(rooms, dev.ID)
+		if len(types) > 0 && !slices.Contains(types, string(dev.Type)) {
+			continue
+		}
+		if len(roomIDs) > 0 && !slices.Contains(roomIDs, room) {
+			continue
+		}
+		dev.State = convertState(dev.Type, dev.State, units)
+		if !mapperData {
+			dev.MapperData = nil
+		}
+		name := cmp.Or(deviceName(names[dev.ID], dev.ID, lang), dev.ID)
+		devices = append(devices, deviceResponse{VirtualDevice: dev, Name: name, Room: room, Unit: stateUnit(dev.Type, units)})
+	}
+
+	c.Vary(fiber.HeaderAcceptLanguage)
+	c.Set("Cache-Control", "no-cache")
+	if len(fields) == 0 {
+		return c.Status(fiber.StatusOK).JSON(devices)
+	}
+	projected := make([]map[string]json.RawMessage, 0, len(devices))
+	for _, dev := range devices {
+		b, err := json.Marshal(dev)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		picked := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := all[f]; ok {
+				picked[f] = v
+			}
+		}
+		projected = append(projected, picked)
+	}
+	return c.Status(fiber.StatusOK).JSON(projected)
+}
+
+// deviceActiveWindow is how recently a device must have reported to count
+// as still being discovered: a mapper would bring it back right after it is
+// deleted.
+const deviceActiveWindow = 24 * time.Hour
+
+// deviceDeletionResponse is what DELETE /api/v1/admin/device/+ did.
+type deviceDeletionResponse struct {
+	DeviceID string `json:"device_id"`
+	// Removed is whether the device was in the device list.
+	Removed bool `json:"removed"`
+	DeviceDeletion
+}
+
+// handleDeleteDevice removes a decommissioned device from the device list
+// and deletes its record, with ?purge_history=true its states too. Devices
+// still being discovered are refused unless ?force=true. "+" is a greedy
+// param so device IDs containing slashes are captured whole. It is
+// registered behind AdminAuthMiddleware.
+func handleDeleteDevice(c *fiber.Ctx) error {
+	id := c.Params("+")
+	purge, force := c.Query("purge_history") == "true", c.Query("force") == "true"
+	dev := vdevManager.Device(id)
+	if dev != nil && dev.Fresh && !force {
+		if ago := time.Since(dev.LastUpdatedAt); ago < deviceActiveWindow {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": fmt.Sprintf("device %s reported %s ago and is still being discovered; delete it with force=true", id, ago.Round(time.Second))})
+		}
+	}
+
+	// Removed first, so that no states are recorded while purging.
+	resp := deviceDeletionResponse{DeviceID: id, Removed: vdevManager.RemoveDevice(id) != nil}
+	recorded := false
+	if vdevHistoryRepo != nil {
+		deletion, err := vdevHistoryRepo.DeleteDevice(id, purge)
+		switch {
+		case errors.Is(err, errDeviceNotRecorded):
+		case err != nil:
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		default:
+			recorded = true
+		}
+		resp.DeviceDeletion = deletion
+	}
+	if !resp.Removed && !recorded {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Device not found"})
+	}
+	deviceLog.Info("device deleted", "user", c.Locals("username"), "device", id,
+		"removed", resp.Removed, "record_deleted", resp.RecordDeleted, "states_purged", resp.StatesDeleted)
+	return c.JSON(resp)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupAllDevicesTest serves /api/v1/all-devices over a hall with a
+// thermometer and a camera, a lab with a relay, and a device in no room.
+func setupAllDevicesTest(t *testing.T) *fiber.App {
+	t.Helper()
+	setupLiveWsTest(t)
+	prevAdapter := mqttAdapter
+	t.Cleanup(func() { mqttAdapter = prevAdapter })
+	mqttAdapter = &MQTTAdapter{}
+	setConfig(&Config{Rooms: []RoomConfig{
+		{ID: "hall", Entities: []EntityConfig{{ID: "hall/temp"}}, Cameras: []string{"hall"}},
+		{ID: "lab", Entities: []EntityConfig{{ID: "lab/relay"}, {ID: "hall/temp"}}},
+	}})
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "hall/temp", Type: VdevTypeTemperature, State: 21.5, MapperData: map[string]any{"ieee": "0x00158d0001"}},
+		{ID: "snapshot/hall", Type: VdevTypeCameraSnapshot},
+		{ID: "lab/relay", Type: VdevTypeRelay, State: true, MapperData: map[string]any{"topic": "zigbee2mqtt/relay"}},
+		{ID: "basement/co2", Type: VdevTypeCO2, State: 800.0},
+	})
+	app := fiber.New()
+	app.Get("/api/v1/all-devices", handleDevices)
+	return app
+}
+
+// getDevices requests target with the given session cookie and decodes the
+// devices by ID.
+func getDevices(t *testing.T, app *fiber.App, target, cookie string) (int, map[string]map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: cookie})
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var devices []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	byID := map[string]map[string]any{}
+	for _, d := range devices {
+		byID[d["id"].(string)] = d
+	}
+	return resp.StatusCode, byID
+}
+
+func TestHandleDevices_Rooms(t *testing.T) {
+	app := setupAllDevicesTest(t)
+	_, devices := getDevices(t, app, "/api/v1/all-devices", "")
+	if len(devices) != 4 {
+		t.Fatalf("%d devices", len(devices))
+	}
+	for id, want := range map[string]any{"hall/temp": "hall", "snapshot/hall": "hall", "lab/relay": "lab", "basement/co2": nil} {
+		if got := devices[id]["room"]; got != want {
+			t.Errorf("%s: room %v, want %v", id, got, want)
+		}
+	}
+	// Everything else is served as before.
+	if d := devices["hall/temp"]; d["type"] != "temperature" || d["state"] != 21.5 || d["prohibit_control"] != false {
+		t.Errorf("hall/temp %v", d)
+	}
+}
+
+func TestHandleDevices_Filters(t *testing.T) {
+	app := setupAllDevicesTest(t)
+	for target, want := range map[string][]string{
+		"/api/v1/all-devices?type=temperature":            {"hall/temp"},
+		"/api/v1/all-devices?type=relay,co2":              {"basement/co2", "lab/relay"},
+		"/api/v1/all-devices?type=radiation":              {},
+		"/api/v1/all-devices?room=hall":                   {"hall/temp", "snapshot/hall"},
+		"/api/v1/all-devices?room=hall,lab":               {"hall/temp", "lab/relay", "snapshot/hall"},
+		"/api/v1/all-devices?room=hall&type=relay":        {},
+		"/api/v1/all-devices?room=lab&type=relay,contact": {"lab/relay"},
+	} {
+		_, devices := getDevices(t, app, target, "")
+		if got := slices.Sorted(maps.Keys(devices)); !slices.Equal(got, want) {
+			t.Errorf("%s: %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestHandleDevices_Fields(t *testing.T) {
+	app := setupAllDevicesTest(t)
+	_, devices := getDevices(t, app, "/api/v1/all-devices?fields=id,state,room", "")
+	if got := devices["hall/temp"]; len(got) != 3 || got["state"] != 21.5 || got["room"] != "hall" {
+		t.Errorf("hall/temp %v", got)
+	}
+	// Fields the device omits stay omitted.
+	if got := devices["basement/co2"]; len(got) != 2 {
+		t.Errorf("basement/co2 %v", got)
+	}
+
+	if status, _ := getDevices(t, app, "/api/v1/all-devices?fields=id,ieee", ""); status != fiber.StatusBadRequest {
+		t.Fatalf("unknown field: status %d", status)
+	}
+}
+
+func TestHandleDevices_FieldsListed(t *testing.T) {
+	dev := deviceResponse{VirtualDevice: &VirtualDevice{LastUpdatedAt: time.Now(), AutoOffAt: time.Now(), RawState: 1.0}, Room: "hall", Unit: "W"}
+	b, err := json.Marshal(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all map[string]any
+	json.Unmarshal(b, &all)
+	if got := slices.Sorted(maps.Keys(all)); !slices.Equal(got, slices.Sorted(slices.Values(allDevicesFields))) {
+		t.Fatalf("served fields %v, allDevicesFields %v", got, allDevicesFields)
+	}
+}
+
+func TestHandleDevices_MapperData(t *testing.T) {
+	app := setupAllDevicesTest(t)
+	setupTestDB(t)
+	createTestSession(t, SessionModel{ID: "s1", Subject: "u1", Username: "alice", IsLocal: true, ExpiresAt: time.Now().Add(time.Hour)})
+
+	// Redacted by default, even for logged in clients.
+	for _, cookie := range []string{"", "s1"} {
+		_, devices := getDevices(t, app, "/api/v1/all-devices", cookie)
+		if got, ok := devices["hall/temp"]["mapper_data"]; !ok || got != nil {
+			t.Errorf("cookie %q: mapper_data %v", cookie, got)
+		}
+	}
+	if status, _ := getDevices(t, app, "/api/v1/all-devices?include=mapper_data", ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("include without a session: status %d", status)
+	}
+	if status, _ := getDevices(t, app, "/api/v1/all-devices?include=mapper_data", "nope"); status != fiber.StatusUnauthorized {
+		t.Fatalf("include with an unknown session: status %d", status)
+	}
+	_, devices := getDevices(t, app, "/api/v1/all-devices?include=mapper_data&fields=id,mapper_data", "s1")
+	if got, _ := devices["lab/relay"]["mapper_data"].(map[string]any); got["topic"] != "zigbee2mqtt/relay" {
+		t.Errorf("logged in with include: %v", devices["lab/relay"])
+	}
+
+	// The deprecated flag serves it to everyone.
+	GetConfig().Web.AllDevicesMapperData = true
+	_, devices = getDevices(t, app, "/api/v1/all-devices", "")
+	if got, _ := devices["hall/temp"]["mapper_data"].(map[string]any); got["ieee"] != "0x00158d0001" {
+		t.Errorf("all_devices_mapper_data: %v", devices["hall/temp"])
+	}
+}
+
+func TestHandleDeleteDevice(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	// Not listening to vdevManager, so that only the states below are recorded.
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	// hall/temp reports live; lab/relay was only restored from the history.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "hall/temp", State: 22.0}})
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "lab/relay", Type: VdevTypeRelay, State: "OFF", LastUpdatedAt: time.Now().Add(-time.Hour)}})
+	recordStates(t, vdevHistoryRepo, "hall/temp", VdevTypeTemperature, 0, "21", "22")
+	recordStates(t, vdevHistoryRepo, "lab/relay", VdevTypeRelay, 0, `"ON"`, `"OFF"`)
+	recordStates(t, vdevHistoryRepo, "old/co2", VdevTypeCO2, 0, "800", "900", "1000")
+	var removed []string
+	vdevManager.OnVirtualDeviceRemoved = append(vdevManager.OnVirtualDeviceRemoved, func(v *VirtualDevice) {
+		removed = append(removed, v.ID)
+	})
+
+	app := fiber.New()
+	app.Delete("/api/v1/admin/device/+", handleDeleteDevice)
+	del := func(target string) (int, deviceDeletionResponse) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodDelete, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body deviceDeletionResponse
+		if resp.StatusCode == fiber.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, body
+	}
+	statesOf := func(device string) int64 {
+		var n int64
+		gormDB.Model(&VirtualDeviceStateModel{}).Joins("VirtualDevice").Where("VirtualDevice.name = ?", device).Count(&n)
+		return n
+	}
+
+	if status, _ := del("/api/v1/admin/device/hall/temp?purge_history=true"); status != fiber.StatusConflict {
+		t.Fatalf("deleting a device reporting live: status %d, want 409", status)
+	}
+	if vdevManager.Device("hall/temp") == nil || statesOf("hall/temp") != 2 {
+		t.Fatal("refused deletion changed something")
+	}
+	status, got := del("/api/v1/admin/device/hall/temp?purge_history=true&force=true")
+	want := deviceDeletionResponse{DeviceID: "hall/temp", Removed: true, DeviceDeletion: DeviceDeletion{RecordDeleted: true, StatesDeleted: 2}}
+	if status != fiber.StatusOK || got != want {
+		t.Errorf("forced: %d %+v, want %+v", status, got, want)
+	}
+
+	// Without purge_history the record stays with the history.
+	status, got = del("/api/v1/admin/device/lab/relay")
+	want = deviceDeletionResponse{DeviceID: "lab/relay", Removed: true}
+	if status != fiber.StatusOK || got != want {
+		t.Errorf("lab/relay: %d %+v, want %+v", status, got, want)
+	}
+	if statesOf("lab/relay") != 2 {
+		t.Errorf("lab/relay history purged without purge_history")
+	}
+
+	// A device that is only recorded, not in the list.
+	status, got = del("/api/v1/admin/device/old/co2?purge_history=true")
+	want = deviceDeletionResponse{DeviceID: "old/co2", DeviceDeletion: DeviceDeletion{RecordDeleted: true, StatesDeleted: 3}}
+	if status != fiber.StatusOK || got != want {
+		t.Errorf("old/co2: %d %+v, want %+v", status, got, want)
+	}
+
+	if status, _ := del("/api/v1/admin/device/old/co2"); status != fiber.StatusNotFound {
+		t.Errorf("deleting again: status %d, want 404", status)
+	}
+	if want := []string{"hall/temp", "lab/relay"}; !slices.Equal(removed, want) {
+		t.Errorf("removal callbacks for %v, want %v", removed, want)
+	}
+	var ids []string
+	for _, dev := range vdevManager.Devices() {
+		ids = append(ids, dev.ID)
+	}
+	if want := []string{"frigate/person/hall"}; !slices.Equal(ids, want) {
+		t.Errorf("devices left %v, want %v", ids, want)
+	}
+}
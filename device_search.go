@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// deviceSearchMinQuery is the shortest query searched for, in letters
+	// and digits.
+	deviceSearchMinQuery = 2
+	// defaultDeviceSearchLimit and maxDeviceSearchLimit bound ?limit=.
+	defaultDeviceSearchLimit = 20
+	maxDeviceSearchLimit     = 100
+)
+
+// Scores of a device search match, by how the query matched a field. The
+// field's weight is added, so an exact ID match ranks above an exact name.
+const (
+	searchScoreExact     = 100
+	searchScorePrefix    = 75
+	searchScoreSubstring = 50
+	// searchScoreTokens is for every query word starting a word of some
+	// field, e.g. "temp lab" for "lab/temperature".
+	searchScoreTokens = 25
+)
+
+// deviceSearchFields are the fields a device is searched by, most
+// significant first, with their weights.
+var deviceSearchFields = []deviceSearchField{{"id", 3}, {"name", 2}, {"room", 1}, {"type", 0}}
+
+type deviceSearchField struct {
+	name   string
+	weight int
+}
+
+// DeviceSearchResult is a device found by GET /api/v1/devices/search.
+type DeviceSearchResult struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Name is the entity's name in the request's language, else the
+	// device's alias; empty when there is neither.
+	Name string `json:"name,omitempty"`
+	Room string `json:"room,omitempty"`
+	// Matched are the fields the query matched: id, name, room or type.
+	Matched []string `json:"matched"`
+	Score   int      `json:"score"`
+}
+
+// searchTokens splits s into words on anything but letters and digits,
+// folded by NormalizeName: "Łazienka/Temp" is ["lazienka", "temp"].
+func searchTokens(s string) []string {
+	var tokens []string
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if token := NormalizeName(word); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// searchText is a searched value split into words.
+type searchText struct {
+	tokens []string
+	// joined are the tokens separated by spaces, for substring matches.
+	joined string
+}
+
+func newSearchText(v string) searchText {
+	tokens := searchTokens(v)
+	return searchText{tokens: tokens, joined: strings.Join(tokens, " ")}
+}
+
+// searchTexts are the values of one field, e.g. a name in every language.
+type searchTexts []searchText
+
+func newSearchTexts(values ...string) searchTexts {
+	texts := make(searchTexts, 0, len(values))
+	for _, v := range values {
+		texts = append(texts, newSearchText(v))
+	}
+	return texts
+}
+
+// match is the best match of the query among the values.
+func (ts searchTexts) match(q searchText) int {
+	score := 0
+	for _, t := range ts {
+		score = max(score, t.match(q))
+	}
+	return score
+}
+
+// hasToken reports whether token starts a word of one of the values.
+func (ts searchTexts) hasToken(token string) bool {
+	return slices.ContainsFunc(ts, func(t searchText) bool { return t.hasTokens([]string{token}) })
+}
+
+// match scores how the query matches the text, 0 when it doesn't.
+func (t searchText) match(q searchText) int {
+	switch {
+	case t.joined == "":
+		return 0
+	case t.joined == q.joined:
+		return searchScoreExact
+	case strings.HasPrefix(t.joined, q.joined):
+		return searchScorePrefix
+	case strings.Contains(t.joined, q.joined):
+		return searchScoreSubstring
+	case t.hasTokens(q.tokens):
+		return searchScoreTokens
+	}
+	return 0
+}
+
+// hasTokens reports whether every query token starts a token of t.
+func (t searchText) hasTokens(tokens []string) bool {
+	for _, q := range tokens {
+		if !slices.ContainsFunc(t.tokens, func(token string) bool { return strings.HasPrefix(token, q) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchDevices ranks the devices matching query by how well they match:
+// exact over prefix over substring over word matches, then by field (ID,
+// name, room, type), then by ID. Names and room names match in every
+// language, aliases as names; name in the results is in lang. Query words may also match
+// across fields, e.g. "temperature laser" for a thermometer in the laser
+// room, which ranks below matches within one field.
+func searchDevices(cfg *Config, devices []*VirtualDevice, query, lang string, limit int) []DeviceSearchResult {
+	q := newSearchText(query)
+	names := entityNames(cfg)
+	roomNames := map[string]LocalizedString{}
+	for _, room := range cfg.Rooms {
+		roomNames[room.ID] = room.LocalizedName
+	}
+	rooms := deviceRooms(cfg)
+
+	results := []DeviceSearchResult{}
+	for _, dev := range devices {
+		if dev == nil {
+			continue
+		}
+		room := deviceRoom(rooms, dev.ID)
+		nameValues := slices.Collect(maps.Values(names[dev.ID]))
+		if alias, ok := deviceAliases.Get(dev.ID); ok {
+			nameValues = append(nameValues, alias.Name)
+		}
+		texts := map[string]searchTexts{
+			"id":   newSearchTexts(dev.ID),
+			"name": newSearchTexts(nameValues...),
+			"room": newSearchTexts(append(slices.Collect(maps.Values(roomNames[room])), room)...),
+			"type": newSearchTexts(string(dev.Type)),
+		}
+		r := DeviceSearchResult{ID: dev.ID, Type: string(dev.Type), Name: deviceName(names[dev.ID], dev.ID, lang), Room: room, Matched: []string{}}
+		for _, f := range deviceSearchFields {
+			score := texts[f.name].match(q)
+			if score == 0 {
+				continue
+			}
+			r.Matched = append(r.Matched, f.name)
+			r.Score = max(r.Score, score+f.weight)
+		}
+		if r.Score == 0 {
+			// Every word has to match some field.
+			matches := func(f deviceSearchField, token string) bool { return texts[f.name].hasToken(token) }
+			unmatched := func(token string) bool {
+				return !slices.ContainsFunc(deviceSearchFields, func(f deviceSearchField) bool { return matches(f, token) })
+			}
+			if slices.ContainsFunc(q.tokens, unmatched) {
+				continue
+			}
+			for _, f := range deviceSearchFields {
+				if slices.ContainsFunc(q.tokens, func(token string) bool { return matches(f, token) }) {
+					r.Matched = append(r.Matched, f.name)
+				}
+			}
+			r.Score = searchScoreTokens
+		}
+		results = append(results, r)
+	}
+	slices.SortFunc(results, func(a, b DeviceSearchResult) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), strings.Compare(a.ID, b.ID))
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// handleDeviceSearch serves the devices matching ?q=, best first, at most
+// ?limit= of them, with names in the language picked by ?lang= or
+// Accept-Language.
+func handleDeviceSearch(c *fiber.Ctx) error {
+	query := c.Query("q")
+	if utf8.RuneCountInString(strings.Join(searchTokens(query), "")) < deviceSearchMinQuery {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("q needs at least %d letters or digits", deviceSearchMinQuery)})
+	}
+	limit := defaultDeviceSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be a positive number"})
+		}
+		limit = min(n, maxDeviceSearchLimit)
+	}
+	cfg := GetConfig()
+	lang := requestLocale(c, configLocales(cfg))
+	c.Vary(fiber.HeaderAcceptLanguage)
+	return c.JSON(searchDevices(cfg, vdevManager.Devices(), query, lang, limit))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// searchTestConfig has a laser room and a bathroom with Polish names.
+var searchTestConfig = &Config{Rooms: []RoomConfig{
+	{ID: "laser", LocalizedName: LocalizedString{"pl": "Laserownia", "en": "Laser room"}, Entities: []EntityConfig{
+		{ID: "laser/temperature", LocalizedName: LocalizedString{"pl": "Temperatura", "en": "Temperature"}},
+		{ID: "laser/fan", LocalizedName: LocalizedString{"pl": "Wyciąg", "en": "Exhaust fan"}},
+	}},
+	{ID: "bathroom", LocalizedName: LocalizedString{"pl": "Łazienka"}, Entities: []EntityConfig{
+		{ID: "bathroom/light", LocalizedName: LocalizedString{"pl": "Światło przy lustrze"}},
+		{ID: "laser", LocalizedName: LocalizedString{"pl": "Zraszacz"}},
+	}},
+}}
+
+var searchTestDevices = []*VirtualDevice{
+	{ID: "laser/temperature", Type: VdevTypeTemperature},
+	{ID: "laser/fan", Type: VdevTypeRelay},
+	{ID: "bathroom/light", Type: VdevTypeRelay},
+	// Named "laser" but in the bathroom: an exact ID match.
+	{ID: "laser", Type: VdevTypeRelay},
+	{ID: "hall/co2", Type: VdevTypeCO2},
+}
+
+func searchIDs(results []DeviceSearchResult) []string {
+	ids := []string{}
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestSearchDevices(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		// The exact ID first, then the devices in the room of that ID.
+		{"laser", []string{"laser", "laser/fan", "laser/temperature"}},
+		// Diacritics and case are folded, in names and queries alike.
+		{"łazienka", []string{"bathroom/light", "laser"}},
+		{"LAZIENKA", []string{"bathroom/light", "laser"}},
+		{"swiatlo", []string{"bathroom/light"}},
+		{"Światło", []string{"bathroom/light"}},
+		{"wyciag", []string{"laser/fan"}},
+		// Name substrings, in any language.
+		{"aust", []string{"laser/fan"}},
+		{"owni", []string{"laser/fan", "laser/temperature"}},
+		// Partial words, in any order and across fields.
+		{"lus świat", []string{"bathroom/light"}},
+		{"temp laser", []string{"laser/temperature"}},
+		{"relay łaz", []string{"bathroom/light", "laser"}},
+		{"co2", []string{"hall/co2"}},
+		{"hall/co", []string{"hall/co2"}},
+		{"garage", []string{}},
+	} {
+		results := searchDevices(searchTestConfig, searchTestDevices, tc.query, "pl", 10)
+		if got := searchIDs(results); !slices.Equal(got, tc.want) {
+			t.Errorf("%q: %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestSearchDevices_Ranking(t *testing.T) {
+	results := searchDevices(searchTestConfig, searchTestDevices, "laser", "en", 10)
+	want := []struct {
+		id      string
+		matched []string
+		score   int
+	}{
+		{"laser", []string{"id"}, searchScoreExact + 3},
+		// Exactly in the room named "laser", which beats the ID prefix.
+		{"laser/fan", []string{"id", "room"}, searchScoreExact + 1},
+		{"laser/temperature", []string{"id", "room"}, searchScoreExact + 1},
+	}
+	for i, w := range want {
+		if r := results[i]; r.ID != w.id || !slices.Equal(r.Matched, w.matched) || r.Score != w.score {
+			t.Errorf("result %d: %+v, want %+v", i, r, w)
+		}
+	}
+
+	// An exact ID ranks above a name containing the query.
+	cfg := &Config{Rooms: []RoomConfig{{ID: "hall", Entities: []EntityConfig{
+		{ID: "hall/lamp", LocalizedName: LocalizedString{"en": "Lamp by the fan"}},
+		{ID: "fan"},
+	}}}}
+	results = searchDevices(cfg, []*VirtualDevice{{ID: "hall/lamp"}, {ID: "fan"}}, "fan", "en", 10)
+	if got := searchIDs(results); !slices.Equal(got, []string{"fan", "hall/lamp"}) || results[1].Matched[0] != "name" {
+		t.Fatalf("results %+v", results)
+	}
+	if results[0].Score <= results[1].Score {
+		t.Fatalf("scores %d, %d", results[0].Score, results[1].Score)
+	}
+
+	// Cross-field word matches list every field a word matched.
+	results = searchDevices(searchTestConfig, searchTestDevices, "temperature laserownia", "en", 10)
+	if len(results) != 1 || !slices.Equal(results[0].Matched, []string{"id", "name", "room", "type"}) || results[0].Score != searchScoreTokens {
+		t.Fatalf("cross-field %+v", results)
+	}
+	if results[0].Name != "Temperature" || results[0].Room != "laser" {
+		t.Errorf("name %q, room %q", results[0].Name, results[0].Room)
+	}
+}
+
+func TestSearchDevices_Limit(t *testing.T) {
+	results := searchDevices(searchTestConfig, searchTestDevices, "laser", "pl", 2)
+	if got := searchIDs(results); !slices.Equal(got, []string{"laser", "laser/fan"}) {
+		t.Fatalf("limited to %v", got)
+	}
+}
+
+func TestHandleDeviceSearch(t *testing.T) {
+	setupLiveWsTest(t)
+	setConfig(searchTestConfig)
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices(searchTestDevices)
+	app := fiber.New()
+	app.Get("/api/v1/devices/search", handleDeviceSearch)
+
+	get := func(target string) (int, []DeviceSearchResult) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []DeviceSearchResult
+		if resp.StatusCode == fiber.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, results
+	}
+
+	for _, target := range []string{"/api/v1/devices/search", "/api/v1/devices/search?q=l", "/api/v1/devices/search?q=%20/-", "/api/v1/devices/search?q=fan&limit=0", "/api/v1/devices/search?q=fan&limit=x"} {
+		if status, _ := get(target); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d", target, status)
+		}
+	}
+	status, results := get("/api/v1/devices/search?q=wyci%C4%85g&lang=en")
+	if status != fiber.StatusOK || len(results) != 1 || results[0].ID != "laser/fan" || results[0].Name != "Exhaust fan" || !slices.Equal(results[0].Matched, []string{"name"}) {
+		t.Fatalf("wyciąg: %d %+v", status, results)
+	}
+	if _, results := get("/api/v1/devices/search?q=laser&limit=1"); len(results) != 1 || results[0].ID != "laser" {
+		t.Fatalf("limit=1: %+v", results)
+	}
+	if _, results := get("/api/v1/devices/search?q=garage"); results == nil || len(results) != 0 {
+		t.Fatalf("no match: %+v", results)
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -23,6 +23,7 @@ type DhcpService struct {
 	cfg *DhcpConfig
 	db  *gorm.DB
 	oui *OuiDB
+	log *slog.Logger
 
 	leaseSource  DhcpLeaseSource
 	wiredSources []WiredPortSource
@@ -49,7 +50,7 @@ type DhcpService struct {
 }
 
 // NewDhcpService wires up sources, the OUI database and parsed access CIDRs.
-func NewDhcpService(cfg *Config, db *gorm.DB) (*DhcpService, error) {
+func NewDhcpService(cfg *Config, db *gorm.DB, logger *slog.Logger) (*DhcpService, error) {
 	dcfg := cfg.Dhcp
 
 	leaseSource, err := NewDhcpLeaseSource(dcfg.Router)
@@ -84,6 +85,7 @@ func NewDhcpService(cfg *Config, db *gorm.DB) (*DhcpService, error) {
 		cfg:              dcfg,
 		db:               db,
 		oui:              oui,
+		log:              logger,
 		leaseSource:      leaseSource,
 		wiredSources:     wiredSources,
 		wifiSources:      wifiSources,
@@ -127,13 +129,13 @@ func (s *DhcpService) scrapeOnce() {
 
 	leases, err := s.leaseSource.FetchLeases(ctx)
 	if err != nil {
-		log.Printf("[dhcp] lease scrape failed: %v", err)
+		s.log.Warn("lease scrape failed", "err", err)
 		s.mu.Lock()
 		s.lastScrapeErr = err.Error()
 		s.mu.Unlock()
 	} else {
 		if err := s.updateLeases(leases); err != nil {
-			log.Printf("[dhcp] persisting leases failed: %v", err)
+			s.log.Warn("persisting leases failed", "err", err)
 			s.mu.Lock()
 			s.lastScrapeErr = err.Error()
 			s.mu.Unlock()
@@ -150,13 +152,13 @@ func (s *DhcpService) scrapeOnce() {
 	for _, src := range s.wiredSources {
 		hosts, err := src.FetchHosts(ctx)
 		if err != nil {
-			log.Printf("[dhcp] wired source %q failed: %v", src.Name(), err)
+			s.log.Warn("wired source failed", "source", src.Name(), "err", err)
 			continue
 		}
 		for mac, info := range hosts {
 			if existing, dup := wired[mac]; dup {
-				log.Printf("[dhcp] MAC %s seen on both %s:%s and %s:%s; using latter",
-					mac, existing.SwitchName, existing.Port, info.SwitchName, info.Port)
+				s.log.Warn("MAC seen on two switch ports, using the latter", "mac", mac,
+					"first", existing.SwitchName+":"+existing.Port, "latter", info.SwitchName+":"+info.Port)
 			}
 			wired[mac] = info
 		}
@@ -167,7 +169,7 @@ func (s *DhcpService) scrapeOnce() {
 	for _, src := range s.wifiSources {
 		clients, err := src.FetchClients(ctx)
 		if err != nil {
-			log.Printf("[dhcp] wifi source %q failed: %v", src.Name(), err)
+			s.log.Warn("wifi source failed", "source", src.Name(), "err", err)
 			continue
 		}
 		wifiOK = true
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// energyMaxSampleGap is how long a power reading is taken to last when
+	// no newer one follows; beyond it the device is assumed offline and
+	// nothing is counted.
+	energyMaxSampleGap = 15 * time.Minute
+	// maxEnergyCostBuckets bounds the buckets of one /api/v1/energy-cost
+	// response.
+	maxEnergyCostBuckets = 2000
+)
+
+// Bucket sizes of /api/v1/energy-cost.
+const (
+	energyBucketHour = "hour"
+	energyBucketDay  = "day"
+)
+
+// EnergyConfig prices the electricity measured by power_usage devices for
+// GET /api/v1/energy-cost. When nil the endpoint returns 503.
+type EnergyConfig struct {
+	// Timezone is the IANA zone the tariff bands and day buckets are in,
+	// e.g. "Europe/Warsaw". Default the server's local time.
+	Timezone string        `yaml:"timezone"`
+	Tariff   *TariffConfig `yaml:"tariff"`
+}
+
+// TariffConfig is the price of a kWh: a flat Rate, or Bands by time of day.
+type TariffConfig struct {
+	// Currency is shown with the costs, e.g. "PLN".
+	Currency string `yaml:"currency"`
+	// Rate is the price of a kWh at any time. Not used with Bands.
+	Rate float64 `yaml:"rate"`
+	// Bands must cover the whole day without overlapping.
+	Bands []TariffBandConfig `yaml:"bands"`
+}
+
+// TariffBandConfig is the price of a kWh from Start until End, both "HH:MM"
+// wall-clock times. An End before Start wraps past midnight; "24:00" ends
+// at midnight.
+type TariffBandConfig struct {
+	Start string  `yaml:"start"`
+	End   string  `yaml:"end"`
+	Rate  float64 `yaml:"rate"`
+}
+
+// parseTariffClock parses "HH:MM" into minutes after midnight, 0 to 1440.
+func parseTariffClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("%q is not an HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// tariffBand is a parsed TariffBandConfig in minutes after midnight, end
+// exclusive and possibly below start.
+type tariffBand struct {
+	start, end int
+	rate       float64
+}
+
+func (b tariffBand) contains(minute int) bool {
+	if b.start < b.end {
+		return minute >= b.start && minute < b.end
+	}
+	return minute >= b.start || minute < b.end
+}
+
+// tariff prices energy by the wall-clock time it was used at.
+type tariff struct {
+	currency string
+	loc      *time.Location
+	// bands is nil for a flat rate; otherwise sorted by start.
+	bands []tariffBand
+	rate  float64
+}
+
+// newTariff parses the tariff of cfg, checking that the bands cover the
+// whole day exactly once.
+func newTariff(cfg *EnergyConfig) (*tariff, error) {
+	if cfg.Tariff == nil {
+		return nil, errors.New("tariff is missing")
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone is unknown (%q)", cfg.Timezone)
+	}
+	tc := cfg.Tariff
+	if tc.Currency == "" {
+		return nil, errors.New("tariff.currency is required")
+	}
+	t := &tariff{currency: tc.Currency, loc: loc, rate: tc.Rate}
+	if len(tc.Bands) == 0 {
+		if tc.Rate < 0 {
+			return nil, errors.New("tariff.rate must not be negative")
+		}
+		return t, nil
+	}
+	if tc.Rate != 0 {
+		return nil, errors.New("tariff.rate and tariff.bands are exclusive")
+	}
+
+	var covered [24 * 60]int
+	for i, bc := range tc.Bands {
+		start, err := parseTariffClock(bc.Start)
+		if err != nil || start == 24*60 {
+			return nil, fmt.Errorf("tariff.bands[%d].start %q is not an HH:MM time", i, bc.Start)
+		}
+		end, err := parseTariffClock(bc.End)
+		if err != nil {
+			return nil, fmt.Errorf("tariff.bands[%d].end %q is not an HH:MM time", i, bc.End)
+		}
+		if end == 24*60 {
+			end = 0
+		}
+		if start == end {
+			return nil, fmt.Errorf("tariff.bands[%d] is empty; use tariff.rate for a flat rate", i)
+		}
+		if bc.Rate < 0 {
+			return nil, fmt.Errorf("tariff.bands[%d].rate must not be negative", i)
+		}
+		b := tariffBand{start: start, end: end, rate: bc.Rate}
+		for m := range covered {
+			if b.contains(m) {
+				covered[m]++
+			}
+		}
+		t.bands = append(t.bands, b)
+	}
+	for m, n := range covered {
+		if n == 0 {
+			return nil, fmt.Errorf("tariff.bands don't cover %02d:%02d", m/60, m%60)
+		}
+		if n > 1 {
+			return nil, fmt.Errorf("tariff.bands overlap at %02d:%02d", m/60, m%60)
+		}
+	}
+	slices.SortFunc(t.bands, func(a, b tariffBand) int { return a.start - b.start })
+	return t, nil
+}
+
+// rateAt returns the price of a kWh used at the given instant.
+func (t *tariff) rateAt(at time.Time) float64 {
+	local := at.In(t.loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, b := range t.bands {
+		if b.contains(minute) {
+			return b.rate
+		}
+	}
+	return t.rate
+}
+
+// nextBoundary returns the first instant after at where the rate may
+// change: a band start, or a UTC offset change, which moves the wall clock
+// past band starts that don't exist that day.
+func (t *tariff) nextBoundary(at time.Time) time.Time {
+	local := at.In(t.loc)
+	next := time.Time{}
+	if _, end := local.ZoneBounds(); !end.IsZero() {
+		next = end
+	}
+	for day := 0; day <= 1; day++ {
+		for _, b := range t.bands {
+			bt := time.Date(local.Year(), local.Month(), local.Day()+day, b.start/60, b.start%60, 0, 0, t.loc)
+			if bt.After(at) {
+				if next.IsZero() || bt.Before(next) {
+					next = bt
+				}
+				return next
+			}
+		}
+	}
+	return next
+}
+
+// split calls fn for the parts of [from, to) in which the rate doesn't
+// change, with that rate.
+func (t *tariff) split(from, to time.Time, fn func(from, to time.Time, rate float64)) {
+	for from.Before(to) {
+		end := to
+		if t.bands != nil {
+			if next := t.nextBoundary(from); !next.IsZero() && next.Before(to) {
+				end = next
+			}
+		}
+		fn(from, end, t.rateAt(from))
+		from = end
+	}
+}
+
+// powerSegment is a power reading held from one sample until the next.
+type powerSegment struct {
+	From, To time.Time
+	Watts    float64
+}
+
+// powerSegments turns power_usage samples, oldest first, into the segments
+// within [from, to). A sample lasts until the next one, but no longer than
+// energyMaxSampleGap. Samples that aren't numbers break the series.
+func powerSegments(history []VirtualDeviceStateModel, from, to time.Time) []powerSegment {
+	var segments []powerSegment
+	for i, h := range history {
+		var state any
+		if err := json.Unmarshal([]byte(h.State), &state); err != nil {
+			continue
+		}
+		watts, ok := toFloat64Internal(state)
+		if !ok {
+			continue
+		}
+		start := time.UnixMilli(h.Timestamp)
+		end := start.Add(energyMaxSampleGap)
+		if i+1 < len(history) {
+			end = minTime(end, time.UnixMilli(history[i+1].Timestamp))
+		}
+		start, end = maxTime(start, from), minTime(end, to)
+		if start.Before(end) {
+			segments = append(segments, powerSegment{From: start, To: end, Watts: watts})
+		}
+	}
+	return segments
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// EnergyCostBucket is the energy used and what it cost within one bucket
+// of /api/v1/energy-cost.
+type EnergyCostBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	KWh   float64   `json:"kwh"`
+	Cost  float64   `json:"cost"`
+}
+
+// EnergyCost is served by GET /api/v1/energy-cost.
+type EnergyCost struct {
+	DeviceID  string             `json:"device_id"`
+	Currency  string             `json:"currency"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Buckets   []EnergyCostBucket `json:"buckets"`
+	TotalKWh  float64            `json:"total_kwh"`
+	TotalCost float64            `json:"total_cost"`
+}
+
+// energyBuckets divides [from, to) into hours or local days; the first and
+// last bucket are cut at from and to.
+func energyBuckets(from, to time.Time, size string, loc *time.Location) []EnergyCostBucket {
+	var buckets []EnergyCostBucket
+	for start := from; start.Before(to); {
+		var end time.Time
+		if size == energyBucketHour {
+			end = start.Truncate(time.Hour).Add(time.Hour)
+		} else {
+			local := start.In(loc)
+			end = time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+		}
+		end = minTime(end, to)
+		buckets = append(buckets, EnergyCostBucket{Start: start, End: end})
+		start = end
+	}
+	return buckets
+}
+
+// energyCost prices the power segments into the buckets, both sorted.
+func energyCost(t *tariff, segments []powerSegment, buckets []EnergyCostBucket) (totalKWh, totalCost float64) {
+	i := 0
+	for _, s := range segments {
+		for i < len(buckets) && !buckets[i].End.After(s.From) {
+			i++
+		}
+		for j := i; j < len(buckets) && buckets[j].Start.Before(s.To); j++ {
+			b := &buckets[j]
+			t.split(maxTime(s.From, b.Start), minTime(s.To, b.End), func(from, to time.Time, rate float64) {
+				kwh := s.Watts * to.Sub(from).Hours() / 1000
+				b.KWh += kwh
+				b.Cost += kwh * rate
+			})
+		}
+	}
+	for _, b := range buckets {
+		totalKWh += b.KWh
+		totalCost += b.Cost
+	}
+	return totalKWh, totalCost
+}
+
+// validateEnergyConfig checks the tariff when the energy section is set.
+func validateEnergyConfig(cfg *Config, cfgPath string) error {
+	if cfg.Energy == nil {
+		return nil
+	}
+	if _, err := newTariff(cfg.Energy); err != nil {
+		return fmt.Errorf("energy.%v in %s", err, cfgPath)
+	}
+	return nil
+}
+
+// handleEnergyCost serves the energy a power_usage device used between
+// ?from= and ?to= (RFC 3339) and its cost under energy.tariff, per ?bucket=
+// (day, the default, or hour) and in total.
+func handleEnergyCost(c *fiber.Ctx) error {
+	cfg := GetConfig()
+	if cfg.Energy == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "energy tariff not configured"})
+	}
+	if vdevHistoryRepo == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "device history not available"})
+	}
+	t, err := newTariff(cfg.Energy)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	deviceID := c.Query("deviceId")
+	if deviceID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "deviceId is required"})
+	}
+	dev := vdevManager.Device(deviceID)
+	if dev == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "device not found"})
+	}
+	if dev.Type != VdevTypePowerUsage {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("device is %s, not %s", dev.Type, VdevTypePowerUsage)})
+	}
+	from, errFrom := time.Parse(time.RFC3339, c.Query("from"))
+	to, errTo := time.Parse(time.RFC3339, c.Query("to"))
+	if errFrom != nil || errTo != nil || !to.After(from) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from and to must be RFC 3339 times, from before to"})
+	}
+	size := c.Query("bucket", energyBucketDay)
+	if size != energyBucketDay && size != energyBucketHour {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("bucket must be %s or %s", energyBucketDay, energyBucketHour)})
+	}
+	buckets := energyBuckets(from, to, size, t.loc)
+	if len(buckets) > maxEnergyCostBuckets {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("the range has more than %d buckets", maxEnergyCostBuckets)})
+	}
+
+	// A reading shortly before from still counts within the range.
+	history, err := vdevHistoryRepo.GetDevicesHistoryInRange([]string{deviceID}, from.Add(-energyMaxSampleGap).UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	totalKWh, totalCost := energyCost(t, powerSegments(history, from, to), buckets)
+	return c.JSON(EnergyCost{
+		DeviceID:  deviceID,
+		Currency:  t.currency,
+		From:      from,
+		To:        to,
+		Buckets:   buckets,
+		TotalKWh:  totalKWh,
+		TotalCost: totalCost,
+	})
+}
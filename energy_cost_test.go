@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// dayNightTariff is 0.5 a kWh from 22:00 to 06:00 and 1.0 otherwise.
+func dayNightTariff(t *testing.T) *tariff {
+	t.Helper()
+	tr, err := newTariff(&EnergyConfig{Timezone: "Europe/Warsaw", Tariff: &TariffConfig{
+		Currency: "PLN",
+		Bands: []TariffBandConfig{
+			{Start: "06:00", End: "22:00", Rate: 1},
+			{Start: "22:00", End: "06:00", Rate: 0.5},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestNewTariff_Validation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		tariff *TariffConfig
+		err    string
+	}{
+		{"missing", nil, "tariff is missing"},
+		{"currency", &TariffConfig{Rate: 1}, "currency is required"},
+		{"negative rate", &TariffConfig{Currency: "PLN", Rate: -1}, "must not be negative"},
+		{"rate and bands", &TariffConfig{Currency: "PLN", Rate: 1, Bands: []TariffBandConfig{{Start: "00:00", End: "24:00", Rate: 1}}}, "exclusive"},
+		{"bad clock", &TariffConfig{Currency: "PLN", Bands: []TariffBandConfig{{Start: "6:00", End: "25:00", Rate: 1}}}, "bands[0].end"},
+		{"empty band", &TariffConfig{Currency: "PLN", Bands: []TariffBandConfig{{Start: "06:00", End: "06:00", Rate: 1}}}, "bands[0] is empty"},
+		{"gap", &TariffConfig{Currency: "PLN", Bands: []TariffBandConfig{
+			{Start: "06:00", End: "22:00", Rate: 1},
+			{Start: "22:30", End: "06:00", Rate: 0.5},
+		}}, "don't cover 22:00"},
+		{"overlap across midnight", &TariffConfig{Currency: "PLN", Bands: []TariffBandConfig{
+			{Start: "05:00", End: "22:00", Rate: 1},
+			{Start: "22:00", End: "06:00", Rate: 0.5},
+		}}, "overlap at 05:00"},
+	} {
+		_, err := newTariff(&EnergyConfig{Tariff: tc.tariff})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+	if _, err := newTariff(&EnergyConfig{Timezone: "Mars/Olympus", Tariff: &TariffConfig{Currency: "PLN", Rate: 1}}); err == nil {
+		t.Error("unknown timezone accepted")
+	}
+	// A whole day from midnight to midnight.
+	if _, err := newTariff(&EnergyConfig{Tariff: &TariffConfig{Currency: "PLN", Bands: []TariffBandConfig{
+		{Start: "00:00", End: "12:00", Rate: 1},
+		{Start: "12:00", End: "24:00", Rate: 2},
+	}}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTariffSplit_AcrossMidnight(t *testing.T) {
+	tr := dayNightTariff(t)
+	type part struct {
+		from, to string
+		rate     float64
+	}
+	var got []part
+	from := time.Date(2026, 1, 10, 20, 0, 0, 0, tr.loc)
+	tr.split(from, from.Add(12*time.Hour), func(from, to time.Time, rate float64) {
+		got = append(got, part{from.Format("02 15:04"), to.Format("02 15:04"), rate})
+	})
+	want := []part{{"10 20:00", "10 22:00", 1}, {"10 22:00", "11 06:00", 0.5}, {"11 06:00", "11 08:00", 1}}
+	if len(got) != len(want) {
+		t.Fatalf("parts %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("part %d: %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// TestEnergyCost_DSTDays runs 1 kW through whole local days on which the
+// clocks change.
+func TestEnergyCost_DSTDays(t *testing.T) {
+	tr := dayNightTariff(t)
+	for _, tc := range []struct {
+		name      string
+		day       time.Time
+		kwh, cost float64
+	}{
+		// 23 hours, one of them in the night band: 7 night and 16 day.
+		{"spring forward", time.Date(2026, 3, 29, 0, 0, 0, 0, tr.loc), 23, 7*0.5 + 16},
+		// 25 hours: 9 night and 16 day.
+		{"fall back", time.Date(2026, 10, 25, 0, 0, 0, 0, tr.loc), 25, 9*0.5 + 16},
+		{"ordinary", time.Date(2026, 6, 1, 0, 0, 0, 0, tr.loc), 24, 8*0.5 + 16},
+	} {
+		end := tc.day.AddDate(0, 0, 1)
+		buckets := energyBuckets(tc.day, end, energyBucketDay, tr.loc)
+		if len(buckets) != 1 {
+			t.Fatalf("%s: %d day buckets", tc.name, len(buckets))
+		}
+		kwh, cost := energyCost(tr, []powerSegment{{From: tc.day, To: end, Watts: 1000}}, buckets)
+		if !approxEqual(kwh, tc.kwh) || !approxEqual(cost, tc.cost) {
+			t.Errorf("%s: %v kWh for %v, want %v kWh for %v", tc.name, kwh, cost, tc.kwh, tc.cost)
+		}
+		if hours := energyBuckets(tc.day, end, energyBucketHour, tr.loc); len(hours) != int(tc.kwh) {
+			t.Errorf("%s: %d hour buckets", tc.name, len(hours))
+		}
+	}
+}
+
+// A band starting in the hour skipped in spring starts when the clocks jump
+// past it.
+func TestEnergyCost_BandStartInSkippedHour(t *testing.T) {
+	tr, err := newTariff(&EnergyConfig{Timezone: "Europe/Warsaw", Tariff: &TariffConfig{
+		Currency: "PLN",
+		Bands: []TariffBandConfig{
+			{Start: "00:00", End: "02:30", Rate: 1},
+			{Start: "02:30", End: "24:00", Rate: 2},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 29, 0, 0, 0, 0, tr.loc)
+	end := day.AddDate(0, 0, 1)
+	// 00:00 to 02:00 at 1, then 03:00 to midnight at 2.
+	if kwh, cost := energyCost(tr, []powerSegment{{From: day, To: end, Watts: 1000}}, energyBuckets(day, end, energyBucketDay, tr.loc)); !approxEqual(kwh, 23) || !approxEqual(cost, 2+21*2) {
+		t.Errorf("%v kWh for %v", kwh, cost)
+	}
+}
+
+func TestPowerSegments(t *testing.T) {
+	from := time.UnixMilli(1_000_000_000)
+	at := func(d time.Duration) int64 { return from.Add(d).UnixMilli() }
+	history := []VirtualDeviceStateModel{
+		{Timestamp: at(-5 * time.Minute), State: "100"},
+		{Timestamp: at(10 * time.Minute), State: "200"},
+		// Offline: the reading lasts energyMaxSampleGap.
+		{Timestamp: at(2 * time.Hour), State: `"unavailable"`},
+		{Timestamp: at(3 * time.Hour), State: "50"},
+	}
+	got := powerSegments(history, from, from.Add(3*time.Hour+5*time.Minute))
+	want := []powerSegment{
+		{From: from, To: from.Add(10 * time.Minute), Watts: 100},
+		{From: from.Add(10 * time.Minute), To: from.Add(10*time.Minute + energyMaxSampleGap), Watts: 200},
+		{From: from.Add(3 * time.Hour), To: from.Add(3*time.Hour + 5*time.Minute), Watts: 50},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("segments %+v", got)
+	}
+	for i := range want {
+		if !got[i].From.Equal(want[i].From) || !got[i].To.Equal(want[i].To) || got[i].Watts != want[i].Watts {
+			t.Errorf("segment %d: %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHandleEnergyCost(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "printer/power", Type: VdevTypePowerUsage, State: 0.0}})
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, vdevManager, testLogger)
+	app := fiber.New()
+	app.Get("/api/v1/energy-cost", handleEnergyCost)
+
+	get := func(target string) int {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := get("/api/v1/energy-cost?deviceId=printer/power"); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("without a tariff: %d", status)
+	}
+	GetConfig().Energy = &EnergyConfig{Timezone: "Europe/Warsaw", Tariff: &TariffConfig{
+		Currency: "PLN",
+		Bands: []TariffBandConfig{
+			{Start: "06:00", End: "22:00", Rate: 1},
+			{Start: "22:00", End: "06:00", Rate: 0.5},
+		},
+	}}
+
+	// 2 kW from 21:00 to 23:00 local, sampled every 10 minutes.
+	loc, _ := time.LoadLocation("Europe/Warsaw")
+	start := time.Date(2026, 1, 10, 21, 0, 0, 0, loc)
+	id, err := vdevHistoryRepo.getOrCreateDeviceID("printer/power", string(VdevTypePowerUsage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := start; ts.Before(start.Add(2 * time.Hour)); ts = ts.Add(10 * time.Minute) {
+		gormDB.Create(&VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: ts.UnixMilli(), VirtualDeviceID: id, State: "2000"})
+	}
+	gormDB.Create(&VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: start.Add(2 * time.Hour).UnixMilli(), VirtualDeviceID: id, State: "0"})
+
+	var got EnergyCost
+	target := "/api/v1/energy-cost?deviceId=printer/power&from=2026-01-10T00:00:00%2B01:00&to=2026-01-12T00:00:00%2B01:00"
+	getJSON(t, app, target, &got)
+	// 2 kWh at 1.0 before 22:00 and 2 kWh at 0.5 after.
+	if got.Currency != "PLN" || len(got.Buckets) != 2 || !approxEqual(got.TotalKWh, 4) || !approxEqual(got.TotalCost, 3) {
+		t.Fatalf("%+v", got)
+	}
+	if !approxEqual(got.Buckets[0].Cost, 3) || got.Buckets[1].KWh != 0 {
+		t.Errorf("buckets %+v", got.Buckets)
+	}
+
+	got = EnergyCost{}
+	if getJSON(t, app, target+"&bucket=hour", &got); len(got.Buckets) != 48 || !approxEqual(got.Buckets[21].Cost, 2) || !approxEqual(got.Buckets[22].Cost, 1) {
+		t.Fatalf("hourly: %+v", got.Buckets)
+	}
+
+	for _, bad := range []string{
+		"/api/v1/energy-cost?from=2026-01-10T00:00:00Z&to=2026-01-11T00:00:00Z",
+		"/api/v1/energy-cost?deviceId=printer/power&from=yesterday&to=2026-01-11T00:00:00Z",
+		"/api/v1/energy-cost?deviceId=printer/power&from=2026-01-11T00:00:00Z&to=2026-01-10T00:00:00Z",
+		"/api/v1/energy-cost?deviceId=hall/temp&from=2026-01-10T00:00:00Z&to=2026-01-11T00:00:00Z",
+		target + "&bucket=week",
+	} {
+		if status := get(bad); status != fiber.StatusBadRequest {
+			t.Errorf("%s: %d", bad, status)
+		}
+	}
+	if status := get("/api/v1/energy-cost?deviceId=missing&from=2026-01-10T00:00:00Z&to=2026-01-11T00:00:00Z"); status != fiber.StatusNotFound {
+		t.Errorf("unknown device: %d", status)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultEventsLimit and maxEventsLimit bound ?limit= of /api/v1/events.
+	defaultEventsLimit = 50
+	maxEventsLimit     = 200
+)
+
+// eventTypes are the device types /api/v1/events reports, and its default
+// ?types=.
+var eventTypes = []string{string(VdevTypeContact), string(VdevTypeRelay), string(VdevTypePerson)}
+
+// Event kinds, by device type and state transition.
+const (
+	eventContactOpened = "contact_opened"
+	eventContactClosed = "contact_closed"
+	eventRelayOn       = "relay_on"
+	eventRelayOff      = "relay_off"
+	// eventPersonArrived and eventPersonLeft are a camera's count leaving
+	// and reaching zero; eventPeopleCount is any other count change.
+	eventPersonArrived = "person_arrived"
+	eventPersonLeft    = "person_left"
+	eventPeopleCount   = "people_count"
+)
+
+// eventTexts are the descriptions of the event kinds: %[1]s is the device,
+// %[2]d the people count.
+var eventTexts = map[string]LocalizedString{
+	eventContactOpened: {"en": "%[1]s opened", "pl": "%[1]s: otwarto"},
+	eventContactClosed: {"en": "%[1]s closed", "pl": "%[1]s: zamknięto"},
+	eventRelayOn:       {"en": "%[1]s switched on", "pl": "%[1]s: włączono"},
+	eventRelayOff:      {"en": "%[1]s switched off", "pl": "%[1]s: wyłączono"},
+	eventPersonArrived: {"en": "%[1]s: someone arrived", "pl": "%[1]s: ktoś przyszedł"},
+	eventPersonLeft:    {"en": "%[1]s: everyone left", "pl": "%[1]s: wszyscy wyszli"},
+	eventPeopleCount:   {"en": "%[1]s: %[2]d people", "pl": "%[1]s: liczba osób %[2]d"},
+}
+
+// DeviceEvent is a state change served by GET /api/v1/events.
+type DeviceEvent struct {
+	// ID is the recorded state's ID, the ?before= of the next page.
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	DeviceID  string    `json:"device_id"`
+	Type      string    `json:"type"`
+	Kind      string    `json:"kind"`
+	Room      string    `json:"room,omitempty"`
+	// Description is the event in the request's language.
+	Description string `json:"description"`
+}
+
+// eventsResponse is a page of events, newest first. Next is the ?before= of
+// the following page; empty on the last one.
+type eventsResponse struct {
+	Events []DeviceEvent `json:"events"`
+	Next   string        `json:"next,omitempty"`
+}
+
+// eventKind classifies a state change; ok is false for states that don't
+// make an event, like an unavailable relay or a camera's first count of
+// zero. count is the people count of person events.
+func eventKind(change StateChange) (kind string, count int, ok bool) {
+	var state any
+	if err := json.Unmarshal([]byte(change.State), &state); err != nil {
+		return "", 0, false
+	}
+	switch VdevType(change.Type) {
+	case VdevTypeContact:
+		closed, ok := state.(bool)
+		if !ok {
+			return "", 0, false
+		}
+		if closed {
+			return eventContactClosed, 0, true
+		}
+		return eventContactOpened, 0, true
+	case VdevTypeRelay:
+		s, _ := state.(string)
+		switch {
+		case strings.EqualFold(s, "ON"):
+			return eventRelayOn, 0, true
+		case strings.EqualFold(s, "OFF"):
+			return eventRelayOff, 0, true
+		}
+	case VdevTypePerson:
+		n, ok := state.(float64)
+		if !ok {
+			return "", 0, false
+		}
+		count = int(n)
+		previous := 0
+		if change.Previous != nil {
+			json.Unmarshal([]byte(*change.Previous), &previous)
+		}
+		switch {
+		case count == previous:
+			// A first recorded count of zero.
+			return "", 0, false
+		case previous == 0:
+			return eventPersonArrived, count, true
+		case count == 0:
+			return eventPersonLeft, 0, true
+		}
+		return eventPeopleCount, count, true
+	}
+	return "", 0, false
+}
+
+// eventTranslator describes events with the entity and room names of a
+// config.
+type eventTranslator struct {
+	entityNames map[string]LocalizedString
+	roomNames   map[string]LocalizedString
+	rooms       map[string]string
+}
+
+func newEventTranslator(cfg *Config) *eventTranslator {
+	t := &eventTranslator{
+		entityNames: map[string]LocalizedString{},
+		roomNames:   map[string]LocalizedString{},
+		rooms:       deviceRooms(cfg),
+	}
+	for _, room := range cfg.Rooms {
+		t.roomNames[room.ID] = room.LocalizedName
+		for _, e := range room.Entities {
+			if _, ok := t.entityNames[e.ID]; !ok {
+				t.entityNames[e.ID] = e.LocalizedName
+			}
+		}
+	}
+	return t
+}
+
+// deviceName is the entity's name in lang followed by its room's, e.g.
+// "Door (Hall)", falling back to the IDs.
+func (t *eventTranslator) deviceName(id, lang string) string {
+	name := cmp.Or(t.entityNames[id].Resolve(lang), id)
+	room, ok := t.rooms[id]
+	if !ok {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, cmp.Or(t.roomNames[room].Resolve(lang), room))
+}
+
+// event translates a state change; ok is false when it makes no event.
+func (t *eventTranslator) event(change StateChange, lang string) (DeviceEvent, bool) {
+	kind, count, ok := eventKind(change)
+	if !ok {
+		return DeviceEvent{}, false
+	}
+	return DeviceEvent{
+		ID:          change.ID,
+		Timestamp:   time.UnixMilli(change.Timestamp),
+		DeviceID:    change.Name,
+		Type:        change.Type,
+		Kind:        kind,
+		Room:        t.rooms[change.Name],
+		Description: fmt.Sprintf(eventTexts[kind].Resolve(lang), t.deviceName(change.Name, lang), count),
+	}, true
+}
+
+// eventLocales are the languages of the config names and the event texts.
+func eventLocales(cfg *Config) []string {
+	locales := configLocales(cfg)
+	for _, text := range eventTexts {
+		locales = append(locales, slices.Collect(maps.Keys(text))...)
+	}
+	slices.Sort(locales)
+	return slices.Compact(locales)
+}
+
+// handleEvents serves the recent state changes of contacts, relays and
+// cameras (or the ?types= listed) as events described in the language
+// picked by ?lang= or Accept-Language, newest first. At most ?limit= are
+// served per page; ?before= takes the next page.
+func handleEvents(c *fiber.Ctx) error {
+	if vdevHistoryRepo == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "history not available"})
+	}
+	types := splitQueryList(c.Query("types"))
+	for _, t := range types {
+		if !slices.Contains(eventTypes, t) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("unknown type %s, expected one of %s", t, strings.Join(eventTypes, ", "))})
+		}
+	}
+	if len(types) == 0 {
+		types = eventTypes
+	}
+	limit := defaultEventsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be a positive number"})
+		}
+		limit = min(n, maxEventsLimit)
+	}
+
+	changes, err := vdevHistoryRepo.GetRecentStateChanges(types, c.Query("before"), limit)
+	if errors.Is(err, errUnknownStateChange) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown before event"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	cfg := GetConfig()
+	lang := requestLocale(c, eventLocales(cfg))
+	c.Vary(fiber.HeaderAcceptLanguage)
+	translator := newEventTranslator(cfg)
+	resp := eventsResponse{Events: []DeviceEvent{}}
+	for _, change := range changes {
+		if event, ok := translator.event(change, lang); ok {
+			resp.Events = append(resp.Events, event)
+		}
+	}
+	// Changes making no event still count against the limit, so a full
+	// page of changes has a next page even with fewer events.
+	if len(changes) == limit {
+		resp.Next = changes[len(changes)-1].ID
+	}
+	return c.JSON(resp)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventsTestConfig has a hall with a door, a light and a camera, named in
+// Polish and English.
+var eventsTestConfig = &Config{Rooms: []RoomConfig{
+	{ID: "hall", LocalizedName: LocalizedString{"pl": "Korytarz", "en": "Hall"}, Entities: []EntityConfig{
+		{ID: "hall/door", LocalizedName: LocalizedString{"pl": "Drzwi", "en": "Door"}},
+		{ID: "hall/light", LocalizedName: LocalizedString{"pl": "Światło"}},
+		{ID: "frigate/person/hall", LocalizedName: LocalizedString{"pl": "Kamera", "en": "Camera"}},
+	}},
+}}
+
+func stateChange(name string, typ VdevType, state string, previous ...string) StateChange {
+	change := StateChange{ID: "s1", Timestamp: 1_700_000_000_000, Name: name, Type: string(typ), State: state}
+	if len(previous) > 0 {
+		change.Previous = &previous[0]
+	}
+	return change
+}
+
+func TestEventTranslator(t *testing.T) {
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	setConfig(&Config{})
+	translator := newEventTranslator(eventsTestConfig)
+
+	for _, tc := range []struct {
+		change StateChange
+		kind   string
+		pl, en string
+	}{
+		{stateChange("hall/door", VdevTypeContact, "false", "true"), eventContactOpened, "Drzwi (Korytarz): otwarto", "Door (Hall) opened"},
+		{stateChange("hall/door", VdevTypeContact, "true", "false"), eventContactClosed, "Drzwi (Korytarz): zamknięto", "Door (Hall) closed"},
+		{stateChange("hall/light", VdevTypeRelay, `"ON"`), eventRelayOn, "Światło (Korytarz): włączono", "Światło (Hall) switched on"},
+		{stateChange("hall/light", VdevTypeRelay, `"OFF"`, `"ON"`), eventRelayOff, "Światło (Korytarz): wyłączono", "Światło (Hall) switched off"},
+		{stateChange("frigate/person/hall", VdevTypePerson, "1", "0"), eventPersonArrived, "Kamera (Korytarz): ktoś przyszedł", "Camera (Hall): someone arrived"},
+		{stateChange("frigate/person/hall", VdevTypePerson, "2"), eventPersonArrived, "Kamera (Korytarz): ktoś przyszedł", "Camera (Hall): someone arrived"},
+		{stateChange("frigate/person/hall", VdevTypePerson, "3", "1"), eventPeopleCount, "Kamera (Korytarz): liczba osób 3", "Camera (Hall): 3 people"},
+		{stateChange("frigate/person/hall", VdevTypePerson, "0", "3"), eventPersonLeft, "Kamera (Korytarz): wszyscy wyszli", "Camera (Hall): everyone left"},
+		// Devices in no room go by their ID.
+		{stateChange("garage/door", VdevTypeContact, "false"), eventContactOpened, "garage/door: otwarto", "garage/door opened"},
+	} {
+		for lang, want := range map[string]string{"pl": tc.pl, "en": tc.en} {
+			event, ok := translator.event(tc.change, lang)
+			if !ok || event.Kind != tc.kind || event.Description != want {
+				t.Errorf("%s %s (%s): %+v, want %s %q", tc.change.Name, tc.change.State, lang, event, tc.kind, want)
+			}
+		}
+	}
+
+	for _, change := range []StateChange{
+		stateChange("hall/light", VdevTypeRelay, `"unavailable"`),
+		stateChange("hall/door", VdevTypeContact, "null"),
+		stateChange("frigate/person/hall", VdevTypePerson, "not json"),
+		stateChange("frigate/person/hall", VdevTypePerson, "0"),
+		stateChange("hall/temp", VdevTypeTemperature, "21.5", "21"),
+	} {
+		if event, ok := translator.event(change, "en"); ok {
+			t.Errorf("%s %s: %+v", change.Name, change.State, event)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	setConfig(eventsTestConfig)
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, vdevManager, testLogger)
+	recordStates(t, vdevHistoryRepo, "hall/door", VdevTypeContact, 1000, "true", "false", "false", "true")
+	recordStates(t, vdevHistoryRepo, "hall/light", VdevTypeRelay, 1500, `"OFF"`, `"ON"`)
+	recordStates(t, vdevHistoryRepo, "frigate/person/hall", VdevTypePerson, 1200, "0", "2")
+	recordStates(t, vdevHistoryRepo, "hall/temp", VdevTypeTemperature, 1000, "21", "22")
+	app := fiber.New()
+	app.Get("/api/v1/events", handleEvents)
+
+	descriptions := func(resp eventsResponse) []string {
+		var d []string
+		for _, e := range resp.Events {
+			d = append(d, e.Description)
+		}
+		return d
+	}
+
+	// Newest first; the repeated door state and the camera's first count
+	// make no event.
+	var resp eventsResponse
+	getJSON(t, app, "/api/v1/events?lang=en", &resp)
+	want := []string{"Door (Hall) closed", "Światło (Hall) switched on", "Camera (Hall): someone arrived", "Door (Hall) opened", "Światło (Hall) switched off", "Door (Hall) closed"}
+	if got := descriptions(resp); !slices.Equal(got, want) || resp.Next != "" {
+		t.Fatalf("events %q, next %q", got, resp.Next)
+	}
+	if e := resp.Events[0]; e.DeviceID != "hall/door" || e.Type != "contact" || e.Room != "hall" || e.Timestamp.UnixMilli() != 4000 {
+		t.Errorf("event %+v", e)
+	}
+
+	// Pages continue where the last one ended.
+	var got []string
+	target := "/api/v1/events?lang=en&limit=3"
+	for range 5 {
+		var page eventsResponse
+		getJSON(t, app, target, &page)
+		got = append(got, descriptions(page)...)
+		if page.Next == "" {
+			break
+		}
+		target = "/api/v1/events?lang=en&limit=3&before=" + page.Next
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("paged %q", got)
+	}
+
+	getJSON(t, app, "/api/v1/events?types=relay&lang=pl", &resp)
+	if got := descriptions(resp); !slices.Equal(got, []string{"Światło (Korytarz): włączono", "Światło (Korytarz): wyłączono"}) {
+		t.Fatalf("relays %q", got)
+	}
+
+	for _, target := range []string{"/api/v1/events?types=temperature", "/api/v1/events?limit=0", "/api/v1/events?before=nope"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d", target, resp.StatusCode)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 )
@@ -23,6 +23,7 @@ type ExitBoardService struct {
 	cfg  *ExitBoardConfig
 	vdev *VdevManager
 	mqtt *MQTTAdapter
+	log  *slog.Logger
 
 	// rooms are the configured rooms that have any entities. Whether a room is
 	// actually relevant (has a light or contact sensor) is decided dynamically at
@@ -32,11 +33,12 @@ type ExitBoardService struct {
 
 // NewExitBoardService creates the service, collecting the rooms that have any
 // entities.
-func NewExitBoardService(cfg *Config, vdev *VdevManager, mqtt *MQTTAdapter) *ExitBoardService {
+func NewExitBoardService(cfg *Config, vdev *VdevManager, mqtt *MQTTAdapter, logger *slog.Logger) *ExitBoardService {
 	s := &ExitBoardService{
 		cfg:  cfg.ExitBoard,
 		vdev: vdev,
 		mqtt: mqtt,
+		log:  logger,
 	}
 	for _, room := range cfg.Rooms {
 		if len(room.Entities) > 0 {
@@ -80,7 +82,7 @@ func (s *ExitBoardService) publishRoom(room RoomConfig) {
 	}
 	topic := s.cfg.MQTTPrefix + "/" + room.ID
 	if err := s.mqtt.Publish(topic, []byte(strconv.Itoa(code)), true); err != nil {
-		log.Printf("[exit_board] failed to publish %s: %v", topic, err)
+		s.log.Warn("publishing failed", "topic", topic, "err", err)
 	}
 }
 
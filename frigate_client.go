@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultFrigateTimeout bounds a request to Frigate, including reading the
+// response, when frigate.timeout isn't set.
+const defaultFrigateTimeout = 10 * time.Second
+
+// FrigateAuthConfig authenticates requests to Frigate, e.g. when it sits
+// behind an authenticating proxy. Token and basic auth are exclusive;
+// Headers are sent in addition to either.
+type FrigateAuthConfig struct {
+	// Token is sent as "Authorization: Bearer <token>".
+	Token                 string            `yaml:"token"`
+	TokenFile             string            `yaml:"token_file"`
+	BasicAuthUsername     string            `yaml:"basic_auth_username"`
+	BasicAuthPassword     string            `yaml:"basic_auth_password"`
+	BasicAuthPasswordFile string            `yaml:"basic_auth_password_file"`
+	Headers               map[string]string `yaml:"headers"`
+}
+
+// validateFrigateClientConfig rejects frigate.auth and frigate.timeout
+// settings that can't be used.
+func validateFrigateClientConfig(cfg *Config, cfgPath string) error {
+	auth := cfg.Frigate.Auth
+	if auth.Token != "" && auth.BasicAuthUsername != "" {
+		return fmt.Errorf("frigate.auth.token and frigate.auth.basic_auth_username are mutually exclusive in %s", cfgPath)
+	}
+	if auth.BasicAuthUsername != "" && auth.BasicAuthPassword == "" {
+		return fmt.Errorf("frigate.auth.basic_auth_username is set without a password in %s", cfgPath)
+	}
+	if v := cfg.Frigate.Timeout; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("frigate.timeout is not a valid duration (%q) in %s", v, cfgPath)
+		}
+	}
+	return nil
+}
+
+// frigateTransport adds frigate.auth to every request.
+type frigateTransport struct {
+	auth FrigateAuthConfig
+	// base sends the requests; http.DefaultTransport when nil.
+	base http.RoundTripper
+}
+
+func (t frigateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	for name, value := range t.auth.Headers {
+		req.Header.Set(name, value)
+	}
+	switch {
+	case t.auth.Token != "":
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+t.auth.Token)
+	case t.auth.BasicAuthUsername != "":
+		req.SetBasicAuth(t.auth.BasicAuthUsername, t.auth.BasicAuthPassword)
+	}
+	if t.base != nil {
+		return t.base.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newFrigateClient returns the client all requests to Frigate go through,
+// with frigate.auth applied and frigate.timeout as the timeout.
+func newFrigateClient(cfg FrigateConfig) *http.Client {
+	timeout := defaultFrigateTimeout
+	if d, err := time.ParseDuration(cfg.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	return &http.Client{Timeout: timeout, Transport: frigateTransport{auth: cfg.Auth}}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frigateAuthStub is a Frigate that records the headers of each request.
+type frigateAuthStub struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers map[string]http.Header // by path
+}
+
+func newFrigateAuthStub(t *testing.T) *frigateAuthStub {
+	t.Helper()
+	jpg := noiseJPEG(t, 320, 180)
+	stub := &frigateAuthStub{headers: map[string]http.Header{}}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		stub.headers[r.URL.Path] = r.Header.Clone()
+		stub.mu.Unlock()
+		if r.URL.Path == "/api/config" {
+			w.Write([]byte(`{"cameras": {"lab": {}}}`))
+			return
+		}
+		w.Write(jpg)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (s *frigateAuthStub) header(path, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers[path].Get(name)
+}
+
+func TestFrigateClient_Auth(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		auth   FrigateAuthConfig
+		header string
+		want   string
+	}{
+		{"token", FrigateAuthConfig{Token: "s3cret"}, "Authorization", "Bearer s3cret"},
+		{"basic", FrigateAuthConfig{BasicAuthUsername: "at2", BasicAuthPassword: "pw"}, "Authorization", "Basic YXQyOnB3"},
+		{"headers", FrigateAuthConfig{Headers: map[string]string{"X-Auth-Request-User": "at2"}}, "X-Auth-Request-User", "at2"},
+		{"none", FrigateAuthConfig{}, "Authorization", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stub := newFrigateAuthStub(t)
+			cfg := &Config{Frigate: FrigateConfig{Url: stub.URL, Auth: tc.auth}}
+			prevCfg, prevMapper := GetConfig(), frigateSnapshotMapper
+			t.Cleanup(func() {
+				setConfig(prevCfg)
+				frigateSnapshotMapper = prevMapper
+				cameraImages.Clear()
+			})
+			setConfig(cfg)
+			frigateSnapshotMapper = NewFrigateSnapshotMapper(NewVdevManager(), cfg, testLogger)
+
+			if err := frigateSnapshotMapper.fetchCameraNames(); err != nil {
+				t.Fatal(err)
+			}
+			frigateSnapshotMapper.fetchCameraSnapshot("lab")
+			fetchAndCacheImage("lab")
+			for _, path := range []string{"/api/config", "/api/lab/latest.jpg", "/api/lab/latest.webp"} {
+				if got := stub.header(path, tc.header); got != tc.want {
+					t.Errorf("%s %s = %q, want %q", path, tc.header, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFrigateClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer frigate.Close()
+	defer close(release)
+
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL, Timeout: "50ms"}}, testLogger)
+	start := time.Now()
+	err := s.fetchCameraNames()
+	if err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Fatalf("err = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+}
+
+func TestValidateFrigateClientConfig(t *testing.T) {
+	for _, tc := range []struct {
+		frigate FrigateConfig
+		err     string
+	}{
+		{FrigateConfig{Auth: FrigateAuthConfig{Token: "t"}, Timeout: "5s"}, ""},
+		{FrigateConfig{Auth: FrigateAuthConfig{Token: "t", BasicAuthUsername: "at2", BasicAuthPassword: "pw"}}, "mutually exclusive"},
+		{FrigateConfig{Auth: FrigateAuthConfig{BasicAuthUsername: "at2"}}, "without a password"},
+		{FrigateConfig{Timeout: "0s"}, "frigate.timeout"},
+	} {
+		err := validateFrigateClientConfig(&Config{Frigate: tc.frigate}, "at2.yaml")
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: err = %v, want %q", tc.frigate, err, tc.err)
+		}
+	}
+}
@@ -2,21 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"reflect"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
 )
 
 type FrigateSnapshotMapperData struct {
@@ -43,33 +49,145 @@ type FrigateSnapshotState struct {
 type FrigateSnapshotMapper struct {
 	vdevMgr *VdevManager
 	cfg     *Config
+	// client sends the requests to Frigate, with cfg's frigate.auth.
+	client *http.Client
 
 	cameraNames []string
-	imagesCache map[string][]byte
+	// cache holds the variants of each camera's last fetch.
+	cache *snapshotCache
+	// archiver, when frigate.archive is set, is offered the mid-size JPEG
+	// of fetches. Set before Start.
+	archiver *SnapshotArchiver
 
 	mu sync.RWMutex
+
+	// reconfigured wakes the fetch loop to fetch every camera again.
+	reconfigured chan struct{}
+
+	// ctx is canceled by Stop; it ends the fetch loop and the requests to
+	// Frigate in flight. lifecycleMu orders Start and Stop, so the loop is
+	// never launched after Stop waited for it.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	lifecycleMu sync.Mutex
+	started     bool
+	loop        sync.WaitGroup
+
+	log *slog.Logger
+
+	// lastSuccess is the Unix nano time of the last successful request to
+	// Frigate (camera list or snapshot), for /readyz.
+	lastSuccess atomic.Int64
+}
+
+// cameraDeviceID is the ID of the snapshot device of a Frigate camera.
+func cameraDeviceID(name string) string {
+	return "snapshot/" + name
+}
+
+// unknownRoomCameras describes every camera a room lists that isn't among
+// the cameras Frigate reported.
+func unknownRoomCameras(cfg *Config, known []string) []string {
+	var unknown []string
+	for _, room := range cfg.Rooms {
+		for _, name := range room.Cameras {
+			if !slices.Contains(known, name) {
+				unknown = append(unknown, fmt.Sprintf("room %s references camera %s, which Frigate doesn't know", room.ID, name))
+			}
+		}
+	}
+	return unknown
 }
 
-func NewFrigateSnapshotMapper(vdevMgr *VdevManager, cfg *Config) *FrigateSnapshotMapper {
+func NewFrigateSnapshotMapper(vdevMgr *VdevManager, cfg *Config, logger *slog.Logger) *FrigateSnapshotMapper {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &FrigateSnapshotMapper{
-		vdevMgr:     vdevMgr,
-		cfg:         cfg,
-		cameraNames: []string{},
-		imagesCache: map[string][]byte{},
+		vdevMgr:      vdevMgr,
+		cfg:          cfg,
+		client:       newFrigateClient(cfg.Frigate),
+		log:          logger,
+		cameraNames:  []string{},
+		cache:        newSnapshotCache(snapshotCacheBytes(cfg)),
+		reconfigured: make(chan struct{}, 1),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+func (s *FrigateSnapshotMapper) config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// Reconfigure switches to a reloaded config. When frigate.snapshots changed,
+// the cached variants are dropped, as their names carry the old widths, and
+// every camera is fetched again right away.
+func (s *FrigateSnapshotMapper) Reconfigure(cfg *Config) {
+	s.mu.Lock()
+	changed := !reflect.DeepEqual(s.cfg.Frigate.Snapshots, cfg.Frigate.Snapshots)
+	s.cfg = cfg
+	s.client = newFrigateClient(cfg.Frigate)
+	s.mu.Unlock()
+	if changed {
+		s.cache.reset(snapshotCacheBytes(cfg))
+		select {
+		case s.reconfigured <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LastSuccess returns when a request to Frigate last succeeded; zero if none
+// has yet.
+func (s *FrigateSnapshotMapper) LastSuccess() time.Time {
+	if ns := s.lastSuccess.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// HasCamera reports whether Frigate reported a camera of that name.
+func (s *FrigateSnapshotMapper) HasCamera(name string) bool {
+	return slices.Contains(s.cameraNames, name)
+}
+
+// Stop ends the snapshot fetch loop, canceling the requests to Frigate in
+// flight, and returns once the loop has exited. The mapper can't be started
+// again afterwards.
+func (s *FrigateSnapshotMapper) Stop() {
+	s.lifecycleMu.Lock()
+	s.cancel()
+	s.lifecycleMu.Unlock()
+	s.loop.Wait()
+}
+
+var errSnapshotMapperStarted = errors.New("snapshot mapper already started")
+
+// Start discovers the cameras, adds their devices and starts fetching their
+// snapshots. It fails when the mapper was already started; a Start that
+// failed may be retried.
 func (s *FrigateSnapshotMapper) Start() error {
+	s.lifecycleMu.Lock()
+	if s.started {
+		s.lifecycleMu.Unlock()
+		return errSnapshotMapperStarted
+	}
+	s.started = true
+	s.lifecycleMu.Unlock()
 
 	err := s.fetchCameraNames()
 	if err != nil {
+		s.lifecycleMu.Lock()
+		s.started = false
+		s.lifecycleMu.Unlock()
 		return fmt.Errorf("failed to fetch camera names from frigate: %w", err)
 	}
 
 	vdevs := []*VirtualDevice{}
 	for _, name := range s.cameraNames {
 		vdev := &VirtualDevice{
-			ID:    fmt.Sprintf("snapshot/%s", name),
+			ID:    cameraDeviceID(name),
 			State: nil,
 			Type:  VdevTypeCameraSnapshot,
 			MapperData: FrigateSnapshotMapperData{
@@ -80,29 +198,58 @@ func (s *FrigateSnapshotMapper) Start() error {
 		vdevs = append(vdevs, vdev)
 	}
 	s.vdevMgr.AddDevices(vdevs)
+	for _, msg := range unknownRoomCameras(s.config(), s.cameraNames) {
+		s.log.Warn(msg)
+	}
 
-	go s.fetchLoop()
-
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	if err := s.ctx.Err(); err != nil {
+		return fmt.Errorf("snapshot mapper stopped: %w", err)
+	}
+	s.loop.Go(s.fetchLoop)
 	return nil
-
 }
 
+// fetchLoop fetches each camera's snapshot every frigate.snapshots interval
+// of the camera.
 func (s *FrigateSnapshotMapper) fetchLoop() {
-	// Fetch snapshots every minute
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+	next := map[string]time.Time{}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
+		select {
+		case <-timer.C:
+		case <-s.reconfigured:
+			clear(next)
+		case <-s.ctx.Done():
+			return
+		}
+
+		snapshots := s.config().Frigate.Snapshots
+		now := time.Now()
 		updates := []*VirtualDeviceUpdate{}
 		for _, name := range s.cameraNames {
+			if s.ctx.Err() != nil {
+				return
+			}
+			if due, ok := next[name]; ok && now.Before(due) {
+				continue
+			}
+			next[name] = now.Add(snapshots.forCamera(name).interval)
 			images, lowResPreview, error := s.fetchCameraSnapshot(name)
 			if error != nil {
-				log.Printf("[frigate snapshot mapper] failed to fetch snapshot for camera %s: %v", name, error)
+				if s.ctx.Err() != nil {
+					return
+				}
+				s.log.Warn("fetching snapshot failed", "camera", name, "err", error)
 				continue
 			}
+			s.lastSuccess.Store(time.Now().UnixNano())
 
 			updates = append(updates, &VirtualDeviceUpdate{
-				Name: fmt.Sprintf("snapshot/%s", name),
+				Name: cameraDeviceID(name),
 				State: FrigateSnapshotState{
 					Images:        images,
 					LowResPreview: lowResPreview,
@@ -110,7 +257,14 @@ func (s *FrigateSnapshotMapper) fetchLoop() {
 			})
 		}
 		s.vdevMgr.ApplyUpdates(updates)
-		<-ticker.C
+
+		wake := now.Add(defaultSnapshotSettings.interval)
+		for _, due := range next {
+			if due.Before(wake) {
+				wake = due
+			}
+		}
+		timer.Reset(time.Until(wake))
 	}
 }
 
@@ -118,22 +272,20 @@ func (s *FrigateSnapshotMapper) fetchCameraSnapshot(cameraName string) ([]Snapsh
 	// Refactored:
 	// 1. Fetch snapshot ONCE as JPEG from Frigate.
 	// 2. Decode locally using stdlib image/jpeg.
-	// 3. Resize to widths 300, 600, 900 (maintain aspect ratio) + original.
-	// 4. Encode each variant as JPEG
-	// 5. Store in s.imagesCache and return metadata with cache-busting URL.
-	base := strings.TrimRight(s.cfg.Frigate.Url, "/")
+	// 3. Resize to the frigate.snapshots widths (maintain aspect ratio) + original.
+	// 4. Encode each variant as JPEG, and have Frigate encode it as WebP if
+	//    frigate.snapshots.formats asks for it.
+	// 5. Replace the camera's variants in s.cache and return metadata with cache-busting URL.
+	cfg := s.config()
+	settings := cfg.Frigate.Snapshots.forCamera(cameraName)
+	base := strings.TrimRight(cfg.Frigate.Url, "/")
 	if base == "" {
 		return nil, "", fmt.Errorf("frigate url empty")
 	}
-	s.mu.Lock()
-	if s.imagesCache == nil {
-		s.imagesCache = make(map[string][]byte)
-	}
-	s.mu.Unlock()
-
-	ts := time.Now().Unix()
-	origURL := fmt.Sprintf("%s/api/%s/latest.jpg?cache=%d&height=1080", base, cameraName, ts)
-	resp, err := http.Get(origURL)
+	now := time.Now()
+	ts := now.Unix()
+	origURL := fmt.Sprintf("%s/api/%s/latest.jpg?cache=%d&height=%d", base, cameraName, ts, settings.sourceHeight)
+	resp, err := s.get(origURL)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to fetch original snapshot: %w", err)
 	}
@@ -155,43 +307,70 @@ func (s *FrigateSnapshotMapper) fetchCameraSnapshot(cameraName string) ([]Snapsh
 	origW := origBounds.Dx()
 	origH := origBounds.Dy()
 
+	// The original, then the resized variants.
+	sizes := []image.Point{{origW, origH}}
+	for _, w := range settings.widths {
+		if w <= 0 || w >= origW {
+			continue
+		}
+		sizes = append(sizes, image.Pt(w, int(float64(origH)*(float64(w)/float64(origW)))))
+	}
+
 	images := []SnapshotImage{}
+	var variants []snapshotVariant
+	// jpegs are the JPEG variants by width, for the archive.
+	jpegs := map[int][]byte{}
 
-	storeVariant := func(width, height int, ext string, data []byte) {
+	storeVariant := func(width, height int, format snapshotFormat, data []byte) {
 		widthPart := "orig"
 		if width > 0 {
 			widthPart = fmt.Sprintf("%d", width)
 		}
-		filename := fmt.Sprintf("%s_%s.%s", cameraName, widthPart, ext)
+		filename := fmt.Sprintf("%s_%s.%s", cameraName, widthPart, format.ext)
 
-		s.mu.Lock()
-		s.imagesCache[filename] = data
-		s.mu.Unlock()
+		variants = append(variants, snapshotVariant{filename: filename, data: data})
+		url := "/api/v1/camera-snapshot/" + filename
+		if cfg.Frigate.SnapshotCacheBusting {
+			url += fmt.Sprintf("?cache=%d", ts)
+		}
 		images = append(images, SnapshotImage{
-			URL:       fmt.Sprintf("/api/v1/camera-snapshot/%s?cache=%d", filename, ts),
+			URL:       url,
 			Width:     width,
 			Height:    height,
-			MediaType: "image/" + ext,
+			MediaType: format.mediaType,
 		})
 	}
 
-	// Store original as-is.
-	storeVariant(origW, origH, "jpg", origBytes)
-
-	targetWidths := []int{300, 600, 900}
-	for _, w := range targetWidths {
-		if w <= 0 || w >= origW {
-			continue
-		}
-		h := int(float64(origH) * (float64(w) / float64(origW)))
-		dst := image.NewRGBA(image.Rect(0, 0, w, h))
-		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), srcImg, origBounds, draw.Over, nil)
-
-		var buf bytes.Buffer
-		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
-			continue
+	for _, name := range settings.formats {
+		format := snapshotFormats[name]
+		for i, size := range sizes {
+			var data []byte
+			switch {
+			case name == "webp":
+				// x/image only decodes WebP; Frigate encodes it for us.
+				data, err = s.fetchWebPSnapshot(base, cameraName, size.Y, settings.quality)
+				if err != nil {
+					s.log.Warn("fetching webp snapshot failed", "camera", cameraName, "height", size.Y, "err", err)
+					continue
+				}
+			case i == 0:
+				// Store original as-is.
+				data = origBytes
+			default:
+				data, err = scaleJPEG(srcImg, size, settings.quality)
+				if err != nil {
+					continue
+				}
+			}
+			if name == "jpeg" {
+				jpegs[size.X] = data
+			}
+			storeVariant(size.X, size.Y, format, data)
 		}
-		storeVariant(w, h, "jpg", buf.Bytes())
+	}
+	s.cache.replace(cameraName, variants, now)
+	if s.archiver != nil && s.archiver.due(cameraName, now) {
+		s.archiveSnapshot(cameraName, srcImg, sizes, jpegs, settings.quality, now)
 	}
 
 	// Generate low-res preview (max LowResThumbnailSize px in any dimension)
@@ -222,37 +401,157 @@ func (s *FrigateSnapshotMapper) fetchCameraSnapshot(cameraName string) ([]Snapsh
 	return images, lowResPreview, nil
 }
 
-// GetCachedSnapshot returns the image bytes and media type for a given snapshot filename.
-// If the requested variant is not present in the cache, it triggers a refresh for the camera
-// and retries the lookup once.
-func (s *FrigateSnapshotMapper) GetCachedSnapshot(filename string) ([]byte, string, error) {
+// scaleJPEG resizes src to size and encodes it as JPEG.
+func scaleJPEG(src image.Image, size image.Point, quality int) ([]byte, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// archiveSnapshot offers the mid-size variant of a fetch to the archiver:
+// the middle of the resized ones, or the original when nothing was resized.
+// It is encoded here when the camera's formats leave out JPEG.
+func (s *FrigateSnapshotMapper) archiveSnapshot(cameraName string, src image.Image, sizes []image.Point, jpegs map[int][]byte, quality int, now time.Time) {
+	size := sizes[0]
+	resized := slices.SortedFunc(slices.Values(sizes[1:]), func(a, b image.Point) int { return a.X - b.X })
+	if len(resized) > 0 {
+		size = resized[len(resized)/2]
+	}
+	data, ok := jpegs[size.X]
+	if !ok {
+		var err error
+		if data, err = scaleJPEG(src, size, quality); err != nil {
+			s.log.Warn("encoding snapshot for the archive failed", "camera", cameraName, "err", err)
+			return
+		}
+	}
+	s.archiver.offer(cameraName, now, data)
+}
+
+// fetchWebPSnapshot fetches the camera's latest frame from Frigate as WebP
+// of the given height.
+func (s *FrigateSnapshotMapper) fetchWebPSnapshot(base, cameraName string, height, quality int) ([]byte, error) {
+	resp, err := s.get(fmt.Sprintf("%s/api/%s/latest.webp?height=%d&quality=%d", base, cameraName, height, quality))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("frigate snapshot status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := webp.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("webp decode failed: %w", err)
+	}
+	return data, nil
+}
+
+// snapshotContentType returns the media type of a variant filename.
+func snapshotContentType(filename string) string {
+	for _, format := range snapshotFormats {
+		if strings.HasSuffix(filename, "."+format.ext) {
+			return format.mediaType
+		}
+	}
+	return "image/jpeg"
+}
+
+// snapshotCameraName returns the camera of a variant filename
+// (<camera>_<width>.<ext>).
+func snapshotCameraName(filename string) string {
+	name, _, _ := strings.Cut(filename, ".")
+	if i := strings.LastIndexByte(name, '_'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// GetCachedSnapshot returns the cached variant for a snapshot filename.
+func (s *FrigateSnapshotMapper) GetCachedSnapshot(filename string) (cachedSnapshot, error) {
 	if filename == "" {
-		return nil, "", fmt.Errorf("empty filename")
+		return cachedSnapshot{}, fmt.Errorf("empty filename")
 	}
 
-	cacheKey := filename
-	s.mu.RLock()
-	data, ok := s.imagesCache[cacheKey]
-	s.mu.RUnlock()
-	if ok {
-		return data, "image/jpeg", nil
+	snap, ok := s.cache.get(filename)
+	if !ok || len(snap.data) == 0 {
+		return cachedSnapshot{}, fmt.Errorf("snapshot not found in cache")
 	}
-	return nil, "", fmt.Errorf("snapshot not found in cache")
+	return snap, nil
 }
 
-// HandleSnapshot is an HTTP handler for Fiber that serves a cached snapshot variant.
+// HandleSnapshot is an HTTP handler for Fiber that serves a cached snapshot
+// variant. Clients may cache it for the camera's refresh interval and
+// revalidate with If-None-Match or If-Modified-Since afterwards. The route
+// requires a login, so shared caches must not store it.
 func (s *FrigateSnapshotMapper) HandleSnapshot(c *fiber.Ctx) error {
 	filename := c.Params("filename")
-	data, mediaType, err := s.GetCachedSnapshot(filename)
-	if err != nil || len(data) == 0 {
+	snap, err := s.GetCachedSnapshot(filename)
+	if err != nil {
 		return fiber.ErrNotFound
 	}
-	c.Set("Content-Type", mediaType)
-	c.Set("Cache-Control", "no-cache")
-	c.Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	return c.Status(fiber.StatusOK).Send(data)
+	// Clients accepting WebP get the WebP variant of a JPEG if there is one.
+	if name, ok := strings.CutSuffix(filename, ".jpg"); ok {
+		c.Vary(fiber.HeaderAccept)
+		if acceptsWebP(c.Get(fiber.HeaderAccept)) {
+			if alt, err := s.GetCachedSnapshot(name + ".webp"); err == nil {
+				snap = alt
+			}
+		}
+	}
+	interval := s.config().Frigate.Snapshots.forCamera(snapshotCameraName(filename)).interval
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", int(interval.Seconds())))
+	c.Set(fiber.HeaderETag, snap.etag)
+	c.Set(fiber.HeaderLastModified, snap.modified.Format(http.TimeFormat))
+	if snapshotNotModified(c, snap) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, snap.contentType)
+	return c.Status(fiber.StatusOK).Send(snap.data)
 }
 
+// acceptsWebP reports whether an Accept header lists image/webp explicitly,
+// as browsers that support it do for images.
+func acceptsWebP(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(mediaType) != "image/webp" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		return !found || strings.Trim(q, "0.") != ""
+	}
+	return false
+}
+
+// snapshotNotModified evaluates the request's conditional headers. As RFC
+// 9110 prescribes, If-Modified-Since is ignored when If-None-Match is sent.
+func snapshotNotModified(c *fiber.Ctx, snap cachedSnapshot) bool {
+	if inm := c.Get(fiber.HeaderIfNoneMatch); inm != "" {
+		return etagMatches(inm, snap.etag)
+	}
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	return err == nil && !snap.modified.After(since)
+}
+
+// get requests url from Frigate with frigate.auth and frigate.timeout; Stop
+// cancels the request.
+func (s *FrigateSnapshotMapper) get(url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	client := s.client
+	s.mu.RUnlock()
+	return client.Do(req)
+}
 
 // FrigateConfigResponse is an incomplete schema for the /api/config response from Frigate.
 type FrigateConfigResponse struct {
@@ -260,11 +559,11 @@ type FrigateConfigResponse struct {
 }
 
 func (s *FrigateSnapshotMapper) fetchCameraNames() error {
-	base := strings.TrimRight(s.cfg.Frigate.Url, "/")
+	base := strings.TrimRight(s.config().Frigate.Url, "/")
 	if base == "" {
 		return fmt.Errorf("frigate url empty")
 	}
-	resp, err := http.Get(base + "/api/config")
+	resp, err := s.get(base + "/api/config")
 	if err != nil {
 		return fmt.Errorf("frigate /api/config request failed: %w", err)
 	}
@@ -284,5 +583,9 @@ func (s *FrigateSnapshotMapper) fetchCameraNames() error {
 	}
 	sort.Strings(names)
 	s.cameraNames = names
+	// Cameras gone from Frigate aren't fetched anymore; don't keep serving
+	// their last variants.
+	s.cache.retainCameras(names)
+	s.lastSuccess.Store(time.Now().UnixNano())
 	return nil
 }
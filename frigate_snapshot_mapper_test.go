@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setupSnapshotTest(t *testing.T) (*FrigateSnapshotMapper, *fiber.App) {
+	t.Helper()
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{}, testLogger)
+	app := fiber.New()
+	app.Get("/api/v1/camera-snapshot/:filename", s.HandleSnapshot)
+	return s, app
+}
+
+func getSnapshot(t *testing.T, app *fiber.App, header http.Header) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/v1/camera-snapshot/lab_600.jpg", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandleSnapshot_ETag(t *testing.T) {
+	s, app := setupSnapshotTest(t)
+	fetched := time.Date(2026, 10, 15, 18, 30, 12, 500, time.UTC)
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg 1")}}, fetched)
+
+	resp := getSnapshot(t, app, nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(body) != "jpeg 1" {
+		t.Fatalf("%d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get(fiber.HeaderCacheControl); got != "private, max-age=60" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderLastModified); got != "Thu, 15 Oct 2026 18:30:12 GMT" {
+		t.Errorf("Last-Modified = %q", got)
+	}
+	etag := resp.Header.Get(fiber.HeaderETag)
+
+	resp = getSnapshot(t, app, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != fiber.StatusNotModified {
+		t.Fatalf("revalidation: %d", resp.StatusCode)
+	}
+
+	// The same image fetched again keeps its validators.
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg 1")}}, fetched.Add(time.Minute))
+	resp = getSnapshot(t, app, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != fiber.StatusNotModified {
+		t.Fatalf("after an unchanged fetch: %d", resp.StatusCode)
+	}
+
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg 2")}}, fetched.Add(2*time.Minute))
+	resp = getSnapshot(t, app, http.Header{"If-None-Match": {etag}})
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(body) != "jpeg 2" {
+		t.Fatalf("after a changed fetch: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHandleSnapshot_IfModifiedSince(t *testing.T) {
+	s, app := setupSnapshotTest(t)
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg 1")}}, time.Date(2026, 10, 15, 18, 30, 12, 0, time.UTC))
+
+	for _, tc := range []struct {
+		header http.Header
+		want   int
+	}{
+		{http.Header{"If-Modified-Since": {"Thu, 15 Oct 2026 18:30:12 GMT"}}, fiber.StatusNotModified},
+		{http.Header{"If-Modified-Since": {"Thu, 15 Oct 2026 18:31:00 GMT"}}, fiber.StatusNotModified},
+		{http.Header{"If-Modified-Since": {"Thu, 15 Oct 2026 18:30:11 GMT"}}, fiber.StatusOK},
+		{http.Header{"If-Modified-Since": {"yesterday"}}, fiber.StatusOK},
+		// If-None-Match takes precedence.
+		{http.Header{"If-Modified-Since": {"Thu, 15 Oct 2026 18:31:00 GMT"}, "If-None-Match": {`"stale"`}}, fiber.StatusOK},
+	} {
+		if resp := getSnapshot(t, app, tc.header); resp.StatusCode != tc.want {
+			t.Errorf("%v: %d, want %d", tc.header, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestHandleSnapshot_NotFound(t *testing.T) {
+	_, app := setupSnapshotTest(t)
+	if resp := getSnapshot(t, app, nil); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("%d", resp.StatusCode)
+	}
+}
+
+func TestFetchCameraSnapshot_URLs(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 800, 450)), nil); err != nil {
+		t.Fatal(err)
+	}
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jpg.Bytes())
+	}))
+	defer frigate.Close()
+
+	for _, cacheBusting := range []bool{false, true} {
+		s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL, SnapshotCacheBusting: cacheBusting}}, testLogger)
+		images, _, err := s.fetchCameraSnapshot("lab")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 3 { // original, 300 and 600 wide
+			t.Fatalf("%d variants", len(images))
+		}
+		for _, img := range images {
+			if strings.Contains(img.URL, "?cache=") != cacheBusting {
+				t.Errorf("snapshot_cache_busting %v: URL %s", cacheBusting, img.URL)
+			}
+		}
+	}
+}
+
+// noiseJPEG encodes a w×h image of noise, which JPEG can't compress well, so
+// quality settings show in the size.
+func noiseJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7919 % 251)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// frigateSnapshotStub serves a 1280×720 snapshot and records the height
+// each request asked for.
+func frigateSnapshotStub(t *testing.T) (*httptest.Server, chan string) {
+	t.Helper()
+	jpg := noiseJPEG(t, 1280, 720)
+	heights := make(chan string, 10)
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heights <- r.URL.Query().Get("height")
+		w.Write(jpg)
+	}))
+	t.Cleanup(frigate.Close)
+	return frigate, heights
+}
+
+func variantWidths(images []SnapshotImage) []int {
+	var widths []int
+	for _, img := range images {
+		widths = append(widths, img.Width)
+	}
+	return widths
+}
+
+func TestFetchCameraSnapshot_CustomSettings(t *testing.T) {
+	frigate, heights := frigateSnapshotStub(t)
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL, Snapshots: SnapshotsConfig{
+		SnapshotSettings: SnapshotSettings{Widths: []int{480, 2000}, Quality: 90},
+		Cameras: map[string]SnapshotSettings{
+			"lab": {Widths: []int{200, 400}, Quality: 10, SourceHeight: 720},
+		},
+	}}}, testLogger)
+
+	images, _, err := s.fetchCameraSnapshot("hall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2000 isn't below the source width.
+	if got := variantWidths(images); !slices.Equal(got, []int{1280, 480}) {
+		t.Errorf("hall variants %v", got)
+	}
+	if h := <-heights; h != "1080" {
+		t.Errorf("hall requested at height %s", h)
+	}
+	hall, _ := s.GetCachedSnapshot("hall_480.jpg")
+
+	images, _, err = s.fetchCameraSnapshot("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := variantWidths(images); !slices.Equal(got, []int{1280, 200, 400}) {
+		t.Errorf("lab variants %v", got)
+	}
+	if images[1].Height != 112 || images[1].URL != "/api/v1/camera-snapshot/lab_200.jpg" {
+		t.Errorf("lab_200: %+v", images[1])
+	}
+	if h := <-heights; h != "720" {
+		t.Errorf("lab requested at height %s", h)
+	}
+	lab, _ := s.GetCachedSnapshot("lab_400.jpg")
+	// Quality 10 at 400 px comes out smaller than quality 90 at 480 px by far
+	// more than the size difference accounts for.
+	if len(lab.data)*3 > len(hall.data) {
+		t.Errorf("quality not applied: lab_400 %d bytes, hall_480 %d bytes", len(lab.data), len(hall.data))
+	}
+}
+
+func TestFrigateSnapshotMapper_Reconfigure(t *testing.T) {
+	frigate, _ := frigateSnapshotStub(t)
+	cfg := &Config{Frigate: FrigateConfig{Url: frigate.URL, Snapshots: SnapshotsConfig{SnapshotSettings: SnapshotSettings{Widths: []int{300}}}}}
+	s := NewFrigateSnapshotMapper(NewVdevManager(), cfg, testLogger)
+	if _, _, err := s.fetchCameraSnapshot("lab"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unrelated changes keep the cache.
+	same := *cfg
+	same.Web.PublicURL = "https://at2.example"
+	s.Reconfigure(&same)
+	if _, err := s.GetCachedSnapshot("lab_300.jpg"); err != nil {
+		t.Fatalf("cache dropped: %v", err)
+	}
+	select {
+	case <-s.reconfigured:
+		t.Fatal("refetch requested for an unrelated change")
+	default:
+	}
+
+	changed := same
+	changed.Frigate.Snapshots = SnapshotsConfig{SnapshotSettings: SnapshotSettings{Widths: []int{480}}}
+	s.Reconfigure(&changed)
+	if _, err := s.GetCachedSnapshot("lab_300.jpg"); err == nil {
+		t.Fatal("old variant still cached")
+	}
+	select {
+	case <-s.reconfigured:
+	default:
+		t.Fatal("no refetch requested")
+	}
+	if _, _, err := s.fetchCameraSnapshot("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCachedSnapshot("lab_480.jpg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchCameraSnapshot_PrunesVariants(t *testing.T) {
+	frigate, _ := frigateSnapshotStub(t)
+	cfg := &Config{Frigate: FrigateConfig{Url: frigate.URL}}
+	s := NewFrigateSnapshotMapper(NewVdevManager(), cfg, testLogger)
+	s.fetchCameraSnapshot("lab")
+
+	// A fetch still in flight when the widths changed stored the old ones;
+	// the next fetch removes them.
+	cfg.Frigate.Snapshots.Widths = []int{480}
+	s.fetchCameraSnapshot("lab")
+	for _, name := range []string{"lab_300.jpg", "lab_600.jpg", "lab_900.jpg"} {
+		if _, err := s.GetCachedSnapshot(name); err == nil {
+			t.Errorf("%s still cached", name)
+		}
+	}
+	if _, err := s.GetCachedSnapshot("lab_480.jpg"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleSnapshot_CameraInterval(t *testing.T) {
+	s, app := setupSnapshotTest(t)
+	s.cfg = &Config{Frigate: FrigateConfig{Snapshots: SnapshotsConfig{
+		Cameras: map[string]SnapshotSettings{"lab": {Interval: "15s"}},
+	}}}
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg")}}, time.Now())
+	if got := getSnapshot(t, app, nil).Header.Get(fiber.HeaderCacheControl); got != "private, max-age=15" {
+		t.Fatalf("Cache-Control = %q", got)
+	}
+}
+
+func TestSnapshotsConfig(t *testing.T) {
+	var cfg Config
+	err := decodeConfig([]byte("frigate:\n  snapshots:\n    widths: [480]\n    interval: 15s\n    cameras:\n      lab:\n        quality: 60\n"), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := cfg.Frigate.Snapshots.forCamera("lab")
+	if !slices.Equal(got.widths, []int{480}) || got.quality != 60 || got.sourceHeight != 1080 || got.interval != 15*time.Second {
+		t.Errorf("lab settings %+v", got)
+	}
+	if got := cfg.Frigate.Snapshots.forCamera("hall"); got.quality != 85 {
+		t.Errorf("hall settings %+v", got)
+	}
+
+	for _, bad := range []SnapshotsConfig{
+		{SnapshotSettings: SnapshotSettings{Widths: []int{300, 0}}},
+		{SnapshotSettings: SnapshotSettings{Quality: 101}},
+		{SnapshotSettings: SnapshotSettings{SourceHeight: -1}},
+		{SnapshotSettings: SnapshotSettings{Interval: "0s"}},
+		{Cameras: map[string]SnapshotSettings{"lab": {Widths: []int{-480}}}},
+		{SnapshotSettings: SnapshotSettings{Formats: []string{"png"}}},
+		{SnapshotSettings: SnapshotSettings{Formats: []string{"webp", "jpeg", "webp"}}},
+	} {
+		if err := validateSnapshotsConfig(&Config{Frigate: FrigateConfig{Snapshots: bad}}, "at2.yaml"); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+// webpHeader returns the start of a lossless WebP file of the given size,
+// enough for webp.DecodeConfig.
+func webpHeader(w, h int) []byte {
+	payload := binary.LittleEndian.AppendUint32([]byte{0x2f}, uint32(w-1)|uint32(h-1)<<14)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+len(payload)+1))
+	b.WriteString("WEBPVP8L")
+	binary.Write(&b, binary.LittleEndian, uint32(len(payload)))
+	b.Write(payload)
+	b.WriteByte(0) // chunk padding
+	return b.Bytes()
+}
+
+func TestFetchCameraSnapshot_WebP(t *testing.T) {
+	jpg := noiseJPEG(t, 1280, 720)
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/lab/latest.jpg":
+			w.Write(jpg)
+		case "/api/lab/latest.webp":
+			if q := r.URL.Query().Get("quality"); q != "70" {
+				t.Errorf("webp requested with quality %s", q)
+			}
+			h, _ := strconv.Atoi(r.URL.Query().Get("height"))
+			w.Write(webpHeader(h*16/9, h))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer frigate.Close()
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL, Snapshots: SnapshotsConfig{
+		SnapshotSettings: SnapshotSettings{Widths: []int{640}, Quality: 70, Formats: []string{"jpeg", "webp"}},
+	}}}, testLogger)
+
+	images, _, err := s.fetchCameraSnapshot("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SnapshotImage{
+		{URL: "/api/v1/camera-snapshot/lab_1280.jpg", Width: 1280, Height: 720, MediaType: "image/jpeg"},
+		{URL: "/api/v1/camera-snapshot/lab_640.jpg", Width: 640, Height: 360, MediaType: "image/jpeg"},
+		{URL: "/api/v1/camera-snapshot/lab_1280.webp", Width: 1280, Height: 720, MediaType: "image/webp"},
+		{URL: "/api/v1/camera-snapshot/lab_640.webp", Width: 640, Height: 360, MediaType: "image/webp"},
+	}
+	if !slices.Equal(images, want) {
+		t.Fatalf("images = %+v", images)
+	}
+	snap, err := s.GetCachedSnapshot("lab_640.webp")
+	if err != nil || snap.contentType != "image/webp" || !bytes.Equal(snap.data, webpHeader(640, 360)) {
+		t.Fatalf("lab_640.webp: %q %v", snap.contentType, err)
+	}
+	if snap, _ := s.GetCachedSnapshot("lab_640.jpg"); snap.contentType != "image/jpeg" {
+		t.Fatalf("lab_640.jpg content type %q", snap.contentType)
+	}
+}
+
+func TestHandleSnapshot_ContentType(t *testing.T) {
+	s, app := setupSnapshotTest(t)
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg")}}, time.Now())
+
+	if resp := getSnapshot(t, app, http.Header{"Accept": {"image/webp,*/*"}}); resp.Header.Get(fiber.HeaderContentType) != "image/jpeg" {
+		t.Fatalf("without a webp variant: %q", resp.Header.Get(fiber.HeaderContentType))
+	}
+
+	s.cache.replace("lab", []snapshotVariant{{"lab_600.jpg", []byte("jpeg")}, {"lab_600.webp", []byte("webp")}}, time.Now())
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", "image/jpeg"},
+		{"image/jpeg", "image/jpeg"},
+		{"image/avif,image/webp,image/apng,*/*;q=0.8", "image/webp"},
+		{"image/webp;q=0.5, image/jpeg", "image/webp"},
+		{"image/webp;q=0, */*", "image/jpeg"},
+		{"image/webp;q=0.0", "image/jpeg"},
+	} {
+		resp := getSnapshot(t, app, http.Header{"Accept": {tc.accept}})
+		body, _ := io.ReadAll(resp.Body)
+		if got := resp.Header.Get(fiber.HeaderContentType); got != tc.want || "image/"+string(body) != tc.want {
+			t.Errorf("Accept %q: %s %q, want %s", tc.accept, got, body, tc.want)
+		}
+		if vary := resp.Header.Get(fiber.HeaderVary); vary != "Accept" {
+			t.Errorf("Accept %q: Vary = %q", tc.accept, vary)
+		}
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/camera-snapshot/lab_600.webp", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get(fiber.HeaderContentType); got != "image/webp" {
+		t.Fatalf("lab_600.webp served as %q", got)
+	}
+}
+
+// fetchLoopRunning reports whether a snapshot fetch loop goroutine is alive.
+func fetchLoopRunning() bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "(*FrigateSnapshotMapper).fetchLoop")
+}
+
+func TestFrigateSnapshotMapper_StopCancelsFetch(t *testing.T) {
+	fetching := make(chan struct{})
+	var once sync.Once
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/config" {
+			w.Write([]byte(`{"cameras": {"lab": {}}}`))
+			return
+		}
+		// A hung Frigate: the snapshot never arrives.
+		once.Do(func() { close(fetching) })
+		<-r.Context().Done()
+	}))
+	defer frigate.Close()
+
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL}}, testLogger)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); !errors.Is(err, errSnapshotMapperStarted) {
+		t.Fatalf("second Start: %v", err)
+	}
+	<-fetching
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the hung fetch")
+	}
+	if fetchLoopRunning() {
+		t.Fatal("fetch loop still running after Stop")
+	}
+	s.Stop() // a second Stop is harmless
+}
+
+func TestFrigateSnapshotMapper_StopBeforeStart(t *testing.T) {
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"cameras": {"lab": {}}}`))
+	}))
+	defer frigate.Close()
+
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL}}, testLogger)
+	s.Stop()
+	if err := s.Start(); err == nil {
+		t.Fatal("started after Stop")
+	}
+	if fetchLoopRunning() {
+		t.Fatal("fetch loop running")
+	}
+}
+
+func TestFrigateSnapshotMapper_RetryFailedStart(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Path == "/api/config" {
+			w.Write([]byte(`{"cameras": {}}`))
+		}
+	}))
+	defer frigate.Close()
+
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL}}, testLogger)
+	defer s.Stop()
+	if err := s.Start(); err == nil {
+		t.Fatal("started with Frigate down")
+	}
+	down.Store(false)
+	if err := s.Start(); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"embed"
+	"fmt"
 	"io/fs"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/proxy"
 )
 
@@ -20,15 +20,30 @@ import (
 //go:embed at2-web/dist/*
 var frontendEmbed embed.FS
 
-func SetupFrontend(app *fiber.App, devMode bool) {
+// frontendDevServer is the Vite dev server started by -dev-frontend.
+type frontendDevServer struct {
+	cmd *exec.Cmd
+}
+
+// Kill stops the dev server together with the processes npm started.
+func (f *frontendDevServer) Kill() error {
+	return syscall.Kill(-f.cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// SetupFrontend serves the embedded frontend, or in dev mode starts the Vite
+// dev server and proxies to it. The dev server is returned so shutdown can
+// stop it; nil otherwise.
+func SetupFrontend(app *fiber.App, devMode bool) (*frontendDevServer, error) {
 	if devMode {
-		log.Println("Starting frontend in dev mode...")
+		slog.Info("starting frontend in dev mode")
 		cmd := exec.Command("npm", "run", "dev", "--", "--host", "0.0.0.0")
 		cmd.Dir = "./at2-web"
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		// Its own process group, so Kill reaches vite and not just npm.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 		if err := cmd.Start(); err != nil {
-			log.Fatalf("Failed to start frontend: %v", err)
+			return nil, fmt.Errorf("starting the dev server: %w", err)
 		}
 
 		app.All("*", func(c *fiber.Ctx) error {
@@ -38,45 +53,19 @@ func SetupFrontend(app *fiber.App, devMode bool) {
 			proxyUrl := "http://localhost:5173" + c.Path()
 			return proxy.Do(c, proxyUrl)
 		})
+		return &frontendDevServer{cmd: cmd}, nil
 	} else {
 		// Serve embedded files
 		distFS, err := fs.Sub(frontendEmbed, "at2-web/dist")
 		if err != nil {
-			log.Fatalf("Failed to get dist fs: %v", err)
+			return nil, fmt.Errorf("opening the embedded dist directory: %w", err)
 		}
 
-		app.Use("/", filesystem.New(filesystem.Config{
-			Root:   http.FS(distFS),
-			Index:  "index.html",
-			Browse: false,
-		}))
-
-		// SPA fallback: If file not found, serve index.html
-		app.Use(func(c *fiber.Ctx) error {
-			if strings.HasPrefix(c.Path(), "/api") {
-				return c.Next()
-			}
-			// Try to open the file to see if it exists
-			file, err := distFS.Open(strings.TrimPrefix(c.Path(), "/"))
-			if err == nil {
-				file.Close()
-				return c.Next()
-			}
-
-			// If not found, serve index.html
-			c.Status(fiber.StatusOK)
-			c.Type("html", "utf-8")
-			index, err := distFS.Open("index.html")
-			if err != nil {
-				return c.Status(fiber.StatusInternalServerError).SendString("index.html not found")
-			}
-			defer index.Close()
-			stat, _ := index.Stat()
-			content := make([]byte, stat.Size())
-			if _, err := index.Read(content); err != nil {
-				return c.Status(fiber.StatusInternalServerError).SendString("failed to read index.html")
-			}
-			return c.Send(content)
-		})
+		assets, err := loadFrontendAssets(distFS, GetConfig())
+		if err != nil {
+			return nil, fmt.Errorf("loading the embedded frontend: %w", err)
+		}
+		app.Use(assets.handler)
 	}
+	return nil, nil
 }
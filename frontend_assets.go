@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// immutableCacheControl is sent for assets with a content hash in their
+	// name: a new build links to new names, so they never need revalidating.
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	// revalidateCacheControl is sent for everything else, index.html in
+	// particular; the ETag keeps revalidation cheap.
+	revalidateCacheControl = "no-cache"
+)
+
+// hashedAssetName matches the file names Vite gives build output, such as
+// assets/index-DiwrgTda.js.
+var hashedAssetName = regexp.MustCompile(`^assets/.+-[A-Za-z0-9_-]{8,}\.[a-z0-9]+$`)
+
+// frontendAsset is one file of the built frontend, held in memory together
+// with its compressed variants. A variant is nil when compressing didn't make
+// the file smaller.
+type frontendAsset struct {
+	body         []byte
+	gzip         []byte
+	brotli       []byte
+	etag         string
+	contentType  string
+	cacheControl string
+}
+
+// frontendAssets serves the built frontend by path (without the leading
+// slash), falling back to index.html for client-side routes.
+type frontendAssets map[string]*frontendAsset
+
+// loadFrontendAssets reads and compresses every file in fsys. This is done
+// once at startup, so requests only pick a variant. index.html gets the
+// OpenGraph tags for cfg, which therefore follow a restart, not a reload.
+func loadFrontendAssets(fsys fs.FS, cfg *Config) (frontendAssets, error) {
+	assets := frontendAssets{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if name == "index.html" {
+			if body, err = withOGMeta(body, cfg); err != nil {
+				return fmt.Errorf("adding the OpenGraph tags: %w", err)
+			}
+		}
+		asset := &frontendAsset{
+			body:         body,
+			etag:         "W/" + bodyETag(body),
+			contentType:  mime.TypeByExtension(path.Ext(name)),
+			cacheControl: revalidateCacheControl,
+		}
+		if asset.contentType == "" {
+			asset.contentType = fiber.MIMEOctetStream
+		}
+		if hashedAssetName.MatchString(name) {
+			asset.cacheControl = immutableCacheControl
+		}
+		if gz := gzipBytes(body); len(gz) < len(body) {
+			asset.gzip = gz
+		}
+		if br := fasthttp.AppendBrotliBytes(nil, body); len(br) < len(body) {
+			asset.brotli = br
+		}
+		assets[name] = asset
+		return nil
+	})
+	return assets, err
+}
+
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+// handler serves GET and HEAD requests for the frontend. Requests under /api
+// and other methods are passed on.
+func (a frontendAssets) handler(c *fiber.Ctx) error {
+	if strings.HasPrefix(c.Path(), "/api") || (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) {
+		return c.Next()
+	}
+	name := strings.TrimPrefix(c.Path(), "/")
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	asset, ok := a[name]
+	if !ok {
+		// SPA fallback: the frontend router handles the path.
+		if asset, ok = a["index.html"]; !ok {
+			return c.Status(fiber.StatusInternalServerError).SendString("index.html not found")
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, asset.cacheControl)
+	c.Set(fiber.HeaderETag, asset.etag)
+	c.Vary(fiber.HeaderAcceptEncoding)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), asset.etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, asset.contentType)
+	switch asset.encoding(c) {
+	case "br":
+		c.Set(fiber.HeaderContentEncoding, "br")
+		return c.Send(asset.brotli)
+	case "gzip":
+		c.Set(fiber.HeaderContentEncoding, "gzip")
+		return c.Send(asset.gzip)
+	}
+	return c.Send(asset.body)
+}
+
+// encoding picks the variant to send for the request's Accept-Encoding,
+// preferring the smaller brotli one whenever it is accepted.
+func (f *frontendAsset) encoding(c *fiber.Ctx) string {
+	// AcceptsEncodings takes a missing header as accepting anything.
+	if c.Get(fiber.HeaderAcceptEncoding) == "" {
+		return "identity"
+	}
+	if f.brotli != nil && c.AcceptsEncodings("br") != "" {
+		return "br"
+	}
+	if f.gzip != nil && c.AcceptsEncodings("gzip") != "" {
+		return "gzip"
+	}
+	return "identity"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testIndexHTML = `<!doctype html><html><head><script type="module" src="/assets/index-DiwrgTda.js"></script></head><body><div id="root"></div></body></html>`
+
+var testAssetJS = strings.Repeat("export const rooms = [\"lab\", \"hardroom\", \"kitchen\"];\n", 200)
+
+func setupFrontendAssetsTest(t *testing.T) *fiber.App {
+	t.Helper()
+	assets, err := loadFrontendAssets(fstest.MapFS{
+		"index.html":               {Data: []byte(testIndexHTML)},
+		"assets/index-DiwrgTda.js": {Data: []byte(testAssetJS)},
+		"favicon.png":              {Data: []byte{0x89, 'P', 'N', 'G'}},
+	}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/api/v1/rooms", func(c *fiber.Ctx) error { return c.SendString("rooms") })
+	app.Use(assets.handler)
+	return app
+}
+
+func getFrontend(t *testing.T, app *fiber.App, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestFrontendAssets_ETag(t *testing.T) {
+	app := setupFrontendAssetsTest(t)
+
+	resp, body := getFrontend(t, app, "/assets/index-DiwrgTda.js", nil)
+	if resp.StatusCode != fiber.StatusOK || body != testAssetJS {
+		t.Fatalf("first request: %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get(fiber.HeaderCacheControl); got != immutableCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(got, "text/javascript") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	etag := resp.Header.Get(fiber.HeaderETag)
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	resp, body = getFrontend(t, app, "/assets/index-DiwrgTda.js", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != fiber.StatusNotModified || body != "" {
+		t.Fatalf("second request: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	// The ETag doesn't depend on the encoding.
+	resp, _ = getFrontend(t, app, "/assets/index-DiwrgTda.js", http.Header{"If-None-Match": {etag}, "Accept-Encoding": {"gzip"}})
+	if resp.StatusCode != fiber.StatusNotModified {
+		t.Fatalf("gzip revalidation: %d", resp.StatusCode)
+	}
+}
+
+func TestFrontendAssets_Encoding(t *testing.T) {
+	app := setupFrontendAssetsTest(t)
+
+	for _, tc := range []struct{ acceptEncoding, want string }{
+		{"", ""},
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"br;q=0, gzip;q=0", ""},
+		{"deflate", ""},
+	} {
+		resp, body := getFrontend(t, app, "/assets/index-DiwrgTda.js", http.Header{"Accept-Encoding": {tc.acceptEncoding}})
+		if got := resp.Header.Get(fiber.HeaderContentEncoding); got != tc.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", tc.acceptEncoding, got, tc.want)
+			continue
+		}
+		if got := resp.Header.Get(fiber.HeaderVary); got != fiber.HeaderAcceptEncoding {
+			t.Errorf("Accept-Encoding %q: Vary = %q", tc.acceptEncoding, got)
+		}
+		switch tc.want {
+		case "gzip":
+			r, err := gzip.NewReader(strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, _ := io.ReadAll(r)
+			body = string(plain)
+		case "br":
+			if len(body) >= len(testAssetJS) {
+				t.Errorf("brotli body is %d bytes, plain %d", len(body), len(testAssetJS))
+			}
+			continue
+		}
+		if body != testAssetJS {
+			t.Errorf("Accept-Encoding %q: body differs", tc.acceptEncoding)
+		}
+	}
+
+	// Compressing doesn't make it smaller, so there is only the plain variant.
+	resp, _ := getFrontend(t, app, "/favicon.png", http.Header{"Accept-Encoding": {"br, gzip"}})
+	if got := resp.Header.Get(fiber.HeaderContentEncoding); got != "" {
+		t.Errorf("favicon Content-Encoding = %q", got)
+	}
+}
+
+func TestFrontendAssets_SPAFallback(t *testing.T) {
+	app := setupFrontendAssetsTest(t)
+	index, err := withOGMeta([]byte(testIndexHTML), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/rooms/lab", "/dhcp"} {
+		resp, body := getFrontend(t, app, path, nil)
+		if resp.StatusCode != fiber.StatusOK || body != string(index) {
+			t.Errorf("%s: %d %q", path, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get(fiber.HeaderCacheControl); got != revalidateCacheControl {
+			t.Errorf("%s: Cache-Control = %q", path, got)
+		}
+	}
+	if resp, body := getFrontend(t, app, "/api/v1/rooms", nil); body != "rooms" {
+		t.Errorf("/api/v1/rooms: %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := getFrontend(t, app, "/api/v1/missing", nil); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("/api/v1/missing: %d", resp.StatusCode)
+	}
+}
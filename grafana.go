@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultGrafanaMaxDataPoints is used when a query doesn't set
+	// maxDataPoints.
+	defaultGrafanaMaxDataPoints = 1000
+	// alertHistoryLimit is how many alert transitions are kept for the
+	// Grafana annotations.
+	alertHistoryLimit = 1000
+	// grafanaPeopleTarget is the derived people count of a room: the most
+	// people any of its cameras counted, like the room states.
+	grafanaPeopleTarget = "rooms/%s/people"
+)
+
+// grafanaAnnotations records the alert transitions served as annotations.
+var grafanaAnnotations = &alertHistory{}
+
+// validateGrafanaConfig requires a token for the Grafana endpoints.
+func validateGrafanaConfig(cfg *Config, cfgPath string) error {
+	if g := cfg.Grafana; g != nil && g.Token == "" {
+		return fmt.Errorf("grafana.token or grafana.token_file is required in %s", cfgPath)
+	}
+	return nil
+}
+
+// registerGrafanaRoutes mounts the simple JSON datasource endpoints when
+// grafana is configured. Nothing is registered otherwise.
+func registerGrafanaRoutes(app *fiber.App, cfg *Config) {
+	if cfg.Grafana == nil {
+		return
+	}
+	grafana := app.Group("/api/v1/grafana", grafanaAuthMiddleware)
+	grafana.Get("/", handleGrafanaTest)
+	grafana.Post("/search", handleGrafanaSearch)
+	grafana.Post("/query", handleGrafanaQuery)
+	grafana.Post("/annotations", handleGrafanaAnnotations)
+}
+
+// grafanaAuthMiddleware accepts requests carrying grafana.token as a bearer
+// token.
+func grafanaAuthMiddleware(c *fiber.Ctx) error {
+	g := GetConfig().Grafana
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if g == nil || g.Token == "" || !ok || !secretEqual(token, g.Token) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	return c.Next()
+}
+
+// handleGrafanaTest answers the datasource's connection test.
+func handleGrafanaTest(c *fiber.Ctx) error {
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// grafanaRange is the time range of a query or annotation request.
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// parse returns the range's bounds, which Grafana sends as RFC 3339 times.
+func (r grafanaRange) parse() (from, to time.Time, err error) {
+	if from, err = time.Parse(time.RFC3339Nano, r.From); err != nil {
+		return from, to, fmt.Errorf("range.from %q is not an RFC 3339 time", r.From)
+	}
+	if to, err = time.Parse(time.RFC3339Nano, r.To); err != nil {
+		return from, to, fmt.Errorf("range.to %q is not an RFC 3339 time", r.To)
+	}
+	if !to.After(from) {
+		return from, to, errors.New("range.to is not after range.from")
+	}
+	return from, to, nil
+}
+
+// grafanaPoint is a datapoint: the value and the time in Unix milliseconds.
+type grafanaPoint [2]float64
+
+// grafanaSeries is a time series answering a target of /query.
+type grafanaSeries struct {
+	Target     string         `json:"target"`
+	Datapoints []grafanaPoint `json:"datapoints"`
+}
+
+// downsample averages points (in time order, within [from, to]) into
+// maxPoints buckets of equal width, each at its start. Points that already
+// fit are returned as they are.
+func downsample(points []grafanaPoint, from, to time.Time, maxPoints int) []grafanaPoint {
+	if maxPoints <= 0 || len(points) <= maxPoints {
+		return points
+	}
+	start := float64(from.UnixMilli())
+	span := to.UnixMilli() - from.UnixMilli()
+	width := float64(max((span+int64(maxPoints)-1)/int64(maxPoints), 1))
+
+	buckets := make([]grafanaPoint, 0, maxPoints)
+	sum, n, bucket := 0.0, 0, -1
+	flush := func() {
+		if n > 0 {
+			buckets = append(buckets, grafanaPoint{sum / float64(n), start + float64(bucket)*width})
+		}
+	}
+	for _, p := range points {
+		// A point at the range end belongs to the last bucket.
+		b := min(int((p[1]-start)/width), maxPoints-1)
+		if b != bucket {
+			flush()
+			sum, n, bucket = 0, 0, b
+		}
+		sum += p[0]
+		n++
+	}
+	flush()
+	return buckets
+}
+
+// grafanaTargets lists the device IDs with numeric history and the derived
+// people counts of the rooms with cameras, sorted.
+func grafanaTargets(cfg *Config, devices []*VirtualDevice) []string {
+	targets := []string{}
+	for _, dev := range devices {
+		if dev != nil && dev.Type != VdevTypeCameraSnapshot && dev.Type != VdevTypePrinter && dev.Type != VdevTypeComfort {
+			targets = append(targets, dev.ID)
+		}
+	}
+	for _, room := range cfg.Rooms {
+		if len(roomPersonDevices(room, devices)) > 0 {
+			targets = append(targets, fmt.Sprintf(grafanaPeopleTarget, room.ID))
+		}
+	}
+	slices.Sort(targets)
+	return slices.Compact(targets)
+}
+
+// roomPersonDevices returns the IDs of the room's person detection entities.
+func roomPersonDevices(room RoomConfig, devices []*VirtualDevice) []string {
+	var ids []string
+	for _, e := range room.Entities {
+		if slices.ContainsFunc(devices, func(d *VirtualDevice) bool { return d != nil && d.ID == e.ID && d.Type == VdevTypePerson }) {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// handleGrafanaSearch lists the targets containing the requested text.
+func handleGrafanaSearch(c *fiber.Ctx) error {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if len(c.Body()) > 0 {
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	filter := strings.ToLower(req.Target)
+	targets := []string{}
+	for _, t := range grafanaTargets(GetConfig(), vdevManager.Devices()) {
+		if strings.Contains(strings.ToLower(t), filter) {
+			targets = append(targets, t)
+		}
+	}
+	return c.JSON(targets)
+}
+
+// historyPoints turns recorded states into datapoints, skipping states that
+// aren't numbers (or booleans and ON/OFF, as 1 and 0).
+func historyPoints(history []VirtualDeviceStateModel) []grafanaPoint {
+	points := []grafanaPoint{}
+	for _, h := range history {
+		var state any
+		if err := json.Unmarshal([]byte(h.State), &state); err != nil {
+			continue
+		}
+		if v, ok := toFloat64Internal(state); ok {
+			points = append(points, grafanaPoint{v, float64(h.Timestamp)})
+		}
+	}
+	return points
+}
+
+// peoplePoints combines the histories of a room's cameras, in time order,
+// into the most people any of them counted after each change.
+func peoplePoints(history []VirtualDeviceStateModel) []grafanaPoint {
+	counts := map[uint]float64{}
+	points := []grafanaPoint{}
+	for _, h := range history {
+		var state any
+		if err := json.Unmarshal([]byte(h.State), &state); err != nil {
+			continue
+		}
+		v, ok := toFloat64Internal(state)
+		if !ok {
+			continue
+		}
+		counts[h.VirtualDeviceID] = v
+		people := 0.0
+		for _, n := range counts {
+			people = max(people, n)
+		}
+		if last := len(points) - 1; last >= 0 && points[last][1] == float64(h.Timestamp) {
+			points[last][0] = people
+			continue
+		}
+		points = append(points, grafanaPoint{people, float64(h.Timestamp)})
+	}
+	return points
+}
+
+// handleGrafanaQuery serves the history of the requested targets within the
+// range, downsampled to maxDataPoints.
+func handleGrafanaQuery(c *fiber.Ctx) error {
+	var req struct {
+		Range         grafanaRange `json:"range"`
+		MaxDataPoints int          `json:"maxDataPoints"`
+		Targets       []struct {
+			Target string `json:"target"`
+		} `json:"targets"`
+	}
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	from, to, err := req.Range.parse()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if vdevHistoryRepo == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "history not available"})
+	}
+	maxPoints := req.MaxDataPoints
+	if maxPoints <= 0 {
+		maxPoints = defaultGrafanaMaxDataPoints
+	}
+
+	cfg := GetConfig()
+	devices := vdevManager.Devices()
+	rooms := map[string]RoomConfig{}
+	for _, room := range cfg.Rooms {
+		rooms[fmt.Sprintf(grafanaPeopleTarget, room.ID)] = room
+	}
+	// The range end is inclusive.
+	fromMs, toMs := from.UnixMilli(), to.UnixMilli()+1
+	series := []grafanaSeries{}
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		var points []grafanaPoint
+		if room, ok := rooms[t.Target]; ok {
+			history, err := vdevHistoryRepo.GetDevicesHistoryInRange(roomPersonDevices(room, devices), fromMs, toMs)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+			points = peoplePoints(history)
+		} else if slices.ContainsFunc(devices, func(d *VirtualDevice) bool { return d != nil && d.ID == t.Target }) {
+			history, err := vdevHistoryRepo.GetDevicesHistoryInRange([]string{t.Target}, fromMs, toMs)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+			points = historyPoints(history)
+		} else {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown target " + t.Target})
+		}
+		series = append(series, grafanaSeries{Target: t.Target, Datapoints: downsample(points, from, to, maxPoints)})
+	}
+	return c.JSON(series)
+}
+
+// alertHistory is an AlertSink keeping the latest alert transitions, oldest
+// first. They are only kept in memory, so annotations start over with every
+// restart.
+type alertHistory struct {
+	mu     sync.Mutex
+	events []alertEvent
+}
+
+func (h *alertHistory) AlertFired(a Alert) {
+	// Repeated notifications aren't new transitions.
+	if a.Repeat == 0 {
+		h.add(alertEvent{alert: a})
+	}
+}
+
+func (h *alertHistory) AlertResolved(a Alert) { h.add(alertEvent{alert: a, resolved: true}) }
+
+func (h *alertHistory) add(ev alertEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, ev)
+	if over := len(h.events) - alertHistoryLimit; over > 0 {
+		h.events = slices.Delete(h.events, 0, over)
+	}
+}
+
+// between returns the transitions within [from, to] by time.
+func (h *alertHistory) between(from, to time.Time) []alertEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []alertEvent
+	for _, ev := range h.events {
+		if at := ev.at(); !at.Before(from) && !at.After(to) {
+			events = append(events, ev)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b alertEvent) int { return a.at().Compare(b.at()) })
+	return events
+}
+
+// at is when the alert fired or resolved.
+func (ev alertEvent) at() time.Time {
+	if ev.resolved {
+		return ev.alert.ResolvedAt
+	}
+	return ev.alert.FiredAt
+}
+
+// grafanaAnnotation is an alert transition served by /annotations.
+type grafanaAnnotation struct {
+	// Annotation is the request's annotation, sent back as the contract
+	// asks.
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Tags       []string        `json:"tags"`
+	Text       string          `json:"text"`
+}
+
+// handleGrafanaAnnotations serves the alerts that fired or resolved within
+// the range. The annotation's query, when set, keeps the alerts whose rule
+// or device ID contains it.
+func handleGrafanaAnnotations(c *fiber.Ctx) error {
+	var req struct {
+		Range      grafanaRange    `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	from, to, err := req.Range.parse()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	var annotation struct {
+		Query string `json:"query"`
+	}
+	json.Unmarshal(req.Annotation, &annotation)
+
+	annotations := []grafanaAnnotation{}
+	for _, ev := range grafanaAnnotations.between(from, to) {
+		a := ev.alert
+		if q := annotation.Query; q != "" && !strings.Contains(a.Rule, q) && !strings.Contains(a.DeviceID, q) {
+			continue
+		}
+		state := "firing"
+		if ev.resolved {
+			state = "resolved"
+		}
+		annotations = append(annotations, grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time:       ev.at().UnixMilli(),
+			Title:      fmt.Sprintf("%s %s: %s", a.Rule, state, a.DeviceID),
+			Tags:       []string{a.Rule, a.Severity, state},
+			Text:       a.Message,
+		})
+	}
+	return c.JSON(annotations)
+}
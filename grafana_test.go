@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestGrafanaRangeParse(t *testing.T) {
+	from, to, err := grafanaRange{From: "2026-01-02T03:04:05.678Z", To: "2026-01-02T04:04:05Z"}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.UnixMilli() != 1767323045678 || to.UnixMilli() != 1767326645000 {
+		t.Fatalf("from %v, to %v", from, to)
+	}
+	// Offsets are honoured.
+	from, _, err = grafanaRange{From: "2026-01-02T05:04:05+02:00", To: "2026-01-02T04:04:05Z"}.parse()
+	if err != nil || from.UnixMilli() != 1767323045000 {
+		t.Fatalf("offset: %v, %v", from, err)
+	}
+
+	for _, r := range []grafanaRange{
+		{From: "", To: "2026-01-02T04:04:05Z"},
+		{From: "2026-01-02T03:04:05Z", To: "now"},
+		{From: "1767323045000", To: "1767326645000"},
+		{From: "2026-01-02T04:04:05Z", To: "2026-01-02T04:04:05Z"},
+		{From: "2026-01-02T04:04:05Z", To: "2026-01-02T03:04:05Z"},
+	} {
+		if _, _, err := r.parse(); err == nil {
+			t.Errorf("%+v parsed", r)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	from := time.UnixMilli(0)
+	to := time.UnixMilli(1000)
+	points := []grafanaPoint{{1, 0}, {3, 100}, {5, 250}, {7, 260}, {10, 600}, {20, 999}, {30, 1000}}
+
+	for _, tc := range []struct {
+		maxPoints int
+		want      []grafanaPoint
+	}{
+		// Points that fit are kept as they are.
+		{7, points},
+		{100, points},
+		{0, points},
+		// Four buckets of 250ms, at their starts; empty ones are left out.
+		{4, []grafanaPoint{{2, 0}, {6, 250}, {10, 500}, {25, 750}}},
+		// 1000ms in three buckets of 334ms.
+		{3, []grafanaPoint{{4, 0}, {10, 334}, {25, 668}}},
+		{1, []grafanaPoint{{76.0 / 7, 0}}},
+	} {
+		if got := downsample(points, from, to, tc.maxPoints); !slices.Equal(got, tc.want) {
+			t.Errorf("maxDataPoints %d: %v, want %v", tc.maxPoints, got, tc.want)
+		}
+	}
+
+	// The range start sets the bucket boundaries.
+	got := downsample([]grafanaPoint{{1, 1100}, {2, 1200}, {4, 1600}}, time.UnixMilli(1000), time.UnixMilli(2000), 2)
+	if want := []grafanaPoint{{1.5, 1000}, {4, 1500}}; !slices.Equal(got, want) {
+		t.Errorf("offset range: %v, want %v", got, want)
+	}
+	// Ranges shorter than maxDataPoints milliseconds get 1ms buckets.
+	got = downsample([]grafanaPoint{{1, 0}, {3, 0}, {5, 1}}, time.UnixMilli(0), time.UnixMilli(2), 2)
+	if want := []grafanaPoint{{2, 0}, {5, 1}}; !slices.Equal(got, want) {
+		t.Errorf("short range: %v, want %v", got, want)
+	}
+}
+
+func TestPeoplePoints(t *testing.T) {
+	history := []VirtualDeviceStateModel{
+		{VirtualDeviceID: 1, Timestamp: 1000, State: "2"},
+		{VirtualDeviceID: 2, Timestamp: 2000, State: "3"},
+		{VirtualDeviceID: 1, Timestamp: 3000, State: "0"},
+		{VirtualDeviceID: 2, Timestamp: 3000, State: "1"},
+		{VirtualDeviceID: 2, Timestamp: 4000, State: "null"},
+		{VirtualDeviceID: 2, Timestamp: 5000, State: "0"},
+	}
+	want := []grafanaPoint{{2, 1000}, {3, 2000}, {1, 3000}, {0, 5000}}
+	if got := peoplePoints(history); !slices.Equal(got, want) {
+		t.Fatalf("%v, want %v", got, want)
+	}
+}
+
+func TestValidateGrafanaConfig(t *testing.T) {
+	if err := validateGrafanaConfig(&Config{}, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateGrafanaConfig(&Config{Grafana: &GrafanaConfig{}}, "at2.yaml"); err == nil {
+		t.Fatal("no token accepted")
+	}
+	if err := validateGrafanaConfig(&Config{Grafana: &GrafanaConfig{Token: "secret"}}, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupGrafanaTest serves the Grafana endpoints over a hall with a camera, a
+// thermometer and a relay, with a day of recorded history.
+func setupGrafanaTest(t *testing.T) *fiber.App {
+	t.Helper()
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	prevAnnotations := grafanaAnnotations
+	t.Cleanup(func() { grafanaAnnotations = prevAnnotations })
+	grafanaAnnotations = &alertHistory{}
+	cfg := &Config{
+		Grafana: &GrafanaConfig{Token: "secret"},
+		Rooms: []RoomConfig{
+			{ID: "hall", Entities: []EntityConfig{{ID: "hall/temp"}, {ID: "hall/relay"}, {ID: "frigate/person/hall"}, {ID: "frigate/person/door"}}},
+			{ID: "lab", Entities: []EntityConfig{{ID: "lab/co2"}}},
+		},
+	}
+	setConfig(cfg)
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "hall/temp", Type: VdevTypeTemperature},
+		{ID: "hall/relay", Type: VdevTypeRelay},
+		{ID: "frigate/person/hall", Type: VdevTypePerson},
+		{ID: "frigate/person/door", Type: VdevTypePerson},
+		{ID: "snapshot/hall", Type: VdevTypeCameraSnapshot},
+	})
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	start := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli()
+	recordStates(t, vdevHistoryRepo, "hall/temp", VdevTypeTemperature, start, "20", "21", `"unavailable"`, "22", "23")
+	recordStates(t, vdevHistoryRepo, "hall/relay", VdevTypeRelay, start, `"ON"`, `"OFF"`)
+	recordStates(t, vdevHistoryRepo, "frigate/person/hall", VdevTypePerson, start, "1", "0")
+	recordStates(t, vdevHistoryRepo, "frigate/person/door", VdevTypePerson, start+500, "2")
+
+	app := fiber.New()
+	registerGrafanaRoutes(app, cfg)
+	return app
+}
+
+// postGrafana posts body to the Grafana endpoint with the token and decodes
+// the response into v.
+func postGrafana(t *testing.T, app *fiber.App, path, token, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/grafana"+path, strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == fiber.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestGrafanaAuth(t *testing.T) {
+	app := setupGrafanaTest(t)
+	for _, token := range []string{"", "wrong"} {
+		if status := postGrafana(t, app, "/search", token, `{}`, nil); status != fiber.StatusUnauthorized {
+			t.Errorf("token %q: status %d", token, status)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/grafana/", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer secret")
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("connection test: %v, %v", resp, err)
+	}
+
+	// Nothing is served without grafana configured.
+	app = fiber.New()
+	registerGrafanaRoutes(app, &Config{})
+	if status := postGrafana(t, app, "/search", "secret", `{}`, nil); status != fiber.StatusNotFound {
+		t.Fatalf("unconfigured: status %d", status)
+	}
+}
+
+func TestGrafanaSearch(t *testing.T) {
+	app := setupGrafanaTest(t)
+	var targets []string
+	postGrafana(t, app, "/search", "secret", `{"target": ""}`, &targets)
+	want := []string{"frigate/person/door", "frigate/person/hall", "hall/relay", "hall/temp", "rooms/hall/people"}
+	if !slices.Equal(targets, want) {
+		t.Fatalf("targets %v, want %v", targets, want)
+	}
+	postGrafana(t, app, "/search", "secret", `{"target": "PEOPLE"}`, &targets)
+	if !slices.Equal(targets, []string{"rooms/hall/people"}) {
+		t.Fatalf("filtered %v", targets)
+	}
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	app := setupGrafanaTest(t)
+	query := func(from, to string, maxPoints int, targets ...string) (int, []grafanaSeries) {
+		t.Helper()
+		req := map[string]any{"range": map[string]string{"from": from, "to": to}, "maxDataPoints": maxPoints}
+		var ts []map[string]string
+		for _, target := range targets {
+			ts = append(ts, map[string]string{"target": target, "refId": "A", "type": "timeserie"})
+		}
+		req["targets"] = ts
+		body, _ := json.Marshal(req)
+		var series []grafanaSeries
+		status := postGrafana(t, app, "/query", "secret", string(body), &series)
+		return status, series
+	}
+
+	status, series := query("2026-01-02T00:00:00Z", "2026-01-02T00:00:04Z", 100, "hall/temp", "hall/relay", "rooms/hall/people")
+	if status != fiber.StatusOK || len(series) != 3 {
+		t.Fatalf("status %d, series %+v", status, series)
+	}
+	start := float64(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli())
+	for i, want := range [][]grafanaPoint{
+		// Non-numeric states are skipped; the range end is included.
+		{{20, start}, {21, start + 1000}, {22, start + 3000}, {23, start + 4000}},
+		{{1, start}, {0, start + 1000}},
+		// The most people either camera counts.
+		{{1, start}, {2, start + 500}, {2, start + 1000}},
+	} {
+		if !slices.Equal(series[i].Datapoints, want) {
+			t.Errorf("%s: %v, want %v", series[i].Target, series[i].Datapoints, want)
+		}
+	}
+
+	// Downsampled into two 2s buckets.
+	_, series = query("2026-01-02T00:00:00Z", "2026-01-02T00:00:04Z", 2, "hall/temp")
+	if want := []grafanaPoint{{20.5, start}, {22.5, start + 2000}}; !slices.Equal(series[0].Datapoints, want) {
+		t.Errorf("downsampled %v, want %v", series[0].Datapoints, want)
+	}
+	// Only the range is served.
+	_, series = query("2026-01-02T00:00:01Z", "2026-01-02T00:00:03Z", 100, "hall/temp")
+	if want := []grafanaPoint{{21, start + 1000}, {22, start + 3000}}; !slices.Equal(series[0].Datapoints, want) {
+		t.Errorf("range %v, want %v", series[0].Datapoints, want)
+	}
+	_, series = query("2026-01-03T00:00:00Z", "2026-01-04T00:00:00Z", 100, "hall/temp")
+	if series[0].Datapoints == nil || len(series[0].Datapoints) != 0 {
+		t.Errorf("empty range %v", series[0].Datapoints)
+	}
+
+	for _, tc := range [][]string{
+		{"2026-01-02T00:00:00Z", "2026-01-02T00:00:04Z", "lab/co2"},
+		{"2026-01-02T00:00:00Z", "2026-01-02T00:00:04Z", "rooms/lab/temperature"},
+		{"yesterday", "2026-01-02T00:00:04Z", "hall/temp"},
+	} {
+		if status, _ := query(tc[0], tc[1], 100, tc[2]); status != fiber.StatusBadRequest {
+			t.Errorf("%v: status %d", tc, status)
+		}
+	}
+}
+
+func TestGrafanaAnnotations(t *testing.T) {
+	app := setupGrafanaTest(t)
+	fired := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	co2 := Alert{Rule: "co2_high", DeviceID: "lab/co2", Severity: "warning", Message: "CO2 at 1500 ppm", FiredAt: fired}
+	grafanaAnnotations.AlertFired(co2)
+	repeat := co2
+	repeat.Repeat = 1
+	grafanaAnnotations.AlertFired(repeat)
+	co2.ResolvedAt = fired.Add(time.Hour)
+	grafanaAnnotations.AlertResolved(co2)
+	grafanaAnnotations.AlertFired(Alert{Rule: "gas_detected", DeviceID: "hall/gas", Severity: "critical", Message: "Gas!", FiredAt: fired.Add(30 * time.Minute)})
+
+	var annotations []struct {
+		Annotation map[string]any `json:"annotation"`
+		Time       int64          `json:"time"`
+		Title      string         `json:"title"`
+		Tags       []string       `json:"tags"`
+		Text       string         `json:"text"`
+	}
+	status := postGrafana(t, app, "/annotations", "secret", `{"range": {"from": "2026-01-02T00:00:00Z", "to": "2026-01-03T00:00:00Z"}, "annotation": {"name": "alerts", "enable": true}}`, &annotations)
+	if status != fiber.StatusOK || len(annotations) != 3 {
+		t.Fatalf("status %d, annotations %+v", status, annotations)
+	}
+	if a := annotations[0]; a.Time != fired.UnixMilli() || a.Title != "co2_high firing: lab/co2" || a.Text != "CO2 at 1500 ppm" || !slices.Equal(a.Tags, []string{"co2_high", "warning", "firing"}) || a.Annotation["name"] != "alerts" {
+		t.Errorf("fired %+v", a)
+	}
+	if a := annotations[2]; a.Time != fired.Add(time.Hour).UnixMilli() || a.Title != "co2_high resolved: lab/co2" {
+		t.Errorf("resolved %+v", a)
+	}
+
+	postGrafana(t, app, "/annotations", "secret", `{"range": {"from": "2026-01-02T10:15:00Z", "to": "2026-01-03T00:00:00Z"}, "annotation": {"query": "co2"}}`, &annotations)
+	if len(annotations) != 1 || annotations[0].Title != "co2_high resolved: lab/co2" {
+		t.Fatalf("filtered %+v", annotations)
+	}
+}
+
+func TestAlertHistoryLimit(t *testing.T) {
+	h := &alertHistory{}
+	start := time.Unix(0, 0)
+	for i := range alertHistoryLimit + 10 {
+		h.AlertFired(Alert{Rule: "r", FiredAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	events := h.between(start, start.Add(time.Hour))
+	if len(events) != alertHistoryLimit || !events[0].alert.FiredAt.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("%d events from %v", len(events), events[0].alert.FiredAt)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/gofrs/uuid/v5"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// haImportBatchSize is how many states are inserted per statement.
+const haImportBatchSize = 1000
+
+// haImportProgressEvery is how many Home Assistant rows are read between
+// progress lines.
+const haImportProgressEvery = 100_000
+
+// haImportTypes are the device types whose Home Assistant states can be
+// converted: plain numbers and on/off.
+var haImportTypes = []VdevType{
+	VdevTypeRelay, VdevTypeContact, VdevTypePerson, VdevTypeTemperature, VdevTypeHumidity,
+	VdevTypePowerUsage, VdevTypeCo, VdevTypeCO2, VdevTypeGas, VdevTypeBattery,
+	VdevTypeNoiseLevel, VdevTypeWaterMeter, VdevTypeGasMeter,
+}
+
+// haEntityMapping is an entry of the -entity-map file, keyed by the Home
+// Assistant entity_id:
+//
+//	sensor.hall_temperature: {device: hall/temperature, type: temperature}
+type haEntityMapping struct {
+	Device string `yaml:"device"`
+	// Type is needed only for devices that at2 has not recorded yet; for
+	// the others it must match.
+	Type VdevType `yaml:"type"`
+}
+
+// haImportStats counts what happened to the rows of one entity.
+type haImportStats struct {
+	Read        int
+	Imported    int
+	Duplicates  int // already in the history, from an earlier run
+	Unchanged   int // same state as the row before
+	Unconverted int // unavailable, unknown or not a value of the device type
+}
+
+func (s *haImportStats) add(o haImportStats) {
+	s.Read += o.Read
+	s.Imported += o.Imported
+	s.Duplicates += o.Duplicates
+	s.Unchanged += o.Unchanged
+	s.Unconverted += o.Unconverted
+}
+
+func (s haImportStats) String() string {
+	return fmt.Sprintf("%d read, %d imported, %d already present, %d unchanged, %d not convertible",
+		s.Read, s.Imported, s.Duplicates, s.Unchanged, s.Unconverted)
+}
+
+// runImportHA imports the history of the entities in the map file from the
+// Home Assistant recorder database at haPath into the at2 database, as
+// -import-ha does, writing progress to w and returning the exit code. With
+// dryRun the at2 database is not written to.
+func runImportHA(haPath, entityMapPath string, dryRun bool, w io.Writer) int {
+	if entityMapPath == "" {
+		fmt.Fprintln(w, "-import-ha needs -entity-map")
+		return 2
+	}
+	entities, err := loadHAEntityMap(entityMapPath)
+	if err != nil {
+		fmt.Fprintf(w, "Reading the entity map: %v\n", err)
+		return 1
+	}
+	if _, err := os.Stat(haPath); err != nil {
+		fmt.Fprintf(w, "Opening the Home Assistant database: %v\n", err)
+		return 1
+	}
+	quiet := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+	ha, err := gorm.Open(sqlite.Open("file:"+haPath+"?mode=ro"), quiet)
+	if err != nil {
+		fmt.Fprintf(w, "Opening the Home Assistant database: %v\n", err)
+		return 1
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(w, "Loading the config: %v\n", err)
+		return 1
+	}
+	db, err := gorm.Open(sqlite.Open(cfg.Database.Path), quiet)
+	if err != nil {
+		fmt.Fprintf(w, "Opening the database: %v\n", err)
+		return 1
+	}
+	if err := AutoMigrateModels(db); err != nil {
+		fmt.Fprintf(w, "Migrating the database: %v\n", err)
+		return 1
+	}
+
+	if dryRun {
+		fmt.Fprintf(w, "Dry run: reading %s, nothing is written to %s\n", haPath, cfg.Database.Path)
+	} else {
+		fmt.Fprintf(w, "Importing %s into %s\n", haPath, cfg.Database.Path)
+	}
+	total, err := importHAHistory(ha, db, entities, dryRun, w)
+	fmt.Fprintf(w, "Total: %s\n", total)
+	if err != nil {
+		fmt.Fprintf(w, "Import failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// loadHAEntityMap reads and checks the -entity-map file.
+func loadHAEntityMap(path string) (map[string]haEntityMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entities map[string]haEntityMapping
+	if err := yaml.UnmarshalWithOptions(data, &entities, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no entities in %s", path)
+	}
+	devices := make(map[string]string)
+	for entityID, m := range entities {
+		if m.Device == "" {
+			return nil, fmt.Errorf("%s: device is required in %s", entityID, path)
+		}
+		if m.Type != "" && !slices.Contains(haImportTypes, m.Type) {
+			return nil, fmt.Errorf("%s: type %q cannot be imported in %s (supported: %v)", entityID, m.Type, path, haImportTypes)
+		}
+		if other, ok := devices[m.Device]; ok {
+			return nil, fmt.Errorf("%s and %s both map to device %s in %s", other, entityID, m.Device, path)
+		}
+		devices[m.Device] = entityID
+	}
+	return entities, nil
+}
+
+// importHAHistory copies the states of the mapped entities from the Home
+// Assistant database ha to the at2 database db, entity by entity. States
+// with a timestamp the device already has are skipped, so that a re-run
+// imports only what is new. Returns the counts over all entities.
+func importHAHistory(ha, db *gorm.DB, entities map[string]haEntityMapping, dryRun bool, w io.Writer) (haImportStats, error) {
+	var total haImportStats
+	if !ha.Migrator().HasTable("states_meta") {
+		return total, errors.New("no states_meta table: the recorder schema of Home Assistant 2023.4 or newer is needed")
+	}
+	// The days with imported people counts, whose cached usage statistics
+	// are stale now.
+	var firstPerson, lastPerson int64 = math.MaxInt64, math.MinInt64
+	for _, entityID := range slices.Sorted(maps.Keys(entities)) {
+		m := entities[entityID]
+		stats, span, err := importHAEntity(ha, db, entityID, m, dryRun, w)
+		total.add(stats)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", entityID, err)
+		}
+		fmt.Fprintf(w, "%s -> %s: %s\n", entityID, m.Device, stats)
+		if span.typ == VdevTypePerson && stats.Imported > 0 {
+			firstPerson = min(firstPerson, span.first)
+			lastPerson = max(lastPerson, span.last)
+		}
+	}
+	if !dryRun && firstPerson <= lastPerson {
+		// The cache is keyed by local date; a day either side covers any
+		// difference between the zone here and the one of the server.
+		from := time.UnixMilli(firstPerson).AddDate(0, 0, -1).Format("2006-01-02")
+		to := time.UnixMilli(lastPerson).AddDate(0, 0, 1).Format("2006-01-02")
+		if err := db.Where("date BETWEEN ? AND ?", from, to).Delete(&UsageStatsDayCache{}).Error; err != nil {
+			return total, fmt.Errorf("clearing the usage statistics cache: %w", err)
+		}
+	}
+	return total, nil
+}
+
+// haImportSpan is the device type and the timestamp range of what was
+// imported for an entity.
+type haImportSpan struct {
+	typ         VdevType
+	first, last int64
+}
+
+// importHAEntity imports the states of one entity, in chronological order.
+func importHAEntity(ha, db *gorm.DB, entityID string, m haEntityMapping, dryRun bool, w io.Writer) (haImportStats, haImportSpan, error) {
+	var stats haImportStats
+	span := haImportSpan{typ: m.Type, first: math.MaxInt64, last: math.MinInt64}
+
+	var device VirtualDeviceModel
+	err := db.Where("name = ?", m.Device).Take(&device).Error
+	switch {
+	case err == nil:
+		if m.Type != "" && VdevType(device.Type) != m.Type {
+			return stats, span, fmt.Errorf("device %s is a %s, not a %s", m.Device, device.Type, m.Type)
+		}
+		span.typ = VdevType(device.Type)
+		if !slices.Contains(haImportTypes, span.typ) {
+			return stats, span, fmt.Errorf("device %s is a %s, which cannot be imported", m.Device, device.Type)
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if m.Type == "" {
+			return stats, span, fmt.Errorf("device %s is not in the database yet, so its type is required", m.Device)
+		}
+		device = VirtualDeviceModel{Name: m.Device, Type: string(m.Type)}
+		if !dryRun {
+			if err := db.Create(&device).Error; err != nil {
+				return stats, span, err
+			}
+		}
+	default:
+		return stats, span, err
+	}
+
+	// The timestamps the device already has; a state at one of them was
+	// imported before or recorded live.
+	present := make(map[int64]struct{})
+	if device.ID != 0 {
+		var timestamps []int64
+		if err := db.Model(&VirtualDeviceStateModel{}).Where("virtual_device_id = ?", device.ID).Pluck("timestamp", &timestamps).Error; err != nil {
+			return stats, span, err
+		}
+		for _, ts := range timestamps {
+			present[ts] = struct{}{}
+		}
+	}
+
+	rows, err := ha.Raw(`SELECT s.state, s.last_updated_ts FROM states s
+		JOIN states_meta m ON m.metadata_id = s.metadata_id
+		WHERE m.entity_id = ? AND s.last_updated_ts IS NOT NULL
+		ORDER BY s.last_updated_ts, s.state_id`, entityID).Rows()
+	if err != nil {
+		return stats, span, err
+	}
+	defer rows.Close()
+
+	// UUIDv7s from one generator are ordered by their timestamps, so the
+	// imported IDs sort like the states they belong to.
+	gen := uuid.NewGen()
+	batch := make([]VirtualDeviceStateModel, 0, haImportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 || dryRun {
+			batch = batch[:0]
+			return nil
+		}
+		err := db.Create(&batch).Error
+		batch = batch[:0]
+		return err
+	}
+
+	var previous string
+	for rows.Next() {
+		var state *string
+		var updated float64
+		if err := rows.Scan(&state, &updated); err != nil {
+			return stats, span, err
+		}
+		stats.Read++
+		if stats.Read%haImportProgressEvery == 0 {
+			fmt.Fprintf(w, "%s: %d rows read\n", entityID, stats.Read)
+		}
+
+		value, ok := convertHAState(span.typ, state)
+		if !ok {
+			stats.Unconverted++
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return stats, span, err
+		}
+		if string(encoded) == previous {
+			stats.Unchanged++
+			continue
+		}
+		previous = string(encoded)
+
+		ts := int64(math.Round(updated * 1000))
+		if _, ok := present[ts]; ok {
+			stats.Duplicates++
+			continue
+		}
+		present[ts] = struct{}{}
+		id, err := gen.NewV7AtTime(time.UnixMilli(ts))
+		if err != nil {
+			return stats, span, err
+		}
+		batch = append(batch, VirtualDeviceStateModel{
+			ID:              id.String(),
+			Timestamp:       ts,
+			VirtualDeviceID: device.ID,
+			State:           previous,
+		})
+		stats.Imported++
+		span.first, span.last = min(span.first, ts), max(span.last, ts)
+		if len(batch) == haImportBatchSize {
+			if err := flush(); err != nil {
+				return stats, span, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return stats, span, err
+	}
+	return stats, span, flush()
+}
+
+// convertHAState converts a Home Assistant state to the state of an at2
+// device of type typ. Unavailable and unknown states, and anything else
+// that is not a value of the type, are not converted.
+func convertHAState(typ VdevType, state *string) (any, bool) {
+	if state == nil {
+		return nil, false
+	}
+	switch typ {
+	case VdevTypeRelay:
+		switch *state {
+		case "on":
+			return "ON", true
+		case "off":
+			return "OFF", true
+		}
+	case VdevTypeContact:
+		// Home Assistant door sensors are on when open; at2 contacts are
+		// true when closed.
+		switch *state {
+		case "on":
+			return false, true
+		case "off":
+			return true, true
+		}
+	case VdevTypePerson:
+		if n, err := strconv.ParseFloat(*state, 64); err == nil && n >= 0 && n <= math.MaxInt32 {
+			return int(n), true
+		}
+	default:
+		if f, err := strconv.ParseFloat(*state, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f, true
+		}
+	}
+	return nil, false
+}
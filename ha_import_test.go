@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"gorm.io/gorm"
+)
+
+// openHAFixture creates a Home Assistant recorder database from
+// testdata/ha_recorder.sql.
+func openHAFixture(t *testing.T) *gorm.DB {
+	t.Helper()
+	schema, err := os.ReadFile("testdata/ha_recorder.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ha := openTestDBFile(t, filepath.Join(t.TempDir(), "home-assistant_v2.db"))
+	if err := ha.Exec(string(schema)).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ha
+}
+
+var testHAEntities = map[string]haEntityMapping{
+	"sensor.hall_temperature":  {Device: "hall/temperature", Type: VdevTypeTemperature},
+	"switch.hall_light":        {Device: "hall/light"},
+	"binary_sensor.front_door": {Device: "front/door", Type: VdevTypeContact},
+	"sensor.hall_people":       {Device: "hall/people", Type: VdevTypePerson},
+}
+
+// setupHAImportTest returns the fixture and an at2 database where
+// hall/light already has a live state.
+func setupHAImportTest(t *testing.T) (ha, db *gorm.DB) {
+	t.Helper()
+	ha = openHAFixture(t)
+	db = openTestDBFile(t, filepath.Join(t.TempDir(), "at2.db"))
+	if err := AutoMigrateModels(db); err != nil {
+		t.Fatal(err)
+	}
+	light := VirtualDeviceModel{Name: "hall/light", Type: string(VdevTypeRelay)}
+	if err := db.Create(&light).Error; err != nil {
+		t.Fatal(err)
+	}
+	live := VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: time.Now().UnixMilli(), VirtualDeviceID: light.ID, State: `"OFF"`}
+	if err := db.Create(&live).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ha, db
+}
+
+type importedState struct {
+	ts    int64
+	state string
+}
+
+func importedStates(t *testing.T, db *gorm.DB, device string) []importedState {
+	t.Helper()
+	var states []VirtualDeviceStateModel
+	err := db.Joins("VirtualDevice").Where("VirtualDevice.name = ?", device).Order("virtual_device_state_models.id").Find(&states).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []importedState
+	for _, s := range states {
+		id := uuid.FromStringOrNil(s.ID)
+		if id.Version() != uuid.V7 {
+			t.Errorf("%s: ID %s is not a UUIDv7", device, s.ID)
+		}
+		ts, _ := uuid.TimestampFromV7(id)
+		if at, _ := ts.Time(); at.UnixMilli() != s.Timestamp {
+			t.Errorf("%s: ID %s has time %v, the state %d", device, s.ID, at, s.Timestamp)
+		}
+		got = append(got, importedState{s.Timestamp, s.State})
+	}
+	return got
+}
+
+func TestImportHAHistory(t *testing.T) {
+	ha, db := setupHAImportTest(t)
+	stats, err := importHAHistory(ha, db, testHAEntities, false, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (haImportStats{Read: 14, Imported: 10, Unchanged: 2, Unconverted: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	const base = 1709251200000
+	for device, want := range map[string][]importedState{
+		"hall/temperature": {{base, "21.5"}, {base + 180500, "22"}},
+		"front/door":       {{base + 300000, "false"}, {base + 360000, "true"}},
+		"hall/people":      {{base, "0"}, {base + 3600000, "2"}, {base + 7200000, "1"}},
+	} {
+		if got := importedStates(t, db, device); !slices.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", device, got, want)
+		}
+	}
+	// The imported states sort before the live one, by ID as by time.
+	light := importedStates(t, db, "hall/light")
+	if len(light) != 4 || light[3].state != `"OFF"` {
+		t.Fatalf("hall/light = %v, want 3 imported states and the live one", light)
+	}
+	if want := []importedState{{base, `"ON"`}, {base + 1200000, `"OFF"`}, {base + 1800000, `"ON"`}}; !slices.Equal(light[:3], want) {
+		t.Errorf("hall/light = %v, want %v first", light, want)
+	}
+	var contact VirtualDeviceModel
+	db.Where("name = ?", "front/door").Take(&contact)
+	if contact.Type != string(VdevTypeContact) {
+		t.Errorf("front/door type = %q, want contact", contact.Type)
+	}
+
+	// A second run finds everything already imported.
+	var before int64
+	db.Model(&VirtualDeviceStateModel{}).Count(&before)
+	stats, err = importHAHistory(ha, db, testHAEntities, false, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (haImportStats{Read: 14, Duplicates: 10, Unchanged: 2, Unconverted: 2}); stats != want {
+		t.Errorf("second run stats = %+v, want %+v", stats, want)
+	}
+	var after int64
+	db.Model(&VirtualDeviceStateModel{}).Count(&after)
+	if after != before {
+		t.Errorf("second run: %d states, want %d", after, before)
+	}
+}
+
+func TestImportHAHistoryDryRun(t *testing.T) {
+	ha, db := setupHAImportTest(t)
+	var out strings.Builder
+	stats, err := importHAHistory(ha, db, testHAEntities, true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (haImportStats{Read: 14, Imported: 10, Unchanged: 2, Unconverted: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+	want := "sensor.hall_temperature -> hall/temperature: 5 read, 2 imported, 0 already present, 1 unchanged, 2 not convertible\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("output %q does not contain %q", out.String(), want)
+	}
+	var devices, states int64
+	db.Model(&VirtualDeviceModel{}).Count(&devices)
+	db.Model(&VirtualDeviceStateModel{}).Count(&states)
+	if devices != 1 || states != 1 {
+		t.Errorf("dry run left %d devices and %d states, want the 1 and 1 there were", devices, states)
+	}
+}
+
+func TestImportHAHistoryClearsUsageCache(t *testing.T) {
+	ha, db := setupHAImportTest(t)
+	for _, date := range []string{"2024-02-20", "2024-03-01", "2024-05-01"} {
+		db.Create(&UsageStatsDayCache{RoomID: "hall", Date: date, HourlyData: "[]"})
+	}
+	if _, err := importHAHistory(ha, db, testHAEntities, false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var dates []string
+	db.Model(&UsageStatsDayCache{}).Order("date").Pluck("date", &dates)
+	if want := []string{"2024-02-20", "2024-05-01"}; !slices.Equal(dates, want) {
+		t.Errorf("cached days = %v, want %v", dates, want)
+	}
+}
+
+func TestImportHAHistoryErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		entities map[string]haEntityMapping
+		want     string
+	}{
+		"type mismatch": {
+			map[string]haEntityMapping{"switch.hall_light": {Device: "hall/light", Type: VdevTypeContact}},
+			"device hall/light is a relay, not a contact",
+		},
+		"new device without type": {
+			map[string]haEntityMapping{"sensor.hall_temperature": {Device: "hall/temperature"}},
+			"device hall/temperature is not in the database yet",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ha, db := setupHAImportTest(t)
+			_, err := importHAHistory(ha, db, tc.entities, false, io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+
+	t.Run("old schema", func(t *testing.T) {
+		ha := openTestDBFile(t, filepath.Join(t.TempDir(), "home-assistant_v2.db"))
+		ha.Exec("CREATE TABLE states (state_id INTEGER PRIMARY KEY, entity_id VARCHAR(255), state VARCHAR(255))")
+		_, err := importHAHistory(ha, ha, testHAEntities, true, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "no states_meta table") {
+			t.Errorf("err = %v, want no states_meta table", err)
+		}
+	})
+}
+
+func TestLoadHAEntityMap(t *testing.T) {
+	for name, tc := range map[string]struct {
+		yaml string
+		want string
+	}{
+		"ok":            {"sensor.a: {device: a/temp, type: temperature}\nswitch.b: {device: b/light}\n", ""},
+		"empty":         {"{}\n", "no entities"},
+		"no device":     {"sensor.a: {type: temperature}\n", "sensor.a: device is required"},
+		"bad type":      {"camera.a: {device: a/cam, type: camera_snapshot}\n", `type "camera_snapshot" cannot be imported`},
+		"unknown field": {"sensor.a: {device: a/temp, kind: temperature}\n", "kind"},
+		"same device":   {"sensor.a: {device: a/temp}\nsensor.b: {device: a/temp}\n", "both map to device a/temp"},
+		"not a mapping": {"- sensor.a\n", "parsing"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entities.yaml")
+			if err := os.WriteFile(path, []byte(tc.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadHAEntityMap(path)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("err = %v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestConvertHAState(t *testing.T) {
+	for _, tc := range []struct {
+		typ   VdevType
+		state string
+		want  any
+	}{
+		{VdevTypeRelay, "on", "ON"},
+		{VdevTypeRelay, "off", "OFF"},
+		{VdevTypeRelay, "1", nil},
+		{VdevTypeContact, "on", false},
+		{VdevTypeContact, "off", true},
+		{VdevTypePerson, "3", 3},
+		{VdevTypePerson, "-1", nil},
+		{VdevTypeTemperature, "21.25", 21.25},
+		{VdevTypeTemperature, "NaN", nil},
+		{VdevTypePowerUsage, "unavailable", nil},
+		{VdevTypeHumidity, "unknown", nil},
+	} {
+		got, ok := convertHAState(tc.typ, &tc.state)
+		if got != tc.want || ok != (tc.want != nil) {
+			t.Errorf("convertHAState(%s, %q) = %v, %v, want %v", tc.typ, tc.state, got, ok, tc.want)
+		}
+	}
+	if _, ok := convertHAState(VdevTypeTemperature, nil); ok {
+		t.Error("a NULL state was converted")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultFrigateMaxAge is how long ago the last successful Frigate
+	// request may be before Frigate counts as down. Snapshots are fetched
+	// every minute.
+	defaultFrigateMaxAge = 5 * time.Minute
+	// defaultHistoryMaxBacklog is how many state changes may wait for the
+	// history writer before it counts as down.
+	defaultHistoryMaxBacklog = 100
+	// readinessCheckTimeout bounds each component check.
+	readinessCheckTimeout = 2 * time.Second
+)
+
+// HealthConfig sets the thresholds of GET /readyz.
+type HealthConfig struct {
+	// FrigateMaxAge is a Go duration: Frigate is down when no request to it
+	// succeeded for this long. Default "5m".
+	FrigateMaxAge string `yaml:"frigate_max_age"`
+	// HistoryMaxBacklog is the number of state changes waiting for the
+	// history writer above which it is down. Default 100.
+	HistoryMaxBacklog int `yaml:"history_max_backlog"`
+}
+
+// validateHealthConfig fails fast on thresholds that can't be used.
+func validateHealthConfig(cfg *Config, cfgPath string) error {
+	if v := cfg.Health.FrigateMaxAge; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("health.frigate_max_age is not a valid duration (%q) in %s", v, cfgPath)
+		}
+	}
+	if cfg.Health.HistoryMaxBacklog < 0 {
+		return fmt.Errorf("health.history_max_backlog must not be negative in %s", cfgPath)
+	}
+	return nil
+}
+
+// healthCheck is one component checked by GET /readyz. A failing critical
+// component makes the server not ready.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// ComponentStatus is the result of one healthCheck.
+type ComponentStatus struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReadinessReport is the GET /readyz body. Failing lists the critical
+// components that are down.
+type ReadinessReport struct {
+	Ready      bool              `json:"ready"`
+	Components []ComponentStatus `json:"components"`
+	Failing    []string          `json:"failing,omitempty"`
+}
+
+// checkReadiness runs checks one after another.
+func checkReadiness(ctx context.Context, checks []healthCheck) ReadinessReport {
+	report := ReadinessReport{Ready: true, Components: make([]ComponentStatus, 0, len(checks))}
+	for _, hc := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		err := hc.check(checkCtx)
+		cancel()
+
+		status := ComponentStatus{Name: hc.name, OK: err == nil, Critical: hc.critical}
+		if err != nil {
+			status.Error = err.Error()
+			if hc.critical {
+				report.Ready = false
+				report.Failing = append(report.Failing, hc.name)
+			}
+		}
+		report.Components = append(report.Components, status)
+	}
+	return report
+}
+
+// readinessChecks checks the running services: MQTT, the database and the
+// history writer are critical, Frigate (only checked when configured) isn't.
+func readinessChecks(cfg *Config) []healthCheck {
+	checks := []healthCheck{
+		{name: "mqtt", critical: true, check: func(context.Context) error {
+			if mqttAdapter == nil || !mqttAdapter.IsConnected() {
+				return errors.New("not connected")
+			}
+			return nil
+		}},
+		{name: "database", critical: true, check: func(ctx context.Context) error {
+			if gormDB == nil {
+				return errors.New("not initialized")
+			}
+			sqlDB, err := gormDB.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		}},
+		{name: "history", critical: true, check: func(context.Context) error {
+			if vdevHistoryRepo == nil {
+				return errors.New("not initialized")
+			}
+			return checkHistoryBacklog(vdevHistoryRepo.Backlog(), cfg.Health.HistoryMaxBacklog)
+		}},
+	}
+	if cfg.Frigate.Url != "" {
+		checks = append(checks, healthCheck{name: "frigate", check: func(context.Context) error {
+			if frigateSnapshotMapper == nil {
+				return errors.New("not initialized")
+			}
+			return checkFrigateAge(frigateSnapshotMapper.LastSuccess(), time.Now(), cfg.Health.FrigateMaxAge)
+		}})
+	}
+	return checks
+}
+
+// checkFrigateAge fails when the last successful Frigate request is older
+// than maxAge (default defaultFrigateMaxAge).
+func checkFrigateAge(last, now time.Time, maxAge string) error {
+	limit := defaultFrigateMaxAge
+	if d, err := time.ParseDuration(maxAge); err == nil {
+		limit = d
+	}
+	if last.IsZero() {
+		return errors.New("no successful request yet")
+	}
+	if age := now.Sub(last); age > limit {
+		return fmt.Errorf("last successful request %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// checkHistoryBacklog fails when more than limit (default
+// defaultHistoryMaxBacklog) state changes wait for the history writer.
+func checkHistoryBacklog(backlog int64, limit int) error {
+	if limit == 0 {
+		limit = defaultHistoryMaxBacklog
+	}
+	if backlog > int64(limit) {
+		return fmt.Errorf("%d state changes waiting to be written", backlog)
+	}
+	return nil
+}
+
+// newReadyzHandler serves GET /readyz, running the checks returned by checks
+// on every request. It answers 503 when a critical component is down.
+func newReadyzHandler(checks func() []healthCheck) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		report := checkReadiness(c.Context(), checks())
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		if !report.Ready {
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func stubCheck(name string, critical bool, err error) healthCheck {
+	return healthCheck{name: name, critical: critical, check: func(context.Context) error { return err }}
+}
+
+func getReadyz(t *testing.T, checks ...healthCheck) (int, ReadinessReport) {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/readyz", newReadyzHandler(func() []healthCheck { return checks }))
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ReadinessReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, report
+}
+
+func TestReadyz_Healthy(t *testing.T) {
+	status, report := getReadyz(t,
+		stubCheck("mqtt", true, nil),
+		stubCheck("database", true, nil),
+		stubCheck("frigate", false, nil),
+	)
+	if status != fiber.StatusOK || !report.Ready || len(report.Failing) != 0 || len(report.Components) != 3 {
+		t.Fatalf("status %d, report %+v", status, report)
+	}
+}
+
+func TestReadyz_CriticalDown(t *testing.T) {
+	status, report := getReadyz(t,
+		stubCheck("mqtt", true, errors.New("not connected")),
+		stubCheck("database", true, nil),
+		stubCheck("history", true, errors.New("500 state changes waiting to be written")),
+	)
+	if status != fiber.StatusServiceUnavailable || report.Ready {
+		t.Fatalf("status %d, report %+v", status, report)
+	}
+	if want := []string{"mqtt", "history"}; !reflect.DeepEqual(report.Failing, want) {
+		t.Fatalf("failing = %v, want %v", report.Failing, want)
+	}
+	if want := (ComponentStatus{Name: "mqtt", Critical: true, Error: "not connected"}); report.Components[0] != want {
+		t.Fatalf("mqtt = %+v", report.Components[0])
+	}
+}
+
+func TestReadyz_NonCriticalDown(t *testing.T) {
+	status, report := getReadyz(t,
+		stubCheck("mqtt", true, nil),
+		stubCheck("frigate", false, errors.New("no successful request yet")),
+	)
+	if status != fiber.StatusOK || !report.Ready || len(report.Failing) != 0 {
+		t.Fatalf("status %d, report %+v", status, report)
+	}
+	if c := report.Components[1]; c.OK || c.Error == "" {
+		t.Fatalf("frigate = %+v", c)
+	}
+}
+
+func TestReadinessChecks_Unavailable(t *testing.T) {
+	prevMQTT, prevDB, prevRepo, prevMapper := mqttAdapter, gormDB, vdevHistoryRepo, frigateSnapshotMapper
+	t.Cleanup(func() {
+		mqttAdapter, gormDB, vdevHistoryRepo, frigateSnapshotMapper = prevMQTT, prevDB, prevRepo, prevMapper
+	})
+	mqttAdapter, gormDB, vdevHistoryRepo, frigateSnapshotMapper = nil, nil, nil, nil
+
+	report := checkReadiness(context.Background(), readinessChecks(&Config{Frigate: FrigateConfig{Url: "http://frigate:5000"}}))
+	if want := []string{"mqtt", "database", "history"}; report.Ready || !reflect.DeepEqual(report.Failing, want) {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(report.Components) != 4 || report.Components[3].Name != "frigate" || report.Components[3].OK {
+		t.Fatalf("components = %+v", report.Components)
+	}
+
+	// Without frigate.url, Frigate isn't checked.
+	if report := checkReadiness(context.Background(), readinessChecks(&Config{})); len(report.Components) != 3 {
+		t.Fatalf("components = %+v", report.Components)
+	}
+}
+
+func TestReadinessChecks_Database(t *testing.T) {
+	setupTestDB(t)
+	for _, hc := range readinessChecks(&Config{}) {
+		if hc.name == "database" {
+			if err := hc.check(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatal("no database check")
+}
+
+func TestCheckFrigateAge(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		last   time.Time
+		maxAge string
+		ok     bool
+	}{
+		{now.Add(-time.Minute), "", true},
+		{now.Add(-10 * time.Minute), "", false},
+		{now.Add(-10 * time.Minute), "15m", true},
+		{time.Time{}, "", false},
+	} {
+		if err := checkFrigateAge(tc.last, now, tc.maxAge); (err == nil) != tc.ok {
+			t.Errorf("last %v, max age %q: err = %v", tc.last, tc.maxAge, err)
+		}
+	}
+}
+
+func TestCheckHistoryBacklog(t *testing.T) {
+	if err := checkHistoryBacklog(100, 0); err != nil {
+		t.Error(err)
+	}
+	if err := checkHistoryBacklog(101, 0); err == nil {
+		t.Error("backlog above the default accepted")
+	}
+	if err := checkHistoryBacklog(5, 3); err == nil {
+		t.Error("backlog above history_max_backlog accepted")
+	}
+}
+
+func TestValidateHealthConfig(t *testing.T) {
+	for _, tc := range []struct {
+		health HealthConfig
+		ok     bool
+	}{
+		{HealthConfig{}, true},
+		{HealthConfig{FrigateMaxAge: "10m", HistoryMaxBacklog: 50}, true},
+		{HealthConfig{FrigateMaxAge: "0s"}, false},
+		{HealthConfig{FrigateMaxAge: "soon"}, false},
+		{HealthConfig{HistoryMaxBacklog: -1}, false},
+	} {
+		if err := validateHealthConfig(&Config{Health: tc.health}, "at2.yaml"); (err == nil) != tc.ok {
+			t.Errorf("%+v: err = %v", tc.health, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultUnixSocketMode lets the socket's group (the reverse proxy) connect.
+const defaultUnixSocketMode = 0o660
+
+// UnixSocketConfig makes the web server listen on a unix socket instead of
+// web.listen_address.
+type UnixSocketConfig struct {
+	Path string `yaml:"path"`
+	// Mode is the octal permission mode of the socket file. Default "0660".
+	Mode string `yaml:"mode"`
+}
+
+// TLSConfig makes the web server serve HTTPS on web.listen_address.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func parseSocketMode(mode string) (fs.FileMode, error) {
+	if mode == "" {
+		return defaultUnixSocketMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("%q is not an octal permission mode", mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// validateListenConfig rejects listener options that can't be combined, and
+// TLS files that can't be loaded.
+func validateListenConfig(cfg *Config, cfgPath string) error {
+	web := cfg.Web
+	if web.ListenUnixSocket != nil {
+		if web.ListenUnixSocket.Path == "" {
+			return fmt.Errorf("web.listen_unix_socket.path is empty in %s", cfgPath)
+		}
+		if _, err := parseSocketMode(web.ListenUnixSocket.Mode); err != nil {
+			return fmt.Errorf("web.listen_unix_socket.mode: %v in %s", err, cfgPath)
+		}
+		if web.ListenAddress != "" {
+			return fmt.Errorf("web.listen_address and web.listen_unix_socket are mutually exclusive in %s", cfgPath)
+		}
+		if web.TLS != nil {
+			return fmt.Errorf("web.tls can't be used with web.listen_unix_socket; terminate TLS in the reverse proxy in %s", cfgPath)
+		}
+	}
+	if web.TLS != nil {
+		if web.TLS.CertFile == "" || web.TLS.KeyFile == "" {
+			return fmt.Errorf("web.tls needs both cert_file and key_file in %s", cfgPath)
+		}
+		if _, err := tls.LoadX509KeyPair(web.TLS.CertFile, web.TLS.KeyFile); err != nil {
+			return fmt.Errorf("web.tls: %v in %s", err, cfgPath)
+		}
+	}
+	return nil
+}
+
+// newWebListener opens the listener the web server serves on: the unix
+// socket, TLS on listen_address, or plain TCP on listen_address.
+func newWebListener(web WebConfig) (net.Listener, error) {
+	if web.ListenUnixSocket != nil {
+		return listenUnixSocket(*web.ListenUnixSocket)
+	}
+	ln, err := net.Listen("tcp", web.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	if web.TLS == nil {
+		return ln, nil
+	}
+	cert, err := tls.LoadX509KeyPair(web.TLS.CertFile, web.TLS.KeyFile)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}), nil
+}
+
+// listenUnixSocket listens on the socket, first removing a socket file left
+// behind by a process that didn't shut down cleanly.
+func listenUnixSocket(sc UnixSocketConfig) (net.Listener, error) {
+	mode, err := parseSocketMode(sc.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(sc.Path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", sc.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(sc.Path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path unless a process still
+// accepts connections on it. Other files are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// removeUnixSocket removes the socket file on shutdown, in case closing the
+// listener didn't.
+func removeUnixSocket(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "at2.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// serveHello serves "hello" on ln until the test ends.
+func serveHello(t *testing.T, ln net.Listener) {
+	t.Helper()
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString("hello") })
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+}
+
+func readBody(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestValidateListenConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	socket := &UnixSocketConfig{Path: filepath.Join(dir, "at2.sock")}
+
+	for _, tc := range []struct {
+		name string
+		web  WebConfig
+		err  string
+	}{
+		{"tcp", WebConfig{ListenAddress: ":8080"}, ""},
+		{"socket", WebConfig{ListenUnixSocket: socket}, ""},
+		{"tls", WebConfig{ListenAddress: ":8443", TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}}, ""},
+		{"socket and address", WebConfig{ListenAddress: ":8080", ListenUnixSocket: socket}, "mutually exclusive"},
+		{"socket and tls", WebConfig{ListenUnixSocket: socket, TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}}, "can't be used with"},
+		{"socket without path", WebConfig{ListenUnixSocket: &UnixSocketConfig{Mode: "0600"}}, "path is empty"},
+		{"bad mode", WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: socket.Path, Mode: "rw-rw----"}}, "octal"},
+		{"tls without key", WebConfig{TLS: &TLSConfig{CertFile: certFile}}, "both cert_file and key_file"},
+		{"tls missing file", WebConfig{TLS: &TLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")}}, "web.tls"},
+	} {
+		err := validateListenConfig(&Config{Web: tc.web}, "at2.yaml")
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestNewWebListener_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.sock")
+
+	// A socket file left behind by a crashed process.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := newWebListener(WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: path, Mode: "0600"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket file: %v, %v", fi.Mode(), err)
+	}
+	serveHello(t, ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	if body := readBody(t, client, "http://at2/"); body != "hello" {
+		t.Fatalf("body = %q", body)
+	}
+
+	// A socket another process still serves on isn't taken over.
+	if _, err := newWebListener(WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: path}}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestNewWebListener_NotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.sock")
+	os.WriteFile(path, []byte("not a socket"), 0o600)
+
+	if _, err := newWebListener(WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: path}}); err == nil {
+		t.Fatal("listened in place of a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "not a socket" {
+		t.Fatal("regular file was removed")
+	}
+}
+
+func TestNewWebListener_TLS(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	ln, err := newWebListener(WebConfig{ListenAddress: "127.0.0.1:0", TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveHello(t, ln)
+
+	pemCert, _ := os.ReadFile(certFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if body := readBody(t, client, "https://"+ln.Addr().String()+"/"); body != "hello" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestShutdown_RemovesUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "at2.sock")
+	ln, err := newWebListener(WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like a listener that doesn't clean up after itself.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	t.Cleanup(func() {
+		liveSubscribersMutex.Lock()
+		liveShuttingDown = false
+		liveSubscribersMutex.Unlock()
+	})
+	stack := shutdownStack{unixSocket: path}
+	if err := runShutdown(context.Background(), stack.steps(), testLogger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file still there: %v", err)
+	}
+}
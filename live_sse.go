@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// liveSseKeepaliveInterval is how often an idle SSE stream gets a comment line,
+// which keeps proxies from timing it out and surfaces dead clients on write.
+const liveSseKeepaliveInterval = 15 * time.Second
+
+// liveSseSessionExpired is the last event of a stream whose session was
+// revoked or expired, the counterpart of the websocket's close code 4001.
+// The client's reconnect is then refused with 401.
+const liveSseSessionExpired = "session_expired"
+
+// writeLiveSse writes one message as an SSE event named after its type, with
+// the protocol version 2 payload as data.
+func writeLiveSse(w *bufio.Writer, sub *liveSubscriber, msg liveMessage) error {
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	sub.recordSent()
+	return nil
+}
+
+func writeLiveSseSnapshot(w *bufio.Writer, sub *liveSubscriber) error {
+	for _, msg := range sub.snapshotMessages() {
+		if err := writeLiveSse(w, sub, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleLiveSse mirrors the live websocket feed as Server-Sent Events for
+// clients that can't speak websockets (e.g. info-beamer displays). It always
+// uses protocol version 2 semantics: room_state snapshots on connect and for
+// room-level changes, entity_update deltas otherwise. ?rooms= filters rooms
+// the same way as on the websocket, and authenticated streams end with a
+// session_expired event once their session does.
+func handleLiveSse(c *fiber.Ctx) error {
+	// The stream outlives this handler and fiber reuses the request buffer
+	// that query values point into, so copy them.
+	sub := newLiveSubscriber(liveWsProtocolV2, parseLiveRoomFilter(strings.Clone(c.Query("rooms"))))
+	sub.username, _ = c.Locals("username").(string)
+	sub.sessionID, _ = c.Locals("session_id").(string)
+	sub.transport = liveTransportSse
+	sub.remoteAddr = clientIP(c)
+	sub.log = liveLog.With("transport", liveTransportSse, "remote", sub.remoteAddr)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no") // disable nginx response buffering
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		subscribeLive(sub)
+		defer unsubscribeLive(sub)
+
+		if err := writeLiveSseSnapshot(w, sub); err != nil {
+			return
+		}
+
+		keepalive := time.NewTicker(liveSseKeepaliveInterval)
+		defer keepalive.Stop()
+
+		// Like the websocket, only streams that had to authenticate re-check
+		// their session; a nil channel never fires.
+		var sessionCheck <-chan time.Time
+		if sub.sessionID != "" && GetConfig().Web.LiveWsRequireAuth {
+			ticker := time.NewTicker(liveWsSessionCheckInterval)
+			defer ticker.Stop()
+			sessionCheck = ticker.C
+		}
+
+		// A write or flush error means the client went away.
+		for {
+			select {
+			case <-sub.closing:
+				return
+			case <-sessionCheck:
+				if !liveWsSessionValid(sub.sessionID) {
+					fmt.Fprintf(w, "event: %s\ndata: {}\n\n", liveSseSessionExpired)
+					w.Flush()
+					return
+				}
+			case <-keepalive.C:
+				if _, err := w.WriteString(": keepalive\n\n"); err != nil {
+					return
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			case <-sub.resync:
+				if err := writeLiveSseSnapshot(w, sub); err != nil {
+					return
+				}
+			case <-sub.notify:
+				for _, msg := range sub.pendingMessages() {
+					if err := writeLiveSse(w, sub, msg); err != nil {
+						return
+					}
+				}
+			case msg := <-sub.control:
+				if err := writeLiveSse(w, sub, msg); err != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type sseEvent struct {
+	name string
+	data map[string]any
+}
+
+// readSseEvent reads lines up to the next blank line, skipping comments.
+func readSseEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading SSE stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if ev.name != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data); err != nil {
+				t.Fatalf("bad SSE data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func liveSubscriberCount() int {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	return len(liveSubscribers)
+}
+
+func TestLiveSse_StreamsSnapshotAndUpdates(t *testing.T) {
+	setupLiveWsTest(t)
+	GetConfig().Rooms = append(GetConfig().Rooms, RoomConfig{
+		ID:       "lab",
+		Entities: []EntityConfig{{ID: "lab/temp"}},
+	})
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "lab/temp", Type: VdevTypeTemperature, State: 17.0}})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/live-sse", handleLiveSse)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.ShutdownWithTimeout(time.Second)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/api/v1/live-sse?rooms=hall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	if ev := readSseEvent(t, r); ev.name != liveMsgServerInfo {
+		t.Fatalf("first event = %q, want server_info", ev.name)
+	}
+	// Only the filtered room is part of the snapshot.
+	if ev := readSseEvent(t, r); ev.name != liveMsgRoomState || ev.data["id"] != "hall" {
+		t.Fatalf("unexpected snapshot event: %+v", ev)
+	}
+
+	// Updates in other rooms are filtered out, so the next event is hall's.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/temp", State: 18.0}, {Name: "hall/temp", State: 23.0}})
+	handleVirtualDeviceStateUpdate(vdevManager.Device("lab/temp"))
+	handleVirtualDeviceStateUpdate(vdevManager.Device("hall/temp"))
+	ev := readSseEvent(t, r)
+	if ev.name != liveMsgEntityUpdate || ev.data["room_id"] != "hall" {
+		t.Fatalf("unexpected update event: %+v", ev)
+	}
+	if entity := ev.data["entity"].(map[string]any); entity["state"] != 23.0 {
+		t.Fatalf("unexpected entity state: %v", entity)
+	}
+
+	// Disconnecting unregisters the subscriber on the next failed write.
+	resp.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for liveSubscriberCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber still registered after disconnect")
+		}
+		handleVirtualDeviceStateUpdate(&VirtualDevice{ID: "hall/temp", Type: VdevTypeTemperature, State: 24.0})
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLiveSse_EndsWhenSessionExpires(t *testing.T) {
+	setupTestDB(t)
+	setupLiveWsTest(t)
+	GetConfig().Web.LiveWsRequireAuth = true
+	prevInterval := liveWsSessionCheckInterval
+	t.Cleanup(func() { liveWsSessionCheckInterval = prevInterval })
+	liveWsSessionCheckInterval = 20 * time.Millisecond
+	createTestSession(t, SessionModel{ID: "s1", Subject: "local:alice", Username: "alice", IsLocal: true, ExpiresAt: time.Now().Add(300 * time.Millisecond)})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/live-sse", LiveWsAuthMiddleware, handleLiveSse)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.ShutdownWithTimeout(time.Second)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/api/v1/live-sse?token=s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	r := bufio.NewReader(resp.Body)
+	for {
+		if ev := readSseEvent(t, r); ev.name == liveSseSessionExpired {
+			break
+		}
+	}
+	// The server ends the stream after the event.
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("stream still open after session_expired")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for liveSubscriberCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber still registered after the session expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
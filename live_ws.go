@@ -1,39 +1,91 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type EntityState struct {
-	ID              string          `json:"id"`
+	ID string `json:"id"`
+	// Name is LocalizedName resolved for the language of the request; only
+	// set by GET /api/v1/room-states.
+	Name            string          `json:"name,omitempty"`
 	LocalizedName   LocalizedString `json:"localized_name"`
 	State           any             `json:"state"`
 	Type            string          `json:"type"`
 	Representation  string          `json:"representation"`
 	ProhibitControl bool            `json:"prohibit_control"`
+	Icon            string          `json:"icon,omitempty"`
+	Group           string          `json:"group,omitempty"`
+	Order           int             `json:"order,omitempty"`
+	// Pending is set while State shows a control command that the device
+	// has not confirmed yet.
+	Pending bool `json:"pending,omitempty"`
 }
 
 type RoomState struct {
-	ID                        string          `json:"id"`
+	ID string `json:"id"`
+	// Name is LocalizedName resolved for the language of the request; only
+	// set by GET /api/v1/room-states.
+	Name                      string          `json:"name,omitempty"`
 	LocalizedName             LocalizedString `json:"localized_name"`
 	ExcludeFromEntranceTablet bool            `json:"exclude_from_entrance_tablet"`
 	// PeopleCount is the number of people in the room
 	// (it is calculated by taking the maximum as reported by each camera)
 	PeopleCount int `json:"people_count"`
+	// DataStale is set when a person device of the room has no fresh
+	// state, e.g. one restored after a restart: PeopleCount leaves it out and
+	// may be wrong.
+	DataStale bool `json:"data_stale"`
 	// LatestPersonDetectedAt is the timestamp (Unix milliseconds) when a person was last
 	// detected in this room. Only set when PeopleCount is 0.
 	LatestPersonDetectedAt *time.Time    `json:"latest_person_detected_at"`
 	VoipPhoneNumber        string        `json:"voip_phone_number"`
 	Entities               []EntityState `json:"entities"`
+	// Cameras are the snapshot devices of the room's Frigate cameras, in
+	// config order. State is nil until the first snapshot was fetched.
+	Cameras []EntityState `json:"cameras"`
+}
+
+// newEntityState builds the client-facing state of a single configured entity
+// from its backing virtual device (nil when the device was not discovered yet).
+func newEntityState(e EntityConfig, v *VirtualDevice) EntityState {
+	es := EntityState{
+		ID:              e.ID,
+		Representation:  e.Representation,
+		LocalizedName:   e.LocalizedName,
+		ProhibitControl: e.ProhibitControl,
+		Icon:            e.Icon,
+		Group:           e.Group,
+		Order:           e.Order,
+	}
+	if v != nil {
+		es.State = v.State
+		es.Type = string(v.Type)
+		es.Pending = v.Pending
+		// Patterns and services (e.g. printers) make devices read-only too.
+		es.ProhibitControl = es.ProhibitControl || v.ProhibitControl
+	}
+	return es
 }
 
 func buildRoomState(id string) *RoomState {
-	for _, r := range ConfigInstance.Rooms {
+	for _, r := range GetConfig().Rooms {
 		if r.ID == id {
 			rs := &RoomState{
 				ID:                        id,
@@ -47,44 +99,44 @@ func buildRoomState(id string) *RoomState {
 			virtDevices := vdevManager.Devices()
 			var personDevices []string // Track person device IDs in this room
 
-			for _, e := range r.Entities {
-				es := EntityState{
-					ID:              e.ID,
-					Representation:  e.Representation,
-					LocalizedName:   e.LocalizedName,
-					ProhibitControl: e.ProhibitControl,
-				}
-
+			for _, e := range roomEntities(GetConfig(), r) {
+				var dev *VirtualDevice
 				for _, v := range virtDevices {
 					if v.ID == e.ID {
-						// Use the maximum people count reported by any camera in the room
-						if v.Type == VdevTypePerson && v.State != nil {
-							personDevices = append(personDevices, v.ID)
-							intVal, ok := v.State.(int)
-							if ok && intVal > rs.PeopleCount {
-								rs.PeopleCount = intVal
-							}
-						}
-						es.State = v.State
-						es.Type = string(v.Type)
+						dev = v
 						break
 					}
+				}
 
+				// Use the maximum people count reported by any camera in the
+				// room. A count that isn't fresh is unknown.
+				if dev != nil && dev.Type == VdevTypePerson && !dev.Fresh {
+					rs.DataStale = true
+				}
+				if dev != nil && dev.Type == VdevTypePerson && dev.State != nil {
+					personDevices = append(personDevices, dev.ID)
+					intVal, ok := dev.State.(int)
+					if ok && intVal > rs.PeopleCount && dev.Fresh {
+						rs.PeopleCount = intVal
+					}
 				}
 
-				rs.Entities = append(rs.Entities, es)
+				rs.Entities = append(rs.Entities, newEntityState(e, dev))
+			}
+
+			rs.Cameras = make([]EntityState, 0, len(r.Cameras))
+			for _, name := range r.Cameras {
+				cam := EntityConfig{ID: cameraDeviceID(name), Representation: string(VdevTypeCameraSnapshot)}
+				rs.Cameras = append(rs.Cameras, newEntityState(cam, vdevManager.Device(cam.ID)))
 			}
 
 			// If room is empty, find the latest person detection time
 			if rs.PeopleCount == 0 && len(personDevices) > 0 && vdevHistoryRepo != nil {
 				var latestTimestamp *int64
-				for _, deviceID := range personDevices {
-					ts, err := vdevHistoryRepo.GetLatestPersonDetectionTime(deviceID)
-					if err != nil {
-						continue
-					}
-					if ts != nil && (latestTimestamp == nil || *ts > *latestTimestamp) {
-						latestTimestamp = ts
+				times, _ := vdevHistoryRepo.GetLatestPersonDetectionTimes(personDevices)
+				for _, ts := range times {
+					if latestTimestamp == nil || ts > *latestTimestamp {
+						latestTimestamp = &ts
 					}
 				}
 				if latestTimestamp != nil {
@@ -102,86 +154,966 @@ func buildRoomState(id string) *RoomState {
 func buildRoomStates() []*RoomState {
 	states := []*RoomState{}
 
-	for _, room := range ConfigInstance.Rooms {
+	for _, room := range GetConfig().Rooms {
 		states = append(states, buildRoomState(room.ID))
 	}
 
 	return states
 }
 
+// localize sets the Name fields of the room and its entities to their names
+// in lang.
+func (rs *RoomState) localize(lang string) {
+	rs.Name = cmp.Or(rs.LocalizedName.Resolve(lang), rs.ID)
+	for _, entities := range [][]EntityState{rs.Entities, rs.Cameras} {
+		for i := range entities {
+			entities[i].Name = cmp.Or(entities[i].LocalizedName.Resolve(lang), entities[i].ID)
+		}
+	}
+}
+
+// handleGetRoomStates serves the state of every room, with names in the
+// language picked by ?lang= or Accept-Language and states in the units picked
+// by ?units=.
 func handleGetRoomStates(c *fiber.Ctx) error {
 	states := buildRoomStates()
+	lang := requestLocale(c, configLocales(GetConfig()))
+	units := requestUnits(c)
+	for _, rs := range states {
+		rs.localize(lang)
+		rs.convertUnits(units)
+	}
+	c.Vary(fiber.HeaderAcceptLanguage)
 	return c.JSON(states)
 }
 
-func handleVirtualDeviceStateUpdate(vdev *VirtualDevice) {
-	devName := vdev.ID
+// Live websocket protocol versions. Version 1 streams bare RoomState objects
+// and rebuilds the whole room on every change. Version 2 wraps every message
+// in a liveEnvelope and sends per-entity deltas. Clients opt into version 2
+// with ?v=2 on the upgrade request or by sending {"type":"hello","v":2}.
+const (
+	liveWsProtocolV1 = 1
+	liveWsProtocolV2 = 2
+)
 
-	var room *RoomConfig
-	for _, r := range ConfigInstance.Rooms {
-		for _, ent := range r.Entities {
-			if ent.ID == devName {
-				room = &r
-				break
-			}
+// Encodings of live websocket messages. JSON is the default; clients opt
+// into MessagePack with ?encoding=msgpack on the upgrade request. Both carry
+// the same structures with the same field names.
+const (
+	liveWsEncodingJSON    = "json"
+	liveWsEncodingMsgpack = "msgpack"
+)
+
+// Server -> client message types. Version 1 clients only ever see
+// server_info and (untagged) room_state.
+const (
+	liveMsgServerInfo   = "server_info"
+	liveMsgRoomState    = "room_state"
+	liveMsgEntityUpdate = "entity_update"
+	liveMsgError        = "error"
+	liveMsgControlAck   = "control_ack"
+	// liveMsgAlert carries an Alert that fired or resolved.
+	liveMsgAlert = "alert"
+)
+
+// Client -> server message types. A resync is answered with a message of the
+// same type carrying the requested room states, so clients can tell it apart
+// from incremental updates.
+const (
+	liveMsgHello   = "hello"
+	liveMsgResync  = "resync"
+	liveMsgControl = "control"
+)
+
+// liveResyncMinInterval rate-limits resync requests per connection.
+const liveResyncMinInterval = 2 * time.Second
+
+// A connection may send at most liveControlBurst control messages per
+// liveControlWindow.
+const (
+	liveControlBurst  = 5
+	liveControlWindow = 2 * time.Second
+)
+
+// liveWsCloseSessionExpired is the close code sent when the session that
+// authenticated a live websocket is revoked or expires mid-connection.
+const liveWsCloseSessionExpired = 4001
+
+// liveWsSessionCheckInterval is how often authenticated connections re-check
+// that their session is still valid. A var so tests can shorten it.
+var liveWsSessionCheckInterval = time.Minute
+
+// liveWsWriteTimeout bounds every websocket write so a stalled client cannot
+// pin its writer goroutine forever.
+const liveWsWriteTimeout = 10 * time.Second
+
+// liveReplyTimeout is how long the answer to a client message may wait for
+// room in the control queue. A var so tests can shorten it.
+var liveReplyTimeout = 5 * time.Second
+
+// liveWsDefaultCompressionThreshold is the smallest message compressed when
+// web.live_ws_compression_threshold is unset.
+const liveWsDefaultCompressionThreshold = 1024
+
+// Transports a live feed subscriber can be connected over.
+const (
+	liveTransportWs  = "ws"
+	liveTransportSse = "sse"
+)
+
+// liveMessage is a server -> client message before it is encoded for the
+// protocol version of a particular client.
+type liveMessage struct {
+	Type    string
+	Payload any
+}
+
+// liveEnvelope is the wire format of every protocol version 2 message.
+// Ts is the server time (Unix milliseconds) the message was written.
+type liveEnvelope struct {
+	Type    string `json:"type"`
+	Ts      int64  `json:"ts"`
+	Payload any    `json:"payload"`
+}
+
+type serverInfoPayload struct {
+	Version string `json:"version"`
+}
+
+// entityUpdatePayload carries the new state of a single entity.
+type entityUpdatePayload struct {
+	RoomID string      `json:"room_id"`
+	Entity EntityState `json:"entity"`
+}
+
+// resyncPayload answers a client resync request.
+type resyncPayload struct {
+	Rooms []*RoomState `json:"rooms"`
+}
+
+// errorPayload reports a rejected client request.
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// controlAckPayload answers a control message, correlated by the ID the
+// client sent. Code and Message explain a rejection.
+type controlAckPayload struct {
+	ID      string `json:"id"`
+	OK      bool   `json:"ok"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// liveClientMessage is a message received from a client.
+type liveClientMessage struct {
+	Type string `json:"type"`
+	// V is the requested protocol version (hello).
+	V int `json:"v"`
+	// Rooms optionally limits a resync to the given room IDs.
+	Rooms []string `json:"rooms"`
+	// ID, DeviceID and State make up a control message.
+	ID       string `json:"id"`
+	DeviceID string `json:"deviceId"`
+	State    any    `json:"state"`
+}
+
+// parseLiveWsVersion maps the ?v= query value to a protocol version, falling
+// back to version 1 for anything unknown.
+func parseLiveWsVersion(v string) int {
+	if v == "2" {
+		return liveWsProtocolV2
+	}
+	return liveWsProtocolV1
+}
+
+// parseLiveWsEncoding maps the ?encoding= query value to an encoding,
+// falling back to JSON for anything unknown.
+func parseLiveWsEncoding(v string) string {
+	if v == liveWsEncodingMsgpack {
+		return liveWsEncodingMsgpack
+	}
+	return liveWsEncodingJSON
+}
+
+// marshalLive serializes an encoded message. MessagePack takes the field
+// names from the json tags, so they are the same in both encodings; times
+// are MessagePack timestamps rather than RFC 3339 strings.
+func marshalLive(encoding string, v any) ([]byte, error) {
+	if encoding != liveWsEncodingMsgpack {
+		return json.Marshal(v)
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackToJSON converts a MessagePack client message to JSON. Client
+// messages are small, and so decode exactly like JSON ones, numbers
+// included.
+func msgpackToJSON(raw []byte) ([]byte, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	dec.UseLooseInterfaceDecoding(true)
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// encodeLiveMessage returns the value to serialize for msg in the given
+// protocol version, or nil when the message has no version 1 equivalent.
+func encodeLiveMessage(version int, msg liveMessage, now time.Time) any {
+	if version == liveWsProtocolV2 {
+		return liveEnvelope{Type: msg.Type, Ts: now.UnixMilli(), Payload: msg.Payload}
+	}
+	switch msg.Type {
+	case liveMsgServerInfo:
+		info, _ := msg.Payload.(serverInfoPayload)
+		return fiber.Map{"type": liveMsgServerInfo, "version": info.Version}
+	case liveMsgRoomState:
+		return msg.Payload
+	case liveMsgResync:
+		resync, _ := msg.Payload.(resyncPayload)
+		return fiber.Map{"type": liveMsgResync, "rooms": resync.Rooms}
+	case liveMsgError:
+		e, _ := msg.Payload.(errorPayload)
+		return fiber.Map{"type": liveMsgError, "code": e.Code, "message": e.Message}
+	case liveMsgControlAck:
+		ack, _ := msg.Payload.(controlAckPayload)
+		out := fiber.Map{"type": liveMsgControlAck, "id": ack.ID, "ok": ack.OK}
+		if !ack.OK {
+			out["code"], out["message"] = ack.Code, ack.Message
 		}
+		return out
 	}
+	return nil
+}
 
-	if room != nil {
-		socketChansMutex.Lock()
-		defer socketChansMutex.Unlock()
-		for _, ch := range socketChans {
+// liveSubscriber is one consumer of the live feed (a websocket or an SSE
+// stream) together with the protocol it speaks and the rooms it follows.
+type liveSubscriber struct {
+	// notify is signalled when rooms were marked dirty. The writer then sends
+	// the current state of each dirty room, so a slow client skips
+	// intermediate states but always ends up with the latest one.
+	notify chan struct{}
+	// control carries replies to client messages (resync answers, errors)
+	// and alerts.
+	control chan liveMessage
+	// resync asks the writer to resend server_info and every room snapshot,
+	// e.g. after the client switched protocol versions.
+	resync chan struct{}
+	// closing is closed when the server shuts down; the writer then ends
+	// the connection.
+	closing   chan struct{}
+	closeOnce sync.Once
+	// stalled is closed when the client stopped reading the replies to its
+	// messages; the writer then ends the connection.
+	stalled   chan struct{}
+	stallOnce sync.Once
+	// rooms limits the feed to the given room IDs; nil means all rooms.
+	rooms map[string]struct{}
 
-			select {
-			case ch <- buildRoomState(room.ID):
-			default:
-			}
+	// username and sessionID are set when the connection was authenticated
+	// by LiveWsAuthMiddleware.
+	username  string
+	sessionID string
+
+	// transport, remoteAddr and connectedAt describe the connection in the
+	// debug listing.
+	transport   string
+	remoteAddr  string
+	connectedAt time.Time
+
+	// log is liveLog, with the connection's user and address once known.
+	log *slog.Logger
+
+	messagesSent atomic.Uint64
+	// coalesced counts updates merged into one still waiting to be sent,
+	// dropped counts alerts discarded because the control queue was full.
+	coalesced atomic.Uint64
+	dropped   atomic.Uint64
+
+	// encoding is how messages are serialized on a websocket; SSE streams
+	// are always JSON.
+	encoding string
+
+	mu         sync.Mutex
+	version    int
+	lastResync time.Time
+	// controlWindow started at the first control message counted in
+	// controlCount.
+	controlWindow time.Time
+	controlCount  int
+	dirty         map[string]*liveDirtyRoom
+	dirtyOrder    []string
+}
+
+// liveDirtyRoom records what changed in a room since the writer last drained
+// it: either the whole room or a set of entities, in first-changed order.
+type liveDirtyRoom struct {
+	full     bool
+	entities []string
+	seen     map[string]struct{}
+}
+
+func newLiveSubscriber(version int, rooms map[string]struct{}) *liveSubscriber {
+	return &liveSubscriber{
+		notify:  make(chan struct{}, 1),
+		control: make(chan liveMessage, 8),
+		resync:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		stalled: make(chan struct{}),
+		dirty:   map[string]*liveDirtyRoom{},
+
+		connectedAt: time.Now(),
+		log:         liveLog,
+		rooms:       rooms,
+		version:     version,
+		encoding:    liveWsEncodingJSON,
+	}
+}
+
+// parseLiveRoomFilter parses the comma-separated ?rooms= query value. An empty
+// value subscribes to every room.
+func parseLiveRoomFilter(q string) map[string]struct{} {
+	if q == "" {
+		return nil
+	}
+	rooms := map[string]struct{}{}
+	for _, id := range strings.Split(q, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			rooms[id] = struct{}{}
 		}
 	}
+	return rooms
 }
 
-var socketChans = []chan *RoomState{}
-var socketChansMutex = sync.Mutex{}
+// wantsRoom reports whether updates of the given room go to this subscriber.
+func (sub *liveSubscriber) wantsRoom(roomID string) bool {
+	if sub.rooms == nil {
+		return true
+	}
+	_, ok := sub.rooms[roomID]
+	return ok
+}
 
-func handleLiveWs(c *websocket.Conn) {
+func (sub *liveSubscriber) protocolVersion() int {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.version
+}
+
+// requestResync schedules a full resend without blocking; repeated requests
+// before the writer catches up collapse into one.
+func (sub *liveSubscriber) requestResync() {
+	select {
+	case sub.resync <- struct{}{}:
+	default:
+	}
+}
+
+// handleClientFrame decodes a websocket frame from the client: MessagePack
+// if it negotiated that encoding and sent a binary frame, else JSON.
+func (sub *liveSubscriber) handleClientFrame(frameType int, raw []byte) {
+	if frameType == websocket.BinaryMessage && sub.encoding == liveWsEncodingMsgpack {
+		var err error
+		if raw, err = msgpackToJSON(raw); err != nil {
+			return
+		}
+	}
+	sub.handleClientMessage(raw)
+}
 
-	// Send the running server version first, so the frontend can detect a
-	// redeployment after a reconnect and reload itself.
-	if err := c.WriteJSON(fiber.Map{"type": "server_info", "version": GitCommitHash}); err != nil {
-		log.Printf("Failed to send server_info to WS: %v", err)
+// handleClientMessage reacts to a JSON message received from the client.
+func (sub *liveSubscriber) handleClientMessage(raw []byte) {
+	var msg liveClientMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
 		return
 	}
+	switch msg.Type {
+	case liveMsgHello:
+		version := liveWsProtocolV1
+		if msg.V == liveWsProtocolV2 {
+			version = liveWsProtocolV2
+		}
+		sub.mu.Lock()
+		sub.version = version
+		sub.mu.Unlock()
+		sub.requestResync()
+	case liveMsgResync:
+		sub.reply(sub.answerResync(msg.Rooms, time.Now()))
+	case liveMsgControl:
+		sub.reply(sub.answerControl(msg, time.Now()))
+	}
+}
+
+// answerControl carries out a control message on behalf of the session that
+// authenticated the connection and builds the acknowledgement.
+func (sub *liveSubscriber) answerControl(msg liveClientMessage, now time.Time) liveMessage {
+	reject := func(code, message string) liveMessage {
+		return liveMessage{Type: liveMsgControlAck, Payload: controlAckPayload{ID: msg.ID, Code: code, Message: message}}
+	}
+
+	sub.mu.Lock()
+	if now.Sub(sub.controlWindow) >= liveControlWindow {
+		sub.controlWindow, sub.controlCount = now, 0
+	}
+	sub.controlCount++
+	limited := sub.controlCount > liveControlBurst
+	sub.mu.Unlock()
+	if limited {
+		return reject("rate_limited", "control requested too often")
+	}
+
+	if msg.DeviceID == "" || msg.State == nil {
+		return reject("invalid", "deviceId and state are required")
+	}
+	if code, message := sub.controlDenied(msg.DeviceID); code != "" {
+		return reject(code, message)
+	}
+	if mqttAdapter == nil {
+		return reject("unavailable", "MQTT adapter not initialized")
+	}
+
+	sub.log.Info("control requested", "device", msg.DeviceID, "state", msg.State)
+	if err := mqttAdapter.ControlDevice(msg.DeviceID, msg.State); err != nil {
+		return reject(controlErrorCode(err), err.Error())
+	}
+	return liveMessage{Type: liveMsgControlAck, Payload: controlAckPayload{ID: msg.ID, OK: true}}
+}
+
+// controlDenied applies the checks RequireAuth and authorizeControl do for
+// HTTP control requests to the session behind the connection. It returns an
+// error code and message, or empty strings when control is allowed.
+func (sub *liveSubscriber) controlDenied(deviceID string) (string, string) {
+	if sub.sessionID == "" {
+		return "unauthorized", "Not logged in"
+	}
+	session, err := lookupLiveSession(sub.sessionID)
+	if err != nil {
+		return "unauthorized", "Invalid session"
+	}
+	if !sessionMayControl(session) {
+		return "unauthorized", "OIDC not configured"
+	}
+	var claims map[string]interface{}
+	if session.CachedClaims != "" {
+		if err := json.Unmarshal([]byte(session.CachedClaims), &claims); err != nil {
+			return "internal", "Failed to parse claims"
+		}
+	}
+	if rule := deniedControlRule(deviceID, claimGroups(claims)); rule != nil {
+		return "forbidden", "Controlling this device requires group " + rule.RequireGroup
+	}
+	return "", ""
+}
+
+// answerResync builds the reply to a resync request for the given rooms (all
+// followed rooms when empty), or an error when the client asks too often.
+func (sub *liveSubscriber) answerResync(rooms []string, now time.Time) liveMessage {
+	sub.mu.Lock()
+	limited := !sub.lastResync.IsZero() && now.Sub(sub.lastResync) < liveResyncMinInterval
+	if !limited {
+		sub.lastResync = now
+	}
+	sub.mu.Unlock()
+	if limited {
+		return liveMessage{Type: liveMsgError, Payload: errorPayload{Code: "rate_limited", Message: "resync requested too often"}}
+	}
+
+	requested := parseLiveRoomFilter(strings.Join(rooms, ","))
+	payload := resyncPayload{Rooms: []*RoomState{}}
+	for _, room := range GetConfig().Rooms {
+		if !sub.wantsRoom(room.ID) {
+			continue
+		}
+		if _, ok := requested[room.ID]; requested != nil && !ok {
+			continue
+		}
+		payload.Rooms = append(payload.Rooms, buildRoomState(room.ID))
+	}
+	return liveMessage{Type: liveMsgResync, Payload: payload}
+}
 
-	// First of all send all room states as an initial message
-	for _, room := range ConfigInstance.Rooms {
-		rs := buildRoomState(room.ID)
-		err := c.WriteJSON(rs)
-		if err != nil {
-			log.Printf("Failed to send initial room state to WS: %v", err)
+// queue hands a broadcast message (an alert) to the subscriber's writer
+// without blocking; it is dropped when the control queue is full.
+func (sub *liveSubscriber) queue(msg liveMessage) {
+	select {
+	case sub.control <- msg:
+	default:
+		sub.dropped.Add(1)
+	}
+}
+
+// reply hands the answer to a client message to the subscriber's writer.
+// Answers are never dropped: the reader waits for room in the control queue,
+// and a client that doesn't read them within liveReplyTimeout is
+// disconnected as a slow consumer.
+func (sub *liveSubscriber) reply(msg liveMessage) {
+	timer := time.NewTimer(liveReplyTimeout)
+	defer timer.Stop()
+	select {
+	case sub.control <- msg:
+	case <-sub.closing:
+	case <-timer.C:
+		sub.log.Warn("client not reading replies, disconnecting")
+		sub.stallOnce.Do(func() { close(sub.stalled) })
+	}
+}
+
+// markDirty records that an entity of the room changed (or the whole room,
+// when full is set) and wakes the writer. It never blocks, and repeated
+// changes before the writer catches up collapse into one pending update.
+func (sub *liveSubscriber) markDirty(roomID, entityID string, full bool) {
+	sub.mu.Lock()
+	d, ok := sub.dirty[roomID]
+	if !ok {
+		d = &liveDirtyRoom{seen: map[string]struct{}{}}
+		sub.dirty[roomID] = d
+		sub.dirtyOrder = append(sub.dirtyOrder, roomID)
+	}
+	merged := false
+	if full {
+		merged = d.full
+		d.full = true
+	} else if _, seen := d.seen[entityID]; seen || d.full {
+		merged = true
+	} else {
+		d.seen[entityID] = struct{}{}
+		d.entities = append(d.entities, entityID)
+	}
+	sub.mu.Unlock()
+	if merged {
+		sub.coalesced.Add(1)
+	}
+
+	select {
+	case sub.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pendingMessages drains the dirty set and returns the messages bringing the
+// client up to date. States are read at call time rather than when the change
+// happened, so whatever was skipped is covered by the newest value. Version 1
+// clients, and rooms whose room-level fields changed, get a full room_state;
+// version 2 clients otherwise get one entity_update per changed entity.
+func (sub *liveSubscriber) pendingMessages() []liveMessage {
+	sub.mu.Lock()
+	version := sub.version
+	dirty, order := sub.dirty, sub.dirtyOrder
+	sub.dirty, sub.dirtyOrder = map[string]*liveDirtyRoom{}, nil
+	sub.mu.Unlock()
+
+	var msgs []liveMessage
+	for _, roomID := range order {
+		d := dirty[roomID]
+		if d.full || version != liveWsProtocolV2 {
+			msgs = append(msgs, liveMessage{Type: liveMsgRoomState, Payload: buildRoomState(roomID)})
+			continue
+		}
+		for _, entityID := range d.entities {
+			if es, ok := currentEntityState(roomID, entityID); ok {
+				msgs = append(msgs, liveMessage{Type: liveMsgEntityUpdate, Payload: entityUpdatePayload{RoomID: roomID, Entity: es}})
+			}
+		}
+	}
+	return msgs
+}
+
+// currentEntityState returns the latest state of an entity of a room.
+func currentEntityState(roomID, entityID string) (EntityState, bool) {
+	cfg := GetConfig()
+	for _, room := range cfg.Rooms {
+		if room.ID != roomID {
+			continue
+		}
+		for _, ent := range roomEntities(cfg, room) {
+			if ent.ID != entityID {
+				continue
+			}
+			vdev := vdevManager.Device(entityID)
+			if vdev == nil {
+				return EntityState{}, false
+			}
+			return newEntityState(ent, vdev), true
+		}
+	}
+	return EntityState{}, false
+}
+
+// snapshotMessages returns the server version followed by the full state of
+// every followed room. The version comes first so the frontend can detect a
+// redeployment after a reconnect and reload itself.
+func (sub *liveSubscriber) snapshotMessages() []liveMessage {
+	msgs := []liveMessage{{Type: liveMsgServerInfo, Payload: serverInfoPayload{Version: currentBuildInfo().GitCommitHash}}}
+	for _, room := range GetConfig().Rooms {
+		if sub.wantsRoom(room.ID) {
+			msgs = append(msgs, liveMessage{Type: liveMsgRoomState, Payload: buildRoomState(room.ID)})
+		}
+	}
+	return msgs
+}
+
+// liveLog is the logger of the live feed; main replaces it with the
+// configured component logger.
+var liveLog = slog.Default()
+
+var liveSubscribers = []*liveSubscriber{}
+var liveSubscribersMutex = sync.Mutex{}
+
+// liveShuttingDown is set by closeLiveSubscribers; subscribers arriving
+// afterwards are closed right away. Guarded by liveSubscribersMutex.
+var liveShuttingDown bool
+
+// subscribeLive registers a subscriber with the live feed. Register before
+// sending the initial snapshot so no update in between is lost; anything
+// queued meanwhile is at least as new as the snapshot.
+func subscribeLive(sub *liveSubscriber) {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	liveSubscribers = append(liveSubscribers, sub)
+	liveClientsGauge.WithLabelValues(sub.transport).Inc()
+	if liveShuttingDown {
+		sub.close()
+	}
+}
+
+// close tells the subscriber's writer to end the connection.
+func (sub *liveSubscriber) close() {
+	sub.closeOnce.Do(func() { close(sub.closing) })
+}
+
+// closeLiveSubscribers ends every live feed connection, websockets with a
+// going-away close frame, and waits until their writers are gone or ctx is
+// done.
+func closeLiveSubscribers(ctx context.Context) error {
+	liveSubscribersMutex.Lock()
+	liveShuttingDown = true
+	for _, sub := range liveSubscribers {
+		sub.close()
+	}
+	liveSubscribersMutex.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		liveSubscribersMutex.Lock()
+		n := len(liveSubscribers)
+		liveSubscribersMutex.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d live clients still connected: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// unsubscribeLive removes a subscriber once its connection has gone away.
+func unsubscribeLive(sub *liveSubscriber) {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	for i, s := range liveSubscribers {
+		if s == sub {
+			liveSubscribers = append(liveSubscribers[:i], liveSubscribers[i+1:]...)
+			liveClientsGauge.WithLabelValues(sub.transport).Dec()
 			return
 		}
 	}
+}
 
-	recvChan := make(chan *RoomState, 20)
-	socketChansMutex.Lock()
+// liveMessagesSentTotal counts messages written to any live feed client over
+// the lifetime of the process.
+var liveMessagesSentTotal atomic.Uint64
 
-	socketChans = append(socketChans, recvChan)
-	socketChansMutex.Unlock()
+// recordSent is called by the writers after each successfully sent message.
+func (sub *liveSubscriber) recordSent() {
+	sub.messagesSent.Add(1)
+	liveMessagesSentTotal.Add(1)
+}
 
-	defer func() {
-		socketChansMutex.Lock()
-		defer socketChansMutex.Unlock()
-		for i, ch := range socketChans {
-			if ch == recvChan {
-				socketChans = append(socketChans[:i], socketChans[i+1:]...)
+// liveClientInfo describes one connected live feed client in the debug
+// listing.
+type liveClientInfo struct {
+	Transport       string    `json:"transport"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Username        string    `json:"username,omitempty"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Encoding        string    `json:"encoding"`
+	// Rooms is nil when the client follows every room.
+	Rooms        []string `json:"rooms"`
+	MessagesSent uint64   `json:"messages_sent"`
+	Coalesced    uint64   `json:"coalesced"`
+	Dropped      uint64   `json:"dropped"`
+}
+
+func liveClients() []liveClientInfo {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	clients := make([]liveClientInfo, 0, len(liveSubscribers))
+	for _, sub := range liveSubscribers {
+		info := liveClientInfo{
+			Transport:       sub.transport,
+			RemoteAddr:      sub.remoteAddr,
+			Username:        sub.username,
+			ConnectedAt:     sub.connectedAt,
+			ProtocolVersion: sub.protocolVersion(),
+			Encoding:        sub.encoding,
+			MessagesSent:    sub.messagesSent.Load(),
+			Coalesced:       sub.coalesced.Load(),
+			Dropped:         sub.dropped.Load(),
+		}
+		if sub.rooms != nil {
+			info.Rooms = make([]string, 0, len(sub.rooms))
+			for id := range sub.rooms {
+				info.Rooms = append(info.Rooms, id)
+			}
+			sort.Strings(info.Rooms)
+		}
+		clients = append(clients, info)
+	}
+	return clients
+}
+
+// handleLiveClients lists the connected live feed clients for debugging.
+func handleLiveClients(c *fiber.Ctx) error {
+	return c.JSON(liveClients())
+}
+
+var liveMessagesSentDesc = prometheus.NewDesc(
+	"at2_ws_messages_sent_total",
+	"Messages sent to live feed clients",
+	nil,
+	nil,
+)
+
+// collectLiveMetrics reports the live feed message metrics; it is called from
+// PrometheusCollector.Collect. The client count is liveClientsGauge.
+func collectLiveMetrics(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(liveMessagesSentDesc, prometheus.CounterValue, float64(liveMessagesSentTotal.Load()))
+}
+
+func handleVirtualDeviceStateUpdate(vdev *VirtualDevice) {
+	cfg := GetConfig()
+	configured := false
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.ID == vdev.ID {
+				broadcastEntityUpdate(room, ent, vdev)
+				configured = true
 				break
 			}
 		}
+		if vdev.Type == VdevTypeCameraSnapshot {
+			for _, name := range room.Cameras {
+				if cameraDeviceID(name) == vdev.ID {
+					broadcastRoomUpdate(room)
+					configured = true
+					break
+				}
+			}
+		}
+	}
+	// Devices no room lists show in the room of their alias.
+	if alias, ok := deviceAliases.Get(vdev.ID); ok && !configured && alias.Room != "" {
+		for _, room := range cfg.Rooms {
+			if room.ID == alias.Room {
+				broadcastEntityUpdate(room, EntityConfig{ID: vdev.ID}, vdev)
+			}
+		}
+	}
+}
+
+// broadcastRoomUpdate marks a room dirty as a whole for every subscriber
+// following it, for changes outside its entities.
+func broadcastRoomUpdate(room RoomConfig) {
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	for _, sub := range liveSubscribers {
+		if sub.wantsRoom(room.ID) {
+			sub.markDirty(room.ID, "", true)
+		}
+	}
+}
+
+// broadcastEntityUpdate marks a changed entity dirty for every subscriber
+// following its room. The state itself is built by each writer when it gets
+// round to sending, so bursts of updates cost nothing for idle connections.
+func broadcastEntityUpdate(room RoomConfig, ent EntityConfig, vdev *VirtualDevice) {
+	// People count and the last-detection time live on the room itself, so
+	// person updates always need a full snapshot.
+	needsFull := vdev.Type == VdevTypePerson
+
+	liveSubscribersMutex.Lock()
+	defer liveSubscribersMutex.Unlock()
+	for _, sub := range liveSubscribers {
+		if sub.wantsRoom(room.ID) {
+			sub.markDirty(room.ID, ent.ID, needsFull)
+		}
+	}
+}
+
+// writeLiveWs is the single path through which messages reach a websocket.
+func writeLiveWs(c *websocket.Conn, sub *liveSubscriber, msg liveMessage) error {
+	out := encodeLiveMessage(sub.protocolVersion(), msg, time.Now())
+	if out == nil {
+		return nil
+	}
+	data, err := marshalLive(sub.encoding, out)
+	if err != nil {
+		return err
+	}
+	frameType := websocket.TextMessage
+	if sub.encoding == liveWsEncodingMsgpack {
+		frameType = websocket.BinaryMessage
+	}
+	if err := c.SetWriteDeadline(time.Now().Add(liveWsWriteTimeout)); err != nil {
+		return err
+	}
+	// Has no effect unless the client negotiated permessage-deflate.
+	compress := GetConfig().Web.LiveWsCompression && len(data) >= liveWsCompressionThreshold()
+	c.EnableWriteCompression(compress)
+	if err := c.WriteMessage(frameType, data); err != nil {
+		return err
+	}
+	sub.recordSent()
+	if compress && GetConfig().Web.LiveWsCompressionDebug {
+		logLiveWsCompressionRatio(sub.log, msg.Type, data)
+	}
+	return nil
+}
+
+func liveWsCompressionThreshold() int {
+	if t := GetConfig().Web.LiveWsCompressionThreshold; t > 0 {
+		return t
+	}
+	return liveWsDefaultCompressionThreshold
+}
+
+// logLiveWsCompressionRatio logs how well a message compresses. The websocket
+// library doesn't report the size on the wire, so the message is deflated
+// again at the same level; that's why this only runs with debugging enabled.
+func logLiveWsCompressionRatio(logger *slog.Logger, msgType string, data []byte) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return
+	}
+	fw.Write(data)
+	fw.Close()
+	logger.Info("compressed message", "type", msgType, "bytes", len(data), "compressed_bytes", buf.Len(),
+		"ratio", fmt.Sprintf("%.1f%%", 100*float64(buf.Len())/float64(len(data))))
+}
+
+func writeLiveWsSnapshot(c *websocket.Conn, sub *liveSubscriber) error {
+	for _, msg := range sub.snapshotMessages() {
+		if err := writeLiveWs(c, sub, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveWsSessionValid reports whether the session behind an authenticated
+// connection still exists and has not expired.
+func liveWsSessionValid(sessionID string) bool {
+	_, err := lookupLiveSession(sessionID)
+	return err == nil
+}
+
+// closeLiveWs sends a close frame with the given code before the handler
+// returns and the connection is torn down.
+func closeLiveWs(c *websocket.Conn, sub *liveSubscriber, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(liveWsWriteTimeout)); err != nil {
+		sub.log.Warn("sending close frame failed", "code", code, "err", err)
+	}
+}
+
+func handleLiveWs(c *websocket.Conn) {
+	client := newLiveSubscriber(parseLiveWsVersion(c.Query("v")), parseLiveRoomFilter(c.Query("rooms")))
+	client.username, _ = c.Locals("username").(string)
+	client.sessionID, _ = c.Locals("session_id").(string)
+	client.transport = liveTransportWs
+	client.encoding = parseLiveWsEncoding(c.Query("encoding"))
+	client.remoteAddr, _ = c.Locals("client_ip").(string)
+	client.log = liveLog.With("transport", liveTransportWs, "remote", client.remoteAddr)
+	if client.username != "" {
+		client.log = client.log.With("user", client.username)
+		client.log.Info("connected")
+		defer client.log.Info("disconnected")
+	}
+
+	subscribeLive(client)
+	defer unsubscribeLive(client)
+
+	if err := writeLiveWsSnapshot(c, client); err != nil {
+		client.log.Warn("sending initial room states failed", "err", err)
+		return
+	}
+
+	// The reader handles client messages and notices the peer going away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			frameType, raw, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			client.handleClientFrame(frameType, raw)
+		}
 	}()
-	for r := range recvChan {
-		err := c.WriteJSON(r)
-		if err != nil {
-			break
+
+	// Only connections that had to authenticate re-check their session; a nil
+	// channel never fires.
+	var sessionCheck <-chan time.Time
+	if client.sessionID != "" && GetConfig().Web.LiveWsRequireAuth {
+		ticker := time.NewTicker(liveWsSessionCheckInterval)
+		defer ticker.Stop()
+		sessionCheck = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-client.closing:
+			closeLiveWs(c, client, websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-client.stalled:
+			closeLiveWs(c, client, websocket.ClosePolicyViolation, "slow consumer")
+			return
+		case <-sessionCheck:
+			if !liveWsSessionValid(client.sessionID) {
+				closeLiveWs(c, client, liveWsCloseSessionExpired, "session expired")
+				return
+			}
+		case <-client.resync:
+			if err := writeLiveWsSnapshot(c, client); err != nil {
+				return
+			}
+		case <-client.notify:
+			for _, msg := range client.pendingMessages() {
+				if err := writeLiveWs(c, client, msg); err != nil {
+					return
+				}
+			}
+		case msg := <-client.control:
+			if err := writeLiveWs(c, client, msg); err != nil {
+				return
+			}
 		}
 	}
 }
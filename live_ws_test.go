@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func setupLiveWsTest(t *testing.T) {
+	t.Helper()
+	prevCfg, prevMgr, prevRepo := GetConfig(), vdevManager, vdevHistoryRepo
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		vdevManager, vdevHistoryRepo = prevMgr, prevRepo
+	})
+
+	setConfig(&Config{Rooms: []RoomConfig{{
+		ID: "hall",
+		Entities: []EntityConfig{
+			{ID: "hall/temp", Representation: "temperature"},
+			{ID: "frigate/person/hall"},
+		},
+	}}})
+	vdevManager = NewVdevManager()
+	vdevHistoryRepo = nil
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "hall/temp", Type: VdevTypeTemperature, State: 21.5, Fresh: true},
+		{ID: "frigate/person/hall", Type: VdevTypePerson, State: 2, Fresh: true},
+	})
+}
+
+// decode round-trips a message through JSON the same way WriteJSON would.
+func decode(t *testing.T, msg any) map[string]any {
+	t.Helper()
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestParseLiveWsVersion(t *testing.T) {
+	cases := map[string]int{"": liveWsProtocolV1, "1": liveWsProtocolV1, "2": liveWsProtocolV2, "abc": liveWsProtocolV1}
+	for in, want := range cases {
+		if got := parseLiveWsVersion(in); got != want {
+			t.Errorf("parseLiveWsVersion(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+// wire encodes a message for the given protocol version and round-trips it
+// through JSON the same way the websocket writer does.
+func wire(t *testing.T, version int, msg liveMessage) map[string]any {
+	t.Helper()
+	out := encodeLiveMessage(version, msg, time.UnixMilli(1700000000000))
+	if out == nil {
+		return nil
+	}
+	return decode(t, out)
+}
+
+// setTemp updates hall/temp in the manager the way an MQTT message would.
+func setTemp(v float64) {
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "hall/temp", State: v}})
+}
+
+func TestPendingMessages_V1SendsBareRoomState(t *testing.T) {
+	setupLiveWsTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV1, nil)
+	sub.markDirty("hall", "hall/temp", false)
+
+	msgs := sub.pendingMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	msg := wire(t, liveWsProtocolV1, msgs[0])
+	if _, ok := msg["type"]; ok {
+		t.Fatalf("v1 message must not carry a type, got %v", msg)
+	}
+	if msg["id"] != "hall" || msg["people_count"] != float64(2) {
+		t.Fatalf("unexpected v1 room state: %v", msg)
+	}
+}
+
+func TestPendingMessages_V2SendsEntityDelta(t *testing.T) {
+	setupLiveWsTest(t)
+	setTemp(22.0)
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	sub.markDirty("hall", "hall/temp", false)
+
+	msgs := sub.pendingMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	msg := wire(t, liveWsProtocolV2, msgs[0])
+	if msg["type"] != liveMsgEntityUpdate || msg["ts"] != float64(1700000000000) {
+		t.Fatalf("unexpected v2 envelope: %v", msg)
+	}
+	payload := msg["payload"].(map[string]any)
+	if payload["room_id"] != "hall" {
+		t.Fatalf("unexpected v2 delta: %v", payload)
+	}
+	entity := payload["entity"].(map[string]any)
+	if entity["id"] != "hall/temp" || entity["state"] != 22.0 || entity["type"] != "temperature" {
+		t.Fatalf("unexpected entity payload: %v", entity)
+	}
+}
+
+func TestPendingMessages_V2PersonSendsRoomState(t *testing.T) {
+	setupLiveWsTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	sub.markDirty("hall", "hall/temp", false)
+	sub.markDirty("hall", "frigate/person/hall", true)
+
+	msgs := sub.pendingMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("a full room update must replace the entity deltas, got %d messages", len(msgs))
+	}
+	msg := wire(t, liveWsProtocolV2, msgs[0])
+	if msg["type"] != liveMsgRoomState {
+		t.Fatalf("unexpected v2 envelope: %v", msg)
+	}
+	payload := msg["payload"].(map[string]any)
+	if payload["id"] != "hall" || payload["people_count"] != float64(2) {
+		t.Fatalf("unexpected v2 room state: %v", payload)
+	}
+	if entities, ok := payload["entities"].([]any); !ok || len(entities) != 2 {
+		t.Fatalf("expected 2 entities in snapshot, got %v", payload["entities"])
+	}
+}
+
+func TestPendingMessages_CoalescesRepeatedUpdates(t *testing.T) {
+	setupLiveWsTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	for i := 0; i < 50; i++ {
+		sub.markDirty("hall", "hall/temp", false)
+	}
+	if msgs := sub.pendingMessages(); len(msgs) != 1 {
+		t.Fatalf("expected repeated updates to collapse into 1 message, got %d", len(msgs))
+	}
+	if msgs := sub.pendingMessages(); len(msgs) != 0 {
+		t.Fatalf("expected the dirty set to be drained, got %d messages", len(msgs))
+	}
+}
+
+// setupRoomCamerasTest gives the hall two cameras, one of which Frigate
+// reports with a snapshot.
+func setupRoomCamerasTest(t *testing.T) *VirtualDevice {
+	t.Helper()
+	setupLiveWsTest(t)
+	GetConfig().Rooms[0].Cameras = []string{"hall_cam", "old_cam"}
+	cam := &VirtualDevice{
+		ID:    "snapshot/hall_cam",
+		Type:  VdevTypeCameraSnapshot,
+		State: FrigateSnapshotState{Images: []SnapshotImage{{URL: "/api/v1/camera-snapshot/hall_cam.jpg?cache=1", Width: 640}}},
+	}
+	vdevManager.AddDevices([]*VirtualDevice{cam})
+	return cam
+}
+
+func TestBuildRoomState_Cameras(t *testing.T) {
+	setupRoomCamerasTest(t)
+
+	rs := buildRoomState("hall")
+	if len(rs.Cameras) != 2 || len(rs.Entities) != 2 {
+		t.Fatalf("cameras = %+v, entities = %+v", rs.Cameras, rs.Entities)
+	}
+	cam := rs.Cameras[0]
+	state, ok := cam.State.(FrigateSnapshotState)
+	if cam.ID != "snapshot/hall_cam" || cam.Type != string(VdevTypeCameraSnapshot) || cam.Representation != "camera_snapshot" ||
+		!ok || state.Images[0].URL != "/api/v1/camera-snapshot/hall_cam.jpg?cache=1" {
+		t.Fatalf("cameras[0] = %+v", cam)
+	}
+	// A camera Frigate doesn't know has no state.
+	if missing := rs.Cameras[1]; missing.ID != "snapshot/old_cam" || missing.State != nil {
+		t.Fatalf("cameras[1] = %+v", missing)
+	}
+}
+
+func TestBuildRoomState_EntityOrder(t *testing.T) {
+	setupLiveWsTest(t)
+	GetConfig().Rooms[0].Entities = []EntityConfig{
+		{ID: "hall/z_light", Group: "lights", Order: 1, Icon: "lamp-ceiling"},
+		{ID: "hall/temp", Representation: "temperature", Order: 5},
+		{ID: "hall/a_light", Group: "lights", Order: 1},
+		{ID: "hall/fan", Group: "lights"},
+		{ID: "frigate/person/hall", Order: 5},
+	}
+
+	rs := buildRoomState("hall")
+	var ids []string
+	for _, e := range rs.Entities {
+		ids = append(ids, e.ID)
+	}
+	want := []string{"frigate/person/hall", "hall/temp", "hall/fan", "hall/a_light", "hall/z_light"}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("entities = %v, want %v", ids, want)
+	}
+
+	got := decode(t, rs.Entities[4])
+	if got["icon"] != "lamp-ceiling" || got["group"] != "lights" || got["order"] != 1.0 {
+		t.Fatalf("entity = %v", got)
+	}
+	// Unset hints are left out.
+	got = decode(t, rs.Entities[0])
+	if _, ok := got["icon"]; ok {
+		t.Fatalf("entity = %v", got)
+	}
+	if _, ok := got["group"]; ok {
+		t.Fatalf("entity = %v", got)
+	}
+}
+
+func TestHandleVirtualDeviceStateUpdate_CameraSendsRoomState(t *testing.T) {
+	cam := setupRoomCamerasTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	subscribeLive(sub)
+	t.Cleanup(func() { unsubscribeLive(sub) })
+
+	handleVirtualDeviceStateUpdate(cam)
+	msgs := sub.pendingMessages()
+	if len(msgs) != 1 || msgs[0].Type != liveMsgRoomState {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	if rs := msgs[0].Payload.(*RoomState); rs.ID != "hall" || len(rs.Cameras) != 2 {
+		t.Fatalf("room state = %+v", rs)
+	}
+}
+
+func TestUnknownRoomCameras(t *testing.T) {
+	cfg := &Config{Rooms: []RoomConfig{
+		{ID: "hall", Cameras: []string{"hall_cam", "old_cam"}},
+		{ID: "lab"},
+	}}
+	got := unknownRoomCameras(cfg, []string{"hall_cam", "yard_cam"})
+	if len(got) != 1 || got[0] != "room hall references camera old_cam, which Frigate doesn't know" {
+		t.Fatalf("unknown = %v", got)
+	}
+}
+
+func TestLiveSubscriber_SlowWriterSeesFinalState(t *testing.T) {
+	setupLiveWsTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	subscribeLive(sub)
+	defer unsubscribeLive(sub)
+
+	const updates = 200
+	var (
+		mu       sync.Mutex
+		sent     int
+		lastTemp float64
+	)
+	stop := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sub.notify:
+				for _, msg := range sub.pendingMessages() {
+					time.Sleep(5 * time.Millisecond) // a client on a bad link
+					update := msg.Payload.(entityUpdatePayload)
+					mu.Lock()
+					sent++
+					lastTemp = update.Entity.State.(float64)
+					mu.Unlock()
+				}
+			}
+		}
+	}()
+
+	room, ent := GetConfig().Rooms[0], GetConfig().Rooms[0].Entities[0]
+	for i := 1; i <= updates; i++ {
+		setTemp(float64(i))
+		broadcastEntityUpdate(room, ent, vdevManager.Device("hall/temp"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got, n := lastTemp, sent
+		mu.Unlock()
+		if got == updates {
+			if n >= updates {
+				t.Fatalf("expected intermediate states to be skipped, sent %d messages", n)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slow writer never caught up: last state %v after %d messages", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-writerDone
+}
+
+func TestEncodeLiveMessage_V1KeepsLegacyShapes(t *testing.T) {
+	info := wire(t, liveWsProtocolV1, liveMessage{Type: liveMsgServerInfo, Payload: serverInfoPayload{Version: "abc"}})
+	if info["type"] != liveMsgServerInfo || info["version"] != "abc" || info["payload"] != nil {
+		t.Fatalf("unexpected v1 server_info: %v", info)
+	}
+
+	delta := liveMessage{Type: liveMsgEntityUpdate, Payload: entityUpdatePayload{RoomID: "hall"}}
+	if got := encodeLiveMessage(liveWsProtocolV1, delta, time.Now()); got != nil {
+		t.Fatalf("entity_update has no v1 form, got %v", got)
+	}
+}
+
+func TestLiveSubscriber_HelloNegotiatesVersion(t *testing.T) {
+	cl := newLiveSubscriber(liveWsProtocolV1, nil)
+
+	cl.handleClientMessage([]byte(`{"type":"hello","v":2}`))
+	if cl.protocolVersion() != liveWsProtocolV2 {
+		t.Fatalf("hello v2 did not upgrade the client")
+	}
+	select {
+	case <-cl.resync:
+	default:
+		t.Fatalf("hello must trigger a resync in the new format")
+	}
+
+	cl.handleClientMessage([]byte(`{"type":"hello","v":7}`))
+	if cl.protocolVersion() != liveWsProtocolV1 {
+		t.Fatalf("unknown version must fall back to v1")
+	}
+
+	// Garbage and unknown messages are ignored.
+	<-cl.resync
+	cl.handleClientMessage([]byte(`not json`))
+	cl.handleClientMessage([]byte(`{"type":"bogus"}`))
+	select {
+	case <-cl.resync:
+		t.Fatalf("unexpected resync for ignored messages")
+	default:
+	}
+}
+
+func TestLiveSubscriber_ResyncReturnsFollowedRooms(t *testing.T) {
+	setupLiveWsTest(t)
+	GetConfig().Rooms = append(GetConfig().Rooms,
+		RoomConfig{ID: "lab"},
+		RoomConfig{ID: "attic"},
+	)
+
+	sub := newLiveSubscriber(liveWsProtocolV2, parseLiveRoomFilter("hall,lab"))
+	sub.handleClientMessage([]byte(`{"type":"resync"}`))
+
+	msg := wire(t, liveWsProtocolV2, <-sub.control)
+	if msg["type"] != liveMsgResync {
+		t.Fatalf("unexpected reply: %v", msg)
+	}
+	rooms := msg["payload"].(map[string]any)["rooms"].([]any)
+	if len(rooms) != 2 || rooms[0].(map[string]any)["id"] != "hall" || rooms[1].(map[string]any)["id"] != "lab" {
+		t.Fatalf("resync must cover exactly the followed rooms, got %v", rooms)
+	}
+
+	// A scoped resync only returns requested rooms the client follows.
+	reply := sub.answerResync([]string{"lab", "attic"}, time.Now().Add(time.Minute))
+	scoped := reply.Payload.(resyncPayload).Rooms
+	if len(scoped) != 1 || scoped[0].ID != "lab" {
+		t.Fatalf("scoped resync returned %v", scoped)
+	}
+}
+
+func TestLiveSubscriber_ResyncRateLimited(t *testing.T) {
+	setupLiveWsTest(t)
+	sub := newLiveSubscriber(liveWsProtocolV1, nil)
+	now := time.Now()
+
+	if reply := sub.answerResync(nil, now); reply.Type != liveMsgResync {
+		t.Fatalf("first resync should succeed, got %v", reply.Type)
+	}
+
+	limited := wire(t, liveWsProtocolV1, sub.answerResync(nil, now.Add(time.Second)))
+	if limited["type"] != liveMsgError || limited["code"] != "rate_limited" {
+		t.Fatalf("expected rate limit error frame, got %v", limited)
+	}
+
+	if reply := sub.answerResync(nil, now.Add(liveResyncMinInterval)); reply.Type != liveMsgResync {
+		t.Fatalf("resync after the interval should succeed, got %v", reply.Type)
+	}
+}
+
+// setupLiveWsAuthTest enables live websocket auth against an in-memory DB and
+// returns an app whose upgrade route answers 200 with the authenticated user.
+func setupLiveWsAuthTest(t *testing.T) *fiber.App {
+	t.Helper()
+	setupTestDB(t)
+	prevCfg := GetConfig()
+	t.Cleanup(func() { setConfig(prevCfg) })
+	setConfig(&Config{Web: WebConfig{LiveWsRequireAuth: true}})
+
+	app := fiber.New()
+	app.Get("/api/v1/live-ws", LiveWsAuthMiddleware, func(c *fiber.Ctx) error {
+		username, _ := c.Locals("username").(string)
+		return c.SendString(username)
+	})
+	return app
+}
+
+func createTestSession(t *testing.T, session SessionModel) {
+	t.Helper()
+	if err := gormDB.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func liveWsStatus(t *testing.T, app *fiber.App, target, cookie string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: cookie})
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestLiveWsAuth_Allowed(t *testing.T) {
+	app := setupLiveWsAuthTest(t)
+	createTestSession(t, SessionModel{ID: "s1", Subject: "u1", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if status, user := liveWsStatus(t, app, "/api/v1/live-ws", "s1"); status != fiber.StatusOK || user != "alice" {
+		t.Fatalf("cookie auth: got %d %q", status, user)
+	}
+	if status, user := liveWsStatus(t, app, "/api/v1/live-ws?token=s1", ""); status != fiber.StatusOK || user != "alice" {
+		t.Fatalf("token auth: got %d %q", status, user)
+	}
+}
+
+func TestLiveWsAuth_Rejected(t *testing.T) {
+	app := setupLiveWsAuthTest(t)
+
+	if status, _ := liveWsStatus(t, app, "/api/v1/live-ws", ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("missing session: got %d, want 401", status)
+	}
+	if status, _ := liveWsStatus(t, app, "/api/v1/live-ws?token=bogus", ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("unknown session: got %d, want 401", status)
+	}
+
+	// With the option off, anonymous clients are still let through.
+	GetConfig().Web.LiveWsRequireAuth = false
+	if status, _ := liveWsStatus(t, app, "/api/v1/live-ws", ""); status != fiber.StatusOK {
+		t.Fatalf("auth disabled: got %d, want 200", status)
+	}
+}
+
+func TestLiveWsAuth_Expired(t *testing.T) {
+	app := setupLiveWsAuthTest(t)
+	createTestSession(t, SessionModel{ID: "tablet", Subject: "tablet", Username: "tablet", IsTablet: true, ExpiresAt: time.Now().Add(-time.Minute)})
+	createTestSession(t, SessionModel{ID: "s1", Subject: "u1", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if status, _ := liveWsStatus(t, app, "/api/v1/live-ws", "tablet"); status != fiber.StatusUnauthorized {
+		t.Fatalf("expired tablet session: got %d, want 401", status)
+	}
+
+	// A session that expired mid-connection fails the periodic re-check,
+	// even while its row is still there; OIDC sessions end sessionMaxAge
+	// after their token expiry.
+	if !liveWsSessionValid("s1") {
+		t.Fatalf("expected s1 to be valid")
+	}
+	createTestSession(t, SessionModel{ID: "s2", Subject: "u2", Username: "bob", ExpiresAt: time.Now().Add(-sessionMaxAge() - time.Minute)})
+	if liveWsSessionValid("s2") {
+		t.Fatalf("expected expired session to be invalid")
+	}
+}
+
+func TestLiveWsAuth_LocalSessionExpires(t *testing.T) {
+	app := setupLiveWsAuthTest(t)
+	createTestSession(t, SessionModel{ID: "stale", Subject: "local:bob", Username: "bob", IsLocal: true, ExpiresAt: time.Now().Add(-time.Minute)})
+	if status, _ := liveWsStatus(t, app, "/api/v1/live-ws", "stale"); status != fiber.StatusUnauthorized {
+		t.Fatalf("expired local session: got %d, want 401", status)
+	}
+
+	// A local session expiring mid-connection is closed with 4001.
+	setupLiveWsTest(t)
+	GetConfig().Web.LiveWsRequireAuth = true
+	prevInterval := liveWsSessionCheckInterval
+	t.Cleanup(func() { liveWsSessionCheckInterval = prevInterval })
+	liveWsSessionCheckInterval = 20 * time.Millisecond
+	createTestSession(t, SessionModel{ID: "s1", Subject: "local:alice", Username: "alice", IsLocal: true, ExpiresAt: time.Now().Add(300 * time.Millisecond)})
+
+	ws := fiber.New(fiber.Config{DisableStartupMessage: true})
+	ws.Get("/api/v1/live-ws", LiveWsAuthMiddleware, websocket.New(handleLiveWs))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ws.Listener(ln)
+	defer ws.ShutdownWithTimeout(time.Second)
+
+	conn, _, err := fastws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/api/v1/live-ws?v=2&token=s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for liveSubscriberCount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !fastws.IsCloseError(err, liveWsCloseSessionExpired) {
+				t.Fatalf("got %v, want close %d", err, liveWsCloseSessionExpired)
+			}
+			return
+		}
+	}
+}
+
+func TestLiveClients_ListingAndMetrics(t *testing.T) {
+	setupLiveWsTest(t)
+	sentBefore := liveMessagesSentTotal.Load()
+	wsBefore := testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportWs))
+	sseBefore := testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportSse))
+
+	ws := newLiveSubscriber(liveWsProtocolV2, nil)
+	ws.transport, ws.remoteAddr, ws.username = liveTransportWs, "10.0.0.1", "alice"
+	sse := newLiveSubscriber(liveWsProtocolV2, parseLiveRoomFilter("hall"))
+	sse.transport, sse.remoteAddr = liveTransportSse, "10.0.0.2"
+	subscribeLive(ws)
+	subscribeLive(sse)
+
+	ws.recordSent()
+	ws.recordSent()
+	sse.recordSent()
+	sse.markDirty("hall", "hall/temp", false)
+	sse.markDirty("hall", "hall/temp", false)
+
+	app := fiber.New()
+	app.Get("/ws-clients", handleLiveClients)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ws-clients", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients []liveClientInfo
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Fatalf("expected 2 clients, got %+v", clients)
+	}
+	if c := clients[0]; c.Transport != liveTransportWs || c.Username != "alice" || c.MessagesSent != 2 || c.Rooms != nil {
+		t.Fatalf("unexpected ws client: %+v", c)
+	}
+	if c := clients[1]; c.Transport != liveTransportSse || c.RemoteAddr != "10.0.0.2" || c.MessagesSent != 1 || c.Coalesced != 1 || len(c.Rooms) != 1 {
+		t.Fatalf("unexpected sse client: %+v", c)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewPrometheusCollector(vdevManager, GetConfig()))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent float64
+	for _, mf := range families {
+		if mf.GetName() == "at2_ws_messages_sent_total" {
+			sent = mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	if got := testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportWs)) - wsBefore; got != 1 {
+		t.Fatalf("at2_ws_clients{transport=ws} grew by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportSse)) - sseBefore; got != 1 {
+		t.Fatalf("at2_ws_clients{transport=sse} grew by %v, want 1", got)
+	}
+	if sent-float64(sentBefore) != 3 {
+		t.Fatalf("at2_ws_messages_sent_total grew by %v, want 3", sent-float64(sentBefore))
+	}
+
+	// Closing a connection removes its entry, once.
+	unsubscribeLive(ws)
+	unsubscribeLive(sse)
+	unsubscribeLive(sse)
+	if clients := liveClients(); len(clients) != 0 {
+		t.Fatalf("expected no clients after close, got %+v", clients)
+	}
+	if ws, sse := testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportWs)), testutil.ToFloat64(liveClientsGauge.WithLabelValues(liveTransportSse)); ws != wsBefore || sse != sseBefore {
+		t.Fatalf("at2_ws_clients after close: ws %v, sse %v", ws, sse)
+	}
+}
+
+func TestLiveWs_CompressedClientDecodesJSON(t *testing.T) {
+	setupLiveWsTest(t)
+	GetConfig().Web.LiveWsCompression = true
+	GetConfig().Web.LiveWsCompressionThreshold = 1 // compress everything
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/live-ws", websocket.New(handleLiveWs, websocket.Config{EnableCompression: true}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.ShutdownWithTimeout(time.Second)
+
+	dialer := fastws.Dialer{EnableCompression: true, HandshakeTimeout: 5 * time.Second}
+	conn, resp, err := dialer.Dial("ws://"+ln.Addr().String()+"/api/v1/live-ws?v=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the handler finish before the test restores the globals it reads.
+	defer func() {
+		conn.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for liveSubscriberCount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not negotiated, extensions = %q", ext)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{liveMsgServerInfo, liveMsgRoomState} {
+		var msg liveEnvelope
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("reading %s: %v", want, err)
+		}
+		if msg.Type != want {
+			t.Fatalf("got %s, want %s", msg.Type, want)
+		}
+	}
+}
+
+// setupLiveWsControlTest returns a subscriber authenticated as a local
+// session, with a zigbee2mqtt relay it may switch.
+func setupLiveWsControlTest(t *testing.T) (*liveSubscriber, *MockClient) {
+	t.Helper()
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	prevAdapter := mqttAdapter
+	t.Cleanup(func() { mqttAdapter = prevAdapter })
+
+	mockClient := &MockClient{}
+	mqttAdapter = &MQTTAdapter{log: testLogger, vdevMgr: vdevManager, client: mockClient, mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)}}
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "relay/hall_light", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "hall_light"}},
+	})
+	createTestSession(t, SessionModel{ID: "s1", Subject: "u1", Username: "alice", IsLocal: true, ExpiresAt: time.Now().Add(time.Hour)})
+
+	sub := newLiveSubscriber(liveWsProtocolV2, nil)
+	sub.username, sub.sessionID = "alice", "s1"
+	return sub, mockClient
+}
+
+// controlAck sends a control message and returns the acknowledgement as the
+// client receives it.
+func controlAck(t *testing.T, sub *liveSubscriber, raw string) map[string]any {
+	t.Helper()
+	sub.handleClientMessage([]byte(raw))
+	select {
+	case msg := <-sub.control:
+		return wire(t, sub.version, msg)
+	default:
+		t.Fatalf("no reply to %s", raw)
+		return nil
+	}
+}
+
+func TestLiveWsControl_Success(t *testing.T) {
+	sub, mockClient := setupLiveWsControlTest(t)
+
+	ack := controlAck(t, sub, `{"type":"control","id":"c1","deviceId":"relay/hall_light","state":"ON"}`)
+	if ack["type"] != liveMsgControlAck {
+		t.Fatalf("ack = %v", ack)
+	}
+	if payload, _ := ack["payload"].(map[string]any); payload["id"] != "c1" || payload["ok"] != true || payload["code"] != nil {
+		t.Fatalf("ack = %v", ack)
+	}
+	if mockClient.PublishedTopic != "zigbee2mqtt/hall_light/set" || string(mockClient.PublishedPayload) != `{"state":"ON"}` {
+		t.Fatalf("published %s %s", mockClient.PublishedTopic, mockClient.PublishedPayload)
+	}
+
+	// v1 clients get a flat acknowledgement.
+	sub.version = liveWsProtocolV1
+	ack = controlAck(t, sub, `{"type":"control","id":"c2","deviceId":"relay/hall_light","state":"OFF"}`)
+	if ack["type"] != liveMsgControlAck || ack["id"] != "c2" || ack["ok"] != true {
+		t.Fatalf("v1 ack = %v", ack)
+	}
+}
+
+func TestLiveWsControl_Rejections(t *testing.T) {
+	sub, mockClient := setupLiveWsControlTest(t)
+	anonymous := newLiveSubscriber(liveWsProtocolV2, nil)
+
+	cases := []struct {
+		sub             *liveSubscriber
+		raw, code, text string
+	}{
+		{sub, `{"type":"control","id":"v","deviceId":"relay/hall_light","state":"DIM"}`, "invalid", "must be ON, OFF or TOGGLE"},
+		{sub, `{"type":"control","id":"v","deviceId":"relay/hall_light"}`, "invalid", "required"},
+		{sub, `{"type":"control","id":"v","deviceId":"relay/missing","state":"ON"}`, "not_found", "not found"},
+		{anonymous, `{"type":"control","id":"v","deviceId":"relay/hall_light","state":"ON"}`, "unauthorized", "Not logged in"},
+	}
+	for _, tc := range cases {
+		ack := controlAck(t, tc.sub, tc.raw)
+		payload, _ := ack["payload"].(map[string]any)
+		message, _ := payload["message"].(string)
+		if payload["id"] != "v" || payload["ok"] != false || payload["code"] != tc.code || !strings.Contains(message, tc.text) {
+			t.Errorf("%s: ack = %v", tc.raw, ack)
+		}
+	}
+	if mockClient.PublishedTopic != "" {
+		t.Fatalf("rejected commands published to %s", mockClient.PublishedTopic)
+	}
+}
+
+func TestLiveWsControl_RateLimited(t *testing.T) {
+	sub, _ := setupLiveWsControlTest(t)
+	msg := liveClientMessage{Type: liveMsgControl, ID: "c", DeviceID: "relay/hall_light", State: "ON"}
+
+	now := time.Now()
+	for i := range liveControlBurst {
+		if ack := sub.answerControl(msg, now).Payload.(controlAckPayload); !ack.OK {
+			t.Fatalf("message %d rejected: %+v", i, ack)
+		}
+	}
+	if ack := sub.answerControl(msg, now.Add(time.Second)).Payload.(controlAckPayload); ack.OK || ack.Code != "rate_limited" {
+		t.Fatalf("message over the limit: %+v", ack)
+	}
+	// The next window accepts messages again.
+	if ack := sub.answerControl(msg, now.Add(liveControlWindow)).Payload.(controlAckPayload); !ack.OK {
+		t.Fatalf("message in the next window: %+v", ack)
+	}
+}
+
+func TestBuildRoomState_RestoredPeopleCount(t *testing.T) {
+	setupLiveWsTest(t)
+	vdevManager = NewVdevManager()
+	vdevManager.SetStateProvider(restoredStateProvider{state: 3, recordedAt: time.Unix(1_700_000_000, 0)})
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "frigate/person/hall", Type: VdevTypePerson}})
+
+	// Restored after a restart: the count is unknown until Frigate reports.
+	if rs := buildRoomState("hall"); rs.PeopleCount != 0 || !rs.DataStale {
+		t.Fatalf("restored: people = %d, stale = %v", rs.PeopleCount, rs.DataStale)
+	}
+
+	// Confirming the same count is a change, so clients learn it's fresh.
+	if changed := vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "frigate/person/hall", State: 3}}); !slices.Equal(changed, []string{"frigate/person/hall"}) {
+		t.Fatalf("changed = %v", changed)
+	}
+	if rs := buildRoomState("hall"); rs.PeopleCount != 3 || rs.DataStale {
+		t.Fatalf("updated: people = %d, stale = %v", rs.PeopleCount, rs.DataStale)
+	}
+	if changed := vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "frigate/person/hall", State: 3}}); len(changed) != 0 {
+		t.Fatalf("repeated fresh state changed %v", changed)
+	}
+
+	vdevManager.MarkStale("frigate/person/hall")
+	if rs := buildRoomState("hall"); rs.PeopleCount != 0 || !rs.DataStale {
+		t.Fatalf("stale: people = %d, stale = %v", rs.PeopleCount, rs.DataStale)
+	}
+}
+
+// decodeLive decodes a message written in the encoding into v.
+func decodeLive(t *testing.T, encoding string, data []byte, v any) {
+	t.Helper()
+	if encoding == liveWsEncodingJSON {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// typedEnvelope is liveEnvelope with the payload decoded as a P.
+type typedEnvelope[P any] struct {
+	Type    string `json:"type"`
+	Ts      int64  `json:"ts"`
+	Payload P      `json:"payload"`
+}
+
+// roundTripLive writes msg in the protocol version and encoding, reads it
+// back as a T and checks it matches what was written.
+func roundTripLive[T any](t *testing.T, encoding string, version int, msg liveMessage) {
+	t.Helper()
+	out := encodeLiveMessage(version, msg, time.UnixMilli(1700000000000))
+	data, err := marshalLive(encoding, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got T
+	decodeLive(t, encoding, data, &got)
+	if g, w := decode(t, got), decode(t, out); !reflect.DeepEqual(g, w) {
+		t.Errorf("v%d %s %s:\n got %v\nwant %v", version, encoding, msg.Type, g, w)
+	}
+}
+
+func TestLiveMessages_RoundTripBothEncodings(t *testing.T) {
+	setupLiveWsTest(t)
+	rs := buildRoomState("hall")
+	seen := time.UnixMilli(1699999000000)
+	rs.LatestPersonDetectedAt = &seen
+	alert := &Alert{ID: "a1", Rule: "hot", DeviceID: "hall/temp", Severity: "warning", State: "firing", Message: "too hot",
+		Value: 31.5, LastSeenAt: seen, Since: seen, FiredAt: seen, ResolvedAt: seen, AckedAt: seen, AckedBy: "alice"}
+
+	serverInfo := liveMessage{Type: liveMsgServerInfo, Payload: serverInfoPayload{Version: "abc"}}
+	roomState := liveMessage{Type: liveMsgRoomState, Payload: rs}
+	entityUpdate := liveMessage{Type: liveMsgEntityUpdate, Payload: entityUpdatePayload{RoomID: "hall", Entity: rs.Entities[0]}}
+	resync := liveMessage{Type: liveMsgResync, Payload: resyncPayload{Rooms: []*RoomState{rs}}}
+	errMsg := liveMessage{Type: liveMsgError, Payload: errorPayload{Code: "rate_limited", Message: "slow down"}}
+	ack := liveMessage{Type: liveMsgControlAck, Payload: controlAckPayload{ID: "c1", Code: "forbidden", Message: "no"}}
+	alertMsg := liveMessage{Type: liveMsgAlert, Payload: alert}
+
+	for _, encoding := range []string{liveWsEncodingJSON, liveWsEncodingMsgpack} {
+		roundTripLive[typedEnvelope[serverInfoPayload]](t, encoding, liveWsProtocolV2, serverInfo)
+		roundTripLive[typedEnvelope[RoomState]](t, encoding, liveWsProtocolV2, roomState)
+		roundTripLive[typedEnvelope[entityUpdatePayload]](t, encoding, liveWsProtocolV2, entityUpdate)
+		roundTripLive[typedEnvelope[resyncPayload]](t, encoding, liveWsProtocolV2, resync)
+		roundTripLive[typedEnvelope[errorPayload]](t, encoding, liveWsProtocolV2, errMsg)
+		roundTripLive[typedEnvelope[controlAckPayload]](t, encoding, liveWsProtocolV2, ack)
+		roundTripLive[typedEnvelope[Alert]](t, encoding, liveWsProtocolV2, alertMsg)
+
+		roundTripLive[map[string]any](t, encoding, liveWsProtocolV1, serverInfo)
+		roundTripLive[RoomState](t, encoding, liveWsProtocolV1, roomState)
+		roundTripLive[map[string]any](t, encoding, liveWsProtocolV1, resync)
+		roundTripLive[map[string]any](t, encoding, liveWsProtocolV1, errMsg)
+		roundTripLive[map[string]any](t, encoding, liveWsProtocolV1, ack)
+	}
+
+	// The field names are those of the JSON encoding, and the room is smaller.
+	out := encodeLiveMessage(liveWsProtocolV2, roomState, time.Now())
+	packed, _ := marshalLive(liveWsEncodingMsgpack, out)
+	plain, _ := marshalLive(liveWsEncodingJSON, out)
+	var generic map[string]any
+	decodeLive(t, liveWsEncodingMsgpack, packed, &generic)
+	payload, _ := generic["payload"].(map[string]any)
+	if _, ok := payload["people_count"]; !ok || generic["type"] != liveMsgRoomState {
+		t.Fatalf("msgpack room_state = %v", generic)
+	}
+	if len(packed) >= len(plain) {
+		t.Errorf("msgpack room_state is %d bytes, JSON %d", len(packed), len(plain))
+	}
+}
+
+// packClientMessage encodes a client message as MessagePack.
+func packClientMessage(t *testing.T, msg map[string]any) []byte {
+	t.Helper()
+	data, err := msgpack.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLiveSubscriber_RepliesAreNeverDropped(t *testing.T) {
+	sub, _ := setupLiveWsControlTest(t)
+	fill := func() {
+		for len(sub.control) < cap(sub.control) {
+			sub.queue(liveMessage{Type: liveMsgAlert})
+		}
+	}
+
+	// With the queue full of alerts the ack waits for the writer.
+	fill()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.handleClientMessage([]byte(`{"type":"control","id":"c1","deviceId":"relay/hall_light","state":"ON"}`))
+	}()
+	for range cap(sub.control) {
+		if msg := <-sub.control; msg.Type != liveMsgAlert {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+	select {
+	case msg := <-sub.control:
+		if ack, _ := msg.Payload.(controlAckPayload); ack.ID != "c1" || !ack.OK {
+			t.Fatalf("ack = %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ack was dropped")
+	}
+	<-done
+
+	// A client that doesn't read its replies is disconnected instead.
+	prevTimeout := liveReplyTimeout
+	t.Cleanup(func() { liveReplyTimeout = prevTimeout })
+	liveReplyTimeout = 20 * time.Millisecond
+	fill()
+	sub.handleClientMessage([]byte(`{"type":"control","id":"c2","deviceId":"relay/hall_light","state":"OFF"}`))
+	select {
+	case <-sub.stalled:
+	default:
+		t.Fatal("stalled client not disconnected")
+	}
+}
+
+func TestLiveSubscriber_MsgpackClientMessages(t *testing.T) {
+	sub, mockClient := setupLiveWsControlTest(t)
+	sub.version, sub.encoding = liveWsProtocolV1, liveWsEncodingMsgpack
+
+	sub.handleClientFrame(websocket.BinaryMessage, packClientMessage(t, map[string]any{"type": "hello", "v": 2}))
+	if sub.protocolVersion() != liveWsProtocolV2 {
+		t.Fatal("msgpack hello did not upgrade the client")
+	}
+	<-sub.resync
+
+	// Numbers decode as in JSON, a compact integer included.
+	var clientMsg liveClientMessage
+	raw, err := msgpackToJSON(packClientMessage(t, map[string]any{"type": "control", "id": "c1", "deviceId": "relay/hall_light", "state": int8(1)}))
+	if err != nil || json.Unmarshal(raw, &clientMsg) != nil || clientMsg.State != 1.0 {
+		t.Fatalf("decoded %s into %+v, %v", raw, clientMsg, err)
+	}
+
+	sub.handleClientFrame(websocket.BinaryMessage, packClientMessage(t, map[string]any{"type": "control", "id": "c2", "deviceId": "relay/hall_light", "state": "ON"}))
+	msg := <-sub.control
+	if ack, _ := msg.Payload.(controlAckPayload); ack.ID != "c2" || !ack.OK {
+		t.Fatalf("ack = %+v", msg)
+	}
+	if string(mockClient.PublishedPayload) != `{"state":"ON"}` {
+		t.Fatalf("published %s", mockClient.PublishedPayload)
+	}
+
+	// Text frames are still JSON; garbage is ignored.
+	sub.handleClientFrame(websocket.TextMessage, []byte(`{"type":"control","id":"c3","deviceId":"relay/hall_light","state":"OFF"}`))
+	if msg := <-sub.control; msg.Payload.(controlAckPayload).ID != "c3" {
+		t.Fatalf("ack = %+v", msg)
+	}
+	sub.handleClientFrame(websocket.BinaryMessage, []byte{0xc1})
+	select {
+	case msg := <-sub.control:
+		t.Fatalf("reply to garbage: %+v", msg)
+	default:
+	}
+}
+
+func TestLiveWs_MsgpackEncoding(t *testing.T) {
+	setupLiveWsTest(t)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/live-ws", websocket.New(handleLiveWs))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.ShutdownWithTimeout(time.Second)
+
+	conn, _, err := fastws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/api/v1/live-ws?v=2&encoding=msgpack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Close()
+		deadline := time.Now().Add(5 * time.Second)
+		for liveSubscriberCount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{liveMsgServerInfo, liveMsgRoomState} {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading %s: %v", want, err)
+		}
+		var msg typedEnvelope[map[string]any]
+		decodeLive(t, liveWsEncodingMsgpack, data, &msg)
+		if frameType != fastws.BinaryMessage || msg.Type != want {
+			t.Fatalf("got %s in frame %d, want %s", msg.Type, frameType, want)
+		}
+	}
+	if clients := liveClients(); len(clients) != 1 || clients[0].Encoding != liveWsEncodingMsgpack {
+		t.Fatalf("clients = %+v", clients)
+	}
+
+	// A resync asked in MessagePack is answered in MessagePack.
+	if err := conn.WriteMessage(fastws.BinaryMessage, packClientMessage(t, map[string]any{"type": "resync"})); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resync typedEnvelope[resyncPayload]
+	decodeLive(t, liveWsEncodingMsgpack, data, &resync)
+	if resync.Type != liveMsgResync || len(resync.Payload.Rooms) != 1 || resync.Payload.Rooms[0].PeopleCount != 2 {
+		t.Fatalf("resync = %+v", resync)
+	}
+}
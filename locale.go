@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// fallbackLocale is the language names fall back to after the requested one
+// and web.default_locale.
+const fallbackLocale = "en"
+
+// defaultLocale returns web.default_locale, "pl" when unset.
+func defaultLocale() string {
+	if cfg := GetConfig(); cfg != nil && cfg.Web.DefaultLocale != "" {
+		return cfg.Web.DefaultLocale
+	}
+	return "pl"
+}
+
+// Resolve returns the name in lang, falling back to web.default_locale, then
+// English, then the first language set (alphabetically). Empty when no name
+// is set at all; callers show the ID then.
+func (s LocalizedString) Resolve(lang string) string {
+	for _, l := range []string{lang, defaultLocale(), fallbackLocale} {
+		if name := s[l]; l != "" && name != "" {
+			return name
+		}
+	}
+	langs := make([]string, 0, len(s))
+	for l, name := range s {
+		if name != "" {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	return s[slices.Min(langs)]
+}
+
+// configLocales lists the languages room and entity names are given in.
+func configLocales(cfg *Config) []string {
+	seen := map[string]struct{}{}
+	for _, room := range cfg.Rooms {
+		for l := range room.LocalizedName {
+			seen[l] = struct{}{}
+		}
+		for _, ent := range room.Entities {
+			for l := range ent.LocalizedName {
+				seen[l] = struct{}{}
+			}
+		}
+	}
+	locales := make([]string, 0, len(seen))
+	for l := range seen {
+		locales = append(locales, l)
+	}
+	slices.Sort(locales)
+	return locales
+}
+
+// requestLocale picks the language for the name fields of a response: the
+// lang query parameter, else the best Accept-Language match among available.
+// Languages not in available resolve like no language at all, so they are
+// returned as "".
+func requestLocale(c *fiber.Ctx, available []string) string {
+	if lang := strings.ToLower(c.Query("lang")); lang != "" {
+		if slices.Contains(available, lang) {
+			return lang
+		}
+		return ""
+	}
+	return negotiateLocale(c.Get(fiber.HeaderAcceptLanguage), available)
+}
+
+// negotiateLocale returns the available language the Accept-Language header
+// prefers most, matching "pl-PL" to "pl". Empty when none is acceptable.
+func negotiateLocale(header string, available []string) string {
+	type acceptedLocale struct {
+		tag string
+		q   float64
+	}
+	var accepted []acceptedLocale
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && tag != "*" && q > 0 {
+			accepted = append(accepted, acceptedLocale{tag, q})
+		}
+	}
+	slices.SortStableFunc(accepted, func(a, b acceptedLocale) int { return cmp.Compare(b.q, a.q) })
+
+	for _, a := range accepted {
+		primary, _, _ := strings.Cut(a.tag, "-")
+		for _, l := range []string{a.tag, primary} {
+			if slices.Contains(available, l) {
+				return l
+			}
+		}
+	}
+	return ""
+}
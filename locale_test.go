@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestLocalizedStringResolve(t *testing.T) {
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	setConfig(&Config{Web: WebConfig{DefaultLocale: "de"}})
+
+	names := LocalizedString{"en": "Lab", "de": "Labor", "pl": "Pracownia"}
+	for _, tc := range []struct {
+		names LocalizedString
+		lang  string
+		want  string
+	}{
+		{names, "pl", "Pracownia"},
+		{names, "fr", "Labor"},
+		{names, "", "Labor"},
+		{LocalizedString{"en": "Lab", "pl": "Pracownia"}, "fr", "Lab"},
+		{LocalizedString{"uk": "Лабораторія", "cs": "Laboratoř"}, "fr", "Laboratoř"},
+		{LocalizedString{"pl": "", "en": "Lab"}, "pl", "Lab"},
+		{LocalizedString{}, "pl", ""},
+		{nil, "pl", ""},
+	} {
+		if got := tc.names.Resolve(tc.lang); got != tc.want {
+			t.Errorf("%v.Resolve(%q) = %q, want %q", tc.names, tc.lang, got, tc.want)
+		}
+	}
+
+	// Without web.default_locale, Polish comes before English.
+	setConfig(&Config{})
+	if got := names.Resolve("fr"); got != "Pracownia" {
+		t.Errorf("default locale: Resolve = %q", got)
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	available := []string{"en", "pl"}
+	for header, want := range map[string]string{
+		"":                          "",
+		"pl":                        "pl",
+		"pl-PL,pl;q=0.9,en;q=0.8":   "pl",
+		"de-DE, en;q=0.5, pl;q=0.8": "pl",
+		"en-GB;q=0.9, pl;q=0.1":     "en",
+		"de, *;q=0.5":               "",
+		"pl;q=0, en":                "en",
+		"pl;q=abc, en;q=0.2":        "en",
+	} {
+		if got := negotiateLocale(header, available); got != want {
+			t.Errorf("negotiateLocale(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestHandleGetRoomStates_Lang(t *testing.T) {
+	setupLiveWsTest(t)
+	GetConfig().Rooms[0].LocalizedName = LocalizedString{"en": "Hall", "pl": "Korytarz"}
+	GetConfig().Rooms[0].Entities[0].LocalizedName = LocalizedString{"en": "Temperature"}
+	app := fiber.New()
+	app.Get("/api/v1/room-states", handleGetRoomStates)
+
+	get := func(target, acceptLanguage string) RoomState {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if acceptLanguage != "" {
+			req.Header.Set(fiber.HeaderAcceptLanguage, acceptLanguage)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states []RoomState
+		if err := json.NewDecoder(resp.Body).Decode(&states); err != nil || len(states) != 1 {
+			t.Fatalf("states = %+v, err = %v", states, err)
+		}
+		return states[0]
+	}
+
+	rs := get("/api/v1/room-states?lang=en", "pl")
+	if rs.Name != "Hall" || rs.Entities[0].Name != "frigate/person/hall" || rs.Entities[1].Name != "Temperature" {
+		t.Fatalf("lang=en: %+v", rs)
+	}
+	if len(rs.LocalizedName) != 2 {
+		t.Fatalf("localized_name = %v", rs.LocalizedName)
+	}
+	rs = get("/api/v1/room-states", "pl-PL")
+	if rs.Name != "Korytarz" || rs.Entities[1].Name != "Temperature" {
+		t.Fatalf("Accept-Language pl-PL: %+v", rs)
+	}
+}
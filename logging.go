@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// LoggingConfig configures the log output.
+type LoggingConfig struct {
+	// Level is debug, info (default), warn or error. A config reload
+	// changes it.
+	Level string `yaml:"level"`
+	// Format is text (default) or json, one object per line.
+	Format string `yaml:"format"`
+}
+
+// logLevel is the level of the default logger, so reloads can change it.
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// validateLoggingConfig fails fast on a level or format that can't be used.
+func validateLoggingConfig(cfg *Config, cfgPath string) error {
+	if _, err := parseLogLevel(cfg.Logging.Level); err != nil {
+		return fmt.Errorf("logging.level %q is not debug, info, warn or error in %s", cfg.Logging.Level, cfgPath)
+	}
+	if _, err := newLogHandler(io.Discard, cfg.Logging, logLevel); err != nil {
+		return fmt.Errorf("%v in %s", err, cfgPath)
+	}
+	return nil
+}
+
+// newLogHandler returns a handler writing to w in the configured format.
+func newLogHandler(w io.Writer, cfg LoggingConfig, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("logging.format %q is not text or json", cfg.Format)
+}
+
+// setupLogging makes the default logger write to stderr as configured. The
+// log package writes through it too, at info level.
+func setupLogging(cfg *Config) error {
+	level, err := parseLogLevel(cfg.Logging.Level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	h, err := newLogHandler(os.Stderr, cfg.Logging, logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+
+	OnConfigReload(func(cfg *Config) {
+		if level, err := parseLogLevel(cfg.Logging.Level); err == nil {
+			logLevel.Set(level)
+		}
+	})
+	return nil
+}
+
+// componentLogger returns the default logger with a component attribute, for
+// passing into a service.
+func componentLogger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// testLogger is passed to services under test; their logs aren't checked.
+var testLogger = slog.New(slog.DiscardHandler)
+
+func TestNewLogHandler_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := newLogHandler(&buf, LoggingConfig{Format: "json"}, slog.LevelWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("component", "mqtt")
+	logger.Info("subscribing", "topic", "zigbee2mqtt/#")
+	logger.Warn("update failed", "topic", "zigbee2mqtt/lab", "device", "lab/temp")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want only the warning, got %q", buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("%q: %v", lines[0], err)
+	}
+	if entry["level"] != "WARN" || entry["msg"] != "update failed" || entry["component"] != "mqtt" || entry["device"] != "lab/temp" {
+		t.Fatalf("entry = %v", entry)
+	}
+}
+
+func TestNewLogHandler_LevelVar(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	h, err := newLogHandler(&buf, LoggingConfig{}, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Debug("message", "topic", "frigate/camera_activity")
+	if buf.Len() != 0 {
+		t.Fatalf("debug logged at info level: %q", buf.String())
+	}
+	// A reload lowers the level of existing loggers.
+	level.Set(slog.LevelDebug)
+	logger.Debug("message", "topic", "frigate/camera_activity")
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), "topic=frigate/camera_activity") {
+		t.Fatalf("text output = %q", buf.String())
+	}
+}
+
+func TestValidateLoggingConfig(t *testing.T) {
+	for _, tc := range []struct {
+		logging LoggingConfig
+		ok      bool
+	}{
+		{LoggingConfig{}, true},
+		{LoggingConfig{Level: "debug", Format: "json"}, true},
+		{LoggingConfig{Level: "WARN", Format: "text"}, true},
+		{LoggingConfig{Level: "verbose"}, false},
+		{LoggingConfig{Format: "logfmt"}, false},
+	} {
+		if err := validateLoggingConfig(&Config{Logging: tc.logging}, "at2.yaml"); (err == nil) != tc.ok {
+			t.Errorf("%+v: err = %v", tc.logging, err)
+		}
+	}
+}
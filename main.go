@@ -3,33 +3,20 @@ package main
 import (
 	_ "embed" // for embedding template
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"net/http" // for http.TimeFormat
+	"log/slog"
+	"os"
 	"runtime/pprof"
-	"sync"
-	"time"
 
-	"github.com/gofiber/adaptor/v2"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-var FRIGATE_URL string
 var PORT string
 
-type CameraImage struct {
-	Data      []byte
-	Timestamp time.Time
-}
-
 var (
-	cameraImages          = sync.Map{} // map[string]CameraImage
 	vdevManager           *VdevManager
 	mqttAdapter           *MQTTAdapter
 	frigateSnapshotMapper *FrigateSnapshotMapper
@@ -39,20 +26,59 @@ var (
 	bambuService          *BambuService
 	pushService           *PushService
 	exitBoardService      *ExitBoardService
+	weatherService        *WeatherService
+	sunService            *SunService
+	usageStatsWorker      *UsageStatsWorker
+	autoOffService        *AutoOffService
+	comfortService        *ComfortService
+	spaceStateService     *SpaceStateService
+	snapshotArchiver      *SnapshotArchiver
+	alertEngine           *AlertEngine
+	alertSilences         *AlertSilences
+	notifications         *NotificationDispatcher
+	telegramBot           *TelegramBot
+	databaseBackups       *DatabaseBackups
+	deviceAliases         *DeviceAliases
 )
 
 func main() {
 	devFrontend := flag.Bool("dev-frontend", false, "Start frontend in dev mode")
+	checkConfig := flag.Bool("check-config", false, "Validate the config file given as argument (or found in the usual places) and exit")
+	importHA := flag.String("import-ha", "", "Import history from the Home Assistant recorder database at this path and exit")
+	entityMap := flag.String("entity-map", "", "YAML file mapping Home Assistant entity IDs to devices, for -import-ha")
+	dryRun := flag.Bool("dry-run", false, "With -import-ha, only report what would be imported")
 	flag.Parse()
 
-	cfg := MustLoadConfig()
+	if *checkConfig {
+		os.Exit(runCheckConfig(flag.Arg(0), os.Stdout))
+	}
+	if *importHA != "" {
+		os.Exit(runImportHA(*importHA, *entityMap, *dryRun, os.Stdout))
+	}
 
-	err := initAuth()
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	if err := setupLogging(cfg); err != nil {
+		log.Fatalf("failed to set up logging: %v", err)
+	}
+	liveLog = componentLogger("live")
+	authLog = componentLogger("auth")
+	configLog = componentLogger("config")
+	controlLog = componentLogger("control")
+	deviceLog = componentLogger("devices")
+	vdevLog = componentLogger("vdev")
+	build := currentBuildInfo()
+	slog.Info("starting at2", "version", build.Version, "git_commit", build.GitCommitHash, "build_date", build.BuildDate)
+
+	err = initAuth()
 	if err != nil {
 		log.Fatalf("failed to initialize authentication: %v", err)
 	}
 
 	vdevManager = NewVdevManager()
+	vdevManager.SetControlProhibited(func(deviceID string) bool { return controlProhibited(GetConfig(), deviceID) })
 
 	// Initialize database
 	db, err := gorm.Open(sqlite.Open(cfg.Database.Path), &gorm.Config{})
@@ -68,17 +94,31 @@ func main() {
 		log.Fatalf("failed to run database migrations: %v", err)
 	}
 	gormDB = db
-	log.Printf("Database initialized at %s", cfg.Database.Path)
+	slog.Info("database initialized", "path", cfg.Database.Path)
+	deviceAliases, err = NewDeviceAliases(db)
+	if err != nil {
+		log.Fatalf("failed to initialize device aliases: %v", err)
+	}
+	startSessionCleanup()
 
 	// Create history repository (registers itself as listener)
-	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(db, vdevManager)
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(db, vdevManager, componentLogger("history"))
 
-	mqttAdapter, err = NewMQTTAdapter(cfg, vdevManager)
+	mqttAdapter, err = NewMQTTAdapter(cfg, vdevManager, componentLogger("mqtt"))
 	if err != nil {
 		log.Fatalf("failed to initialize MQTT adapter: %v", err)
 	}
 
-	frigateSnapshotMapper = NewFrigateSnapshotMapper(vdevManager, cfg)
+	frigateSnapshotMapper = NewFrigateSnapshotMapper(vdevManager, cfg, componentLogger("frigate_snapshots"))
+	OnConfigReload(frigateSnapshotMapper.Reconfigure)
+	if cfg.Frigate.Archive != nil {
+		snapshotArchiver = NewSnapshotArchiver(cfg, componentLogger("snapshot_archive"))
+		if err := snapshotArchiver.Start(); err != nil {
+			log.Fatalf("failed to start snapshot archive: %v", err)
+		}
+		frigateSnapshotMapper.archiver = snapshotArchiver
+		slog.Info("archiving camera snapshots", "dir", snapshotArchiver.dir)
+	}
 	err = frigateSnapshotMapper.Start()
 	// if err != nil {
 	// 	log.Fatalf("failed to start Frigate snapshot mapper: %v", err)
@@ -94,55 +134,141 @@ func main() {
 
 	// Optional DHCP lease tracking service.
 	if cfg.Dhcp != nil {
-		dhcpService, err = NewDhcpService(cfg, db)
+		dhcpService, err = NewDhcpService(cfg, db, componentLogger("dhcp"))
 		if err != nil {
 			log.Fatalf("failed to initialize DHCP service: %v", err)
 		}
 		dhcpService.Start()
-		log.Printf("DHCP lease tracking started")
+		slog.Info("DHCP lease tracking started")
 	}
 
 	// Web push service (VAPID keys persisted in the database).
-	pushService, err = NewPushService(db)
+	pushService, err = NewPushService(db, componentLogger("push"))
 	if err != nil {
 		log.Fatalf("failed to initialize push service: %v", err)
 	}
 
 	// Optional Bambu Labs printer monitoring.
 	if len(cfg.BambuPrinters) > 0 {
-		bambuService, err = NewBambuService(cfg, vdevManager, pushService, db)
+		bambuService, err = NewBambuService(cfg, vdevManager, pushService, db, componentLogger("bambu"))
 		if err != nil {
 			log.Fatalf("failed to initialize Bambu service: %v", err)
 		}
 		bambuService.Start()
-		log.Printf("Bambu printer monitoring started for %d printer(s)", len(cfg.BambuPrinters))
+		slog.Info("Bambu printer monitoring started", "printers", len(cfg.BambuPrinters))
 	}
 
 	// Optional exit-board MQTT publisher.
 	if cfg.ExitBoard != nil && cfg.ExitBoard.MQTTPrefix != "" {
-		exitBoardService = NewExitBoardService(cfg, vdevManager, mqttAdapter)
+		exitBoardService = NewExitBoardService(cfg, vdevManager, mqttAdapter, componentLogger("exit_board"))
 		exitBoardService.Start()
-		log.Printf("Exit board publishing to %s/<room_id>", cfg.ExitBoard.MQTTPrefix)
+		slog.Info("exit board publishing", "topic", cfg.ExitBoard.MQTTPrefix+"/<room_id>")
+	}
+
+	// Relays with auto_off_minutes.
+	autoOffService = NewAutoOffService(cfg, vdevManager, mqttAdapter.ControlDevice, componentLogger("auto_off"))
+	autoOffService.Start()
+
+	// Comfort devices derived from thermometers and hygrometers.
+	comfortService = NewComfortService(cfg, vdevManager, componentLogger("comfort"))
+	comfortService.Start()
+
+	// Outdoor conditions from Open-Meteo.
+	if cfg.Weather != nil {
+		weatherService = NewWeatherService(cfg, vdevManager, componentLogger("weather"))
+		weatherService.Start()
+		lat, lon := cfg.Weather.coordinates(cfg)
+		slog.Info("polling the weather", "lat", lat, "lon", lon, "interval", weatherService.interval)
+	}
+
+	// Sun elevation and daylight, computed locally.
+	if cfg.Sun != nil {
+		sunService = NewSunService(cfg, vdevManager, componentLogger("sun"))
+		sunService.Start()
+	}
+
+	// Heavy usage heatmaps, precomputed in the background.
+	if cfg.UsageStats != nil {
+		usageStatsWorker = NewUsageStatsWorker(cfg, vdevManager, vdevHistoryRepo, componentLogger("usage_stats"))
+		usageStatsWorker.Start()
+	}
+
+	// Alert rules on device states, pushed to the live feed, webhooks, Matrix,
+	// Telegram and MQTT.
+	alertEngine = NewAlertEngine(cfg, vdevManager, componentLogger("alerts"))
+	alertSilences, err = NewAlertSilences(db)
+	if err != nil {
+		log.Fatalf("failed to initialize alert silences: %v", err)
+	}
+	alertEngine.SetSilences(alertSilences)
+	alertEngine.AddSink(liveAlertSink{})
+	if len(cfg.Notifications.Webhooks) > 0 || cfg.Notifications.Matrix != nil || cfg.Notifications.Telegram != nil {
+		notifications = NewNotificationDispatcher(cfg, componentLogger("notifications"))
+		notifications.Start()
+		alertEngine.AddSink(notifications)
+		slog.Info("sending alerts", "webhooks", len(cfg.Notifications.Webhooks), "matrix", cfg.Notifications.Matrix != nil, "telegram", cfg.Notifications.Telegram != nil)
+	}
+	if cfg.Notifications.Digest != nil && notifications != nil {
+		digest, err := NewAlertDigest(cfg, vdevManager, db, notifications, componentLogger("notifications"))
+		if err != nil {
+			log.Fatalf("failed to initialize digest: %v", err)
+		}
+		digest.Start()
+		slog.Info("sending a digest of low batteries and stale devices")
+	}
+	if tg := cfg.Notifications.Telegram; tg != nil && len(tg.AllowedUsers) > 0 {
+		telegramBot = NewTelegramBot(*tg, alertSilences, alertEngine, vdevManager, componentLogger("notifications"))
+		telegramBot.Start()
+		slog.Info("Telegram bot taking commands", "users", len(tg.AllowedUsers))
 	}
+	if cfg.Notifications.MQTT != nil {
+		mqttAlerts := NewMQTTAlertSink(cfg, mqttAdapter, componentLogger("notifications"))
+		mqttAlerts.Start(cfg)
+		alertEngine.AddSink(mqttAlerts)
+		slog.Info("publishing alerts", "topic", mqttAlerts.prefix+"/<rule>")
+	}
+	if cfg.Grafana != nil {
+		alertEngine.AddSink(grafanaAnnotations)
+	}
+	alertEngine.Start()
 
-	fiberCfg := fiber.Config{}
-	// When behind a trusted reverse proxy (e.g. Traefik), derive the real
-	// client IP from the X-Forwarded-For header instead of the proxy's IP.
-	if len(cfg.Web.TrustedProxies) > 0 {
-		fiberCfg.EnableTrustedProxyCheck = true
-		fiberCfg.TrustedProxies = cfg.Web.TrustedProxies
-		fiberCfg.ProxyHeader = fiber.HeaderXForwardedFor
+	// Scheduled database backups; a failure is notified like an alert.
+	if cfg.Database.Backup != nil {
+		var sink AlertSink
+		if notifications != nil {
+			sink = notifications
+		}
+		databaseBackups, err = NewDatabaseBackups(cfg, sink, componentLogger("backup"))
+		if err != nil {
+			log.Fatalf("failed to initialize database backups: %v", err)
+		}
+		if err := databaseBackups.Start(); err != nil {
+			log.Fatalf("failed to start database backups: %v", err)
+		}
+		slog.Info("backing up the database", "dir", databaseBackups.dir)
+	}
+
+	// Open/closed transitions for SpaceAPI's state.lastchange.
+	spaceStateService, err = NewSpaceStateService(cfg, vdevManager, db, componentLogger("spaceapi"))
+	if err != nil {
+		log.Fatalf("failed to initialize space state service: %v", err)
 	}
-	app := fiber.New(fiberCfg)
+	spaceStateService.Start()
+	vdevManager.OnVirtualDeviceUpdated = append(vdevManager.OnVirtualDeviceUpdated, invalidateSpaceAPICache)
+	vdevManager.OnVirtualDeviceUpdated = append(vdevManager.OnVirtualDeviceUpdated, invalidatePersonLastSeenCache)
 
-	// Prometheus
-	promRegistry := prometheus.NewRegistry()
-	promCollector := NewPrometheusCollector(vdevManager, cfg)
-	promRegistry.MustRegister(promCollector)
+	// Log configured entities that weren't discovered once discovery settled.
+	startReconcileReport(cfg, vdevManager, componentLogger("reconcile"))
+	OnConfigReload(func(*Config) { spaceAPIResponseCache.invalidate() })
+
+	app := fiber.New(fiberAppConfig(cfg))
+
+	httpLog := componentLogger("http")
+	app.Use(requestIDMiddleware, newAccessLogMiddleware(httpLog), newRecoverMiddleware(httpLog))
 
 	// Routes
 	app.Use(func(c *fiber.Ctx) error {
-		hostname := c.Hostname()
+		hostname := requestHost(c)
 		for _, domain := range cfg.Web.SpaceapiDomains {
 			if domain == hostname {
 				return handleSpaceAPI(c)
@@ -150,40 +276,112 @@ func main() {
 		}
 		return c.Next()
 	})
+	app.Use(RequireAuth)
 
-	app.Get("/metrics", adaptor.HTTPHandler(promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})))
+	registerMetricsRoute(app, cfg, vdevManager)
 	app.Get("/image/:name", AuthMiddleware, handleImage)
 	app.Get("/robots.txt", handleRobots)
 	app.Get("/api/v1/all-devices", handleDevices)
-	app.Get("/api/v1/live-ws", websocket.New(handleLiveWs))
+	app.Get("/api/v1/devices/search", handleDeviceSearch)
+	app.Get("/api/v1/device-aliases", handleListDeviceAliases)
+	app.Put("/api/v1/device/+/alias", AuthMiddleware, handleSetDeviceAlias)
+	app.Delete("/api/v1/device/+/alias", AuthMiddleware, handleDeleteDeviceAlias)
+	app.Get("/api/v1/live-ws", LiveWsAuthMiddleware, websocket.New(handleLiveWs, websocket.Config{EnableCompression: cfg.Web.LiveWsCompression}))
+	app.Get("/api/v1/live-sse", LiveWsAuthMiddleware, handleLiveSse)
 	app.Get("/api/v1/room-states", handleGetRoomStates)
+	app.Get("/api/v1/person-last-seen", handlePersonLastSeen)
+	app.Get("/api/v1/rooms", handleGetRooms)
 	app.Get("/api/v1/camera-snapshot/:filename", AuthMiddleware, frigateSnapshotMapper.HandleSnapshot)
+	app.Get("/api/v1/camera-stream/:camera", AuthMiddleware, frigateSnapshotMapper.HandleStream)
+	app.Get("/api/v1/camera-archive/:camera", AuthMiddleware, handleCameraArchiveList)
+	app.Get("/api/v1/camera-archive/:camera/:timestamp", AuthMiddleware, handleCameraArchiveSnapshot)
 	app.Get("/api/v1/auth/login", handleLoginRequest)
 	app.Get("/api/v1/auth/callback", handleAuthCallback)
 	app.Get("/api/v1/auth/me", handleMe)
+	app.Get("/api/v1/auth/logout", handleLogout)
 	app.Post("/api/v1/auth/logout", handleLogout)
 	app.Post("/api/v1/auth/backchannel-logout", handleBackchannelLogout)
 	app.Post("/api/v1/auth/tablet-auth", handleTabletAuth)
+	app.Post("/api/v1/auth/login-local", handleLocalLogin)
+	app.Get("/api/v1/auth/sessions", AuthMiddleware, handleListSessions)
+	app.Post("/api/v1/admin/backup", AuthMiddleware, AdminAuthMiddleware, handleDatabaseBackup)
+	app.Get("/api/v1/admin/backups", AuthMiddleware, AdminAuthMiddleware, handleListDatabaseBackups)
+	app.Delete("/api/v1/admin/device/+", AuthMiddleware, AdminAuthMiddleware, handleDeleteDevice)
+	app.Delete("/api/v1/auth/sessions/:id", AuthMiddleware, handleRevokeSession)
 	app.Get("/api/v1/reservations", TabletAuthMiddleware, handleReservations)
 	app.Post("/api/v1/control-relay", AuthMiddleware, handleControlRelay)
+	app.Post("/api/v1/control", AuthMiddleware, handleControl)
+	app.Get("/api/v1/scenes", AuthMiddleware, handleListScenes)
+	app.Post("/api/v1/scenes/:name/activate", AuthMiddleware, handleActivateScene)
+	app.Get("/api/v1/alerts", AuthMiddleware, handleListAlerts)
+	app.Post("/api/v1/alerts/:id/ack", AuthMiddleware, handleAckAlert)
 	app.Get("/api/v1/spaceapi", handleSpaceAPI)
+	app.Get("/spaceapi.json", handleSpaceAPI)
+	app.Get("/api/v1/space-open.ics", handleSpaceOpenCalendar)
+	app.Get("/badge.svg", handleBadge)
+	app.Get(ogImagePath, handleOGImage)
 	app.Get("/api/v1/app-config", handleAppConfig)
+	app.Get("/api/v1/version", handleVersion)
 	app.Get("/health", handleHealth)
+	app.Get("/healthz", handleHealth)
+	app.Get("/readyz", newReadyzHandler(func() []healthCheck { return readinessChecks(GetConfig()) }))
 	app.Get("/api/v1/device-history", handleDeviceHistory)
+	app.Get("/api/v1/events", handleEvents)
+	app.Get("/api/v1/energy-cost", handleEnergyCost)
+	app.Get("/api/v1/meter-stats", handleMeterStats)
 	app.Get("/api/v1/stats/usage-heatmap", handleUsageHeatmap)
+	app.Get("/api/v1/usage-prediction", handleUsagePrediction)
 	app.Get("/api/v1/debug/pprof-heap", AuthMiddleware, DebugAccessAuthMiddleware, handlePprofHeap)
+	app.Get("/api/v1/debug/ws-clients", AuthMiddleware, DebugAccessAuthMiddleware, handleLiveClients)
+	app.Get("/api/v1/debug/config-reload", AuthMiddleware, DebugAccessAuthMiddleware, handleConfigReloadStats)
+	app.Get("/api/v1/debug/config-report", AuthMiddleware, DebugAccessAuthMiddleware, handleConfigReport)
+	registerDebugRoutes(app, cfg)
+	registerGrafanaRoutes(app, cfg)
 	app.Get("/api/v1/dhcp/leases", AuthMiddleware, handleDhcpLeases)
 	app.Get("/api/v1/printer-thumbnail/+", handleBambuThumbnail)
 	app.Get("/api/v1/push/vapid-public-key", handlePushVapidKey)
 	app.Post("/api/v1/push/subscribe", handlePushSubscribe)
 	app.Post("/api/v1/push/unsubscribe", handlePushUnsubscribe)
 
-	SetupFrontend(app, *devFrontend)
+	frontend, err := SetupFrontend(app, *devFrontend)
+	if err != nil {
+		log.Fatalf("failed to set up frontend: %v", err)
+	}
+
+	// Reload rooms, rules and scenes on SIGHUP or when the file changes.
+	watchConfig(configPath)
+
+	stack := shutdownStack{app: app, snapshots: frigateSnapshotMapper, mqtt: mqttAdapter, history: vdevHistoryRepo}
+	if snapshotArchiver != nil {
+		stack.archive = snapshotArchiver
+	}
+	if notifications != nil {
+		stack.notify = notifications
+	}
+	if databaseBackups != nil {
+		stack.backup = databaseBackups
+	}
+	if telegramBot != nil {
+		stack.telegram = telegramBot
+	}
+	if frontend != nil {
+		stack.frontend = frontend
+	}
+	ln, err := newWebListener(cfg.Web)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	if cfg.Web.ListenUnixSocket != nil {
+		stack.unixSocket = cfg.Web.ListenUnixSocket.Path
+	}
+	shutdownDone := handleShutdownSignals(stack, componentLogger("shutdown"))
 
-	log.Printf("Starting Fiber server on %s", cfg.Web.ListenAddress)
-	if err := app.Listen(cfg.Web.ListenAddress); err != nil {
+	slog.Info("starting Fiber server", "addr", ln.Addr().String())
+	if err := app.Listener(ln); err != nil {
 		log.Fatalf("Fiber server failed: %v", err)
 	}
+	// Listen returns once the shutdown sequence stopped the server.
+	<-shutdownDone
 }
 
 func handleDeviceHistory(c *fiber.Ctx) error {
@@ -198,13 +396,19 @@ func handleDeviceHistory(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
+	if dev := vdevManager.Device(deviceName); dev != nil {
+		units := requestUnits(c)
+		for i := range history {
+			history[i].State = convertStoredState(dev.Type, history[i].State, units)
+		}
+	}
 
 	return c.JSON(history)
 }
 
 type ControlRelayRequest struct {
 	ID    string `json:"id"`
-	State string `json:"state"` // "ON" or "OFF"
+	State string `json:"state"` // "ON", "OFF" or "TOGGLE"
 }
 
 func handleControlRelay(c *fiber.Ctx) error {
@@ -213,11 +417,15 @@ func handleControlRelay(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
+	if ok, err := authorizeControl(c, req.ID); !ok {
+		return err
+	}
+
 	if mqttAdapter == nil {
 		return c.Status(fiber.StatusServiceUnavailable).SendString("MQTT adapter not initialized")
 	}
 
-	log.Printf("User %s requested to turn %s relay %s", c.Locals("username"), req.State, req.ID)
+	controlLog.Info("relay control requested", "user", c.Locals("username"), "device", req.ID, "state", req.State)
 
 	if err := mqttAdapter.ControlDevice(req.ID, req.State); err != nil {
 		// Differentiate between user error (bad ID/State) and system error?
@@ -233,40 +441,6 @@ func handleControlRelay(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func fetchAndCacheImage(name string) {
-	url := fmt.Sprintf("%s/api/%s/latest.webp?height=900&cache=%d", FRIGATE_URL, name, time.Now().Unix())
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching image for camera %s: %v", name, err)
-		return
-	}
-	defer resp.Body.Close()
-
-	imgBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading image for camera %s: %v", name, err)
-		return
-	}
-
-	cameraImages.Store(name, CameraImage{
-		Data:      imgBytes,
-		Timestamp: time.Now(),
-	})
-}
-
-func handleImage(c *fiber.Ctx) error {
-	name := c.Params("name")
-	if val, ok := cameraImages.Load(name); ok {
-		img := val.(CameraImage)
-		c.Set("Content-Type", "image/webp")
-		c.Set("Cache-Control", "no-cache")
-		c.Set("Last-Modified", img.Timestamp.Format(http.TimeFormat))
-		c.Set("Content-Length", fmt.Sprintf("%d", len(img.Data)))
-		return c.Status(fiber.StatusOK).Send(img.Data)
-	}
-	return fiber.ErrNotFound
-}
-
 var robotsTxt = []byte(`User-agent: *
 Disallow: /`)
 
@@ -276,25 +450,11 @@ func handleRobots(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).Send(robotsTxt)
 }
 
-func handleDevices(c *fiber.Ctx) error {
-	if mqttAdapter == nil {
-		return c.Status(fiber.StatusServiceUnavailable).SendString("MQTT adapter not initialized")
-	}
-	devices := vdevManager.Devices()
-
-	c.Set("Cache-Control", "no-cache")
-	return c.Status(fiber.StatusOK).JSON(devices)
-}
-
 func handleAppConfig(c *fiber.Ctx) error {
-	cfg := MustLoadConfig()
+	cfg := GetConfig()
 	return c.JSON(fiber.Map{
 		"branding": cfg.Branding,
-		"version": fiber.Map{
-			"git_repo_url":    GitRepoURL,
-			"git_commit_hash": GitCommitHash,
-			"git_commit_date": GitCommitDate,
-		},
+		"version":  currentBuildInfo(),
 	})
 }
 
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Default ranges of /api/v1/meter-stats, by resolution, when from is not
+// given.
+const (
+	meterStatsDefaultDayRange  = 30 * 24 * time.Hour
+	meterStatsDefaultHourRange = 24 * time.Hour
+)
+
+// MeterStatsBucket is the volume used within one bucket of
+// /api/v1/meter-stats.
+type MeterStatsBucket struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Consumption float64   `json:"consumption"`
+}
+
+// MeterStats is served by GET /api/v1/meter-stats.
+type MeterStats struct {
+	DeviceID   string             `json:"device_id"`
+	Unit       string             `json:"unit"`
+	Resolution string             `json:"resolution"`
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Buckets    []MeterStatsBucket `json:"buckets"`
+	Total      float64            `json:"total"`
+	// Resets counts the times the meter went back, e.g. when it was
+	// replaced or its counter wrapped.
+	Resets int `json:"resets"`
+}
+
+// isMeter reports whether devices of type t count an ever-increasing total.
+func isMeter(t VdevType) bool {
+	return t == VdevTypeWaterMeter || t == VdevTypeGasMeter
+}
+
+// meterConsumption adds the increases of a meter between consecutive
+// samples, oldest first, to the buckets. baseline is the last sample before
+// the range, nil when there is none.
+//
+// The history only records changes, so the meter read the previous value
+// until shortly before a sample: an increase is counted in the bucket of the
+// later sample, however long the gap since the previous one. A decrease is a
+// counter reset, after which the meter counted up from zero to the new value.
+// Samples that aren't numbers are skipped.
+func meterConsumption(history []VirtualDeviceStateModel, baseline *VirtualDeviceStateModel, buckets []MeterStatsBucket) (total float64, resets int) {
+	var prev float64
+	hasPrev := false
+	if baseline != nil {
+		prev, hasPrev = meterReading(*baseline)
+	}
+	i := 0
+	for _, h := range history {
+		cur, ok := meterReading(h)
+		if !ok {
+			continue
+		}
+		if !hasPrev {
+			prev, hasPrev = cur, true
+			continue
+		}
+		delta := cur - prev
+		if delta < 0 {
+			delta = cur
+			resets++
+		}
+		prev = cur
+
+		at := time.UnixMilli(h.Timestamp)
+		for i < len(buckets) && !buckets[i].End.After(at) {
+			i++
+		}
+		if i == len(buckets) {
+			break
+		}
+		if at.Before(buckets[i].Start) {
+			continue
+		}
+		buckets[i].Consumption += delta
+		total += delta
+	}
+	return total, resets
+}
+
+func meterReading(h VirtualDeviceStateModel) (float64, bool) {
+	var state any
+	if err := json.Unmarshal([]byte(h.State), &state); err != nil {
+		return 0, false
+	}
+	return toFloat64Internal(state)
+}
+
+// meterStatsLocation is the zone of the day buckets: the energy timezone
+// when configured, else the server's local time.
+func meterStatsLocation(cfg *Config) *time.Location {
+	if cfg.Energy != nil && cfg.Energy.Timezone != "" {
+		if loc, err := time.LoadLocation(cfg.Energy.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// handleMeterStats serves the consumption of a water or gas meter per hour
+// or day, computed from its history.
+func handleMeterStats(c *fiber.Ctx) error {
+	if vdevHistoryRepo == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "device history not available"})
+	}
+	deviceID := c.Query("deviceId")
+	if deviceID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "deviceId is required"})
+	}
+	dev := vdevManager.Device(deviceID)
+	if dev == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "device not found"})
+	}
+	if !isMeter(dev.Type) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("device is %s, not %s or %s", dev.Type, VdevTypeWaterMeter, VdevTypeGasMeter)})
+	}
+	resolution := c.Query("resolution", energyBucketDay)
+	defaultRange := meterStatsDefaultDayRange
+	switch resolution {
+	case energyBucketDay:
+	case energyBucketHour:
+		defaultRange = meterStatsDefaultHourRange
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("resolution must be %s or %s", energyBucketDay, energyBucketHour)})
+	}
+
+	to := time.Now()
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to must be an RFC 3339 time"})
+		}
+		to = t
+	}
+	from := to.Add(-defaultRange)
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be an RFC 3339 time"})
+		}
+		from = t
+	}
+	if !to.After(from) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be before to"})
+	}
+	ranges := energyBuckets(from, to, resolution, meterStatsLocation(GetConfig()))
+	if len(ranges) > maxEnergyCostBuckets {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("the range has more than %d buckets", maxEnergyCostBuckets)})
+	}
+	buckets := make([]MeterStatsBucket, len(ranges))
+	for i, r := range ranges {
+		buckets[i] = MeterStatsBucket{Start: r.Start, End: r.End}
+	}
+
+	baseline, err := vdevHistoryRepo.GetDeviceStateBefore(deviceID, from.UnixMilli())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	history, err := vdevHistoryRepo.GetDevicesHistoryInRange([]string{deviceID}, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	total, resets := meterConsumption(history, baseline, buckets)
+	return c.JSON(MeterStats{
+		DeviceID:   deviceID,
+		Unit:       vdevUnits[dev.Type],
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+		Buckets:    buckets,
+		Total:      total,
+		Resets:     resets,
+	})
+}
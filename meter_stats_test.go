@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func meterSample(at time.Time, value float64) VirtualDeviceStateModel {
+	return VirtualDeviceStateModel{Timestamp: at.UnixMilli(), State: fmt.Sprint(value)}
+}
+
+func TestMeterConsumption(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	buckets := make([]MeterStatsBucket, 3)
+	for i, r := range energyBuckets(day, day.Add(72*time.Hour), energyBucketDay, time.UTC) {
+		buckets[i] = MeterStatsBucket{Start: r.Start, End: r.End}
+	}
+	baseline := meterSample(day.Add(-2*time.Hour), 100)
+	history := []VirtualDeviceStateModel{
+		meterSample(day.Add(6*time.Hour), 100.5),
+		meterSample(day.Add(18*time.Hour), 101.25),
+		{Timestamp: day.Add(19 * time.Hour).UnixMilli(), State: `"unavailable"`},
+		// The meter was replaced mid-window and counts up from zero.
+		meterSample(day.Add(30*time.Hour), 0.5),
+		meterSample(day.Add(40*time.Hour), 2),
+		// No sample for a day: everything since is counted on the third.
+		meterSample(day.Add(70*time.Hour), 5),
+	}
+
+	total, resets := meterConsumption(history, &baseline, buckets)
+	for i, want := range []float64{1.25, 2, 3} {
+		if !approxEqual(buckets[i].Consumption, want) {
+			t.Errorf("bucket %d consumption = %v, want %v", i, buckets[i].Consumption, want)
+		}
+	}
+	if !approxEqual(total, 6.25) || resets != 1 {
+		t.Errorf("total %v with %d resets, want 6.25 with 1", total, resets)
+	}
+
+	// Without a baseline the first sample only sets the starting reading.
+	for i := range buckets {
+		buckets[i].Consumption = 0
+	}
+	if total, _ := meterConsumption(history, nil, buckets); !approxEqual(total, 5.75) || !approxEqual(buckets[0].Consumption, 0.75) {
+		t.Errorf("without baseline total %v, buckets %+v", total, buckets)
+	}
+}
+
+func TestHandleMeterStats(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "utility/water", Type: VdevTypeWaterMeter, State: 12.5},
+		{ID: "printer/power", Type: VdevTypePowerUsage, State: 0.0},
+	})
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, vdevManager, testLogger)
+	app := fiber.New()
+	app.Get("/api/v1/meter-stats", handleMeterStats)
+
+	for target, want := range map[string]int{
+		"/api/v1/meter-stats":                                                                          fiber.StatusBadRequest,
+		"/api/v1/meter-stats?deviceId=utility/gas":                                                     fiber.StatusNotFound,
+		"/api/v1/meter-stats?deviceId=printer/power":                                                   fiber.StatusBadRequest,
+		"/api/v1/meter-stats?deviceId=utility/water&resolution=week":                                   fiber.StatusBadRequest,
+		"/api/v1/meter-stats?deviceId=utility/water&from=yesterday":                                    fiber.StatusBadRequest,
+		"/api/v1/meter-stats?deviceId=utility/water&resolution=hour":                                   fiber.StatusOK,
+		"/api/v1/meter-stats?deviceId=utility/water&to=2026-03-01T00:00:00Z&from=2026-03-02T00:00:00Z": fiber.StatusBadRequest,
+	} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s: %d, want %d", target, resp.StatusCode, want)
+		}
+	}
+
+	start := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC).UnixMilli()
+	recordStates(t, vdevHistoryRepo, "utility/water", VdevTypeWaterMeter, start, "10", "10.5")
+	recordStates(t, vdevHistoryRepo, "utility/water", VdevTypeWaterMeter, start+2*3600*1000, "11", "0.25")
+
+	var got MeterStats
+	getJSON(t, app, "/api/v1/meter-stats?deviceId=utility/water&from=2026-03-02T00:00:00Z&to=2026-03-04T00:00:00Z", &got)
+	if got.Unit != "m³" || got.Resolution != energyBucketDay || len(got.Buckets) != 2 {
+		t.Fatalf("%+v", got)
+	}
+	if !approxEqual(got.Buckets[0].Consumption, 0.75) || got.Buckets[1].Consumption != 0 || got.Resets != 1 {
+		t.Errorf("buckets %+v, %d resets", got.Buckets, got.Resets)
+	}
+}
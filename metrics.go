@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Health metrics of at2 itself, updated from the code paths they count.
+var (
+	mqttConnectedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "at2_mqtt_connected",
+		Help: "Whether the MQTT client is connected to the broker (0/1)",
+	})
+	mqttMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "at2_mqtt_messages_received_total",
+		Help: "MQTT messages received, by the mapper subscribed to the topic",
+	}, []string{"mapper"})
+	historyWritesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "at2_history_writes_total",
+		Help: "Device states written to the history database",
+	})
+	historyWriteErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "at2_history_write_errors_total",
+		Help: "Device states that failed to be written to the history database",
+	})
+	liveClientsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "at2_ws_clients",
+		Help: "Connected live feed clients",
+	}, []string{"transport"})
+	updateCallbacksDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "at2_update_callbacks_dropped_total",
+		Help: "Device updates whose callbacks were skipped because the update queue was full",
+	})
+)
+
+// registerMetricsRoute mounts GET /metrics serving the device metrics together
+// with the Go runtime and process metrics, unless metrics.disabled is set.
+func registerMetricsRoute(app *fiber.App, cfg *Config, vm *VdevManager) {
+	if cfg.Metrics.Disabled {
+		slog.Info("Prometheus /metrics endpoint disabled")
+		return
+	}
+
+	// Both transports are exported from the start, even with no clients.
+	liveClientsGauge.WithLabelValues(liveTransportWs)
+	liveClientsGauge.WithLabelValues(liveTransportSse)
+
+	collector := NewPrometheusCollector(vm, cfg)
+	OnConfigReload(collector.loadConfig)
+	registry := prometheus.NewRegistry()
+	prefixed := prometheus.WrapRegistererWithPrefix(cfg.Prometheus.MetricPrefix, registry)
+	prefixed.MustRegister(
+		collector,
+		mqttConnectedGauge,
+		mqttMessagesReceived,
+		historyWritesTotal,
+		historyWriteErrorsTotal,
+		liveClientsGauge,
+		updateCallbacksDroppedTotal,
+		newBuildInfoMetric(currentBuildInfo()),
+	)
+	prefixed.MustRegister(newSnapshotCacheMetrics()...)
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	handler := adaptor.HTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	app.Get("/metrics", MetricsAuthMiddleware(cfg.Metrics), handler)
+}
+
+// MetricsAuthMiddleware accepts requests carrying the configured bearer token
+// or basic auth credentials. It lets everything through when neither is set.
+func MetricsAuthMiddleware(mc MetricsConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if mc.Token == "" && mc.BasicAuthUsername == "" {
+			return c.Next()
+		}
+		auth := c.Get(fiber.HeaderAuthorization)
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok && mc.Token != "" && secretEqual(token, mc.Token) {
+			return c.Next()
+		}
+		if encoded, ok := strings.CutPrefix(auth, "Basic "); ok && mc.BasicAuthUsername != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				user, pass, _ := strings.Cut(string(decoded), ":")
+				// Evaluate both, so timing doesn't reveal a valid username.
+				userOK := secretEqual(user, mc.BasicAuthUsername)
+				passOK := secretEqual(pass, mc.BasicAuthPassword)
+				if userOK && passOK {
+					return c.Next()
+				}
+			}
+		}
+		if mc.BasicAuthUsername != "" {
+			c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="metrics"`)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+}
+
+// secretEqual compares a presented credential with the configured one in
+// constant time.
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// validateMetricsConfig rejects basic auth without a password and warns when
+// the metrics are public.
+func validateMetricsConfig(cfg *Config, cfgPath string, r *ConfigReport) error {
+	mc := cfg.Metrics
+	if mc.Disabled {
+		return nil
+	}
+	if mc.BasicAuthUsername != "" && mc.BasicAuthPassword == "" {
+		return fmt.Errorf("metrics.basic_auth_username is set without a password in %s", cfgPath)
+	}
+	if mc.Token == "" && mc.BasicAuthUsername == "" {
+		r.warnf("/metrics is public and exposes room occupancy; set metrics.token or metrics.basic_auth_username in %s", cfgPath)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setupMetricsTest(t *testing.T, mc MetricsConfig) *fiber.App {
+	t.Helper()
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/people", Type: VdevTypePerson, State: 2.0}})
+	cfg := &Config{
+		Metrics: mc,
+		Rooms:   []RoomConfig{{ID: "lab", Entities: []EntityConfig{{ID: "lab/people"}}}},
+	}
+	app := fiber.New()
+	registerMetricsRoute(app, cfg, vm)
+	return app
+}
+
+func scrapeMetrics(t *testing.T, app *fiber.App, authorization string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if authorization != "" {
+		req.Header.Set(fiber.HeaderAuthorization, authorization)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMetrics_Scrape(t *testing.T) {
+	app := setupMetricsTest(t, MetricsConfig{})
+
+	status, body := scrapeMetrics(t, app, "")
+	if status != fiber.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	for _, series := range []string{"\nat2_", "\ngo_goroutines "} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("no %q series in:\n%s", strings.TrimSpace(series), body)
+		}
+	}
+}
+
+func TestMetrics_Auth(t *testing.T) {
+	app := setupMetricsTest(t, MetricsConfig{Token: "s3cret", BasicAuthUsername: "prom", BasicAuthPassword: "hunter2"})
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	for _, tc := range []struct {
+		authorization string
+		want          int
+	}{
+		{"", fiber.StatusUnauthorized},
+		{"Bearer wrong", fiber.StatusUnauthorized},
+		{"Bearer s3cret", fiber.StatusOK},
+		{basic("prom", "wrong"), fiber.StatusUnauthorized},
+		{basic("other", "hunter2"), fiber.StatusUnauthorized},
+		{basic("prom", "hunter2"), fiber.StatusOK},
+	} {
+		if status, _ := scrapeMetrics(t, app, tc.authorization); status != tc.want {
+			t.Errorf("Authorization %q: status = %d, want %d", tc.authorization, status, tc.want)
+		}
+	}
+}
+
+func TestMetrics_Disabled(t *testing.T) {
+	app := setupMetricsTest(t, MetricsConfig{Disabled: true})
+
+	if status, _ := scrapeMetrics(t, app, ""); status != fiber.StatusNotFound {
+		t.Fatalf("status = %d, want 404", status)
+	}
+}
+
+func TestMetrics_HealthCounters(t *testing.T) {
+	setupTestDB(t)
+	app := setupMetricsTest(t, MetricsConfig{})
+	vm := NewVdevManager()
+	repo := NewVirtualDeviceHistoryRepository(gormDB, vm, testLogger)
+	adapter := &MQTTAdapter{log: testLogger, vdevMgr: vm}
+
+	received := testutil.ToFloat64(mqttMessagesReceived.WithLabelValues("zigbee2mqtt"))
+	writes, writeErrors := testutil.ToFloat64(historyWritesTotal), testutil.ToFloat64(historyWriteErrorsTotal)
+
+	adapter.handleMapperMessage(NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger), "zigbee2mqtt/bridge/devices", []byte(z2mSCD41Devices))
+	adapter.handleMapperMessage(NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger), "zigbee2mqtt/lab/air", []byte(`{"co2": 812}`))
+	repo.OnDeviceUpdated(&VirtualDevice{ID: "lab/air/co2", Type: VdevTypeCO2, State: 812.0})
+	if err := gormDB.Migrator().DropTable(&VirtualDeviceStateModel{}); err != nil {
+		t.Fatal(err)
+	}
+	repo.OnDeviceUpdated(&VirtualDevice{ID: "lab/air/co2", Type: VdevTypeCO2, State: 900.0})
+
+	if got := testutil.ToFloat64(mqttMessagesReceived.WithLabelValues("zigbee2mqtt")) - received; got != 2 {
+		t.Errorf("messages received += %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(historyWritesTotal) - writes; got != 1 {
+		t.Errorf("history writes += %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(historyWriteErrorsTotal) - writeErrors; got != 1 {
+		t.Errorf("history write errors += %v, want 1", got)
+	}
+
+	_, body := scrapeMetrics(t, app, "")
+	for _, series := range []string{
+		`at2_mqtt_messages_received_total{mapper="zigbee2mqtt"}`,
+		"at2_mqtt_connected ",
+		"at2_history_writes_total ",
+		"at2_history_write_errors_total ",
+		`at2_ws_clients{transport="ws"}`,
+		"at2_update_callbacks_dropped_total ",
+		`at2_build_info{build_date="dev",git_commit="dev",version="dev"} 1`,
+	} {
+		if !strings.Contains(body, "\n"+series) {
+			t.Errorf("no %s series", series)
+		}
+	}
+}
+
+func TestMetrics_UpdateCallbacksDropped(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/temp", Type: VdevTypeTemperature, State: 0.0}})
+	release := make(chan struct{})
+	vm.OnVirtualDeviceUpdated = append(vm.OnVirtualDeviceUpdated, func(*VirtualDevice) { <-release })
+	dropped := testutil.ToFloat64(updateCallbacksDroppedTotal)
+
+	// A stuck callback holds at most one batch besides the full queue.
+	const updates = vdevUpdateQueueSize + 10
+	for i := 1; i <= updates; i++ {
+		vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/temp", State: float64(i)}})
+	}
+	close(release)
+	if got := testutil.ToFloat64(updateCallbacksDroppedTotal) - dropped; got < updates-vdevUpdateQueueSize-1 || got > updates-vdevUpdateQueueSize {
+		t.Fatalf("dropped += %v, want %d or %d", got, updates-vdevUpdateQueueSize-1, updates-vdevUpdateQueueSize)
+	}
+}
+
+func TestVdevManager_SlowCallbackDelaysOnlyItself(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/temp", Type: VdevTypeTemperature, State: 0.0}})
+	release := make(chan struct{})
+	defer close(release)
+	const updates = vdevUpdateQueueSize + 10
+	seen := make(chan *VirtualDevice, updates)
+	var recorded atomic.Int64
+	vm.OnVirtualDeviceUpdated = append(vm.OnVirtualDeviceUpdated,
+		func(*VirtualDevice) { <-release },
+		func(dev *VirtualDevice) { seen <- dev },
+	)
+	vm.OnVirtualDeviceRecorded = append(vm.OnVirtualDeviceRecorded, func(*VirtualDevice) { recorded.Add(1) })
+
+	for i := 1; i <= updates; i++ {
+		vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/temp", State: float64(i)}})
+	}
+	select {
+	case dev := <-seen:
+		if dev.State != 1.0 {
+			t.Fatalf("first update state = %v", dev.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stuck callback held up the others")
+	}
+	// The recorded callback gets every update although the stuck one drops.
+	deadline := time.Now().Add(5 * time.Second)
+	for recorded.Load() != updates {
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d of %d updates", recorded.Load(), updates)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics_Prefix(t *testing.T) {
+	app := fiber.New()
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5}})
+	registerMetricsRoute(app, &Config{Prometheus: PrometheusConfig{MetricPrefix: "hq_"}}, vm)
+
+	_, body := scrapeMetrics(t, app, "")
+	for _, series := range []string{`hq_at2_temperature_celsius{id="lab/temp",room=""} 21.5`, "hq_at2_mqtt_connected ", "go_goroutines "} {
+		if !strings.Contains(body, "\n"+series) {
+			t.Errorf("no %s series", series)
+		}
+	}
+	if strings.Contains(body, "\nat2_") {
+		t.Error("unprefixed at2_ series exported")
+	}
+}
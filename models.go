@@ -41,12 +41,17 @@ type SessionModel struct {
 	Username     string    `gorm:"not null"`             // Cached preferred_username
 	AccessToken  string    `gorm:"type:text"`
 	RefreshToken string    `gorm:"type:text"`
+	IDToken      string    `gorm:"type:text"` // Raw ID token, sent as id_token_hint on logout
 	CachedClaims string    `gorm:"type:text"` // JSON-encoded claims
 	ExpiresAt    time.Time `gorm:"not null;index"`
 	CreatedAt    time.Time `gorm:"autoCreateTime"`
+	LastSeenAt   time.Time // Updated at most once per sessionLastSeenInterval
 	// IsTablet marks a long-lived session granted to a trusted kiosk tablet.
 	// Such sessions have no OIDC tokens and are not refreshed.
 	IsTablet bool `gorm:"not null;default:false"`
+	// IsLocal marks a session of a web.local_users user. Like tablet
+	// sessions it has no OIDC tokens and lasts until ExpiresAt.
+	IsLocal bool `gorm:"not null;default:false"`
 }
 
 // TableName overrides the default table name.
@@ -148,9 +153,50 @@ func (BambuThumbnailModel) TableName() string {
 	return "bambu_thumbnails"
 }
 
+// SpaceStateChangeModel records a transition of the space between open and
+// closed, so SpaceAPI's state.lastchange survives restarts.
+type SpaceStateChangeModel struct {
+	ID        uint  `gorm:"primaryKey;autoIncrement"`
+	Open      bool  `gorm:"not null"`
+	ChangedAt int64 `gorm:"not null;index"` // Unix seconds
+}
+
+func (SpaceStateChangeModel) TableName() string {
+	return "space_state_changes"
+}
+
+// AlertSilenceModel keeps notifications of matching alert rules from being
+// sent until it expires.
+type AlertSilenceModel struct {
+	ID uint `gorm:"primaryKey;autoIncrement"`
+	// Rule is a glob (path.Match syntax) on alert rule names.
+	Rule      string `gorm:"not null"`
+	Until     int64  `gorm:"not null;index"` // Unix seconds
+	CreatedBy string
+	CreatedAt int64 `gorm:"not null"` // Unix seconds
+}
+
+func (AlertSilenceModel) TableName() string {
+	return "alert_silences"
+}
+
+// DeviceAliasModel is a display name, and optionally a room, given to a
+// device through the API.
+type DeviceAliasModel struct {
+	DeviceID  string `gorm:"primaryKey;type:text"`
+	Name      string `gorm:"not null"`
+	RoomID    string
+	UpdatedBy string
+	UpdatedAt int64 `gorm:"not null"` // Unix seconds
+}
+
+func (DeviceAliasModel) TableName() string {
+	return "device_aliases"
+}
+
 // AutoMigrateModels runs GORM auto-migration for all models.
 func AutoMigrateModels(db *gorm.DB) error {
-	return db.AutoMigrate(&VirtualDeviceModel{}, &VirtualDeviceStateModel{}, &SessionModel{}, &UsageStatsDayCache{}, &DhcpLeaseModel{}, &AppSettingModel{}, &PushSubscriptionModel{}, &BambuThumbnailModel{})
+	return db.AutoMigrate(&VirtualDeviceModel{}, &VirtualDeviceStateModel{}, &SessionModel{}, &UsageStatsDayCache{}, &DhcpLeaseModel{}, &AppSettingModel{}, &PushSubscriptionModel{}, &BambuThumbnailModel{}, &SpaceStateChangeModel{}, &AlertSilenceModel{}, &DeviceAliasModel{})
 }
 
 // CurrentTimestampMillis returns current time as Unix milliseconds.
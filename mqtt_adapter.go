@@ -3,7 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
@@ -27,8 +27,10 @@ type MQTTMapper interface {
 	DiscoverDevicesFromMessage(topic string, payload []byte) ([]*VirtualDevice, error)
 	// UpdateDevicesFromMessage attempts to extract state updates from an incoming message.
 	UpdateDevicesFromMessage(topic string, payload []byte) ([]*VirtualDeviceUpdate, error)
-	// Control attempts to control a specific virtual device.
-	Control(vdev *VirtualDevice, state any, client mqtt.Client) error
+	// Control attempts to control a specific virtual device. The command was
+	// validated by ControlDevice: "ON", "OFF" or "TOGGLE" for relays,
+	// CoverCommand or ThermostatCommand for covers and thermostats.
+	Control(vdev *VirtualDevice, command any, client mqtt.Client) error
 } // MQTTMapper
 
 // MapperConnectHook is an optional interface a mapper can implement to be notified
@@ -38,19 +40,34 @@ type MapperConnectHook interface {
 	OnConnect(client mqtt.Client)
 }
 
+// MapperNativeToggle is an optional interface for mappers whose protocol has
+// a toggle command. ControlDevice passes TOGGLE through to a mapper that
+// toggles the device natively; for other mappers it resolves TOGGLE to the
+// inverse of the device's current state, which races with other clients.
+type MapperNativeToggle interface {
+	TogglesNatively(vdev *VirtualDevice) bool
+}
+
 // MQTTAdapter adapts mqtt messages coming from multiple sources (e.g. Zigbee2MQTT, Frigate)
 // into a unified list of VirtualDevice objects managed by VdevManager.
 type MQTTAdapter struct {
 	client mqtt.Client
-	config *Config
+	// config is replaced on config reload; configMu guards it.
+	configMu sync.RWMutex
+	config   *Config
 
 	started atomicBool
 	// Virtual device manager extracted from previous in-struct logic.
 	vdevMgr *VdevManager
 	mappers []MQTTMapper
 
-	// deviceSettings maps device ID to its configuration (for prohibited control etc)
+	// deviceSettings maps device ID to its configuration (e.g. value negation)
 	deviceSettings map[string]EntityConfig
+
+	// unknownUnits holds the device and unit pairs warned about.
+	unknownUnits sync.Map
+
+	log *slog.Logger
 }
 
 // Publish sends a raw payload to the given topic on the shared MQTT connection.
@@ -82,14 +99,16 @@ func (b *atomicBool) Get() bool {
 	return b.val
 }
 
-// NewMQTTAdapter creates and connects the MQTT client; registers mapper subscriptions.
-func NewMQTTAdapter(cfg *Config, vdevMgr *VdevManager) (*MQTTAdapter, error) {
+// NewMQTTAdapter creates and connects the MQTT client; registers mapper
+// subscriptions. The mappers log to logger with a mapper attribute.
+func NewMQTTAdapter(cfg *Config, vdevMgr *VdevManager, logger *slog.Logger) (*MQTTAdapter, error) {
 
 	a := &MQTTAdapter{
 
 		config:         cfg,
 		vdevMgr:        vdevMgr,
 		deviceSettings: make(map[string]EntityConfig),
+		log:            logger,
 	}
 
 	// Index device configurations for fast lookup
@@ -110,13 +129,14 @@ func NewMQTTAdapter(cfg *Config, vdevMgr *VdevManager) (*MQTTAdapter, error) {
 	// - mqtt_mapper_zigbee2mqtt.go
 	// - mqtt_mapper_frigate.go
 	a.mappers = []MQTTMapper{
-		NewZigbee2MQTTMapper("zigbee2mqtt/"),
-		NewFrigateMapper("frigate/"),
-		NewESPHomeMapper(a.deviceSettings),
+		NewZigbee2MQTTMapper("zigbee2mqtt/", logger.With("mapper", "zigbee2mqtt")),
+		NewFrigateMapper("frigate/", logger.With("mapper", "frigate")),
+		NewESPHomeMapper(a.deviceSettings, logger.With("mapper", "esphome")),
 	}
 
 	opts.OnConnect = func(c mqtt.Client) {
-		log.Printf("[mqtt] connected to %s", cfg.MQTT.Broker)
+		a.log.Info("connected", "broker", cfg.MQTT.Broker)
+		mqttConnectedGauge.Set(1)
 		a.subscribeAllMapperTopics()
 		// Notify mappers that implement the connect hook (e.g. Frigate kick publish).
 		for _, mapper := range a.mappers {
@@ -127,11 +147,8 @@ func NewMQTTAdapter(cfg *Config, vdevMgr *VdevManager) (*MQTTAdapter, error) {
 	}
 
 	opts.OnConnectionLost = func(c mqtt.Client, err error) {
-		if err != nil {
-			log.Printf("[mqtt] connection lost: %v", err)
-		} else {
-			log.Printf("[mqtt] connection lost")
-		}
+		mqttConnectedGauge.Set(0)
+		a.log.Warn("connection lost", "err", err)
 	}
 
 	a.client = mqtt.NewClient(opts)
@@ -143,6 +160,7 @@ func NewMQTTAdapter(cfg *Config, vdevMgr *VdevManager) (*MQTTAdapter, error) {
 		return nil, fmt.Errorf("mqtt connect failed: %w", err)
 	}
 	a.started.Set(true)
+	OnConfigReload(a.loadConfig)
 	return a, nil
 }
 
@@ -176,21 +194,21 @@ func (a *MQTTAdapter) buildClientOptions(cfg *Config) (*mqtt.ClientOptions, erro
 // subscribeAllMapperTopics subscribes to all topics declared by each mapper implementation.
 func (a *MQTTAdapter) subscribeAllMapperTopics() {
 	if a.client == nil {
-		log.Printf("[mqtt] client is nil, cannot subscribe")
+		a.log.Error("client is nil, cannot subscribe")
 		return
 	}
 
 	for _, mapper := range a.mappers {
 		for _, topic := range mapper.SubscriptionTopics() {
 			topic := topic // capture loop variable
-			log.Printf("[mqtt] subscribing to %s", topic)
+			a.log.Info("subscribing", "topic", topic)
 			token := a.client.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
 				a.handleMapperMessage(mapper, msg.Topic(), msg.Payload())
 			})
 			if !token.WaitTimeout(5 * time.Second) {
-				log.Printf("[mqtt] subscription timeout for %s", topic)
+				a.log.Warn("subscription timed out", "topic", topic)
 			} else if err := token.Error(); err != nil {
-				log.Printf("[mqtt] failed to subscribe to %s: %v", topic, err)
+				a.log.Error("subscribing failed", "topic", topic, "err", err)
 			}
 		}
 	}
@@ -198,37 +216,85 @@ func (a *MQTTAdapter) subscribeAllMapperTopics() {
 
 // handleMapperMessage invokes discovery and update logic on a mapper and mutates virtual devices accordingly.
 func (a *MQTTAdapter) handleMapperMessage(mapper MQTTMapper, topic string, payload []byte) {
+	mqttMessagesReceived.WithLabelValues(mapperName(mapper)).Inc()
+	a.log.Debug("message", "mapper", mapperName(mapper), "topic", topic, "bytes", len(payload))
+
 	// Discovery
 	discovered, derr := mapper.DiscoverDevicesFromMessage(topic, payload)
 	if derr != nil {
-		log.Printf("[mqtt] discovery error on topic %s: %v", topic, derr)
+		a.log.Warn("discovery failed", "mapper", mapperName(mapper), "topic", topic, "err", derr)
 	}
 	if len(discovered) > 0 {
-		// Enrich discovered devices with config data
-		for _, d := range discovered {
-			if cfg, ok := a.deviceSettings[d.ID]; ok {
-				d.ProhibitControl = cfg.ProhibitControl
-			}
-		}
 		a.vdevMgr.AddDevices(discovered)
 	}
 
 	// Updates
 	updates, uerr := mapper.UpdateDevicesFromMessage(topic, payload)
 	if uerr != nil {
-		log.Printf("[mqtt] update error on topic %s: %v", topic, uerr)
+		a.log.Warn("update failed", "mapper", mapperName(mapper), "topic", topic, "err", uerr)
 	}
 	if len(updates) > 0 {
+		a.normalizeUnits(updates)
+		cfg := GetConfig()
+		calibrateUpdates(cfg, updates)
+		roundUpdates(cfg, updates, a.deviceType)
 		// VdevManager handles callback invocation.
 		a.vdevMgr.ApplyUpdates(updates)
 	}
 }
 
+// normalizeUnits converts numeric readings reported in another unit to the
+// canonical one of their quantity (see unitConversions), before they are
+// calibrated. Readings in unknown units are left as they are, with a
+// warning the first time a device reports one.
+func (a *MQTTAdapter) normalizeUnits(updates []*VirtualDeviceUpdate) {
+	for _, upd := range updates {
+		if upd == nil || upd.Unit == "" {
+			continue
+		}
+		v, ok := upd.State.(float64)
+		if !ok {
+			continue
+		}
+		normalized, _, ok := normalizeUnit(v, upd.Unit)
+		if !ok {
+			if _, warned := a.unknownUnits.LoadOrStore(upd.Name+"\x00"+upd.Unit, struct{}{}); !warned {
+				a.log.Warn("unknown unit, value left as reported", "device", upd.Name, "unit", upd.Unit)
+			}
+			continue
+		}
+		upd.State = normalized
+		upd.Unit = ""
+	}
+}
+
+// deviceType is the type of a known device, "" for others.
+func (a *MQTTAdapter) deviceType(id string) VdevType {
+	if dev := a.vdevMgr.Device(id); dev != nil {
+		return dev.Type
+	}
+	return ""
+}
+
+// mapperName labels a mapper in metrics.
+func mapperName(mapper MQTTMapper) string {
+	switch mapper.(type) {
+	case *Zigbee2MQTTMapper:
+		return "zigbee2mqtt"
+	case *FrigateMapper:
+		return "frigate"
+	case *ESPHomeMapper:
+		return "esphome"
+	}
+	return fmt.Sprintf("%T", mapper)
+}
+
 // Close disconnects MQTT client.
 func (a *MQTTAdapter) Close() {
 	if a.client != nil && a.client.IsConnectionOpen() {
 		a.client.Disconnect(250)
-		log.Printf("[mqtt] disconnected")
+		mqttConnectedGauge.Set(0)
+		a.log.Info("disconnected")
 	}
 }
 
@@ -237,45 +303,61 @@ func (a *MQTTAdapter) IsConnected() bool {
 	return a.client != nil && a.client.IsConnectionOpen()
 }
 
+// Errors ControlDevice returns before publishing anything, matched with
+// errors.Is to tell the caller's mistakes from broker failures.
+var (
+	ErrMQTTNotConnected  = errors.New("MQTT client not connected")
+	ErrDeviceNotFound    = errors.New("device not found")
+	ErrControlProhibited = errors.New("control prohibited")
+	ErrInvalidControl    = errors.New("invalid control command")
+)
+
+// controlError carries a descriptive message while matching one of the
+// sentinel errors above.
+type controlError struct {
+	kind error
+	msg  string
+}
+
+func (e *controlError) Error() string { return e.msg }
+func (e *controlError) Unwrap() error { return e.kind }
+
+func controlErrorf(kind error, format string, args ...any) error {
+	return &controlError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
 // ControlDevice attempts to find the device and the responsible mapper to send a control command.
-func (a *MQTTAdapter) ControlDevice(deviceID string, state any) error {
+// The command is checked against the device type, see parseControlCommand.
+func (a *MQTTAdapter) ControlDevice(deviceID string, command any) error {
 	if !a.IsConnected() {
-		return errors.New("MQTT client not connected")
+		return ErrMQTTNotConnected
 	}
 
 	// 1. Retrieve device to check type and mapper data.
 	a.vdevMgr.mu.RLock()
 	var targetDev *VirtualDevice
+	var currentState any
 	for _, dev := range a.vdevMgr.devices {
 		if dev.ID == deviceID {
-			targetDev = dev
+			targetDev, currentState = dev, dev.State
 			break
 		}
 	}
 	a.vdevMgr.mu.RUnlock()
 
 	if targetDev == nil {
-		return fmt.Errorf("device %s not found", deviceID)
+		return controlErrorf(ErrDeviceNotFound, "device %s not found", deviceID)
 	}
 
-	// 2. Validation: Relay only
-	if targetDev.Type != VdevTypeRelay {
-		return fmt.Errorf("device %s is not a relay (type: %s)", deviceID, targetDev.Type)
-	}
-
-	// 2.5 Validation: ProhibitControl
+	// 2. Validation: ProhibitControl
 	if targetDev.ProhibitControl {
-		return fmt.Errorf("control is prohibited for device %s", deviceID)
+		return controlErrorf(ErrControlProhibited, "control is prohibited for device %s", deviceID)
 	}
 
-	// 3. Validation: State must be ON or OFF
-	stateStr, ok := state.(string)
-	if !ok {
-		return errors.New("state must be a string")
-	}
-	upperState := strings.ToUpper(stateStr)
-	if upperState != "ON" && upperState != "OFF" {
-		return fmt.Errorf("invalid state %q; must be ON or OFF", stateStr)
+	// 3. Validation: the command must suit the device type
+	cmd, err := parseControlCommand(deviceID, targetDev.Type, command)
+	if err != nil {
+		return err
 	}
 
 	// 4. Iterate mappers to find who owns this device (or just try all, since they check internally).
@@ -285,12 +367,108 @@ func (a *MQTTAdapter) ControlDevice(deviceID string, state any) error {
 	// The `Zigbee2MQTTMapper` checks `vdev.MapperData.(*Zigbee2MQTTMapperData)`.
 	// So safe to iterate all.
 
+	// TOGGLE is passed on only when the mapper owning the device toggles
+	// natively; otherwise it becomes the inverse of the known state.
+	if cmd == "TOGGLE" && !a.togglesNatively(targetDev) {
+		inverted, known := invertRelayState(currentState)
+		if !known {
+			return controlErrorf(ErrInvalidControl, "cannot toggle %s: current state %v is unknown", deviceID, currentState)
+		}
+		cmd = inverted
+	}
+
 	for _, mapper := range a.mappers {
-		// We pass strict "ON" or "OFF" to ensure consistency.
-		if err := mapper.Control(targetDev, upperState, a.client); err != nil {
+		// We pass strict "ON", "OFF" or a native "TOGGLE" to ensure consistency.
+		if err := mapper.Control(targetDev, cmd, a.client); err != nil {
 			return err
 		}
 	}
 
+	// Show the commanded relay state until the device confirms or the
+	// window ends.
+	if relayCmd, ok := cmd.(string); ok {
+		if optimistic, ok := optimisticRelayState(currentState, relayCmd); ok {
+			a.vdevMgr.ApplyOptimistic(deviceID, optimistic, controlConfirmTimeout(a.currentConfig()))
+		}
+	}
+
 	return nil
 }
+
+// loadConfig takes the settings read per command (mqtt.control_confirm_timeout)
+// from a reloaded config; the connection and mappers keep the startup one.
+func (a *MQTTAdapter) loadConfig(cfg *Config) {
+	a.configMu.Lock()
+	defer a.configMu.Unlock()
+	a.config = cfg
+}
+
+func (a *MQTTAdapter) currentConfig() *Config {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.config
+}
+
+// defaultControlConfirmTimeout applies when mqtt.control_confirm_timeout is
+// unset. Zigbee relays usually report back within a second.
+const defaultControlConfirmTimeout = 5 * time.Second
+
+// controlConfirmTimeout returns mqtt.control_confirm_timeout, or the default
+// when unset.
+func controlConfirmTimeout(cfg *Config) time.Duration {
+	if cfg == nil || cfg.MQTT.ControlConfirmTimeout == "" {
+		return defaultControlConfirmTimeout
+	}
+	if d, err := time.ParseDuration(cfg.MQTT.ControlConfirmTimeout); err == nil {
+		return d
+	}
+	return defaultControlConfirmTimeout
+}
+
+// optimisticRelayState returns the state a relay is expected to report after
+// the command, in the same representation as its current state. It fails
+// for a TOGGLE of an unknown state.
+func optimisticRelayState(current any, command string) (any, bool) {
+	target := command
+	if command == "TOGGLE" {
+		inverted, ok := invertRelayState(current)
+		if !ok {
+			return nil, false
+		}
+		target = inverted
+	}
+	if _, isBool := current.(bool); isBool {
+		return target == "ON", true
+	}
+	return target, true
+}
+
+// togglesNatively reports whether a mapper can toggle the device itself.
+func (a *MQTTAdapter) togglesNatively(vdev *VirtualDevice) bool {
+	for _, mapper := range a.mappers {
+		if toggler, ok := mapper.(MapperNativeToggle); ok && toggler.TogglesNatively(vdev) {
+			return true
+		}
+	}
+	return false
+}
+
+// invertRelayState returns the command switching a relay away from its
+// current state, reported as "ON"/"OFF" or a bool.
+func invertRelayState(state any) (string, bool) {
+	switch s := state.(type) {
+	case bool:
+		if s {
+			return "OFF", true
+		}
+		return "ON", true
+	case string:
+		switch strings.ToUpper(s) {
+		case "ON":
+			return "OFF", true
+		case "OFF":
+			return "ON", true
+		}
+	}
+	return "", false
+}
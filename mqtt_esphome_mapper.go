@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,6 +14,8 @@ import (
 type ESPHomeMapperData struct {
 	StateTopic string `json:"state_topic"`
 	UniqueID   string `json:"unique_id"`
+	// Unit is the unit_of_meas announced by the sensor.
+	Unit string `json:"unit,omitempty"`
 }
 
 // ESPHomeConfig represents the JSON configuration received from Home Assistant discovery.
@@ -27,19 +29,38 @@ type ESPHomeConfig struct {
 	UniqueID          string `json:"uniq_id"`
 }
 
+// esphomeDeviceClasses maps the Home Assistant device classes of discovered
+// ESPHome sensors to virtual device types. Other sensors are ignored.
+var esphomeDeviceClasses = map[string]VdevType{
+	"power":          VdevTypePowerUsage,
+	"carbon_dioxide": VdevTypeCO2,
+	"battery":        VdevTypeBattery,
+	"sound_pressure": VdevTypeNoiseLevel,
+}
+
+// esphomeMeterClasses are the device classes of meters, discovered only as
+// total_increasing counters.
+var esphomeMeterClasses = map[string]VdevType{
+	"water": VdevTypeWaterMeter,
+	"gas":   VdevTypeGasMeter,
+}
+
 // ESPHomeMapper implements MQTTMapper for ESPHome devices using Home Assistant discovery topics.
 type ESPHomeMapper struct {
 	mu sync.RWMutex
 	// devicesByStateTopic maps state topics to virtual devices.
 	devicesByStateTopic map[string][]*VirtualDevice
 	deviceSettings      map[string]EntityConfig
+
+	log *slog.Logger
 }
 
 // NewESPHomeMapper creates a new ESPHome mapper.
-func NewESPHomeMapper(deviceSettings map[string]EntityConfig) *ESPHomeMapper {
+func NewESPHomeMapper(deviceSettings map[string]EntityConfig, logger *slog.Logger) *ESPHomeMapper {
 	return &ESPHomeMapper{
 		devicesByStateTopic: make(map[string][]*VirtualDevice),
 		deviceSettings:      deviceSettings,
+		log:                 logger,
 	}
 }
 
@@ -67,7 +88,11 @@ func (m *ESPHomeMapper) DiscoverDevicesFromMessage(topic string, payload []byte)
 		return nil, err
 	}
 
-	if config.DeviceClass != "power" {
+	vdevType, ok := esphomeDeviceClasses[config.DeviceClass]
+	if meter, isMeter := esphomeMeterClasses[config.DeviceClass]; isMeter && config.StateClass == "total_increasing" {
+		vdevType, ok = meter, true
+	}
+	if !ok {
 		return nil, nil
 	}
 
@@ -78,10 +103,11 @@ func (m *ESPHomeMapper) DiscoverDevicesFromMessage(topic string, payload []byte)
 	vdevID := "esphome/" + strings.TrimSuffix(config.StateTopic, "/state")
 	d := &VirtualDevice{
 		ID:   vdevID,
-		Type: VdevTypePowerUsage,
+		Type: vdevType,
 		MapperData: &ESPHomeMapperData{
 			StateTopic: config.StateTopic,
 			UniqueID:   config.UniqueID,
+			Unit:       config.UnitOfMeasurement,
 		},
 	}
 
@@ -116,7 +142,7 @@ func (m *ESPHomeMapper) UpdateDevicesFromMessage(topic string, payload []byte) (
 	valStr := string(payload)
 	val, err := strconv.ParseFloat(valStr, 64)
 	if err != nil {
-		log.Printf("[esphome] failed to parse state value %q as float: %v", valStr, err)
+		m.log.Warn("state is not a number", "topic", topic, "value", valStr, "err", err)
 		return nil, nil
 	}
 
@@ -126,16 +152,18 @@ func (m *ESPHomeMapper) UpdateDevicesFromMessage(topic string, payload []byte) (
 		if cfg, ok := m.deviceSettings[d.ID]; ok && cfg.NegateValue {
 			finalVal = -val
 		}
-		updates = append(updates, &VirtualDeviceUpdate{
-			Name:  d.ID,
-			State: finalVal,
-		})
+		upd := &VirtualDeviceUpdate{Name: d.ID, State: finalVal}
+		if data, ok := d.MapperData.(*ESPHomeMapperData); ok {
+			upd.Unit = data.Unit
+		}
+		updates = append(updates, upd)
 	}
 
 	return updates, nil
 }
 
-// Control is a no-op for power sensors.
-func (m *ESPHomeMapper) Control(vdev *VirtualDevice, state any, client mqtt.Client) error {
+// Control is a no-op for sensors. ESPHome has no native toggle here, so
+// ControlDevice resolves TOGGLE to ON or OFF before calling it.
+func (m *ESPHomeMapper) Control(vdev *VirtualDevice, command any, client mqtt.Client) error {
 	return nil
 }
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
@@ -42,13 +42,16 @@ type FrigateMapper struct {
 
 	// tickerOnce guards starting the periodic onConnect publisher exactly once.
 	tickerOnce sync.Once
+
+	log *slog.Logger
 }
 
 // NewFrigateMapper constructs a new FrigateMapper with the given prefix (e.g. "frigate/").
-func NewFrigateMapper(prefix string) *FrigateMapper {
+func NewFrigateMapper(prefix string, logger *slog.Logger) *FrigateMapper {
 
 	return &FrigateMapper{
 		prefix: prefix,
+		log:    logger,
 	}
 }
 
@@ -102,7 +105,7 @@ func (m *FrigateMapper) UpdateDevicesFromMessage(topic string, payload []byte) (
 
 	var activity map[string]cameraActivity
 	if err := json.Unmarshal(payload, &activity); err != nil {
-		log.Printf("[frigate] invalid camera_activity payload: %v", err)
+		m.log.Warn("invalid camera_activity payload", "topic", topic, "err", err)
 		return nil, nil
 	}
 
@@ -144,11 +147,11 @@ func (m *FrigateMapper) publishOnConnect(client mqtt.Client) {
 	token := client.Publish(m.prefix+"onConnect", 0, false, "1")
 	token.Wait()
 	if err := token.Error(); err != nil {
-		log.Printf("[frigate] failed to publish onConnect: %v", err)
+		m.log.Warn("publishing onConnect failed", "err", err)
 	}
 }
 
 // Control is a no-op for Frigate devices.
-func (m *FrigateMapper) Control(vdev *VirtualDevice, state any, client mqtt.Client) error {
+func (m *FrigateMapper) Control(vdev *VirtualDevice, command any, client mqtt.Client) error {
 	return nil
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// z2mSCD41Devices is a bridge/devices payload trimmed to a single SCD41-style
+// CO2 sensor that also reports temperature and humidity.
+const z2mSCD41Devices = `[
+  {
+    "friendly_name": "lab/air",
+    "ieee_address": "0x00124b0029aabbcc",
+    "definition": {
+      "exposes": [
+        {"type": "numeric", "property": "co2", "unit": "ppm"},
+        {"type": "numeric", "property": "temperature", "unit": "°C"},
+        {"type": "numeric", "property": "humidity", "unit": "%"}
+      ]
+    }
+  }
+]`
+
+func TestZigbee2MQTTMapper_DiscoversCO2(t *testing.T) {
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
+	devs, err := mapper.DiscoverDevicesFromMessage("zigbee2mqtt/bridge/devices", []byte(z2mSCD41Devices))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]VdevType{}
+	for _, d := range devs {
+		types[d.ID] = d.Type
+	}
+	if types["lab/air/co2"] != VdevTypeCO2 || types["lab/air/temperature"] != VdevTypeTemperature || len(types) != 3 {
+		t.Fatalf("discovered %v", types)
+	}
+
+	updates, err := mapper.UpdateDevicesFromMessage("zigbee2mqtt/lab/air", []byte(`{"co2": 812, "temperature": 22.4, "humidity": 41}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range updates {
+		if u.Name == "lab/air/co2" {
+			if u.State != 812.0 {
+				t.Fatalf("co2 state = %v", u.State)
+			}
+			return
+		}
+	}
+	t.Fatalf("no co2 update in %+v", updates)
+}
+
+func TestESPHomeMapper_DiscoversCO2(t *testing.T) {
+	mapper := NewESPHomeMapper(nil, testLogger)
+	config := `{"dev_cla":"carbon_dioxide","unit_of_meas":"ppm","stat_cla":"measurement","name":"SCD41 CO2",` +
+		`"stat_t":"hall-air/sensor/scd41_co2/state","uniq_id":"hall-airsensorscd41_co2"}`
+	devs, err := mapper.DiscoverDevicesFromMessage("homeassistant/sensor/hall-air/scd41_co2/config", []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 || devs[0].ID != "esphome/hall-air/sensor/scd41_co2" || devs[0].Type != VdevTypeCO2 {
+		t.Fatalf("discovered %+v", devs)
+	}
+
+	updates, err := mapper.UpdateDevicesFromMessage("hall-air/sensor/scd41_co2/state", []byte("1034"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].State != 1034.0 {
+		t.Fatalf("updates = %+v", updates)
+	}
+
+	// Sensors of other classes are still ignored.
+	devs, err = mapper.DiscoverDevicesFromMessage("homeassistant/sensor/hall-air/voltage/config",
+		[]byte(`{"dev_cla":"voltage","stat_t":"hall-air/sensor/voltage/state","uniq_id":"v"}`))
+	if err != nil || len(devs) != 0 {
+		t.Fatalf("voltage sensor discovered: %+v, %v", devs, err)
+	}
+}
+
+// z2mCoverAndTRVDevices is a bridge/devices payload with a roller blind and a
+// thermostatic radiator valve.
+const z2mCoverAndTRVDevices = `[
+  {
+    "friendly_name": "blinds",
+    "definition": {"exposes": [
+      {"type": "cover", "features": [
+        {"type": "enum", "property": "state", "values": ["OPEN", "CLOSE", "STOP"]},
+        {"type": "numeric", "property": "position", "value_min": 0, "value_max": 100}
+      ]}
+    ]}
+  },
+  {
+    "friendly_name": "trv",
+    "definition": {"exposes": [
+      {"type": "climate", "features": [
+        {"type": "numeric", "property": "local_temperature"},
+        {"type": "numeric", "property": "current_heating_setpoint", "value_min": 5, "value_max": 30}
+      ]}
+    ]}
+  }
+]`
+
+func TestZigbee2MQTTMapper_DiscoversCoverAndThermostat(t *testing.T) {
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
+	devs, err := mapper.DiscoverDevicesFromMessage("zigbee2mqtt/bridge/devices", []byte(z2mCoverAndTRVDevices))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{}
+	for _, d := range devs {
+		keys[d.ID+":"+string(d.Type)] = d.MapperData.(*Zigbee2MQTTMapperData).StateKey
+	}
+	if len(keys) != 2 || keys["blinds/cover:cover"] != "position" || keys["trv/thermostat:thermostat"] != "current_heating_setpoint" {
+		t.Fatalf("discovered %v", keys)
+	}
+
+	updates, err := mapper.UpdateDevicesFromMessage("zigbee2mqtt/trv", []byte(`{"current_heating_setpoint": 21, "local_temperature": 19.2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Name != "trv/thermostat" || updates[0].State != 21.0 {
+		t.Fatalf("updates = %+v", updates)
+	}
+}
+
+func TestESPHomeMapper_DiscoversMeters(t *testing.T) {
+	mapper := NewESPHomeMapper(nil, testLogger)
+	discover := func(object, class, stateClass string) []*VirtualDevice {
+		t.Helper()
+		config := fmt.Sprintf(`{"dev_cla":%q,"unit_of_meas":"L","stat_cla":%q,"name":%q,`+
+			`"stat_t":"utility/sensor/%s/state","uniq_id":"utility%s"}`, class, stateClass, object, object, object)
+		devs, err := mapper.DiscoverDevicesFromMessage("homeassistant/sensor/utility/"+object+"/config", []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return devs
+	}
+	if devs := discover("water_total", "water", "total_increasing"); len(devs) != 1 || devs[0].Type != VdevTypeWaterMeter {
+		t.Errorf("water meter discovered as %+v", devs)
+	}
+	if devs := discover("gas_total", "gas", "total_increasing"); len(devs) != 1 || devs[0].Type != VdevTypeGasMeter {
+		t.Errorf("gas meter discovered as %+v", devs)
+	}
+	// A flow rate isn't a counter.
+	if devs := discover("water_flow", "water", "measurement"); len(devs) != 0 {
+		t.Errorf("water measurement discovered as %+v", devs)
+	}
+
+	updates, err := mapper.UpdateDevicesFromMessage("utility/sensor/water_total/state", []byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Unit != "L" {
+		t.Fatalf("updates = %+v", updates)
+	}
+	if v, unit, ok := normalizeUnit(123456, updates[0].Unit); !ok || !approxEqual(v, 123.456) || unit != "m³" {
+		t.Errorf("litres normalized to %v %q, %t", v, unit, ok)
+	}
+}
+
+func TestESPHomeMapper_DiscoversNoiseLevel(t *testing.T) {
+	mapper := NewESPHomeMapper(nil, testLogger)
+	config := `{"dev_cla":"sound_pressure","unit_of_meas":"dBA","stat_cla":"measurement","name":"Sound level",` +
+		`"stat_t":"workshop-noise/sensor/sound_level/state","uniq_id":"workshop-noisesound_level"}`
+	devs, err := mapper.DiscoverDevicesFromMessage("homeassistant/sensor/workshop-noise/sound_level/config", []byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 || devs[0].ID != "esphome/workshop-noise/sensor/sound_level" || devs[0].Type != VdevTypeNoiseLevel {
+		t.Fatalf("discovered %+v", devs)
+	}
+
+	updates, err := mapper.UpdateDevicesFromMessage("workshop-noise/sensor/sound_level/state", []byte("72.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].State != 72.4 || updates[0].Unit != "dBA" {
+		t.Fatalf("updates = %+v", updates)
+	}
+	if v, unit, ok := normalizeUnit(72.4, updates[0].Unit); !ok || v != 72.4 || unit != vdevUnits[VdevTypeNoiseLevel] {
+		t.Errorf("dBA normalized to %v %q, %t", v, unit, ok)
+	}
+}
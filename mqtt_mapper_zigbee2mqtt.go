@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 
@@ -14,6 +14,8 @@ type Zigbee2MQTTMapperData struct {
 	StateKey    string `json:"state_key"`
 	BaseTopic   string `json:"base_topic"`
 	Endpoint    string `json:"endpoint"`
+	// Unit is the unit of the exposed property, for numeric ones.
+	Unit string `json:"unit,omitempty"`
 }
 
 // Zigbee2MQTTMapper implements MQTTMapper for zigbee2mqtt messages.
@@ -23,14 +25,17 @@ type Zigbee2MQTTMapper struct {
 	mu sync.RWMutex
 	// devicesByBase stores discovered virtual devices keyed by their friendly base name.
 	devicesByBase map[string][]*VirtualDevice
+
+	log *slog.Logger
 }
 
 // NewZigbee2MQTTMapper creates a new mapper with the given topic prefix (e.g. "zigbee2mqtt/").
-func NewZigbee2MQTTMapper(prefix string) *Zigbee2MQTTMapper {
+func NewZigbee2MQTTMapper(prefix string, logger *slog.Logger) *Zigbee2MQTTMapper {
 
 	return &Zigbee2MQTTMapper{
 		prefix:        prefix,
 		devicesByBase: make(map[string][]*VirtualDevice),
+		log:           logger,
 	}
 }
 
@@ -53,8 +58,10 @@ var z2mSensorConfigs = map[string]z2mExposureConfig{
 	"numeric:temperature": {VdevTypeTemperature, "/temperature", "temperature"},
 	"numeric:humidity":    {VdevTypeHumidity, "/humidity", "humidity"},
 	"numeric:co":          {VdevTypeCo, "/co", "co"},
+	"numeric:co2":         {VdevTypeCO2, "/co2", "co2"},
 	"numeric:gas_value":   {VdevTypeGas, "/gas", "gas_value"},
 	"binary:contact":      {VdevTypeContact, "/contact", "contact"},
+	"numeric:battery":     {VdevTypeBattery, "/battery", "battery"},
 }
 
 // DiscoverDevicesFromMessage parses the bridge/devices payload and builds virtual devices.
@@ -73,7 +80,7 @@ func (m *Zigbee2MQTTMapper) DiscoverDevicesFromMessage(topic string, payload []b
 	for _, raw := range rawDevices {
 		var devMap map[string]any
 		if err := json.Unmarshal(raw, &devMap); err != nil {
-			log.Printf("[zigbee2mqtt] device entry unmarshal error: %v", err)
+			m.log.Warn("invalid device entry", "topic", topic, "err", err)
 			continue
 		}
 
@@ -133,12 +140,22 @@ func (m *Zigbee2MQTTMapper) DiscoverDevicesFromMessage(topic string, payload []b
 				continue
 			}
 
+			// Covers and thermostats are controlled through one writable
+			// property: the position and the heating setpoint.
+			if expType == "cover" || expType == "climate" {
+				if d := z2mControllableDevice(friendlyName, ieee, expType, expMap); d != nil {
+					discovered = append(discovered, d)
+				}
+				continue
+			}
+
 			// Handle general sensors from the map
 			property, _ := expMap["property"].(string)
 			mapKey := expType + ":" + property
 
 			if config, ok := z2mSensorConfigs[mapKey]; ok {
 				endpoint := extractEndpointZigbee(expMap)
+				unit, _ := expMap["unit"].(string)
 				discovered = append(discovered, &VirtualDevice{
 					ID:   friendlyName + config.IDsomefix,
 					Type: config.VdevType,
@@ -147,6 +164,7 @@ func (m *Zigbee2MQTTMapper) DiscoverDevicesFromMessage(topic string, payload []b
 						Endpoint:    endpoint,
 						IEEEAddress: ieee,
 						StateKey:    config.StateKey,
+						Unit:        unit,
 					},
 				})
 			}
@@ -210,6 +228,7 @@ func (m *Zigbee2MQTTMapper) UpdateDevicesFromMessage(topic string, payload []byt
 			updates = append(updates, &VirtualDeviceUpdate{
 				Name:  d.ID,
 				State: parsed[val.StateKey],
+				Unit:  val.Unit,
 			})
 		} else {
 			// Some devices (e.g. relay) might represent state as uppercase "state"
@@ -220,6 +239,39 @@ func (m *Zigbee2MQTTMapper) UpdateDevicesFromMessage(topic string, payload []byt
 	return updates, nil
 }
 
+// z2mControllableDevice builds the device for a cover or climate exposure,
+// or returns nil when it lacks the property at2 controls.
+func z2mControllableDevice(friendlyName, ieee, expType string, expMap map[string]any) *VirtualDevice {
+	vdevType, suffix, wanted := VdevTypeCover, "/cover", []string{"position"}
+	if expType == "climate" {
+		vdevType, suffix, wanted = VdevTypeThermostat, "/thermostat", []string{"occupied_heating_setpoint", "current_heating_setpoint"}
+	}
+	features, _ := expMap["features"].([]any)
+	for _, want := range wanted {
+		for _, feature := range features {
+			fm, _ := feature.(map[string]any)
+			if prop, _ := fm["property"].(string); prop != want {
+				continue
+			}
+			endpoint := extractEndpointZigbee(expMap)
+			if endpoint != "" {
+				suffix += "/" + endpoint
+			}
+			return &VirtualDevice{
+				ID:   friendlyName + suffix,
+				Type: vdevType,
+				MapperData: &Zigbee2MQTTMapperData{
+					BaseTopic:   friendlyName,
+					Endpoint:    endpoint,
+					IEEEAddress: ieee,
+					StateKey:    want,
+				},
+			}
+		}
+	}
+	return nil
+}
+
 // extractEndpointZigbee attempts to read the endpoint field from an exposure map.
 func extractEndpointZigbee(ex map[string]any) string {
 	if ep, ok := ex["endpoint"].(string); ok {
@@ -228,8 +280,15 @@ func extractEndpointZigbee(ex map[string]any) string {
 	return ""
 }
 
+// TogglesNatively reports whether the device is controlled by this mapper;
+// zigbee2mqtt accepts {"state":"TOGGLE"} for every switch.
+func (m *Zigbee2MQTTMapper) TogglesNatively(vdev *VirtualDevice) bool {
+	_, ok := vdev.MapperData.(*Zigbee2MQTTMapperData)
+	return ok
+}
+
 // Control publishes a set message to the zigbee2mqtt device.
-func (m *Zigbee2MQTTMapper) Control(vdev *VirtualDevice, state any, client mqtt.Client) error {
+func (m *Zigbee2MQTTMapper) Control(vdev *VirtualDevice, command any, client mqtt.Client) error {
 	mapperData, ok := vdev.MapperData.(*Zigbee2MQTTMapperData)
 	if !ok {
 		return nil // Not managed by this mapper
@@ -244,18 +303,31 @@ func (m *Zigbee2MQTTMapper) Control(vdev *VirtualDevice, state any, client mqtt.
 	// If Endpoint is present, some z2m setups might need it, but usually sending to friendly_name/set with {"state_bottom": "ON"} etc is enough.
 	payloadMap := map[string]any{}
 
-	key := mapperData.StateKey
-	if key == "" {
-		key = "state"
+	key, value := mapperData.StateKey, command
+	switch cmd := command.(type) {
+	case CoverCommand:
+		value = cmd.Position
+		if key == "" {
+			key = "position"
+		}
+	case ThermostatCommand:
+		value = cmd.Setpoint
+		if key == "" {
+			key = "current_heating_setpoint"
+		}
+	default:
+		if key == "" {
+			key = "state"
+		}
 	}
-	payloadMap[key] = state
+	payloadMap[key] = value
 
 	payloadBytes, err := json.Marshal(payloadMap)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[zigbee2mqtt] controlling %s via topic %s: %s", vdev.ID, topic, string(payloadBytes))
+	m.log.Info("controlling device", "device", vdev.ID, "topic", topic, "payload", string(payloadBytes))
 	token := client.Publish(topic, 0, false, payloadBytes)
 	if token.Wait() && token.Error() != nil {
 		return token.Error()
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultWebhookTimeout bounds one delivery attempt when the webhook
+	// has no timeout.
+	defaultWebhookTimeout = 10 * time.Second
+	// defaultWebhookMaxAttempts is a webhook's max_attempts when it isn't set.
+	defaultWebhookMaxAttempts = 5
+	// webhookQueueSize is how many notifications may wait per webhook while
+	// an earlier one is being retried.
+	webhookQueueSize = 64
+	// maxWebhookBackoff caps the wait between delivery attempts.
+	maxWebhookBackoff = time.Minute
+)
+
+// NotificationsConfig configures where alerts are sent as they fire and
+// resolve. Changes take effect on restart.
+type NotificationsConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// MQTT is optional; when nil alerts aren't published to MQTT.
+	MQTT *MQTTAlertsConfig `yaml:"mqtt"`
+	// Matrix is optional; when nil alerts aren't sent to Matrix.
+	Matrix *MatrixConfig `yaml:"matrix"`
+	// Telegram is optional; when nil alerts aren't sent to Telegram.
+	Telegram *TelegramConfig `yaml:"telegram"`
+	// Digest is optional; when nil no digest is sent.
+	Digest *DigestConfig `yaml:"digest"`
+}
+
+// WebhookConfig is an HTTP endpoint alerts are POSTed to, e.g. an ntfy topic
+// or a Slack incoming webhook.
+type WebhookConfig struct {
+	// Name identifies the webhook in logs; it must be unique.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// URLFile reads the URL from a file, for URLs carrying a token.
+	URLFile string            `yaml:"url_file"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is a text/template rendered with the Alert; {{json .Message}}
+	// quotes a field for JSON payloads. By default the Alert is sent as
+	// JSON. A custom body is sent as text/plain unless the headers set a
+	// Content-Type.
+	Body string `yaml:"body"`
+	// Severities limits the webhook to alerts of these severities.
+	Severities []string `yaml:"severities"`
+	// Rules limits the webhook to alerts of rules whose names match one of
+	// these globs (path.Match syntax).
+	Rules []string `yaml:"rules"`
+	// Timeout is a Go duration bounding each attempt. Default "10s".
+	Timeout string `yaml:"timeout"`
+	// MaxAttempts is how often delivery is tried before the notification is
+	// logged as dead. Default 5; failures in between back off exponentially.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// webhookTemplateFuncs are available in webhook body templates.
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// validateNotificationsConfig fails fast on webhooks that can't be used.
+func validateNotificationsConfig(cfg *Config, cfgPath string) error {
+	seen := map[string]struct{}{}
+	for i, w := range cfg.Notifications.Webhooks {
+		if w.Name == "" {
+			return fmt.Errorf("notifications.webhooks[%d] needs a name in %s", i, cfgPath)
+		}
+		if _, dup := seen[w.Name]; dup {
+			return fmt.Errorf("duplicate webhook name %q in %s", w.Name, cfgPath)
+		}
+		seen[w.Name] = struct{}{}
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// The URL may carry a token; don't log it.
+			return fmt.Errorf("webhook %q needs an http(s) url or url_file in %s", w.Name, cfgPath)
+		}
+		if _, err := template.New(w.Name).Funcs(webhookTemplateFuncs).Parse(w.Body); err != nil {
+			return fmt.Errorf("webhook %q has invalid body template in %s: %v", w.Name, cfgPath, err)
+		}
+		if err := validateAlertRouting(fmt.Sprintf("webhook %q", w.Name), w.Severities, w.Rules, cfgPath); err != nil {
+			return err
+		}
+		if v := w.Timeout; v != "" {
+			if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+				return fmt.Errorf("webhook %q timeout is not a valid duration (%q) in %s", w.Name, v, cfgPath)
+			}
+		}
+		if w.MaxAttempts < 0 {
+			return fmt.Errorf("webhook %q has negative max_attempts in %s", w.Name, cfgPath)
+		}
+	}
+	return nil
+}
+
+// validateAlertRouting checks the severities and rule globs limiting a
+// notification target to some alerts.
+func validateAlertRouting(target string, severities, rules []string, cfgPath string) error {
+	for _, s := range severities {
+		if !slices.Contains(alertSeverities, s) {
+			return fmt.Errorf("%s has unknown severity %q in %s", target, s, cfgPath)
+		}
+	}
+	for _, pattern := range rules {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s has invalid rule pattern %q in %s: %v", target, pattern, cfgPath, err)
+		}
+	}
+	return nil
+}
+
+// alertRouted reports whether an alert has one of the severities and a rule
+// matching one of the globs; empty lists take any.
+func alertRouted(severities, rules []string, a Alert) bool {
+	if len(severities) > 0 && !slices.Contains(severities, a.Severity) {
+		return false
+	}
+	if len(rules) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(rules, func(pattern string) bool {
+		ok, _ := path.Match(pattern, a.Rule)
+		return ok
+	})
+}
+
+// NotificationDispatcher is an AlertSink sending alerts to the configured
+// webhooks, Matrix room and Telegram chat. Each target delivers in order on its own
+// goroutine, retrying failed deliveries, so a slow or broken one holds up
+// neither the alert engine nor the other targets.
+type NotificationDispatcher struct {
+	log      *slog.Logger
+	webhooks []*webhookTarget
+	matrix   *matrixTarget
+	telegram *telegramTarget
+	// backoff is the wait after the given failed attempt (1-based).
+	backoff func(attempt int) time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// deadLetters counts notifications given up on.
+	deadLetters atomic.Uint64
+}
+
+type webhookTarget struct {
+	WebhookConfig
+	body        *template.Template
+	client      *http.Client
+	maxAttempts int
+	queue       chan webhookNotification
+}
+
+// webhookNotification is a rendered notification waiting for delivery.
+type webhookNotification struct {
+	alert Alert
+	body  []byte
+}
+
+// NewNotificationDispatcher creates the dispatcher for the webhooks of cfg.
+// Deliveries start with Start.
+func NewNotificationDispatcher(cfg *Config, logger *slog.Logger) *NotificationDispatcher {
+	d := &NotificationDispatcher{log: logger, backoff: webhookBackoff}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, w := range cfg.Notifications.Webhooks {
+		timeout := defaultWebhookTimeout
+		if v, err := time.ParseDuration(w.Timeout); err == nil && v > 0 {
+			timeout = v
+		}
+		attempts := w.MaxAttempts
+		if attempts <= 0 {
+			attempts = defaultWebhookMaxAttempts
+		}
+		t := &webhookTarget{
+			WebhookConfig: w,
+			client:        &http.Client{Timeout: timeout},
+			maxAttempts:   attempts,
+			queue:         make(chan webhookNotification, webhookQueueSize),
+		}
+		if w.Body != "" {
+			// validateNotificationsConfig rejected templates that don't parse.
+			t.body = template.Must(template.New(w.Name).Funcs(webhookTemplateFuncs).Parse(w.Body))
+		}
+		d.webhooks = append(d.webhooks, t)
+	}
+	if m := cfg.Notifications.Matrix; m != nil {
+		d.matrix = newMatrixTarget(*m)
+	}
+	if tg := cfg.Notifications.Telegram; tg != nil {
+		d.telegram = newTelegramTarget(*tg)
+	}
+	return d
+}
+
+// webhookBackoff doubles the wait after each failed attempt, from a second
+// up to maxWebhookBackoff.
+func webhookBackoff(attempt int) time.Duration {
+	return min(time.Second<<min(attempt-1, 16), maxWebhookBackoff)
+}
+
+// Start starts delivering to the targets.
+func (d *NotificationDispatcher) Start() {
+	if t := d.matrix; t != nil {
+		d.workers.Go(func() {
+			for {
+				select {
+				case <-d.ctx.Done():
+					return
+				case a := <-t.queue:
+					d.deliverMatrix(t, a)
+				}
+			}
+		})
+	}
+	if t := d.telegram; t != nil {
+		d.workers.Go(func() {
+			for {
+				select {
+				case <-d.ctx.Done():
+					return
+				case a := <-t.queue:
+					d.deliverTelegram(t, a)
+				}
+			}
+		})
+	}
+	for _, t := range d.webhooks {
+		d.workers.Go(func() {
+			for {
+				select {
+				case <-d.ctx.Done():
+					return
+				case n := <-t.queue:
+					d.deliver(t, n)
+				}
+			}
+		})
+	}
+}
+
+// Stop abandons the deliveries in progress and waits for the target
+// goroutines to end.
+func (d *NotificationDispatcher) Stop() {
+	d.cancel()
+	d.workers.Wait()
+}
+
+func (d *NotificationDispatcher) AlertFired(a Alert)    { d.notify(a) }
+func (d *NotificationDispatcher) AlertResolved(a Alert) { d.notify(a) }
+
+// notify renders the alert for each target it routes to and queues it. A
+// template failing for one alert only drops that notification.
+func (d *NotificationDispatcher) notify(a Alert) {
+	if t := d.matrix; t != nil && a.routedTo(escalationTargetMatrix, t.Severities, t.Rules) {
+		select {
+		case t.queue <- a:
+		default:
+			d.deadLetter("matrix", a, nil, 0, fmt.Errorf("queue full"))
+		}
+	}
+	if t := d.telegram; t != nil && a.routedTo(escalationTargetTelegram, t.Severities, t.Rules) {
+		select {
+		case t.queue <- a:
+		default:
+			d.deadLetter("telegram", a, nil, 0, fmt.Errorf("queue full"))
+		}
+	}
+	for _, t := range d.webhooks {
+		if !a.routedTo(t.Name, t.Severities, t.Rules) {
+			continue
+		}
+		body, err := t.render(a)
+		if err != nil {
+			d.log.Error("rendering webhook body failed", "webhook", t.Name, "rule", a.Rule, "device", a.DeviceID, "err", err)
+			continue
+		}
+		select {
+		case t.queue <- webhookNotification{alert: a, body: body}:
+		default:
+			d.deadLetter("webhook "+t.Name, a, body, 0, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+func (t *webhookTarget) render(a Alert) ([]byte, error) {
+	if t.body == nil {
+		return json.Marshal(a)
+	}
+	var b bytes.Buffer
+	if err := t.body.Execute(&b, a); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// deliver tries the notification up to the webhook's max_attempts, backing
+// off between attempts. Client errors other than 408 and 429 aren't retried.
+func (d *NotificationDispatcher) deliver(t *webhookTarget, n webhookNotification) {
+	d.retry("webhook "+t.Name, n.alert, n.body, t.maxAttempts, func() (time.Duration, bool, error) {
+		retry, err := t.post(d.ctx, n.body)
+		return 0, retry, err
+	})
+}
+
+// retry calls send until it succeeds, reports a failure not worth retrying,
+// or maxAttempts have failed; the notification is then dead-lettered. It
+// waits between attempts for as long as send asked (retryAfter), or backs
+// off. It reports whether the notification was delivered.
+func (d *NotificationDispatcher) retry(target string, a Alert, body []byte, maxAttempts int, send func() (retryAfter time.Duration, retry bool, err error)) bool {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var retryAfter time.Duration
+		var retry bool
+		if retryAfter, retry, err = send(); err == nil {
+			if attempt > 1 {
+				d.log.Info("notification delivered after retrying", "target", target, "rule", a.Rule, "device", a.DeviceID, "attempts", attempt)
+			}
+			return true
+		}
+		if d.ctx.Err() != nil {
+			d.log.Warn("notification abandoned on shutdown", "target", target, "rule", a.Rule, "device", a.DeviceID)
+			return false
+		}
+		if !retry || attempt >= maxAttempts {
+			break
+		}
+		wait := retryAfter
+		if wait <= 0 {
+			wait = d.backoff(attempt)
+		}
+		d.log.Warn("notification delivery failed, retrying", "target", target, "rule", a.Rule, "device", a.DeviceID, "attempt", attempt, "retry_in", wait, "err", err)
+		if !sleepCtx(d.ctx, wait) {
+			return false
+		}
+	}
+	d.deadLetter(target, a, body, attempt, err)
+	return false
+}
+
+// deadLetter logs a notification that won't be delivered, with its body so
+// it can be resent by hand.
+func (d *NotificationDispatcher) deadLetter(target string, a Alert, body []byte, attempts int, err error) {
+	d.deadLetters.Add(1)
+	d.log.Error("notification dead-lettered", "target", target, "rule", a.Rule, "device", a.DeviceID,
+		"state", a.State, "attempts", attempts, "err", err, "body", string(body))
+}
+
+// post sends one attempt and reports whether a failure is worth retrying.
+func (t *webhookTarget) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if t.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		// Don't log the URL, which may carry a token.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return false, err
+	}
+	return true, err
+}
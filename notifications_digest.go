@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// digestRule and alertDigest are the rule and state of the digest
+	// notification, which sinks route and format like an alert.
+	digestRule  = "digest"
+	alertDigest = "digest"
+
+	// defaultDigestSchedule is notifications.digest.schedule when it isn't set.
+	defaultDigestSchedule = "0 8 * * *"
+	// defaultDigestBatteryThreshold is notifications.digest.battery_threshold
+	// when it isn't set.
+	defaultDigestBatteryThreshold = 20
+	// digestCheckInterval is how often the schedule is looked at; below a
+	// minute so no scheduled minute is missed.
+	digestCheckInterval = 20 * time.Second
+	// digestLastSentKey is the app_settings key of the last scheduled minute
+	// a digest was due, in Unix seconds.
+	digestLastSentKey = "alert_digest_last_sent"
+)
+
+// defaultDigestStaleAfter is notifications.digest.stale_after when it isn't
+// set: sensors that report on their own every few minutes.
+var defaultDigestStaleAfter = map[string]string{
+	string(VdevTypeTemperature): "24h",
+	string(VdevTypeHumidity):    "24h",
+	string(VdevTypeCo):          "24h",
+	string(VdevTypeCO2):         "24h",
+	string(VdevTypeGas):         "24h",
+	string(VdevTypeBattery):     "24h",
+	string(VdevTypeNoiseLevel):  "24h",
+}
+
+// DigestConfig sends one summary of low batteries and stale devices on a
+// schedule, instead of an alert for each, through the webhooks, Matrix and
+// Telegram as an info notification of rule "digest".
+type DigestConfig struct {
+	// Schedule is a cron expression (minute hour day-of-month month
+	// day-of-week) in Timezone. Default "0 8 * * *", every morning at 8.
+	Schedule string `yaml:"schedule"`
+	// Timezone is an IANA zone name, e.g. "Europe/Warsaw". Default the
+	// server's local time.
+	Timezone string `yaml:"timezone"`
+	// BatteryThreshold lists battery devices at or below this percentage.
+	// Default 20.
+	BatteryThreshold float64 `yaml:"battery_threshold"`
+	// StaleAfter maps device types to Go durations: devices of the type that
+	// haven't reported for that long are listed as stale. Types not listed
+	// aren't checked. Default 24h for temperature, humidity, co, co2, gas and
+	// battery devices.
+	StaleAfter map[string]string `yaml:"stale_after"`
+}
+
+// validateDigestConfig fails fast on a digest that can't be scheduled or sent.
+func validateDigestConfig(cfg *Config, cfgPath string) error {
+	dg := cfg.Notifications.Digest
+	if dg == nil {
+		return nil
+	}
+	n := cfg.Notifications
+	if len(n.Webhooks) == 0 && n.Matrix == nil && n.Telegram == nil {
+		return fmt.Errorf("notifications.digest needs a webhook, matrix or telegram to send to in %s", cfgPath)
+	}
+	if _, err := parseCronSchedule(cmp.Or(dg.Schedule, defaultDigestSchedule)); err != nil {
+		return fmt.Errorf("notifications.digest.schedule: %v in %s", err, cfgPath)
+	}
+	if _, err := time.LoadLocation(dg.Timezone); err != nil {
+		return fmt.Errorf("notifications.digest.timezone is unknown (%q) in %s", dg.Timezone, cfgPath)
+	}
+	if dg.BatteryThreshold < 0 || dg.BatteryThreshold > 100 {
+		return fmt.Errorf("notifications.digest.battery_threshold must be between 0 and 100 in %s", cfgPath)
+	}
+	for typ, v := range dg.StaleAfter {
+		if !slices.Contains(vdevTypes, VdevType(typ)) {
+			return fmt.Errorf("notifications.digest.stale_after has unknown type %q in %s", typ, cfgPath)
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("notifications.digest.stale_after.%s is not a valid duration (%q) in %s", typ, v, cfgPath)
+		}
+	}
+	return nil
+}
+
+// AlertDigest sends the digest when its schedule is due. The last due minute
+// is persisted, so a restart within it doesn't send the digest twice.
+type AlertDigest struct {
+	vdev *VdevManager
+	db   *gorm.DB
+	sink AlertSink
+	log  *slog.Logger
+
+	schedule         cronSchedule
+	loc              *time.Location
+	batteryThreshold float64
+	staleAfter       map[VdevType]time.Duration
+
+	lastSent time.Time
+}
+
+// NewAlertDigest creates the digest for notifications.digest, sending to
+// sink, and restores when it was last due from the database.
+func NewAlertDigest(cfg *Config, vdev *VdevManager, db *gorm.DB, sink AlertSink, logger *slog.Logger) (*AlertDigest, error) {
+	dg := cfg.Notifications.Digest
+	// validateDigestConfig rejected schedules and zones that don't parse.
+	schedule, err := parseCronSchedule(cmp.Or(dg.Schedule, defaultDigestSchedule))
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(dg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	d := &AlertDigest{
+		vdev:             vdev,
+		db:               db,
+		sink:             sink,
+		log:              logger,
+		schedule:         schedule,
+		loc:              loc,
+		batteryThreshold: cmp.Or(dg.BatteryThreshold, defaultDigestBatteryThreshold),
+		staleAfter:       map[VdevType]time.Duration{},
+	}
+	staleAfter := dg.StaleAfter
+	if staleAfter == nil {
+		staleAfter = defaultDigestStaleAfter
+	}
+	for typ, v := range staleAfter {
+		if ttl, err := time.ParseDuration(v); err == nil {
+			d.staleAfter[VdevType(typ)] = ttl
+		}
+	}
+
+	var setting AppSettingModel
+	err = db.Where("key = ?", digestLastSentKey).First(&setting).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to load last digest time: %w", err)
+	default:
+		if unix, err := strconv.ParseInt(setting.Value, 10, 64); err == nil {
+			d.lastSent = time.Unix(unix, 0)
+		}
+	}
+	return d, nil
+}
+
+// Start checks the schedule periodically.
+func (d *AlertDigest) Start() {
+	go func() {
+		ticker := time.NewTicker(digestCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			d.run(time.Now())
+		}
+	}()
+}
+
+// run sends the digest when the schedule is due in now's minute and it
+// wasn't sent for that minute yet. Nothing is sent when all is well.
+func (d *AlertDigest) run(now time.Time) {
+	minute := now.In(d.loc).Truncate(time.Minute)
+	if !d.schedule.matches(minute) || !minute.After(d.lastSent) {
+		return
+	}
+	d.lastSent = minute
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value"}),
+	}).Create(&AppSettingModel{Key: digestLastSentKey, Value: strconv.FormatInt(minute.Unix(), 10)}).Error; err != nil {
+		d.log.Error("storing last digest time failed", "err", err)
+	}
+
+	summary, ok := d.summary(now)
+	if !ok {
+		d.log.Info("digest skipped, nothing to report")
+		return
+	}
+	d.log.Info("sending digest")
+	d.sink.AlertFired(Alert{Rule: digestRule, Severity: "info", State: alertDigest, Message: summary, Since: now, FiredAt: now})
+}
+
+// summary lists the battery devices at or below the threshold and the stale
+// devices, and reports false when there are none.
+func (d *AlertDigest) summary(now time.Time) (string, bool) {
+	devs := d.vdev.Devices()
+	slices.SortFunc(devs, func(a, b *VirtualDevice) int { return strings.Compare(a.ID, b.ID) })
+	var low, stale []string
+	for _, dev := range devs {
+		if dev.Type == VdevTypeBattery {
+			if level, ok := toFloat64Internal(dev.State); ok && level <= d.batteryThreshold {
+				low = append(low, fmt.Sprintf("- %s: %g%%", dev.ID, level))
+			}
+		}
+		ttl, ok := d.staleAfter[dev.Type]
+		switch {
+		case !ok:
+		case dev.LastUpdatedAt.IsZero():
+			stale = append(stale, fmt.Sprintf("- %s: never reported", dev.ID))
+		case now.Sub(dev.LastUpdatedAt) > ttl:
+			stale = append(stale, fmt.Sprintf("- %s: last report %s", dev.ID, dev.LastUpdatedAt.In(d.loc).Format("2006-01-02 15:04")))
+		}
+	}
+	if len(low) == 0 && len(stale) == 0 {
+		return "", false
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Digest: %d low battery, %d stale", len(low), len(stale))
+	if len(low) > 0 {
+		fmt.Fprintf(&b, "\nLow battery (≤ %g%%):\n%s", d.batteryThreshold, strings.Join(low, "\n"))
+	}
+	if len(stale) > 0 {
+		fmt.Fprintf(&b, "\nStale:\n%s", strings.Join(stale, "\n"))
+	}
+	return b.String(), true
+}
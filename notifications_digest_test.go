@@ -0,0 +1,134 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDigest creates a digest on the test database over the given
+// devices, recording what it sends.
+func newTestDigest(t *testing.T, dg DigestConfig, devs ...*VirtualDevice) (*AlertDigest, *recordingSink) {
+	t.Helper()
+	cfg := &Config{Notifications: NotificationsConfig{Webhooks: []WebhookConfig{{Name: "ntfy", URL: "https://ntfy.sh/hs"}}, Digest: &dg}}
+	if err := validateDigestConfig(cfg, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	vdev := NewVdevManager()
+	vdev.AddDevices(devs)
+	sink := &recordingSink{}
+	d, err := NewAlertDigest(cfg, vdev, gormDB, sink, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, sink
+}
+
+func TestAlertDigest_Summary(t *testing.T) {
+	setupTestDB(t)
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 15, 8, 0, 0, 0, warsaw)
+	d, sink := newTestDigest(t, DigestConfig{Timezone: "Europe/Warsaw", StaleAfter: map[string]string{"temperature": "1h", "battery": "24h"}},
+		reading("hall/door/battery", VdevTypeBattery, 12.0, now.Add(-time.Hour)),
+		reading("lab/remote/battery", VdevTypeBattery, 20.0, now.Add(-time.Hour)),
+		reading("lab/sensor/battery", VdevTypeBattery, 80.0, now.Add(-time.Hour)),
+		reading("lab/temperature", VdevTypeTemperature, 21.5, now.Add(-90*time.Minute)),
+		reading("hall/temperature", VdevTypeTemperature, 21.5, now.Add(-time.Minute)),
+		&VirtualDevice{ID: "kitchen/temperature", Type: VdevTypeTemperature},
+		// Not checked for staleness: co2 isn't in stale_after.
+		reading("lab/co2", VdevTypeCO2, 800.0, now.Add(-48*time.Hour)),
+	)
+
+	d.run(now)
+	if got := sink.take(); !slices.Equal(got, []string{"fired:digest/"}) {
+		t.Fatalf("events %v", got)
+	}
+	a := sink.alerts[0]
+	if a.Severity != "info" || a.State != alertDigest {
+		t.Errorf("sent %+v", a)
+	}
+	want := strings.Join([]string{
+		"Digest: 2 low battery, 2 stale",
+		"Low battery (≤ 20%):",
+		"- hall/door/battery: 12%",
+		"- lab/remote/battery: 20%",
+		"Stale:",
+		"- kitchen/temperature: never reported",
+		"- lab/temperature: last report 2026-10-15 06:30",
+	}, "\n")
+	if a.Message != want {
+		t.Fatalf("summary\n%s\nwant\n%s", a.Message, want)
+	}
+}
+
+func TestAlertDigest_ScheduleInTimezone(t *testing.T) {
+	setupTestDB(t)
+	d, sink := newTestDigest(t, DigestConfig{Schedule: "30 7 * * *", Timezone: "Europe/Warsaw"},
+		reading("hall/door/battery", VdevTypeBattery, 5.0, time.Now()))
+
+	// 07:30 UTC is 09:30 in Warsaw (CEST).
+	d.run(time.Date(2026, 10, 15, 7, 30, 0, 0, time.UTC))
+	expectEvents(t, sink, "07:30 UTC")
+	d.run(time.Date(2026, 10, 15, 5, 30, 10, 0, time.UTC))
+	expectEvents(t, sink, "07:30 Warsaw", "fired:digest/")
+	// After the switch to CET on October 25th, 07:30 is 06:30 UTC.
+	d.run(time.Date(2026, 10, 26, 6, 30, 0, 0, time.UTC))
+	expectEvents(t, sink, "07:30 Warsaw in winter", "fired:digest/")
+}
+
+func TestAlertDigest_SendsOncePerMinuteAcrossRestarts(t *testing.T) {
+	setupTestDB(t)
+	battery := reading("hall/door/battery", VdevTypeBattery, 5.0, time.Now())
+	d, sink := newTestDigest(t, DigestConfig{Timezone: "UTC"}, battery)
+	at8 := time.Date(2026, 10, 15, 8, 0, 5, 0, time.UTC)
+
+	d.run(at8)
+	d.run(at8.Add(20 * time.Second))
+	expectEvents(t, sink, "8:00", "fired:digest/")
+
+	restarted, sink := newTestDigest(t, DigestConfig{Timezone: "UTC"}, battery)
+	restarted.run(at8.Add(40 * time.Second))
+	expectEvents(t, sink, "restarted at 8:00")
+	restarted.run(at8.Add(24 * time.Hour))
+	expectEvents(t, sink, "next day", "fired:digest/")
+}
+
+func TestAlertDigest_NothingToReport(t *testing.T) {
+	setupTestDB(t)
+	now := time.Date(2026, 10, 15, 8, 0, 0, 0, time.UTC)
+	d, sink := newTestDigest(t, DigestConfig{Timezone: "UTC"},
+		reading("hall/door/battery", VdevTypeBattery, 60.0, now),
+		reading("lab/temperature", VdevTypeTemperature, 21.5, now.Add(-time.Hour)))
+
+	d.run(now)
+	expectEvents(t, sink, "all well")
+}
+
+func TestValidateDigestConfig(t *testing.T) {
+	webhooks := []WebhookConfig{{Name: "ntfy", URL: "https://ntfy.sh/hs"}}
+	for _, tc := range []struct {
+		name     string
+		webhooks []WebhookConfig
+		digest   *DigestConfig
+		ok       bool
+	}{
+		{"none", nil, nil, true},
+		{"defaults", webhooks, &DigestConfig{}, true},
+		{"valid", webhooks, &DigestConfig{Schedule: "0 9 * * 1-5", Timezone: "Europe/Warsaw", BatteryThreshold: 15, StaleAfter: map[string]string{"co2": "2h"}}, true},
+		{"no target", nil, &DigestConfig{}, false},
+		{"schedule", webhooks, &DigestConfig{Schedule: "8:00"}, false},
+		{"timezone", webhooks, &DigestConfig{Timezone: "Europe/Krakow"}, false},
+		{"threshold", webhooks, &DigestConfig{BatteryThreshold: 120}, false},
+		{"stale type", webhooks, &DigestConfig{StaleAfter: map[string]string{"door": "1h"}}, false},
+		{"stale duration", webhooks, &DigestConfig{StaleAfter: map[string]string{"co2": "1 day"}}, false},
+	} {
+		err := validateDigestConfig(&Config{Notifications: NotificationsConfig{Webhooks: tc.webhooks, Digest: tc.digest}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
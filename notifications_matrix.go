@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// matrixSendInterval spaces out the messages sent to the room, well
+	// within homeservers' default rate limits.
+	matrixSendInterval = time.Second
+	// maxMatrixRetryAfter caps how long a 429 from the homeserver is waited
+	// out before trying again.
+	maxMatrixRetryAfter = 5 * time.Minute
+)
+
+// matrixSeverityColors color the severity in the HTML body.
+var matrixSeverityColors = map[string]string{
+	"critical": "#d32f2f",
+	"warning":  "#f57c00",
+	"info":     "#1976d2",
+}
+
+// matrixResolvedColor replaces the severity color for resolved alerts.
+const matrixResolvedColor = "#388e3c"
+
+// MatrixConfig sends alerts to a Matrix room as m.notice messages.
+type MatrixConfig struct {
+	// Homeserver is the client-server API base URL, e.g. "https://matrix.org".
+	Homeserver  string `yaml:"homeserver"`
+	AccessToken string `yaml:"access_token"`
+	// AccessTokenFile reads the access token from a file.
+	AccessTokenFile string `yaml:"access_token_file"`
+	// RoomID is the room's internal ID ("!abc:example.org"), not an alias.
+	// The account must have joined it.
+	RoomID string `yaml:"room_id"`
+	// Severities and Rules limit the alerts sent, like those of a webhook.
+	Severities []string `yaml:"severities"`
+	Rules      []string `yaml:"rules"`
+	// MaxAttempts is how often a message is tried before it is logged as
+	// dead. Default 5.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// validateMatrixConfig fails fast on a Matrix target that can't be sent to.
+func validateMatrixConfig(cfg *Config, cfgPath string) error {
+	m := cfg.Notifications.Matrix
+	if m == nil {
+		return nil
+	}
+	if u, err := url.Parse(m.Homeserver); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("notifications.matrix.homeserver is not an http(s) URL (%q) in %s", m.Homeserver, cfgPath)
+	}
+	if m.AccessToken == "" {
+		return fmt.Errorf("notifications.matrix needs access_token or access_token_file in %s", cfgPath)
+	}
+	if !strings.HasPrefix(m.RoomID, "!") || !strings.Contains(m.RoomID, ":") {
+		return fmt.Errorf("notifications.matrix.room_id must be a room ID like !abc:example.org (got %q) in %s", m.RoomID, cfgPath)
+	}
+	if m.MaxAttempts < 0 {
+		return fmt.Errorf("notifications.matrix.max_attempts must not be negative in %s", cfgPath)
+	}
+	return validateAlertRouting("notifications.matrix", m.Severities, m.Rules, cfgPath)
+}
+
+// matrixTarget sends to the Matrix room. Its fields past queue belong to
+// the delivering goroutine.
+type matrixTarget struct {
+	MatrixConfig
+	client      *http.Client
+	maxAttempts int
+	queue       chan Alert
+
+	// interval is the least time between two messages.
+	interval time.Duration
+	lastSent time.Time
+	// events are the IDs of the messages of firing alerts, which their
+	// resolved message replies to.
+	events map[alertKey]string
+	// txnPrefix and txn make the transaction IDs, which let the homeserver
+	// drop the duplicate when a sent message is retried.
+	txnPrefix string
+	txn       int
+}
+
+func newMatrixTarget(cfg MatrixConfig) *matrixTarget {
+	attempts := cfg.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookMaxAttempts
+	}
+	return &matrixTarget{
+		MatrixConfig: cfg,
+		client:       &http.Client{Timeout: defaultWebhookTimeout},
+		maxAttempts:  attempts,
+		queue:        make(chan Alert, webhookQueueSize),
+		interval:     matrixSendInterval,
+		events:       map[alertKey]string{},
+		txnPrefix:    "at2-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// matrixMessage is the content of an m.room.message event.
+type matrixMessage struct {
+	MsgType       string           `json:"msgtype"`
+	Body          string           `json:"body"`
+	Format        string           `json:"format"`
+	FormattedBody string           `json:"formatted_body"`
+	RelatesTo     *matrixRelatesTo `json:"m.relates_to,omitempty"`
+}
+
+type matrixRelatesTo struct {
+	InReplyTo matrixEventRef `json:"m.in_reply_to"`
+}
+
+type matrixEventRef struct {
+	EventID string `json:"event_id"`
+}
+
+// message formats the alert, replying to the firing message when resolved.
+func (t *matrixTarget) message(a Alert) matrixMessage {
+	color := matrixSeverityColors[a.Severity]
+	if a.State == alertResolved {
+		color = matrixResolvedColor
+	}
+	label := strings.ToUpper(a.Severity)
+	msg := matrixMessage{
+		MsgType: "m.notice",
+		Body:    fmt.Sprintf("[%s] %s: %s", label, a.stateLabel(), a.Message),
+		Format:  "org.matrix.custom.html",
+		FormattedBody: fmt.Sprintf(`<font color="%s"><b>[%s]</b></font> %s: %s`,
+			color, label, html.EscapeString(a.stateLabel()), strings.ReplaceAll(html.EscapeString(a.Message), "\n", "<br>")),
+	}
+	if a.State == alertResolved {
+		if id, ok := t.events[alertKey{rule: a.Rule, device: a.DeviceID}]; ok {
+			msg.RelatesTo = &matrixRelatesTo{InReplyTo: matrixEventRef{EventID: id}}
+		}
+	}
+	return msg
+}
+
+// deliverMatrix sends the alert to the room, waiting out 429s for as long as
+// the homeserver asks and backing off after other failures.
+func (d *NotificationDispatcher) deliverMatrix(t *matrixTarget, a Alert) {
+	key := alertKey{rule: a.Rule, device: a.DeviceID}
+	if a.State == alertResolved {
+		defer delete(t.events, key)
+	}
+	body, err := json.Marshal(t.message(a))
+	if err != nil {
+		d.log.Error("encoding matrix message failed", "rule", a.Rule, "device", a.DeviceID, "err", err)
+		return
+	}
+	t.txn++
+	txnID := fmt.Sprintf("%s-%d", t.txnPrefix, t.txn)
+
+	var eventID string
+	delivered := d.retry("matrix", a, body, t.maxAttempts, func() (retryAfter time.Duration, retry bool, err error) {
+		if !sleepCtx(d.ctx, time.Until(t.lastSent.Add(t.interval))) {
+			return 0, false, d.ctx.Err()
+		}
+		t.lastSent = time.Now()
+		eventID, retryAfter, retry, err = t.send(d.ctx, txnID, body)
+		return retryAfter, retry, err
+	})
+	if delivered && a.State == alertFiring {
+		t.events[key] = eventID
+	}
+}
+
+// send PUTs the message event. A 429 reports how long the homeserver asked
+// to wait; other client errors aren't worth retrying.
+func (t *matrixTarget) send(ctx context.Context, txnID string, body []byte) (eventID string, retryAfter time.Duration, retry bool, err error) {
+	endpoint := strings.TrimRight(t.Homeserver, "/") + "/_matrix/client/v3/rooms/" +
+		url.PathEscape(t.RoomID) + "/send/m.room.message/" + url.PathEscape(txnID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", 0, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", 0, true, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		EventID      string `json:"event_id"`
+		ErrCode      string `json:"errcode"`
+		Error        string `json:"error"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	if resp.StatusCode == http.StatusOK {
+		return result.EventID, 0, false, nil
+	}
+
+	err = fmt.Errorf("matrix status %d %s %s", resp.StatusCode, result.ErrCode, result.Error)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter = time.Duration(result.RetryAfterMs) * time.Millisecond
+		if retryAfter == 0 {
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				retryAfter = time.Duration(s) * time.Second
+			}
+		}
+		return "", min(retryAfter, maxMatrixRetryAfter), true, err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return "", 0, false, err
+	}
+	return "", 0, true, err
+}
+
+// sleepCtx waits for d, reporting false when ctx was canceled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// matrixRequest is a message event received by the test homeserver.
+type matrixRequest struct {
+	path    string
+	auth    string
+	at      time.Time
+	content matrixMessage
+}
+
+// matrixHomeserverStub answers the given number of sends with a 429 asking
+// to wait retryAfterMs, then accepts them with event IDs $1, $2, ...
+func matrixHomeserverStub(t *testing.T, rateLimited int, retryAfterMs int) (*httptest.Server, <-chan matrixRequest) {
+	t.Helper()
+	reqs := make(chan matrixRequest, 10)
+	var calls, events atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := matrixRequest{path: r.URL.Path, auth: r.Header.Get("Authorization"), at: time.Now()}
+		if r.Method != http.MethodPut || json.NewDecoder(r.Body).Decode(&req.content) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reqs <- req
+		if int(calls.Add(1)) <= rateLimited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":%d}`, retryAfterMs)
+			return
+		}
+		fmt.Fprintf(w, `{"event_id":"$%d"}`, events.Add(1))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func setupMatrixTest(t *testing.T, homeserver string, interval time.Duration) *NotificationDispatcher {
+	t.Helper()
+	cfg := &Config{Notifications: NotificationsConfig{Matrix: &MatrixConfig{
+		Homeserver: homeserver, AccessToken: "syt_token", RoomID: "!infra:example.org",
+	}}}
+	if err := validateMatrixConfig(cfg, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	d := NewNotificationDispatcher(cfg, testLogger)
+	d.matrix.interval = interval
+	// Long enough that a test waiting for it times out.
+	d.backoff = func(int) time.Duration { return time.Hour }
+	d.Start()
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func receiveMatrix(t *testing.T, reqs <-chan matrixRequest) matrixRequest {
+	t.Helper()
+	select {
+	case req := <-reqs:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("homeserver not called")
+		return matrixRequest{}
+	}
+}
+
+func TestMatrixSink_Send(t *testing.T) {
+	srv, reqs := matrixHomeserverStub(t, 0, 0)
+	d := setupMatrixTest(t, srv.URL+"/", 0)
+
+	d.AlertFired(Alert{Rule: "gas", DeviceID: "kitchen/gas", Severity: "critical", State: alertFiring, Message: "gas <detected>"})
+	req := receiveMatrix(t, reqs)
+	if !strings.HasPrefix(req.path, "/_matrix/client/v3/rooms/!infra:example.org/send/m.room.message/at2-") || req.auth != "Bearer syt_token" {
+		t.Fatalf("PUT %s with %q", req.path, req.auth)
+	}
+	c := req.content
+	if c.MsgType != "m.notice" || c.Body != "[CRITICAL] firing: gas <detected>" || c.Format != "org.matrix.custom.html" {
+		t.Errorf("content %+v", c)
+	}
+	if !strings.Contains(c.FormattedBody, `color="#d32f2f"`) || !strings.Contains(c.FormattedBody, "gas &lt;detected&gt;") {
+		t.Errorf("formatted body %q", c.FormattedBody)
+	}
+	if c.RelatesTo != nil {
+		t.Errorf("firing message relates to %+v", c.RelatesTo)
+	}
+}
+
+func TestMatrixSink_RetriesAfterRateLimit(t *testing.T) {
+	srv, reqs := matrixHomeserverStub(t, 1, 100)
+	d := setupMatrixTest(t, srv.URL, 0)
+
+	d.AlertFired(Alert{Rule: "gas", DeviceID: "kitchen/gas", Severity: "critical", State: alertFiring})
+	limited, sent := receiveMatrix(t, reqs), receiveMatrix(t, reqs)
+	if wait := sent.at.Sub(limited.at); wait < 100*time.Millisecond {
+		t.Errorf("retried after %v, before retry_after_ms", wait)
+	}
+	// The same transaction, so the homeserver can drop a duplicate.
+	if sent.path != limited.path {
+		t.Errorf("retried as %s, first sent as %s", sent.path, limited.path)
+	}
+}
+
+func TestMatrixSink_ResolvedRepliesToFiring(t *testing.T) {
+	srv, reqs := matrixHomeserverStub(t, 0, 0)
+	d := setupMatrixTest(t, srv.URL, 0)
+	gas := Alert{Rule: "gas", DeviceID: "kitchen/gas", Severity: "critical", State: alertFiring}
+	door := Alert{Rule: "door_open", DeviceID: "front_door/contact", Severity: "warning", State: alertFiring}
+
+	d.AlertFired(gas)
+	d.AlertFired(door)
+	gas.State = alertResolved
+	d.AlertResolved(gas)
+	first, second, resolved := receiveMatrix(t, reqs), receiveMatrix(t, reqs), receiveMatrix(t, reqs)
+	if first.path == second.path {
+		t.Errorf("two messages in transaction %s", first.path)
+	}
+	if r := resolved.content.RelatesTo; r == nil || r.InReplyTo.EventID != "$1" {
+		t.Fatalf("resolved message relates to %+v, want a reply to $1", r)
+	}
+	if !strings.Contains(resolved.content.FormattedBody, matrixResolvedColor) {
+		t.Errorf("resolved formatted body %q", resolved.content.FormattedBody)
+	}
+
+	// The event is forgotten once resolved; without one there's no reply.
+	d.AlertResolved(gas)
+	if r := receiveMatrix(t, reqs).content.RelatesTo; r != nil {
+		t.Fatalf("second resolved message relates to %+v", r)
+	}
+}
+
+func TestMatrixSink_SpacesOutMessages(t *testing.T) {
+	srv, reqs := matrixHomeserverStub(t, 0, 0)
+	d := setupMatrixTest(t, srv.URL, 100*time.Millisecond)
+
+	d.AlertFired(Alert{Rule: "gas", DeviceID: "kitchen/gas", State: alertFiring})
+	d.AlertFired(Alert{Rule: "gas", DeviceID: "lab/gas", State: alertFiring})
+	first, second := receiveMatrix(t, reqs), receiveMatrix(t, reqs)
+	// The interval is between the starts of the requests; allow for the
+	// first taking a moment to arrive.
+	if gap := second.at.Sub(first.at); gap < 90*time.Millisecond {
+		t.Fatalf("messages %v apart", gap)
+	}
+}
+
+func TestValidateMatrixConfig(t *testing.T) {
+	ok := MatrixConfig{Homeserver: "https://matrix.org", AccessToken: "syt_token", RoomID: "!infra:example.org"}
+	with := func(edit func(*MatrixConfig)) *MatrixConfig {
+		m := ok
+		edit(&m)
+		return &m
+	}
+	for _, tc := range []struct {
+		name   string
+		matrix *MatrixConfig
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"valid", with(func(m *MatrixConfig) { m.Severities, m.Rules = []string{"critical"}, []string{"gas*"} }), true},
+		{"homeserver", with(func(m *MatrixConfig) { m.Homeserver = "matrix.org" }), false},
+		{"token", with(func(m *MatrixConfig) { m.AccessToken = "" }), false},
+		{"alias", with(func(m *MatrixConfig) { m.RoomID = "#infra:example.org" }), false},
+		{"severity", with(func(m *MatrixConfig) { m.Severities = []string{"page"} }), false},
+		{"max_attempts", with(func(m *MatrixConfig) { m.MaxAttempts = -1 }), false},
+	} {
+		err := validateMatrixConfig(&Config{Notifications: NotificationsConfig{Matrix: tc.matrix}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
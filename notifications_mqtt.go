@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAlertTopicPrefix is notifications.mqtt.topic_prefix when it isn't set.
+const defaultAlertTopicPrefix = "at2/alerts"
+
+// MQTTAlertsConfig publishes alerts to retained MQTT topics on the broker of
+// the mqtt section, e.g. for a siren listening there.
+type MQTTAlertsConfig struct {
+	// TopicPrefix: a rule's alerts go to <TopicPrefix>/<rule>. Default
+	// "at2/alerts".
+	TopicPrefix string `yaml:"topic_prefix"`
+}
+
+// validateMQTTAlertsConfig rejects topic prefixes and rule names that don't
+// make valid topics to publish to.
+func validateMQTTAlertsConfig(cfg *Config, cfgPath string) error {
+	m := cfg.Notifications.MQTT
+	if m == nil {
+		return nil
+	}
+	if strings.ContainsAny(m.TopicPrefix, "+#") {
+		return fmt.Errorf("notifications.mqtt.topic_prefix must not contain wildcards (%q) in %s", m.TopicPrefix, cfgPath)
+	}
+	for _, rule := range cfg.Alerts.Rules {
+		if strings.ContainsAny(rule.Name, "+#") {
+			return fmt.Errorf("alert rule %q can't be published to MQTT, its name has wildcards, in %s", rule.Name, cfgPath)
+		}
+	}
+	return nil
+}
+
+// mqttAlertPayload is published for a rule's alert.
+type mqttAlertPayload struct {
+	State    string `json:"state"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Device   string `json:"device"`
+	Value    any    `json:"value"`
+	// Timestamp is when the alert fired or resolved, in Unix seconds.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// MQTTAlertSink is an AlertSink publishing each rule's alert state, retained,
+// to <prefix>/<rule>. While several devices fire for one rule the topic
+// shows the latest of them; it only turns resolved once all have resolved.
+type MQTTAlertSink struct {
+	mqtt   *MQTTAdapter
+	prefix string
+	log    *slog.Logger
+
+	mu sync.Mutex
+	// firing holds the firing alerts by rule and device.
+	firing map[string]map[string]Alert
+}
+
+// NewMQTTAlertSink creates the sink for notifications.mqtt, publishing with
+// the adapter's client.
+func NewMQTTAlertSink(cfg *Config, adapter *MQTTAdapter, logger *slog.Logger) *MQTTAlertSink {
+	prefix := defaultAlertTopicPrefix
+	if p := strings.TrimRight(cfg.Notifications.MQTT.TopicPrefix, "/"); p != "" {
+		prefix = p
+	}
+	return &MQTTAlertSink{mqtt: adapter, prefix: prefix, log: logger, firing: map[string]map[string]Alert{}}
+}
+
+// Start clears the topics of the configured rules, so alerts that were
+// firing when at2 stopped don't stay retained.
+func (s *MQTTAlertSink) Start(cfg *Config) {
+	for _, rule := range cfg.Alerts.Rules {
+		topic := s.topic(rule.Name)
+		if err := s.mqtt.Publish(topic, nil, true); err != nil {
+			s.log.Warn("clearing alert topic failed", "topic", topic, "err", err)
+		}
+	}
+}
+
+func (s *MQTTAlertSink) topic(rule string) string {
+	return s.prefix + "/" + rule
+}
+
+func (s *MQTTAlertSink) AlertFired(a Alert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firing[a.Rule] == nil {
+		s.firing[a.Rule] = map[string]Alert{}
+	}
+	s.firing[a.Rule][a.DeviceID] = a
+	s.publish(a, a.FiredAt)
+}
+
+// AlertResolved publishes the resolved alert, unless another device still
+// fires for the rule, which is then shown instead.
+func (s *MQTTAlertSink) AlertResolved(a Alert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := s.firing[a.Rule]
+	delete(devices, a.DeviceID)
+	var latest *Alert
+	for _, other := range devices {
+		if latest == nil || other.FiredAt.After(latest.FiredAt) {
+			latest = &other
+		}
+	}
+	if latest != nil {
+		s.publish(*latest, latest.FiredAt)
+		return
+	}
+	delete(s.firing, a.Rule)
+	s.publish(a, a.ResolvedAt)
+}
+
+// publish sends the alert as the rule's retained state. Called with s.mu
+// held, which keeps the publishes of a rule in order.
+func (s *MQTTAlertSink) publish(a Alert, at time.Time) {
+	payload, err := json.Marshal(mqttAlertPayload{
+		State:     a.State,
+		Rule:      a.Rule,
+		Severity:  a.Severity,
+		Message:   a.Message,
+		Device:    a.DeviceID,
+		Value:     a.Value,
+		Timestamp: at.Unix(),
+	})
+	if err != nil {
+		s.log.Error("encoding alert failed", "rule", a.Rule, "device", a.DeviceID, "err", err)
+		return
+	}
+	topic := s.topic(a.Rule)
+	if err := s.mqtt.Publish(topic, payload, true); err != nil {
+		s.log.Warn("publishing alert failed", "topic", topic, "err", err)
+	}
+}
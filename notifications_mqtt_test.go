@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func setupMQTTAlertTest(prefix string) (*MQTTAlertSink, *MockClient) {
+	client := &MockClient{}
+	cfg := &Config{Notifications: NotificationsConfig{MQTT: &MQTTAlertsConfig{TopicPrefix: prefix}}}
+	return NewMQTTAlertSink(cfg, &MQTTAdapter{client: client}, testLogger), client
+}
+
+func publishedAlert(t *testing.T, client *MockClient, wantTopic string) mqttAlertPayload {
+	t.Helper()
+	if client.PublishedTopic != wantTopic || !client.PublishedRetained {
+		t.Fatalf("published to %q (retained %v), want retained %q", client.PublishedTopic, client.PublishedRetained, wantTopic)
+	}
+	var p mqttAlertPayload
+	if err := json.Unmarshal(client.PublishedPayload, &p); err != nil {
+		t.Fatalf("payload %q: %v", client.PublishedPayload, err)
+	}
+	return p
+}
+
+func TestMQTTAlertSink_FiringAndResolved(t *testing.T) {
+	s, client := setupMQTTAlertTest("")
+	fired := time.Unix(1760529600, 0)
+	a := Alert{Rule: "gas", DeviceID: "kitchen/gas", Severity: "critical", State: alertFiring, Message: "gas!", Value: true, FiredAt: fired}
+
+	s.AlertFired(a)
+	p := publishedAlert(t, client, "at2/alerts/gas")
+	if p.State != alertFiring || p.Device != "kitchen/gas" || p.Message != "gas!" || p.Value != true || p.Severity != "critical" || p.Timestamp != fired.Unix() {
+		t.Fatalf("firing payload %+v", p)
+	}
+
+	a.State, a.Value, a.ResolvedAt = alertResolved, false, fired.Add(time.Minute)
+	s.AlertResolved(a)
+	p = publishedAlert(t, client, "at2/alerts/gas")
+	if p.State != alertResolved || p.Value != false || p.Timestamp != fired.Add(time.Minute).Unix() {
+		t.Fatalf("resolved payload %+v", p)
+	}
+}
+
+func TestMQTTAlertSink_KeepsFiringWhileAnotherDeviceFires(t *testing.T) {
+	s, client := setupMQTTAlertTest("hq/alerts/")
+	t0 := time.Unix(1760529600, 0)
+	lab := Alert{Rule: "hot", DeviceID: "lab/temperature", State: alertFiring, FiredAt: t0}
+	hall := Alert{Rule: "hot", DeviceID: "hall/temperature", State: alertFiring, FiredAt: t0.Add(time.Minute)}
+	s.AlertFired(lab)
+	s.AlertFired(hall)
+
+	hall.State, hall.ResolvedAt = alertResolved, t0.Add(2*time.Minute)
+	s.AlertResolved(hall)
+	if p := publishedAlert(t, client, "hq/alerts/hot"); p.State != alertFiring || p.Device != "lab/temperature" {
+		t.Fatalf("after one of two resolved: %+v", p)
+	}
+
+	lab.State, lab.ResolvedAt = alertResolved, t0.Add(3*time.Minute)
+	s.AlertResolved(lab)
+	if p := publishedAlert(t, client, "hq/alerts/hot"); p.State != alertResolved || p.Device != "lab/temperature" {
+		t.Fatalf("after both resolved: %+v", p)
+	}
+}
+
+func TestMQTTAlertSink_StartClearsRuleTopics(t *testing.T) {
+	s, client := setupMQTTAlertTest("")
+	s.Start(&Config{Alerts: AlertsConfig{Rules: []AlertRule{{Name: "gas"}, {Name: "hot"}}}})
+	if client.PublishedTopic != "at2/alerts/hot" || !client.PublishedRetained || len(client.PublishedPayload) != 0 {
+		t.Fatalf("published %q to %q (retained %v), want an empty retained message", client.PublishedPayload, client.PublishedTopic, client.PublishedRetained)
+	}
+}
+
+func TestValidateMQTTAlertsConfig(t *testing.T) {
+	rules := []AlertRule{{Name: "gas"}}
+	for _, tc := range []struct {
+		cfg Config
+		ok  bool
+	}{
+		{Config{Alerts: AlertsConfig{Rules: []AlertRule{{Name: "co2#lab"}}}}, true},
+		{Config{Alerts: AlertsConfig{Rules: rules}, Notifications: NotificationsConfig{MQTT: &MQTTAlertsConfig{}}}, true},
+		{Config{Alerts: AlertsConfig{Rules: []AlertRule{{Name: "co2#lab"}}}, Notifications: NotificationsConfig{MQTT: &MQTTAlertsConfig{}}}, false},
+		{Config{Notifications: NotificationsConfig{MQTT: &MQTTAlertsConfig{TopicPrefix: "at2/+/alerts"}}}, false},
+	} {
+		err := validateMQTTAlertsConfig(&tc.cfg, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: err = %v", tc.cfg.Notifications.MQTT, err)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTelegramAPIURL is notifications.telegram.api_url when it isn't set.
+	defaultTelegramAPIURL = "https://api.telegram.org"
+	// telegramPollTimeout is how long a getUpdates long poll waits for a
+	// message.
+	telegramPollTimeout = 30 * time.Second
+	// telegramPollBackoff is the wait after a failed poll.
+	telegramPollBackoff = 5 * time.Second
+	// telegramCommandMaxAge drops commands sent long before they were
+	// received, e.g. while at2 was down.
+	telegramCommandMaxAge = 5 * time.Minute
+	// maxSilenceDuration caps how long a /silence lasts.
+	maxSilenceDuration = 7 * 24 * time.Hour
+)
+
+// telegramSeverityEmoji prefix the alert messages.
+var telegramSeverityEmoji = map[string]string{
+	"critical": "🔴",
+	"warning":  "🟠",
+	"info":     "🔵",
+}
+
+// telegramResolvedEmoji replaces the severity emoji for resolved alerts.
+const telegramResolvedEmoji = "✅"
+
+// TelegramConfig sends alerts to a Telegram chat through a bot, and lets
+// allowed users silence alerts and ask for the space's status by messaging
+// the bot.
+type TelegramConfig struct {
+	BotToken string `yaml:"bot_token"`
+	// BotTokenFile reads the bot token from a file.
+	BotTokenFile string `yaml:"bot_token_file"`
+	// ChatID is the user, group or channel the alerts are sent to.
+	ChatID int64 `yaml:"chat_id"`
+	// AllowedUsers are the Telegram user IDs whose commands are obeyed.
+	// Without any, the bot doesn't read messages.
+	AllowedUsers []int64 `yaml:"allowed_users"`
+	// Severities and Rules limit the alerts sent, like those of a webhook.
+	Severities []string `yaml:"severities"`
+	Rules      []string `yaml:"rules"`
+	// MaxAttempts is how often a message is tried before it is logged as
+	// dead. Default 5.
+	MaxAttempts int `yaml:"max_attempts"`
+	// APIURL is the Bot API base URL. Default "https://api.telegram.org".
+	APIURL string `yaml:"api_url"`
+}
+
+// validateTelegramConfig fails fast on a Telegram bot that can't be used.
+func validateTelegramConfig(cfg *Config, cfgPath string) error {
+	tg := cfg.Notifications.Telegram
+	if tg == nil {
+		return nil
+	}
+	if tg.BotToken == "" {
+		return fmt.Errorf("notifications.telegram needs bot_token or bot_token_file in %s", cfgPath)
+	}
+	if tg.ChatID == 0 {
+		return fmt.Errorf("notifications.telegram needs chat_id in %s", cfgPath)
+	}
+	if tg.APIURL != "" {
+		if u, err := url.Parse(tg.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notifications.telegram.api_url is not an http(s) URL (%q) in %s", tg.APIURL, cfgPath)
+		}
+	}
+	if tg.MaxAttempts < 0 {
+		return fmt.Errorf("notifications.telegram.max_attempts must not be negative in %s", cfgPath)
+	}
+	return validateAlertRouting("notifications.telegram", tg.Severities, tg.Rules, cfgPath)
+}
+
+// telegramAPI calls the Bot API methods.
+type telegramAPI struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newTelegramAPI(cfg TelegramConfig, timeout time.Duration) telegramAPI {
+	base := defaultTelegramAPIURL
+	if cfg.APIURL != "" {
+		base = strings.TrimRight(cfg.APIURL, "/")
+	}
+	return telegramAPI{baseURL: base, token: cfg.BotToken, client: &http.Client{Timeout: timeout}}
+}
+
+// call POSTs params to the method and decodes its result into result. A 429
+// reports how long Telegram asked to wait; other client errors aren't worth
+// retrying.
+func (api telegramAPI) call(ctx context.Context, method string, params, result any) (retryAfter time.Duration, retry bool, err error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return 0, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.baseURL+"/bot"+api.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.client.Do(req)
+	if err != nil {
+		// Don't log the URL, which carries the token.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply)
+	if resp.StatusCode == http.StatusOK && reply.OK {
+		if result != nil {
+			if err := json.Unmarshal(reply.Result, result); err != nil {
+				return 0, false, fmt.Errorf("telegram %s result: %w", method, err)
+			}
+		}
+		return 0, false, nil
+	}
+
+	err = fmt.Errorf("telegram status %d %s", resp.StatusCode, reply.Description)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return min(time.Duration(reply.Parameters.RetryAfter)*time.Second, maxMatrixRetryAfter), true, err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return 0, false, err
+	}
+	return 0, true, err
+}
+
+// telegramSendMessage are the sendMessage parameters.
+type telegramSendMessage struct {
+	ChatID    int64  `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// telegramTarget sends alerts to the chat.
+type telegramTarget struct {
+	TelegramConfig
+	api         telegramAPI
+	maxAttempts int
+	queue       chan Alert
+}
+
+func newTelegramTarget(cfg TelegramConfig) *telegramTarget {
+	attempts := cfg.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookMaxAttempts
+	}
+	return &telegramTarget{
+		TelegramConfig: cfg,
+		api:            newTelegramAPI(cfg, defaultWebhookTimeout),
+		maxAttempts:    attempts,
+		queue:          make(chan Alert, webhookQueueSize),
+	}
+}
+
+// message formats the alert as an HTML message.
+func (t *telegramTarget) message(a Alert) telegramSendMessage {
+	emoji := telegramSeverityEmoji[a.Severity]
+	if a.State == alertResolved {
+		emoji = telegramResolvedEmoji
+	}
+	return telegramSendMessage{
+		ChatID: t.ChatID,
+		Text: fmt.Sprintf("%s <b>[%s]</b> %s: %s", emoji, strings.ToUpper(a.Severity),
+			html.EscapeString(a.stateLabel()), html.EscapeString(a.Message)),
+		ParseMode: "HTML",
+	}
+}
+
+// deliverTelegram sends the alert to the chat, waiting out 429s for as long
+// as Telegram asks and backing off after other failures.
+func (d *NotificationDispatcher) deliverTelegram(t *telegramTarget, a Alert) {
+	msg := t.message(a)
+	body, _ := json.Marshal(msg)
+	d.retry("telegram", a, body, t.maxAttempts, func() (time.Duration, bool, error) {
+		return t.api.call(d.ctx, "sendMessage", msg, nil)
+	})
+}
+
+// telegramUpdate is a getUpdates result; only messages are asked for.
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	From *struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	// Date is when the message was sent, in Unix seconds.
+	Date int64  `json:"date"`
+	Text string `json:"text"`
+}
+
+// TelegramBot long-polls the bot's messages and answers the commands of the
+// allowed users:
+//
+//	/silence <rule> <duration>  hold back the notifications of matching rules
+//	/status                     open state, people present and firing alerts
+type TelegramBot struct {
+	api      telegramAPI
+	allowed  []int64
+	silences *AlertSilences
+	engine   *AlertEngine
+	vdev     *VdevManager
+	// config returns the current config, for the rule names and rooms.
+	config func() *Config
+	log    *slog.Logger
+
+	pollTimeout time.Duration
+	offset      int64
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// NewTelegramBot creates the command handler for notifications.telegram.
+// Polling starts with Start.
+func NewTelegramBot(cfg TelegramConfig, silences *AlertSilences, engine *AlertEngine, vdev *VdevManager, logger *slog.Logger) *TelegramBot {
+	return &TelegramBot{
+		api:         newTelegramAPI(cfg, telegramPollTimeout+defaultWebhookTimeout),
+		allowed:     cfg.AllowedUsers,
+		silences:    silences,
+		engine:      engine,
+		vdev:        vdev,
+		config:      GetConfig,
+		log:         logger,
+		pollTimeout: telegramPollTimeout,
+	}
+}
+
+// Start polls for messages until Stop.
+func (b *TelegramBot) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel, b.done = cancel, make(chan struct{})
+	go func() {
+		defer close(b.done)
+		for ctx.Err() == nil {
+			if err := b.poll(ctx); err != nil && ctx.Err() == nil {
+				b.log.Warn("polling telegram failed", "err", err)
+				sleepCtx(ctx, telegramPollBackoff)
+			}
+		}
+	}()
+}
+
+// Stop ends polling and waits for a command being handled.
+func (b *TelegramBot) Stop() {
+	b.cancel()
+	<-b.done
+}
+
+// poll waits for new messages and answers them.
+func (b *TelegramBot) poll(ctx context.Context) error {
+	var updates []telegramUpdate
+	_, _, err := b.api.call(ctx, "getUpdates", map[string]any{
+		"offset":          b.offset,
+		"timeout":         int(b.pollTimeout / time.Second),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		b.offset = max(b.offset, u.UpdateID+1)
+		m := u.Message
+		if m == nil || m.From == nil || time.Since(time.Unix(m.Date, 0)) > telegramCommandMaxAge {
+			continue
+		}
+		reply := b.handleCommand(m.From.ID, m.From.Username, m.Text, time.Now())
+		if reply == "" {
+			continue
+		}
+		msg := telegramSendMessage{ChatID: m.Chat.ID, Text: reply}
+		if _, _, err := b.api.call(ctx, "sendMessage", msg, nil); err != nil {
+			b.log.Warn("replying on telegram failed", "chat", m.Chat.ID, "err", err)
+		}
+	}
+	return nil
+}
+
+// handleCommand answers a message from the given user. Messages that aren't
+// commands get no answer ("").
+func (b *TelegramBot) handleCommand(from int64, username, text string, now time.Time) string {
+	args := strings.Fields(text)
+	if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+		return ""
+	}
+	if !slices.Contains(b.allowed, from) {
+		b.log.Warn("telegram command from a user not allowed", "user_id", from, "username", username, "command", args[0])
+		return "You are not allowed to use this bot."
+	}
+	// In groups commands may be addressed as /status@bot_name.
+	cmd, _, _ := strings.Cut(args[0], "@")
+	switch cmd {
+	case "/silence":
+		return b.silence(args[1:], telegramUser(from, username), now)
+	case "/status":
+		return b.status(now)
+	}
+	return "Commands:\n/silence <rule> <duration> – hold back alerts, e.g. /silence co2_* 2h\n/status – open state, people and firing alerts"
+}
+
+func telegramUser(id int64, username string) string {
+	if username != "" {
+		return "telegram:" + username
+	}
+	return "telegram:" + strconv.FormatInt(id, 10)
+}
+
+// silence handles /silence <rule> <duration>.
+func (b *TelegramBot) silence(args []string, createdBy string, now time.Time) string {
+	if len(args) != 2 {
+		return "Usage: /silence <rule> <duration>, e.g. /silence co2_* 2h"
+	}
+	rule := args[0]
+	if _, err := path.Match(rule, ""); err != nil {
+		return fmt.Sprintf("Invalid rule pattern %q.", rule)
+	}
+	if !slices.ContainsFunc(b.config().Alerts.Rules, func(r AlertRule) bool {
+		ok, _ := path.Match(rule, r.Name)
+		return ok
+	}) {
+		return fmt.Sprintf("No alert rule matches %q.", rule)
+	}
+	d, ok := parseSilenceDuration(args[1])
+	if !ok {
+		return fmt.Sprintf("Invalid duration %q: use e.g. 30m, 2h or 1d, at most 7d.", args[1])
+	}
+	silence, err := b.silences.Add(rule, now.Add(d), createdBy, now)
+	if err != nil {
+		b.log.Error("adding silence failed", "rule", rule, "err", err)
+		return "Storing the silence failed."
+	}
+	b.log.Info("alerts silenced", "rule", rule, "until", silence.Until, "by", createdBy)
+	return fmt.Sprintf("Silenced %s until %s.", rule, silence.Until.Format("2006-01-02 15:04"))
+}
+
+// parseSilenceDuration parses a Go duration or a number of days ("2d"),
+// positive and at most maxSilenceDuration.
+func parseSilenceDuration(s string) (time.Duration, bool) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n > int(maxSilenceDuration/(24*time.Hour)) {
+			return 0, false
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, false
+		}
+	}
+	return d, d > 0 && d <= maxSilenceDuration
+}
+
+// status handles /status.
+func (b *TelegramBot) status(now time.Time) string {
+	cfg := b.config()
+	deviceMap := map[string]*VirtualDevice{}
+	for _, dev := range b.vdev.Devices() {
+		deviceMap[dev.ID] = dev
+	}
+	var s strings.Builder
+	switch open := spaceOpen(cfg, deviceMap); {
+	case open == nil:
+		s.WriteString("The open state is unknown.")
+	case *open:
+		s.WriteString("The space is open.")
+	default:
+		s.WriteString("The space is closed.")
+	}
+	if people, known := spacePeopleCount(cfg, deviceMap); known {
+		fmt.Fprintf(&s, "\nPeople present: %g", people)
+	} else {
+		s.WriteString("\nPeople present: unknown")
+	}
+
+	firing := 0
+	if b.engine != nil {
+		for _, a := range b.engine.Active() {
+			if a.State == alertFiring {
+				firing++
+			}
+		}
+	}
+	fmt.Fprintf(&s, "\nAlerts firing: %d", firing)
+	for _, silence := range b.silences.Active(now) {
+		fmt.Fprintf(&s, "\nSilenced: %s until %s", silence.Rule, silence.Until.Format("2006-01-02 15:04"))
+	}
+	return s.String()
+}
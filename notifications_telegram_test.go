@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// telegramRequest is a Bot API call received by the test server.
+type telegramRequest struct {
+	path   string
+	params map[string]any
+}
+
+// telegramAPIStub answers getUpdates with updates once, then holds the long
+// poll until the client gives up, and accepts every other method.
+func telegramAPIStub(t *testing.T, updates ...string) (*httptest.Server, <-chan telegramRequest) {
+	t.Helper()
+	reqs := make(chan telegramRequest, 10)
+	pending := make(chan string, 1)
+	pending <- "[" + strings.Join(updates, ",") + "]"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := telegramRequest{path: r.URL.Path}
+		json.NewDecoder(r.Body).Decode(&req.params)
+		if strings.HasSuffix(req.path, "/getUpdates") {
+			select {
+			case result := <-pending:
+				w.Write([]byte(`{"ok":true,"result":` + result + `}`))
+			case <-r.Context().Done():
+			}
+			return
+		}
+		reqs <- req
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func receiveTelegram(t *testing.T, reqs <-chan telegramRequest) telegramRequest {
+	t.Helper()
+	select {
+	case req := <-reqs:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("telegram not called")
+		return telegramRequest{}
+	}
+}
+
+func TestTelegramSink_Send(t *testing.T) {
+	srv, reqs := telegramAPIStub(t)
+	cfg := &Config{Notifications: NotificationsConfig{Telegram: &TelegramConfig{BotToken: "123:abc", ChatID: -1001, APIURL: srv.URL}}}
+	if err := validateTelegramConfig(cfg, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	d := NewNotificationDispatcher(cfg, testLogger)
+	d.Start()
+	t.Cleanup(d.Stop)
+
+	d.AlertFired(Alert{Rule: "gas", DeviceID: "kitchen/gas", Severity: "critical", State: alertFiring, Message: "gas <detected>"})
+	req := receiveTelegram(t, reqs)
+	if req.path != "/bot123:abc/sendMessage" {
+		t.Fatalf("called %s", req.path)
+	}
+	if req.params["chat_id"] != -1001.0 || req.params["parse_mode"] != "HTML" || req.params["text"] != "🔴 <b>[CRITICAL]</b> firing: gas &lt;detected&gt;" {
+		t.Errorf("params %v", req.params)
+	}
+}
+
+func newTestTelegramBot(t *testing.T, cfg *Config) *TelegramBot {
+	t.Helper()
+	setupTestDB(t)
+	silences, err := NewAlertSilences(gormDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewTelegramBot(TelegramConfig{BotToken: "123:abc", AllowedUsers: []int64{42}}, silences, nil, NewVdevManager(), testLogger)
+	b.config = func() *Config { return cfg }
+	return b
+}
+
+func TestTelegramBot_Commands(t *testing.T) {
+	b := newTestTelegramBot(t, &Config{Alerts: AlertsConfig{Rules: []AlertRule{{Name: "co2_high"}, {Name: "gas"}}}})
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.Local)
+
+	for _, tc := range []struct {
+		from  int64
+		text  string
+		reply string
+	}{
+		{42, "hello", ""},
+		{42, "", ""},
+		{7, "/status", "You are not allowed to use this bot."},
+		{7, "/silence gas 1h", "You are not allowed to use this bot."},
+		{42, "/silence", "Usage: /silence <rule> <duration>, e.g. /silence co2_* 2h"},
+		{42, "/silence gas", "Usage: /silence <rule> <duration>, e.g. /silence co2_* 2h"},
+		{42, "/silence door 1h", `No alert rule matches "door".`},
+		{42, "/silence [ 1h", `Invalid rule pattern "[".`},
+		{42, "/silence gas soon", `Invalid duration "soon": use e.g. 30m, 2h or 1d, at most 7d.`},
+		{42, "/silence gas -1h", `Invalid duration "-1h": use e.g. 30m, 2h or 1d, at most 7d.`},
+		{42, "/silence gas 8d", `Invalid duration "8d": use e.g. 30m, 2h or 1d, at most 7d.`},
+		{42, "/silence co2_* 90m", "Silenced co2_* until 2026-10-15 13:30."},
+		{42, "/silence@at2_bot gas 2d", "Silenced gas until 2026-10-17 12:00."},
+		{42, "/help", "Commands:"},
+	} {
+		if got := b.handleCommand(tc.from, "alice", tc.text, now); !strings.HasPrefix(got, tc.reply) || (tc.reply == "" && got != "") {
+			t.Errorf("%d %q: replied %q, want %q", tc.from, tc.text, got, tc.reply)
+		}
+	}
+
+	// Only the allowed user's silences were stored.
+	active := b.silences.Active(now)
+	if len(active) != 2 || active[0].Rule != "co2_*" || active[0].CreatedBy != "telegram:alice" || active[1].Rule != "gas" {
+		t.Fatalf("silences %+v", active)
+	}
+}
+
+func TestTelegramBot_SilenceExpires(t *testing.T) {
+	b := newTestTelegramBot(t, &Config{Alerts: AlertsConfig{Rules: []AlertRule{{Name: "gas"}}}})
+	now := time.Now()
+	b.handleCommand(42, "", "/silence gas 30m", now)
+	if !b.silences.Silenced("gas", now.Add(29*time.Minute)) {
+		t.Fatal("gas not silenced")
+	}
+	if b.silences.Silenced("gas", now.Add(30*time.Minute)) {
+		t.Fatal("gas still silenced after 30m")
+	}
+	if got := b.silences.Active(now)[0].CreatedBy; got != "telegram:42" {
+		t.Errorf("created by %q", got)
+	}
+}
+
+func TestTelegramBot_Status(t *testing.T) {
+	cfg := &Config{Rooms: []RoomConfig{{ID: "hall", Entities: []EntityConfig{{ID: "hall/people"}, {ID: "lab/people"}}}}}
+	b := newTestTelegramBot(t, cfg)
+	now := time.Now()
+	people := []*VirtualDevice{
+		reading("hall/people", VdevTypePerson, 2.0, now),
+		reading("lab/people", VdevTypePerson, 1.0, now),
+	}
+	b.vdev.AddDevices(people)
+	b.engine, _ = newTestAlertEngine(t, AlertsConfig{Rules: []AlertRule{{Name: "crowded", Type: "person", Condition: "> 1"}}})
+	b.engine.evaluate(people, now)
+	b.silences.Add("gas", now.Add(time.Hour), "test", now)
+
+	got := b.handleCommand(42, "", "/status", now)
+	want := "The space is open.\nPeople present: 3\nAlerts firing: 1\nSilenced: gas until " + now.Add(time.Hour).Format("2006-01-02 15:04")
+	if got != want {
+		t.Fatalf("status %q, want %q", got, want)
+	}
+}
+
+func TestTelegramBot_PollAnswersCommands(t *testing.T) {
+	now, hourAgo := time.Now().Unix(), time.Now().Add(-time.Hour).Unix()
+	srv, reqs := telegramAPIStub(t,
+		fmt.Sprintf(`{"update_id":10,"message":{"from":{"id":7},"chat":{"id":7},"date":%d,"text":"/status"}}`, now),
+		fmt.Sprintf(`{"update_id":11,"message":{"from":{"id":42},"chat":{"id":-1001},"date":%d,"text":"/status"}}`, hourAgo),
+		fmt.Sprintf(`{"update_id":12,"message":{"from":{"id":42},"chat":{"id":-1001},"date":%d,"text":"/status"}}`, now),
+	)
+	b := newTestTelegramBot(t, &Config{})
+	b.api.baseURL = srv.URL
+	b.Start()
+	t.Cleanup(b.Stop)
+
+	if req := receiveTelegram(t, reqs); req.params["chat_id"] != 7.0 || req.params["text"] != "You are not allowed to use this bot." {
+		t.Fatalf("first reply %v", req.params)
+	}
+	// The hour old message is skipped.
+	if req := receiveTelegram(t, reqs); req.params["chat_id"] != -1001.0 || !strings.HasPrefix(req.params["text"].(string), "The space is closed.") {
+		t.Fatalf("second reply %v", req.params)
+	}
+}
+
+func TestValidateTelegramConfig(t *testing.T) {
+	ok := TelegramConfig{BotToken: "123:abc", ChatID: -1001}
+	with := func(edit func(*TelegramConfig)) *TelegramConfig {
+		tg := ok
+		edit(&tg)
+		return &tg
+	}
+	for _, tc := range []struct {
+		name     string
+		telegram *TelegramConfig
+		ok       bool
+	}{
+		{"none", nil, true},
+		{"valid", with(func(tg *TelegramConfig) { tg.AllowedUsers, tg.Rules = []int64{42}, []string{"gas*"} }), true},
+		{"token", with(func(tg *TelegramConfig) { tg.BotToken = "" }), false},
+		{"chat", with(func(tg *TelegramConfig) { tg.ChatID = 0 }), false},
+		{"api_url", with(func(tg *TelegramConfig) { tg.APIURL = "api.telegram.org" }), false},
+		{"severity", with(func(tg *TelegramConfig) { tg.Severities = []string{"page"} }), false},
+		{"max_attempts", with(func(tg *TelegramConfig) { tg.MaxAttempts = -1 }), false},
+	} {
+		err := validateTelegramConfig(&Config{Notifications: NotificationsConfig{Telegram: tc.telegram}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by a test webhook.
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+// webhookStub answers with the given statuses in turn, then 200, and passes
+// on each request.
+func webhookStub(t *testing.T, statuses ...int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+	reqs := make(chan webhookRequest, 10)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs <- webhookRequest{header: r.Header, body: string(body)}
+		if n := int(calls.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func setupNotificationTest(t *testing.T, webhooks ...WebhookConfig) *NotificationDispatcher {
+	t.Helper()
+	cfg := &Config{Notifications: NotificationsConfig{Webhooks: webhooks}}
+	if err := validateNotificationsConfig(cfg, "at2.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	d := NewNotificationDispatcher(cfg, testLogger)
+	d.backoff = func(int) time.Duration { return time.Millisecond }
+	d.Start()
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func receive(t *testing.T, reqs <-chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case req := <-reqs:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+		return webhookRequest{}
+	}
+}
+
+func expectNoRequest(t *testing.T, reqs <-chan webhookRequest) {
+	t.Helper()
+	select {
+	case req := <-reqs:
+		t.Fatalf("unexpected webhook request %q", req.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+var testAlert = Alert{Rule: "co2_high", DeviceID: "lab/co2", Severity: "warning", State: alertFiring, Message: `CO2 "high"`, Value: 1300.0}
+
+func TestNotificationDispatcher_DefaultJSON(t *testing.T) {
+	srv, reqs := webhookStub(t)
+	d := setupNotificationTest(t, WebhookConfig{Name: "ntfy", URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer tk"}})
+
+	d.AlertFired(testAlert)
+	req := receive(t, reqs)
+	var got Alert
+	if err := json.Unmarshal([]byte(req.body), &got); err != nil || got.Rule != "co2_high" || got.State != alertFiring || got.Value != 1300.0 {
+		t.Fatalf("body %s (%v)", req.body, err)
+	}
+	if req.header.Get("Content-Type") != "application/json" || req.header.Get("Authorization") != "Bearer tk" {
+		t.Errorf("headers %v", req.header)
+	}
+
+	resolved := testAlert
+	resolved.State = alertResolved
+	d.AlertResolved(resolved)
+	if req := receive(t, reqs); json.Unmarshal([]byte(req.body), &got) != nil || got.State != alertResolved {
+		t.Fatalf("resolved body %s", req.body)
+	}
+}
+
+func TestNotificationDispatcher_Template(t *testing.T) {
+	srv, reqs := webhookStub(t)
+	d := setupNotificationTest(t, WebhookConfig{
+		Name:    "slack",
+		URL:     srv.URL,
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"text": {{json (printf "[%s] %s" .Severity .Message)}}}`,
+	})
+
+	d.AlertFired(testAlert)
+	req := receive(t, reqs)
+	var body struct{ Text string }
+	if err := json.Unmarshal([]byte(req.body), &body); err != nil || body.Text != `[warning] CO2 "high"` {
+		t.Fatalf("body %s (%v)", req.body, err)
+	}
+	if req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type %q", req.header.Get("Content-Type"))
+	}
+}
+
+func TestNotificationDispatcher_RetriesAfterServerError(t *testing.T) {
+	srv, reqs := webhookStub(t, http.StatusInternalServerError, http.StatusBadGateway)
+	d := setupNotificationTest(t, WebhookConfig{Name: "ntfy", URL: srv.URL})
+
+	d.AlertFired(testAlert)
+	first := receive(t, reqs)
+	receive(t, reqs)
+	if last := receive(t, reqs); last.body != first.body {
+		t.Errorf("retried with another body: %q, then %q", first.body, last.body)
+	}
+	expectNoRequest(t, reqs)
+	if n := d.deadLetters.Load(); n != 0 {
+		t.Errorf("%d dead letters", n)
+	}
+}
+
+func TestNotificationDispatcher_DeadLetter(t *testing.T) {
+	failing, failingReqs := webhookStub(t, 500, 500, 500, 500)
+	rejecting, rejectingReqs := webhookStub(t, http.StatusBadRequest)
+	d := setupNotificationTest(t,
+		WebhookConfig{Name: "failing", URL: failing.URL, MaxAttempts: 3},
+		WebhookConfig{Name: "rejecting", URL: rejecting.URL},
+	)
+
+	d.AlertFired(testAlert)
+	for range 3 {
+		receive(t, failingReqs)
+	}
+	expectNoRequest(t, failingReqs)
+	// Client errors aren't retried.
+	receive(t, rejectingReqs)
+	expectNoRequest(t, rejectingReqs)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.deadLetters.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dead letters, want 2", d.deadLetters.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotificationDispatcher_TemplateFailureIsPerNotification(t *testing.T) {
+	strict, strictReqs := webhookStub(t)
+	plain, plainReqs := webhookStub(t)
+	d := setupNotificationTest(t,
+		// Alert has no Room; executing this fails, but only for stale alerts.
+		WebhookConfig{Name: "strict", URL: strict.URL, Body: "{{if .Stale}}{{.Room}}{{else}}{{.Message}}{{end}}"},
+		WebhookConfig{Name: "plain", URL: plain.URL},
+	)
+
+	stale := testAlert
+	stale.Stale = true
+	d.AlertFired(stale)
+	d.AlertFired(testAlert)
+
+	if req := receive(t, strictReqs); req.body != testAlert.Message {
+		t.Fatalf("strict webhook got %q, want the non-stale alert", req.body)
+	}
+	expectNoRequest(t, strictReqs)
+	receive(t, plainReqs)
+	receive(t, plainReqs)
+}
+
+func TestNotificationDispatcher_Routing(t *testing.T) {
+	srv, reqs := webhookStub(t)
+	d := setupNotificationTest(t, WebhookConfig{Name: "oncall", URL: srv.URL, Severities: []string{"critical"}, Rules: []string{"gas*", "door_*"}})
+
+	for _, a := range []Alert{
+		{Rule: "gas", Severity: "warning"},
+		{Rule: "co2_high", Severity: "critical"},
+		{Rule: "gas_kitchen", Severity: "critical"},
+	} {
+		d.AlertFired(a)
+	}
+	var got Alert
+	if req := receive(t, reqs); json.Unmarshal([]byte(req.body), &got) != nil || got.Rule != "gas_kitchen" {
+		t.Fatalf("routed %s", req.body)
+	}
+	expectNoRequest(t, reqs)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 7: time.Minute, 100: time.Minute} {
+		if got := webhookBackoff(attempt); got != want {
+			t.Errorf("attempt %d: %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestValidateNotificationsConfig(t *testing.T) {
+	ok := WebhookConfig{Name: "ntfy", URL: "https://ntfy.sh/hs-alerts"}
+	with := func(edit func(*WebhookConfig)) WebhookConfig {
+		w := ok
+		edit(&w)
+		return w
+	}
+	for _, tc := range []struct {
+		name     string
+		webhooks []WebhookConfig
+		ok       bool
+	}{
+		{"valid", []WebhookConfig{ok, with(func(w *WebhookConfig) {
+			w.Name, w.Body, w.Severities, w.Rules, w.Timeout, w.MaxAttempts = "slack", "{{json .Message}}", []string{"critical"}, []string{"co2_*"}, "5s", 3
+		})}, true},
+		{"no name", []WebhookConfig{with(func(w *WebhookConfig) { w.Name = "" })}, false},
+		{"duplicate", []WebhookConfig{ok, ok}, false},
+		{"no url", []WebhookConfig{with(func(w *WebhookConfig) { w.URL = "" })}, false},
+		{"url scheme", []WebhookConfig{with(func(w *WebhookConfig) { w.URL = "ftp://example.com" })}, false},
+		{"body", []WebhookConfig{with(func(w *WebhookConfig) { w.Body = "{{.Message" })}, false},
+		{"severity", []WebhookConfig{with(func(w *WebhookConfig) { w.Severities = []string{"page"} })}, false},
+		{"rules", []WebhookConfig{with(func(w *WebhookConfig) { w.Rules = []string{"["} })}, false},
+		{"timeout", []WebhookConfig{with(func(w *WebhookConfig) { w.Timeout = "0s" })}, false},
+		{"max_attempts", []WebhookConfig{with(func(w *WebhookConfig) { w.MaxAttempts = -1 })}, false},
+	} {
+		err := validateNotificationsConfig(&Config{Notifications: NotificationsConfig{Webhooks: tc.webhooks}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// The OpenGraph card size recommended by the big link-preview consumers.
+const (
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+)
+
+// ogImagePath is where the card is served, linked from the meta tags of
+// index.html.
+const ogImagePath = "/api/v1/og-image.png"
+
+// ogImageTTL is how often the card is rendered at most; previews are cached
+// by the chat services anyway.
+const ogImageTTL = time.Minute
+
+// ogMaxTemperatures is how many rooms get their temperature on the card.
+const ogMaxTemperatures = 3
+
+// ogImageCache holds the last rendered card.
+var ogImageCache = &spaceAPICache{}
+
+var (
+	ogBackground = color.RGBA{0x1e, 0x1e, 0x2e, 0xff}
+	ogForeground = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+	ogMuted      = color.RGBA{0xa0, 0xa0, 0xb0, 0xff}
+	ogOpen       = color.RGBA{0x44, 0xcc, 0x11, 0xff}
+	ogClosed     = color.RGBA{0xe0, 0x5d, 0x44, 0xff}
+	ogUnknown    = color.RGBA{0x9f, 0x9f, 0x9f, 0xff}
+)
+
+// The card is set in the Go fonts, which come embedded in x/image.
+var ogRegularFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+var ogBoldFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// ogTemperature is a room temperature shown on the card.
+type ogTemperature struct {
+	Room  string
+	Value float64
+}
+
+// ogCard is what the card shows.
+type ogCard struct {
+	Space        string
+	Open         *bool
+	People       int
+	Temperatures []ogTemperature
+}
+
+// buildOGCard collects the card from the same data as SpaceAPI: the open
+// state, the people count and the first temperature of the first rooms that
+// have one.
+func buildOGCard(cfg *Config, deviceMap map[string]*VirtualDevice) ogCard {
+	people, _ := spacePeopleCount(cfg, deviceMap)
+	card := ogCard{
+		Space:  cmp.Or(cfg.SpaceAPI.Space, "at2"),
+		Open:   spaceOpen(cfg, deviceMap),
+		People: int(people),
+	}
+	for _, room := range cfg.Rooms {
+		if len(card.Temperatures) == ogMaxTemperatures {
+			break
+		}
+		for _, entity := range room.Entities {
+			dev, ok := deviceMap[entity.ID]
+			if !ok || dev.Type != VdevTypeTemperature {
+				continue
+			}
+			if val, isValid := toFloat64Internal(dev.State); isValid {
+				card.Temperatures = append(card.Temperatures, ogTemperature{
+					Room:  cmp.Or(room.LocalizedName.Resolve("en"), room.ID),
+					Value: val,
+				})
+				break
+			}
+		}
+	}
+	return card
+}
+
+// ogText draws lines of text in one face and color.
+type ogText struct {
+	dst  draw.Image
+	face font.Face
+	col  color.Color
+}
+
+// draw writes s with its baseline at y, cut with an ellipsis where it
+// would pass maxWidth.
+func (t ogText) draw(x, y, maxWidth int, s string) {
+	d := &font.Drawer{Dst: t.dst, Src: image.NewUniform(t.col), Face: t.face}
+	limit := fixed.I(maxWidth)
+	if d.MeasureString(s) > limit {
+		runes := []rune(s)
+		for len(runes) > 0 && d.MeasureString(string(runes)+"…") > limit {
+			runes = runes[:len(runes)-1]
+		}
+		s = strings.TrimSpace(string(runes)) + "…"
+	}
+	d.Dot = fixed.P(x, y)
+	d.DrawString(s)
+}
+
+func ogFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// renderOGImage draws the card as a PNG: a bar in the color of the open
+// state, the space name, the state, the people count and the temperatures.
+func renderOGImage(card ogCard) ([]byte, error) {
+	regular, err := ogRegularFont()
+	if err != nil {
+		return nil, fmt.Errorf("parsing the regular font: %w", err)
+	}
+	bold, err := ogBoldFont()
+	if err != nil {
+		return nil, fmt.Errorf("parsing the bold font: %w", err)
+	}
+	titleFace, err := ogFace(bold, 64)
+	if err != nil {
+		return nil, err
+	}
+	stateFace, err := ogFace(bold, 96)
+	if err != nil {
+		return nil, err
+	}
+	bodyFace, err := ogFace(regular, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	state, stateColor := "Unknown", ogUnknown
+	if card.Open != nil {
+		state, stateColor = "Closed", ogClosed
+		if *card.Open {
+			state, stateColor = "Open", ogOpen
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, ogImageWidth, ogImageHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(ogBackground), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 24, ogImageHeight), image.NewUniform(stateColor), image.Point{}, draw.Src)
+
+	const left, width = 80, ogImageWidth - 80 - 60
+	ogText{img, titleFace, ogForeground}.draw(left, 140, width, card.Space)
+	ogText{img, stateFace, stateColor}.draw(left, 280, width, state)
+	people := fmt.Sprintf("%d people inside", card.People)
+	if card.People == 1 {
+		people = "1 person inside"
+	}
+	ogText{img, bodyFace, ogForeground}.draw(left, 360, width, people)
+	for i, temp := range card.Temperatures {
+		ogText{img, bodyFace, ogMuted}.draw(left, 440+i*56, width, fmt.Sprintf("%s: %.1f °C", temp.Room, temp.Value))
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleOGImage serves the OpenGraph card, rendered at most once per
+// ogImageTTL.
+func handleOGImage(c *fiber.Ctx) error {
+	body, etag, err := ogImageCache.get(time.Now(), ogImageTTL, func() ([]byte, error) {
+		deviceMap := make(map[string]*VirtualDevice)
+		for _, dev := range vdevManager.Devices() {
+			deviceMap[dev.ID] = dev
+		}
+		return renderOGImage(buildOGCard(GetConfig(), deviceMap))
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Set(fiber.HeaderContentType, "image/png")
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(ogImageTTL.Seconds())))
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.Send(body)
+}
+
+// ogMetaTemplate are the link-preview tags added to index.html.
+var ogMetaTemplate = template.Must(template.New("og").Parse(`<meta property="og:type" content="website">` +
+	`<meta property="og:title" content="{{.Title}}">` +
+	`<meta property="og:description" content="{{.Description}}">` +
+	`<meta property="og:image" content="{{.Image}}">` +
+	`<meta property="og:image:width" content="{{.Width}}">` +
+	`<meta property="og:image:height" content="{{.Height}}">` +
+	`<meta name="twitter:card" content="summary_large_image">`))
+
+// withOGMeta adds the OpenGraph tags before </head> of an HTML page. The
+// image link is absolute when web.public_url is set, as crawlers expect.
+// Pages without a head are returned unchanged.
+func withOGMeta(page []byte, cfg *Config) ([]byte, error) {
+	i := bytes.Index(page, []byte("</head>"))
+	if i < 0 {
+		return page, nil
+	}
+	space := cmp.Or(cfg.SpaceAPI.Space, "at2")
+	var meta bytes.Buffer
+	err := ogMetaTemplate.Execute(&meta, map[string]any{
+		"Title":       space,
+		"Description": fmt.Sprintf("Whether %s is open, who is in and how warm it is", space),
+		"Image":       strings.TrimRight(cfg.Web.PublicURL, "/") + ogImagePath,
+		"Width":       ogImageWidth,
+		"Height":      ogImageHeight,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(page[:i], meta.Bytes(), page[i:]), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func decodeOGImage(t *testing.T, b []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != ogImageWidth || size.Y != ogImageHeight {
+		t.Fatalf("size %v", size)
+	}
+	return img
+}
+
+func TestRenderOGImage(t *testing.T) {
+	open, closed := true, false
+	for _, tc := range []struct {
+		name string
+		card ogCard
+		bar  color.RGBA
+	}{
+		{"open", ogCard{Space: "Hackerspace Kraków", Open: &open, People: 3, Temperatures: []ogTemperature{{"Lab", 21.5}, {"Warsztat", 18}}}, ogOpen},
+		{"closed", ogCard{Space: "Hackerspace Kraków", Open: &closed}, ogClosed},
+		{"unknown", ogCard{Space: strings.Repeat("Very long space name ", 10)}, ogUnknown},
+	} {
+		b, err := renderOGImage(tc.card)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		img := decodeOGImage(t, b)
+		if got := color.RGBAModel.Convert(img.At(5, ogImageHeight/2)); got != tc.bar {
+			t.Errorf("%s: bar %v, want %v", tc.name, got, tc.bar)
+		}
+		// Text was drawn: the text area isn't all background.
+		drawn := 0
+		for y := 60; y < 400; y += 2 {
+			for x := 80; x < ogImageWidth-60; x += 2 {
+				if color.RGBAModel.Convert(img.At(x, y)) != ogBackground {
+					drawn++
+				}
+			}
+		}
+		if drawn == 0 {
+			t.Errorf("%s: nothing drawn", tc.name)
+		}
+		// The long name is cut before the right margin.
+		for y := 60; y < 160; y++ {
+			if color.RGBAModel.Convert(img.At(ogImageWidth-30, y)) != ogBackground {
+				t.Errorf("%s: text in the margin at y=%d", tc.name, y)
+				break
+			}
+		}
+	}
+}
+
+func TestBuildOGCard(t *testing.T) {
+	cfg := &Config{
+		SpaceAPI: SpaceAPIConfig{Space: "hs"},
+		Rooms: []RoomConfig{
+			{ID: "lab", LocalizedName: LocalizedString{"en": "Lab"}, Entities: []EntityConfig{{ID: "lab/people"}, {ID: "lab/temp"}, {ID: "lab/temp2"}}},
+			{ID: "hall", Entities: []EntityConfig{{ID: "hall/temp"}}},
+			{ID: "attic", Entities: []EntityConfig{{ID: "attic/temp"}}},
+			{ID: "cellar", Entities: []EntityConfig{{ID: "cellar/temp"}}},
+			{ID: "roof", Entities: []EntityConfig{{ID: "roof/temp"}}},
+		},
+	}
+	deviceMap := map[string]*VirtualDevice{
+		"lab/people":  {ID: "lab/people", Type: VdevTypePerson, State: 2, Fresh: true},
+		"lab/temp":    {ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5},
+		"lab/temp2":   {ID: "lab/temp2", Type: VdevTypeTemperature, State: 30.0},
+		"hall/temp":   {ID: "hall/temp", Type: VdevTypeTemperature, State: "unavailable"},
+		"attic/temp":  {ID: "attic/temp", Type: VdevTypeTemperature, State: 25.0},
+		"cellar/temp": {ID: "cellar/temp", Type: VdevTypeTemperature, State: 12.0},
+		"roof/temp":   {ID: "roof/temp", Type: VdevTypeTemperature, State: 5.0},
+	}
+	card := buildOGCard(cfg, deviceMap)
+	if card.Space != "hs" || card.Open == nil || !*card.Open || card.People != 2 {
+		t.Fatalf("card %+v", card)
+	}
+	want := []ogTemperature{{"Lab", 21.5}, {"attic", 25}, {"cellar", 12}}
+	if len(card.Temperatures) != len(want) {
+		t.Fatalf("temperatures %+v", card.Temperatures)
+	}
+	for i := range want {
+		if card.Temperatures[i] != want[i] {
+			t.Errorf("temperature %d: %+v, want %+v", i, card.Temperatures[i], want[i])
+		}
+	}
+}
+
+func TestWithOGMeta(t *testing.T) {
+	cfg := &Config{
+		SpaceAPI: SpaceAPIConfig{Space: `Hackerspace "KRK" <&>`},
+		Web:      WebConfig{PublicURL: "https://at.example.com/"},
+	}
+	page, err := withOGMeta([]byte(testIndexHTML), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(page)
+	for _, want := range []string{
+		`<meta property="og:title" content="Hackerspace &#34;KRK&#34; &lt;&amp;&gt;">`,
+		`<meta property="og:image" content="https://at.example.com/api/v1/og-image.png">`,
+		`<meta property="og:image:width" content="1200">`,
+		`<meta name="twitter:card" content="summary_large_image"></head>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %s in\n%s", want, s)
+		}
+	}
+	if strings.Count(s, "<head>") != 1 || !strings.HasSuffix(s, "<body><div id=\"root\"></div></body></html>") {
+		t.Errorf("page mangled:\n%s", s)
+	}
+
+	// No head, nothing to add to.
+	if page, _ := withOGMeta([]byte("<html></html>"), cfg); string(page) != "<html></html>" {
+		t.Errorf("headless page: %s", page)
+	}
+}
+
+func TestHandleOGImage(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	ogImageCache.invalidate()
+	t.Cleanup(ogImageCache.invalidate)
+	app := fiber.New()
+	app.Get(ogImagePath, handleOGImage)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, ogImagePath, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "image/png" || resp.Header.Get(fiber.HeaderCacheControl) != "public, max-age=60" {
+		t.Fatalf("status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	etag := resp.Header.Get(fiber.HeaderETag)
+	first, _ := io.ReadAll(resp.Body)
+	img := decodeOGImage(t, first)
+	if got := color.RGBAModel.Convert(img.At(5, 5)); got != ogClosed {
+		t.Fatalf("bar %v, want closed", got)
+	}
+
+	// Within the minute the cached card is served, even after a change.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 2}})
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, ogImagePath, nil))
+	if b, _ := io.ReadAll(resp.Body); !bytes.Equal(b, first) {
+		t.Fatal("card rendered again within the TTL")
+	}
+	req := httptest.NewRequest(http.MethodGet, ogImagePath, nil)
+	req.Header.Set(fiber.HeaderIfNoneMatch, etag)
+	if resp, _ = app.Test(req); resp.StatusCode != fiber.StatusNotModified {
+		t.Fatalf("revalidation: %d", resp.StatusCode)
+	}
+}
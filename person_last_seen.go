@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// personLastSeenCacheTTL is how long GET /api/v1/person-last-seen serves a
+// computed list; it reads the history of every camera.
+const personLastSeenCacheTTL = 10 * time.Second
+
+// PersonLastSeen is a person detection device served by
+// GET /api/v1/person-last-seen.
+type PersonLastSeen struct {
+	DeviceID string `json:"device_id"`
+	// Camera is the Frigate camera name; empty for other mappers.
+	Camera string `json:"camera,omitempty"`
+	Count  int    `json:"count"`
+	// LastSeenAt is when the camera last saw a person: the latest update
+	// while it sees someone, else when the count last dropped to zero. Nil
+	// when the history has no such drop.
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+// personLastSeenCache holds the last list served by handlePersonLastSeen.
+var personLastSeenCache = &lastSeenCache{}
+
+// lastSeenCache keeps a person last seen list until it expires or is
+// invalidated.
+type lastSeenCache struct {
+	mu         sync.Mutex
+	list       []PersonLastSeen
+	expires    time.Time
+	generation uint64
+}
+
+// get returns the cached list, calling build for a fresh one when it has
+// expired. The result of a build that raced with invalidate is returned but
+// not kept.
+func (c *lastSeenCache) get(now time.Time, build func() ([]PersonLastSeen, error)) ([]PersonLastSeen, error) {
+	c.mu.Lock()
+	if c.list != nil && now.Before(c.expires) {
+		list := c.list
+		c.mu.Unlock()
+		return list, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	list, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.list, c.expires = list, now.Add(personLastSeenCacheTTL)
+	}
+	c.mu.Unlock()
+	return list, nil
+}
+
+// invalidate drops the cached list so the next request rebuilds it.
+func (c *lastSeenCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list, c.expires = nil, time.Time{}
+	c.generation++
+}
+
+// invalidatePersonLastSeenCache is a VdevManager callback dropping the cached
+// list when a person count changes.
+func invalidatePersonLastSeenCache(v *VirtualDevice) {
+	if v != nil && v.Type == VdevTypePerson {
+		personLastSeenCache.invalidate()
+	}
+}
+
+// buildPersonLastSeen lists the person detection devices by ID, looking up
+// when the empty ones last saw someone in the history with one query.
+func buildPersonLastSeen(devices []*VirtualDevice, repo *VirtualDeviceHistoryRepository) ([]PersonLastSeen, error) {
+	list := []PersonLastSeen{}
+	var empty []string
+	for _, dev := range devices {
+		if dev == nil || dev.Type != VdevTypePerson {
+			continue
+		}
+		p := PersonLastSeen{DeviceID: dev.ID}
+		if data, ok := dev.MapperData.(*FrigateMapperData); ok && data != nil {
+			p.Camera = data.CameraName
+		}
+		if count, ok := toFloat64Internal(dev.State); ok {
+			p.Count = int(count)
+		}
+		if p.Count > 0 && !dev.LastUpdatedAt.IsZero() {
+			seen := dev.LastUpdatedAt
+			p.LastSeenAt = &seen
+		} else {
+			empty = append(empty, dev.ID)
+		}
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b PersonLastSeen) int { return cmp.Compare(a.DeviceID, b.DeviceID) })
+
+	if repo == nil || len(empty) == 0 {
+		return list, nil
+	}
+	times, err := repo.GetLatestPersonDetectionTimes(empty)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range list {
+		if ts, ok := times[p.DeviceID]; ok && p.LastSeenAt == nil {
+			seen := time.UnixMilli(ts)
+			list[i].LastSeenAt = &seen
+		}
+	}
+	return list, nil
+}
+
+// handlePersonLastSeen serves every person detection device with its current
+// count and when it last saw a person.
+func handlePersonLastSeen(c *fiber.Ctx) error {
+	list, err := personLastSeenCache.get(time.Now(), func() ([]PersonLastSeen, error) {
+		return buildPersonLastSeen(vdevManager.Devices(), vdevHistoryRepo)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(list)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHandlePersonLastSeen(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	personLastSeenCache.invalidate()
+	t.Cleanup(personLastSeenCache.invalidate)
+	seen := time.UnixMilli(1_700_000_000_000)
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "frigate/person/hall", Type: VdevTypePerson, State: 0, MapperData: &FrigateMapperData{CameraName: "hall"}},
+		{ID: "frigate/person/lab", Type: VdevTypePerson, State: 2, MapperData: &FrigateMapperData{CameraName: "lab"}, LastUpdatedAt: seen},
+		{ID: "frigate/person/yard", Type: VdevTypePerson, State: 0, MapperData: &FrigateMapperData{CameraName: "yard"}},
+		{ID: "hall/temp", Type: VdevTypeTemperature, State: 21.5},
+	})
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	recordStates(t, vdevHistoryRepo, "frigate/person/hall", VdevTypePerson, 1_600_000_000_000, "1", "0")
+	app := fiber.New()
+	app.Get("/api/v1/person-last-seen", handlePersonLastSeen)
+
+	var list []PersonLastSeen
+	getJSON(t, app, "/api/v1/person-last-seen", &list)
+	if len(list) != 3 {
+		t.Fatalf("list %+v", list)
+	}
+	if p := list[0]; p.DeviceID != "frigate/person/hall" || p.Camera != "hall" || p.Count != 0 || p.LastSeenAt == nil || p.LastSeenAt.UnixMilli() != 1_600_000_001_000 {
+		t.Errorf("hall %+v", p)
+	}
+	if p := list[1]; p.DeviceID != "frigate/person/lab" || p.Count != 2 || p.LastSeenAt == nil || !p.LastSeenAt.Equal(seen) {
+		t.Errorf("lab %+v", p)
+	}
+	if p := list[2]; p.DeviceID != "frigate/person/yard" || p.LastSeenAt != nil {
+		t.Errorf("yard %+v", p)
+	}
+
+	// The list is cached, also over other devices changing...
+	recordStates(t, vdevHistoryRepo, "frigate/person/yard", VdevTypePerson, 1_650_000_000_000, "3", "0")
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "frigate/person/lab", State: 0}})
+	invalidatePersonLastSeenCache(vdevManager.Device("hall/temp"))
+	getJSON(t, app, "/api/v1/person-last-seen", &list)
+	if list[2].LastSeenAt != nil {
+		t.Fatalf("not cached: %+v", list[2])
+	}
+	// ...until a person count changes.
+	invalidatePersonLastSeenCache(vdevManager.Device("frigate/person/lab"))
+	getJSON(t, app, "/api/v1/person-last-seen", &list)
+	if p := list[2]; p.LastSeenAt == nil || p.LastSeenAt.UnixMilli() != 1_650_000_001_000 {
+		t.Errorf("yard after invalidation %+v", p)
+	}
+	if p := list[1]; p.Count != 0 {
+		t.Errorf("lab after invalidation %+v", p)
+	}
+}
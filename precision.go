@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync/atomic"
+)
+
+// maxPrecision bounds the decimals a precision may keep.
+const maxPrecision = 6
+
+// defaultPrecision is the number of decimals numeric readings of a type are
+// rounded to, so that jitter below what the sensor can tell apart doesn't
+// count as a change. Types not listed are kept as reported.
+var defaultPrecision = map[VdevType]int{
+	VdevTypeTemperature: 1,
+	VdevTypeThermostat:  1,
+	VdevTypeHumidity:    0,
+	VdevTypePowerUsage:  0,
+	VdevTypeCo:          0,
+	VdevTypeCO2:         0,
+	VdevTypeBattery:     0,
+	VdevTypeCover:       0,
+	VdevTypeNoiseLevel:  1,
+	VdevTypeWaterMeter:  3,
+	VdevTypeGasMeter:    3,
+}
+
+// roundToPrecision rounds v to decimals places, halves away from zero, so
+// -2.25 rounds to -2.3 like 2.25 to 2.3. A result of zero is never -0.
+func roundToPrecision(v float64, decimals int) float64 {
+	p := math.Pow10(decimals)
+	r := math.Round(v*p) / p
+	if r == 0 {
+		return 0
+	}
+	return r
+}
+
+// validatePrecision checks the precision overrides by type and entity.
+func validatePrecision(cfg *Config, cfgPath string) error {
+	for typ, decimals := range cfg.Precision {
+		if !slices.Contains(vdevTypes, VdevType(typ)) {
+			return fmt.Errorf("precision has unknown type %q in %s", typ, cfgPath)
+		}
+		if decimals < -1 || decimals > maxPrecision {
+			return fmt.Errorf("precision.%s must be -1 to %d (got %d) in %s", typ, maxPrecision, decimals, cfgPath)
+		}
+	}
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if p := ent.Precision; p != nil && (*p < -1 || *p > maxPrecision) {
+				return fmt.Errorf("entity %s precision must be -1 to %d (got %d) in %s", ent.ID, maxPrecision, *p, cfgPath)
+			}
+		}
+	}
+	return nil
+}
+
+// precisions are the precisions of a config by type and device ID, with
+// the defaults and overrides resolved.
+type precisions struct {
+	cfg      *Config
+	byType   map[VdevType]int
+	byDevice map[string]int
+}
+
+// precisionsCache holds the precisions of the active config; a reload
+// replaces it on the next update.
+var precisionsCache atomic.Pointer[precisions]
+
+func configPrecisions(cfg *Config) *precisions {
+	if p := precisionsCache.Load(); p != nil && p.cfg == cfg {
+		return p
+	}
+	p := &precisions{cfg: cfg, byType: map[VdevType]int{}, byDevice: map[string]int{}}
+	for typ, decimals := range defaultPrecision {
+		p.byType[typ] = decimals
+	}
+	for typ, decimals := range cfg.Precision {
+		p.byType[VdevType(typ)] = decimals
+	}
+	for _, room := range cfg.Rooms {
+		for _, ent := range room.Entities {
+			if ent.Precision != nil {
+				if _, ok := p.byDevice[ent.ID]; !ok {
+					p.byDevice[ent.ID] = *ent.Precision
+				}
+			}
+		}
+	}
+	precisionsCache.Store(p)
+	return p
+}
+
+// roundUpdates rounds the float states of updates, in place, to the
+// precision of their device: the entity's precision, else the precision of
+// its type in cfg, else defaultPrecision. A precision of -1 keeps the
+// reading as reported. It runs after calibration, so what ApplyUpdates
+// compares, and the history stores, is rounded the same way every time.
+func roundUpdates(cfg *Config, updates []*VirtualDeviceUpdate, typeOf func(id string) VdevType) {
+	if cfg == nil {
+		return
+	}
+	p := configPrecisions(cfg)
+	for _, upd := range updates {
+		if upd == nil {
+			continue
+		}
+		v, ok := upd.State.(float64)
+		if !ok {
+			continue
+		}
+		decimals, ok := p.byDevice[upd.Name]
+		if !ok {
+			decimals, ok = p.byType[typeOf(upd.Name)]
+		}
+		if !ok || decimals < 0 {
+			continue
+		}
+		upd.State = roundToPrecision(v, decimals)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func intPtr(i int) *int { return &i }
+
+func TestRoundToPrecision(t *testing.T) {
+	for _, tc := range []struct {
+		v        float64
+		decimals int
+		want     float64
+	}{
+		{21.799999999, 1, 21.8},
+		{21.84, 1, 21.8},
+		{2.25, 1, 2.3},
+		{-2.25, 1, -2.3},
+		{-7.349, 1, -7.3},
+		{-0.04, 1, 0},
+		{-0.4, 0, 0},
+		{-3.5, 0, -4},
+		{41.5, 0, 42},
+		{1.23456, 3, 1.235},
+	} {
+		got := roundToPrecision(tc.v, tc.decimals)
+		if got != tc.want {
+			t.Errorf("roundToPrecision(%v, %d) = %v, want %v", tc.v, tc.decimals, got, tc.want)
+		}
+	}
+	if got := roundToPrecision(-0.04, 1); 1/got < 0 {
+		t.Errorf("-0.04 rounded to negative zero")
+	}
+}
+
+func TestRoundUpdates_SuppressesJitter(t *testing.T) {
+	cfg := &Config{
+		Precision: map[string]int{"power_usage": 1},
+		Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{
+			{ID: "lab/raw", Precision: intPtr(-1)},
+			{ID: "lab/outside", Precision: intPtr(0)},
+		}}},
+	}
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "lab/temp", Type: VdevTypeTemperature},
+		{ID: "lab/humidity", Type: VdevTypeHumidity},
+		{ID: "lab/power", Type: VdevTypePowerUsage},
+		{ID: "lab/raw", Type: VdevTypeTemperature},
+		{ID: "lab/outside", Type: VdevTypeTemperature},
+	})
+	typeOf := (&MQTTAdapter{vdevMgr: vm}).deviceType
+
+	var changes int
+	for _, reading := range []float64{21.8, 21.799999999, 21.80000001, 21.83, 21.77} {
+		updates := []*VirtualDeviceUpdate{
+			{Name: "lab/temp", State: reading},
+			{Name: "lab/humidity", State: reading * 2},
+		}
+		roundUpdates(cfg, updates, typeOf)
+		changes += len(vm.ApplyUpdates(updates))
+	}
+	// Only the first readings, 21.8 °C and 44%, are changes.
+	if changes != 2 {
+		t.Errorf("%d changes from jittery readings, want 2", changes)
+	}
+	if s := vm.Device("lab/temp").State; s != 21.8 {
+		t.Errorf("temperature = %v, want 21.8", s)
+	}
+
+	updates := []*VirtualDeviceUpdate{
+		{Name: "lab/power", State: 1234.56},
+		{Name: "lab/raw", State: 21.799999999},
+		{Name: "lab/outside", State: -3.5},
+		{Name: "lab/temp", State: 3},
+		{Name: "lab/unknown", State: 1.23456},
+	}
+	roundUpdates(cfg, updates, typeOf)
+	for i, want := range []any{1234.6, 21.799999999, -4.0, 3, 1.23456} {
+		if got := updates[i].State; got != want {
+			t.Errorf("%s = %v (%T), want %v", updates[i].Name, got, got, want)
+		}
+	}
+}
+
+func TestMQTTAdapter_RoundsAfterCalibration(t *testing.T) {
+	setupLiveWsTest(t)
+	setConfig(calibrationConfig(EntityConfig{ID: "lab/air/temperature", Calibration: &CalibrationConfig{Offset: -0.33}}))
+	vm := NewVdevManager()
+	adapter := &MQTTAdapter{log: testLogger, vdevMgr: vm}
+	mapper := NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)
+	adapter.handleMapperMessage(mapper, "zigbee2mqtt/bridge/devices", []byte(z2mSCD41Devices))
+
+	adapter.handleMapperMessage(mapper, "zigbee2mqtt/lab/air", []byte(`{"co2": 812.4, "temperature": 22.08, "humidity": 40.6}`))
+	for id, want := range map[string]any{"lab/air/temperature": 21.8, "lab/air/co2": 812.0, "lab/air/humidity": 41.0} {
+		if got := vm.Device(id).State; got != want {
+			t.Errorf("%s = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestValidatePrecision(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg  *Config
+		want string
+	}{
+		"ok":           {&Config{Precision: map[string]int{"temperature": 2, "humidity": -1}}, ""},
+		"unknown type": {&Config{Precision: map[string]int{"pressure": 1}}, `precision has unknown type "pressure"`},
+		"type range":   {&Config{Precision: map[string]int{"temperature": 7}}, "precision.temperature must be -1 to 6"},
+		"entity range": {calibrationConfig(EntityConfig{ID: "lab/temp", Precision: intPtr(-2)}), "entity lab/temp precision must be -1 to 6"},
+	} {
+		err := validatePrecision(tc.cfg, "at2.yaml")
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}
@@ -1,61 +1,271 @@
 package main
 
 import (
+	"fmt"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	deviceLastUpdateDesc = prometheus.NewDesc(
+		"at2_device_last_update_timestamp_seconds",
+		"Unix time the device last reported (for restored states, when the state was recorded; 0 if never)",
+		[]string{"id", "room"},
+		nil,
+	)
+	deviceFreshDesc = prometheus.NewDesc(
+		"at2_device_fresh",
+		"Whether the device reported since startup (1) or only has a restored state (0)",
+		[]string{"id", "room"},
+		nil,
+	)
+	deviceInfoDesc = prometheus.NewDesc(
+		"at2_device_info",
+		"Device metadata for joining on id; always 1",
+		[]string{"id", "type", "room", "name"},
+		nil,
+	)
+	roomPeopleDesc = prometheus.NewDesc(
+		"at2_room_people",
+		"People in the room, the highest count of its person sensors",
+		[]string{"room"},
+		nil,
+	)
+	roomOccupiedDesc = prometheus.NewDesc(
+		"at2_room_occupied",
+		"Whether any person sensor in the room counts someone (0/1)",
+		[]string{"room"},
+		nil,
+	)
+)
+
 // PrometheusCollector collects metrics from VirtualDevices
 type PrometheusCollector struct {
 	vdevManager *VdevManager
-	config      *Config
+
+	// mu guards the config and the lookups built from it, which a reload
+	// replaces while a scrape may be running.
+	mu     sync.RWMutex
+	config *Config
 
 	// Cache room lookup
 	deviceRoomMap map[string]string // deviceID -> roomID
+	deviceNameMap map[string]string // deviceID -> normalized entity name
+
+	excludeTypes map[VdevType]struct{}
+
+	// Descriptors of the per-type value metrics, created once
+	valueDescs map[VdevType]*prometheus.Desc
 }
 
 func NewPrometheusCollector(vm *VdevManager, cfg *Config) *PrometheusCollector {
 	pc := &PrometheusCollector{
-		vdevManager:   vm,
-		config:        cfg,
-		deviceRoomMap: make(map[string]string),
+		vdevManager: vm,
+		valueDescs:  make(map[VdevType]*prometheus.Desc, len(vdevTypes)),
+	}
+	for _, t := range vdevTypes {
+		pc.valueDescs[t] = deviceValueDesc(t)
+	}
+	pc.loadConfig(cfg)
+	return pc
+}
+
+// deviceValueDesc describes the value metric of a device type. The metric is
+// named after the type, with the base unit encoded as a suffix following
+// Prometheus naming conventions (e.g. _celsius, _watts).
+func deviceValueDesc(t VdevType) *prometheus.Desc {
+	metricName := "at2_" + string(t)
+	help := "Virtual device metric for " + string(t)
+	unit := ""
+	switch t {
+	case VdevTypeRelay:
+		help = "Relay state (0=off, 1=on)"
+	case VdevTypeContact:
+		help = "Contact sensor state (0=open, 1=closed)"
+	case VdevTypeTemperature:
+		unit = "celsius"
+		help = "Temperature in Celsius"
+	case VdevTypeHumidity:
+		unit = "percent"
+		help = "Humidity in %"
+	case VdevTypeCo:
+		unit = "ppm"
+		help = "Carbon Monoxide level in ppm"
+	case VdevTypeCO2:
+		unit = "ppm"
+		help = "Carbon dioxide level in ppm"
+	case VdevTypeGas:
+		unit = "lel"
+		help = "Gas level in LEL"
+	case VdevTypePowerUsage:
+		unit = "watts"
+		help = "Power usage in Watts"
+	case VdevTypeCover:
+		unit = "percent"
+		help = "Cover position in % (0=closed)"
+	case VdevTypeThermostat:
+		unit = "celsius"
+		help = "Thermostat setpoint in Celsius"
+	case VdevTypeBattery:
+		unit = "percent"
+		help = "Battery level in %"
+	case VdevTypeNoiseLevel:
+		unit = "decibels"
+		help = "Sound pressure level in dB"
+	case VdevTypeWaterMeter:
+		unit = "cubic_meters"
+		help = "Water used in m³, as counted by the meter"
+	case VdevTypeGasMeter:
+		unit = "cubic_meters"
+		help = "Gas used in m³, as counted by the meter"
+	case VdevTypeWindSpeed:
+		unit = "meters_per_second"
+		help = "Wind speed in m/s"
+	case VdevTypeSunElevation:
+		unit = "degrees"
+		help = "Elevation of the sun in degrees"
+	case VdevTypeDaylight:
+		help = "Daylight by sun.day_above (0=night, 1=day)"
+	}
+	if unit != "" {
+		metricName += "_" + unit
+	}
+	if deviceValueType(t) == prometheus.CounterValue {
+		metricName += "_total"
+	}
+	return prometheus.NewDesc(metricName, help, []string{"id", "room"}, nil)
+}
+
+// deviceValueType is the metric type of the value of a device type: meters
+// are counters, everything else gauges.
+func deviceValueType(t VdevType) prometheus.ValueType {
+	if isMeter(t) {
+		return prometheus.CounterValue
+	}
+	return prometheus.GaugeValue
+}
+
+// loadConfig builds the device -> room and device -> name lookups from the
+// room config. A config reload has to call it again.
+func (pc *PrometheusCollector) loadConfig(cfg *Config) {
+	deviceRoomMap := make(map[string]string)
+	deviceNameMap := make(map[string]string)
+	excludeTypes := make(map[VdevType]struct{})
+	for _, t := range cfg.Prometheus.ExcludeTypes {
+		excludeTypes[VdevType(t)] = struct{}{}
 	}
 
-	// Pre-build device -> room map
 	for _, room := range cfg.Rooms {
-		roomLabel := room.ID
-		if name, ok := room.LocalizedName["pl"]; ok && name != "" {
-			roomLabel = NormalizeName(name)
-		} else if name, ok := room.LocalizedName["en"]; ok && name != "" {
-			roomLabel = NormalizeName(name)
+		roomLabel := metricLabelName(room.LocalizedName, "")
+		if roomLabel == "" {
+			roomLabel = room.ID
 		}
 
 		for _, devConf := range room.Entities {
-			pc.deviceRoomMap[devConf.ID] = roomLabel
+			deviceRoomMap[devConf.ID] = roomLabel
+			if name := metricLabelName(devConf.LocalizedName, cfg.Prometheus.NameLanguage); name != "" {
+				deviceNameMap[devConf.ID] = name
+			}
 		}
 	}
 
-	return pc
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.config = cfg
+	pc.deviceRoomMap = deviceRoomMap
+	pc.deviceNameMap = deviceNameMap
+	pc.excludeTypes = excludeTypes
+}
+
+// excluded reports whether prometheus.exclude_types or exclude_devices drop
+// the device from all metrics. Callers hold pc.mu.
+func (pc *PrometheusCollector) excluded(dev *VirtualDevice) bool {
+	if _, ok := pc.excludeTypes[dev.Type]; ok {
+		return true
+	}
+	for _, pattern := range pc.config.Prometheus.ExcludeDevices {
+		if ok, _ := path.Match(pattern, dev.ID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// metricLabelName returns the name in the given language (see
+// LocalizedString.Resolve), normalized for use as a label value. Empty when
+// none is set.
+func metricLabelName(names LocalizedString, lang string) string {
+	if name := names.Resolve(lang); name != "" {
+		return NormalizeName(name)
+	}
+	return ""
 }
 
-// Describe sends the super-set of all possible descriptors of metrics
+// Describe sends the descriptors of every metric the collector can emit, so
+// the registry can check them for consistency.
 func (pc *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
-	// Since metrics are dynamic based on devices, we can't easily describe them all upfront 
-	// without iterating devices again, but Describe is mostly for checking consistency.
-	// We can leave this unchecked or implement if strictly needed, 
-	// but unchecked collectors are common for dynamic metrics.
+	for _, t := range vdevTypes {
+		ch <- pc.valueDescs[t]
+	}
+	ch <- deviceInfoDesc
+	ch <- deviceLastUpdateDesc
+	ch <- deviceFreshDesc
+	ch <- roomPeopleDesc
+	ch <- roomOccupiedDesc
+	ch <- liveMessagesSentDesc
+}
+
+// metricPrefixPattern matches prefixes that keep metric names valid.
+var metricPrefixPattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// validatePrometheusConfig fails fast on exclusion globs and metric prefixes
+// that can't be used.
+func validatePrometheusConfig(cfg *Config, cfgPath string) error {
+	pc := cfg.Prometheus
+	for i, pattern := range pc.ExcludeDevices {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("prometheus.exclude_devices[%d] has invalid pattern %q in %s: %v", i, pattern, cfgPath, err)
+		}
+	}
+	if pc.MetricPrefix != "" && !metricPrefixPattern.MatchString(pc.MetricPrefix) {
+		return fmt.Errorf("prometheus.metric_prefix %q is not a valid metric name prefix in %s", pc.MetricPrefix, cfgPath)
+	}
+	return nil
 }
 
 // Collect is called by the Prometheus registry when collecting metrics.
 func (pc *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
 	devices := pc.vdevManager.Devices()
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	// Like buildRoomState, rooms count the maximum any of their cameras sees.
+	roomPeople := make(map[string]float64)
 
 	for _, dev := range devices {
-		if dev == nil {
+		if dev == nil || pc.excluded(dev) {
 			continue
 		}
+		roomID := pc.deviceRoomMap[dev.ID]
+
+		// Exported for every device, so alerts can fire on sensors that stop
+		// reporting whatever their state looks like.
+		lastUpdate := 0.0
+		if !dev.LastUpdatedAt.IsZero() {
+			lastUpdate = float64(dev.LastUpdatedAt.UnixMilli()) / 1000
+		}
+		fresh := 0.0
+		if dev.Fresh {
+			fresh = 1
+		}
+		ch <- prometheus.MustNewConstMetric(deviceLastUpdateDesc, prometheus.GaugeValue, lastUpdate, dev.ID, roomID)
+		ch <- prometheus.MustNewConstMetric(deviceFreshDesc, prometheus.GaugeValue, fresh, dev.ID, roomID)
+		ch <- prometheus.MustNewConstMetric(deviceInfoDesc, prometheus.GaugeValue, 1,
+			dev.ID, string(dev.Type), roomID, pc.deviceNameMap[dev.ID])
 
 		val := 0.0
 		isValid := false
@@ -100,52 +310,34 @@ func (pc *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
 			continue
 		}
 
-
-		roomID := pc.deviceRoomMap[dev.ID]
-
-		// Metric name based on type, with the base unit encoded as a suffix
-		// following Prometheus naming conventions (e.g. _celsius, _watts).
-		metricName := "at2_" + string(dev.Type)
-		help := "Virtual device metric for " + string(dev.Type)
-		unit := ""
-		switch dev.Type {
-		case VdevTypeRelay:
-			help = "Relay state (0=off, 1=on)"
-		case VdevTypeContact:
-			help = "Contact sensor state (0=open, 1=closed)"
-		case VdevTypeTemperature:
-			unit = "celsius"
-			help = "Temperature in Celsius"
-		case VdevTypeHumidity:
-			unit = "percent"
-			help = "Humidity in %"
-		case VdevTypeCo:
-			unit = "ppm"
-			help = "Carbon Monoxide level in ppm"
-		case VdevTypeGas:
-			unit = "lel"
-			help = "Gas level in LEL"
-		case VdevTypePowerUsage:
-			unit = "watts"
-			help = "Power usage in Watts"
-		}
-		if unit != "" {
-			metricName += "_" + unit
+		if dev.Type == VdevTypePerson && roomID != "" {
+			if people, seen := roomPeople[roomID]; !seen || val > people {
+				roomPeople[roomID] = val
+			}
 		}
 
-		desc := prometheus.NewDesc(
-			metricName,
-			help,
-			[]string{"id", "room"},
-			nil,
-		)
-
+		// A type missing from vdevTypes has no described metric.
+		desc, ok := pc.valueDescs[dev.Type]
+		if !ok {
+			continue
+		}
 		ch <- prometheus.MustNewConstMetric(
 			desc,
-			prometheus.GaugeValue,
+			deviceValueType(dev.Type),
 			val,
 			dev.ID,
 			roomID,
 		)
 	}
+
+	for room, people := range roomPeople {
+		occupied := 0.0
+		if people > 0 {
+			occupied = 1
+		}
+		ch <- prometheus.MustNewConstMetric(roomPeopleDesc, prometheus.GaugeValue, people, room)
+		ch <- prometheus.MustNewConstMetric(roomOccupiedDesc, prometheus.GaugeValue, occupied, room)
+	}
+
+	collectLiveMetrics(ch)
 }
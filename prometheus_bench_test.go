@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BenchmarkPrometheusCollector_Collect scrapes a few hundred devices spread
+// over rooms, roughly the size of a real deployment.
+func BenchmarkPrometheusCollector_Collect(b *testing.B) {
+	vm := NewVdevManager()
+	cfg := &Config{}
+	types := []VdevType{VdevTypeTemperature, VdevTypeHumidity, VdevTypeRelay, VdevTypePerson, VdevTypePowerUsage}
+	for r := 0; r < 20; r++ {
+		room := RoomConfig{ID: fmt.Sprintf("room%d", r)}
+		for d := 0; d < 20; d++ {
+			id := fmt.Sprintf("room%d/dev%d", r, d)
+			vm.AddDevices([]*VirtualDevice{{ID: id, Type: types[d%len(types)], State: float64(d)}})
+			room.Entities = append(room.Entities, EntityConfig{ID: id})
+		}
+		cfg.Rooms = append(cfg.Rooms, room)
+	}
+	collector := NewPrometheusCollector(vm, cfg)
+
+	ch := make(chan prometheus.Metric, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		collector.Collect(ch)
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+}
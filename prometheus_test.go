@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusCollector_ExportsCO2(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/air/co2", Type: VdevTypeCO2, State: 812.0}})
+	cfg := &Config{Rooms: []RoomConfig{{
+		ID:            "lab",
+		LocalizedName: LocalizedString{"en": "Lab"},
+		Entities:      []EntityConfig{{ID: "lab/air/co2"}},
+	}}}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewPrometheusCollector(vm, cfg))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "at2_co2_ppm" {
+			continue
+		}
+		m := mf.GetMetric()[0]
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if m.GetGauge().GetValue() != 812 || labels["id"] != "lab/air/co2" || labels["room"] != NormalizeName("Lab") {
+			t.Fatalf("unexpected metric %v", m)
+		}
+		return
+	}
+	t.Fatal("no at2_co2_ppm metric")
+}
+
+// compareCollector compares the named metrics of the collector with the
+// expected text exposition.
+func compareCollector(t *testing.T, c prometheus.Collector, expected string, metricNames ...string) {
+	t.Helper()
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), metricNames...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restoredStateProvider restores every device to the same state and time.
+type restoredStateProvider struct {
+	state      any
+	recordedAt time.Time
+}
+
+func (p restoredStateProvider) GetLatestDeviceState(string) (any, time.Time, error) {
+	return p.state, p.recordedAt, nil
+}
+
+func TestPrometheusCollector_DeviceFreshness(t *testing.T) {
+	vm := NewVdevManager()
+	vm.SetStateProvider(restoredStateProvider{state: "idle", recordedAt: time.Unix(1_700_000_000, 0)})
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "lab/temp", Type: VdevTypeTemperature},
+		{ID: "lab/printer", Type: VdevTypePrinter},
+	})
+	vm.SetStateProvider(nil)
+	vm.AddDevices([]*VirtualDevice{{ID: "lab/new", Type: VdevTypeRelay}})
+	cfg := &Config{Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{{ID: "lab/temp"}}}}}
+
+	// Reporting the restored state again still counts as an update.
+	before := time.Now()
+	vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/printer", State: "idle"}})
+	if dev := vm.Device("lab/printer"); !dev.Fresh || dev.LastUpdatedAt.Before(before) {
+		t.Fatalf("printer after update: %+v", dev)
+	}
+
+	// Pin the live update's time so the expected output is stable.
+	vm.mu.Lock()
+	for _, dev := range vm.devices {
+		if dev.ID == "lab/printer" {
+			dev.LastUpdatedAt = time.Unix(1_700_000_600, 0)
+		}
+	}
+	vm.mu.Unlock()
+
+	expected := `
+# HELP at2_device_fresh Whether the device reported since startup (1) or only has a restored state (0)
+# TYPE at2_device_fresh gauge
+at2_device_fresh{id="lab/new",room=""} 0
+at2_device_fresh{id="lab/printer",room=""} 1
+at2_device_fresh{id="lab/temp",room="lab"} 0
+# HELP at2_device_last_update_timestamp_seconds Unix time the device last reported (for restored states, when the state was recorded; 0 if never)
+# TYPE at2_device_last_update_timestamp_seconds gauge
+at2_device_last_update_timestamp_seconds{id="lab/new",room=""} 0
+at2_device_last_update_timestamp_seconds{id="lab/printer",room=""} 1.7000006e+09
+at2_device_last_update_timestamp_seconds{id="lab/temp",room="lab"} 1.7e+09
+`
+	compareCollector(t, NewPrometheusCollector(vm, cfg), expected, "at2_device_fresh", "at2_device_last_update_timestamp_seconds")
+}
+
+func TestPrometheusCollector_RoomOccupancy(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "frigate/lab_door/person", Type: VdevTypePerson, State: 1},
+		{ID: "frigate/lab_bench/person", Type: VdevTypePerson, State: 3},
+		{ID: "frigate/hall/person", Type: VdevTypePerson, State: 0},
+	})
+	cfg := &Config{Rooms: []RoomConfig{
+		{ID: "lab", Entities: []EntityConfig{{ID: "frigate/lab_door/person"}, {ID: "frigate/lab_bench/person"}}},
+		{ID: "hall", Entities: []EntityConfig{{ID: "frigate/hall/person"}}},
+	}}
+
+	expected := `
+# HELP at2_room_occupied Whether any person sensor in the room counts someone (0/1)
+# TYPE at2_room_occupied gauge
+at2_room_occupied{room="hall"} 0
+at2_room_occupied{room="lab"} 1
+# HELP at2_room_people People in the room, the highest count of its person sensors
+# TYPE at2_room_people gauge
+at2_room_people{room="hall"} 0
+at2_room_people{room="lab"} 3
+`
+	compareCollector(t, NewPrometheusCollector(vm, cfg), expected, "at2_room_people", "at2_room_occupied")
+}
+
+func TestPrometheusCollector_DeviceInfo(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "lab/light", Type: VdevTypeRelay, State: true},
+		{ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5},
+		{ID: "unassigned", Type: VdevTypeContact, State: false},
+	})
+	cfg := &Config{
+		Prometheus: PrometheusConfig{NameLanguage: "de"},
+		Rooms: []RoomConfig{{
+			ID:            "lab",
+			LocalizedName: LocalizedString{"en": "Lab", "pl": "Pracownia"},
+			Entities: []EntityConfig{
+				{ID: "lab/light", LocalizedName: LocalizedString{"en": "Main Light", "de": "Hauptlicht"}},
+				{ID: "lab/temp", LocalizedName: LocalizedString{"en": "Bench", "pl": "Stół łączeniowy"}},
+			},
+		}},
+	}
+
+	expected := `
+# HELP at2_device_info Device metadata for joining on id; always 1
+# TYPE at2_device_info gauge
+at2_device_info{id="lab/light",name="hauptlicht",room="pracownia",type="relay"} 1
+at2_device_info{id="lab/temp",name="stol_laczeniowy",room="pracownia",type="temperature"} 1
+at2_device_info{id="unassigned",name="",room="",type="contact"} 1
+`
+	collector := NewPrometheusCollector(vm, cfg)
+	compareCollector(t, collector, expected, "at2_device_info")
+
+	// A reloaded config changes the names.
+	cfg.Prometheus.NameLanguage = "en"
+	collector.loadConfig(cfg)
+	expected = strings.NewReplacer("hauptlicht", "main_light", "stol_laczeniowy", "bench").Replace(expected)
+	compareCollector(t, collector, expected, "at2_device_info")
+}
+
+func TestPrometheusCollector_Exclusions(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5},
+		{ID: "lab/gas", Type: VdevTypeGas, State: 3.0},
+		{ID: "frigate/lab/snapshot_person", Type: VdevTypePerson, State: 4},
+		{ID: "frigate/lab/person", Type: VdevTypePerson, State: 1},
+	})
+	cfg := &Config{
+		Prometheus: PrometheusConfig{
+			ExcludeTypes:   []string{string(VdevTypeGas)},
+			ExcludeDevices: []string{"frigate/*/snapshot_*"},
+		},
+		Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{
+			{ID: "lab/temp"}, {ID: "lab/gas"}, {ID: "frigate/lab/snapshot_person"}, {ID: "frigate/lab/person"},
+		}}},
+	}
+
+	// Excluded devices don't count towards the room either.
+	expected := `
+# HELP at2_device_info Device metadata for joining on id; always 1
+# TYPE at2_device_info gauge
+at2_device_info{id="frigate/lab/person",name="",room="lab",type="person"} 1
+at2_device_info{id="lab/temp",name="",room="lab",type="temperature"} 1
+# HELP at2_room_people People in the room, the highest count of its person sensors
+# TYPE at2_room_people gauge
+at2_room_people{room="lab"} 1
+`
+	compareCollector(t, NewPrometheusCollector(vm, cfg), expected, "at2_device_info", "at2_room_people", "at2_gas_lel")
+}
+
+func TestPrometheusCollector_Lint(t *testing.T) {
+	vm := NewVdevManager()
+	for _, vt := range vdevTypes {
+		vm.AddDevices([]*VirtualDevice{{ID: "lab/" + string(vt), Type: vt, State: 1.0}})
+	}
+	cfg := &Config{Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{{ID: "lab/person"}}}}}
+
+	problems, err := testutil.CollectAndLint(NewPrometheusCollector(vm, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("%s: %s", p.Metric, p.Text)
+	}
+}
+
+func TestPrometheusCollector_ExportsNoiseLevel(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "esphome/workshop-noise/sensor/sound_level", Type: VdevTypeNoiseLevel, State: 72.4}})
+	cfg := &Config{Rooms: []RoomConfig{{ID: "workshop", Entities: []EntityConfig{{ID: "esphome/workshop-noise/sensor/sound_level"}}}}}
+	compareCollector(t, NewPrometheusCollector(vm, cfg), `
+# HELP at2_noise_level_decibels Sound pressure level in dB
+# TYPE at2_noise_level_decibels gauge
+at2_noise_level_decibels{id="esphome/workshop-noise/sensor/sound_level",room="workshop"} 72.4
+`, "at2_noise_level_decibels")
+}
+
+func TestPrometheusCollector_ExportsMetersAsCounters(t *testing.T) {
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{
+		{ID: "utility/water", Type: VdevTypeWaterMeter, State: 123.456},
+		{ID: "utility/gas", Type: VdevTypeGasMeter, State: 42.0},
+	})
+	cfg := &Config{Rooms: []RoomConfig{{ID: "utility", Entities: []EntityConfig{{ID: "utility/water"}, {ID: "utility/gas"}}}}}
+	compareCollector(t, NewPrometheusCollector(vm, cfg), `
+# HELP at2_gas_meter_cubic_meters_total Gas used in m³, as counted by the meter
+# TYPE at2_gas_meter_cubic_meters_total counter
+at2_gas_meter_cubic_meters_total{id="utility/gas",room="utility"} 42
+# HELP at2_water_meter_cubic_meters_total Water used in m³, as counted by the meter
+# TYPE at2_water_meter_cubic_meters_total counter
+at2_water_meter_cubic_meters_total{id="utility/water",room="utility"} 123.456
+`, "at2_water_meter_cubic_meters_total", "at2_gas_meter_cubic_meters_total")
+}
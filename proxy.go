@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseTrustedProxies parses web.trusted_proxies, IPs and CIDRs.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// validateTrustedProxies rejects entries Fiber would silently ignore.
+func validateTrustedProxies(cfg *Config, cfgPath string) error {
+	if _, err := parseTrustedProxies(cfg.Web.TrustedProxies); err != nil {
+		return fmt.Errorf("web.trusted_proxies: %v in %s", err, cfgPath)
+	}
+	return nil
+}
+
+// fiberAppConfig returns the Fiber config for the server. The trusted proxy
+// check is always on, so with no trusted proxies Fiber ignores forwarding
+// headers (X-Forwarded-Host in Hostname, X-Forwarded-Proto in Protocol)
+// instead of believing anyone. Client IPs come from clientIP rather than
+// Fiber's ProxyHeader, which returns the whole X-Forwarded-For header.
+func fiberAppConfig(cfg *Config) fiber.Config {
+	return fiber.Config{
+		ErrorHandler:            errorHandler,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          cfg.Web.TrustedProxies,
+	}
+}
+
+// isTrustedProxy reports whether addr is one of web.trusted_proxies.
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTrustedProxies returns the configured trusted proxies and whether the
+// request's peer is one of them. Peers on web.listen_unix_socket are always
+// trusted: only local processes the socket mode lets in can connect, and
+// they have no IP to check.
+func peerTrustedProxies(c *fiber.Ctx) ([]netip.Prefix, bool) {
+	trusted, err := parseTrustedProxies(GetConfig().Web.TrustedProxies)
+	if _, ok := c.Context().RemoteAddr().(*net.UnixAddr); ok {
+		return trusted, err == nil
+	}
+	if err != nil || len(trusted) == 0 {
+		return nil, false
+	}
+	peer, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	return trusted, ok && isTrustedProxy(peer, trusted)
+}
+
+// clientIP returns the IP of the client. Requests from a trusted proxy are
+// attributed to the rightmost X-Forwarded-For entry that isn't a trusted
+// proxy itself: entries left of it were sent by the client and can be
+// anything.
+func clientIP(c *fiber.Ctx) string {
+	peer := c.Context().RemoteIP().String()
+	trusted, ok := peerTrustedProxies(c)
+	if !ok {
+		return peer
+	}
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A garbled entry ends the part of the chain that can be trusted.
+			break
+		}
+		if !isTrustedProxy(addr, trusted) || i == 0 {
+			return addr.Unmap().String()
+		}
+	}
+	return peer
+}
+
+// requestScheme returns "https" when the client reached the server over
+// https: directly, or through a trusted proxy saying so in X-Forwarded-Proto.
+func requestScheme(c *fiber.Ctx) string {
+	if c.Context().IsTLS() {
+		return "https"
+	}
+	if _, ok := peerTrustedProxies(c); ok {
+		proto, _, _ := strings.Cut(c.Get(fiber.HeaderXForwardedProto), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// requestBaseURL returns web.public_url, or when it isn't set the URL the
+// client used to reach the server, for building redirect URLs.
+func requestBaseURL(c *fiber.Ctx) string {
+	if publicURL := GetConfig().Web.PublicURL; publicURL != "" {
+		return strings.TrimRight(publicURL, "/")
+	}
+	return requestScheme(c) + "://" + requestHost(c)
+}
+
+// requestHost returns the host the client asked for: X-Forwarded-Host from a
+// trusted proxy, otherwise the Host header. Unlike c.Hostname it also trusts
+// peers on the unix socket.
+func requestHost(c *fiber.Ctx) string {
+	if _, ok := peerTrustedProxies(c); ok {
+		if fwd, _, _ := strings.Cut(c.Get(fiber.HeaderXForwardedHost), ","); strings.TrimSpace(fwd) != "" {
+			return strings.TrimSpace(fwd)
+		}
+	}
+	return string(c.Request().Host())
+}
+
+// secureForRequest marks cookie Secure when the request came over https,
+// even if web.public_url doesn't say so.
+func secureForRequest(c *fiber.Ctx, cookie *fiber.Cookie) *fiber.Cookie {
+	if requestScheme(c) == "https" {
+		cookie.Secure = true
+	}
+	return cookie
+}
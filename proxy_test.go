@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// app.Test requests come from 0.0.0.0.
+const (
+	testPeerTrusted   = "0.0.0.0/32"
+	testPeerUntrusted = "10.0.0.1"
+)
+
+func setTrustedProxies(t *testing.T, proxies ...string) *Config {
+	t.Helper()
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	var cfg Config
+	if prev != nil {
+		cfg = *prev
+	}
+	cfg.Web.TrustedProxies = proxies
+	setConfig(&cfg)
+	return &cfg
+}
+
+func proxyEcho(t *testing.T, cfg *Config, header http.Header, echo func(c *fiber.Ctx) string) string {
+	t.Helper()
+	app := fiber.New(fiberAppConfig(cfg))
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString(echo(c)) })
+	req := httptest.NewRequest(http.MethodGet, "http://at2.local/", nil)
+	req.Header = header
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		proxies []string
+		xff     string
+		want    string
+	}{
+		{"no proxies", nil, "203.0.113.7", "0.0.0.0"},
+		{"untrusted peer", []string{testPeerUntrusted}, "203.0.113.7", "0.0.0.0"},
+		{"trusted peer", []string{testPeerTrusted}, "203.0.113.7", "203.0.113.7"},
+		{"spoofed entry left of the client", []string{testPeerTrusted}, "127.0.0.1, 203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", []string{testPeerTrusted, "10.0.0.0/8"}, "192.0.2.1, 203.0.113.7, 10.1.2.3", "203.0.113.7"},
+		{"only trusted proxies", []string{testPeerTrusted, "10.0.0.0/8"}, "10.1.2.3", "10.1.2.3"},
+		{"garbled entry", []string{testPeerTrusted}, "203.0.113.7, bogus", "0.0.0.0"},
+		{"no header", []string{testPeerTrusted}, "", "0.0.0.0"},
+	} {
+		cfg := setTrustedProxies(t, tc.proxies...)
+		header := http.Header{}
+		if tc.xff != "" {
+			header.Set(fiber.HeaderXForwardedFor, tc.xff)
+		}
+		if got := proxyEcho(t, cfg, header, clientIP); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRequestScheme_OnlyFromTrustedProxies(t *testing.T) {
+	header := http.Header{
+		fiber.HeaderXForwardedProto: {"https"},
+		fiber.HeaderXForwardedHost:  {"evil.test"},
+	}
+	baseURL := func(c *fiber.Ctx) string { return requestBaseURL(c) + " " + c.Hostname() }
+
+	for _, tc := range []struct {
+		proxies []string
+		want    string
+	}{
+		{nil, "http://at2.local at2.local"},
+		{[]string{testPeerUntrusted}, "http://at2.local at2.local"},
+		{[]string{testPeerTrusted}, "https://evil.test evil.test"},
+	} {
+		cfg := setTrustedProxies(t, tc.proxies...)
+		if got := proxyEcho(t, cfg, header, baseURL); got != tc.want {
+			t.Errorf("trusted_proxies %v: got %q, want %q", tc.proxies, got, tc.want)
+		}
+	}
+
+	// public_url wins over what the request says.
+	cfg := setTrustedProxies(t, testPeerTrusted)
+	cfg.Web.PublicURL = "https://at2.example/"
+	setConfig(cfg)
+	if got := proxyEcho(t, cfg, header, requestBaseURL); got != "https://at2.example" {
+		t.Errorf("with public_url: %q", got)
+	}
+}
+
+func TestProxyHeaders_FromUnixSocketPeer(t *testing.T) {
+	cfg := setTrustedProxies(t)
+	path := filepath.Join(t.TempDir(), "at2.sock")
+	ln, err := newWebListener(WebConfig{ListenUnixSocket: &UnixSocketConfig{Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiberAppConfig(cfg))
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(clientIP(c) + " " + requestBaseURL(c))
+	})
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://at2.local/", nil)
+	req.Header.Set(fiber.HeaderXForwardedFor, "203.0.113.7")
+	req.Header.Set(fiber.HeaderXForwardedProto, "https")
+	req.Header.Set(fiber.HeaderXForwardedHost, "at2.example")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := string(body), "203.0.113.7 https://at2.example"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		proxies []string
+		ok      bool
+	}{
+		{[]string{"10.0.0.0/8", "192.168.1.2", "::1", "fd00::/8"}, true},
+		{[]string{"traefik"}, false},
+		{[]string{"10.0.0.0/33"}, false},
+	} {
+		err := validateTrustedProxies(&Config{Web: WebConfig{TrustedProxies: tc.proxies}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%v: err = %v", tc.proxies, err)
+		}
+	}
+}
+
+// forwardedLogin starts a login with X-Forwarded-Proto/-Host set and no
+// public_url configured.
+func forwardedLogin(t *testing.T, app *fiber.App, proxies ...string) (url.Values, *http.Cookie) {
+	t.Helper()
+	cfg := setTrustedProxies(t, proxies...)
+	cfg.Web.PublicURL = ""
+	setConfig(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "http://at2.local/api/v1/auth/login", nil)
+	req.Header.Set(fiber.HeaderXForwardedProto, "https")
+	req.Header.Set(fiber.HeaderXForwardedHost, "at2.example")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcStateCookieName {
+			return location.Query(), cookie
+		}
+	}
+	t.Fatalf("login did not set the %s cookie", oidcStateCookieName)
+	return nil, nil
+}
+
+func TestOIDCLogin_ForwardedProtoFromTrustedProxy(t *testing.T) {
+	app, provider := setupOIDCTest(t)
+
+	params, cookie := forwardedLogin(t, app, testPeerTrusted)
+	if !cookie.Secure {
+		t.Error("state cookie not Secure behind an https proxy")
+	}
+	if got := params.Get("redirect_uri"); got != "https://at2.example/api/v1/auth/callback" {
+		t.Errorf("redirect_uri = %q", got)
+	}
+
+	provider.setNonce(params.Get("nonce"))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/callback?code=abc&state="+url.QueryEscape(params.Get("state")), nil)
+	req.Header.Set(fiber.HeaderXForwardedProto, "https")
+	req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: cookie.Value})
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("callback status = %d", resp.StatusCode)
+	}
+	if got := provider.lastTokenForm().Get("redirect_uri"); got != "https://at2.example/api/v1/auth/callback" {
+		t.Errorf("token exchange redirect_uri = %q", got)
+	}
+	secure := false
+	for _, c := range resp.Cookies() {
+		secure = secure || c.Name == CookieName && c.Secure
+	}
+	if !secure {
+		t.Error("session cookie not Secure behind an https proxy")
+	}
+}
+
+func TestOIDCLogin_ForwardedProtoFromUntrustedPeer(t *testing.T) {
+	app, _ := setupOIDCTest(t)
+
+	for _, proxies := range [][]string{nil, {testPeerUntrusted}} {
+		params, cookie := forwardedLogin(t, app, proxies...)
+		if cookie.Secure {
+			t.Errorf("trusted_proxies %v: spoofed X-Forwarded-Proto made the cookie Secure", proxies)
+		}
+		if got := params.Get("redirect_uri"); !strings.HasPrefix(got, "http://at2.local/") {
+			t.Errorf("trusted_proxies %v: redirect_uri = %q", proxies, got)
+		}
+	}
+}
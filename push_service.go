@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 
@@ -28,13 +28,14 @@ type vapidKeys struct {
 type PushService struct {
 	db   *gorm.DB
 	keys vapidKeys
+	log  *slog.Logger
 	mu   sync.Mutex
 }
 
 // NewPushService loads the VAPID keypair from the database, generating and
 // persisting one on first run.
-func NewPushService(db *gorm.DB) (*PushService, error) {
-	s := &PushService{db: db}
+func NewPushService(db *gorm.DB, logger *slog.Logger) (*PushService, error) {
+	s := &PushService{db: db, log: logger}
 	if err := s.loadOrCreateKeys(); err != nil {
 		return nil, err
 	}
@@ -49,7 +50,7 @@ func (s *PushService) loadOrCreateKeys() error {
 			s.keys.Public != "" && s.keys.Private != "" {
 			return nil
 		}
-		log.Printf("[push] stored VAPID keys invalid, regenerating")
+		s.log.Warn("stored VAPID keys invalid, regenerating")
 	} else if err != gorm.ErrRecordNotFound {
 		return err
 	}
@@ -66,7 +67,7 @@ func (s *PushService) loadOrCreateKeys() error {
 	}).Create(&AppSettingModel{Key: vapidSettingKey, Value: string(value)}).Error; cerr != nil {
 		return cerr
 	}
-	log.Printf("[push] generated new VAPID keypair")
+	s.log.Info("generated new VAPID keypair")
 	return nil
 }
 
@@ -109,7 +110,7 @@ func (s *PushService) SendPrintNotification(printerID, taskID, title, body strin
 		q = q.Where("task_id = ? OR task_id = ''", taskID)
 	}
 	if err := q.Find(&subs).Error; err != nil {
-		log.Printf("[push] failed to load subscriptions for %s: %v", printerID, err)
+		s.log.Warn("loading subscriptions failed", "printer", printerID, "err", err)
 		return
 	}
 	if len(subs) == 0 {
@@ -134,7 +135,7 @@ func (s *PushService) SendPrintNotification(printerID, taskID, title, body strin
 			TTL:             60,
 		})
 		if err != nil {
-			log.Printf("[push] send failed for %s: %v", sub.Endpoint, err)
+			s.log.Warn("sending failed", "endpoint", sub.Endpoint, "err", err)
 			continue
 		}
 		resp.Body.Close()
@@ -150,6 +151,6 @@ func (s *PushService) SendPrintNotification(printerID, taskID, title, body strin
 		ids[i] = sub.ID
 	}
 	if err := s.db.Where("id IN ?", ids).Delete(&PushSubscriptionModel{}).Error; err != nil {
-		log.Printf("[push] failed to clear subscriptions: %v", err)
+		s.log.Warn("clearing subscriptions failed", "err", err)
 	}
 }
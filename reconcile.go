@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultReconcileDelay is how long after startup the configured entities
+// are compared with the discovered devices, giving discovery time to settle.
+const defaultReconcileDelay = 2 * time.Minute
+
+// ReconcileReport compares the configured entities with the discovered
+// devices. It is served by GET /api/v1/debug/config-report.
+type ReconcileReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	// Missing are configured entities no device was discovered for.
+	Missing []ReconcileEntity `json:"missing"`
+	// Unconfigured are IDs of discovered devices no room lists and that
+	// have no alias, by type.
+	Unconfigured map[VdevType][]string `json:"unconfigured"`
+	// AliasedUnconfigured are discovered devices no room lists that were
+	// given an alias instead, by device ID.
+	AliasedUnconfigured []DeviceAlias `json:"aliased_unconfigured"`
+	// Mismatched are entities whose device type doesn't fit their
+	// representation.
+	Mismatched []ReconcileMismatch `json:"mismatched"`
+}
+
+// ReconcileEntity is a configured entity of a ReconcileReport.
+type ReconcileEntity struct {
+	ID     string `json:"id"`
+	RoomID string `json:"room_id"`
+}
+
+// ReconcileMismatch is an entity whose device type doesn't fit its
+// representation.
+type ReconcileMismatch struct {
+	ReconcileEntity
+	Representation string   `json:"representation"`
+	Type           VdevType `json:"type"`
+}
+
+// validateReconcileDelay fails fast on a reconcile_delay that can't be used.
+func validateReconcileDelay(cfg *Config, cfgPath string) error {
+	if cfg.ReconcileDelay == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(cfg.ReconcileDelay); err != nil || d < 0 {
+		return fmt.Errorf("reconcile_delay is not a valid duration (%q) in %s", cfg.ReconcileDelay, cfgPath)
+	}
+	return nil
+}
+
+// reconcileDelay returns reconcile_delay, or the default when unset.
+func reconcileDelay(cfg *Config) time.Duration {
+	if d, err := time.ParseDuration(cfg.ReconcileDelay); err == nil {
+		return d
+	}
+	return defaultReconcileDelay
+}
+
+// buildReconcileReport compares the rooms of cfg with devices. Snapshot
+// devices of room cameras count as configured.
+func buildReconcileReport(cfg *Config, devices []*VirtualDevice, now time.Time) ReconcileReport {
+	report := ReconcileReport{
+		GeneratedAt:         now,
+		Missing:             []ReconcileEntity{},
+		Unconfigured:        map[VdevType][]string{},
+		AliasedUnconfigured: []DeviceAlias{},
+		Mismatched:          []ReconcileMismatch{},
+	}
+	byID := make(map[string]*VirtualDevice, len(devices))
+	for _, dev := range devices {
+		byID[dev.ID] = dev
+	}
+
+	configured := map[string]struct{}{}
+	for _, room := range cfg.Rooms {
+		for _, name := range room.Cameras {
+			configured[cameraDeviceID(name)] = struct{}{}
+		}
+		for _, ent := range room.Entities {
+			configured[ent.ID] = struct{}{}
+			entity := ReconcileEntity{ID: ent.ID, RoomID: room.ID}
+			dev, ok := byID[ent.ID]
+			if !ok {
+				report.Missing = append(report.Missing, entity)
+				continue
+			}
+			types, known := representationTypes[ent.Representation]
+			if known && !slices.Contains(types, dev.Type) {
+				report.Mismatched = append(report.Mismatched, ReconcileMismatch{
+					ReconcileEntity: entity,
+					Representation:  ent.Representation,
+					Type:            dev.Type,
+				})
+			}
+		}
+	}
+
+	for _, dev := range devices {
+		if _, ok := configured[dev.ID]; ok {
+			continue
+		}
+		if alias, ok := deviceAliases.Get(dev.ID); ok {
+			report.AliasedUnconfigured = append(report.AliasedUnconfigured, alias)
+		} else {
+			report.Unconfigured[dev.Type] = append(report.Unconfigured[dev.Type], dev.ID)
+		}
+	}
+	for _, ids := range report.Unconfigured {
+		slices.Sort(ids)
+	}
+	slices.SortFunc(report.AliasedUnconfigured, func(a, b DeviceAlias) int { return strings.Compare(a.DeviceID, b.DeviceID) })
+	return report
+}
+
+// logSummary logs what the report found, listing the missing and mismatched
+// entities; unconfigured and aliased devices are only counted.
+func (r ReconcileReport) logSummary(logger *slog.Logger) {
+	unconfigured := 0
+	for _, ids := range r.Unconfigured {
+		unconfigured += len(ids)
+	}
+	logger.Info("reconciled config with discovered devices", "missing", len(r.Missing), "unconfigured", unconfigured,
+		"aliased_unconfigured", len(r.AliasedUnconfigured), "mismatched", len(r.Mismatched))
+	if len(r.Missing) > 0 {
+		ids := make([]string, len(r.Missing))
+		for i, e := range r.Missing {
+			ids[i] = e.ID
+		}
+		logger.Warn("configured entities missing", "ids", strings.Join(ids, ", "))
+	}
+	for _, m := range r.Mismatched {
+		logger.Warn("type mismatch", "device", m.ID, "room", m.RoomID, "type", m.Type, "representation", m.Representation)
+	}
+}
+
+// startReconcileReport logs a reconciliation report once discovery had
+// reconcile_delay to settle. "0s" disables it.
+func startReconcileReport(cfg *Config, vm *VdevManager, logger *slog.Logger) {
+	delay := reconcileDelay(cfg)
+	if delay <= 0 {
+		return
+	}
+	time.AfterFunc(delay, func() {
+		buildReconcileReport(GetConfig(), vm.Devices(), time.Now()).logSummary(logger)
+	})
+}
+
+func handleConfigReport(c *fiber.Ctx) error {
+	return c.JSON(buildReconcileReport(GetConfig(), vdevManager.Devices(), time.Now()))
+}
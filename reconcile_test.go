@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func reconcileTestConfig() *Config {
+	return &Config{Rooms: []RoomConfig{
+		{ID: "lab", Cameras: []string{"lab_cam"}, Entities: []EntityConfig{
+			{ID: "lab/light", Representation: "light"},
+			{ID: "lab/temp", Representation: "humidity"},
+			{ID: "lab/old_plug", Representation: "plug"},
+		}},
+		{ID: "hall", Entities: []EntityConfig{
+			{ID: "hall/door"},
+			{ID: "hall/people", Representation: "presence"},
+		}},
+	}}
+}
+
+func reconcileTestDevices() []*VirtualDevice {
+	return []*VirtualDevice{
+		{ID: "lab/light", Type: VdevTypeRelay},
+		{ID: "lab/temp", Type: VdevTypeTemperature},
+		{ID: "hall/door", Type: VdevTypeContact},
+		{ID: "hall/people", Type: VdevTypePerson},
+		{ID: "snapshot/lab_cam", Type: VdevTypeCameraSnapshot},
+		{ID: "snapshot/yard_cam", Type: VdevTypeCameraSnapshot},
+		{ID: "lab/fan", Type: VdevTypeRelay},
+		{ID: "lab/compressor", Type: VdevTypeRelay},
+	}
+}
+
+func TestBuildReconcileReport(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	r := buildReconcileReport(reconcileTestConfig(), reconcileTestDevices(), now)
+
+	if want := []ReconcileEntity{{ID: "lab/old_plug", RoomID: "lab"}}; !reflect.DeepEqual(r.Missing, want) {
+		t.Errorf("missing = %+v", r.Missing)
+	}
+	want := map[VdevType][]string{
+		VdevTypeRelay:          {"lab/compressor", "lab/fan"},
+		VdevTypeCameraSnapshot: {"snapshot/yard_cam"},
+	}
+	if !reflect.DeepEqual(r.Unconfigured, want) {
+		t.Errorf("unconfigured = %+v", r.Unconfigured)
+	}
+	wantMismatch := []ReconcileMismatch{{
+		ReconcileEntity: ReconcileEntity{ID: "lab/temp", RoomID: "lab"},
+		Representation:  "humidity",
+		Type:            VdevTypeTemperature,
+	}}
+	if !reflect.DeepEqual(r.Mismatched, wantMismatch) {
+		t.Errorf("mismatched = %+v", r.Mismatched)
+	}
+	if !r.GeneratedAt.Equal(now) {
+		t.Errorf("generated at %v", r.GeneratedAt)
+	}
+}
+
+func TestBuildReconcileReport_AllMatching(t *testing.T) {
+	cfg := &Config{Rooms: []RoomConfig{{ID: "lab", Entities: []EntityConfig{{ID: "lab/light", Representation: "light"}}}}}
+	r := buildReconcileReport(cfg, []*VirtualDevice{{ID: "lab/light", Type: VdevTypeRelay}}, time.Now())
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	// Empty categories are empty lists, not null.
+	if missing, _ := got["missing"].([]any); missing == nil || len(missing) != 0 {
+		t.Errorf("missing = %v", got["missing"])
+	}
+	if mismatched, _ := got["mismatched"].([]any); mismatched == nil || len(mismatched) != 0 {
+		t.Errorf("mismatched = %v", got["mismatched"])
+	}
+	if unconfigured, _ := got["unconfigured"].(map[string]any); unconfigured == nil || len(unconfigured) != 0 {
+		t.Errorf("unconfigured = %v", got["unconfigured"])
+	}
+}
+
+func TestHandleConfigReport(t *testing.T) {
+	prevCfg, prevMgr := GetConfig(), vdevManager
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		vdevManager = prevMgr
+	})
+	setConfig(reconcileTestConfig())
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices(reconcileTestDevices())
+
+	app := fiber.New()
+	app.Get("/api/v1/debug/config-report", handleConfigReport)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/debug/config-report", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r ReconcileReport
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Missing) != 1 || len(r.Unconfigured[VdevTypeRelay]) != 2 || len(r.Mismatched) != 1 || r.Mismatched[0].ID != "lab/temp" {
+		t.Fatalf("report = %+v", r)
+	}
+}
+
+func TestValidateReconcileDelay(t *testing.T) {
+	for delay, ok := range map[string]bool{"": true, "0s": true, "30s": true, "-1m": false, "soon": false} {
+		if err := validateReconcileDelay(&Config{ReconcileDelay: delay}, "at2.yaml"); (err == nil) != ok {
+			t.Errorf("reconcile_delay %q: err = %v", delay, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	fiberrecover "github.com/gofiber/fiber/v2/middleware/recover"
+)
+
+// maxRequestIDLength bounds an incoming X-Request-ID; longer ones are
+// replaced.
+const maxRequestIDLength = 128
+
+// requestIDMiddleware keeps a usable incoming X-Request-ID or generates a
+// UUIDv7, and echoes it in the response. Handlers get it with requestID.
+func requestIDMiddleware(c *fiber.Ctx) error {
+	id := c.Get(fiber.HeaderXRequestID)
+	if !validRequestID(id) {
+		id = GenerateUUIDv7()
+	}
+	c.Locals("request_id", id)
+	c.Set(fiber.HeaderXRequestID, id)
+	return c.Next()
+}
+
+// validRequestID accepts IDs of letters, digits and ._:- so they can't mess
+// up log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == ':', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID set by requestIDMiddleware, or "".
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("request_id").(string)
+	return id
+}
+
+// newAccessLogMiddleware logs one line per request once it has been handled.
+// Errors returned by later handlers are passed to the app's ErrorHandler
+// here, so the logged status is the one sent.
+func newAccessLogMiddleware(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"method", c.Method(),
+			"route", c.Route().Path,
+			"path", c.Path(),
+			"status", status,
+			"duration", time.Since(start),
+			"request_id", requestID(c),
+		}
+		// Set by the auth middlewares further down the chain.
+		if user, _ := c.Locals("username").(string); user != "" {
+			attrs = append(attrs, "user", user)
+		}
+		logger.Log(c.UserContext(), level, "request", attrs...)
+		return nil
+	}
+}
+
+// newRecoverMiddleware turns a panic in a handler into a 500 error, logging
+// the stack trace.
+func newRecoverMiddleware(logger *slog.Logger) fiber.Handler {
+	return fiberrecover.New(fiberrecover.Config{
+		EnableStackTrace: true,
+		StackTraceHandler: func(c *fiber.Ctx, e any) {
+			logger.Error("panic", "route", c.Route().Path, "request_id", requestID(c), "panic", fmt.Sprint(e), "stack", string(debug.Stack()))
+		},
+	})
+}
+
+// errorHandler is the app's fiber.ErrorHandler: errors returned by handlers
+// are sent as {"error": ..., "request_id": ...}. Handlers that write their own
+// error response with SendString don't return an error and aren't affected.
+func errorHandler(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		code = fe.Code
+	}
+	return c.Status(code).JSON(fiber.Map{"error": err.Error(), "request_id": requestID(c)})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newRequestLogTestApp returns an app with the request ID, access log and
+// recover middlewares, logging as JSON to the returned buffer.
+func newRequestLogTestApp(t *testing.T) (*fiber.App, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler, DisableStartupMessage: true})
+	app.Use(requestIDMiddleware, newAccessLogMiddleware(logger), newRecoverMiddleware(logger))
+	app.Get("/rooms/:id", func(c *fiber.Ctx) error {
+		c.Locals("username", "alice")
+		return fiber.NewError(fiber.StatusNotFound, "Room not found")
+	})
+	app.Get("/boom", func(c *fiber.Ctx) error { panic("nil map") })
+	app.Get("/plain", func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing device query parameter")
+	})
+	return app, &buf
+}
+
+func decodeErrorEnvelope(t *testing.T, body io.Reader) map[string]string {
+	t.Helper()
+	var envelope map[string]string
+	if err := json.NewDecoder(body).Decode(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+func TestErrorHandler_Envelope(t *testing.T) {
+	app, logs := newRequestLogTestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/rooms/lab", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	id := resp.Header.Get(fiber.HeaderXRequestID)
+	if len(id) != 36 {
+		t.Fatalf("generated request ID = %q", id)
+	}
+	if env := decodeErrorEnvelope(t, resp.Body); env["error"] != "Room not found" || env["request_id"] != id {
+		t.Fatalf("envelope = %v, request ID %s", env, id)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("%q: %v", logs.String(), err)
+	}
+	if line["route"] != "/rooms/:id" || line["status"] != float64(404) || line["user"] != "alice" || line["request_id"] != id {
+		t.Fatalf("access log = %v", line)
+	}
+}
+
+func TestErrorHandler_Panic(t *testing.T) {
+	app, logs := newRequestLogTestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/boom", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if env := decodeErrorEnvelope(t, resp.Body); env["error"] != "nil map" || env["request_id"] == "" {
+		t.Fatalf("envelope = %v", env)
+	}
+	if !strings.Contains(logs.String(), `"msg":"panic"`) || !strings.Contains(logs.String(), "request_log_test.go") {
+		t.Fatalf("no stack trace logged: %s", logs.String())
+	}
+}
+
+func TestErrorHandler_SendStringUnchanged(t *testing.T) {
+	app, _ := newRequestLogTestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/plain", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusBadRequest || string(body) != "Missing device query parameter" {
+		t.Fatalf("%d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRequestIDMiddleware_Incoming(t *testing.T) {
+	app, logs := newRequestLogTestApp(t)
+
+	for _, tc := range []struct{ incoming, want string }{
+		{"traefik-4f1c2b", "traefik-4f1c2b"},
+		{"bad id\nwith newline", ""},
+		{strings.Repeat("a", maxRequestIDLength+1), ""},
+	} {
+		logs.Reset()
+		req := httptest.NewRequest("GET", "/rooms/lab", nil)
+		req.Header.Set(fiber.HeaderXRequestID, tc.incoming)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := resp.Header.Get(fiber.HeaderXRequestID)
+		if tc.want != "" && id != tc.want || tc.want == "" && (id == tc.incoming || id == "") {
+			t.Errorf("incoming %q: request ID = %q", tc.incoming, id)
+		}
+		if !strings.Contains(logs.String(), `"request_id":"`+id+`"`) {
+			t.Errorf("incoming %q: access log = %s", tc.incoming, logs.String())
+		}
+	}
+}
@@ -39,11 +39,11 @@ type conduitResponse struct {
 // conduitCall performs a Conduit API call against the configured Phabricator
 // instance and returns the raw `result` payload.
 func conduitCall(method string, form url.Values) (json.RawMessage, error) {
-	base := strings.TrimRight(ConfigInstance.Phabricator.URL, "/")
+	base := strings.TrimRight(GetConfig().Phabricator.URL, "/")
 	if base == "" {
 		return nil, fmt.Errorf("phabricator.url is not configured")
 	}
-	token := ConfigInstance.Phabricator.APIToken
+	token := GetConfig().Phabricator.APIToken
 	if token == "" {
 		return nil, fmt.Errorf("phabricator.api_token is not configured")
 	}
@@ -143,7 +143,7 @@ func fetchReservations(rangeStart, rangeEnd int64) ([]ReservationEvent, error) {
 
 	hostNames := resolveHostNames(parsed)
 
-	base := strings.TrimRight(ConfigInstance.Phabricator.URL, "/")
+	base := strings.TrimRight(GetConfig().Phabricator.URL, "/")
 	events := make([]ReservationEvent, 0, len(parsed.Data))
 	for _, e := range parsed.Data {
 		events = append(events, ReservationEvent{
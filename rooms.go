@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RoomInfo is a room as served by GET /api/v1/rooms: its layout and
+// entities, without the settings only the backend uses.
+type RoomInfo struct {
+	ID string `json:"id"`
+	// Name is LocalizedName resolved for the language of the request.
+	Name                      string           `json:"name"`
+	LocalizedName             LocalizedString  `json:"localized_name"`
+	ExcludeFromEntranceTablet bool             `json:"exclude_from_entrance_tablet"`
+	VoipPhoneNumber           string           `json:"voip_phone_number,omitempty"`
+	Cameras                   []string         `json:"cameras"`
+	Floorplan                 *RoomFloorplan   `json:"floorplan,omitempty"`
+	Entities                  []RoomEntityInfo `json:"entities"`
+}
+
+// RoomEntityInfo is a configured entity of a RoomInfo.
+type RoomEntityInfo struct {
+	ID             string          `json:"id"`
+	Name           string          `json:"name"`
+	LocalizedName  LocalizedString `json:"localized_name"`
+	Representation string          `json:"representation,omitempty"`
+	Icon           string          `json:"icon,omitempty"`
+	Group          string          `json:"group,omitempty"`
+	Order          int             `json:"order,omitempty"`
+	Position       *FloorplanPoint `json:"position,omitempty"`
+}
+
+// knownIcons are the entity icons the dashboard can draw: lucide icon names
+// in kebab case.
+var knownIcons = map[string]struct{}{
+	"air-vent": {}, "alarm-smoke": {}, "battery": {}, "bell": {}, "cctv": {},
+	"coffee": {}, "cpu": {}, "door-closed": {}, "door-open": {}, "drill": {},
+	"droplets": {}, "fan": {}, "flame": {}, "gauge": {}, "heater": {},
+	"lamp": {}, "lamp-ceiling": {}, "lamp-desk": {}, "lightbulb": {},
+	"lock": {}, "microwave": {}, "monitor": {}, "moon": {}, "plug": {},
+	"power": {}, "printer": {}, "refrigerator": {}, "router": {},
+	"server": {}, "siren": {}, "speaker": {}, "sun": {}, "thermometer": {},
+	"tv": {}, "user": {}, "users": {}, "washing-machine": {}, "wifi": {},
+	"wind": {}, "wrench": {}, "zap": {},
+}
+
+var (
+	// svgPathPattern matches the characters SVG path data can contain.
+	svgPathPattern = regexp.MustCompile(`^[MmLlHhVvCcSsQqTtAaZz0-9eE.,+\-\s]+$`)
+)
+
+// validateRoomLayout fails fast on floor plans, entity positions and icons
+// the dashboard can't draw.
+func validateRoomLayout(cfg *Config, cfgPath string) error {
+	for _, room := range cfg.Rooms {
+		if fp := room.Floorplan; fp != nil {
+			switch {
+			case fp.Path != "" && len(fp.Points) > 0:
+				return fmt.Errorf("room %s floorplan has both path and points in %s", room.ID, cfgPath)
+			case fp.Path == "" && len(fp.Points) < 3:
+				return fmt.Errorf("room %s floorplan needs a path or at least 3 points in %s", room.ID, cfgPath)
+			case fp.Path != "" && !svgPathPattern.MatchString(fp.Path):
+				return fmt.Errorf("room %s floorplan path is not SVG path data in %s", room.ID, cfgPath)
+			}
+			for _, p := range fp.Points {
+				if !p.finite() {
+					return fmt.Errorf("room %s floorplan has a point that isn't a number in %s", room.ID, cfgPath)
+				}
+			}
+			if fp.Label != nil && !fp.Label.finite() {
+				return fmt.Errorf("room %s floorplan label isn't a number in %s", room.ID, cfgPath)
+			}
+		}
+		for _, ent := range room.Entities {
+			if _, ok := knownIcons[ent.Icon]; ent.Icon != "" && !ok {
+				return fmt.Errorf("entity %s has unknown icon %q in %s", ent.ID, ent.Icon, cfgPath)
+			}
+			if ent.Position != nil && !ent.Position.finite() {
+				return fmt.Errorf("entity %s position isn't a number in %s", ent.ID, cfgPath)
+			}
+		}
+	}
+	return nil
+}
+
+func (p FloorplanPoint) finite() bool {
+	return !math.IsNaN(p.X) && !math.IsInf(p.X, 0) && !math.IsNaN(p.Y) && !math.IsInf(p.Y, 0)
+}
+
+// sortedEntities returns a room's entities in display order: by group, then
+// order, then ID.
+func sortedEntities(entities []EntityConfig) []EntityConfig {
+	sorted := slices.Clone(entities)
+	slices.SortStableFunc(sorted, func(a, b EntityConfig) int {
+		return cmp.Or(
+			cmp.Compare(a.Group, b.Group),
+			cmp.Compare(a.Order, b.Order),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+	return sorted
+}
+
+// buildRoomInfos lists the configured rooms for GET /api/v1/rooms, with names
+// in lang.
+func buildRoomInfos(cfg *Config, lang string) []RoomInfo {
+	rooms := make([]RoomInfo, 0, len(cfg.Rooms))
+	for _, room := range cfg.Rooms {
+		info := RoomInfo{
+			ID:                        room.ID,
+			Name:                      cmp.Or(room.LocalizedName.Resolve(lang), room.ID),
+			LocalizedName:             room.LocalizedName,
+			ExcludeFromEntranceTablet: room.ExcludeFromEntranceTablet,
+			VoipPhoneNumber:           room.VoipPhoneNumber,
+			Cameras:                   room.Cameras,
+			Floorplan:                 room.Floorplan,
+			Entities:                  make([]RoomEntityInfo, 0, len(room.Entities)),
+		}
+		if info.Cameras == nil {
+			info.Cameras = []string{}
+		}
+		for _, ent := range sortedEntities(room.Entities) {
+			info.Entities = append(info.Entities, RoomEntityInfo{
+				ID:             ent.ID,
+				Name:           cmp.Or(ent.LocalizedName.Resolve(lang), ent.ID),
+				LocalizedName:  ent.LocalizedName,
+				Representation: ent.Representation,
+				Icon:           ent.Icon,
+				Group:          ent.Group,
+				Order:          ent.Order,
+				Position:       ent.Position,
+			})
+		}
+		rooms = append(rooms, info)
+	}
+	return rooms
+}
+
+// roomsBody is a marshaled GET /api/v1/rooms body.
+type roomsBody struct {
+	body []byte
+	etag string
+}
+
+// roomsResponse holds the GET /api/v1/rooms bodies of one config, by the
+// language of their names. Only languages the config uses get their own body,
+// so there are at most a few.
+type roomsResponse struct {
+	cfg     *Config
+	locales []string
+
+	mu     sync.Mutex
+	bodies map[string]roomsBody
+}
+
+// roomsResponseCache holds the bodies for the active config; a reload
+// replaces the config and so makes the next request start over.
+var roomsResponseCache atomic.Pointer[roomsResponse]
+
+// body returns the body with names in lang, building it on first use.
+func (r *roomsResponse) body(lang string) (roomsBody, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.bodies[lang]; ok {
+		return b, nil
+	}
+	body, err := json.Marshal(buildRoomInfos(r.cfg, lang))
+	if err != nil {
+		return roomsBody{}, err
+	}
+	b := roomsBody{body: body, etag: bodyETag(body)}
+	r.bodies[lang] = b
+	return b, nil
+}
+
+// handleGetRooms serves the room configuration, with names in the language
+// picked by ?lang= or Accept-Language, answering 304 when the client already
+// has it.
+func handleGetRooms(c *fiber.Ctx) error {
+	cfg := GetConfig()
+	resp := roomsResponseCache.Load()
+	if resp == nil || resp.cfg != cfg {
+		resp = &roomsResponse{cfg: cfg, locales: configLocales(cfg), bodies: map[string]roomsBody{}}
+		roomsResponseCache.Store(resp)
+	}
+	b, err := resp.body(requestLocale(c, resp.locales))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderETag, b.etag)
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Vary(fiber.HeaderAcceptLanguage)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), b.etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(b.body)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setupRoomsTest(t *testing.T) *fiber.App {
+	t.Helper()
+	prev := GetConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	setConfig(&Config{Rooms: []RoomConfig{
+		{
+			ID:            "lab",
+			LocalizedName: LocalizedString{"en": "Lab"},
+			Cameras:       []string{"lab_cam"},
+			Floorplan: &RoomFloorplan{
+				Points: []FloorplanPoint{{0, 0}, {10, 0}, {10, 5}},
+				Label:  &FloorplanPoint{5, 2},
+			},
+			Entities: []EntityConfig{{
+				ID:              "lab/fan",
+				Representation:  "fan",
+				Icon:            "fan",
+				Position:        &FloorplanPoint{X: 3, Y: 4},
+				AutoOffMinutes:  30,
+				NegateValue:     true,
+				ProhibitControl: true,
+				SpaceAPI:        &EntitySpaceAPIConfig{Description: "internal"},
+			}},
+			SourceFile: "/etc/at2/rooms.yaml",
+		},
+		{ID: "hall"},
+	}})
+
+	app := fiber.New()
+	app.Get("/api/v1/rooms", handleGetRooms)
+	return app
+}
+
+func TestHandleGetRooms(t *testing.T) {
+	app := setupRoomsTest(t)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/rooms", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	want := `[{"id":"lab","name":"Lab","localized_name":{"en":"Lab"},"exclude_from_entrance_tablet":false,"cameras":["lab_cam"],` +
+		`"floorplan":{"points":[{"x":0,"y":0},{"x":10,"y":0},{"x":10,"y":5}],"label":{"x":5,"y":2}},` +
+		`"entities":[{"id":"lab/fan","name":"lab/fan","localized_name":null,"representation":"fan","icon":"fan","position":{"x":3,"y":4}}]},` +
+		`{"id":"hall","name":"hall","localized_name":null,"exclude_from_entrance_tablet":false,"cameras":[],"entities":[]}]`
+	if string(body) != want {
+		t.Fatalf("body = %s\nwant  %s", body, want)
+	}
+	if resp.Header.Get(fiber.HeaderETag) == "" {
+		t.Fatal("no ETag")
+	}
+}
+
+func TestHandleGetRooms_ETag(t *testing.T) {
+	app := setupRoomsTest(t)
+	get := func(ifNoneMatch string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/rooms", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set(fiber.HeaderIfNoneMatch, ifNoneMatch)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	etag := get("").Header.Get(fiber.HeaderETag)
+	if resp := get(etag); resp.StatusCode != fiber.StatusNotModified {
+		t.Fatalf("status with matching ETag = %d", resp.StatusCode)
+	}
+
+	// A reloaded config is a new document.
+	cfg := *GetConfig()
+	cfg.Rooms = cfg.Rooms[:1]
+	setConfig(&cfg)
+	resp := get(etag)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderETag) == etag {
+		t.Fatalf("after reload: status %d, ETag %s", resp.StatusCode, resp.Header.Get(fiber.HeaderETag))
+	}
+	var rooms []RoomInfo
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil || len(rooms) != 1 {
+		t.Fatalf("rooms = %+v, err = %v", rooms, err)
+	}
+}
+
+func TestHandleGetRooms_Lang(t *testing.T) {
+	app := setupRoomsTest(t)
+	GetConfig().Rooms[0].LocalizedName = LocalizedString{"en": "Lab", "pl": "Pracownia"}
+	get := func(target, acceptLanguage string) (string, string) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if acceptLanguage != "" {
+			req.Header.Set(fiber.HeaderAcceptLanguage, acceptLanguage)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rooms []RoomInfo
+		if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+			t.Fatal(err)
+		}
+		return rooms[0].Name, resp.Header.Get(fiber.HeaderETag)
+	}
+
+	en, enETag := get("/api/v1/rooms?lang=en", "pl")
+	pl, plETag := get("/api/v1/rooms", "de-DE, en;q=0.5, pl;q=0.8")
+	if en != "Lab" || pl != "Pracownia" {
+		t.Fatalf("names = %q, %q", en, pl)
+	}
+	if enETag == plETag {
+		t.Fatal("same ETag for different languages")
+	}
+	// Languages the config has no names in get the default body.
+	if name, etag := get("/api/v1/rooms?lang=de", ""); name != "Pracownia" || etag != plETag {
+		t.Fatalf("lang=de: %q, %s", name, etag)
+	}
+}
+
+func TestValidateRoomLayout(t *testing.T) {
+	square := []FloorplanPoint{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	for _, tc := range []struct {
+		name    string
+		room    RoomConfig
+		wantErr string
+	}{
+		{name: "points", room: RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Points: square}}},
+		{name: "path", room: RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Path: "M0 0 H10 V5 H0 Z"}}},
+		{
+			name:    "path and points",
+			room:    RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Path: "M0 0 Z", Points: square}},
+			wantErr: "both path and points",
+		},
+		{
+			name:    "too few points",
+			room:    RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Points: square[:2]}},
+			wantErr: "at least 3 points",
+		},
+		{
+			name:    "markup in path",
+			room:    RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Path: `M0 0"/><script>`}},
+			wantErr: "not SVG path data",
+		},
+		{
+			name:    "infinite label",
+			room:    RoomConfig{ID: "lab", Floorplan: &RoomFloorplan{Points: square, Label: &FloorplanPoint{X: math.Inf(1)}}},
+			wantErr: "label isn't a number",
+		},
+		{
+			name:    "icon",
+			room:    RoomConfig{ID: "lab", Entities: []EntityConfig{{ID: "lab/fan", Icon: "Fan Icon"}}},
+			wantErr: `unknown icon "Fan Icon"`,
+		},
+		{
+			name:    "unknown icon",
+			room:    RoomConfig{ID: "lab", Entities: []EntityConfig{{ID: "lab/fan", Icon: "mdi:fan"}}},
+			wantErr: `unknown icon "mdi:fan"`,
+		},
+		{name: "known icon", room: RoomConfig{ID: "lab", Entities: []EntityConfig{{ID: "lab/fan", Icon: "fan"}}}},
+		{
+			name:    "position",
+			room:    RoomConfig{ID: "lab", Entities: []EntityConfig{{ID: "lab/fan", Position: &FloorplanPoint{Y: math.NaN()}}}},
+			wantErr: "entity lab/fan position",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateRoomLayout(&Config{Rooms: []RoomConfig{tc.room}}, "at2.yaml")
+			if tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
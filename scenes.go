@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SceneCommandResult reports how one command of an activated scene went.
+type SceneCommandResult struct {
+	DeviceID string `json:"deviceId"`
+	State    any    `json:"state"`
+	OK       bool   `json:"ok"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SceneActivation is the response of POST /api/v1/scenes/:name/activate.
+type SceneActivation struct {
+	Scene     string               `json:"scene"`
+	Succeeded int                  `json:"succeeded"`
+	Failed    int                  `json:"failed"`
+	Results   []SceneCommandResult `json:"results"`
+}
+
+// validateScenes fails fast on scenes that can't be addressed or do nothing.
+func validateScenes(cfg *Config, cfgPath string) error {
+	seen := map[string]struct{}{}
+	for i, scene := range cfg.Scenes {
+		if scene.Name == "" || strings.Contains(scene.Name, "/") {
+			return fmt.Errorf("scenes[%d] needs a name without slashes in %s", i, cfgPath)
+		}
+		if _, dup := seen[scene.Name]; dup {
+			return fmt.Errorf("duplicate scene name %q in %s", scene.Name, cfgPath)
+		}
+		seen[scene.Name] = struct{}{}
+		if len(scene.Commands) == 0 {
+			return fmt.Errorf("scene %q has no commands in %s", scene.Name, cfgPath)
+		}
+		for j, cmd := range scene.Commands {
+			if cmd.DeviceID == "" || cmd.State == nil {
+				return fmt.Errorf("scene %q commands[%d] needs device_id and state in %s", scene.Name, j, cfgPath)
+			}
+		}
+	}
+	return nil
+}
+
+// findScene returns the configured scene with the given name, or nil.
+func findScene(name string) *SceneConfig {
+	scenes := GetConfig().Scenes
+	for i := range scenes {
+		if scenes[i].Name == name {
+			return &scenes[i]
+		}
+	}
+	return nil
+}
+
+func handleListScenes(c *fiber.Ctx) error {
+	scenes := GetConfig().Scenes
+	if scenes == nil {
+		scenes = []SceneConfig{}
+	}
+	return c.JSON(scenes)
+}
+
+// handleActivateScene sends every command of a scene in order and answers
+// with a summary. Commands the control rules deny or ControlDevice rejects
+// are reported as failed without stopping the others.
+func handleActivateScene(c *fiber.Ctx) error {
+	scene := findScene(c.Params("name"))
+	if scene == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Scene not found"})
+	}
+	groups, err := getUserGroups(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to parse claims"})
+	}
+	if mqttAdapter == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "MQTT adapter not initialized"})
+	}
+
+	summary := SceneActivation{Scene: scene.Name, Results: make([]SceneCommandResult, 0, len(scene.Commands))}
+	for _, cmd := range scene.Commands {
+		result := SceneCommandResult{DeviceID: cmd.DeviceID, State: cmd.State, OK: true}
+		if rule := deniedControlRule(cmd.DeviceID, groups); rule != nil {
+			result.OK, result.Code = false, "forbidden"
+			result.Error = "Controlling this device requires group " + rule.RequireGroup
+		} else if err := mqttAdapter.ControlDevice(cmd.DeviceID, cmd.State); err != nil {
+			result.OK, result.Code, result.Error = false, controlErrorCode(err), err.Error()
+		}
+		if result.OK {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	// One log line for the whole scene rather than one per device.
+	controlLog.Info("scene activated", "user", c.Locals("username"), "scene", scene.Name, "succeeded", summary.Succeeded, "failed", summary.Failed)
+	return c.JSON(summary)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setupScenesTest(t *testing.T) (*fiber.App, *MockClient) {
+	t.Helper()
+	setupControlRulesTest(t)
+	GetConfig().Scenes = []SceneConfig{{
+		Name: "closing_time",
+		Commands: []SceneCommand{
+			{DeviceID: "relay/hall_light", State: "OFF"},
+			{DeviceID: "relay/missing", State: "OFF"},
+			{DeviceID: "relay/compressor_main", State: "OFF"},
+			{DeviceID: "relay/locked", State: "OFF"},
+			{DeviceID: "relay/fan", State: "DIM"},
+			{DeviceID: "relay/fan", State: "OFF"},
+		},
+	}}
+
+	mgr := NewVdevManager()
+	mockClient := &MockClient{}
+	mqttAdapter = &MQTTAdapter{log: testLogger, vdevMgr: mgr, client: mockClient, mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)}}
+	mgr.AddDevices([]*VirtualDevice{
+		{ID: "relay/hall_light", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "hall_light"}},
+		{ID: "relay/compressor_main", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "compressor"}},
+		{ID: "relay/locked", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "locked"}, ProhibitControl: true},
+		{ID: "relay/fan", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "fan"}},
+	})
+
+	app := fiber.New()
+	app.Get("/api/v1/scenes", handleListScenes)
+	app.Post("/api/v1/scenes/:name/activate", handleActivateScene)
+	return app, mockClient
+}
+
+func TestHandleActivateScene_CollectsErrors(t *testing.T) {
+	app, mockClient := setupScenesTest(t)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/v1/scenes/closing_time/activate", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var summary SceneActivation
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+
+	wantCodes := []string{"", "not_found", "forbidden", "forbidden", "invalid", ""}
+	if summary.Scene != "closing_time" || summary.Succeeded != 2 || summary.Failed != 4 || len(summary.Results) != len(wantCodes) {
+		t.Fatalf("summary = %+v", summary)
+	}
+	for i, want := range wantCodes {
+		if r := summary.Results[i]; r.Code != want || r.OK != (want == "") {
+			t.Errorf("results[%d] = %+v, want code %q", i, r, want)
+		}
+	}
+	// The last command still ran after the failures.
+	if mockClient.PublishedTopic != "zigbee2mqtt/fan/set" {
+		t.Errorf("last published to %s", mockClient.PublishedTopic)
+	}
+}
+
+func TestHandleActivateScene_NotFound(t *testing.T) {
+	app, _ := setupScenesTest(t)
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/v1/scenes/party/activate", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestHandleListScenes(t *testing.T) {
+	app, _ := setupScenesTest(t)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/scenes", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scenes []map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&scenes); err != nil {
+		t.Fatal(err)
+	}
+	commands, _ := scenes[0]["commands"].([]any)
+	first, _ := commands[0].(map[string]any)
+	if len(scenes) != 1 || scenes[0]["name"] != "closing_time" || len(commands) != 6 ||
+		first["deviceId"] != "relay/hall_light" || first["state"] != "OFF" {
+		t.Fatalf("scenes = %v", scenes)
+	}
+}
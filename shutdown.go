@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds the whole shutdown sequence. A second SIGINT or
+// SIGTERM kills the process right away.
+const shutdownTimeout = 15 * time.Second
+
+// shutdownStack holds what is torn down on shutdown. The fields are
+// interfaces so tests can pass fakes; nil fields are skipped.
+type shutdownStack struct {
+	app       interface{ ShutdownWithTimeout(time.Duration) error }
+	snapshots interface{ Stop() }
+	archive   interface{ Stop() }
+	backup    interface{ Stop() }
+	notify    interface{ Stop() }
+	telegram  interface{ Stop() }
+	mqtt      interface{ Close() }
+	history   interface{ Flush() error }
+	frontend  interface{ Kill() error }
+	// unixSocket is the socket file the server listened on, if any.
+	unixSocket string
+}
+
+// shutdownStep is one step of the shutdown sequence.
+type shutdownStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// steps returns the shutdown sequence. Live clients go first since their
+// connections would keep the HTTP server from shutting down. MQTT is closed
+// before the history is flushed so no state change arrives afterwards.
+func (s shutdownStack) steps() []shutdownStep {
+	steps := []shutdownStep{{"closing live clients", closeLiveSubscribers}}
+	if s.app != nil {
+		steps = append(steps, shutdownStep{"stopping HTTP server", func(ctx context.Context) error {
+			timeout := shutdownTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = time.Until(deadline)
+			}
+			return s.app.ShutdownWithTimeout(timeout)
+		}})
+	}
+	if s.unixSocket != "" {
+		steps = append(steps, shutdownStep{"removing unix socket", func(context.Context) error {
+			return removeUnixSocket(s.unixSocket)
+		}})
+	}
+	if s.snapshots != nil {
+		steps = append(steps, shutdownStep{"stopping snapshot fetching", func(context.Context) error {
+			s.snapshots.Stop()
+			return nil
+		}})
+	}
+	if s.archive != nil {
+		steps = append(steps, shutdownStep{"stopping snapshot archive", func(context.Context) error {
+			s.archive.Stop()
+			return nil
+		}})
+	}
+	if s.backup != nil {
+		steps = append(steps, shutdownStep{"stopping database backups", func(context.Context) error {
+			s.backup.Stop()
+			return nil
+		}})
+	}
+	if s.notify != nil {
+		steps = append(steps, shutdownStep{"stopping notifications", func(context.Context) error {
+			s.notify.Stop()
+			return nil
+		}})
+	}
+	if s.telegram != nil {
+		steps = append(steps, shutdownStep{"stopping Telegram bot", func(context.Context) error {
+			s.telegram.Stop()
+			return nil
+		}})
+	}
+	if s.mqtt != nil {
+		steps = append(steps, shutdownStep{"closing MQTT", func(context.Context) error {
+			s.mqtt.Close()
+			return nil
+		}})
+	}
+	if s.history != nil {
+		steps = append(steps, shutdownStep{"flushing history", func(context.Context) error {
+			return s.history.Flush()
+		}})
+	}
+	if s.frontend != nil {
+		steps = append(steps, shutdownStep{"stopping dev frontend", func(context.Context) error {
+			return s.frontend.Kill()
+		}})
+	}
+	return steps
+}
+
+// runShutdown runs steps in order. A failed step is logged and the next one
+// runs; once ctx is done the remaining steps are skipped.
+func runShutdown(ctx context.Context, steps []shutdownStep, logger *slog.Logger) error {
+	for i, step := range steps {
+		logger.Info(step.name)
+		done := make(chan error, 1)
+		go func() { done <- step.run(ctx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				logger.Warn("shutdown step failed", "step", step.name, "err", err)
+			}
+		case <-ctx.Done():
+			var skipped []string
+			for _, s := range steps[i+1:] {
+				skipped = append(skipped, s.name)
+			}
+			return fmt.Errorf("%s: %w (skipped: %s)", step.name, ctx.Err(), strings.Join(skipped, ", "))
+		}
+	}
+	return nil
+}
+
+// handleShutdownSignals shuts stack down on SIGINT or SIGTERM. The returned
+// channel is closed once the sequence has finished.
+func handleShutdownSignals(stack shutdownStack, logger *slog.Logger) <-chan struct{} {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-sigs
+		signal.Stop(sigs)
+		logger.Info("shutting down", "signal", sig, "deadline", shutdownTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := runShutdown(ctx, stack.steps(), logger); err != nil {
+			logger.Error("shutdown gave up", "err", err)
+			return
+		}
+		logger.Info("shutdown done")
+	}()
+	return done
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// shutdownRecorder records the calls of the fake shutdown components.
+type shutdownRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *shutdownRecorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+type recordingApp struct {
+	*fiber.App
+	rec *shutdownRecorder
+}
+
+func (a recordingApp) ShutdownWithTimeout(d time.Duration) error {
+	a.rec.record("app")
+	return a.App.ShutdownWithTimeout(d)
+}
+
+type fakeSnapshots struct{ rec *shutdownRecorder }
+
+func (f fakeSnapshots) Stop() { f.rec.record("snapshots") }
+
+type fakeMQTT struct{ rec *shutdownRecorder }
+
+func (f fakeMQTT) Close() { f.rec.record("mqtt") }
+
+type fakeHistory struct{ rec *shutdownRecorder }
+
+func (f fakeHistory) Flush() error {
+	f.rec.record("history")
+	return errors.New("disk full")
+}
+
+type fakeFrontend struct{ rec *shutdownRecorder }
+
+func (f fakeFrontend) Kill() error {
+	f.rec.record("frontend")
+	return nil
+}
+
+func TestShutdown_Sequence(t *testing.T) {
+	setupLiveWsTest(t)
+	t.Cleanup(func() {
+		liveSubscribersMutex.Lock()
+		liveShuttingDown = false
+		liveSubscribersMutex.Unlock()
+	})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/api/v1/live-ws", websocket.New(handleLiveWs))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenDone := make(chan error, 1)
+	go func() { listenDone <- app.Listener(ln) }()
+
+	conn, _, err := fastws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/api/v1/live-ws?v=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closeCode := make(chan int, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var ce *fastws.CloseError
+				if errors.As(err, &ce) {
+					closeCode <- ce.Code
+				}
+				close(closeCode)
+				return
+			}
+		}
+	}()
+
+	rec := &shutdownRecorder{}
+	stack := shutdownStack{
+		app:       recordingApp{app, rec},
+		snapshots: fakeSnapshots{rec},
+		mqtt:      fakeMQTT{rec},
+		history:   fakeHistory{rec},
+		frontend:  fakeFrontend{rec},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The failing history flush doesn't stop the sequence.
+	if err := runShutdown(ctx, stack.steps(), testLogger); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := <-closeCode; code != fastws.CloseGoingAway {
+		t.Errorf("websocket close code = %d, want %d", code, fastws.CloseGoingAway)
+	}
+	if err := <-listenDone; err != nil {
+		t.Errorf("Listener = %v", err)
+	}
+	if want := []string{"app", "snapshots", "mqtt", "history", "frontend"}; !slices.Equal(rec.calls, want) {
+		t.Errorf("calls = %v, want %v", rec.calls, want)
+	}
+}
+
+func TestRunShutdown_Deadline(t *testing.T) {
+	var ran []string
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	steps := []shutdownStep{
+		{"first", func(context.Context) error { ran = append(ran, "first"); return nil }},
+		{"stuck", func(context.Context) error { <-stuck; return nil }},
+		{"last", func(context.Context) error { ran = append(ran, "last"); return nil }},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := runShutdown(ctx, steps, testLogger)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if !slices.Equal(ran, []string{"first"}) {
+		t.Fatalf("ran = %v", ran)
+	}
+}
+
+func TestVirtualDeviceHistoryRepository_Flush(t *testing.T) {
+	setupTestDB(t)
+	db := gormDB
+	repo := NewVirtualDeviceHistoryRepository(db, NewVdevManager(), testLogger)
+	dev := &VirtualDevice{ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5}
+
+	repo.OnDeviceUpdated(dev)
+	if err := repo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	repo.OnDeviceUpdated(dev)
+
+	var n int64
+	db.Model(&VirtualDeviceStateModel{}).Count(&n)
+	if n != 1 {
+		t.Fatalf("%d states recorded, want 1", n)
+	}
+}
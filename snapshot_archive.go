@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultArchiveInterval  = 10 * time.Minute
+	defaultArchiveMaxAge    = 7 * 24 * time.Hour
+	defaultArchiveMaxSizeMB = 1024
+	// archiveQueueSize is how many snapshots may wait to be written before
+	// further ones are dropped, so a slow disk never holds up fetching.
+	archiveQueueSize = 16
+	// archiveDateLayout names the per-day directories, in UTC.
+	archiveDateLayout = "2006-01-02"
+)
+
+// SnapshotArchiveConfig is frigate.archive: keeping a snapshot of every
+// camera every interval on disk. The archive is set up at startup; changes
+// take effect after a restart.
+type SnapshotArchiveConfig struct {
+	// DataDir is where the archive goes, under snapshots/. Defaults to the
+	// directory of database.path.
+	DataDir string `yaml:"data_dir"`
+	// Interval is a Go duration: one snapshot per camera is archived in each
+	// interval of wall-clock time. Default "10m".
+	Interval string `yaml:"interval"`
+	// MaxAge is a Go duration after which archived snapshots are deleted.
+	// Default "168h".
+	MaxAge string `yaml:"max_age"`
+	// MaxSizeMB caps the whole archive in MiB; the oldest snapshots are
+	// deleted beyond it. Default 1024.
+	MaxSizeMB int `yaml:"max_size_mb"`
+}
+
+// validateSnapshotArchiveConfig rejects frigate.archive settings that can't be
+// used.
+func validateSnapshotArchiveConfig(cfg *Config, cfgPath string) error {
+	a := cfg.Frigate.Archive
+	if a == nil {
+		return nil
+	}
+	for field, val := range map[string]string{"interval": a.Interval, "max_age": a.MaxAge} {
+		if val == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+			return fmt.Errorf("frigate.archive.%s is not a valid duration (%q) in %s", field, val, cfgPath)
+		}
+	}
+	if a.MaxSizeMB < 0 {
+		return fmt.Errorf("frigate.archive.max_size_mb must not be negative in %s", cfgPath)
+	}
+	return nil
+}
+
+// archivedSnapshot is a snapshot waiting to be written.
+type archivedSnapshot struct {
+	camera string
+	at     time.Time
+	data   []byte
+}
+
+// SnapshotArchiver writes the snapshots the FrigateSnapshotMapper offers to
+// <data_dir>/snapshots/<camera>/<date>/<unix seconds>.jpg and prunes them by
+// age and total size. Writing happens on its own goroutine. The archive is
+// scanned once at Start; from then on the archived files are tracked in
+// memory, so pruning after each write doesn't walk the disk.
+type SnapshotArchiver struct {
+	dir      string
+	interval time.Duration
+	maxAge   time.Duration
+	maxBytes int64
+	log      *slog.Logger
+
+	queue chan archivedSnapshot
+	mu    sync.Mutex
+	// last is when a snapshot of each camera was last queued.
+	last map[string]time.Time
+	// files are the archived snapshots, oldest first. Only Start and the
+	// write loop use them.
+	files []archivedFile
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	loop   sync.WaitGroup
+}
+
+func NewSnapshotArchiver(cfg *Config, logger *slog.Logger) *SnapshotArchiver {
+	a := cfg.Frigate.Archive
+	dataDir := a.DataDir
+	if dataDir == "" {
+		dataDir = filepath.Dir(cfg.Database.Path)
+	}
+	interval, maxAge, maxMB := defaultArchiveInterval, defaultArchiveMaxAge, defaultArchiveMaxSizeMB
+	if d, err := time.ParseDuration(a.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	if d, err := time.ParseDuration(a.MaxAge); err == nil && d > 0 {
+		maxAge = d
+	}
+	if a.MaxSizeMB > 0 {
+		maxMB = a.MaxSizeMB
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SnapshotArchiver{
+		dir:      filepath.Join(dataDir, "snapshots"),
+		interval: interval,
+		maxAge:   maxAge,
+		maxBytes: int64(maxMB) << 20,
+		log:      logger,
+		queue:    make(chan archivedSnapshot, archiveQueueSize),
+		last:     map[string]time.Time{},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start creates the archive directory, scans and prunes it and starts writing
+// offered snapshots.
+func (a *SnapshotArchiver) Start() error {
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return fmt.Errorf("creating snapshot archive: %w", err)
+	}
+	now := time.Now()
+	files, err := a.scan("", time.Unix(0, 0), now.Add(24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("scanning snapshot archive: %w", err)
+	}
+	a.files = files
+	a.prune(now)
+	a.loop.Go(a.writeLoop)
+	return nil
+}
+
+// Stop ends the write loop once the snapshot being written is done; queued
+// ones are dropped.
+func (a *SnapshotArchiver) Stop() {
+	a.cancel()
+	a.loop.Wait()
+}
+
+func (a *SnapshotArchiver) writeLoop() {
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case snap := <-a.queue:
+			if err := a.write(snap); err != nil {
+				a.log.Warn("archiving snapshot failed", "camera", snap.camera, "err", err)
+				continue
+			}
+			a.prune(time.Now())
+		}
+	}
+}
+
+// due reports whether a snapshot of camera taken at now falls into an
+// interval nothing was archived in yet.
+func (a *SnapshotArchiver) due(camera string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	last, ok := a.last[camera]
+	return !ok || !now.Truncate(a.interval).Equal(last.Truncate(a.interval))
+}
+
+// offer queues a snapshot to be archived without waiting for the disk. It is
+// dropped when the queue is full.
+func (a *SnapshotArchiver) offer(camera string, at time.Time, data []byte) {
+	a.mu.Lock()
+	a.last[camera] = at
+	a.mu.Unlock()
+	select {
+	case a.queue <- archivedSnapshot{camera: camera, at: at, data: data}:
+	default:
+		a.log.Warn("snapshot archive queue full, dropping snapshot", "camera", camera)
+	}
+}
+
+// validArchiveName reports whether name can be used as a single path element
+// of the archive.
+func validArchiveName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// archivePath is the path of a camera's snapshot taken at ts, relative to the
+// archive directory.
+func archivePath(camera string, ts int64) (string, error) {
+	if !validArchiveName(camera) {
+		return "", fmt.Errorf("invalid camera name %q", camera)
+	}
+	if ts <= 0 {
+		return "", fmt.Errorf("invalid timestamp %d", ts)
+	}
+	date := time.Unix(ts, 0).UTC().Format(archiveDateLayout)
+	return path.Join(camera, date, strconv.FormatInt(ts, 10)+".jpg"), nil
+}
+
+// write stores a snapshot through a temporary file, so a partly written one is
+// never served, and tracks it for pruning.
+func (a *SnapshotArchiver) write(snap archivedSnapshot) error {
+	name, err := archivePath(snap.camera, snap.at.Unix())
+	if err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(a.dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err := root.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := root.WriteFile(tmp, snap.data, 0o644); err != nil {
+		return err
+	}
+	if err := root.Rename(tmp, name); err != nil {
+		return err
+	}
+	a.track(archivedFile{path: name, at: time.Unix(snap.at.Unix(), 0), size: int64(len(snap.data))})
+	return nil
+}
+
+// track adds a written file to files, in order, replacing an earlier one at
+// the same path.
+func (a *SnapshotArchiver) track(f archivedFile) {
+	a.files = slices.DeleteFunc(a.files, func(x archivedFile) bool { return x.path == f.path })
+	i, _ := slices.BinarySearchFunc(a.files, f.at, func(x archivedFile, at time.Time) int { return x.at.Compare(at) })
+	a.files = slices.Insert(a.files, i, f)
+}
+
+// archivedFile is a snapshot in the archive.
+type archivedFile struct {
+	path string
+	at   time.Time
+	size int64
+}
+
+// scan lists the archived snapshots of camera, or of all cameras when it is
+// empty, taken on the UTC dates of from through to.
+func (a *SnapshotArchiver) scan(camera string, from, to time.Time) ([]archivedFile, error) {
+	root, err := os.OpenRoot(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	fromDate := from.UTC().Format(archiveDateLayout)
+	toDate := to.UTC().Format(archiveDateLayout)
+
+	start := "."
+	if camera != "" {
+		start = camera
+	}
+	var files []archivedFile
+	err = fs.WalkDir(root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		parts := strings.Split(p, "/")
+		if d.IsDir() {
+			// <camera>/<date>: skip days outside the range.
+			if len(parts) == 2 && (parts[1] < fromDate || parts[1] > toDate) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if len(parts) != 3 {
+			return nil
+		}
+		ts, err := strconv.ParseInt(strings.TrimSuffix(parts[2], ".jpg"), 10, 64)
+		if err != nil || !strings.HasSuffix(parts[2], ".jpg") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, archivedFile{path: p, at: time.Unix(ts, 0), size: info.Size()})
+		return nil
+	})
+	slices.SortFunc(files, func(x, y archivedFile) int { return x.at.Compare(y.at) })
+	return files, err
+}
+
+// archiveFilesToPrune returns the files, sorted oldest first, that are older
+// than maxAge, followed by the oldest ones that have to go for the rest to fit
+// in maxBytes.
+func archiveFilesToPrune(files []archivedFile, now time.Time, maxAge time.Duration, maxBytes int64) []archivedFile {
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	var prune []archivedFile
+	for _, f := range files {
+		if now.Sub(f.at) <= maxAge && total <= maxBytes {
+			break
+		}
+		prune = append(prune, f)
+		total -= f.size
+	}
+	return prune
+}
+
+// prune deletes the tracked snapshots beyond frigate.archive's max_age and
+// max_size_mb, and the day directories left empty.
+func (a *SnapshotArchiver) prune(now time.Time) {
+	prune := archiveFilesToPrune(a.files, now, a.maxAge, a.maxBytes)
+	if len(prune) == 0 {
+		return
+	}
+	root, err := os.OpenRoot(a.dir)
+	if err != nil {
+		a.log.Warn("pruning snapshot archive failed", "err", err)
+		return
+	}
+	defer root.Close()
+	for _, f := range prune {
+		if err := root.Remove(f.path); err != nil {
+			a.log.Warn("pruning archived snapshot failed", "path", f.path, "err", err)
+		}
+		// Fails while the day still has snapshots.
+		root.Remove(path.Dir(f.path))
+	}
+	// The pruned files are the oldest; they are forgotten even when removing
+	// them failed, so a missing file isn't tried again after every write.
+	a.files = slices.Delete(a.files, 0, len(prune))
+	a.log.Debug("pruned snapshot archive", "removed", len(prune))
+}
+
+// archivedSnapshotResponse is one entry of the camera archive listing.
+type archivedSnapshotResponse struct {
+	Timestamp int64     `json:"timestamp"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+}
+
+type cameraArchiveResponse struct {
+	Camera    string                     `json:"camera"`
+	From      time.Time                  `json:"from"`
+	To        time.Time                  `json:"to"`
+	Snapshots []archivedSnapshotResponse `json:"snapshots"`
+}
+
+// parseArchiveTime parses a from/to query parameter: RFC 3339 or Unix
+// seconds.
+func parseArchiveTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// handleCameraArchiveList lists a camera's archived snapshots between the
+// from and to query parameters, by default the last 24 hours. Requires
+// AuthMiddleware.
+func handleCameraArchiveList(c *fiber.Ctx) error {
+	if snapshotArchiver == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "snapshot archive not configured"})
+	}
+	camera := c.Params("camera")
+	if !validArchiveName(camera) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid camera name"})
+	}
+	to := time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		t, err := parseArchiveTime(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid to"})
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := parseArchiveTime(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid from"})
+		}
+		from = t
+	}
+	if from.After(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from is after to"})
+	}
+
+	files, err := snapshotArchiver.scan(camera, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	resp := cameraArchiveResponse{Camera: camera, From: from, To: to, Snapshots: []archivedSnapshotResponse{}}
+	for _, f := range files {
+		if f.at.Before(from) || f.at.After(to) {
+			continue
+		}
+		resp.Snapshots = append(resp.Snapshots, archivedSnapshotResponse{
+			Timestamp: f.at.Unix(),
+			Time:      f.at.UTC(),
+			URL:       fmt.Sprintf("/api/v1/camera-archive/%s/%d", camera, f.at.Unix()),
+		})
+	}
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.JSON(resp)
+}
+
+// handleCameraArchiveSnapshot serves an archived snapshot by camera and Unix
+// timestamp. Requires AuthMiddleware.
+func handleCameraArchiveSnapshot(c *fiber.Ctx) error {
+	if snapshotArchiver == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "snapshot archive not configured"})
+	}
+	ts, err := strconv.ParseInt(c.Params("timestamp"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid timestamp"})
+	}
+	name, err := archivePath(c.Params("camera"), ts)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	// The root keeps the lookup inside the archive, symlinks included.
+	root, err := os.OpenRoot(snapshotArchiver.dir)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer root.Close()
+	data, err := root.ReadFile(name)
+	if err != nil {
+		// Including links out of the archive, which the root refuses.
+		if !errors.Is(err, fs.ErrNotExist) {
+			snapshotArchiver.log.Warn("reading archived snapshot failed", "path", name, "err", err)
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "snapshot not found"})
+	}
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	// An archived snapshot never changes; the route requires a login.
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400, immutable")
+	return c.Send(data)
+}
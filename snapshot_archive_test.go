@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setupArchiveTest(t *testing.T, archive SnapshotArchiveConfig) (*SnapshotArchiver, *fiber.App) {
+	t.Helper()
+	dataDir := t.TempDir()
+	archive.DataDir = dataDir
+	a := NewSnapshotArchiver(&Config{Frigate: FrigateConfig{Archive: &archive}}, testLogger)
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := snapshotArchiver
+	snapshotArchiver = a
+	t.Cleanup(func() { snapshotArchiver = prev })
+
+	app := fiber.New()
+	app.Get("/api/v1/camera-archive/:camera", handleCameraArchiveList)
+	app.Get("/api/v1/camera-archive/:camera/:timestamp", handleCameraArchiveSnapshot)
+	return a, app
+}
+
+func archiveSnapshots(t *testing.T, a *SnapshotArchiver, camera string, times ...time.Time) {
+	t.Helper()
+	for _, at := range times {
+		if err := a.write(archivedSnapshot{camera: camera, at: at, data: []byte(camera + at.Format(time.RFC3339))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func archivedPaths(t *testing.T, a *SnapshotArchiver) []string {
+	t.Helper()
+	files, err := a.scan("", time.Unix(0, 0), time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+func TestArchiveFilesToPrune(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	files := []archivedFile{
+		{path: "old", at: now.Add(-50 * time.Hour), size: 10},
+		{path: "a", at: now.Add(-3 * time.Hour), size: 10},
+		{path: "b", at: now.Add(-2 * time.Hour), size: 10},
+		{path: "c", at: now.Add(-time.Hour), size: 10},
+	}
+	paths := func(files []archivedFile) []string {
+		var p []string
+		for _, f := range files {
+			p = append(p, f.path)
+		}
+		return p
+	}
+	for _, tc := range []struct {
+		maxAge   time.Duration
+		maxBytes int64
+		want     []string
+	}{
+		{48 * time.Hour, 100, []string{"old"}},
+		{48 * time.Hour, 25, []string{"old", "a"}},
+		{150 * time.Minute, 100, []string{"old", "a"}},
+		{72 * time.Hour, 5, []string{"old", "a", "b", "c"}},
+		{72 * time.Hour, 100, nil},
+	} {
+		if got := paths(archiveFilesToPrune(files, now, tc.maxAge, tc.maxBytes)); !slices.Equal(got, tc.want) {
+			t.Errorf("max age %v, max bytes %d: pruned %v, want %v", tc.maxAge, tc.maxBytes, got, tc.want)
+		}
+	}
+}
+
+func TestSnapshotArchiver_Prune(t *testing.T) {
+	a, _ := setupArchiveTest(t, SnapshotArchiveConfig{MaxAge: "24h"})
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	archiveSnapshots(t, a, "lab", old, now.Add(-time.Hour), now)
+	archiveSnapshots(t, a, "hall", old)
+
+	a.prune(now)
+	want := []string{
+		filepath.ToSlash(mustArchivePath(t, "lab", now.Add(-time.Hour))),
+		filepath.ToSlash(mustArchivePath(t, "lab", now)),
+	}
+	if got := archivedPaths(t, a); !slices.Equal(got, want) {
+		t.Fatalf("archive after pruning by age: %v, want %v", got, want)
+	}
+	// The day directories left empty are gone too.
+	oldDay := old.UTC().Format(archiveDateLayout)
+	for _, camera := range []string{"lab", "hall"} {
+		if _, err := os.Stat(filepath.Join(a.dir, camera, oldDay)); !os.IsNotExist(err) {
+			t.Errorf("%s/%s still exists: %v", camera, oldDay, err)
+		}
+	}
+
+	// Each snapshot is over 20 bytes, so 40 bytes keep only the newest one.
+	a.maxBytes = 40
+	a.prune(now)
+	if got := archivedPaths(t, a); !slices.Equal(got, want[1:]) {
+		t.Fatalf("archive after pruning by size: %v, want %v", got, want[1:])
+	}
+}
+
+func TestSnapshotArchiver_StartTracksExistingSnapshots(t *testing.T) {
+	a, _ := setupArchiveTest(t, SnapshotArchiveConfig{MaxAge: "24h"})
+	now := time.Now()
+	previous := NewSnapshotArchiver(&Config{Frigate: FrigateConfig{Archive: &SnapshotArchiveConfig{DataDir: filepath.Dir(a.dir)}}}, testLogger)
+	archiveSnapshots(t, previous, "lab", now.Add(-72*time.Hour), now.Add(-2*time.Hour))
+
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+	kept := filepath.ToSlash(mustArchivePath(t, "lab", now.Add(-2*time.Hour)))
+	if got := archivedPaths(t, a); !slices.Equal(got, []string{kept}) {
+		t.Fatalf("archive after Start: %v, want %v", got, kept)
+	}
+
+	// Snapshots of the previous run count towards the size without a rescan.
+	a.maxBytes = 40
+	archiveSnapshots(t, a, "hall", now.Add(-time.Hour))
+	a.prune(now)
+	if got := archivedPaths(t, a); !slices.Equal(got, []string{filepath.ToSlash(mustArchivePath(t, "hall", now.Add(-time.Hour)))}) {
+		t.Fatalf("archive after pruning by size: %v", got)
+	}
+}
+
+func mustArchivePath(t *testing.T, camera string, at time.Time) string {
+	t.Helper()
+	p, err := archivePath(camera, at.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestArchivePath_RejectsTraversal(t *testing.T) {
+	for _, camera := range []string{"", ".", "..", "../lab", "lab/..", "a/b", `a\b`, "/etc"} {
+		if p, err := archivePath(camera, 1760529600); err == nil {
+			t.Errorf("camera %q: got path %q", camera, p)
+		}
+	}
+	if _, err := archivePath("lab", -1); err == nil {
+		t.Error("negative timestamp accepted")
+	}
+	if p := mustArchivePath(t, "lab", time.Unix(1760529600, 0)); p != "lab/2025-10-15/1760529600.jpg" {
+		t.Errorf("path %q", p)
+	}
+}
+
+func TestHandleCameraArchiveSnapshot(t *testing.T) {
+	a, app := setupArchiveTest(t, SnapshotArchiveConfig{})
+	at := time.Unix(1760529600, 0)
+	archiveSnapshots(t, a, "lab", at)
+
+	// Something outside the archive, and a link to it from inside.
+	secret := filepath.Join(filepath.Dir(a.dir), "at2.db")
+	os.WriteFile(secret, []byte("secret"), 0o600)
+	day := filepath.Join(a.dir, "lab", at.UTC().Format(archiveDateLayout))
+	if err := os.Symlink(secret, filepath.Join(day, "1760529601.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/api/v1/camera-archive/lab/1760529600", fiber.StatusOK},
+		{"/api/v1/camera-archive/lab/1760529660", fiber.StatusNotFound},
+		{"/api/v1/camera-archive/lab/1760529601", fiber.StatusNotFound},
+		{"/api/v1/camera-archive/lab/..%2F..%2Fat2.db", fiber.StatusBadRequest},
+		// Parameters aren't unescaped; these are names no camera has.
+		{"/api/v1/camera-archive/..%2F..%2F/1760529600", fiber.StatusNotFound},
+		{"/api/v1/camera-archive/%2e%2e/1760529600", fiber.StatusNotFound},
+		{"/api/v1/camera-archive/lab%5C..%5C../1760529600", fiber.StatusNotFound},
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", tc.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tc.want || bytes.Contains(body, []byte("secret")) {
+			t.Errorf("%s: %d %q, want %d", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestHandleCameraArchiveList(t *testing.T) {
+	a, app := setupArchiveTest(t, SnapshotArchiveConfig{})
+	day := time.Date(2026, 10, 14, 23, 50, 0, 0, time.UTC)
+	archiveSnapshots(t, a, "lab", day.Add(-24*time.Hour), day, day.Add(10*time.Minute), day.Add(20*time.Minute))
+	archiveSnapshots(t, a, "hall", day)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/camera-archive/lab?from=2026-10-14T23:45:00Z&to="+strconv.FormatInt(day.Add(10*time.Minute).Unix(), 10), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list cameraArchiveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	for _, s := range list.Snapshots {
+		got = append(got, s.Timestamp)
+	}
+	// 2026-10-14T23:50Z and 2026-10-15T00:00Z, across the date directories.
+	if want := []int64{day.Unix(), day.Add(10 * time.Minute).Unix()}; !slices.Equal(got, want) {
+		t.Fatalf("timestamps %v, want %v", got, want)
+	}
+	if list.Snapshots[0].URL != fmt.Sprintf("/api/v1/camera-archive/lab/%d", day.Unix()) {
+		t.Errorf("url %q", list.Snapshots[0].URL)
+	}
+
+	for _, path := range []string{
+		"/api/v1/camera-archive/lab?from=yesterday",
+		"/api/v1/camera-archive/lab?from=2026-10-15T00:00:00Z&to=2026-10-14T23:50:00Z",
+	} {
+		if resp, _ := app.Test(httptest.NewRequest("GET", path, nil)); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: %d", path, resp.StatusCode)
+		}
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/api/v1/camera-archive/garage", nil))
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != fiber.StatusOK || !bytes.Contains(body, []byte(`"snapshots":[]`)) {
+		t.Errorf("unknown camera: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestFetchCameraSnapshot_OffersMidSizeToArchive(t *testing.T) {
+	frigate, _ := frigateSnapshotStub(t)
+	cfg := &Config{Frigate: FrigateConfig{Url: frigate.URL, Archive: &SnapshotArchiveConfig{DataDir: t.TempDir()}}}
+	s := NewFrigateSnapshotMapper(NewVdevManager(), cfg, testLogger)
+	s.archiver = NewSnapshotArchiver(cfg, testLogger)
+
+	if _, _, err := s.fetchCameraSnapshot("lab"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case snap := <-s.archiver.queue:
+		img, err := jpeg.DecodeConfig(bytes.NewReader(snap.data))
+		if err != nil || img.Width != 600 {
+			t.Fatalf("archived %dpx wide (%v), want the 600px variant", img.Width, err)
+		}
+	default:
+		t.Fatal("nothing offered to the archive")
+	}
+
+	// The next fetch in the same interval isn't archived again.
+	if _, _, err := s.fetchCameraSnapshot("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.archiver.queue) != 0 {
+		t.Error("archived twice in one interval")
+	}
+}
+
+func TestValidateSnapshotArchiveConfig(t *testing.T) {
+	for _, tc := range []struct {
+		archive *SnapshotArchiveConfig
+		ok      bool
+	}{
+		{nil, true},
+		{&SnapshotArchiveConfig{Interval: "5m", MaxAge: "720h", MaxSizeMB: 200}, true},
+		{&SnapshotArchiveConfig{Interval: "0s"}, false},
+		{&SnapshotArchiveConfig{MaxAge: "a week"}, false},
+		{&SnapshotArchiveConfig{MaxSizeMB: -1}, false},
+	} {
+		err := validateSnapshotArchiveConfig(&Config{Frigate: FrigateConfig{Archive: tc.archive}}, "at2.yaml")
+		if (err == nil) != tc.ok {
+			t.Errorf("%+v: err = %v", tc.archive, err)
+		}
+	}
+}
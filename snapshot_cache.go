@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultSnapshotCacheMB is frigate.snapshots.cache_max_mb when it isn't set.
+const defaultSnapshotCacheMB = 64
+
+// cachedSnapshot is a snapshot variant with its validators.
+type cachedSnapshot struct {
+	data        []byte
+	contentType string
+	etag        string
+	// modified is when the content last changed, in whole seconds like
+	// Last-Modified.
+	modified time.Time
+}
+
+// snapshotVariant is one variant of a fetch, to be cached under filename.
+type snapshotVariant struct {
+	filename string
+	data     []byte
+}
+
+type snapshotCacheEntry struct {
+	cachedSnapshot
+	filename string
+}
+
+// snapshotCache holds the snapshot variants of all cameras within a byte
+// budget. A camera's variants are replaced together when a fetch completes;
+// when the budget is exceeded the least recently served variants are evicted.
+type snapshotCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	// lru holds *snapshotCacheEntry, most recently served or stored first.
+	lru       list.List
+	entries   map[string]*list.Element
+	cameras   map[string][]string
+	evictions int
+}
+
+func newSnapshotCache(maxBytes int) *snapshotCache {
+	return &snapshotCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		cameras:  map[string][]string{},
+	}
+}
+
+// snapshotCacheBytes returns the cache budget set by
+// frigate.snapshots.cache_max_mb.
+func snapshotCacheBytes(cfg *Config) int {
+	mb := cfg.Frigate.Snapshots.CacheMaxMB
+	if mb <= 0 {
+		mb = defaultSnapshotCacheMB
+	}
+	return mb << 20
+}
+
+// replace makes variants the camera's cached variants, dropping the ones of
+// its previous fetch. An unchanged image keeps its validators, so clients
+// keep getting 304s.
+func (c *snapshotCache) replace(camera string, variants []snapshotVariant, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	filenames := make([]string, 0, len(variants))
+	for _, v := range variants {
+		filenames = append(filenames, v.filename)
+		etag := bodyETag(v.data)
+		if el, ok := c.entries[v.filename]; ok {
+			entry := el.Value.(*snapshotCacheEntry)
+			if entry.etag == etag {
+				continue
+			}
+			c.remove(el)
+		}
+		entry := &snapshotCacheEntry{
+			cachedSnapshot: cachedSnapshot{
+				data:        v.data,
+				contentType: snapshotContentType(v.filename),
+				etag:        etag,
+				modified:    now.UTC().Truncate(time.Second),
+			},
+			filename: v.filename,
+		}
+		c.entries[v.filename] = c.lru.PushFront(entry)
+		c.size += len(v.data)
+	}
+	for _, old := range c.cameras[camera] {
+		if el, ok := c.entries[old]; ok && !slices.Contains(filenames, old) {
+			c.remove(el)
+		}
+	}
+	c.cameras[camera] = filenames
+	c.evict()
+}
+
+// get returns a cached variant and marks it as recently served.
+func (c *snapshotCache) get(filename string) (cachedSnapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[filename]
+	if !ok {
+		return cachedSnapshot{}, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*snapshotCacheEntry).cachedSnapshot, true
+}
+
+// retainCameras drops the variants of cameras not in names.
+func (c *snapshotCache) retainCameras(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for camera, filenames := range c.cameras {
+		if slices.Contains(names, camera) {
+			continue
+		}
+		for _, filename := range filenames {
+			if el, ok := c.entries[filename]; ok {
+				c.remove(el)
+			}
+		}
+		delete(c.cameras, camera)
+	}
+}
+
+// reset drops every variant and sets a new budget.
+func (c *snapshotCache) reset(maxBytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.entries)
+	clear(c.cameras)
+	c.size = 0
+	c.maxBytes = maxBytes
+}
+
+// remove drops an entry; the caller holds mu. The camera's filename list
+// keeps the name, which is harmless: lookups go through entries.
+func (c *snapshotCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*snapshotCacheEntry)
+	delete(c.entries, entry.filename)
+	c.size -= len(entry.data)
+}
+
+// evict removes the least recently served variants until the cache fits its
+// budget; the caller holds mu.
+func (c *snapshotCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// SnapshotCacheStats describes the snapshot cache for the debug stats.
+type SnapshotCacheStats struct {
+	Bytes     int `json:"bytes"`
+	MaxBytes  int `json:"max_bytes"`
+	Entries   int `json:"entries"`
+	Evictions int `json:"evictions"`
+}
+
+func (c *snapshotCache) stats() SnapshotCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SnapshotCacheStats{Bytes: c.size, MaxBytes: c.maxBytes, Entries: c.lru.Len(), Evictions: c.evictions}
+}
+
+// snapshotCacheStats returns the stats of the running snapshot mapper's
+// cache, zero before it exists.
+func snapshotCacheStats() SnapshotCacheStats {
+	if frigateSnapshotMapper == nil {
+		return SnapshotCacheStats{}
+	}
+	return frigateSnapshotMapper.cache.stats()
+}
+
+// newSnapshotCacheMetrics returns the snapshot cache metrics, read from the
+// running snapshot mapper at scrape time.
+func newSnapshotCacheMetrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "at2_snapshot_cache_bytes",
+			Help: "Bytes of camera snapshot variants cached",
+		}, func() float64 { return float64(snapshotCacheStats().Bytes) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "at2_snapshot_cache_entries",
+			Help: "Camera snapshot variants cached",
+		}, func() float64 { return float64(snapshotCacheStats().Entries) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "at2_snapshot_cache_evictions_total",
+			Help: "Camera snapshot variants evicted to stay within frigate.snapshots.cache_max_mb",
+		}, func() float64 { return float64(snapshotCacheStats().Evictions) }),
+	}
+}
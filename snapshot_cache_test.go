@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cachedFilenames(c *snapshotCache) []string {
+	var names []string
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		names = append(names, el.Value.(*snapshotCacheEntry).filename)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestSnapshotCache_Replace(t *testing.T) {
+	c := newSnapshotCache(1 << 20)
+	now := time.Date(2026, 10, 15, 18, 30, 12, 0, time.UTC)
+	c.replace("lab", []snapshotVariant{{"lab_orig.jpg", []byte("orig 1")}, {"lab_600.jpg", []byte("600 1")}}, now)
+	c.replace("hall", []snapshotVariant{{"hall_orig.jpg", []byte("hall")}}, now)
+	unchanged, _ := c.get("lab_orig.jpg")
+
+	// The next fetch no longer produces lab_600.jpg; the image is unchanged.
+	c.replace("lab", []snapshotVariant{{"lab_orig.jpg", []byte("orig 1")}, {"lab_300.jpg", []byte("300 2")}}, now.Add(time.Minute))
+	if got, want := cachedFilenames(c), []string{"hall_orig.jpg", "lab_300.jpg", "lab_orig.jpg"}; !slices.Equal(got, want) {
+		t.Fatalf("cached %v, want %v", got, want)
+	}
+	if snap, _ := c.get("lab_orig.jpg"); snap.etag != unchanged.etag || !snap.modified.Equal(now) {
+		t.Errorf("unchanged variant got new validators: %+v", snap)
+	}
+	if stats := c.stats(); stats.Bytes != len("orig 1")+len("300 2")+len("hall") || stats.Entries != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	c.replace("lab", []snapshotVariant{{"lab_orig.jpg", []byte("orig 22")}}, now.Add(2*time.Minute))
+	if snap, _ := c.get("lab_orig.jpg"); string(snap.data) != "orig 22" || !snap.modified.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("changed variant: %+v", snap)
+	}
+	if stats := c.stats(); stats.Bytes != len("orig 22")+len("hall") {
+		t.Errorf("bytes = %d after replacing with a larger image", stats.Bytes)
+	}
+}
+
+func TestSnapshotCache_EvictsLeastRecentlyServed(t *testing.T) {
+	c := newSnapshotCache(30)
+	now := time.Now()
+	c.replace("a", []snapshotVariant{{"a_orig.jpg", make([]byte, 10)}}, now)
+	c.replace("b", []snapshotVariant{{"b_orig.jpg", make([]byte, 10)}}, now)
+	c.replace("c", []snapshotVariant{{"c_orig.jpg", make([]byte, 10)}}, now)
+	// a is served, so b is now the least recently used.
+	c.get("a_orig.jpg")
+
+	c.replace("d", []snapshotVariant{{"d_orig.jpg", make([]byte, 10)}}, now)
+	if got, want := cachedFilenames(c), []string{"a_orig.jpg", "c_orig.jpg", "d_orig.jpg"}; !slices.Equal(got, want) {
+		t.Fatalf("cached %v, want %v", got, want)
+	}
+	c.replace("e", []snapshotVariant{{"e_orig.jpg", make([]byte, 20)}}, now)
+	if got, want := cachedFilenames(c), []string{"d_orig.jpg", "e_orig.jpg"}; !slices.Equal(got, want) {
+		t.Fatalf("cached %v, want %v", got, want)
+	}
+	if stats := c.stats(); stats.Bytes != 30 || stats.Evictions != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// A variant over the whole budget isn't kept at all.
+	c.replace("f", []snapshotVariant{{"f_orig.jpg", make([]byte, 40)}}, now)
+	if _, ok := c.get("f_orig.jpg"); ok || c.stats().Bytes != 0 {
+		t.Errorf("kept a variant over budget: %+v", c.stats())
+	}
+}
+
+func TestFetchCameraNames_DropsRemovedCameras(t *testing.T) {
+	var cameras atomic.Value
+	cameras.Store(`{"cameras": {"lab": {}, "hall": {}}}`)
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(cameras.Load().(string)))
+	}))
+	defer frigate.Close()
+
+	s := NewFrigateSnapshotMapper(NewVdevManager(), &Config{Frigate: FrigateConfig{Url: frigate.URL}}, testLogger)
+	if err := s.fetchCameraNames(); err != nil {
+		t.Fatal(err)
+	}
+	s.cache.replace("lab", []snapshotVariant{{"lab_orig.jpg", []byte("lab")}, {"lab_600.jpg", []byte("lab")}}, time.Now())
+	s.cache.replace("hall", []snapshotVariant{{"hall_orig.jpg", []byte("hall")}}, time.Now())
+
+	cameras.Store(`{"cameras": {"hall": {}}}`)
+	if err := s.fetchCameraNames(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedFilenames(s.cache); !slices.Equal(got, []string{"hall_orig.jpg"}) {
+		t.Fatalf("cached %v after lab was removed", got)
+	}
+	if _, err := s.GetCachedSnapshot("lab_orig.jpg"); err == nil {
+		t.Error("removed camera's snapshot still served")
+	}
+}
+
+func TestValidateSnapshotsConfig_CacheMaxMB(t *testing.T) {
+	cfg := &Config{Frigate: FrigateConfig{Snapshots: SnapshotsConfig{CacheMaxMB: -1}}}
+	if err := validateSnapshotsConfig(cfg, "at2.yaml"); err == nil {
+		t.Error("negative cache_max_mb accepted")
+	}
+	cfg.Frigate.Snapshots.CacheMaxMB = 0
+	if got := snapshotCacheBytes(cfg); got != 64<<20 {
+		t.Errorf("default budget %d", got)
+	}
+}
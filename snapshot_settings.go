@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SnapshotSettings tunes the snapshot variants generated for cameras. Zero
+// values keep the default.
+type SnapshotSettings struct {
+	// Widths of the resized variants in px; widths not below the source
+	// image's are skipped. Default [300, 600, 900].
+	Widths []int `yaml:"widths"`
+	// Quality is the JPEG quality of the resized variants, and the WebP
+	// quality Frigate encodes with, 1-100. Default 85.
+	Quality int `yaml:"quality"`
+	// SourceHeight is the height in px the snapshot is requested from Frigate
+	// in. Default 1080.
+	SourceHeight int `yaml:"source_height"`
+	// Interval is a Go duration: how often snapshots are fetched, and so how
+	// long clients may cache one. Default "1m".
+	Interval string `yaml:"interval"`
+	// Formats the variants are stored in, "jpeg" and/or "webp", listed in
+	// the snapshot state in this order. WebP variants are encoded by Frigate
+	// and served in place of JPEG to clients accepting WebP. Default
+	// ["jpeg"].
+	Formats []string `yaml:"formats"`
+}
+
+// SnapshotsConfig is frigate.snapshots: settings for all cameras, and
+// overrides of them by camera name.
+type SnapshotsConfig struct {
+	SnapshotSettings `yaml:",inline"`
+	Cameras          map[string]SnapshotSettings `yaml:"cameras"`
+	// CacheMaxMB caps the memory the cached variants of all cameras take, in
+	// MiB; the least recently served variants are evicted beyond it.
+	// Default 64.
+	CacheMaxMB int `yaml:"cache_max_mb"`
+}
+
+// snapshotSettings are the SnapshotSettings in effect for one camera.
+type snapshotSettings struct {
+	widths       []int
+	quality      int
+	sourceHeight int
+	interval     time.Duration
+	formats      []string
+}
+
+var defaultSnapshotSettings = snapshotSettings{
+	widths:       []int{300, 600, 900},
+	quality:      85,
+	sourceHeight: 1080,
+	interval:     time.Minute,
+	formats:      []string{"jpeg"},
+}
+
+// snapshotFormat is the file extension and media type of a variant format.
+type snapshotFormat struct {
+	ext       string
+	mediaType string
+}
+
+var snapshotFormats = map[string]snapshotFormat{
+	"jpeg": {ext: "jpg", mediaType: "image/jpeg"},
+	"webp": {ext: "webp", mediaType: "image/webp"},
+}
+
+// forCamera resolves the settings of a camera: its override, then the
+// frigate.snapshots settings, then the defaults.
+func (sc SnapshotsConfig) forCamera(name string) snapshotSettings {
+	settings := defaultSnapshotSettings.with(sc.SnapshotSettings)
+	if override, ok := sc.Cameras[name]; ok {
+		settings = settings.with(override)
+	}
+	return settings
+}
+
+func (s snapshotSettings) with(o SnapshotSettings) snapshotSettings {
+	if len(o.Widths) > 0 {
+		s.widths = o.Widths
+	}
+	if o.Quality > 0 {
+		s.quality = o.Quality
+	}
+	if o.SourceHeight > 0 {
+		s.sourceHeight = o.SourceHeight
+	}
+	if d, err := time.ParseDuration(o.Interval); err == nil && d > 0 {
+		s.interval = d
+	}
+	if len(o.Formats) > 0 {
+		s.formats = o.Formats
+	}
+	return s
+}
+
+// validateSnapshotsConfig rejects snapshot settings that can't be used.
+func validateSnapshotsConfig(cfg *Config, cfgPath string) error {
+	check := func(field string, s SnapshotSettings) error {
+		if slices.ContainsFunc(s.Widths, func(w int) bool { return w <= 0 }) {
+			return fmt.Errorf("%s.widths must be positive (%v) in %s", field, s.Widths, cfgPath)
+		}
+		if s.Quality < 0 || s.Quality > 100 {
+			return fmt.Errorf("%s.quality must be between 1 and 100 (%d) in %s", field, s.Quality, cfgPath)
+		}
+		if s.SourceHeight < 0 {
+			return fmt.Errorf("%s.source_height must not be negative in %s", field, cfgPath)
+		}
+		if s.Interval != "" {
+			if d, err := time.ParseDuration(s.Interval); err != nil || d <= 0 {
+				return fmt.Errorf("%s.interval is not a valid duration (%q) in %s", field, s.Interval, cfgPath)
+			}
+		}
+		for _, format := range s.Formats {
+			if _, ok := snapshotFormats[format]; !ok {
+				return fmt.Errorf("%s.formats: unknown format %q (jpeg or webp) in %s", field, format, cfgPath)
+			}
+		}
+		if len(slices.Compact(slices.Sorted(slices.Values(s.Formats)))) != len(s.Formats) {
+			return fmt.Errorf("%s.formats lists a format twice in %s", field, cfgPath)
+		}
+		return nil
+	}
+	snapshots := cfg.Frigate.Snapshots
+	if snapshots.CacheMaxMB < 0 {
+		return fmt.Errorf("frigate.snapshots.cache_max_mb must not be negative in %s", cfgPath)
+	}
+	if err := check("frigate.snapshots", snapshots.SnapshotSettings); err != nil {
+		return err
+	}
+	for name, override := range snapshots.Cameras {
+		if err := check("frigate.snapshots.cameras."+name, override); err != nil {
+			return err
+		}
+	}
+	return nil
+}
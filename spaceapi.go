@@ -1,14 +1,39 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// handleSpaceAPI serves the SpaceAPI document from spaceAPIResponseCache,
+// answering 304 when the client already has the current version.
 func handleSpaceAPI(c *fiber.Ctx) error {
-	cfg := MustLoadConfig()
+	cfg := GetConfig()
+	body, etag, err := spaceAPIResponseCache.get(time.Now(), spaceAPICacheTTL(cfg), func() ([]byte, error) {
+		return marshalSpaceAPI(buildSpaceAPI(cfg), cfg.SpaceAPI.Ext)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(body)
+}
+
+// buildSpaceAPI assembles the SpaceAPI document from the config and the
+// current device states.
+func buildSpaceAPI(cfg *Config) A15Json {
 	devices := vdevManager.Devices()
 	deviceMap := make(map[string]*VirtualDevice)
 	for _, dev := range devices {
@@ -45,18 +70,25 @@ func handleSpaceAPI(c *fiber.Ctx) error {
 		},
 		Sensors: &A15JsonSensors{},
 		State: &A15JsonState{
-			Open: boolPtr(false),
+			Open:    spaceOpen(cfg, deviceMap),
+			Message: stringPtr(cfg.SpaceAPI.Message),
 		},
 	}
 
-	for _, room := range cfg.Rooms {
-		roomLabel := room.ID
-		if name, ok := room.LocalizedName["en"]; ok && name != "" {
-			roomLabel = name
+	if spaceStateService != nil {
+		if lastChange, ok := spaceStateService.LastChange(); ok {
+			ts := float64(lastChange.Unix())
+			api.State.Lastchange = &ts
 		}
+	}
+
+	for _, room := range cfg.Rooms {
+		roomLabel := cmp.Or(room.LocalizedName.Resolve("en"), room.ID)
 
 		roomPeopleCount := 0.0
 		hasPeopleSensor := false
+		var peopleDescription *string
+		var peopleNames []string
 		roomPowerUsage := 0.0
 		hasPowerUsageSensor := false
 
@@ -66,34 +98,70 @@ func handleSpaceAPI(c *fiber.Ctx) error {
 				continue
 			}
 
-			entityName := entity.ID
-			if name, ok := entity.LocalizedName["en"]; ok && name != "" {
-				entityName = name
+			entityName := cmp.Or(entity.LocalizedName.Resolve("en"), entity.ID)
+			var description *string
+			if o := entity.SpaceAPI; o != nil {
+				if o.Name != "" {
+					entityName = o.Name
+				}
+				description = stringPtr(o.Description)
 			}
 
 			val, isValid := toFloat64Internal(dev.State)
 			if !isValid {
 				continue
 			}
+			// A state that isn't fresh, e.g. restored after a restart, is
+			// unknown unless spaceapi.stale_sensor_types lists its type;
+			// then lastchange tells how old it is.
+			var lastchange *float64
+			if !dev.Fresh {
+				if !slices.Contains(cfg.SpaceAPI.StaleSensorTypes, string(dev.Type)) {
+					continue
+				}
+				if !dev.LastUpdatedAt.IsZero() {
+					t := float64(dev.LastUpdatedAt.Unix())
+					lastchange = &t
+				}
+			}
 
 			switch dev.Type {
 			case VdevTypeTemperature:
 				api.Sensors.Temperature = append(api.Sensors.Temperature, A15JsonSensorsTemperatureElem{
-					Location: roomLabel,
-					Name:     &entityName,
-					Unit:     A15JsonSensorsTemperatureElemUnitC,
-					Value:    val,
+					Location:    roomLabel,
+					Name:        &entityName,
+					Description: description,
+					Unit:        A15JsonSensorsTemperatureElemUnitC,
+					Value:       val,
+					Lastchange:  lastchange,
 				})
 			case VdevTypeHumidity:
 				api.Sensors.Humidity = append(api.Sensors.Humidity, A15JsonSensorsHumidityElem{
-					Location: roomLabel,
-					Name:     &entityName,
-					Unit:     A15JsonSensorsHumidityElemUnitUndefined,
-					Value:    val,
+					Location:    roomLabel,
+					Name:        &entityName,
+					Description: description,
+					Unit:        A15JsonSensorsHumidityElemUnitUndefined,
+					Value:       val,
+					Lastchange:  lastchange,
+				})
+			case VdevTypeCO2:
+				api.Sensors.Carbondioxide = append(api.Sensors.Carbondioxide, A15JsonSensorsCarbondioxideElem{
+					Location:    roomLabel,
+					Name:        &entityName,
+					Description: description,
+					Unit:        A15JsonSensorsCarbondioxideElemUnitPpm,
+					Value:       val,
+					Lastchange:  lastchange,
 				})
 			case VdevTypePerson:
 				roomPeopleCount += val
 				hasPeopleSensor = true
+				if peopleDescription == nil {
+					peopleDescription = description
+				}
+				if entity.SpaceAPI != nil && val > 0 {
+					peopleNames = append(peopleNames, entity.SpaceAPI.Names...)
+				}
 			case VdevTypePowerUsage:
 				roomPowerUsage += val
 				hasPowerUsageSensor = true
@@ -102,8 +170,10 @@ func handleSpaceAPI(c *fiber.Ctx) error {
 
 		if hasPeopleSensor {
 			api.Sensors.PeopleNowPresent = append(api.Sensors.PeopleNowPresent, A15JsonSensorsPeopleNowPresentElem{
-				Location: &roomLabel,
-				Value:    roomPeopleCount,
+				Location:    &roomLabel,
+				Description: peopleDescription,
+				Names:       peopleNames,
+				Value:       roomPeopleCount,
 			})
 		}
 
@@ -125,16 +195,9 @@ func handleSpaceAPI(c *fiber.Ctx) error {
 			Name:  stringPtr("total"),
 			Value: totalPeople,
 		})
-		if totalPeople > 0 {
-			api.State.Open = boolPtr(true)
-		}
 	}
 
-	if len(api.Sensors.PowerConsumption) > 0 {
-		totalPower := 0.0
-		for _, p := range api.Sensors.PowerConsumption {
-			totalPower += p.Value
-		}
+	if totalPower, ok := spaceTotalPower(cfg, deviceMap, api.Sensors.PowerConsumption); ok {
 		api.Sensors.PowerConsumption = append(api.Sensors.PowerConsumption, A15JsonSensorsPowerConsumptionElem{
 			Name:     stringPtr("total"),
 			Location: "total",
@@ -143,7 +206,130 @@ func handleSpaceAPI(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(api)
+	return api
+}
+
+// marshalSpaceAPI encodes the document with the configured ext_ fields added
+// at the top level. Schema fields always win over ext entries.
+func marshalSpaceAPI(api A15Json, ext map[string]any) ([]byte, error) {
+	body, err := json.Marshal(api)
+	if err != nil || len(ext) == 0 {
+		return body, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	for key, value := range ext {
+		if _, exists := doc[key]; exists {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("spaceapi.ext.%s: %w", key, err)
+		}
+		doc[key] = raw
+	}
+	return json.Marshal(doc)
+}
+
+// validateSpaceAPIConfig fails fast on spaceapi options that can't be used.
+func validateSpaceAPIConfig(cfg *Config, cfgPath string) error {
+	if ttl := cfg.SpaceAPI.CacheTTL; ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil || d < 0 {
+			return fmt.Errorf("spaceapi.cache_ttl is not a duration (%q) in %s", ttl, cfgPath)
+		}
+	}
+	if v := cfg.SpaceAPI.CalendarLookback; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("spaceapi.calendar_lookback is not a positive duration (%q) in %s", v, cfgPath)
+		}
+	}
+	for _, typ := range cfg.SpaceAPI.StaleSensorTypes {
+		switch VdevType(typ) {
+		case VdevTypeTemperature, VdevTypeHumidity, VdevTypeCO2:
+		default:
+			return fmt.Errorf("spaceapi.stale_sensor_types has %q, not temperature, humidity or co2, in %s", typ, cfgPath)
+		}
+	}
+	for key, value := range cfg.SpaceAPI.Ext {
+		if !strings.HasPrefix(key, "ext_") || key == "ext_" {
+			return fmt.Errorf("spaceapi.ext key %q must start with \"ext_\" in %s", key, cfgPath)
+		}
+		if _, err := json.Marshal(value); err != nil {
+			return fmt.Errorf("spaceapi.ext.%s can't be encoded as JSON in %s: %v", key, cfgPath, err)
+		}
+	}
+	return nil
+}
+
+// spaceOpen decides state.open according to spaceapi.open_source. It returns
+// nil (open state unknown) when the configured device is missing or has no
+// usable state.
+func spaceOpen(cfg *Config, deviceMap map[string]*VirtualDevice) *bool {
+	source := cfg.SpaceAPI.OpenSource
+	if source != "" && source != SpaceAPIOpenSourcePeople {
+		dev, ok := deviceMap[source]
+		if !ok {
+			return nil
+		}
+		val, isValid := toFloat64Internal(dev.State)
+		if !isValid {
+			return nil
+		}
+		return boolPtr(val > 0)
+	}
+	people, known := spacePeopleCount(cfg, deviceMap)
+	if !known {
+		return nil
+	}
+	return boolPtr(people > 0)
+}
+
+// spacePeopleCount sums the fresh states of the person entities of all
+// rooms. known is false when there are person entities but none of them is
+// fresh, e.g. right after a restart.
+func spacePeopleCount(cfg *Config, deviceMap map[string]*VirtualDevice) (people float64, known bool) {
+	sensors := 0
+	for _, room := range cfg.Rooms {
+		for _, entity := range room.Entities {
+			dev, ok := deviceMap[entity.ID]
+			if !ok || dev.Type != VdevTypePerson {
+				continue
+			}
+			sensors++
+			if !dev.Fresh {
+				continue
+			}
+			if val, isValid := toFloat64Internal(dev.State); isValid {
+				people += val
+				known = true
+			}
+		}
+	}
+	return people, known || sensors == 0
+}
+
+// spaceTotalPower returns the total power consumption: the reading of
+// spaceapi.power_total_device when configured, otherwise the sum of the room
+// entries. ok is false when there is nothing to report.
+func spaceTotalPower(cfg *Config, deviceMap map[string]*VirtualDevice, rooms []A15JsonSensorsPowerConsumptionElem) (float64, bool) {
+	if id := cfg.SpaceAPI.PowerTotalDevice; id != "" {
+		dev, ok := deviceMap[id]
+		if !ok || dev.Type != VdevTypePowerUsage || !dev.Fresh {
+			return 0, false
+		}
+		return toFloat64Internal(dev.State)
+	}
+
+	if len(rooms) == 0 {
+		return 0, false
+	}
+	total := 0.0
+	for _, p := range rooms {
+		total += p.Value
+	}
+	return total, true
 }
 
 func toFloat64Internal(v any) (float64, bool) {
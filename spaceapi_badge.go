@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Badge styles of /badge.svg, after the shields.io styles of the same name.
+const (
+	badgeStyleFlat       = "flat"
+	badgeStyleFlatSquare = "flat-square"
+)
+
+// Badge message colors by open state.
+const (
+	badgeColorOpen    = "#4c1"
+	badgeColorClosed  = "#e05d44"
+	badgeColorUnknown = "#9f9f9f"
+)
+
+// badgeCacheControl keeps the badge fresh enough to follow the open state
+// while sparing the server from embeds reloading it.
+const badgeCacheControl = "public, max-age=5"
+
+// badgeCharWidths are the advance widths, in pixels, of the printable ASCII
+// characters (from ' ') in 11px Verdana, the badge font.
+var badgeCharWidths = [...]float64{
+	3.87, 4.33, 5.05, 9.0, 7.0, 11.84, 8.0, 2.95, 4.99, 4.99, 7.0, 9.0, 4.0, 4.99, 4.0, 4.99, // ' ' to '/'
+	7.0, 7.0, 7.0, 7.0, 7.0, 7.0, 7.0, 7.0, 7.0, 7.0, 4.99, 4.99, 9.0, 9.0, 9.0, 6.0, // '0' to '?'
+	11.0, 7.52, 7.54, 7.68, 8.48, 6.96, 6.32, 8.53, 8.27, 4.63, 5.0, 7.62, 6.12, 9.27, 8.23, 8.66, // '@' to 'O'
+	6.63, 8.66, 7.65, 7.52, 6.78, 8.05, 7.52, 10.88, 7.54, 6.77, 7.54, 4.99, 4.99, 4.99, 9.0, 7.0, // 'P' to '_'
+	7.0, 6.61, 6.85, 5.73, 6.85, 6.55, 3.87, 6.85, 6.96, 3.02, 3.79, 6.51, 3.02, 10.7, 6.96, 6.68, // '`' to 'o'
+	6.85, 6.85, 4.69, 5.73, 4.33, 6.96, 6.51, 9.0, 6.51, 6.51, 5.78, 6.98, 4.99, 6.98, 9.0, // 'p' to '~'
+}
+
+// badgeFallbackWidth is used for characters outside printable ASCII, about
+// the width of an average letter with a diacritic.
+const badgeFallbackWidth = 7.0
+
+// badgeTextWidth estimates the rendered width of s in 11px Verdana.
+func badgeTextWidth(s string) float64 {
+	width := 0.0
+	for _, r := range s {
+		if i := int(r) - ' '; i >= 0 && i < len(badgeCharWidths) {
+			width += badgeCharWidths[i]
+		} else {
+			width += badgeFallbackWidth
+		}
+	}
+	return width
+}
+
+// badgeMessage describes the open state and the people count, with the
+// color of the state.
+func badgeMessage(open *bool, people int) (string, string) {
+	switch {
+	case open == nil:
+		return "unknown", badgeColorUnknown
+	case !*open:
+		return "closed", badgeColorClosed
+	case people == 1:
+		return "open, 1 person", badgeColorOpen
+	case people > 1:
+		return fmt.Sprintf("open, %d people", people), badgeColorOpen
+	}
+	return "open", badgeColorOpen
+}
+
+// renderBadge draws a two-part badge: the label on grey and the message on
+// color, each padded by 5px on both sides.
+func renderBadge(label, message, color, style string) string {
+	labelWidth := int(math.Round(badgeTextWidth(label))) + 10
+	messageWidth := int(math.Round(badgeTextWidth(message))) + 10
+	width := labelWidth + messageWidth
+	label, message = html.EscapeString(label), html.EscapeString(message)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, message)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, message)
+	if style == badgeStyleFlatSquare {
+		b.WriteString(`<g shape-rendering="crispEdges">`)
+		fmt.Fprintf(&b, `<rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/>`, labelWidth, labelWidth, messageWidth, color)
+		b.WriteString(`</g>`)
+	} else {
+		b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+		fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, width)
+		b.WriteString(`<g clip-path="url(#r)">`)
+		fmt.Fprintf(&b, `<rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/>`, labelWidth, labelWidth, messageWidth, color, width)
+		b.WriteString(`</g>`)
+	}
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	for _, part := range []struct {
+		text string
+		x    float64
+	}{{label, float64(labelWidth) / 2}, {message, float64(labelWidth) + float64(messageWidth)/2}} {
+		if style != badgeStyleFlatSquare {
+			// The text shadow of the flat style.
+			fmt.Fprintf(&b, `<text x="%g" y="15" fill="#010101" fill-opacity=".3">%s</text>`, part.x, part.text)
+		}
+		fmt.Fprintf(&b, `<text x="%g" y="14">%s</text>`, part.x, part.text)
+	}
+	b.WriteString(`</g></svg>`)
+	return b.String()
+}
+
+// handleBadge serves an SVG badge with the open state and the people count
+// of the space, from the same data as SpaceAPI. ?style= is flat (default)
+// or flat-square.
+func handleBadge(c *fiber.Ctx) error {
+	cfg := GetConfig()
+	style := c.Query("style", badgeStyleFlat)
+	if style != badgeStyleFlat && style != badgeStyleFlatSquare {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("style must be %s or %s", badgeStyleFlat, badgeStyleFlatSquare)})
+	}
+	deviceMap := make(map[string]*VirtualDevice)
+	for _, dev := range vdevManager.Devices() {
+		deviceMap[dev.ID] = dev
+	}
+	people, _ := spacePeopleCount(cfg, deviceMap)
+	message, color := badgeMessage(spaceOpen(cfg, deviceMap), int(people))
+	label := cmp.Or(cfg.SpaceAPI.BadgeLabel, cfg.SpaceAPI.Space, "space")
+
+	c.Set(fiber.HeaderContentType, "image/svg+xml")
+	c.Set(fiber.HeaderCacheControl, badgeCacheControl)
+	return c.SendString(renderBadge(label, message, color, style))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRenderBadge_Golden(t *testing.T) {
+	open, closed := true, false
+	for _, tc := range []struct {
+		golden, label, style string
+		open                 *bool
+		people               int
+	}{
+		{"badge_open.svg", "Hackerspace Kraków", badgeStyleFlat, &open, 3},
+		{"badge_closed.svg", "hs <krk>", badgeStyleFlatSquare, &closed, 0},
+		{"badge_long_count.svg", "space", badgeStyleFlat, &open, 1234567},
+	} {
+		message, color := badgeMessage(tc.open, tc.people)
+		checkGolden(t, tc.golden, renderBadge(tc.label, message, color, tc.style))
+	}
+}
+
+func TestBadgeMessage(t *testing.T) {
+	open, closed := true, false
+	for _, tc := range []struct {
+		open   *bool
+		people int
+		want   string
+		color  string
+	}{
+		{nil, 5, "unknown", badgeColorUnknown},
+		{&closed, 5, "closed", badgeColorClosed},
+		{&open, 0, "open", badgeColorOpen},
+		{&open, 1, "open, 1 person", badgeColorOpen},
+		{&open, 2, "open, 2 people", badgeColorOpen},
+	} {
+		if got, color := badgeMessage(tc.open, tc.people); got != tc.want || color != tc.color {
+			t.Errorf("badgeMessage(%v, %d) = %q %s, want %q %s", tc.open, tc.people, got, color, tc.want, tc.color)
+		}
+	}
+}
+
+func TestBadgeTextWidth(t *testing.T) {
+	if w := badgeTextWidth("11"); w != 14 {
+		t.Errorf("digits: %v", w)
+	}
+	// Wide letters are wider than narrow ones.
+	if badgeTextWidth("mmm") <= badgeTextWidth("iii") {
+		t.Error("m isn't wider than i")
+	}
+	if w := badgeTextWidth("ł"); w != badgeFallbackWidth {
+		t.Errorf("non-ASCII: %v", w)
+	}
+}
+
+func TestHandleBadge(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	app := fiber.New()
+	app.Get("/badge.svg", handleBadge)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/badge.svg?style=flat", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "image/svg+xml" || resp.Header.Get(fiber.HeaderCacheControl) != badgeCacheControl {
+		t.Fatalf("status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "<title>Test Space: ") {
+		t.Fatalf("body %s", b)
+	}
+
+	GetConfig().SpaceAPI.BadgeLabel = "at2"
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/badge.svg?style=flat-square", nil))
+	b, _ = io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "<title>at2: ") || !strings.Contains(string(b), "crispEdges") {
+		t.Fatalf("body %s", b)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/badge.svg?style=plastic", nil))
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("unknown style: status %d", resp.StatusCode)
+	}
+}
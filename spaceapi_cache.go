@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSpaceAPICacheTTL is how long a generated SpaceAPI document is served
+// when spaceapi.cache_ttl is not set. Directory crawlers and status widgets
+// poll the endpoint often, while most of it changes rarely.
+const defaultSpaceAPICacheTTL = 10 * time.Second
+
+// spaceAPIResponseCache holds the last marshaled SpaceAPI document.
+var spaceAPIResponseCache = &spaceAPICache{}
+
+// spaceAPICache keeps a marshaled document with its ETag until it expires or
+// is invalidated.
+type spaceAPICache struct {
+	mu         sync.Mutex
+	body       []byte
+	etag       string
+	expires    time.Time
+	generation uint64
+}
+
+// get returns the cached document, calling build for a fresh one when it has
+// expired. A ttl <= 0 builds on every call. The result of a build that raced
+// with invalidate is returned but not kept.
+func (c *spaceAPICache) get(now time.Time, ttl time.Duration, build func() ([]byte, error)) ([]byte, string, error) {
+	c.mu.Lock()
+	if c.body != nil && now.Before(c.expires) {
+		body, etag := c.body, c.etag
+		c.mu.Unlock()
+		return body, etag, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	body, err := build()
+	if err != nil {
+		return nil, "", err
+	}
+	etag := bodyETag(body)
+
+	if ttl > 0 {
+		c.mu.Lock()
+		if c.generation == generation {
+			c.body, c.etag, c.expires = body, etag, now.Add(ttl)
+		}
+		c.mu.Unlock()
+	}
+	return body, etag, nil
+}
+
+// invalidate drops the cached document so the next request rebuilds it.
+func (c *spaceAPICache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body, c.etag, c.expires = nil, "", time.Time{}
+	c.generation++
+}
+
+// invalidateSpaceAPICache is a VdevManager callback dropping the cached
+// document when a device deciding the open state or the people count changes.
+func invalidateSpaceAPICache(v *VirtualDevice) {
+	if v == nil {
+		return
+	}
+	cfg := GetConfig()
+	if v.Type == VdevTypePerson || (cfg != nil && v.ID == cfg.SpaceAPI.OpenSource) {
+		spaceAPIResponseCache.invalidate()
+	}
+}
+
+// spaceAPICacheTTL returns spaceapi.cache_ttl, or the default when unset.
+func spaceAPICacheTTL(cfg *Config) time.Duration {
+	if cfg == nil || cfg.SpaceAPI.CacheTTL == "" {
+		return defaultSpaceAPICacheTTL
+	}
+	if d, err := time.ParseDuration(cfg.SpaceAPI.CacheTTL); err == nil {
+		return d
+	}
+	return defaultSpaceAPICacheTTL
+}
+
+// bodyETag returns a strong ETag derived from the response body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 prescribes for GET.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getSpaceAPI requests /spaceapi.json, optionally with If-None-Match, and
+// returns the status, ETag and body.
+func getSpaceAPI(t *testing.T, app *fiber.App, ifNoneMatch string) (int, string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil)
+	if ifNoneMatch != "" {
+		req.Header.Set(fiber.HeaderIfNoneMatch, ifNoneMatch)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get(fiber.HeaderETag), string(body)
+}
+
+func TestSpaceAPI_NotModified(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{CacheTTL: "1m"})
+
+	status, etag, _ := getSpaceAPI(t, app, "")
+	if status != fiber.StatusOK || etag == "" {
+		t.Fatalf("status = %d, etag = %q", status, etag)
+	}
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if status, got, body := getSpaceAPI(t, app, inm); status != fiber.StatusNotModified || got != etag || body != "" {
+			t.Fatalf("If-None-Match %s: status = %d, etag = %q, body = %q", inm, status, got, body)
+		}
+	}
+	if status, _, _ := getSpaceAPI(t, app, `"other"`); status != fiber.StatusOK {
+		t.Fatalf("mismatching If-None-Match: status = %d", status)
+	}
+}
+
+func TestSpaceAPI_CacheInvalidatedByPeopleChange(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{CacheTTL: "1m"})
+	_, etag, _ := getSpaceAPI(t, app, "")
+
+	// Other sensors wait for the TTL.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/temp", State: 25.0}})
+	invalidateSpaceAPICache(vdevManager.Device("lab/temp"))
+	if status, _, _ := getSpaceAPI(t, app, etag); status != fiber.StatusNotModified {
+		t.Fatalf("temperature change: status = %d, want cached 304", status)
+	}
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 1.0}})
+	invalidateSpaceAPICache(vdevManager.Device("lab/people"))
+	status, newEtag, _ := getSpaceAPI(t, app, etag)
+	if status != fiber.StatusOK || newEtag == etag {
+		t.Fatalf("people change: status = %d, etag %q -> %q", status, etag, newEtag)
+	}
+	if state := spaceAPIState(t, app); state["open"] != true {
+		t.Fatalf("state = %v", state)
+	}
+}
+
+func TestSpaceAPI_CacheConcurrentRequests(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{CacheTTL: "1m"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+			if err != nil || resp.StatusCode != fiber.StatusOK {
+				t.Errorf("resp = %v, err = %v", resp, err)
+			}
+			spaceAPIResponseCache.invalidate()
+		}()
+	}
+	wg.Wait()
+}
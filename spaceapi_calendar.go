@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultCalendarLookback is how far back /api/v1/space-open.ics goes when
+// spaceapi.calendar_lookback is not set.
+const defaultCalendarLookback = 30 * 24 * time.Hour
+
+// icsTimeFormat is an iCalendar UTC date-time.
+const icsTimeFormat = "20060102T150405Z"
+
+// icsMaxLineOctets is where iCalendar content lines are folded.
+const icsMaxLineOctets = 75
+
+// calendarLookback returns spaceapi.calendar_lookback, or the default when
+// unset.
+func calendarLookback(cfg *Config) time.Duration {
+	if d, err := time.ParseDuration(cfg.SpaceAPI.CalendarLookback); err == nil {
+		return d
+	}
+	return defaultCalendarLookback
+}
+
+// icsEscape escapes an iCalendar TEXT value.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "").Replace(s)
+}
+
+// icsWriter builds an iCalendar document of CRLF-terminated content lines.
+type icsWriter struct {
+	b strings.Builder
+}
+
+// line writes "name:value", folding it into lines of at most 75 octets
+// without splitting a UTF-8 sequence.
+func (w *icsWriter) line(name, value string) {
+	s := name + ":" + value
+	limit := icsMaxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		// Continuation lines start with the folding space.
+		limit = icsMaxLineOctets - 1
+	}
+	w.b.WriteString(s + "\r\n")
+}
+
+// spaceOpenCalendar renders the open periods as an iCalendar document, one
+// event per period. The period still open ends at now and is tentative.
+func spaceOpenCalendar(cfg *Config, periods []OpenPeriod, now time.Time) string {
+	space := cmp.Or(cfg.SpaceAPI.Space, "Space")
+	domain := "at2"
+	if u, err := url.Parse(cfg.SpaceAPI.Url); err == nil && u.Hostname() != "" {
+		domain = u.Hostname()
+	}
+	summary := icsEscape(space + " open")
+
+	w := &icsWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//at2//space open periods//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", summary)
+	for _, p := range periods {
+		end, status := p.Until, "CONFIRMED"
+		if end.IsZero() {
+			end, status = now, "TENTATIVE"
+		}
+		w.line("BEGIN", "VEVENT")
+		// The opening time identifies the event, so it keeps its UID while
+		// it grows and once it ends.
+		w.line("UID", fmt.Sprintf("space-open-%d@%s", p.Since.Unix(), domain))
+		w.line("DTSTAMP", now.UTC().Format(icsTimeFormat))
+		w.line("DTSTART", p.Since.UTC().Format(icsTimeFormat))
+		w.line("DTEND", end.UTC().Format(icsTimeFormat))
+		w.line("SUMMARY", summary)
+		w.line("STATUS", status)
+		w.line("TRANSP", "TRANSPARENT")
+		w.line("END", "VEVENT")
+	}
+	w.line("END", "VCALENDAR")
+	return w.b.String()
+}
+
+// handleSpaceOpenCalendar serves the periods the space was open within
+// spaceapi.calendar_lookback as an iCalendar feed.
+func handleSpaceOpenCalendar(c *fiber.Ctx) error {
+	if spaceStateService == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "space state not available"})
+	}
+	cfg := GetConfig()
+	now := time.Now()
+	periods, err := spaceStateService.OpenPeriods(now.Add(-calendarLookback(cfg)))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	c.Set("Cache-Control", "no-cache")
+	return c.SendString(spaceOpenCalendar(cfg, periods, now))
+}
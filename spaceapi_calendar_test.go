@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, rewriting it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestSpaceOpenCalendar_Golden(t *testing.T) {
+	now := time.Date(2026, 3, 14, 18, 30, 15, 0, time.UTC)
+	cfg := &Config{SpaceAPI: SpaceAPIConfig{
+		Space: "Hackerspace Kraków; pracownia, warsztat i laboratorium elektroniki\\",
+		Url:   "https://hackerspace-krk.pl/",
+	}}
+	warsaw := time.FixedZone("CET", 3600)
+	periods := []OpenPeriod{
+		{Since: time.Date(2026, 3, 12, 17, 0, 0, 0, warsaw), Until: time.Date(2026, 3, 12, 23, 45, 30, 0, warsaw)},
+		{Since: time.Date(2026, 3, 13, 23, 0, 0, 0, time.UTC), Until: time.Date(2026, 3, 14, 2, 0, 0, 0, time.UTC)},
+		{Since: time.Date(2026, 3, 14, 16, 5, 0, 0, time.UTC)},
+	}
+	checkGolden(t, "space_open.ics", spaceOpenCalendar(cfg, periods, now))
+
+	checkGolden(t, "space_open_empty.ics", spaceOpenCalendar(&Config{}, nil, now))
+}
+
+func TestICSEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":             "plain",
+		"a;b,c":             `a\;b\,c`,
+		`back\slash`:        `back\\slash`,
+		"two\nlines\r\nend": `two\nlines\nend`,
+	} {
+		if got := icsEscape(in); got != want {
+			t.Errorf("icsEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestICSWriterFolds(t *testing.T) {
+	w := &icsWriter{}
+	value := strings.Repeat("żółw ", 40)
+	w.line("SUMMARY", value)
+	out := w.b.String()
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Fatalf("not CRLF terminated: %q", out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	for i, l := range lines {
+		if len(l) > icsMaxLineOctets || !utf8.ValidString(l) {
+			t.Errorf("line %d: %d octets, %q", i, len(l), l)
+		}
+		if i > 0 && !strings.HasPrefix(l, " ") {
+			t.Errorf("line %d isn't a continuation: %q", i, l)
+		}
+	}
+	// Unfolding gives the line back.
+	if got := strings.ReplaceAll(strings.TrimSuffix(out, "\r\n"), "\r\n ", ""); got != "SUMMARY:"+value {
+		t.Fatalf("unfolded %q", got)
+	}
+}
+
+func TestSpaceStateService_OpenPeriods(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	setupTestDB(t)
+	t0 := time.Unix(1_700_000_000, 0)
+	for _, c := range []SpaceStateChangeModel{
+		{Open: true, ChangedAt: t0.Unix()},
+		{Open: false, ChangedAt: t0.Add(time.Hour).Unix()},
+		{Open: true, ChangedAt: t0.Add(10 * time.Hour).Unix()},
+		{Open: false, ChangedAt: t0.Add(12 * time.Hour).Unix()},
+		{Open: true, ChangedAt: t0.Add(20 * time.Hour).Unix()},
+	} {
+		if err := gormDB.Create(&c).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestSpaceStateService(t)
+
+	for _, tc := range []struct {
+		from time.Time
+		want []OpenPeriod
+	}{
+		{t0.Add(-time.Hour), []OpenPeriod{
+			{Since: t0, Until: t0.Add(time.Hour)},
+			{Since: t0.Add(10 * time.Hour), Until: t0.Add(12 * time.Hour)},
+			{Since: t0.Add(20 * time.Hour)},
+		}},
+		// A period open at from is returned whole.
+		{t0.Add(11 * time.Hour), []OpenPeriod{
+			{Since: t0.Add(10 * time.Hour), Until: t0.Add(12 * time.Hour)},
+			{Since: t0.Add(20 * time.Hour)},
+		}},
+		{t0.Add(15 * time.Hour), []OpenPeriod{{Since: t0.Add(20 * time.Hour)}}},
+		{t0.Add(21 * time.Hour), []OpenPeriod{{Since: t0.Add(20 * time.Hour)}}},
+	} {
+		periods, err := s.OpenPeriods(tc.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.EqualFunc(periods, tc.want, func(a, b OpenPeriod) bool { return a.Since.Equal(b.Since) && a.Until.Equal(b.Until) }) {
+			t.Errorf("from %v: %+v, want %+v", tc.from, periods, tc.want)
+		}
+	}
+
+	// Repeated transitions don't split a period.
+	gormDB.Create(&SpaceStateChangeModel{Open: true, ChangedAt: t0.Add(22 * time.Hour).Unix()})
+	if periods, _ := s.OpenPeriods(t0.Add(15 * time.Hour)); len(periods) != 1 {
+		t.Fatalf("repeated open: %+v", periods)
+	}
+}
+
+func TestHandleSpaceOpenCalendar(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	setupTestDB(t)
+	prev := spaceStateService
+	t.Cleanup(func() { spaceStateService = prev })
+	now := time.Now()
+	gormDB.Create(&SpaceStateChangeModel{Open: true, ChangedAt: now.Add(-40 * 24 * time.Hour).Unix()})
+	gormDB.Create(&SpaceStateChangeModel{Open: false, ChangedAt: now.Add(-39 * 24 * time.Hour).Unix()})
+	gormDB.Create(&SpaceStateChangeModel{Open: true, ChangedAt: now.Add(-2 * time.Hour).Unix()})
+	spaceStateService = newTestSpaceStateService(t)
+	app := fiber.New()
+	app.Get("/api/v1/space-open.ics", handleSpaceOpenCalendar)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/space-open.ics", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "text/calendar; charset=utf-8" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get(fiber.HeaderContentType))
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+	// Only the current period is within the default 30 days.
+	if n := strings.Count(body, "BEGIN:VEVENT"); n != 1 || !strings.Contains(body, "STATUS:TENTATIVE") || !strings.Contains(body, "SUMMARY:Test Space open") {
+		t.Fatalf("%d events in\n%s", n, body)
+	}
+
+	GetConfig().SpaceAPI.CalendarLookback = "1000h"
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/space-open.ics", nil))
+	b, _ = io.ReadAll(resp.Body)
+	if n := strings.Count(string(b), "BEGIN:VEVENT"); n != 2 {
+		t.Fatalf("%d events with a longer lookback", n)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SpaceStateService follows the open/closed state of the space (see
+// spaceOpen) and persists every transition, so SpaceAPI can report since
+// when the space has been open or closed, across restarts.
+type SpaceStateService struct {
+	vdev *VdevManager
+	db   *gorm.DB
+	log  *slog.Logger
+
+	mu sync.Mutex
+	// cfg is replaced on config reload.
+	cfg        *Config
+	open       *bool
+	lastChange time.Time
+}
+
+// NewSpaceStateService creates the service, restoring the last recorded
+// transition from the database.
+func NewSpaceStateService(cfg *Config, vdev *VdevManager, db *gorm.DB, logger *slog.Logger) (*SpaceStateService, error) {
+	s := &SpaceStateService{cfg: cfg, vdev: vdev, db: db, log: logger}
+
+	var last SpaceStateChangeModel
+	err := db.Order("changed_at DESC, id DESC").First(&last).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to load last space state change: %w", err)
+	default:
+		s.open = boolPtr(last.Open)
+		s.lastChange = time.Unix(last.ChangedAt, 0)
+	}
+	return s, nil
+}
+
+// Start registers a callback so changes of the devices deciding the open
+// state are checked for a transition, and follows config reloads.
+func (s *SpaceStateService) Start() {
+	s.vdev.OnVirtualDeviceUpdated = append(s.vdev.OnVirtualDeviceUpdated, s.onDeviceUpdate)
+	OnConfigReload(s.loadConfig)
+}
+
+// loadConfig takes the open state settings of cfg. A different
+// spaceapi.open_source may already tell a different state, so it is
+// rechecked at once.
+func (s *SpaceStateService) loadConfig(cfg *Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	s.update(time.Now())
+}
+
+func (s *SpaceStateService) config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+func (s *SpaceStateService) onDeviceUpdate(v *VirtualDevice) {
+	if v == nil {
+		return
+	}
+	if v.Type == VdevTypePerson || v.ID == s.config().SpaceAPI.OpenSource {
+		s.update(time.Now())
+	}
+}
+
+// update recomputes the open state and records a transition when it differs
+// from the last recorded one. An unknown state is not a transition.
+func (s *SpaceStateService) update(now time.Time) {
+	devices := s.vdev.Devices()
+	deviceMap := make(map[string]*VirtualDevice, len(devices))
+	for _, dev := range devices {
+		deviceMap[dev.ID] = dev
+	}
+	open := spaceOpen(s.config(), deviceMap)
+	if open == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open != nil && *s.open == *open {
+		return
+	}
+	change := SpaceStateChangeModel{Open: *open, ChangedAt: now.Unix()}
+	if err := s.db.Create(&change).Error; err != nil {
+		s.log.Warn("recording space state change failed", "err", err)
+		return
+	}
+	s.open = open
+	s.lastChange = time.Unix(change.ChangedAt, 0)
+	spaceAPIResponseCache.invalidate()
+	s.log.Info("space state changed", "open", *open)
+}
+
+// LastChange returns when the space last opened or closed, and false when no
+// transition has been recorded yet.
+func (s *SpaceStateService) LastChange() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastChange, s.open != nil
+}
+
+// OpenPeriod is a time the space was open. Until is zero while it still is.
+type OpenPeriod struct {
+	Since time.Time
+	Until time.Time
+}
+
+// OpenPeriods returns the periods the space was open since from, oldest
+// first, from the recorded transitions. A period open at from is returned
+// whole.
+func (s *SpaceStateService) OpenPeriods(from time.Time) ([]OpenPeriod, error) {
+	var changes []SpaceStateChangeModel
+	// The last transition before from tells whether the space was open then.
+	var before SpaceStateChangeModel
+	err := s.db.Where("changed_at < ?", from.Unix()).Order("changed_at DESC, id DESC").First(&before).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		changes = append(changes, before)
+	}
+	var since []SpaceStateChangeModel
+	if err := s.db.Where("changed_at >= ?", from.Unix()).Order("changed_at, id").Find(&since).Error; err != nil {
+		return nil, err
+	}
+	changes = append(changes, since...)
+
+	var periods []OpenPeriod
+	for _, change := range changes {
+		at := time.Unix(change.ChangedAt, 0)
+		open := len(periods) > 0 && periods[len(periods)-1].Until.IsZero()
+		switch {
+		case change.Open && !open:
+			periods = append(periods, OpenPeriod{Since: at})
+		case !change.Open && open:
+			periods[len(periods)-1].Until = at
+		}
+	}
+	return periods, nil
+}
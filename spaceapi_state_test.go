@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestSpaceStateService(t *testing.T) *SpaceStateService {
+	t.Helper()
+	s, err := NewSpaceStateService(GetConfig(), vdevManager, gormDB, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSpaceStateService_RecordsTransitions(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	setupTestDB(t)
+	s := newTestSpaceStateService(t)
+	if _, ok := s.LastChange(); ok {
+		t.Fatal("LastChange reported without any transition")
+	}
+
+	t0 := time.Unix(1_700_000_000, 0)
+	s.update(t0)
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 2.0}})
+	s.update(t0.Add(time.Hour))
+	// More people arriving doesn't change the state.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 3.0}})
+	s.update(t0.Add(2 * time.Hour))
+
+	var changes []SpaceStateChangeModel
+	gormDB.Order("id").Find(&changes)
+	if len(changes) != 2 || changes[0].Open || changes[0].ChangedAt != t0.Unix() ||
+		!changes[1].Open || changes[1].ChangedAt != t0.Add(time.Hour).Unix() {
+		t.Fatalf("unexpected transitions: %+v", changes)
+	}
+	if last, ok := s.LastChange(); !ok || !last.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("LastChange = %v, %v", last, ok)
+	}
+}
+
+func TestSpaceStateService_IgnoresUnknownState(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{OpenSource: "switch/missing"})
+	setupTestDB(t)
+	s := newTestSpaceStateService(t)
+
+	s.update(time.Now())
+	var count int64
+	gormDB.Model(&SpaceStateChangeModel{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("recorded %d transitions for an unknown state", count)
+	}
+}
+
+func TestSpaceStateService_FollowsConfigReload(t *testing.T) {
+	setupSpaceAPITest(t, SpaceAPIConfig{})
+	setupTestDB(t)
+	s := newTestSpaceStateService(t)
+	s.update(time.Now())
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "switch/space_open", State: 1.0}})
+
+	// The switch decides from now on, and it says open.
+	cfg := *GetConfig()
+	cfg.SpaceAPI.OpenSource = "switch/space_open"
+	s.loadConfig(&cfg)
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "switch/space_open", State: 0.0}})
+	s.onDeviceUpdate(vdevManager.Device("switch/space_open"))
+
+	var changes []SpaceStateChangeModel
+	gormDB.Order("id").Find(&changes)
+	if len(changes) != 3 || changes[0].Open || !changes[1].Open || changes[2].Open {
+		t.Fatalf("unexpected transitions: %+v", changes)
+	}
+}
+
+func TestSpaceStateService_LastChangeSurvivesRestart(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{})
+	setupTestDB(t)
+	opened := time.Unix(1_700_000_000, 0)
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 1.0}})
+	newTestSpaceStateService(t).update(opened)
+
+	// A new service on the same database picks up the recorded transition,
+	// and seeing the same state again isn't a new one.
+	prev := spaceStateService
+	t.Cleanup(func() { spaceStateService = prev })
+	spaceStateService = newTestSpaceStateService(t)
+	spaceStateService.update(opened.Add(time.Hour))
+	if last, ok := spaceStateService.LastChange(); !ok || !last.Equal(opened) {
+		t.Fatalf("LastChange after restart = %v, %v; want %v", last, ok, opened)
+	}
+
+	state := spaceAPIState(t, app)
+	if state["open"] != true || state["lastchange"] != float64(opened.Unix()) {
+		t.Fatalf("state = %v", state)
+	}
+}
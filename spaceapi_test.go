@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupSpaceAPITest seeds a lab room with a person sensor and a "space open"
+// switch and serves the SpaceAPI endpoint.
+func setupSpaceAPITest(t *testing.T, spaceCfg SpaceAPIConfig) *fiber.App {
+	t.Helper()
+	prevCfg, prevManager := GetConfig(), vdevManager
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		vdevManager = prevManager
+	})
+
+	spaceCfg.Space = "Test Space"
+	// Tests that don't exercise the cache see every device change at once.
+	if spaceCfg.CacheTTL == "" {
+		spaceCfg.CacheTTL = "0s"
+	}
+	spaceAPIResponseCache.invalidate()
+	t.Cleanup(spaceAPIResponseCache.invalidate)
+	setConfig(&Config{
+		SpaceAPI: spaceCfg,
+		Rooms: []RoomConfig{{
+			ID:       "lab",
+			Entities: []EntityConfig{{ID: "lab/people"}, {ID: "lab/temp"}},
+		}},
+	})
+	vdevManager = NewVdevManager()
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "lab/people", Type: VdevTypePerson, State: 0.0, Fresh: true},
+		{ID: "lab/temp", Type: VdevTypeTemperature, State: 21.5, Fresh: true},
+		{ID: "switch/space_open", Type: VdevTypeRelay, State: false},
+	})
+
+	app := fiber.New()
+	app.Get("/spaceapi.json", handleSpaceAPI)
+	return app
+}
+
+// spaceAPIBody fetches /spaceapi.json into power consumption entries and
+// the state object.
+func spaceAPIBody(t *testing.T, app *fiber.App) (power []A15JsonSensorsPowerConsumptionElem, state map[string]any) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var body struct {
+		Sensors struct {
+			PowerConsumption []A15JsonSensorsPowerConsumptionElem `json:"power_consumption"`
+		} `json:"sensors"`
+		State map[string]any `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Sensors.PowerConsumption, body.State
+}
+
+// spaceAPIState fetches /spaceapi.json and returns its state object.
+func spaceAPIState(t *testing.T, app *fiber.App) map[string]any {
+	t.Helper()
+	_, state := spaceAPIBody(t, app)
+	return state
+}
+
+func TestSpaceAPI_OpenFromPeoplePresent(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{Message: "members only"})
+
+	state := spaceAPIState(t, app)
+	if state["open"] != false || state["message"] != "members only" {
+		t.Fatalf("empty space: state = %v", state)
+	}
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 2.0}})
+	if state := spaceAPIState(t, app); state["open"] != true {
+		t.Fatalf("people present: state = %v", state)
+	}
+
+	// The switch is ignored with the default source.
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 0.0}, {Name: "switch/space_open", State: true}})
+	if state := spaceAPIState(t, app); state["open"] != false {
+		t.Fatalf("switch on, nobody present: state = %v", state)
+	}
+}
+
+func TestSpaceAPI_OpenFromDevice(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{OpenSource: "switch/space_open"})
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 3.0}})
+	if state := spaceAPIState(t, app); state["open"] != false {
+		t.Fatalf("switch off, people present: state = %v", state)
+	}
+	if _, ok := spaceAPIState(t, app)["message"]; ok {
+		t.Fatal("message set without spaceapi.message")
+	}
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "switch/space_open", State: "ON"}})
+	if state := spaceAPIState(t, app); state["open"] != true {
+		t.Fatalf("switch on: state = %v", state)
+	}
+}
+
+func TestSpaceAPI_UnknownOpenDevice(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{OpenSource: "switch/missing"})
+
+	// A missing open state means "temporarily unknown" in the SpaceAPI schema.
+	if state := spaceAPIState(t, app); state["open"] != nil {
+		t.Fatalf("state = %v, want open omitted", state)
+	}
+}
+
+// setupSpaceAPIPowerTest adds a lab with two power meters and a hall with one
+// to the SpaceAPI test setup, plus a meter for the whole space.
+func setupSpaceAPIPowerTest(t *testing.T, spaceCfg SpaceAPIConfig) *fiber.App {
+	t.Helper()
+	app := setupSpaceAPITest(t, spaceCfg)
+	GetConfig().Rooms = []RoomConfig{
+		{ID: "lab", LocalizedName: LocalizedString{"en": "Lab"}, Entities: []EntityConfig{{ID: "lab/power1"}, {ID: "lab/power2"}}},
+		{ID: "hall", Entities: []EntityConfig{{ID: "hall/power"}}},
+	}
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "lab/power1", Type: VdevTypePowerUsage},
+		{ID: "lab/power2", Type: VdevTypePowerUsage},
+		{ID: "hall/power", Type: VdevTypePowerUsage},
+		{ID: "main/power", Type: VdevTypePowerUsage},
+	})
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{
+		{Name: "lab/power1", State: 100.0},
+		{Name: "lab/power2", State: 50.0},
+		{Name: "hall/power", State: 25.0},
+		{Name: "main/power", State: 400.0},
+	})
+	return app
+}
+
+func powerByLocation(power []A15JsonSensorsPowerConsumptionElem) map[string]float64 {
+	m := map[string]float64{}
+	for _, p := range power {
+		if p.Unit != A15JsonSensorsPowerConsumptionElemUnitW {
+			continue
+		}
+		m[p.Location] = p.Value
+	}
+	return m
+}
+
+func TestSpaceAPI_PowerConsumptionPerRoomAndTotal(t *testing.T) {
+	app := setupSpaceAPIPowerTest(t, SpaceAPIConfig{})
+
+	power, _ := spaceAPIBody(t, app)
+	got := powerByLocation(power)
+	if len(power) != 3 || got["Lab"] != 150 || got["hall"] != 25 || got["total"] != 175 {
+		t.Fatalf("power_consumption = %+v", power)
+	}
+}
+
+func TestSpaceAPI_PowerConsumptionTotalFromDevice(t *testing.T) {
+	app := setupSpaceAPIPowerTest(t, SpaceAPIConfig{PowerTotalDevice: "main/power"})
+
+	power, _ := spaceAPIBody(t, app)
+	if got := powerByLocation(power); got["total"] != 400 || got["Lab"] != 150 {
+		t.Fatalf("power_consumption = %+v", power)
+	}
+}
+
+func TestSpaceAPI_PowerConsumptionSkipsStaleDevices(t *testing.T) {
+	app := setupSpaceAPIPowerTest(t, SpaceAPIConfig{PowerTotalDevice: "main/stale"})
+	// Restored from the database, never updated since.
+	vdevManager.AddDevices([]*VirtualDevice{
+		{ID: "hall/stale", Type: VdevTypePowerUsage, State: 1000.0},
+		{ID: "main/stale", Type: VdevTypePowerUsage, State: 2000.0},
+	})
+	GetConfig().Rooms[1].Entities = append(GetConfig().Rooms[1].Entities, EntityConfig{ID: "hall/stale"})
+
+	power, _ := spaceAPIBody(t, app)
+	got := powerByLocation(power)
+	if got["hall"] != 25 {
+		t.Fatalf("stale reading counted: %+v", power)
+	}
+	if _, ok := got["total"]; ok {
+		t.Fatalf("total reported from a stale device: %+v", power)
+	}
+}
+
+func TestSpaceAPI_CarbonDioxide(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{})
+	GetConfig().Rooms[0].LocalizedName = LocalizedString{"en": "Lab"}
+	GetConfig().Rooms[0].Entities = append(GetConfig().Rooms[0].Entities,
+		EntityConfig{ID: "lab/air/co2", LocalizedName: LocalizedString{"en": "SCD41"}})
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "lab/air/co2", Type: VdevTypeCO2, State: 812.0, Fresh: true}})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Sensors A15JsonSensors `json:"sensors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	co2 := body.Sensors.Carbondioxide
+	if len(co2) != 1 || co2[0].Location != "Lab" || co2[0].Name == nil || *co2[0].Name != "SCD41" ||
+		co2[0].Unit != A15JsonSensorsCarbondioxideElemUnitPpm || co2[0].Value != 812 {
+		t.Fatalf("carbondioxide = %+v", co2)
+	}
+	if len(body.Sensors.Temperature) != 1 {
+		t.Fatalf("temperature = %+v", body.Sensors.Temperature)
+	}
+}
+
+func TestSpaceAPI_ExtFields(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{Ext: map[string]any{
+		"ext_ccc":      "chaos",
+		"ext_calendar": map[string]any{"url": "https://example.com/cal.ics", "public": true},
+	}})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	calendar, _ := body["ext_calendar"].(map[string]any)
+	if body["ext_ccc"] != "chaos" || calendar["url"] != "https://example.com/cal.ics" || calendar["public"] != true {
+		t.Fatalf("ext fields = %v, %v", body["ext_ccc"], body["ext_calendar"])
+	}
+	if body["space"] != "Test Space" || body["state"] == nil || body["api_compatibility"] == nil {
+		t.Fatalf("schema fields missing: %v", body)
+	}
+}
+
+func TestMarshalSpaceAPI_ExtDoesNotClobberSchema(t *testing.T) {
+	body, err := marshalSpaceAPI(A15Json{Space: "Test Space"}, map[string]any{"space": "other", "ext_x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["space"] != "Test Space" || doc["ext_x"] != float64(1) {
+		t.Fatalf("doc = %v", doc)
+	}
+
+	// Without ext the document is the plain schema encoding.
+	plain, _ := marshalSpaceAPI(A15Json{Space: "Test Space"}, nil)
+	if want, _ := json.Marshal(A15Json{Space: "Test Space"}); string(plain) != string(want) {
+		t.Fatalf("plain = %s, want %s", plain, want)
+	}
+}
+
+func TestSpaceAPI_EntityOverrides(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{})
+	GetConfig().Rooms[0].Entities = []EntityConfig{
+		{ID: "lab/people", SpaceAPI: &EntitySpaceAPIConfig{Description: "door counter", Names: []string{"alice"}}},
+		{ID: "lab/temp", LocalizedName: LocalizedString{"en": "Thermometer"},
+			SpaceAPI: &EntitySpaceAPIConfig{Name: "Bench", Description: "next to the soldering station"}},
+	}
+
+	get := func() A15JsonSensors {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Sensors A15JsonSensors `json:"sensors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Sensors
+	}
+
+	sensors := get()
+	temp := sensors.Temperature
+	if len(temp) != 1 || *temp[0].Name != "Bench" || temp[0].Description == nil || *temp[0].Description != "next to the soldering station" {
+		t.Fatalf("temperature = %+v", temp)
+	}
+	people := sensors.PeopleNowPresent[0]
+	if people.Description == nil || *people.Description != "door counter" || people.Names != nil {
+		t.Fatalf("empty room: people = %+v", people)
+	}
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 1.0}})
+	if people := get().PeopleNowPresent[0]; len(people.Names) != 1 || people.Names[0] != "alice" {
+		t.Fatalf("occupied room: people = %+v", people)
+	}
+}
+
+// spaceAPISensors fetches /spaceapi.json and returns its sensors.
+func spaceAPISensors(t *testing.T, app *fiber.App) A15JsonSensors {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/spaceapi.json", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Sensors A15JsonSensors `json:"sensors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Sensors
+}
+
+func TestSpaceAPI_RestoredPeopleUnknown(t *testing.T) {
+	app := setupSpaceAPITest(t, SpaceAPIConfig{})
+	vdevManager = NewVdevManager()
+	vdevManager.SetStateProvider(restoredStateProvider{state: 3.0, recordedAt: time.Unix(1_700_000_000, 0)})
+	vdevManager.AddDevices([]*VirtualDevice{{ID: "lab/people", Type: VdevTypePerson}})
+
+	// Restored after a restart: nobody knows if the space is open.
+	if state := spaceAPIState(t, app); state["open"] != nil {
+		t.Fatalf("restored: state = %v, want open omitted", state)
+	}
+	if people := spaceAPISensors(t, app).PeopleNowPresent; len(people) != 0 {
+		t.Fatalf("restored: people_now_present = %+v", people)
+	}
+
+	vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/people", State: 3.0}})
+	if state := spaceAPIState(t, app); state["open"] != true {
+		t.Fatalf("updated: state = %v", state)
+	}
+	if people := spaceAPISensors(t, app).PeopleNowPresent; len(people) != 2 || people[0].Value != 3 {
+		t.Fatalf("updated: people_now_present = %+v", people)
+	}
+}
+
+func TestSpaceAPI_StaleSensorTypes(t *testing.T) {
+	recorded := time.Unix(1_700_000_000, 0)
+	for _, tc := range []struct {
+		staleTypes []string
+		want       int
+	}{
+		{nil, 0},
+		{[]string{"temperature"}, 1},
+	} {
+		app := setupSpaceAPITest(t, SpaceAPIConfig{StaleSensorTypes: tc.staleTypes})
+		vdevManager = NewVdevManager()
+		vdevManager.SetStateProvider(restoredStateProvider{state: 19.5, recordedAt: recorded})
+		vdevManager.AddDevices([]*VirtualDevice{{ID: "lab/temp", Type: VdevTypeTemperature}})
+
+		temp := spaceAPISensors(t, app).Temperature
+		if len(temp) != tc.want {
+			t.Fatalf("stale types %v: temperature = %+v", tc.staleTypes, temp)
+		}
+		if tc.want > 0 && (temp[0].Value != 19.5 || temp[0].Lastchange == nil || *temp[0].Lastchange != float64(recorded.Unix())) {
+			t.Fatalf("stale types %v: temperature = %+v", tc.staleTypes, temp[0])
+		}
+
+		// Once updated the reading is shown as usual.
+		vdevManager.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "lab/temp", State: 19.5}})
+		if temp := spaceAPISensors(t, app).Temperature; len(temp) != 1 || temp[0].Lastchange != nil {
+			t.Fatalf("stale types %v, updated: temperature = %+v", tc.staleTypes, temp)
+		}
+	}
+}
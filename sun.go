@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+const (
+	// defaultSunDayAbove is sun.day_above when it isn't set: the end of
+	// civil twilight.
+	defaultSunDayAbove = -6.0
+	// sunUpdateInterval is how often the sun devices are recomputed.
+	sunUpdateInterval = time.Minute
+)
+
+// IDs of the sun devices.
+const (
+	sunElevationID = "sun/elevation"
+	sunIsDayID     = "sun/is_day"
+)
+
+// SunConfig computes the sun/elevation and sun/is_day devices from the
+// position of the sun at a location, without network access.
+type SunConfig struct {
+	// Lat and Lon default to spaceapi.location.
+	Lat *float64 `yaml:"lat"`
+	Lon *float64 `yaml:"lon"`
+	// DayAbove is the elevation of the sun (degrees) above which sun/is_day
+	// is true. Default -6, the end of civil twilight; 0 is sunrise.
+	DayAbove *float64 `yaml:"day_above"`
+}
+
+func (c *SunConfig) dayAbove() float64 {
+	if c.DayAbove != nil {
+		return *c.DayAbove
+	}
+	return defaultSunDayAbove
+}
+
+// validateSunConfig fails fast on a sun without a location or with a
+// threshold the sun can't cross.
+func validateSunConfig(cfg *Config, cfgPath string) error {
+	sc := cfg.Sun
+	if sc == nil {
+		return nil
+	}
+	if err := validateCoordinates(cfg, "sun", sc.Lat, sc.Lon, cfgPath); err != nil {
+		return err
+	}
+	if d := sc.dayAbove(); d <= -90 || d >= 90 || math.IsNaN(d) {
+		return fmt.Errorf("sun.day_above must be between -90 and 90 degrees (got %v) in %s", d, cfgPath)
+	}
+	return nil
+}
+
+// sunElevation is the geometric elevation of the sun's center (degrees)
+// at lat, lon at time t, by the NOAA solar calculator equations. It is
+// within a minute of arc for years 1800 to 2100; atmospheric refraction is
+// not included, so the sun rises and sets at -0.833°.
+func sunElevation(t time.Time, lat, lon float64) float64 {
+	rad := math.Pi / 180
+	julianDay := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+	jc := (julianDay - 2451545) / 36525 // Julian centuries since J2000
+
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	meanAnomaly := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	eccentricity := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	center := math.Sin(meanAnomaly*rad)*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(2*meanAnomaly*rad)*(0.019993-0.000101*jc) +
+		math.Sin(3*meanAnomaly*rad)*0.000289
+	omega := 125.04 - 1934.136*jc
+	apparentLong := meanLong + center - 0.00569 - 0.00478*math.Sin(omega*rad)
+	meanObliquity := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliquity := meanObliquity + 0.00256*math.Cos(omega*rad)
+	declination := math.Asin(math.Sin(obliquity*rad) * math.Sin(apparentLong*rad))
+
+	y := math.Pow(math.Tan(obliquity*rad/2), 2)
+	equationOfTime := 4 / rad * (y*math.Sin(2*meanLong*rad) -
+		2*eccentricity*math.Sin(meanAnomaly*rad) +
+		4*eccentricity*y*math.Sin(meanAnomaly*rad)*math.Cos(2*meanLong*rad) -
+		0.5*y*y*math.Sin(4*meanLong*rad) -
+		1.25*eccentricity*eccentricity*math.Sin(2*meanAnomaly*rad)) // minutes
+
+	utc := t.UTC()
+	minutes := float64(utc.Hour()*60+utc.Minute()) + float64(utc.Second())/60 + float64(utc.Nanosecond())/6e10
+	trueSolarTime := minutes + equationOfTime + 4*lon
+	hourAngle := trueSolarTime/4 - 180
+
+	cosZenith := math.Sin(lat*rad)*math.Sin(declination) +
+		math.Cos(lat*rad)*math.Cos(declination)*math.Cos(hourAngle*rad)
+	return 90 - math.Acos(max(-1, min(1, cosZenith)))/rad
+}
+
+// SunService keeps the sun devices up to date.
+type SunService struct {
+	vdev     *VdevManager
+	lat, lon float64
+	dayAbove float64
+	now      func() time.Time
+	log      *slog.Logger
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewSunService registers the sun devices of cfg.Sun, which must be set.
+// Updates start with Start.
+func NewSunService(cfg *Config, vdev *VdevManager, logger *slog.Logger) *SunService {
+	lat, lon := configCoordinates(cfg, cfg.Sun.Lat, cfg.Sun.Lon)
+	vdev.AddDevices([]*VirtualDevice{
+		{ID: sunElevationID, Type: VdevTypeSunElevation, ProhibitControl: true},
+		{ID: sunIsDayID, Type: VdevTypeDaylight, ProhibitControl: true},
+	})
+	return &SunService{vdev: vdev, lat: lat, lon: lon, dayAbove: cfg.Sun.dayAbove(), now: time.Now, log: logger}
+}
+
+// Start computes the sun devices now and every minute until Stop.
+func (s *SunService) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	s.update()
+	s.log.Info("computing the sun", "lat", s.lat, "lon", s.lon, "day_above", s.dayAbove)
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(sunUpdateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.update()
+			}
+		}
+	}()
+}
+
+// Stop ends the updates.
+func (s *SunService) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *SunService) update() {
+	elevation := sunElevation(s.now(), s.lat, s.lon)
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{
+		{Name: sunElevationID, State: math.Round(elevation*100) / 100},
+		{Name: sunIsDayID, State: elevation > s.dayAbove},
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// sunriseElevation is where the sun's center is at the published sunrise
+// and sunset times, with refraction and the sun's radius.
+const sunriseElevation = -0.833
+
+func TestSunElevation_SunriseSunset(t *testing.T) {
+	london, _ := time.LoadLocation("Europe/London")
+	sydney, _ := time.LoadLocation("Australia/Sydney")
+	for _, tc := range []struct {
+		name     string
+		lat, lon float64
+		at       time.Time
+		rising   bool
+	}{
+		{"London midsummer sunrise", 51.5074, -0.1278, time.Date(2024, 6, 21, 4, 43, 0, 0, london), true},
+		{"London midsummer sunset", 51.5074, -0.1278, time.Date(2024, 6, 21, 21, 21, 0, 0, london), false},
+		{"London midwinter sunrise", 51.5074, -0.1278, time.Date(2024, 12, 21, 8, 4, 0, 0, london), true},
+		{"London midwinter sunset", 51.5074, -0.1278, time.Date(2024, 12, 21, 15, 53, 0, 0, london), false},
+		{"Sydney midsummer sunrise", -33.8688, 151.2093, time.Date(2024, 12, 21, 5, 41, 0, 0, sydney), true},
+		{"Sydney midsummer sunset", -33.8688, 151.2093, time.Date(2024, 12, 21, 20, 5, 0, 0, sydney), false},
+	} {
+		// Published times are rounded to the minute; allow a minute more.
+		before := sunElevation(tc.at.Add(-90*time.Second), tc.lat, tc.lon)
+		after := sunElevation(tc.at.Add(90*time.Second), tc.lat, tc.lon)
+		if tc.rising && !(before < sunriseElevation && after > sunriseElevation) ||
+			!tc.rising && !(before > sunriseElevation && after < sunriseElevation) {
+			t.Errorf("%s: elevation %.3f° to %.3f° around %s", tc.name, before, after, tc.at.Format(time.Kitchen))
+		}
+	}
+}
+
+func TestSunElevation_PolarDayAndNight(t *testing.T) {
+	const lat, lon = 69.6492, 18.9553 // Tromsø
+	for _, tc := range []struct {
+		day   time.Time
+		above bool
+	}{
+		{time.Date(2026, 6, 21, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 12, 21, 0, 0, 0, 0, time.UTC), false},
+	} {
+		for at := tc.day; at.Before(tc.day.Add(24 * time.Hour)); at = at.Add(10 * time.Minute) {
+			if e := sunElevation(at, lat, lon); (e > 0) != tc.above {
+				t.Fatalf("elevation at %s is %.2f°", at.Format(time.RFC3339), e)
+			}
+		}
+	}
+}
+
+func TestSunService(t *testing.T) {
+	cfg := &Config{Sun: &SunConfig{}}
+	cfg.SpaceAPI.Location.Lat, cfg.SpaceAPI.Location.Lon = 51.5074, -0.1278
+	vm := NewVdevManager()
+	s := NewSunService(cfg, vm, testLogger)
+
+	// Half an hour after the midwinter sunset the sun is about 5° below the
+	// horizon: still civil twilight.
+	s.now = func() time.Time { return time.Date(2024, 12, 21, 16, 23, 0, 0, time.UTC) }
+	s.update()
+	elevation := vm.Device(sunElevationID)
+	if e, ok := elevation.State.(float64); !ok || e > -4 || e < -6 || !elevation.ProhibitControl {
+		t.Fatalf("elevation = %+v", elevation)
+	}
+	if isDay := vm.Device(sunIsDayID).State; isDay != true {
+		t.Errorf("is_day during civil twilight = %v", isDay)
+	}
+
+	s.dayAbove = 0
+	s.update()
+	if isDay := vm.Device(sunIsDayID).State; isDay != false {
+		t.Errorf("is_day after sunset with day_above 0 = %v", isDay)
+	}
+}
+
+func TestValidateSunConfig(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sun  *SunConfig
+		want string
+	}{
+		"ok":          {&SunConfig{Lat: float64Ptr(50), Lon: float64Ptr(20), DayAbove: float64Ptr(-12)}, ""},
+		"no location": {&SunConfig{}, "sun needs lat and lon"},
+		"threshold":   {&SunConfig{Lat: float64Ptr(50), Lon: float64Ptr(20), DayAbove: float64Ptr(90)}, "sun.day_above must be between"},
+	} {
+		err := validateSunConfig(&Config{Sun: tc.sun}, "at2.yaml")
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+-- The tables of the Home Assistant recorder schema (version 43) that the
+-- import reads, cut down to the columns it uses and a few it ignores.
+CREATE TABLE states_meta (
+	metadata_id INTEGER NOT NULL PRIMARY KEY,
+	entity_id VARCHAR(255)
+);
+CREATE TABLE states (
+	state_id INTEGER NOT NULL PRIMARY KEY,
+	state VARCHAR(255),
+	attributes TEXT,
+	last_changed_ts FLOAT,
+	last_updated_ts FLOAT,
+	old_state_id INTEGER REFERENCES states (state_id),
+	metadata_id INTEGER REFERENCES states_meta (metadata_id)
+);
+CREATE INDEX ix_states_metadata_id_last_updated_ts ON states (metadata_id, last_updated_ts);
+
+INSERT INTO states_meta (metadata_id, entity_id) VALUES
+	(1, 'sensor.hall_temperature'),
+	(2, 'switch.hall_light'),
+	(3, 'binary_sensor.front_door'),
+	(4, 'sensor.hall_people'),
+	(5, 'sensor.not_mapped');
+
+-- 2024-03-01T00:00:00Z is 1709251200.
+INSERT INTO states (state_id, state, last_changed_ts, last_updated_ts, metadata_id) VALUES
+	(1, '21.5', 1709251200.0, 1709251200.0, 1),
+	(2, 'unavailable', 1709251260.0, 1709251260.0, 1),
+	(3, '21.5', 1709251320.0, 1709251320.0, 1),
+	(4, '22.0', 1709251380.5, 1709251380.5, 1),
+	(5, 'unknown', 1709251440.0, 1709251440.0, 1),
+	(6, 'on', 1709251200.0, 1709251200.0, 2),
+	(7, 'on', 1709251800.0, 1709251800.25, 2),
+	(9, 'on', 1709253000.0, 1709253000.0, 2),
+	(8, 'off', 1709252400.0, 1709252400.0, 2),
+	(10, 'on', 1709251500.0, 1709251500.0, 3),
+	(11, 'off', 1709251560.0, 1709251560.0, 3),
+	(12, '0', 1709251200.0, 1709251200.0, 4),
+	(13, '2', 1709254800.0, 1709254800.0, 4),
+	(14, '1', 1709258400.0, 1709258400.0, 4),
+	(15, NULL, NULL, NULL, 4),
+	(16, '5', 1709251200.0, 1709251200.0, 5);
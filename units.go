@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Unit systems of API responses. Device states are kept metric everywhere
+// else: in memory, in the history, on MQTT and in Prometheus.
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// vdevUnits are the units device states of a type are kept in. Types not
+// listed are unitless.
+var vdevUnits = map[VdevType]string{
+	VdevTypeTemperature:  "°C",
+	VdevTypeThermostat:   "°C",
+	VdevTypeHumidity:     "%",
+	VdevTypeCo:           "ppm",
+	VdevTypeCO2:          "ppm",
+	VdevTypeGas:          "LEL",
+	VdevTypePowerUsage:   "W",
+	VdevTypeCover:        "%",
+	VdevTypeBattery:      "%",
+	VdevTypeNoiseLevel:   "dB",
+	VdevTypeWaterMeter:   "m³",
+	VdevTypeGasMeter:     "m³",
+	VdevTypeWindSpeed:    "m/s",
+	VdevTypeSunElevation: "°",
+}
+
+// unitConversion converts readings in a unit to the canonical unit of
+// their quantity.
+type unitConversion struct {
+	canonical string
+	convert   func(float64) float64
+}
+
+// canonicalUnits are the units readings are kept in, as mappers report them.
+var canonicalUnits = map[string]bool{
+	"°C": true, "%": true, "W": true, "ppm": true, "hPa": true, "lux": true, "LEL": true,
+	"dB": true, "m³": true, "m/s": true,
+}
+
+// unitConversions convert the other units sources report readings in, by
+// the unit of measurement they announce.
+var unitConversions = map[string]unitConversion{
+	"°F":   {"°C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"K":    {"°C", func(v float64) float64 { return v - 273.15 }},
+	"mW":   {"W", func(v float64) float64 { return v / 1000 }},
+	"kW":   {"W", func(v float64) float64 { return v * 1000 }},
+	"Pa":   {"hPa", func(v float64) float64 { return v / 100 }},
+	"kPa":  {"hPa", func(v float64) float64 { return v * 10 }},
+	"mbar": {"hPa", func(v float64) float64 { return v }},
+	"lx":   {"lux", func(v float64) float64 { return v }},
+	"L":    {"m³", func(v float64) float64 { return v / 1000 }},
+	"mL":   {"m³", func(v float64) float64 { return v / 1e6 }},
+	"ft³":  {"m³", func(v float64) float64 { return v * 0.028316846592 }},
+	"CCF":  {"m³", func(v float64) float64 { return v * 2.8316846592 }},
+	"gal":  {"m³", func(v float64) float64 { return v * 0.003785411784 }},
+	// A-weighted levels are kept as plain dB; the weighting is the
+	// sensor's.
+	"dBA":   {"dB", func(v float64) float64 { return v }},
+	"dB(A)": {"dB", func(v float64) float64 { return v }},
+}
+
+// normalizeUnit converts a reading in unit to its canonical unit. ok is
+// false for units that are neither canonical nor convertible, whose
+// readings are returned unchanged.
+func normalizeUnit(value float64, unit string) (normalized float64, canonical string, ok bool) {
+	if canonicalUnits[unit] {
+		return value, unit, true
+	}
+	conv, ok := unitConversions[unit]
+	if !ok {
+		return value, unit, false
+	}
+	return conv.convert(value), conv.canonical, true
+}
+
+// stateUnit is the unit the states of a device of type t are served in.
+func stateUnit(t VdevType, units string) string {
+	if units == unitsImperial && vdevUnits[t] == "°C" {
+		return "°F"
+	}
+	return vdevUnits[t]
+}
+
+// validateUnitsConfig fails fast on an unknown web.default_units.
+func validateUnitsConfig(cfg *Config, cfgPath string) error {
+	switch cfg.Web.DefaultUnits {
+	case "", unitsMetric, unitsImperial:
+		return nil
+	}
+	return fmt.Errorf("web.default_units must be metric or imperial (got %q) in %s", cfg.Web.DefaultUnits, cfgPath)
+}
+
+// requestUnits picks the unit system of a response: the units query
+// parameter, else web.default_units, else metric. Unknown values resolve like
+// no value at all.
+func requestUnits(c *fiber.Ctx) string {
+	switch units := strings.ToLower(c.Query("units")); units {
+	case unitsMetric, unitsImperial:
+		return units
+	}
+	if cfg := GetConfig(); cfg != nil && cfg.Web.DefaultUnits != "" {
+		return cfg.Web.DefaultUnits
+	}
+	return unitsMetric
+}
+
+// convertState returns a state of a device of type t in the given units.
+// Only temperatures differ in imperial units; other states, and states that
+// aren't numbers, are returned unchanged.
+func convertState(t VdevType, state any, units string) any {
+	if units != unitsImperial || vdevUnits[t] != "°C" {
+		return state
+	}
+	switch v := state.(type) {
+	case float64:
+		return celsiusToFahrenheit(v)
+	case int:
+		return celsiusToFahrenheit(float64(v))
+	case int64:
+		return celsiusToFahrenheit(float64(v))
+	}
+	return state
+}
+
+// celsiusToFahrenheit converts, rounding to hundredths so 22.0 reads 71.6
+// rather than 71.60000000000001.
+func celsiusToFahrenheit(c float64) float64 {
+	return math.Round((c*9/5+32)*100) / 100
+}
+
+// convertStoredState converts a JSON-encoded history state like convertState.
+func convertStoredState(t VdevType, state string, units string) string {
+	if units != unitsImperial || vdevUnits[t] != "°C" {
+		return state
+	}
+	var v any
+	if err := json.Unmarshal([]byte(state), &v); err != nil {
+		return state
+	}
+	b, err := json.Marshal(convertState(t, v, units))
+	if err != nil {
+		return state
+	}
+	return string(b)
+}
+
+// convertUnits converts the states of the room's entities to units.
+func (rs *RoomState) convertUnits(units string) {
+	for i := range rs.Entities {
+		es := &rs.Entities[i]
+		es.State = convertState(VdevType(es.Type), es.State, units)
+	}
+}
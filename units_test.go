@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestConvertState(t *testing.T) {
+	for _, tc := range []struct {
+		typ   VdevType
+		state any
+		units string
+		want  any
+	}{
+		{VdevTypeTemperature, 22.0, unitsImperial, 71.6},
+		{VdevTypeTemperature, -40.0, unitsImperial, -40.0},
+		{VdevTypeTemperature, 0, unitsImperial, 32.0},
+		{VdevTypeTemperature, int64(100), unitsImperial, 212.0},
+		{VdevTypeTemperature, 21.37, unitsImperial, 70.47},
+		{VdevTypeThermostat, 20.0, unitsImperial, 68.0},
+		{VdevTypeTemperature, 22.0, unitsMetric, 22.0},
+		{VdevTypeTemperature, nil, unitsImperial, nil},
+		{VdevTypeTemperature, "unavailable", unitsImperial, "unavailable"},
+		{VdevTypeHumidity, 45.0, unitsImperial, 45.0},
+		{VdevTypeCO2, 800.0, unitsImperial, 800.0},
+		{VdevTypeRelay, true, unitsImperial, true},
+	} {
+		if got := convertState(tc.typ, tc.state, tc.units); got != tc.want {
+			t.Errorf("convertState(%s, %v, %s) = %v, want %v", tc.typ, tc.state, tc.units, got, tc.want)
+		}
+	}
+}
+
+func TestConvertStoredState(t *testing.T) {
+	for _, tc := range []struct {
+		typ   VdevType
+		state string
+		units string
+		want  string
+	}{
+		{VdevTypeTemperature, "22.5", unitsImperial, "72.5"},
+		{VdevTypeTemperature, "22.5", unitsMetric, "22.5"},
+		{VdevTypeTemperature, "null", unitsImperial, "null"},
+		{VdevTypeTemperature, "not json", unitsImperial, "not json"},
+		{VdevTypeHumidity, "45", unitsImperial, "45"},
+	} {
+		if got := convertStoredState(tc.typ, tc.state, tc.units); got != tc.want {
+			t.Errorf("convertStoredState(%s, %s, %s) = %s, want %s", tc.typ, tc.state, tc.units, got, tc.want)
+		}
+	}
+}
+
+func TestValidateUnitsConfig(t *testing.T) {
+	for units, ok := range map[string]bool{"": true, "metric": true, "imperial": true, "fahrenheit": false, "Imperial": false} {
+		err := validateUnitsConfig(&Config{Web: WebConfig{DefaultUnits: units}}, "at2.yaml")
+		if (err == nil) != ok {
+			t.Errorf("%q: err = %v", units, err)
+		}
+	}
+}
+
+// getJSON requests target from app and decodes the response into v.
+func getJSON(t *testing.T, app *fiber.App, target string, v any) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("%s: status %d", target, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s: %v", target, err)
+	}
+}
+
+func TestHandleGetRoomStates_Units(t *testing.T) {
+	setupLiveWsTest(t)
+	app := fiber.New()
+	app.Get("/api/v1/room-states", handleGetRoomStates)
+
+	for _, tc := range []struct {
+		target, defaultUnits string
+		want                 float64
+	}{
+		{"/api/v1/room-states", "", 21.5},
+		{"/api/v1/room-states?units=imperial", "", 70.7},
+		{"/api/v1/room-states?units=metric", "imperial", 21.5},
+		{"/api/v1/room-states", "imperial", 70.7},
+		{"/api/v1/room-states?units=kelvin", "imperial", 70.7},
+	} {
+		GetConfig().Web.DefaultUnits = tc.defaultUnits
+		var states []RoomState
+		getJSON(t, app, tc.target, &states)
+		if got := states[0].Entities[1].State; got != tc.want {
+			t.Errorf("%s (default %q): temperature %v, want %v", tc.target, tc.defaultUnits, got, tc.want)
+		}
+		// Only temperatures are converted.
+		if got := states[0].Entities[0].State; got != 2.0 {
+			t.Errorf("%s: people %v", tc.target, got)
+		}
+	}
+	// The manager keeps the metric state.
+	if got := vdevManager.Device("hall/temp").State; got != 21.5 {
+		t.Fatalf("device state changed to %v", got)
+	}
+}
+
+func TestHandleDevices_Units(t *testing.T) {
+	setupLiveWsTest(t)
+	prevAdapter := mqttAdapter
+	t.Cleanup(func() { mqttAdapter = prevAdapter })
+	mqttAdapter = &MQTTAdapter{}
+	app := fiber.New()
+	app.Get("/api/v1/all-devices", handleDevices)
+
+	states := func(target string) map[string]any {
+		t.Helper()
+		var devices []VirtualDevice
+		getJSON(t, app, target, &devices)
+		byID := map[string]any{}
+		for _, d := range devices {
+			byID[d.ID] = d.State
+		}
+		return byID
+	}
+	if got := states("/api/v1/all-devices"); got["hall/temp"] != 21.5 || got["frigate/person/hall"] != 2.0 {
+		t.Errorf("metric: %v", got)
+	}
+	if got := states("/api/v1/all-devices?units=imperial"); got["hall/temp"] != 70.7 || got["frigate/person/hall"] != 2.0 {
+		t.Errorf("imperial: %v", got)
+	}
+	if got := vdevManager.Device("hall/temp").State; got != 21.5 {
+		t.Fatalf("device state changed to %v", got)
+	}
+
+	var devices []deviceResponse
+	getJSON(t, app, "/api/v1/all-devices?units=imperial", &devices)
+	for _, d := range devices {
+		if want := map[string]string{"hall/temp": "°F"}[d.ID]; d.Unit != want {
+			t.Errorf("%s unit = %q, want %q", d.ID, d.Unit, want)
+		}
+	}
+}
+
+func TestNormalizeUnit(t *testing.T) {
+	for _, tc := range []struct {
+		value     float64
+		unit      string
+		want      float64
+		canonical string
+		ok        bool
+	}{
+		{1.5, "kW", 1500, "W", true},
+		{250, "mW", 0.25, "W", true},
+		{60, "W", 60, "W", true},
+		{212, "°F", 100, "°C", true},
+		{-40, "°F", -40, "°C", true},
+		{293.15, "K", 20, "°C", true},
+		{21.5, "°C", 21.5, "°C", true},
+		{101325, "Pa", 1013.25, "hPa", true},
+		{320, "lx", 320, "lux", true},
+		{45, "%", 45, "%", true},
+		{3, "BTU/h", 3, "BTU/h", false},
+		{7, "", 7, "", false},
+	} {
+		got, canonical, ok := normalizeUnit(tc.value, tc.unit)
+		if math.Abs(got-tc.want) > 1e-9 || canonical != tc.canonical || ok != tc.ok {
+			t.Errorf("normalizeUnit(%v, %q) = %v, %q, %t, want %v, %q, %t", tc.value, tc.unit, got, canonical, ok, tc.want, tc.canonical, tc.ok)
+		}
+	}
+}
+
+func TestMQTTAdapter_NormalizesUnits(t *testing.T) {
+	var logs strings.Builder
+	vm := NewVdevManager()
+	adapter := &MQTTAdapter{log: slog.New(slog.NewTextHandler(&logs, nil)), vdevMgr: vm}
+	mapper := NewESPHomeMapper(nil, testLogger)
+	for node, unit := range map[string]string{"lab-power": "kW", "hall-power": "W", "attic-power": "BTU/h"} {
+		config := `{"dev_cla":"power","unit_of_meas":"` + unit + `","stat_t":"` + node + `/sensor/power/state","uniq_id":"` + node + `power"}`
+		adapter.handleMapperMessage(mapper, "homeassistant/sensor/"+node+"/power/config", []byte(config))
+	}
+	for range 2 {
+		for _, node := range []string{"lab-power", "hall-power", "attic-power"} {
+			adapter.handleMapperMessage(mapper, node+"/sensor/power/state", []byte("1.5"))
+		}
+	}
+
+	for id, want := range map[string]float64{
+		"esphome/lab-power/sensor/power":   1500,
+		"esphome/hall-power/sensor/power":  1.5,
+		"esphome/attic-power/sensor/power": 1.5,
+	} {
+		if got := vm.Device(id).State; got != want {
+			t.Errorf("%s = %v, want %v", id, got, want)
+		}
+	}
+	if n := strings.Count(logs.String(), "unknown unit"); n != 1 || !strings.Contains(logs.String(), "unit=BTU/h") {
+		t.Errorf("want one unknown unit warning for BTU/h, got:\n%s", logs.String())
+	}
+}
+
+func TestHandleDeviceHistory_Units(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, vdevManager, testLogger)
+	vdevHistoryRepo.OnDeviceUpdated(&VirtualDevice{ID: "hall/temp", Type: VdevTypeTemperature, State: 20.0})
+	vdevHistoryRepo.OnDeviceUpdated(&VirtualDevice{ID: "hall/temp", Type: VdevTypeTemperature, State: 21.5})
+	app := fiber.New()
+	app.Get("/api/v1/device-history", handleDeviceHistory)
+
+	for target, want := range map[string][]string{
+		"/api/v1/device-history?device=hall/temp":                {"20", "21.5"},
+		"/api/v1/device-history?device=hall/temp&units=imperial": {"68", "70.7"},
+	} {
+		var history []VirtualDeviceStateModel
+		getJSON(t, app, target, &history)
+		if len(history) != len(want) {
+			t.Fatalf("%s: %d states", target, len(history))
+		}
+		for i, h := range history {
+			if h.State != want[i] {
+				t.Errorf("%s: state %d is %s, want %s", target, i, h.State, want[i])
+			}
+		}
+	}
+
+	// The history keeps the metric states.
+	stored, err := vdevHistoryRepo.GetDeviceHistory("hall/temp", 60_000)
+	if err != nil || len(stored) != 2 || stored[1].State != "21.5" {
+		t.Fatalf("stored %+v, %v", stored, err)
+	}
+}
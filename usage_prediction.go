@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	DefaultUsagePredictionWeeks = 8
+	MaxUsagePredictionWeeks     = 52
+	// MinUsagePredictionSamples is the sample size below which a prediction
+	// is flagged lowConfidence.
+	MinUsagePredictionSamples = 4
+)
+
+// UsagePrediction is served by GET /api/v1/usage-prediction: how the room
+// was used in the same hour of the same weekday over the past weeks.
+type UsagePrediction struct {
+	RoomID string `json:"roomId"`
+	// StartsAt is the start of the hour predicted, in Unix milliseconds.
+	StartsAt int64 `json:"startsAt"`
+	Weekday  int   `json:"weekday"` // 0 = Sunday
+	Hour     int   `json:"hour"`
+	Weeks    int   `json:"weeks"`
+	// Samples is how many of those weeks have history for the hour.
+	Samples int `json:"samples"`
+	// OccupancyProbability is the share of the samples in which anybody
+	// was present during the hour.
+	OccupancyProbability float64 `json:"occupancyProbability"`
+	// MedianPeople is the median of the most people present in each sample.
+	MedianPeople  float64 `json:"medianPeople"`
+	LowConfidence bool    `json:"lowConfidence"`
+}
+
+func handleUsagePrediction(c *fiber.Ctx) error {
+	if vdevHistoryRepo == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "device history not available"})
+	}
+	roomId := c.Query("roomId")
+	at := time.Now()
+	if s := c.Query("at"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "at must be an RFC 3339 time"})
+		}
+		at = t
+	}
+	weeks := DefaultUsagePredictionWeeks
+	if s := c.Query("weeks"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxUsagePredictionWeeks {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("weeks must be 1 to %d", MaxUsagePredictionWeeks)})
+		}
+		weeks = n
+	}
+
+	cfg := GetConfig()
+	rooms := cfg.Rooms
+	if roomId != "" {
+		i := slices.IndexFunc(cfg.Rooms, func(r RoomConfig) bool { return r.ID == roomId })
+		if i < 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "room not found"})
+		}
+		rooms = cfg.Rooms[i : i+1]
+	}
+
+	prediction, err := computeUsagePrediction(vdevHistoryRepo, rooms, roomId, at, weeks, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(prediction)
+}
+
+// computeUsagePrediction samples the hour of at, in the server's local time,
+// on the same weekday in each of the weeks before it. Hours that haven't
+// ended by now, or started before the first presence reading, aren't
+// samples. Like the heatmap, the hourly stats come from the day cache of
+// cacheKey and are computed and cached for the days missing.
+func computeUsagePrediction(repo *VirtualDeviceHistoryRepository, rooms []RoomConfig, cacheKey string, at time.Time, weeks int, now time.Time) (*UsagePrediction, error) {
+	at = at.In(now.Location())
+	hour := time.Date(at.Year(), at.Month(), at.Day(), at.Hour(), 0, 0, 0, at.Location())
+	prediction := &UsagePrediction{
+		RoomID:   cacheKey,
+		StartsAt: hour.UnixMilli(),
+		Weekday:  int(hour.Weekday()),
+		Hour:     hour.Hour(),
+		Weeks:    weeks,
+	}
+	sensorNames, roomToSensors := presenceSensors(rooms)
+	earliest, ok, err := repo.GetEarliestStateTimestamp(sensorNames)
+	if err != nil || !ok {
+		prediction.LowConfidence = true
+		return prediction, err
+	}
+
+	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var cells []time.Time
+	days := make(map[string]time.Time)
+	for week := 1; week <= weeks; week++ {
+		cell := hour.AddDate(0, 0, -7*week)
+		if cell.Add(time.Hour).After(now) || cell.UnixMilli() < earliest {
+			continue
+		}
+		cells = append(cells, cell)
+		days[cell.Format("2006-01-02")] = time.Date(cell.Year(), cell.Month(), cell.Day(), 0, 0, 0, 0, cell.Location())
+	}
+
+	var pastDates []string
+	for dateStr, dayStart := range days {
+		if dayStart.Before(todayStart) {
+			pastDates = append(pastDates, dateStr)
+		}
+	}
+	caches, err := repo.GetDayCaches(cacheKey, pastDates)
+	if err != nil {
+		return nil, err
+	}
+	hourly := make(map[string][]UsageHeatmapDataPoint, len(days))
+	daysToCompute := make(map[string]time.Time)
+	for dateStr, dayStart := range days {
+		cached, ok := caches[dateStr]
+		if !ok {
+			daysToCompute[dateStr] = dayStart
+			continue
+		}
+		var points []UsageHeatmapDataPoint
+		if err := json.Unmarshal([]byte(cached.HourlyData), &points); err != nil {
+			daysToCompute[dateStr] = dayStart
+			continue
+		}
+		hourly[dateStr] = points
+	}
+	computed, err := computeUsageDays(repo, cacheKey, sensorNames, roomToSensors, daysToCompute, todayStart, now)
+	if err != nil {
+		return nil, err
+	}
+	for dateStr, day := range computed {
+		hourly[dateStr] = day.hourly
+	}
+
+	var occupied int
+	var people []int
+	for _, cell := range cells {
+		points := hourly[cell.Format("2006-01-02")]
+		// An hour may be missing on a day with a DST change.
+		i := slices.IndexFunc(points, func(p UsageHeatmapDataPoint) bool { return p.StartsAt == cell.UnixMilli() })
+		if i < 0 {
+			continue
+		}
+		if points[i].ActiveHours > 0 {
+			occupied++
+		}
+		people = append(people, points[i].MaxPeople)
+	}
+	prediction.Samples = len(people)
+	if len(people) > 0 {
+		prediction.OccupancyProbability = float64(occupied) / float64(len(people))
+		slices.Sort(people)
+		mid := len(people) / 2
+		prediction.MedianPeople = float64(people[mid])
+		if len(people)%2 == 0 {
+			prediction.MedianPeople = float64(people[mid-1]+people[mid]) / 2
+		}
+	}
+	prediction.LowConfidence = prediction.Samples < MinUsagePredictionSamples
+	return prediction, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestComputeUsagePrediction(t *testing.T) {
+	setupTestDB(t)
+	repo := NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	rooms := []RoomConfig{{ID: "hackroom", Entities: []EntityConfig{{ID: "hackroom/people", Representation: "person"}}}}
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC) // a Wednesday
+	at := time.Date(2026, 10, 14, 18, 30, 0, 0, time.UTC)
+
+	if p, err := computeUsagePrediction(repo, rooms, "hackroom", at, 8, now); err != nil || p.Samples != 0 || !p.LowConfidence {
+		t.Fatalf("without history: %+v, %v", p, err)
+	}
+
+	id, err := repo.getOrCreateDeviceID("hackroom/people", string(VdevTypePerson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(weeksAgo, hour, minute int, count string) {
+		ts := time.Date(2026, 10, 14-7*weeksAgo, hour, minute, 0, 0, time.UTC)
+		gormDB.Create(&VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: ts.UnixMilli(), VirtualDeviceID: id, State: count})
+	}
+	// The history starts five weeks ago, so older Wednesdays aren't samples.
+	record(5, 8, 0, "0")
+	record(4, 18, 50, "2")
+	record(4, 20, 0, "0")
+	record(2, 17, 0, "1")
+	record(2, 19, 0, "0")
+	record(1, 18, 10, "3")
+	record(1, 18, 40, "0")
+
+	for _, tc := range []struct {
+		weeks       int
+		samples     int
+		probability float64
+		median      float64
+		low         bool
+	}{
+		// Most people at 18:00 five weeks ago to one week ago: 0, 2, 0, 1, 3.
+		{8, 5, 3.0 / 5, 1, false},
+		{8, 5, 3.0 / 5, 1, false}, // again, from the day cache
+		// One week ago to three weeks ago: 0, 1, 3.
+		{3, 3, 2.0 / 3, 1, true},
+		{2, 2, 1, 2, true},
+	} {
+		p, err := computeUsagePrediction(repo, rooms, "hackroom", at, tc.weeks, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Samples != tc.samples || !approxEqual(p.OccupancyProbability, tc.probability) || p.MedianPeople != tc.median || p.LowConfidence != tc.low {
+			t.Errorf("over %d weeks: %+v", tc.weeks, p)
+		}
+		if p.Weekday != int(time.Wednesday) || p.Hour != 18 || p.StartsAt != time.Date(2026, 10, 14, 18, 0, 0, 0, time.UTC).UnixMilli() {
+			t.Errorf("predicted cell %d/%d at %d", p.Weekday, p.Hour, p.StartsAt)
+		}
+	}
+	var cached int64
+	gormDB.Model(&UsageStatsDayCache{}).Where("room_id = ?", "hackroom").Count(&cached)
+	if cached != 5 {
+		t.Errorf("%d days cached, want 5", cached)
+	}
+}
+
+func TestHandleUsagePrediction(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, vdevManager, testLogger)
+	setConfig(&Config{Rooms: []RoomConfig{{ID: "hackroom", Entities: []EntityConfig{{ID: "hackroom/people", Representation: "person"}}}}})
+	app := fiber.New()
+	app.Get("/api/v1/usage-prediction", handleUsagePrediction)
+
+	for target, want := range map[string]int{
+		"/api/v1/usage-prediction":                                fiber.StatusOK,
+		"/api/v1/usage-prediction?roomId=hackroom&weeks=4":        fiber.StatusOK,
+		"/api/v1/usage-prediction?roomId=lounge":                  fiber.StatusNotFound,
+		"/api/v1/usage-prediction?at=tomorrow":                    fiber.StatusBadRequest,
+		"/api/v1/usage-prediction?weeks=0":                        fiber.StatusBadRequest,
+		"/api/v1/usage-prediction?at=2026-10-14T18:30:00%2B02:00": fiber.StatusOK,
+	} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("%s: %d, want %d", target, resp.StatusCode, want)
+		}
+	}
+	var got UsagePrediction
+	getJSON(t, app, "/api/v1/usage-prediction?roomId=hackroom", &got)
+	if got.RoomID != "hackroom" || got.Weeks != DefaultUsagePredictionWeeks || got.Samples != 0 || !got.LowConfidence {
+		t.Errorf("%+v", got)
+	}
+}
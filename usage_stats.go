@@ -18,6 +18,9 @@ type UsageHeatmapDataPoint struct {
 
 type UsageHeatmapResponse struct {
 	DataPoints []UsageHeatmapDataPoint `json:"dataPoints"`
+	// ComputedAt is when the data points were computed, in Unix
+	// milliseconds: earlier than the request when served precomputed.
+	ComputedAt int64 `json:"computedAt"`
 }
 
 const (
@@ -30,46 +33,22 @@ const (
 func handleUsageHeatmap(c *fiber.Ctx) error {
 	roomId := c.Query("roomId")
 	resolution := c.Query("resolution", "day")
-	durationStr := c.Query("duration")
 
-	var durationHours int
-	if resolution == "day" {
-		if durationStr == "" {
-			durationHours = DefaultDailyDurationHours
-		} else {
-			fmt.Sscanf(durationStr, "%d", &durationHours)
-			durationHours *= 24
-		}
-		if durationHours > MaxDailyDurationHours {
-			durationHours = MaxDailyDurationHours
-		}
-	} else if resolution == "hour" {
-		if durationStr == "" {
-			durationHours = DefaultHourlyDurationHours
-		} else {
-			fmt.Sscanf(durationStr, "%d", &durationHours)
-		}
-		if durationHours > MaxHourlyDurationHours {
-			durationHours = MaxHourlyDurationHours
-		}
-	} else {
+	durationHours, ok := usageHeatmapHours(resolution, c.Query("duration"))
+	if !ok {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid resolution. Use 'day' or 'hour'.")
 	}
 
-	cfg := MustLoadConfig()
-	var rooms []RoomConfig
-	if roomId != "" {
-		for _, r := range cfg.Rooms {
-			if r.ID == roomId {
-				rooms = append(rooms, r)
-				break
-			}
-		}
-		if len(rooms) == 0 {
-			return c.Status(fiber.StatusNotFound).SendString("Room not found")
-		}
-	} else {
-		rooms = cfg.Rooms
+	cfg := GetConfig()
+	rooms, ok := usageHeatmapRooms(cfg, roomId)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Room not found")
+	}
+
+	// The usage stats worker may have it precomputed.
+	key := usageReportKey{roomID: roomId, resolution: resolution, hours: durationHours}
+	if resp := usageStatsWorker.lookup(cfg, key, time.Now()); resp != nil {
+		return c.JSON(resp)
 	}
 
 	resp, err := computeUsageHeatmap(vdevHistoryRepo, rooms, roomId, resolution, durationHours)
@@ -79,6 +58,41 @@ func handleUsageHeatmap(c *fiber.Ctx) error {
 	return c.JSON(resp)
 }
 
+// usageHeatmapHours converts the duration of a heatmap, in days by day and
+// in hours by hour, to hours within the maximum of the resolution. An empty
+// duration is the default. ok is false for an unknown resolution.
+func usageHeatmapHours(resolution, duration string) (hours int, ok bool) {
+	switch resolution {
+	case "day":
+		if duration == "" {
+			return DefaultDailyDurationHours, true
+		}
+		fmt.Sscanf(duration, "%d", &hours)
+		return min(hours*24, MaxDailyDurationHours), true
+	case "hour":
+		if duration == "" {
+			return DefaultHourlyDurationHours, true
+		}
+		fmt.Sscanf(duration, "%d", &hours)
+		return min(hours, MaxHourlyDurationHours), true
+	}
+	return 0, false
+}
+
+// usageHeatmapRooms returns the room of roomId, or all rooms when it is
+// empty. ok is false for an unknown room.
+func usageHeatmapRooms(cfg *Config, roomId string) (rooms []RoomConfig, ok bool) {
+	if roomId == "" {
+		return cfg.Rooms, true
+	}
+	for _, r := range cfg.Rooms {
+		if r.ID == roomId {
+			return []RoomConfig{r}, true
+		}
+	}
+	return nil, false
+}
+
 // computedDayData holds the pre-computed results for a single calendar day.
 type computedDayData struct {
 	daily  UsageHeatmapDataPoint
@@ -88,22 +102,12 @@ type computedDayData struct {
 // computeUsageHeatmap is the core logic, extracted for testability.
 // cacheKey is the roomId (or "" for all rooms).
 func computeUsageHeatmap(repo *VirtualDeviceHistoryRepository, rooms []RoomConfig, cacheKey, resolution string, durationHours int) (*UsageHeatmapResponse, error) {
-	var sensorNames []string
-	roomToSensors := make(map[string][]string)
-	for _, r := range rooms {
-		for _, e := range r.Entities {
-			if e.Representation == "presence" || e.Representation == "person" {
-				sensorNames = append(sensorNames, e.ID)
-				roomToSensors[r.ID] = append(roomToSensors[r.ID], e.ID)
-			}
-		}
-	}
-
+	now := time.Now()
+	sensorNames, roomToSensors := presenceSensors(rooms)
 	if len(sensorNames) == 0 {
-		return &UsageHeatmapResponse{DataPoints: []UsageHeatmapDataPoint{}}, nil
+		return &UsageHeatmapResponse{DataPoints: []UsageHeatmapDataPoint{}, ComputedAt: now.UnixMilli()}, nil
 	}
 
-	now := time.Now()
 	durationMs := int64(durationHours) * 60 * 60 * 1000
 
 	// Round start time to resolution boundary.
@@ -126,7 +130,7 @@ func computeUsageHeatmap(repo *VirtualDeviceHistoryRepository, rooms []RoomConfi
 		bucketTimes = append(bucketTimes, bt)
 	}
 	if len(bucketTimes) == 0 {
-		return &UsageHeatmapResponse{DataPoints: []UsageHeatmapDataPoint{}}, nil
+		return &UsageHeatmapResponse{DataPoints: []UsageHeatmapDataPoint{}, ComputedAt: now.UnixMilli()}, nil
 	}
 
 	// --- Cache lookup for complete days ---
@@ -167,58 +171,9 @@ func computeUsageHeatmap(repo *VirtualDeviceHistoryRepository, rooms []RoomConfi
 
 	// --- DB query for uncached days ---
 
-	computedResults := make(map[string]computedDayData)
-	if len(daysToCompute) > 0 {
-		var minDay, maxDay time.Time
-		first := true
-		for _, d := range daysToCompute {
-			if first || d.Before(minDay) {
-				minDay = d
-			}
-			if first || d.After(maxDay) {
-				maxDay = d
-			}
-			first = false
-		}
-
-		// Query from 2 hours before the earliest day to capture sensors active around midnight.
-		queryFrom := minDay.Add(-2 * time.Hour)
-		queryTo := maxDay.Add(24 * time.Hour)
-		if queryTo.After(now) {
-			queryTo = now
-		}
-
-		history, err := repo.GetDevicesHistoryInRange(sensorNames, queryFrom.UnixMilli(), queryTo.UnixMilli())
-		if err != nil {
-			return nil, err
-		}
-
-		for dateStr, dayStart := range daysToCompute {
-			dayEnd := dayStart.Add(24 * time.Hour)
-			if dayEnd.After(now) {
-				dayEnd = now
-			}
-
-			// Filter sorted history to [dayStart-2h, dayEnd) using binary search.
-			lookbackMs := dayStart.Add(-2 * time.Hour).UnixMilli()
-			dayHistory := filterHistoryInRange(history, lookbackMs, dayEnd.UnixMilli())
-
-			daily, hourly := computeDayBuckets(dayHistory, roomToSensors, dayStart, dayEnd)
-			computedResults[dateStr] = computedDayData{daily: daily, hourly: hourly}
-
-			// Upsert cache only for complete (past) days.
-			if dayStart.Before(todayStart) {
-				hourlyJSON, _ := json.Marshal(hourly)
-				_ = repo.UpsertDayCache(&UsageStatsDayCache{
-					RoomID:      cacheKey,
-					Date:        dateStr,
-					MaxPeople:   daily.MaxPeople,
-					ManHours:    daily.ManHours,
-					ActiveHours: daily.ActiveHours,
-					HourlyData:  string(hourlyJSON),
-				})
-			}
-		}
+	computedResults, err := computeUsageDays(repo, cacheKey, sensorNames, roomToSensors, daysToCompute, todayStart, now)
+	if err != nil {
+		return nil, err
 	}
 
 	// --- Assemble response ---
@@ -262,7 +217,83 @@ func computeUsageHeatmap(repo *VirtualDeviceHistoryRepository, rooms []RoomConfi
 		dataPoints = append(dataPoints, dp)
 	}
 
-	return &UsageHeatmapResponse{DataPoints: dataPoints}, nil
+	return &UsageHeatmapResponse{DataPoints: dataPoints, ComputedAt: now.UnixMilli()}, nil
+}
+
+// presenceSensors returns the presence and person entities of the rooms,
+// and them grouped by room ID.
+func presenceSensors(rooms []RoomConfig) (sensorNames []string, roomToSensors map[string][]string) {
+	roomToSensors = make(map[string][]string)
+	for _, r := range rooms {
+		for _, e := range r.Entities {
+			if e.Representation == "presence" || e.Representation == "person" {
+				sensorNames = append(sensorNames, e.ID)
+				roomToSensors[r.ID] = append(roomToSensors[r.ID], e.ID)
+			}
+		}
+	}
+	return sensorNames, roomToSensors
+}
+
+// computeUsageDays computes the stats of the given days (keyed by
+// "2006-01-02") from the history in one query, and caches those of complete
+// days, before todayStart.
+func computeUsageDays(repo *VirtualDeviceHistoryRepository, cacheKey string, sensorNames []string, roomToSensors map[string][]string, days map[string]time.Time, todayStart, now time.Time) (map[string]computedDayData, error) {
+	computedResults := make(map[string]computedDayData)
+	if len(days) == 0 {
+		return computedResults, nil
+	}
+	var minDay, maxDay time.Time
+	first := true
+	for _, d := range days {
+		if first || d.Before(minDay) {
+			minDay = d
+		}
+		if first || d.After(maxDay) {
+			maxDay = d
+		}
+		first = false
+	}
+
+	// Query from 2 hours before the earliest day to capture sensors active around midnight.
+	queryFrom := minDay.Add(-2 * time.Hour)
+	queryTo := maxDay.Add(24 * time.Hour)
+	if queryTo.After(now) {
+		queryTo = now
+	}
+
+	history, err := repo.GetDevicesHistoryInRange(sensorNames, queryFrom.UnixMilli(), queryTo.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	for dateStr, dayStart := range days {
+		dayEnd := dayStart.Add(24 * time.Hour)
+		if dayEnd.After(now) {
+			dayEnd = now
+		}
+
+		// Filter sorted history to [dayStart-2h, dayEnd) using binary search.
+		lookbackMs := dayStart.Add(-2 * time.Hour).UnixMilli()
+		dayHistory := filterHistoryInRange(history, lookbackMs, dayEnd.UnixMilli())
+
+		daily, hourly := computeDayBuckets(dayHistory, roomToSensors, dayStart, dayEnd)
+		computedResults[dateStr] = computedDayData{daily: daily, hourly: hourly}
+
+		// Upsert cache only for complete (past) days.
+		if dayStart.Before(todayStart) {
+			hourlyJSON, _ := json.Marshal(hourly)
+			_ = repo.UpsertDayCache(&UsageStatsDayCache{
+				RoomID:      cacheKey,
+				Date:        dateStr,
+				MaxPeople:   daily.MaxPeople,
+				ManHours:    daily.ManHours,
+				ActiveHours: daily.ActiveHours,
+				HourlyData:  string(hourlyJSON),
+			})
+		}
+	}
+	return computedResults, nil
 }
 
 // filterHistoryInRange returns the slice of history records with timestamp in [fromMs, toMs).
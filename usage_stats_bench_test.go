@@ -60,7 +60,7 @@ func setupBenchDB(b *testing.B) (*VirtualDeviceHistoryRepository, []RoomConfig)
 	}
 
 	mgr := NewVdevManager()
-	repo := NewVirtualDeviceHistoryRepository(db, mgr)
+	repo := NewVirtualDeviceHistoryRepository(db, mgr, testLogger)
 
 	rooms := []RoomConfig{
 		{
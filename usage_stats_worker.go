@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultUsageStatsInterval is usage_stats.interval when it isn't set.
+	defaultUsageStatsInterval = 15 * time.Minute
+	// defaultUsageStatsDebounce is usage_stats.debounce when it isn't set.
+	defaultUsageStatsDebounce = time.Minute
+	// usageStatsMaxAgeIntervals is how many intervals old a precomputed
+	// report may be and still be served, so a worker that keeps failing
+	// falls back to computing on demand.
+	usageStatsMaxAgeIntervals = 2
+)
+
+// UsageStatsConfig keeps usage heatmaps precomputed in the background, so
+// /api/v1/stats/usage-heatmap serves the slow ones, like 60 days by day,
+// from memory. Other parameters are still computed on demand.
+type UsageStatsConfig struct {
+	// Reports are the heatmaps kept precomputed. Default: the two views of
+	// the web UI, 60 days by day and 14 days by hour, for all rooms together
+	// and for each room with presence sensors.
+	Reports []UsageReportConfig `yaml:"reports"`
+	// Interval is a Go duration between recomputations. Default "15m".
+	Interval string `yaml:"interval"`
+	// Debounce is how long presence must stay unchanged after a change
+	// before the reports are recomputed early. Default "1m"; "0s" only
+	// recomputes every interval.
+	Debounce string `yaml:"debounce"`
+}
+
+// UsageReportConfig is one precomputed heatmap, with the parameters of the
+// endpoint.
+type UsageReportConfig struct {
+	// RoomID is the room, or empty for all rooms together.
+	RoomID string `yaml:"room_id"`
+	// Resolution is "day" or "hour".
+	Resolution string `yaml:"resolution"`
+	// Duration is in days by day and in hours by hour. Default that of the
+	// endpoint.
+	Duration int `yaml:"duration"`
+}
+
+func (c *UsageStatsConfig) interval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil {
+		return d
+	}
+	return defaultUsageStatsInterval
+}
+
+func (c *UsageStatsConfig) debounce() time.Duration {
+	if d, err := time.ParseDuration(c.Debounce); err == nil {
+		return d
+	}
+	return defaultUsageStatsDebounce
+}
+
+// validateUsageStatsConfig fails fast on bad durations and on reports the
+// endpoint would reject.
+func validateUsageStatsConfig(cfg *Config, cfgPath string) error {
+	us := cfg.UsageStats
+	if us == nil {
+		return nil
+	}
+	if us.Interval != "" {
+		if d, err := time.ParseDuration(us.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("usage_stats.interval is not a positive duration (%q) in %s", us.Interval, cfgPath)
+		}
+	}
+	if us.Debounce != "" {
+		if d, err := time.ParseDuration(us.Debounce); err != nil || d < 0 {
+			return fmt.Errorf("usage_stats.debounce is not a valid duration (%q) in %s", us.Debounce, cfgPath)
+		}
+	}
+	for i, r := range us.Reports {
+		if r.RoomID != "" && !slices.ContainsFunc(cfg.Rooms, func(room RoomConfig) bool { return room.ID == r.RoomID }) {
+			return fmt.Errorf("usage_stats.reports[%d] has unknown room %q in %s", i, r.RoomID, cfgPath)
+		}
+		if r.Resolution != "day" && r.Resolution != "hour" {
+			return fmt.Errorf("usage_stats.reports[%d].resolution must be day or hour (got %q) in %s", i, r.Resolution, cfgPath)
+		}
+		if r.Duration < 0 {
+			return fmt.Errorf("usage_stats.reports[%d].duration must not be negative in %s", i, cfgPath)
+		}
+	}
+	return nil
+}
+
+// usageReportKey identifies a heatmap by the normalized parameters of the
+// endpoint.
+type usageReportKey struct {
+	roomID     string
+	resolution string
+	hours      int
+}
+
+// usageReport is a report of a config, resolved to its rooms.
+type usageReport struct {
+	key   usageReportKey
+	rooms []RoomConfig
+}
+
+// usageReports resolves the reports of cfg.UsageStats, or the default ones.
+func usageReports(cfg *Config) []usageReport {
+	defs := cfg.UsageStats.Reports
+	if len(defs) == 0 {
+		roomIDs := []string{""}
+		for _, room := range cfg.Rooms {
+			if sensors, _ := presenceSensors([]RoomConfig{room}); len(sensors) > 0 {
+				roomIDs = append(roomIDs, room.ID)
+			}
+		}
+		for _, id := range roomIDs {
+			defs = append(defs,
+				UsageReportConfig{RoomID: id, Resolution: "day", Duration: MaxDailyDurationHours / 24},
+				UsageReportConfig{RoomID: id, Resolution: "hour", Duration: MaxHourlyDurationHours})
+		}
+	}
+	var reports []usageReport
+	for _, def := range defs {
+		duration := ""
+		if def.Duration > 0 {
+			duration = strconv.Itoa(def.Duration)
+		}
+		hours, ok := usageHeatmapHours(def.Resolution, duration)
+		if !ok {
+			continue
+		}
+		rooms, ok := usageHeatmapRooms(cfg, def.RoomID)
+		if !ok {
+			continue
+		}
+		key := usageReportKey{roomID: def.RoomID, resolution: def.Resolution, hours: hours}
+		if slices.ContainsFunc(reports, func(r usageReport) bool { return r.key == key }) {
+			continue
+		}
+		reports = append(reports, usageReport{key: key, rooms: rooms})
+	}
+	return reports
+}
+
+// UsageStatsWorker recomputes the configured usage reports every interval,
+// and a debounce after presence changes, for the heatmap endpoint to
+// serve. A failed recomputation keeps the previous result until it is too
+// old; requests never wait for the worker.
+type UsageStatsWorker struct {
+	vdev *VdevManager
+	repo *VirtualDeviceHistoryRepository
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	cfg      *Config
+	reports  []usageReport
+	sensors  map[string]bool
+	interval time.Duration
+	debounce time.Duration
+	results  map[usageReportKey]*UsageHeatmapResponse
+	// resultsCfg is the config the results were computed for.
+	resultsCfg *Config
+	timer      *time.Timer
+	ticker     *time.Ticker
+
+	// kick asks the worker to recompute now.
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewUsageStatsWorker prepares the reports of cfg.UsageStats, which must be
+// set. Recomputation starts with Start.
+func NewUsageStatsWorker(cfg *Config, vdev *VdevManager, repo *VirtualDeviceHistoryRepository, logger *slog.Logger) *UsageStatsWorker {
+	s := &UsageStatsWorker{vdev: vdev, repo: repo, log: logger, kick: make(chan struct{}, 1)}
+	s.loadConfig(cfg)
+	return s
+}
+
+// loadConfig takes the reports and timings of cfg. The results of the
+// previous config are no longer served; the reports are recomputed at once.
+func (s *UsageStatsWorker) loadConfig(cfg *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	s.reports, s.sensors = nil, map[string]bool{}
+	if cfg.UsageStats == nil {
+		return
+	}
+	s.reports = usageReports(cfg)
+	for _, r := range s.reports {
+		names, _ := presenceSensors(r.rooms)
+		for _, name := range names {
+			s.sensors[name] = true
+		}
+	}
+	s.interval, s.debounce = cfg.UsageStats.interval(), cfg.UsageStats.debounce()
+	if s.ticker != nil {
+		s.ticker.Reset(s.interval)
+		s.trigger()
+	}
+}
+
+// Start recomputes the reports now, every interval and after presence
+// changes settle, until Stop.
+func (s *UsageStatsWorker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	s.mu.Lock()
+	s.ticker = time.NewTicker(s.interval)
+	s.mu.Unlock()
+	s.vdev.OnVirtualDeviceUpdated = append(s.vdev.OnVirtualDeviceUpdated, s.onDeviceUpdate)
+	OnConfigReload(s.loadConfig)
+	go func() {
+		defer close(s.done)
+		defer s.ticker.Stop()
+		s.recompute(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.ticker.C:
+			case <-s.kick:
+			}
+			s.recompute(ctx)
+		}
+	}()
+}
+
+// Stop ends the recomputations.
+func (s *UsageStatsWorker) Stop() {
+	s.cancel()
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// trigger asks for a recomputation unless one is already waiting.
+func (s *UsageStatsWorker) trigger() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// onDeviceUpdate recomputes the reports once the presence sensors they use
+// have been quiet for the debounce.
+func (s *UsageStatsWorker) onDeviceUpdate(dev *VirtualDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sensors[dev.ID] || s.debounce == 0 {
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.debounce, s.trigger)
+		return
+	}
+	s.timer.Reset(s.debounce)
+}
+
+// recompute computes every report and keeps the results of those that
+// succeeded; a failed or panicking report keeps its previous result.
+func (s *UsageStatsWorker) recompute(ctx context.Context) {
+	s.mu.Lock()
+	cfg, reports := s.cfg, s.reports
+	s.mu.Unlock()
+
+	results := make(map[usageReportKey]*UsageHeatmapResponse, len(reports))
+	for _, r := range reports {
+		if ctx.Err() != nil {
+			return
+		}
+		resp, err := s.compute(r)
+		if err != nil {
+			s.log.Warn("precomputing usage report failed", "room", r.key.roomID, "resolution", r.key.resolution, "hours", r.key.hours, "err", err)
+			continue
+		}
+		results[r.key] = resp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg != cfg {
+		// Reloaded meanwhile; the new config is recomputed next.
+		return
+	}
+	if s.resultsCfg == cfg {
+		for key, resp := range s.results {
+			if _, ok := results[key]; !ok {
+				results[key] = resp
+			}
+		}
+	}
+	s.results, s.resultsCfg = results, cfg
+}
+
+// compute computes one report. A panic fails only that report, so the others
+// are still computed and its previous result is kept.
+func (s *UsageStatsWorker) compute(r usageReport) (resp *UsageHeatmapResponse, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return computeUsageHeatmap(s.repo, r.rooms, r.key.roomID, r.key.resolution, r.key.hours)
+}
+
+// lookup returns the precomputed heatmap of the parameters under cfg, or
+// nil when there is none recent enough. A nil worker has none.
+func (s *UsageStatsWorker) lookup(cfg *Config, key usageReportKey, now time.Time) *UsageHeatmapResponse {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resultsCfg != cfg {
+		return nil
+	}
+	resp, ok := s.results[key]
+	if !ok || now.Sub(time.UnixMilli(resp.ComputedAt)) > usageStatsMaxAgeIntervals*s.interval {
+		return nil
+	}
+	return resp
+}
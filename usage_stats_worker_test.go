@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupUsageStatsWorkerTest serves the heatmap from a room with a person
+// sensor, with a worker precomputing reports over a day by hour.
+func setupUsageStatsWorkerTest(t *testing.T, us *UsageStatsConfig) (*fiber.App, *UsageStatsWorker) {
+	t.Helper()
+	prevCfg, prevRepo, prevWorker := GetConfig(), vdevHistoryRepo, usageStatsWorker
+	t.Cleanup(func() {
+		setConfig(prevCfg)
+		vdevHistoryRepo, usageStatsWorker = prevRepo, prevWorker
+	})
+
+	setupTestDB(t)
+	vdevHistoryRepo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	cfg := &Config{
+		Rooms: []RoomConfig{
+			{ID: "hackroom", Entities: []EntityConfig{{ID: "hackroom/people", Representation: "person"}}},
+			{ID: "hall", Entities: []EntityConfig{{ID: "hall/temp", Representation: "temperature"}}},
+		},
+		UsageStats: us,
+	}
+	setConfig(cfg)
+	usageStatsWorker = NewUsageStatsWorker(cfg, NewVdevManager(), vdevHistoryRepo, testLogger)
+
+	app := fiber.New()
+	app.Get("/api/v1/stats/usage-heatmap", handleUsageHeatmap)
+	return app, usageStatsWorker
+}
+
+// heatmapManHours sums the man-hours of a heatmap response.
+func heatmapManHours(resp UsageHeatmapResponse) float64 {
+	total := 0.0
+	for _, dp := range resp.DataPoints {
+		total += dp.ManHours
+	}
+	return total
+}
+
+func TestHandleUsageHeatmap_ServesPrecomputed(t *testing.T) {
+	app, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{
+		Reports: []UsageReportConfig{{RoomID: "hackroom", Resolution: "hour", Duration: 24}},
+	})
+	now := time.Now()
+	recordStates(t, vdevHistoryRepo, "hackroom/people", VdevTypePerson, now.Add(-3*time.Hour).UnixMilli(), "2")
+	recordStates(t, vdevHistoryRepo, "hackroom/people", VdevTypePerson, now.Add(-2*time.Hour).UnixMilli(), "0")
+
+	worker.recompute(context.Background())
+	const url = "/api/v1/stats/usage-heatmap?roomId=hackroom&resolution=hour&duration=24"
+	var precomputed UsageHeatmapResponse
+	getJSON(t, app, url, &precomputed)
+	if len(precomputed.DataPoints) != 25 || !approxEqual(heatmapManHours(precomputed), 2) {
+		t.Fatalf("precomputed: %d points, %v man-hours", len(precomputed.DataPoints), heatmapManHours(precomputed))
+	}
+
+	// Until recomputed, the endpoint serves the same result.
+	recordStates(t, vdevHistoryRepo, "hackroom/people", VdevTypePerson, now.Add(-time.Hour).UnixMilli(), "1")
+	var again UsageHeatmapResponse
+	getJSON(t, app, url, &again)
+	if again.ComputedAt != precomputed.ComputedAt || !approxEqual(heatmapManHours(again), 2) {
+		t.Fatalf("not served precomputed: computed at %d, %v man-hours", again.ComputedAt, heatmapManHours(again))
+	}
+
+	// Other parameters are computed on demand.
+	var onDemand UsageHeatmapResponse
+	getJSON(t, app, "/api/v1/stats/usage-heatmap?roomId=hackroom&resolution=hour&duration=12", &onDemand)
+	if onDemand.ComputedAt < precomputed.ComputedAt || heatmapManHours(onDemand) < 2.9 {
+		t.Fatalf("on demand: computed at %d, %v man-hours", onDemand.ComputedAt, heatmapManHours(onDemand))
+	}
+
+	// A result too old isn't served, e.g. when the worker keeps failing.
+	worker.mu.Lock()
+	worker.results[usageReportKey{"hackroom", "hour", 24}].ComputedAt = now.Add(-3 * defaultUsageStatsInterval).UnixMilli()
+	worker.mu.Unlock()
+	var expired UsageHeatmapResponse
+	getJSON(t, app, url, &expired)
+	if expired.ComputedAt < precomputed.ComputedAt || heatmapManHours(expired) < 2.9 {
+		t.Fatalf("expired: computed at %d, %v man-hours", expired.ComputedAt, heatmapManHours(expired))
+	}
+}
+
+func TestHandleUsageHeatmap_IgnoresResultsOfOtherConfig(t *testing.T) {
+	app, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{})
+	worker.recompute(context.Background())
+	if resp := worker.lookup(GetConfig(), usageReportKey{"", "day", MaxDailyDurationHours}, time.Now()); resp == nil {
+		t.Fatal("default report over 60 days by day not precomputed")
+	}
+	if resp := worker.lookup(GetConfig(), usageReportKey{"hall", "day", MaxDailyDurationHours}, time.Now()); resp != nil {
+		t.Fatal("room without presence sensors precomputed")
+	}
+
+	// A reloaded config may have other rooms.
+	reloaded := *GetConfig()
+	setConfig(&reloaded)
+	var resp UsageHeatmapResponse
+	before := time.Now().UnixMilli()
+	getJSON(t, app, "/api/v1/stats/usage-heatmap?resolution=day&duration=60", &resp)
+	if resp.ComputedAt < before {
+		t.Fatalf("served the result of the previous config, computed at %d", resp.ComputedAt)
+	}
+}
+
+func TestUsageStatsWorker_FailureKeepsPreviousResult(t *testing.T) {
+	_, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{
+		Reports: []UsageReportConfig{{RoomID: "hackroom", Resolution: "day"}},
+	})
+	key := usageReportKey{"hackroom", "day", DefaultDailyDurationHours}
+	worker.recompute(context.Background())
+	first := worker.lookup(GetConfig(), key, time.Now())
+	if first == nil {
+		t.Fatal("report not precomputed")
+	}
+
+	setupTestDB(t)
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	worker.repo = NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	worker.recompute(context.Background())
+	if got := worker.lookup(GetConfig(), key, time.Now()); got != first {
+		t.Fatalf("failed recomputation replaced the result: %+v", got)
+	}
+}
+
+func TestUsageStatsWorker_PanicKeepsPreviousResult(t *testing.T) {
+	_, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{
+		Reports: []UsageReportConfig{{RoomID: "hackroom", Resolution: "day"}, {Resolution: "hour", Duration: 24}},
+	})
+	worker.recompute(context.Background())
+	keys := []usageReportKey{{"hackroom", "day", DefaultDailyDurationHours}, {"", "hour", 24}}
+	var first []*UsageHeatmapResponse
+	for _, key := range keys {
+		resp := worker.lookup(GetConfig(), key, time.Now())
+		if resp == nil {
+			t.Fatalf("report %+v not precomputed", key)
+		}
+		first = append(first, resp)
+	}
+
+	// Without a repository every report panics; the worker survives.
+	worker.repo = nil
+	worker.recompute(context.Background())
+	for i, key := range keys {
+		if got := worker.lookup(GetConfig(), key, time.Now()); got != first[i] {
+			t.Fatalf("panicking recomputation replaced the result of %+v: %+v", key, got)
+		}
+	}
+}
+
+func TestUsageStatsWorker_DebouncesPresenceUpdates(t *testing.T) {
+	_, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{Debounce: "20ms"})
+	kicked := func() bool {
+		select {
+		case <-worker.kick:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	worker.onDeviceUpdate(&VirtualDevice{ID: "hall/temp", Type: VdevTypeTemperature})
+	if kicked() {
+		t.Fatal("recomputed after a temperature update")
+	}
+	for range 3 {
+		worker.onDeviceUpdate(&VirtualDevice{ID: "hackroom/people", Type: VdevTypePerson})
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !kicked() {
+		t.Fatal("not recomputed after presence settled")
+	}
+	select {
+	case <-worker.kick:
+		t.Fatal("recomputed once per update")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUsageStatsWorker_StartPrecomputes(t *testing.T) {
+	_, worker := setupUsageStatsWorkerTest(t, &UsageStatsConfig{})
+	worker.Start()
+	defer worker.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for worker.lookup(GetConfig(), usageReportKey{"hackroom", "hour", MaxHourlyDurationHours}, time.Now()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing precomputed after Start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestValidateUsageStatsConfig(t *testing.T) {
+	rooms := []RoomConfig{{ID: "hackroom"}}
+	for name, tc := range map[string]struct {
+		us   *UsageStatsConfig
+		want string
+	}{
+		"defaults":       {&UsageStatsConfig{}, ""},
+		"report":         {&UsageStatsConfig{Reports: []UsageReportConfig{{RoomID: "hackroom", Resolution: "hour", Duration: 48}}}, ""},
+		"unknown room":   {&UsageStatsConfig{Reports: []UsageReportConfig{{RoomID: "attic", Resolution: "day"}}}, "unknown room"},
+		"resolution":     {&UsageStatsConfig{Reports: []UsageReportConfig{{Resolution: "week"}}}, "must be day or hour"},
+		"zero interval":  {&UsageStatsConfig{Interval: "0s"}, "not a positive duration"},
+		"bad debounce":   {&UsageStatsConfig{Debounce: "soon"}, "not a valid duration"},
+		"debounce off":   {&UsageStatsConfig{Debounce: "0s"}, ""},
+		"negative hours": {&UsageStatsConfig{Reports: []UsageReportConfig{{Resolution: "hour", Duration: -1}}}, "must not be negative"},
+	} {
+		err := validateUsageStatsConfig(&Config{Rooms: rooms, UsageStats: tc.us}, "at2.yaml")
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -14,18 +18,30 @@ type VirtualDeviceHistoryRepository struct {
 	db        *gorm.DB
 	deviceIDs map[string]uint // cache: device name -> DB ID
 	mu        sync.Mutex
+	// flushed is set by Flush; later state changes are not recorded.
+	flushed bool
+	// backlog counts state changes waiting for or being written.
+	backlog atomic.Int64
+	// comfortLabels are the last recorded labels of comfort devices, which
+	// are recorded only when their label changes.
+	comfortLabels map[string]string
+
+	log *slog.Logger
 }
 
 // NewVirtualDeviceHistoryRepository creates a new repository and registers as listener.
-func NewVirtualDeviceHistoryRepository(db *gorm.DB, vdevManager *VdevManager) *VirtualDeviceHistoryRepository {
+func NewVirtualDeviceHistoryRepository(db *gorm.DB, vdevManager *VdevManager, logger *slog.Logger) *VirtualDeviceHistoryRepository {
 	repo := &VirtualDeviceHistoryRepository{
-		db:        db,
-		deviceIDs: make(map[string]uint),
+		db:            db,
+		deviceIDs:     make(map[string]uint),
+		comfortLabels: make(map[string]string),
+		log:           logger,
 	}
 
-	// Register as listener for state changes
-	vdevManager.OnVirtualDeviceUpdated = append(
-		vdevManager.OnVirtualDeviceUpdated,
+	// Register as listener for state changes; its queue never drops, so no
+	// change goes unrecorded behind a slow database.
+	vdevManager.OnVirtualDeviceRecorded = append(
+		vdevManager.OnVirtualDeviceRecorded,
 		repo.OnDeviceUpdated,
 	)
 
@@ -41,21 +57,47 @@ func (r *VirtualDeviceHistoryRepository) OnDeviceUpdated(vdev *VirtualDevice) {
 	if vdev.Type == VdevTypeCameraSnapshot || vdev.Type == VdevTypePrinter {
 		return
 	}
+	// Optimistic states are only recorded once the device confirms them.
+	if vdev.Pending {
+		return
+	}
 
+	r.backlog.Add(1)
+	defer r.backlog.Add(-1)
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.flushed {
+		return
+	}
 
 	// Get or create device ID
 	deviceID, err := r.getOrCreateDeviceID(vdev.ID, string(vdev.Type))
 	if err != nil {
-		log.Printf("VirtualDeviceHistoryRepository: failed to get/create device %s: %v", vdev.ID, err)
+		historyWriteErrorsTotal.Inc()
+		r.log.Error("creating device failed", "device", vdev.ID, "err", err)
 		return
 	}
 
+	// A comfort device changes with every reading of its inputs, but only
+	// a new label is worth keeping.
+	var label string
+	if vdev.Type == VdevTypeComfort {
+		label = comfortLabel(vdev.State)
+		last, ok := r.comfortLabels[vdev.ID]
+		if !ok {
+			last = r.lastComfortLabelLocked(deviceID)
+		}
+		if label == last {
+			r.comfortLabels[vdev.ID] = last
+			return
+		}
+	}
+
 	// Serialize state to JSON
 	stateJSON, err := json.Marshal(vdev.State)
 	if err != nil {
-		log.Printf("VirtualDeviceHistoryRepository: failed to serialize state for %s: %v", vdev.ID, err)
+		historyWriteErrorsTotal.Inc()
+		r.log.Error("serializing state failed", "device", vdev.ID, "err", err)
 		return
 	}
 
@@ -68,9 +110,43 @@ func (r *VirtualDeviceHistoryRepository) OnDeviceUpdated(vdev *VirtualDevice) {
 	}
 
 	if err := r.db.Create(&stateRecord).Error; err != nil {
-		log.Printf("VirtualDeviceHistoryRepository: failed to insert state for %s: %v", vdev.ID, err)
+		historyWriteErrorsTotal.Inc()
+		r.log.Error("inserting state failed", "device", vdev.ID, "err", err)
 		return
 	}
+	historyWritesTotal.Inc()
+	if vdev.Type == VdevTypeComfort {
+		r.comfortLabels[vdev.ID] = label
+	}
+}
+
+// lastComfortLabelLocked returns the label of the latest recorded state of
+// a comfort device, empty when there is none.
+func (r *VirtualDeviceHistoryRepository) lastComfortLabelLocked(deviceID uint) string {
+	var latest VirtualDeviceStateModel
+	err := r.db.Where("virtual_device_id = ?", deviceID).Order("timestamp DESC").Limit(1).Find(&latest).Error
+	if err != nil || latest.State == "" {
+		return ""
+	}
+	var state any
+	if err := json.Unmarshal([]byte(latest.State), &state); err != nil {
+		return ""
+	}
+	return comfortLabel(state)
+}
+
+// Backlog returns how many state changes are waiting for or being written.
+func (r *VirtualDeviceHistoryRepository) Backlog() int64 {
+	return r.backlog.Load()
+}
+
+// Flush waits for the state write in progress and stops recording further
+// changes, so the database can be closed on shutdown.
+func (r *VirtualDeviceHistoryRepository) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed = true
+	return nil
 }
 
 // getOrCreateDeviceID returns the database ID for a device, creating it if necessary.
@@ -95,36 +171,69 @@ func (r *VirtualDeviceHistoryRepository) getOrCreateDeviceID(name string, device
 	return device.ID, nil
 }
 
+// personHistoryDepth is how many of a person detection device's latest
+// states are searched for the last person leaving.
+const personHistoryDepth = 100
+
 // GetLatestPersonDetectionTime returns the timestamp (in milliseconds) when a person was last detected
 // for the given device. It finds the most recent transition from a positive count to zero.
 // Returns nil if the person is still detected (current state is positive) or if no history exists.
 func (r *VirtualDeviceHistoryRepository) GetLatestPersonDetectionTime(deviceName string) (*int64, error) {
+	times, err := r.GetLatestPersonDetectionTimes([]string{deviceName})
+	if ts, ok := times[deviceName]; ok {
+		return &ts, nil
+	}
+	return nil, err
+}
+
+// GetLatestPersonDetectionTimes is GetLatestPersonDetectionTime for several
+// devices in one query. Devices without such a time are left out.
+func (r *VirtualDeviceHistoryRepository) GetLatestPersonDetectionTimes(deviceNames []string) (map[string]int64, error) {
+	times := map[string]int64{}
+	if len(deviceNames) == 0 {
+		return times, nil
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Get device ID
-	var device VirtualDeviceModel
-	if err := r.db.Where("name = ?", deviceName).First(&device).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, nil // No history for this device
-		}
-		return nil, err
+	// The latest personHistoryDepth states of each device, newest first.
+	var rows []struct {
+		Name      string
+		Timestamp int64
+		State     string
 	}
-
-	// Query recent state history (last 100 records should be sufficient)
-	var states []VirtualDeviceStateModel
-	if err := r.db.Where("virtual_device_id = ?", device.ID).
-		Order("timestamp DESC").
-		Limit(100).
-		Find(&states).Error; err != nil {
+	if err := r.db.Raw(`SELECT name, timestamp, state FROM (
+			SELECT d.name, s.timestamp, s.state,
+				ROW_NUMBER() OVER (PARTITION BY s.virtual_device_id ORDER BY s.timestamp DESC) AS n
+			FROM virtual_device_state_models s
+			JOIN virtual_device_models d ON d.id = s.virtual_device_id
+			WHERE d.name IN ?
+		) WHERE n <= ? ORDER BY name, timestamp DESC`, deviceNames, personHistoryDepth).
+		Scan(&rows).Error; err != nil {
 		return nil, err
 	}
 
-	if len(states) == 0 {
-		return nil, nil // No state history
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && rows[end].Name == rows[start].Name {
+			end++
+		}
+		states := make([]VirtualDeviceStateModel, 0, end-start)
+		for _, row := range rows[start:end] {
+			states = append(states, VirtualDeviceStateModel{Timestamp: row.Timestamp, State: row.State})
+		}
+		if ts, ok := personLeftAt(states); ok {
+			times[rows[start].Name] = ts
+		}
+		start = end
 	}
+	return times, nil
+}
 
-	// Parse states and find transition from positive to zero
+// personLeftAt finds when the count of a person detection device last went
+// from positive to zero in its states, newest first. It reports false while
+// a person is still detected or when no such transition is recorded.
+func personLeftAt(states []VirtualDeviceStateModel) (int64, bool) {
 	// States are ordered DESC by timestamp, so we iterate from most recent to oldest
 	for i := 0; i < len(states); i++ {
 		var currentCount int
@@ -134,7 +243,7 @@ func (r *VirtualDeviceHistoryRepository) GetLatestPersonDetectionTime(deviceName
 
 		// If current (most recent) state is positive, person is still present
 		if i == 0 && currentCount > 0 {
-			return nil, nil
+			return 0, false
 		}
 
 		// Look for transition: current state is 0, previous state (older) was positive
@@ -147,17 +256,18 @@ func (r *VirtualDeviceHistoryRepository) GetLatestPersonDetectionTime(deviceName
 			if previousCount > 0 {
 				// Found transition from positive to zero
 				// Return the timestamp of the zero state (when person left)
-				return &states[i].Timestamp, nil
+				return states[i].Timestamp, true
 			}
 		}
 	}
 
-	return nil, nil // No transition found
+	return 0, false // No transition found
 }
 
-// GetLatestDeviceState returns the most recent state for the given device ID.
-// Returns nil, nil if no state is found.
-func (r *VirtualDeviceHistoryRepository) GetLatestDeviceState(deviceID string) (any, error) {
+// GetLatestDeviceState returns the most recent state for the given device ID
+// and when it was recorded. Returns a nil state and no error if no state is
+// found.
+func (r *VirtualDeviceHistoryRepository) GetLatestDeviceState(deviceID string) (any, time.Time, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -165,9 +275,9 @@ func (r *VirtualDeviceHistoryRepository) GetLatestDeviceState(deviceID string) (
 	var device VirtualDeviceModel
 	if err := r.db.Where("name = ?", deviceID).First(&device).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, nil
+			return nil, time.Time{}, nil
 		}
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	// 2. Get the latest state record
@@ -178,18 +288,42 @@ func (r *VirtualDeviceHistoryRepository) GetLatestDeviceState(deviceID string) (
 
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return nil, nil
+			return nil, time.Time{}, nil
 		}
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	// 3. Unmarshal the state
 	var state any
 	if err := json.Unmarshal([]byte(latestState.State), &state); err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
-	return state, nil
+	return state, time.UnixMilli(latestState.Timestamp), nil
+}
+
+// GetDeviceStateBefore returns the last state of a device recorded before
+// beforeMs, or nil when there is none.
+func (r *VirtualDeviceHistoryRepository) GetDeviceStateBefore(deviceName string, beforeMs int64) (*VirtualDeviceStateModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var device VirtualDeviceModel
+	if err := r.db.Where("name = ?", deviceName).First(&device).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []VirtualDeviceStateModel
+	err := r.db.Where("virtual_device_id = ? AND timestamp < ?", device.ID, beforeMs).
+		Order("timestamp DESC").
+		Limit(1).
+		Find(&states).Error
+	if err != nil || len(states) == 0 {
+		return nil, err
+	}
+	return &states[0], nil
 }
 
 // GetDeviceHistory returns the state history for a device within a specific duration.
@@ -248,6 +382,76 @@ func (r *VirtualDeviceHistoryRepository) GetDevicesHistoryInRange(deviceNames []
 	return history, err
 }
 
+// GetEarliestStateTimestamp returns the timestamp (ms) of the oldest state
+// recorded for any of the devices; ok is false when there is none.
+func (r *VirtualDeviceHistoryRepository) GetEarliestStateTimestamp(deviceNames []string) (ts int64, ok bool, err error) {
+	if len(deviceNames) == 0 {
+		return 0, false, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var earliest *int64
+	err = r.db.Model(&VirtualDeviceStateModel{}).
+		Joins("JOIN virtual_device_models ON virtual_device_models.id = virtual_device_state_models.virtual_device_id").
+		Where("virtual_device_models.name IN ?", deviceNames).
+		Select("MIN(virtual_device_state_models.timestamp)").
+		Scan(&earliest).Error
+	if err != nil || earliest == nil {
+		return 0, false, err
+	}
+	return *earliest, true, nil
+}
+
+// errUnknownStateChange is returned by GetRecentStateChanges for a before ID
+// that isn't a recorded state.
+var errUnknownStateChange = errors.New("unknown state change")
+
+// StateChange is a recorded state with the state the device had before it.
+type StateChange struct {
+	ID        string
+	Timestamp int64
+	Name      string
+	Type      string
+	State     string
+	// Previous is nil for the first recorded state of a device.
+	Previous *string
+}
+
+// GetRecentStateChanges returns the recorded states of devices of the given
+// types that differ from the state before, newest first, at most limit of
+// them. A non-empty before continues after the state with that ID.
+func (r *VirtualDeviceHistoryRepository) GetRecentStateChanges(types []string, before string, limit int) ([]StateChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	afterTimestamp, afterID := int64(math.MaxInt64), ""
+	if before != "" {
+		var state VirtualDeviceStateModel
+		if err := r.db.Where("id = ?", before).First(&state).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, errUnknownStateChange
+			}
+			return nil, err
+		}
+		afterTimestamp, afterID = state.Timestamp, state.ID
+	}
+
+	var changes []StateChange
+	err := r.db.Raw(`SELECT id, timestamp, name, type, state, previous FROM (
+			SELECT s.id, s.timestamp, d.name, d.type, s.state,
+				(SELECT p.state FROM virtual_device_state_models p
+					WHERE p.virtual_device_id = s.virtual_device_id AND (p.timestamp, p.id) < (s.timestamp, s.id)
+					ORDER BY p.timestamp DESC, p.id DESC LIMIT 1) AS previous
+			FROM virtual_device_state_models s
+			JOIN virtual_device_models d ON d.id = s.virtual_device_id
+			WHERE d.type IN ? AND (s.timestamp, s.id) < (?, ?)
+		) WHERE previous IS NULL OR previous <> state
+		ORDER BY timestamp DESC, id DESC LIMIT ?`, types, afterTimestamp, afterID, limit).
+		Scan(&changes).Error
+	return changes, err
+}
+
 // GetDayCaches returns cached daily stats for the given roomID and date strings ("2006-01-02").
 // The returned map is keyed by date string.
 func (r *VirtualDeviceHistoryRepository) GetDayCaches(roomID string, dates []string) (map[string]*UsageStatsDayCache, error) {
@@ -310,3 +514,71 @@ func (r *VirtualDeviceHistoryRepository) GetDevicesHistory(deviceNames []string,
 
 	return history, err
 }
+
+// historyPurgeBatchSize is how many states DeleteDevice deletes per
+// statement; the recording of other devices gets its turn between them.
+const historyPurgeBatchSize = 5000
+
+// errDeviceNotRecorded is returned by DeleteDevice for a device without a
+// record.
+var errDeviceNotRecorded = errors.New("device not recorded")
+
+// DeviceDeletion is what DeleteDevice removed.
+type DeviceDeletion struct {
+	// RecordDeleted is false when the history is kept, as the states
+	// belong to the record.
+	RecordDeleted bool  `json:"record_deleted"`
+	StatesDeleted int64 `json:"states_deleted"`
+}
+
+// DeleteDevice deletes the record of a device. With purgeHistory its states
+// are deleted first, in batches of historyPurgeBatchSize; without, the
+// record is only deleted when the device has no states. A device recorded
+// again afterwards gets a new record.
+func (r *VirtualDeviceHistoryRepository) DeleteDevice(name string, purgeHistory bool) (DeviceDeletion, error) {
+	var result DeviceDeletion
+	var device VirtualDeviceModel
+	r.mu.Lock()
+	err := r.db.Where("name = ?", name).Take(&device).Error
+	r.mu.Unlock()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return result, errDeviceNotRecorded
+	}
+	if err != nil {
+		return result, err
+	}
+
+	for purgeHistory {
+		r.mu.Lock()
+		res := r.db.Where("id IN (?)", r.db.Model(&VirtualDeviceStateModel{}).Select("id").
+			Where("virtual_device_id = ?", device.ID).Limit(historyPurgeBatchSize)).
+			Delete(&VirtualDeviceStateModel{})
+		r.mu.Unlock()
+		if res.Error != nil {
+			return result, res.Error
+		}
+		result.StatesDeleted += res.RowsAffected
+		if res.RowsAffected < historyPurgeBatchSize {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.comfortLabels, name)
+	var states int64
+	if err := r.db.Model(&VirtualDeviceStateModel{}).Where("virtual_device_id = ?", device.ID).Count(&states).Error; err != nil {
+		return result, err
+	}
+	// States recorded while purging are left, with the record, for the
+	// next attempt.
+	if states > 0 {
+		return result, nil
+	}
+	if err := r.db.Delete(&device).Error; err != nil {
+		return result, err
+	}
+	delete(r.deviceIDs, name)
+	result.RecordDeleted = true
+	return result, nil
+}
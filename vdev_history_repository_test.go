@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// recordStates stores the JSON states of a device one second apart, starting
+// at start (Unix milliseconds).
+func recordStates(t *testing.T, repo *VirtualDeviceHistoryRepository, name string, typ VdevType, start int64, states ...string) {
+	t.Helper()
+	id, err := repo.getOrCreateDeviceID(name, string(typ))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range states {
+		state := VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: start + int64(i)*1000, VirtualDeviceID: id, State: s}
+		if err := repo.db.Create(&state).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetLatestPersonDetectionTimes(t *testing.T) {
+	setupLiveWsTest(t)
+	setupTestDB(t)
+	repo := NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+
+	// Left at 4000 after leaving at 2000 once before.
+	recordStates(t, repo, "frigate/person/hall", VdevTypePerson, 0, "0", "2", "0", "1", "0", "0")
+	// Still someone there.
+	recordStates(t, repo, "frigate/person/lab", VdevTypePerson, 0, "0", "1", "0", "3")
+	// Nobody ever seen.
+	recordStates(t, repo, "frigate/person/yard", VdevTypePerson, 0, "0", "0")
+	// Left at 1000, but further back than the searched history.
+	deep := []string{"1"}
+	for range personHistoryDepth {
+		deep = append(deep, "0")
+	}
+	recordStates(t, repo, "frigate/person/garage", VdevTypePerson, 0, deep...)
+	// Another device's states don't count.
+	recordStates(t, repo, "hall/temp", VdevTypeTemperature, 10_000, "1", "0")
+
+	queries := 0
+	countQueries := func(*gorm.DB) { queries++ }
+	gormDB.Callback().Query().Before("gorm:query").Register("test:count", countQueries)
+	gormDB.Callback().Row().Before("gorm:row").Register("test:count", countQueries)
+
+	times, err := repo.GetLatestPersonDetectionTimes([]string{"frigate/person/hall", "frigate/person/lab", "frigate/person/yard", "frigate/person/garage", "frigate/person/unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 1 {
+		t.Errorf("%d queries", queries)
+	}
+	if len(times) != 1 || times["frigate/person/hall"] != 4000 {
+		t.Fatalf("times %v", times)
+	}
+
+	// The single device lookup agrees.
+	if ts, err := repo.GetLatestPersonDetectionTime("frigate/person/hall"); err != nil || ts == nil || *ts != 4000 {
+		t.Fatalf("hall: %v, %v", ts, err)
+	}
+	if ts, err := repo.GetLatestPersonDetectionTime("frigate/person/lab"); err != nil || ts != nil {
+		t.Fatalf("lab: %v, %v", ts, err)
+	}
+	if times, err := repo.GetLatestPersonDetectionTimes(nil); err != nil || len(times) != 0 {
+		t.Fatalf("no devices: %v, %v", times, err)
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	setupTestDB(t)
+	repo := NewVirtualDeviceHistoryRepository(gormDB, NewVdevManager(), testLogger)
+	// More than two batches, so the purge takes three statements.
+	id, err := repo.getOrCreateDeviceID("lab/relay", string(VdevTypeRelay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make([]VirtualDeviceStateModel, 2*historyPurgeBatchSize+7)
+	for i := range states {
+		states[i] = VirtualDeviceStateModel{ID: GenerateUUIDv7(), Timestamp: int64(i), VirtualDeviceID: id, State: `"ON"`}
+	}
+	if err := gormDB.CreateInBatches(states, 1000).Error; err != nil {
+		t.Fatal(err)
+	}
+	recordStates(t, repo, "hall/temp", VdevTypeTemperature, 0, "21", "22")
+	recordStates(t, repo, "lab/empty", VdevTypeRelay, 0)
+
+	deletes := 0
+	gormDB.Callback().Delete().Before("gorm:delete").Register("count_deletes", func(db *gorm.DB) {
+		if db.Statement.Table == "virtual_device_state_models" {
+			deletes++
+		}
+	})
+	t.Cleanup(func() { gormDB.Callback().Delete().Remove("count_deletes") })
+
+	// Without purging, the record stays with the history.
+	got, err := repo.DeleteDevice("hall/temp", false)
+	if err != nil || got != (DeviceDeletion{}) {
+		t.Fatalf("DeleteDevice(hall/temp) = %+v, %v; want nothing deleted", got, err)
+	}
+	got, err = repo.DeleteDevice("lab/empty", false)
+	if err != nil || got != (DeviceDeletion{RecordDeleted: true}) {
+		t.Fatalf("DeleteDevice(lab/empty) = %+v, %v; want the record deleted", got, err)
+	}
+
+	got, err = repo.DeleteDevice("lab/relay", true)
+	if err != nil || got != (DeviceDeletion{RecordDeleted: true, StatesDeleted: int64(len(states))}) {
+		t.Fatalf("DeleteDevice(lab/relay, purge) = %+v, %v; want all %d states deleted", got, err, len(states))
+	}
+	if deletes != 3 {
+		t.Errorf("purged in %d statements, want 3", deletes)
+	}
+	var left int64
+	gormDB.Model(&VirtualDeviceStateModel{}).Count(&left)
+	if left != 2 {
+		t.Errorf("%d states left, want the 2 of hall/temp", left)
+	}
+
+	if _, err := repo.DeleteDevice("lab/relay", true); err != errDeviceNotRecorded {
+		t.Errorf("deleting again: err = %v, want %v", err, errDeviceNotRecorded)
+	}
+	// Recording the device again creates a new record.
+	newID, err := repo.getOrCreateDeviceID("lab/relay", string(VdevTypeRelay))
+	if err != nil || newID == id {
+		t.Errorf("recreated ID = %d, %v; want a new one, not %d", newID, err, id)
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"log/slog"
 	"reflect"
+	"runtime"
+	"slices"
 	"sync"
+	"time"
 )
 
+// vdevLog is the logger of the device manager; main replaces it with the
+// configured component logger.
+var vdevLog = slog.Default()
+
 // VdevType represents the type of a virtual device.
 type VdevType string
 
@@ -16,11 +24,36 @@ const (
 	VdevTypeCameraSnapshot VdevType = "camera_snapshot"
 	VdevTypePowerUsage     VdevType = "power_usage"
 	VdevTypeCo             VdevType = "co"
+	VdevTypeCO2            VdevType = "co2"
 	VdevTypeGas            VdevType = "gas"
 	VdevTypeContact        VdevType = "contact"
 	VdevTypePrinter        VdevType = "printer"
+	VdevTypeCover          VdevType = "cover"
+	VdevTypeThermostat     VdevType = "thermostat"
+	VdevTypeBattery        VdevType = "battery"
+	VdevTypeNoiseLevel     VdevType = "noise_level"
+	// Meters are ever-increasing counters of the volume used, in m³.
+	VdevTypeWaterMeter VdevType = "water_meter"
+	VdevTypeGasMeter   VdevType = "gas_meter"
+	VdevTypeWindSpeed  VdevType = "wind_speed"
+	// VdevTypeSunElevation is the elevation of the sun in degrees and
+	// VdevTypeDaylight whether it is above sun.day_above.
+	VdevTypeSunElevation VdevType = "sun_elevation"
+	VdevTypeDaylight     VdevType = "daylight"
+	// VdevTypeComfort is derived by ComfortService; its state is a
+	// ComfortState.
+	VdevTypeComfort VdevType = "comfort"
 )
 
+// vdevTypes lists every VdevType, for code that needs to enumerate them.
+var vdevTypes = []VdevType{
+	VdevTypeRelay, VdevTypeTemperature, VdevTypeHumidity, VdevTypePerson,
+	VdevTypeCameraSnapshot, VdevTypePowerUsage, VdevTypeCo, VdevTypeCO2,
+	VdevTypeGas, VdevTypeContact, VdevTypePrinter, VdevTypeCover,
+	VdevTypeThermostat, VdevTypeBattery, VdevTypeComfort, VdevTypeNoiseLevel,
+	VdevTypeWaterMeter, VdevTypeGasMeter, VdevTypeWindSpeed, VdevTypeSunElevation, VdevTypeDaylight,
+}
+
 // VirtualDevice represents a single controllable/readable capability broken out
 // from a physical device (e.g. multi-relay or multi-sensor).
 // Moved from mqtt_adapter.go into this dedicated manager file.
@@ -35,13 +68,26 @@ type VirtualDevice struct {
 	MapperData any `json:"mapper_data"`
 	// Fresh indicates if the state is from a live update (true) or restored/initial (false).
 	Fresh bool `json:"fresh"`
+	// LastUpdatedAt is when the device last reported, even an unchanged
+	// state. For restored states it is when the state was recorded; zero
+	// when the device has never reported.
+	LastUpdatedAt time.Time `json:"last_updated_at,omitzero"`
 	// ProhibitControl indicates if this device cannot be controlled.
 	ProhibitControl bool `json:"prohibit_control"`
+	// Pending is set while State is an optimistic update after a control
+	// command that the device has not confirmed yet.
+	Pending bool `json:"pending"`
+	// AutoOffAt is when AutoOffService turns the relay off; zero when no
+	// auto-off is scheduled.
+	AutoOffAt time.Time `json:"auto_off_at,omitzero"`
+	// RawState is the last reported state before calibration, kept for
+	// devices whose calibration has keep_raw.
+	RawState any `json:"raw_state,omitempty"`
 }
 
 // DeviceStateProvider defines the interface for retrieving persisted device state.
 type DeviceStateProvider interface {
-	GetLatestDeviceState(deviceID string) (any, error)
+	GetLatestDeviceState(deviceID string) (any, time.Time, error)
 }
 
 // VirtualDeviceUpdate represents a state change for a virtual device.
@@ -49,6 +95,11 @@ type DeviceStateProvider interface {
 type VirtualDeviceUpdate struct {
 	Name  string `json:"name"`
 	State any    `json:"state,omitempty"`
+	// RawState is State before calibration (see calibrateUpdates).
+	RawState any `json:"raw_state,omitempty"`
+	// Unit is the unit of measurement the source announced for a numeric
+	// State; MQTTAdapter.normalizeUnits converts State to the canonical one.
+	Unit string `json:"unit,omitempty"`
 }
 
 // VdevManager owns the in-memory collection of VirtualDevice objects and
@@ -59,9 +110,105 @@ type VdevManager struct {
 	devices []*VirtualDevice
 
 	// OnVirtualDeviceUpdated callbacks are invoked for each device whose state changed.
+	// Each runs on its own queue, so a slow one only delays itself; one that
+	// falls vdevUpdateQueueSize batches behind misses updates.
 	OnVirtualDeviceUpdated []func(vdev *VirtualDevice)
+	// OnVirtualDeviceRecorded callbacks are invoked like OnVirtualDeviceUpdated
+	// ones, but their queues never drop: history must not lose rows.
+	OnVirtualDeviceRecorded []func(vdev *VirtualDevice)
+	// OnVirtualDeviceRemoved callbacks are invoked with each device removed
+	// by RemoveDevice, before it returns.
+	OnVirtualDeviceRemoved []func(vdev *VirtualDevice)
 
 	stateProvider DeviceStateProvider
+	// controlProhibited makes matching devices read-only as they are added.
+	controlProhibited func(deviceID string) bool
+
+	// pending tracks optimistic updates awaiting confirmation, by device ID.
+	pending map[string]*pendingControl
+
+	// updateQueues and recordQueues hold the queue of each callback, in
+	// registration order. A callback's queue and goroutine are started with
+	// the first batch after it was registered.
+	updateQueues []*vdevUpdateQueue
+	recordQueues []*vdevUpdateQueue
+}
+
+// vdevUpdateQueueSize is how many batches of updated devices may wait for a
+// slow OnVirtualDeviceUpdated callback before further batches are dropped.
+const vdevUpdateQueueSize = 1024
+
+// vdevUpdateQueue feeds batches of updated devices to one callback.
+type vdevUpdateQueue struct {
+	callback func(vdev *VirtualDevice)
+	// lossless queues grow without bound instead of dropping.
+	lossless bool
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	batches [][]*VirtualDevice
+	// dropping is set while batches are being dropped, so that is logged
+	// once per stall rather than for every batch.
+	dropping bool
+}
+
+func newVdevUpdateQueue(callback func(vdev *VirtualDevice), lossless bool) *vdevUpdateQueue {
+	q := &vdevUpdateQueue{callback: callback, lossless: lossless, wake: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+
+// push queues a batch, or drops it when the queue is full, counting it in
+// at2_update_callbacks_dropped_total rather than blocking the caller.
+func (q *vdevUpdateQueue) push(devs []*VirtualDevice) {
+	q.mu.Lock()
+	if !q.lossless && len(q.batches) >= vdevUpdateQueueSize {
+		if !q.dropping {
+			vdevLog.Warn("update callback is behind, dropping updates", "callback", callbackName(q.callback))
+			q.dropping = true
+		}
+		q.mu.Unlock()
+		updateCallbacksDroppedTotal.Add(float64(len(devs)))
+		return
+	}
+	if q.dropping {
+		vdevLog.Info("update callback caught up", "callback", callbackName(q.callback))
+		q.dropping = false
+	}
+	q.batches = append(q.batches, devs)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run invokes the callback for each queued batch in order.
+func (q *vdevUpdateQueue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			if len(q.batches) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			devs := q.batches[0]
+			q.batches[0] = nil
+			q.batches = q.batches[1:]
+			q.mu.Unlock()
+			for _, dev := range devs {
+				q.callback(dev)
+			}
+		}
+	}
+}
+
+// callbackName names a callback in logs, e.g. main.(*AlertEngine).onDeviceUpdate-fm.
+func callbackName(callback func(vdev *VirtualDevice)) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(callback).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return "unknown"
 }
 
 // NewVdevManager creates an empty manager instance.
@@ -76,6 +223,14 @@ func (m *VdevManager) SetStateProvider(p DeviceStateProvider) {
 	m.stateProvider = p
 }
 
+// SetControlProhibited configures which devices are made read-only
+// (ProhibitControl) when they are added.
+func (m *VdevManager) SetControlProhibited(match func(deviceID string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.controlProhibited = match
+}
+
 // AddDevices adds newly discovered virtual devices whose IDs are not already present.
 func (m *VdevManager) AddDevices(devs []*VirtualDevice) {
 	if len(devs) == 0 {
@@ -96,11 +251,15 @@ func (m *VdevManager) AddDevices(devs []*VirtualDevice) {
 		if _, found := existing[d.ID]; found {
 			continue
 		}
+		if m.controlProhibited != nil && m.controlProhibited(d.ID) {
+			d.ProhibitControl = true
+		}
 
 		// Try to restore state if provider is available
 		if m.stateProvider != nil {
-			if persistedState, err := m.stateProvider.GetLatestDeviceState(d.ID); err == nil && persistedState != nil {
+			if persistedState, recordedAt, err := m.stateProvider.GetLatestDeviceState(d.ID); err == nil && persistedState != nil {
 				d.State = persistedState
+				d.LastUpdatedAt = recordedAt
 				// Fresh remains false (default) because this is a restored state
 			}
 		}
@@ -110,7 +269,8 @@ func (m *VdevManager) AddDevices(devs []*VirtualDevice) {
 }
 
 // ApplyUpdates applies the provided updates to matching devices and returns
-// the list of device IDs whose state actually changed.
+// the list of device IDs whose state actually changed, including devices
+// whose pending optimistic state got confirmed.
 // It also invokes the update callback for each changed device (if configured).
 func (m *VdevManager) ApplyUpdates(updates []*VirtualDeviceUpdate) []string {
 	if len(updates) == 0 {
@@ -125,43 +285,70 @@ func (m *VdevManager) ApplyUpdates(updates []*VirtualDeviceUpdate) []string {
 		index[d.ID] = d
 	}
 
+	now := time.Now()
 	changed := make([]string, 0, len(updates))
 	for _, upd := range updates {
 		if upd == nil || upd.Name == "" {
 			continue
 		}
 		if dev, ok := index[upd.Name]; ok {
+			// Repeating the same state still shows the device is alive.
+			dev.LastUpdatedAt = now
+			// A restored or stale state the device confirms counts again,
+			// e.g. for people, so it is notified like a change.
+			refreshed := !dev.Fresh && dev.State != nil
+			dev.Fresh = true
+			dev.RawState = upd.RawState
+			if p, ok := m.pending[dev.ID]; ok {
+				if m.confirmPendingLocked(dev, p, upd.State) {
+					changed = append(changed, dev.ID)
+				}
+				continue
+			}
 			if shouldAssignState(dev.State, upd.State) {
 				dev.State = upd.State
-				dev.Fresh = true
+				changed = append(changed, dev.ID)
+			} else if refreshed {
 				changed = append(changed, dev.ID)
 			}
 		}
 	}
 
-	// Fire callbacks outside the lock to avoid deadlocks.
-	if len(changed) > 0 && len(m.OnVirtualDeviceUpdated) > 0 {
-		// Collect updated devices for callbacks
-		updatedDevices := make([]*VirtualDevice, 0, len(changed))
-		for _, id := range changed {
-			if dev, ok := index[id]; ok {
-				clone := *dev
-				updatedDevices = append(updatedDevices, &clone)
-			}
-		}
-		callbacks := append([]func(vdev *VirtualDevice){}, m.OnVirtualDeviceUpdated...) // copy slice
-		go func(devices []*VirtualDevice, cbs []func(vdev *VirtualDevice)) {
-			for _, dev := range devices {
-				for _, cb := range cbs {
-					cb(dev)
-				}
-			}
-		}(updatedDevices, callbacks)
+	updatedDevices := make([]*VirtualDevice, 0, len(changed))
+	for _, id := range changed {
+		updatedDevices = append(updatedDevices, index[id])
 	}
+	m.notifyLocked(updatedDevices)
 
 	return changed
 }
 
+// notifyLocked queues copies of the devices for the update callbacks, which
+// run in order outside the lock to avoid deadlocks, each on its own queue.
+func (m *VdevManager) notifyLocked(devs []*VirtualDevice) {
+	if len(devs) == 0 || len(m.OnVirtualDeviceUpdated)+len(m.OnVirtualDeviceRecorded) == 0 {
+		return
+	}
+	updatedDevices := make([]*VirtualDevice, 0, len(devs))
+	for _, dev := range devs {
+		clone := *dev
+		updatedDevices = append(updatedDevices, &clone)
+	}
+	for _, cb := range m.OnVirtualDeviceUpdated[len(m.updateQueues):] {
+		m.updateQueues = append(m.updateQueues, newVdevUpdateQueue(cb, false))
+	}
+	for _, cb := range m.OnVirtualDeviceRecorded[len(m.recordQueues):] {
+		m.recordQueues = append(m.recordQueues, newVdevUpdateQueue(cb, true))
+	}
+	// Callbacks only read the cloned devices, so the queues share them.
+	for _, q := range m.recordQueues {
+		q.push(updatedDevices)
+	}
+	for _, q := range m.updateQueues {
+		q.push(updatedDevices)
+	}
+}
+
 // shouldAssignState returns true if newValue should replace oldValue.
 // Comparable types are compared directly; non-comparable types always trigger assignment.
 func shouldAssignState(oldValue, newValue any) bool {
@@ -198,3 +385,74 @@ func (m *VdevManager) Devices() []*VirtualDevice {
 	}
 	return cp
 }
+
+// Device returns a copy of the device with the given ID, or nil if unknown.
+func (m *VdevManager) Device(id string) *VirtualDevice {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if dev := m.deviceLocked(id); dev != nil {
+		clone := *dev
+		return &clone
+	}
+	return nil
+}
+
+// MarkStale clears Fresh on the devices with the given IDs, for sources that
+// know their last state is outdated. The state is unchanged, so no callbacks
+// run.
+func (m *VdevManager) MarkStale(ids ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		if dev := m.deviceLocked(id); dev != nil {
+			dev.Fresh = false
+		}
+	}
+}
+
+// RemoveDevice drops the device with the given ID, so that it is no longer
+// listed or updated, and invokes the removal callbacks with a copy of it.
+// A mapper discovering the device again adds it back. Returns nil if the
+// device is unknown.
+func (m *VdevManager) RemoveDevice(id string) *VirtualDevice {
+	m.mu.Lock()
+	i := slices.IndexFunc(m.devices, func(dev *VirtualDevice) bool { return dev != nil && dev.ID == id })
+	if i < 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	removed := *m.devices[i]
+	m.devices = slices.Delete(m.devices, i, i+1)
+	if p, ok := m.pending[id]; ok {
+		p.timer.Stop()
+		delete(m.pending, id)
+	}
+	callbacks := slices.Clone(m.OnVirtualDeviceRemoved)
+	m.mu.Unlock()
+
+	for _, cb := range callbacks {
+		clone := removed
+		cb(&clone)
+	}
+	return &removed
+}
+
+// SetAutoOffAt records when the device will be turned off automatically.
+// It does not invoke the update callbacks.
+func (m *VdevManager) SetAutoOffAt(id string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dev := m.deviceLocked(id); dev != nil {
+		dev.AutoOffAt = at
+	}
+}
+
+// deviceLocked returns the device with the given ID; m.mu must be held.
+func (m *VdevManager) deviceLocked(id string) *VirtualDevice {
+	for _, dev := range m.devices {
+		if dev != nil && dev.ID == id {
+			return dev
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import "time"
+
+// pendingControl remembers what an optimistic update replaced until the
+// device confirms the commanded state or the window runs out.
+type pendingControl struct {
+	// optimistic is the state shown while waiting for the confirmation.
+	optimistic any
+	// revertTo is the last state the device reported itself.
+	revertTo any
+	timer    *time.Timer
+}
+
+// ApplyOptimistic shows state for the device right away, marked Pending,
+// after a control command was published. An update reporting that state
+// within window confirms it; otherwise the device reverts to the last state
+// it reported. A command overlapping a pending one restarts the window but
+// still reverts to the state from before the first command. It reports
+// whether an optimistic update was applied.
+func (m *VdevManager) ApplyOptimistic(id string, state any, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dev := m.deviceLocked(id)
+	if dev == nil {
+		return false
+	}
+	prev, pending := m.pending[id]
+	if !pending && !shouldAssignState(dev.State, state) {
+		return false
+	}
+
+	p := &pendingControl{optimistic: state, revertTo: dev.State}
+	if pending {
+		prev.timer.Stop()
+		p.revertTo = prev.revertTo
+	}
+	p.timer = time.AfterFunc(window, func() { m.revertPending(id, p) })
+	if m.pending == nil {
+		m.pending = map[string]*pendingControl{}
+	}
+	m.pending[id] = p
+
+	dev.State = state
+	dev.Pending = true
+	m.notifyLocked([]*VirtualDevice{dev})
+	return true
+}
+
+// confirmPendingLocked handles an update for a device with a pending
+// optimistic state. It reports whether the update confirmed it; any other
+// state becomes the one to revert to, while the optimistic one stays shown.
+func (m *VdevManager) confirmPendingLocked(dev *VirtualDevice, p *pendingControl, state any) bool {
+	if shouldAssignState(p.optimistic, state) {
+		p.revertTo = state
+		return false
+	}
+	p.timer.Stop()
+	delete(m.pending, dev.ID)
+	dev.State = state
+	dev.Pending = false
+	return true
+}
+
+// revertPending restores the reported state of a device whose optimistic
+// state was not confirmed in time.
+func (m *VdevManager) revertPending(id string, p *pendingControl) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// A confirmation or a newer command may have won the race for the lock.
+	if m.pending[id] != p {
+		return
+	}
+	delete(m.pending, id)
+	dev := m.deviceLocked(id)
+	if dev == nil {
+		return
+	}
+	dev.State = p.revertTo
+	dev.Pending = false
+	m.notifyLocked([]*VirtualDevice{dev})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setupPendingTest returns a manager with an "OFF" relay and a channel
+// receiving every device passed to the update callbacks.
+func setupPendingTest(t *testing.T) (*VdevManager, chan *VirtualDevice) {
+	t.Helper()
+	vm := NewVdevManager()
+	vm.AddDevices([]*VirtualDevice{{ID: "relay/light", Type: VdevTypeRelay, State: "OFF"}})
+	updates := make(chan *VirtualDevice, 16)
+	vm.OnVirtualDeviceUpdated = append(vm.OnVirtualDeviceUpdated, func(v *VirtualDevice) { updates <- v })
+	return vm, updates
+}
+
+func nextUpdate(t *testing.T, updates chan *VirtualDevice) *VirtualDevice {
+	t.Helper()
+	select {
+	case v := <-updates:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update callback")
+		return nil
+	}
+}
+
+func TestApplyOptimistic_Confirmed(t *testing.T) {
+	vm, updates := setupPendingTest(t)
+
+	if !vm.ApplyOptimistic("relay/light", "ON", time.Hour) {
+		t.Fatal("optimistic update not applied")
+	}
+	if v := nextUpdate(t, updates); v.State != "ON" || !v.Pending {
+		t.Fatalf("optimistic update = %+v", v)
+	}
+
+	// The confirming update reports the same state but clears Pending.
+	changed := vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/light", State: "ON"}})
+	if len(changed) != 1 {
+		t.Fatalf("changed = %v", changed)
+	}
+	if v := nextUpdate(t, updates); v.State != "ON" || v.Pending || !v.Fresh {
+		t.Fatalf("confirmed update = %+v", v)
+	}
+	if len(vm.pending) != 0 {
+		t.Fatalf("pending after confirmation: %v", vm.pending)
+	}
+}
+
+func TestApplyOptimistic_Reverted(t *testing.T) {
+	vm, updates := setupPendingTest(t)
+
+	vm.ApplyOptimistic("relay/light", "ON", 20*time.Millisecond)
+	nextUpdate(t, updates)
+
+	// A report of another state doesn't end the optimistic state but is
+	// what it reverts to.
+	if changed := vm.ApplyUpdates([]*VirtualDeviceUpdate{{Name: "relay/light", State: "OFF"}}); len(changed) != 0 {
+		t.Fatalf("unconfirming update changed %v", changed)
+	}
+	if v := vm.Device("relay/light"); v.State != "ON" || !v.Pending {
+		t.Fatalf("device during window = %+v", v)
+	}
+
+	if v := nextUpdate(t, updates); v.State != "OFF" || v.Pending {
+		t.Fatalf("reverted update = %+v", v)
+	}
+	if v := vm.Device("relay/light"); v.State != "OFF" || v.Pending {
+		t.Fatalf("device after revert = %+v", v)
+	}
+}
+
+func TestApplyOptimistic_Overlapping(t *testing.T) {
+	vm, updates := setupPendingTest(t)
+
+	vm.ApplyOptimistic("relay/light", "ON", 20*time.Millisecond)
+	nextUpdate(t, updates)
+	// The second command replaces the first one's timer and still reverts
+	// to the state from before both.
+	vm.ApplyOptimistic("relay/light", "OFF", time.Hour)
+	if v := nextUpdate(t, updates); v.State != "OFF" || !v.Pending {
+		t.Fatalf("second optimistic update = %+v", v)
+	}
+	vm.ApplyOptimistic("relay/light", "ON", 20*time.Millisecond)
+	if v := nextUpdate(t, updates); v.State != "ON" || !v.Pending {
+		t.Fatalf("third optimistic update = %+v", v)
+	}
+
+	if v := nextUpdate(t, updates); v.State != "OFF" || v.Pending {
+		t.Fatalf("reverted update = %+v", v)
+	}
+	select {
+	case v := <-updates:
+		t.Fatalf("replaced timer fired: %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestApplyOptimistic_Skipped(t *testing.T) {
+	vm, _ := setupPendingTest(t)
+	if vm.ApplyOptimistic("relay/light", "OFF", time.Hour) {
+		t.Fatal("applied the state the device already has")
+	}
+	if vm.ApplyOptimistic("relay/light", "ON", 0) {
+		t.Fatal("applied with optimistic updates disabled")
+	}
+	if vm.ApplyOptimistic("relay/missing", "ON", time.Hour) {
+		t.Fatal("applied to an unknown device")
+	}
+}
+
+func TestMQTTAdapter_ControlDevice_Optimistic(t *testing.T) {
+	mgr := NewVdevManager()
+	adapter := &MQTTAdapter{
+		log:     testLogger,
+		config:  &Config{MQTT: MQTTConfig{ControlConfirmTimeout: "1h"}},
+		vdevMgr: mgr,
+		client:  &MockClient{},
+		mappers: []MQTTMapper{NewZigbee2MQTTMapper("zigbee2mqtt/", testLogger)},
+	}
+	mgr.AddDevices([]*VirtualDevice{
+		{ID: "relay/string", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "s"}, State: "ON"},
+		{ID: "relay/bool", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "b"}, State: false},
+		{ID: "relay/unknown", Type: VdevTypeRelay, MapperData: &Zigbee2MQTTMapperData{BaseTopic: "u"}},
+	})
+
+	for _, c := range []struct {
+		id, command string
+		want        any
+		pending     bool
+	}{
+		{"relay/string", "TOGGLE", "OFF", true},
+		{"relay/bool", "on", true, true},
+		// Toggling an unknown state publishes but can't predict the result.
+		{"relay/unknown", "TOGGLE", nil, false},
+	} {
+		if err := adapter.ControlDevice(c.id, c.command); err != nil {
+			t.Fatalf("%s %s: %v", c.id, c.command, err)
+		}
+		if v := mgr.Device(c.id); v.State != c.want || v.Pending != c.pending {
+			t.Errorf("%s after %s = %+v", c.id, c.command, v)
+		}
+	}
+}
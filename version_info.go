@@ -1,8 +1,63 @@
 package main
 
-// These variables are set at build time via -ldflags
+import (
+	"cmp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// These variables are set at build time via -ldflags, e.g.
+// -X 'main.Version=v1.2.0'. Unset or empty ones read as "dev".
 var (
-	GitRepoURL    = "unknown"
-	GitCommitHash = "unknown"
-	GitCommitDate = "unknown"
+	Version       string
+	GitRepoURL    string
+	GitCommitHash string
+	GitCommitDate string
+	BuildDate     string
 )
+
+// devBuild stands in for build info not set via -ldflags.
+const devBuild = "dev"
+
+// BuildInfo describes the running binary. It is served at /api/v1/version and
+// as the version of /api/v1/app-config.
+type BuildInfo struct {
+	Version       string `json:"version"`
+	GitRepoURL    string `json:"git_repo_url,omitempty"`
+	GitCommitHash string `json:"git_commit_hash"`
+	GitCommitDate string `json:"git_commit_date"`
+	BuildDate     string `json:"build_date"`
+}
+
+// currentBuildInfo returns the build info injected via -ldflags. The Docker
+// build passes empty values when its build args aren't given, so those fall
+// back like unset ones. The repo URL has no fallback since it is used in
+// links.
+func currentBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:       cmp.Or(Version, devBuild),
+		GitRepoURL:    GitRepoURL,
+		GitCommitHash: cmp.Or(GitCommitHash, devBuild),
+		GitCommitDate: cmp.Or(GitCommitDate, devBuild),
+		BuildDate:     cmp.Or(BuildDate, devBuild),
+	}
+}
+
+func handleVersion(c *fiber.Ctx) error {
+	return c.JSON(currentBuildInfo())
+}
+
+// newBuildInfoMetric returns the at2_build_info gauge: always 1, with the
+// build info as labels.
+func newBuildInfoMetric(info BuildInfo) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "at2_build_info",
+		Help: "Build info of the running at2 binary, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":    info.Version,
+			"git_commit": info.GitCommitHash,
+			"build_date": info.BuildDate,
+		},
+	}, func() float64 { return 1 })
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setBuildVars sets the -ldflags variables for the duration of the test.
+func setBuildVars(t *testing.T, version, commit, commitDate, buildDate string) {
+	t.Helper()
+	prev := []string{Version, GitCommitHash, GitCommitDate, BuildDate}
+	t.Cleanup(func() { Version, GitCommitHash, GitCommitDate, BuildDate = prev[0], prev[1], prev[2], prev[3] })
+	Version, GitCommitHash, GitCommitDate, BuildDate = version, commit, commitDate, buildDate
+}
+
+func getVersion(t *testing.T) BuildInfo {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/api/v1/version", handleVersion)
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/version", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info BuildInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestHandleVersion(t *testing.T) {
+	setBuildVars(t, "v1.4.0", "3f9c2e1", "2026-10-01T12:00:00Z", "2026-10-02T08:30:00Z")
+
+	want := BuildInfo{Version: "v1.4.0", GitCommitHash: "3f9c2e1", GitCommitDate: "2026-10-01T12:00:00Z", BuildDate: "2026-10-02T08:30:00Z"}
+	if got := getVersion(t); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHandleVersion_DevFallback(t *testing.T) {
+	// An unset Docker build arg injects "".
+	setBuildVars(t, "", "", "", "")
+
+	want := BuildInfo{Version: "dev", GitCommitHash: "dev", GitCommitDate: "dev", BuildDate: "dev"}
+	if got := getVersion(t); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWeatherAPIURL is weather.api_url when it isn't set.
+	defaultWeatherAPIURL = "https://api.open-meteo.com"
+	// defaultWeatherInterval is weather.interval when it isn't set.
+	defaultWeatherInterval = 15 * time.Minute
+	// minWeatherInterval keeps the poller within Open-Meteo's fair use; the
+	// current conditions change every 15 minutes anyway.
+	minWeatherInterval = time.Minute
+	// weatherTimeout bounds one request to the API.
+	weatherTimeout = 10 * time.Second
+	// maxWeatherBackoff caps the wait between failed fetches, unless the
+	// interval is longer.
+	maxWeatherBackoff = time.Hour
+	// weatherStaleAfterFailures is how many fetches in a row must fail
+	// before the weather devices are marked stale.
+	weatherStaleAfterFailures = 3
+)
+
+// IDs of the weather devices.
+const (
+	weatherTemperatureID = "weather/outdoor_temperature"
+	weatherHumidityID    = "weather/outdoor_humidity"
+	weatherWindSpeedID   = "weather/wind_speed"
+)
+
+// WeatherConfig polls the current outdoor conditions from Open-Meteo into
+// the weather/outdoor_temperature, weather/outdoor_humidity and
+// weather/wind_speed devices.
+type WeatherConfig struct {
+	// Lat and Lon are where the weather is taken. Default
+	// spaceapi.location.
+	Lat *float64 `yaml:"lat"`
+	Lon *float64 `yaml:"lon"`
+	// Interval is a Go duration between fetches, at least a minute.
+	// Default "15m".
+	Interval string `yaml:"interval"`
+	// APIURL is the Open-Meteo base URL. Default "https://api.open-meteo.com".
+	APIURL string `yaml:"api_url"`
+}
+
+// coordinates are the configured ones, falling back to spaceapi.location.
+func (w *WeatherConfig) coordinates(cfg *Config) (lat, lon float64) {
+	return configCoordinates(cfg, w.Lat, w.Lon)
+}
+
+// configCoordinates returns lat and lon, or those of spaceapi.location where
+// they are nil.
+func configCoordinates(cfg *Config, lat, lon *float64) (float64, float64) {
+	la, lo := cfg.SpaceAPI.Location.Lat, cfg.SpaceAPI.Location.Lon
+	if lat != nil {
+		la = *lat
+	}
+	if lon != nil {
+		lo = *lon
+	}
+	return la, lo
+}
+
+// validateCoordinates checks that a section has a location of its own or
+// from spaceapi.location, within range.
+func validateCoordinates(cfg *Config, section string, lat, lon *float64, cfgPath string) error {
+	if (lat == nil || lon == nil) && cfg.SpaceAPI.Location.Lat == 0 && cfg.SpaceAPI.Location.Lon == 0 {
+		return fmt.Errorf("%s needs lat and lon, or spaceapi.location, in %s", section, cfgPath)
+	}
+	if la, lo := configCoordinates(cfg, lat, lon); la < -90 || la > 90 || lo < -180 || lo > 180 {
+		return fmt.Errorf("%s location %v, %v is out of range in %s", section, la, lo, cfgPath)
+	}
+	return nil
+}
+
+func (w *WeatherConfig) interval() time.Duration {
+	if d, err := time.ParseDuration(w.Interval); err == nil {
+		return d
+	}
+	return defaultWeatherInterval
+}
+
+// validateWeatherConfig fails fast on a weather poller without a location or
+// with a bad interval or URL.
+func validateWeatherConfig(cfg *Config, cfgPath string) error {
+	w := cfg.Weather
+	if w == nil {
+		return nil
+	}
+	if err := validateCoordinates(cfg, "weather", w.Lat, w.Lon, cfgPath); err != nil {
+		return err
+	}
+	if w.Interval != "" {
+		d, err := time.ParseDuration(w.Interval)
+		if err != nil {
+			return fmt.Errorf("weather.interval is not a valid duration (%q) in %s", w.Interval, cfgPath)
+		}
+		if d < minWeatherInterval {
+			return fmt.Errorf("weather.interval must be at least %s in %s", minWeatherInterval, cfgPath)
+		}
+	}
+	if w.APIURL != "" {
+		if u, err := url.Parse(w.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("weather.api_url is not an http(s) URL (%q) in %s", w.APIURL, cfgPath)
+		}
+	}
+	return nil
+}
+
+// openMeteoCurrent is the part of an Open-Meteo forecast response with the
+// current conditions. Missing values are nil.
+type openMeteoCurrent struct {
+	Current *struct {
+		Temperature *float64 `json:"temperature_2m"`
+		Humidity    *float64 `json:"relative_humidity_2m"`
+		WindSpeed   *float64 `json:"wind_speed_10m"`
+	} `json:"current"`
+}
+
+// WeatherService publishes the outdoor conditions as virtual devices.
+type WeatherService struct {
+	vdev     *VdevManager
+	client   *http.Client
+	url      string
+	interval time.Duration
+	log      *slog.Logger
+
+	// failures counts the fetches that failed in a row.
+	failures int
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewWeatherService registers the weather devices of cfg.Weather, which
+// must be set. Polling starts with Start.
+func NewWeatherService(cfg *Config, vdev *VdevManager, logger *slog.Logger) *WeatherService {
+	w := cfg.Weather
+	base := defaultWeatherAPIURL
+	if w.APIURL != "" {
+		base = strings.TrimRight(w.APIURL, "/")
+	}
+	lat, lon := w.coordinates(cfg)
+	query := url.Values{
+		"latitude":        {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"longitude":       {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"current":         {"temperature_2m,relative_humidity_2m,wind_speed_10m"},
+		"wind_speed_unit": {"ms"},
+	}
+	vdev.AddDevices([]*VirtualDevice{
+		{ID: weatherTemperatureID, Type: VdevTypeTemperature, ProhibitControl: true},
+		{ID: weatherHumidityID, Type: VdevTypeHumidity, ProhibitControl: true},
+		{ID: weatherWindSpeedID, Type: VdevTypeWindSpeed, ProhibitControl: true},
+	})
+	return &WeatherService{
+		vdev:     vdev,
+		client:   &http.Client{Timeout: weatherTimeout},
+		url:      base + "/v1/forecast?" + query.Encode(),
+		interval: w.interval(),
+		log:      logger,
+	}
+}
+
+// Start fetches the weather now and every interval until Stop, waiting
+// longer after failures.
+func (s *WeatherService) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel, s.done = cancel, make(chan struct{})
+	go func() {
+		defer close(s.done)
+		for {
+			wait := s.interval
+			if err := s.poll(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				wait = s.failed(err)
+			}
+			if !sleepCtx(ctx, wait) {
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends polling.
+func (s *WeatherService) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+// failed counts a failed fetch, marks the devices stale once enough failed
+// in a row, and returns the wait before the next fetch.
+func (s *WeatherService) failed(err error) time.Duration {
+	s.failures++
+	s.log.Warn("fetching weather failed", "failures", s.failures, "err", err)
+	if s.failures == weatherStaleAfterFailures {
+		s.vdev.MarkStale(weatherTemperatureID, weatherHumidityID, weatherWindSpeedID)
+	}
+	return weatherBackoff(s.interval, s.failures)
+}
+
+// weatherBackoff doubles the interval after each failed fetch in a row, up
+// to maxWeatherBackoff or the interval when that is longer.
+func weatherBackoff(interval time.Duration, failures int) time.Duration {
+	return min(interval<<min(failures, 16), max(interval, maxWeatherBackoff))
+}
+
+// poll fetches the current weather and updates the devices.
+func (s *WeatherService) poll(ctx context.Context) error {
+	current, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	s.failures = 0
+	s.vdev.ApplyUpdates([]*VirtualDeviceUpdate{
+		{Name: weatherTemperatureID, State: *current.Current.Temperature},
+		{Name: weatherHumidityID, State: *current.Current.Humidity},
+		{Name: weatherWindSpeedID, State: *current.Current.WindSpeed},
+	})
+	return nil
+}
+
+func (s *WeatherService) fetch(ctx context.Context) (*openMeteoCurrent, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open-meteo returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var current openMeteoCurrent
+	if err := json.Unmarshal(body, &current); err != nil {
+		return nil, fmt.Errorf("decoding open-meteo response: %w", err)
+	}
+	c := current.Current
+	if c == nil || c.Temperature == nil || c.Humidity == nil || c.WindSpeed == nil {
+		return nil, errors.New("open-meteo response lacks current temperature, humidity or wind speed")
+	}
+	return &current, nil
+}
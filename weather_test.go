@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWeatherService_Poll(t *testing.T) {
+	body := `{"latitude":50.06,"longitude":19.94,"current_units":{"wind_speed_10m":"m/s"},` +
+		`"current":{"time":"2026-10-15T12:00","interval":900,"temperature_2m":11.4,"relative_humidity_2m":82,"wind_speed_10m":3.1}}`
+	status := http.StatusOK
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Encode()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Weather: &WeatherConfig{APIURL: srv.URL + "/"}}
+	cfg.SpaceAPI.Location.Lat, cfg.SpaceAPI.Location.Lon = 50.0647, 19.945
+	vm := NewVdevManager()
+	s := NewWeatherService(cfg, vm, testLogger)
+	if s.interval != defaultWeatherInterval {
+		t.Errorf("interval = %s", s.interval)
+	}
+
+	if err := s.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"latitude=50.0647", "longitude=19.945", "wind_speed_unit=ms"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query %q lacks %s", query, want)
+		}
+	}
+	for id, want := range map[string]any{weatherTemperatureID: 11.4, weatherHumidityID: 82.0, weatherWindSpeedID: 3.1} {
+		dev := vm.Device(id)
+		if dev == nil || dev.State != want || !dev.Fresh || !dev.ProhibitControl {
+			t.Errorf("%s = %+v, want fresh %v", id, dev, want)
+		}
+	}
+
+	// A malformed response leaves the last reading, until enough fetches
+	// failed in a row to call it stale.
+	for _, bad := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, `{"current":{"temperature_2m":"warm"}}`},
+		{http.StatusOK, `{"current":{"temperature_2m":12}}`},
+		{http.StatusBadGateway, `upstream down`},
+	} {
+		status, body = bad.status, bad.body
+		err := s.poll(context.Background())
+		if err == nil {
+			t.Fatalf("polling %d %s succeeded", bad.status, bad.body)
+		}
+		s.failed(err)
+		if dev := vm.Device(weatherTemperatureID); dev.State != 11.4 || dev.Fresh != (s.failures < weatherStaleAfterFailures) {
+			t.Errorf("after %d failures temperature %+v", s.failures, dev)
+		}
+	}
+}
+
+func TestWeatherBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{15 * time.Minute, 1, 30 * time.Minute},
+		{15 * time.Minute, 2, time.Hour},
+		{15 * time.Minute, 40, time.Hour},
+		{2 * time.Hour, 3, 2 * time.Hour},
+	} {
+		if got := weatherBackoff(tc.interval, tc.failures); got != tc.want {
+			t.Errorf("weatherBackoff(%s, %d) = %s, want %s", tc.interval, tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestValidateWeatherConfig(t *testing.T) {
+	withLocation := func(w *WeatherConfig) *Config {
+		cfg := &Config{Weather: w}
+		cfg.SpaceAPI.Location.Lat, cfg.SpaceAPI.Location.Lon = 50.06, 19.94
+		return cfg
+	}
+	for name, tc := range map[string]struct {
+		cfg  *Config
+		want string
+	}{
+		"spaceapi location": {withLocation(&WeatherConfig{Interval: "10m"}), ""},
+		"own location":      {&Config{Weather: &WeatherConfig{Lat: float64Ptr(52.2), Lon: float64Ptr(21)}}, ""},
+		"no location":       {&Config{Weather: &WeatherConfig{Lat: float64Ptr(52.2)}}, "weather needs lat and lon"},
+		"out of range":      {withLocation(&WeatherConfig{Lat: float64Ptr(95)}), "out of range"},
+		"short interval":    {withLocation(&WeatherConfig{Interval: "10s"}), "at least 1m0s"},
+		"bad interval":      {withLocation(&WeatherConfig{Interval: "often"}), "not a valid duration"},
+		"bad url":           {withLocation(&WeatherConfig{APIURL: "ftp://example.com"}), "not an http(s) URL"},
+	} {
+		err := validateWeatherConfig(tc.cfg, "at2.yaml")
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", name, err, tc.want)
+		}
+	}
+}